@@ -94,18 +94,36 @@ func nsqdFlagSet(opts *nsqd.Options) *flag.FlagSet {
 	flagSet.String("reverse-proxy-port", opts.ReverseProxyPort, "<port> for reverse proxy port")
 	authHTTPAddresses := app.StringArray{}
 	flagSet.Var(&authHTTPAddresses, "auth-http-address", "<addr>:<port> to query auth server (may be given multiple times)")
+	flagSet.Duration("auth-cache-ttl", opts.AuthCacheTTL, "duration to cache the auth state of the same client secret (disabled if 0)")
+	flagSet.Int("auth-cache-max-size", opts.AuthCacheMaxSize, "maximum number of the auth states cached")
 	flagSet.String("broadcast-address", opts.BroadcastAddress, "address that will be registered with lookupd (defaults to the OS hostname)")
 	flagSet.String("broadcast-interface", opts.BroadcastInterface, "address that will be registered with lookupd (defaults to the OS hostname)")
 	lookupdTCPAddrs := app.StringArray{}
 	flagSet.Var(&lookupdTCPAddrs, "lookupd-tcp-address", "lookupd TCP address (may be given multiple times)")
 	flagSet.String("lookup-ping-interval", opts.LookupPingInterval.String(), "duration between ping to nsqlookup")
+	flagSet.Duration("exit-timeout", opts.ExitTimeout, "duration to wait the background tasks while exiting, wait forever if 0, the data path is kept locked until they exit")
+	flagSet.Bool("allow-duplicate-worker-id", opts.AllowDuplicateWorkerID, "start even if the worker-id is used by another live node in the cluster")
+	flagSet.Bool("disable-lookupd", opts.DisableLookupd, "disable all the lookupd interactions to run standalone")
 
 	// diskqueue options
 	flagSet.String("data-path", opts.DataPath, "path to store disk-backed messages")
+	flagSet.Bool("data-path-per-worker", opts.DataPathPerWorker, "use the sub directory of data-path for each worker-id, so multi instances can share the data-path")
 	flagSet.Int64("mem-queue-size", opts.MemQueueSize, "number of messages to keep in memory (per topic/channel)")
 	flagSet.Int64("max-bytes-per-file", opts.MaxBytesPerFile, "number of bytes per diskqueue file before rolling")
 	flagSet.Int64("sync-every", opts.SyncEvery, "number of messages per diskqueue fsync")
 	flagSet.Duration("sync-timeout", opts.SyncTimeout, "duration of time per diskqueue fsync")
+	flagSet.String("cold-data-path", opts.ColdDataPath, "path to move the consumed old data files (disabled if empty)")
+	flagSet.Duration("cold-data-age", opts.ColdDataAge, "the data files older than this will be moved to the cold data path")
+	flagSet.Duration("meta-sync-batch-window", opts.MetaSyncBatchWindow, "duration to batch the channel meta syncs of the same topic with a single directory fsync (disabled if 0)")
+	flagSet.String("metadata-format", opts.MetadataFormat, "format of the nsqd metadata file (json, gob), the old format file can still be loaded")
+	flagSet.String("queue-file-name-pattern", opts.QueueFileNamePattern, "naming pattern of the data files, should have %s for the queue name followed by %06d for the file number (default \"%s.diskqueue.%06d.dat\")")
+	flagSet.String("reader-meta-name-pattern", opts.ReaderMetaNamePattern, "naming pattern of the channel meta files, should have %s for the channel name (default \"%s.diskqueue.meta.v2.reader.dat\")")
+	flagSet.Bool("rebuild-offset-meta", opts.RebuildOffsetMeta, "rebuild the missing offset meta of the data files by scanning them on first access")
+	flagSet.Bool("check-files-on-start", opts.CheckFilesOnStart, "check the data files are contiguous while loading the topics and refuse to load the topic if not")
+	flagSet.Bool("repair-on-start", opts.RepairOnStart, "quarantine the overlapped data files found while loading the topics instead of refusing to load")
+	flagSet.Duration("scrub-interval", opts.ScrubInterval, "duration to verify a consumed but retained data file by the checksum saved while finished (disabled if 0)")
+	flagSet.Int64("queue-file-shard-size", opts.QueueFileShardSize, "number of the data files in each sharded sub directory, the legacy files in the data path can still be read (disabled if 0)")
+	flagSet.Bool("external-confirm-store", opts.ExternalConfirmStore, "save the channel confirmed offsets to the cluster leadership store, and recover them from it while the channel loaded")
 
 	// msg and command options
 	flagSet.String("msg-timeout", opts.MsgTimeout.String(), "duration to wait before auto-requeing a message")
@@ -123,6 +141,21 @@ func nsqdFlagSet(opts *nsqd.Options) *flag.FlagSet {
 	flagSet.Int64("max-output-buffer-size", opts.MaxOutputBufferSize, "maximum client configurable size (in bytes) for a client output buffer")
 	flagSet.Duration("max-output-buffer-timeout", opts.MaxOutputBufferTimeout, "maximum client configurable duration of time between flushing to a client")
 	flagSet.Int64("max-confirm-win", opts.MaxConfirmWin, "maximum confirm window (in bytes)")
+	flagSet.Int64("max-inflight-msgs", opts.MaxInFlightMsgs, "maximum messages read but not confirmed for each channel (disabled if 0)")
+	flagSet.Bool("clamp-over-confirm", opts.ClampOverConfirm, "clamp the channel confirm exceed the read position with warning instead of rejecting it")
+	flagSet.Bool("strict-confirm", opts.StrictConfirm, "reject the channel confirm not after the confirmed offset as regression instead of ignoring it")
+	flagSet.Bool("parse-msg-header", opts.ParseMsgHeader, "parse the message header while the channel reads the disk queue")
+	flagSet.Bool("confirm-boundary-check", opts.ConfirmBoundary, "reject the channel confirm not at the message boundary, which is verified by reading the data if not tracked")
+	flagSet.Duration("confirm-win-breaker-timeout", opts.ConfirmWinBreakerTimeout, "duration of the channel confirm window saturated before the channel is alarmed (disabled if 0)")
+	flagSet.Bool("adaptive-read-pacing", opts.AdaptiveReadPacing, "pace the channel reads by the confirm latency while the confirm window is filling up")
+	flagSet.String("corruption-policy", opts.CorruptionPolicy, "policy to handle the corrupt data of the channel: skip-file, skip-to-end or halt (default \"skip-file\")")
+	flagSet.String("corrupt-quarantine-path", opts.CorruptQuarantinePath, "path to keep the copy of the corrupt data files skipped by the channels (disabled if empty)")
+	flagSet.String("end-divergence-policy", opts.EndDivergencePolicy, "policy to handle the channel read past the topic end moved backward: clamp or halt (default \"clamp\")")
+	flagSet.Int("max-cached-read-files", opts.MaxCachedReadFiles, "maximum idle data file handles cached for the random-access reads of all the channels (disabled if 0)")
+	flagSet.Duration("confirm-deadline", opts.ConfirmDeadline, "duration for the channel to confirm each message delivered before it is redelivered by rewinding the read (disabled if 0)")
+	flagSet.Int("confirm-deadline-max-redeliver", opts.ConfirmDeadlineMaxRedeliver, "maximum times of the message redelivered by the confirm deadline")
+	flagSet.Int64("pub-rate-limit", opts.PubRateLimit, "maximum messages published to each topic per second (disabled if 0)")
+	flagSet.Int64("pub-bytes-rate-limit", opts.PubBytesRateLimit, "maximum bytes published to each topic per second (disabled if 0)")
 
 	// statsd integration options
 	flagSet.String("statsd-address", opts.StatsdAddress, " <addr>:<port> of a statsd daemon for pushing stats")
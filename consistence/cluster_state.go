@@ -0,0 +1,116 @@
+package consistence
+
+import (
+	"sort"
+)
+
+// ClusterPartitionState is the replica info and the leader session of the topic partition,
+// the leader session is nil if no leader acquired the partition.
+type ClusterPartitionState struct {
+	Partition int
+	TopicPartitionReplicaInfo
+	LeaderSession *TopicLeaderSession
+}
+
+// ClusterTopicState is the meta of the topic with all the partitions, the placement is nil
+// if the topic is not placed.
+type ClusterTopicState struct {
+	Name string
+	TopicMetaInfo
+	Partitions []ClusterPartitionState
+	Placement  map[int][]string
+}
+
+// ClusterState is the snapshot of the coordinated cluster view, the nodes and the topics are
+// sorted by the id and the name.
+type ClusterState struct {
+	ClusterID    string
+	Epoch        EpochType
+	LookupdNodes []NsqLookupdNodeInfo
+	NsqdNodes    []NsqdNodeInfo
+	Topics       []ClusterTopicState
+}
+
+type lookupdNodesByID []NsqLookupdNodeInfo
+
+func (s lookupdNodesByID) Len() int           { return len(s) }
+func (s lookupdNodesByID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s lookupdNodesByID) Less(i, j int) bool { return s[i].ID < s[j].ID }
+
+type nsqdNodesByID []NsqdNodeInfo
+
+func (s nsqdNodesByID) Len() int           { return len(s) }
+func (s nsqdNodesByID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s nsqdNodesByID) Less(i, j int) bool { return s[i].ID < s[j].ID }
+
+type partitionStatesByID []ClusterPartitionState
+
+func (s partitionStatesByID) Len() int           { return len(s) }
+func (s partitionStatesByID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s partitionStatesByID) Less(i, j int) bool { return s[i].Partition < s[j].Partition }
+
+type topicStatesByName []ClusterTopicState
+
+func (s topicStatesByName) Len() int           { return len(s) }
+func (s topicStatesByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s topicStatesByName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+
+func isClusterKeyMissing(err error) bool {
+	return err == ErrKeyNotFound || err == ErrLeaderSessionNotExist
+}
+
+// DumpClusterState reads the registered nodes, the topics with the leader of each partition
+// and the topic placements from the leadership without changing anything. The missing keys
+// are left empty in the snapshot, and the other errors are returned.
+func (self *NsqLookupCoordinator) DumpClusterState() (ClusterState, error) {
+	state := ClusterState{ClusterID: self.clusterKey}
+	var err error
+	state.Epoch, err = self.leadership.GetClusterEpoch()
+	if err != nil && !isClusterKeyMissing(err) {
+		return state, err
+	}
+	state.LookupdNodes, err = self.leadership.GetAllLookupdNodes()
+	if err != nil && !isClusterKeyMissing(err) {
+		return state, err
+	}
+	sort.Sort(lookupdNodesByID(state.LookupdNodes))
+	state.NsqdNodes, err = self.leadership.GetNsqdNodes()
+	if err != nil && !isClusterKeyMissing(err) {
+		return state, err
+	}
+	sort.Sort(nsqdNodesByID(state.NsqdNodes))
+
+	partitions, err := self.leadership.ScanTopics()
+	if err != nil && !isClusterKeyMissing(err) {
+		return state, err
+	}
+	topics := make(map[string]*ClusterTopicState)
+	for _, p := range partitions {
+		t, ok := topics[p.Name]
+		if !ok {
+			t = &ClusterTopicState{Name: p.Name, TopicMetaInfo: p.TopicMetaInfo}
+			topics[p.Name] = t
+		}
+		ps := ClusterPartitionState{Partition: p.Partition, TopicPartitionReplicaInfo: p.TopicPartitionReplicaInfo}
+		session, err := self.leadership.GetTopicLeaderSession(p.Name, p.Partition)
+		if err == nil {
+			s := *session
+			ps.LeaderSession = &s
+		} else if !isClusterKeyMissing(err) {
+			return state, err
+		}
+		t.Partitions = append(t.Partitions, ps)
+	}
+	for name, t := range topics {
+		sort.Sort(partitionStatesByID(t.Partitions))
+		placement, err := self.leadership.GetTopicPlacement(name)
+		if err == nil {
+			t.Placement = placement
+		} else if !isClusterKeyMissing(err) {
+			return state, err
+		}
+		state.Topics = append(state.Topics, *t)
+	}
+	sort.Sort(topicStatesByName(state.Topics))
+	return state, nil
+}
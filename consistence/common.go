@@ -190,6 +190,8 @@ var (
 	ErrLocalChannelPauseFailed             = NewCoordErr("local channel pause/unpause failed", CoordLocalErr)
 	ErrLocalChannelSkipFailed              = NewCoordErr("local channel skip/unskip failed", CoordLocalErr)
 	ErrLocalDelayedQueueMissing            = NewCoordErr("local delayed queue is missing", CoordLocalErr)
+	ErrLocalInitChannelFailed              = NewCoordErr("local channel init failed", CoordLocalErr)
+	ErrLocalTopicNoDiskQueue               = NewCoordErr("local topic has no disk queue", CoordLocalErr)
 )
 
 func GenNsqdNodeID(n *NsqdNodeInfo, extra string) string {
@@ -222,6 +224,11 @@ func ExtractRpcAddrFromID(nid string) string {
 	return nid[:pos1+pos2+1]
 }
 
+// the worker id is the extra part at the end of the nsqd node id
+func ExtractWorkerIDFromID(nid string) string {
+	return nid[strings.LastIndex(nid, ":")+1:]
+}
+
 func FindSlice(in []string, e string) int {
 	for i, v := range in {
 		if v == e {
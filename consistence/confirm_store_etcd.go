@@ -0,0 +1,61 @@
+package consistence
+
+import (
+	"encoding/json"
+	"path"
+	"strconv"
+
+	etcdlock "github.com/absolute8511/xlock2"
+	"github.com/coreos/etcd/client"
+	"github.com/youzan/nsq/nsqd"
+)
+
+type ChannelConfirmInfo struct {
+	Offset int64 `json:"offset"`
+	Cnt    int64 `json:"cnt"`
+}
+
+// EtcdConfirmStore saves the channel confirmed offsets in the cluster leadership etcd, it is
+// separated from the topic dir, so the topic watchers are not notified while the offsets saved.
+type EtcdConfirmStore struct {
+	client    *etcdlock.EtcdClient
+	clusterID string
+}
+
+func NewEtcdConfirmStore(host string, clusterID string) *EtcdConfirmStore {
+	return &EtcdConfirmStore{
+		client:    etcdlock.NewEClient(host),
+		clusterID: clusterID,
+	}
+}
+
+func (self *EtcdConfirmStore) LoadConfirmed(topic string, channel string, partition int) (nsqd.BackendOffset, int64, error) {
+	rsp, err := self.client.Get(self.createChannelConfirmPath(topic, channel, partition), false, false)
+	if err != nil {
+		if client.IsKeyNotFound(err) {
+			return 0, 0, nsqd.ErrConfirmNotStored
+		}
+		return 0, 0, err
+	}
+	var info ChannelConfirmInfo
+	err = json.Unmarshal([]byte(rsp.Node.Value), &info)
+	if err != nil {
+		return 0, 0, err
+	}
+	return nsqd.BackendOffset(info.Offset), info.Cnt, nil
+}
+
+func (self *EtcdConfirmStore) SaveConfirmed(topic string, channel string, partition int,
+	offset nsqd.BackendOffset, cnt int64) error {
+	value, err := json.Marshal(&ChannelConfirmInfo{Offset: int64(offset), Cnt: cnt})
+	if err != nil {
+		return err
+	}
+	_, err = self.client.Set(self.createChannelConfirmPath(topic, channel, partition), string(value), 0)
+	return err
+}
+
+func (self *EtcdConfirmStore) createChannelConfirmPath(topic string, channel string, partition int) string {
+	return path.Join("/", NSQ_ROOT_DIR, self.clusterID, NSQ_CHANNEL_CONFIRM_DIR, topic,
+		strconv.Itoa(partition), channel)
+}
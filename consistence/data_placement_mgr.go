@@ -58,6 +58,7 @@ var (
 	ErrBalanceNodeUnavailable     = errors.New("can not find a node to be balanced")
 	ErrNodeIsExcludedForTopicData = errors.New("destination node is excluded for topic")
 	ErrClusterBalanceRunning      = errors.New("another balance is running, should wait")
+	ErrPlacementNodeNotEnough     = errors.New("nodes is less than the replica for the topic placement")
 )
 
 const (
@@ -1728,9 +1729,23 @@ func (self *DataPlacement) getRebalancedOrderedTopicPartitions(
 func (self *DataPlacement) getRebalancedOrderedTopicPartitionsFromNameList(
 	partitionNum int, replica int,
 	nodeNameList SortableStrings) ([][]string, *CoordErr) {
-	if len(nodeNameList) < replica {
+	partitionNodes, err := AssignPartitions(partitionNum, replica, nodeNameList)
+	if err != nil {
 		return nil, ErrNodeUnavailable
 	}
+	return partitionNodes, nil
+}
+
+// AssignPartitions returns the nodes for each partition, the first node is the leader.
+// The nodes are sorted by id and each partition starts from the next node of the previous
+// one, so the same nodes always get the same placement and the leaders and followers are
+// spread evenly across the nodes.
+func AssignPartitions(partitionNum int, replica int, nodes []string) ([][]string, error) {
+	if replica <= 0 || len(nodes) < replica {
+		return nil, ErrPlacementNodeNotEnough
+	}
+	nodeNameList := make(SortableStrings, len(nodes))
+	copy(nodeNameList, nodes)
 	sort.Sort(nodeNameList)
 	partitionNodes := make([][]string, partitionNum)
 	selectIndex := 0
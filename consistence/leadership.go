@@ -10,6 +10,7 @@ var (
 	ErrLeaderSessionNotExist     = errors.New("session not exist")
 	ErrKeyAlreadyExist           = errors.New("Key already exist")
 	ErrKeyNotFound               = errors.New("Key not found")
+	ErrDuplicateWorkerID         = errors.New("worker id is already used by another node")
 )
 
 type EpochType int64
@@ -59,6 +60,13 @@ type TopicMetaInfo struct {
 	OrderedMulti bool
 	//used for message ext
 	Ext bool
+	// the pub rate limits in messages and bytes per second, the node options are used if 0
+	PubRateLimit      int64
+	PubBytesRateLimit int64
+	// the max message size of the pub, the node option is used if 0 or larger
+	MaxMsgSize int64
+	// the queue backing of the topic, disk if empty
+	Backing string
 }
 
 type TopicPartitionReplicaInfo struct {
@@ -164,6 +172,11 @@ type NSQLookupdLeadership interface {
 	ReleaseTopicLeader(topic string, partition int, session *TopicLeaderSession) error
 	// get topic meta info map with passin topics slice
 	GetTopicsMetaInfoMap(topics []string) (map[string]*TopicMetaInfo, error)
+	// write the nodes placed for each partition of the topic, the placement is kept
+	// out of the topic path so it can be written before the topic created.
+	UpdateTopicPlacement(topic string, placement map[int][]string) error
+	// if no placement for the topic should return ErrKeyNotFound as error
+	GetTopicPlacement(topic string) (map[int][]string, error)
 }
 
 type NSQDLeadership interface {
@@ -177,6 +190,8 @@ type NSQDLeadership interface {
 	ReleaseTopicLeader(topic string, partition int, session *TopicLeaderSession) error
 	// all registered lookup nodes.
 	GetAllLookupdNodes() ([]NsqLookupdNodeInfo, error)
+	// all registered nsqd nodes.
+	GetAllNsqdNodes() ([]NsqdNodeInfo, error)
 	// get the newest lookup leader and watch the change of it.
 	WatchLookupdLeader(leader chan *NsqLookupdNodeInfo, stop chan struct{}) error
 	GetTopicInfo(topic string, partition int) (*TopicPartitionMetaInfo, error)
@@ -882,6 +882,31 @@ func (self *NsqLookupdEtcdMgr) watchTopicLeaderSession(watchTopicLeaderInfo *Wat
 	}
 }
 
+func (self *NsqLookupdEtcdMgr) UpdateTopicPlacement(topic string, placement map[int][]string) error {
+	value, err := json.Marshal(placement)
+	if err != nil {
+		return err
+	}
+	_, err = self.client.Set(self.createTopicPlacementPath(topic), string(value), 0)
+	return err
+}
+
+func (self *NsqLookupdEtcdMgr) GetTopicPlacement(topic string) (map[int][]string, error) {
+	rsp, err := self.client.Get(self.createTopicPlacementPath(topic), false, false)
+	if err != nil {
+		if client.IsKeyNotFound(err) {
+			return nil, ErrKeyNotFound
+		}
+		return nil, err
+	}
+	var placement map[int][]string
+	err = json.Unmarshal([]byte(rsp.Node.Value), &placement)
+	if err != nil {
+		return nil, err
+	}
+	return placement, nil
+}
+
 func (self *NsqLookupdEtcdMgr) createClusterPath() string {
 	return path.Join("/", NSQ_ROOT_DIR, self.clusterID)
 }
@@ -906,6 +931,10 @@ func (self *NsqLookupdEtcdMgr) createTopicRootPath() string {
 	return path.Join("/", NSQ_ROOT_DIR, self.clusterID, NSQ_TOPIC_DIR)
 }
 
+func (self *NsqLookupdEtcdMgr) createTopicPlacementPath(topic string) string {
+	return path.Join("/", NSQ_ROOT_DIR, self.clusterID, NSQ_TOPIC_PLACEMENT_DIR, topic)
+}
+
 func (self *NsqLookupdEtcdMgr) createTopicPath(topic string) string {
 	return path.Join(self.topicRoot, topic)
 }
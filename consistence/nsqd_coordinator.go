@@ -147,6 +147,7 @@ type NsqdCoordinator struct {
 	enableBenchCost        bool
 	stopping               int32
 	catchupRunning         int32
+	allowDuplicateWorkerID bool
 }
 
 func NewNsqdCoordinator(cluster, ip, tcpport, rpcport, httpport, extraID string, rootPath string, nsqd *nsqd.NSQD) *NsqdCoordinator {
@@ -184,6 +185,37 @@ func (self *NsqdCoordinator) GetMyID() string {
 	return self.myNode.GetID()
 }
 
+// SetAllowDuplicateWorkerID allows the node to start with the worker id used by another
+// live node, it should only be used while the other node is known to be down.
+func (self *NsqdCoordinator) SetAllowDuplicateWorkerID(allow bool) {
+	self.allowDuplicateWorkerID = allow
+}
+
+// check whether the worker id is used by another live node in the cluster, the worker id
+// is used for the message id and the data file naming, so it should be unique.
+func (self *NsqdCoordinator) checkDuplicateWorkerID() error {
+	nodes, err := self.leadership.GetAllNsqdNodes()
+	if err != nil {
+		if err != ErrKeyNotFound {
+			coordLog.Warningf("failed to get the nsqd nodes for checking the worker id: %v", err)
+		}
+		return nil
+	}
+	myID := self.myNode.GetID()
+	workerID := ExtractWorkerIDFromID(myID)
+	for _, n := range nodes {
+		if n.GetID() == myID {
+			continue
+		}
+		if ExtractWorkerIDFromID(n.GetID()) == workerID {
+			coordLog.Errorf("the worker id %v of node %v is already used by the live node %v",
+				workerID, myID, n.GetID())
+			return ErrDuplicateWorkerID
+		}
+	}
+	return nil
+}
+
 func (self *NsqdCoordinator) SetLeadershipMgr(l NSQDLeadership) {
 	self.leadership = l
 	if self.leadership != nil {
@@ -232,6 +264,16 @@ func (self *NsqdCoordinator) Start() error {
 			panic("no lookupd found while starting nsqd coordinator")
 		}
 	}
+	if self.leadership != nil {
+		err := self.checkDuplicateWorkerID()
+		if err != nil {
+			if !self.allowDuplicateWorkerID {
+				close(self.stopChan)
+				return err
+			}
+			coordLog.Warningf("start with the duplicate worker id since it is allowed")
+		}
+	}
 
 	err := self.loadLocalTopicData()
 	if err != nil {
@@ -701,10 +743,13 @@ func (self *NsqdCoordinator) loadLocalTopicData() error {
 				panic(err)
 			}
 			dyConf := &nsqd.TopicDynamicConf{SyncEvery: int64(topicInfo.SyncEvery),
-				AutoCommit:   0,
-				RetentionDay: topicInfo.RetentionDay,
-				OrderedMulti: topicInfo.OrderedMulti,
-				Ext:          topicInfo.Ext,
+				AutoCommit:        0,
+				RetentionDay:      topicInfo.RetentionDay,
+				OrderedMulti:      topicInfo.OrderedMulti,
+				Ext:               topicInfo.Ext,
+				PubRateLimit:      topicInfo.PubRateLimit,
+				PubBytesRateLimit: topicInfo.PubBytesRateLimit,
+				MaxMsgSize:        topicInfo.MaxMsgSize,
 			}
 			tc.GetData().updateBufferSize(int(dyConf.SyncEvery - 1))
 			maybeInitDelayedQ(tc.GetData(), topic)
@@ -839,6 +884,10 @@ func checkAndFixLocalLogQueueData(tc *coordData,
 	endFixErr := checkAndFixLocalLogQueueEnd(tc, localLogQ, logMgr, true, forceFix)
 
 	snap := localLogQ.GetDiskQueueSnapshot()
+	if snap == nil {
+		// the memory queue has no data to check
+		return nil
+	}
 	for {
 		err = snap.SeekTo(nsqd.BackendOffset(log.MsgOffset))
 		if err != nil {
@@ -1079,6 +1128,9 @@ func (self *NsqdCoordinator) SearchLogByMsgOffset(topic string, part int, offset
 			return l, 0, 0, localErr
 		}
 		snap := t.GetDiskQueueSnapshot()
+		if snap == nil {
+			return l, 0, 0, nsqd.ErrTopicNoDiskQueue
+		}
 		localErr = snap.SeekTo(nsqd.BackendOffset(realOffset))
 		if localErr != nil {
 			coordLog.Infof("seek to disk queue error: %v, %v", localErr, realOffset)
@@ -1123,6 +1175,9 @@ func (self *NsqdCoordinator) SearchLogByMsgCnt(topic string, part int, count int
 			return l, 0, 0, localErr
 		}
 		snap := t.GetDiskQueueSnapshot()
+		if snap == nil {
+			return l, 0, 0, nsqd.ErrTopicNoDiskQueue
+		}
 		localErr = snap.SeekTo(nsqd.BackendOffset(realOffset))
 		if localErr != nil {
 			coordLog.Infof("seek to disk queue error: %v, %v", localErr, realOffset)
@@ -1217,6 +1272,9 @@ func (self *NsqdCoordinator) SearchLogByMsgTimestamp(topic string, part int, ts_
 	}
 
 	snap := t.GetDiskQueueSnapshot()
+	if snap == nil {
+		return nil, 0, 0, nsqd.ErrTopicNoDiskQueue
+	}
 	comp := &MsgTimestampComparator{
 		localTopicReader: snap,
 		searchEnd:        tcData.logMgr.GetCurrentStart(),
@@ -1743,10 +1801,13 @@ func (self *NsqdCoordinator) catchupFromLeader(topicInfo TopicPartitionMetaInfo,
 	}
 
 	dyConf := &nsqd.TopicDynamicConf{SyncEvery: int64(topicInfo.SyncEvery),
-		AutoCommit:   0,
-		RetentionDay: topicInfo.RetentionDay,
-		OrderedMulti: topicInfo.OrderedMulti,
-		Ext:          topicInfo.Ext,
+		AutoCommit:        0,
+		RetentionDay:      topicInfo.RetentionDay,
+		OrderedMulti:      topicInfo.OrderedMulti,
+		Ext:               topicInfo.Ext,
+		PubRateLimit:      topicInfo.PubRateLimit,
+		PubBytesRateLimit: topicInfo.PubBytesRateLimit,
+		MaxMsgSize:        topicInfo.MaxMsgSize,
 	}
 	tc.GetData().updateBufferSize(int(dyConf.SyncEvery - 1))
 	localTopic.SetDynamicInfo(*dyConf, tc.GetData().logMgr)
@@ -1810,7 +1871,11 @@ func (self *NsqdCoordinator) catchupFromLeader(topicInfo TopicPartitionMetaInfo,
 
 				oldChList := localTopic.GetChannelMapCopy()
 				for _, chName := range chList {
-					ch := localTopic.GetChannel(chName)
+					ch, err := localTopic.GetOrCreateChannel(chName)
+					if err != nil {
+						coordLog.Warningf("topic %v failed to init the channel %v: %v", topicInfo.GetTopicDesp(), chName, err)
+						continue
+					}
 					if meta, ok := metaMaps[chName]; ok {
 						if meta.Paused {
 							ch.Pause()
@@ -1818,6 +1883,9 @@ func (self *NsqdCoordinator) catchupFromLeader(topicInfo TopicPartitionMetaInfo,
 						if meta.Skipped {
 							ch.Skip()
 						}
+						ch.SetDeadLetterPolicy(meta.DeadLetterTopic, meta.DeadLetterAttempts)
+						ch.SetRewindRetention(meta.RewindRetention)
+						ch.SetRetentionSeconds(meta.RetentionSeconds)
 					}
 					delete(oldChList, chName)
 				}
@@ -2073,7 +2141,12 @@ func (self *NsqdCoordinator) switchStateForMaster(topicCoord *TopicCoordinator,
 		ch, localErr := localTopic.GetExistingChannel(chName)
 		if localErr != nil {
 			offset.AllowBackward = true
-			ch = localTopic.GetChannel(chName)
+			ch, localErr = localTopic.GetOrCreateChannel(chName)
+			if localErr != nil {
+				coordLog.Warningf("slave init the channel %v, %v failed: %v",
+					tcData.topicInfo.GetTopicDesp(), chName, localErr)
+				continue
+			}
 			coordLog.Infof("slave init the channel : %v, %v, offset: %v",
 				tcData.topicInfo.GetTopicDesp(), chName, ch.GetConfirmed())
 		}
@@ -2135,10 +2208,13 @@ func (self *NsqdCoordinator) updateTopicLeaderSession(topicCoord *TopicCoordinat
 		return ErrLocalMissingTopic
 	}
 	dyConf := &nsqd.TopicDynamicConf{SyncEvery: int64(tcData.topicInfo.SyncEvery),
-		AutoCommit:   0,
-		RetentionDay: tcData.topicInfo.RetentionDay,
-		OrderedMulti: tcData.topicInfo.OrderedMulti,
-		Ext:          tcData.topicInfo.Ext,
+		AutoCommit:        0,
+		RetentionDay:      tcData.topicInfo.RetentionDay,
+		OrderedMulti:      tcData.topicInfo.OrderedMulti,
+		Ext:               tcData.topicInfo.Ext,
+		PubRateLimit:      tcData.topicInfo.PubRateLimit,
+		PubBytesRateLimit: tcData.topicInfo.PubBytesRateLimit,
+		MaxMsgSize:        tcData.topicInfo.MaxMsgSize,
 	}
 	tcData.updateBufferSize(int(dyConf.SyncEvery - 1))
 	localTopic.SetDynamicInfo(*dyConf, tcData.logMgr)
@@ -2336,6 +2412,9 @@ func (self *NsqdCoordinator) readTopicRawData(topic string, partition int, offse
 		}
 		snap = dq.GetDiskQueueSnapshot()
 	}
+	if snap == nil {
+		return nil, ErrLocalTopicNoDiskQueue
+	}
 	for i, offset := range offsetList {
 		size := sizeList[i]
 		err = snap.SeekTo(nsqd.BackendOffset(offset))
@@ -2367,8 +2446,9 @@ func (self *NsqdCoordinator) notifyFlushData(topic string, partition int) {
 
 func (self *NsqdCoordinator) updateLocalTopic(topicInfo *TopicPartitionMetaInfo, tcData *coordData) (*nsqd.Topic, *CoordErr) {
 	// check topic exist and prepare on local.
-	t := self.localNsqd.GetTopicWithDisabled(topicInfo.Name, topicInfo.Partition, topicInfo.Ext)
-	if t == nil {
+	t, err := self.localNsqd.GetTopicWithBackingDisabled(topicInfo.Name, topicInfo.Partition, topicInfo.Ext, topicInfo.Backing)
+	if err != nil {
+		coordLog.Errorf("topic %v init local failed: %v", topicInfo.GetTopicDesp(), err)
 		return nil, ErrLocalInitTopicFailed
 	}
 	localErr := self.localNsqd.SetTopicMagicCode(t, topicInfo.MagicCode)
@@ -2376,10 +2456,13 @@ func (self *NsqdCoordinator) updateLocalTopic(topicInfo *TopicPartitionMetaInfo,
 		return t, ErrLocalInitTopicFailed
 	}
 	dyConf := &nsqd.TopicDynamicConf{SyncEvery: int64(topicInfo.SyncEvery),
-		AutoCommit:   0,
-		RetentionDay: topicInfo.RetentionDay,
-		OrderedMulti: topicInfo.OrderedMulti,
-		Ext:          topicInfo.Ext,
+		AutoCommit:        0,
+		RetentionDay:      topicInfo.RetentionDay,
+		OrderedMulti:      topicInfo.OrderedMulti,
+		Ext:               topicInfo.Ext,
+		PubRateLimit:      topicInfo.PubRateLimit,
+		PubBytesRateLimit: topicInfo.PubBytesRateLimit,
+		MaxMsgSize:        topicInfo.MaxMsgSize,
 	}
 	tcData.updateBufferSize(int(dyConf.SyncEvery - 1))
 	localErr = maybeInitDelayedQ(tcData, t)
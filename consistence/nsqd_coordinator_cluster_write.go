@@ -1131,7 +1131,11 @@ func (self *NsqdCoordinator) updateChannelStateOnSlave(tc *coordData, channelNam
 	ch, localErr = topic.GetExistingChannel(channelName)
 	// if a new channel on slave, we should set the consume offset by force
 	if localErr != nil {
-		ch = topic.GetChannel(channelName)
+		ch, localErr = topic.GetOrCreateChannel(channelName)
+		if localErr != nil {
+			coordLog.Warningf("slave init the channel %v, %v failed: %v", topic.GetTopicName(), channelName, localErr)
+			return ErrLocalInitChannelFailed
+		}
 		coordLog.Infof("slave init the channel : %v, %v, offset: %v", topic.GetTopicName(), channelName, ch.GetConfirmed())
 	}
 	if ch.IsEphemeral() {
@@ -1196,7 +1200,11 @@ func (self *NsqdCoordinator) updateChannelOffsetOnSlave(tc *coordData, channelNa
 	// if a new channel on slave, we should set the consume offset by force
 	if localErr != nil {
 		offset.AllowBackward = true
-		ch = topic.GetChannel(channelName)
+		ch, localErr = topic.GetOrCreateChannel(channelName)
+		if localErr != nil {
+			coordLog.Warningf("slave init the channel %v, %v failed: %v", topic.GetTopicName(), channelName, localErr)
+			return ErrLocalInitChannelFailed
+		}
 		coordLog.Infof("slave init the channel : %v, %v, offset: %v", topic.GetTopicName(), channelName, ch.GetConfirmed())
 	}
 	if ch.IsEphemeral() {
@@ -1648,3 +1648,25 @@ func BenchmarkNsqdCoordPub2Replicator1024(b *testing.B) {
 func BenchmarkNsqdCoordPub3Replicator1024(b *testing.B) {
 	benchmarkNsqdCoordPubWithArg(b, 3, 1024)
 }
+
+func TestNsqdCoordDuplicateWorkerID(t *testing.T) {
+	fakeLeadership := NewFakeNSQDLeadership().(*fakeNsqdLeadership)
+	nsqdCoord1 := NewNsqdCoordinator(TEST_NSQ_CLUSTER_NAME, "127.0.0.1", "0", "10001", "0", "1", "", nil)
+	nsqdCoord1.leadership = fakeLeadership
+	test.Nil(t, nsqdCoord1.checkDuplicateWorkerID())
+	test.Nil(t, fakeLeadership.RegisterNsqd(&nsqdCoord1.myNode))
+	// the registered node itself is not the duplicate
+	test.Nil(t, nsqdCoord1.checkDuplicateWorkerID())
+
+	nsqdCoord2 := NewNsqdCoordinator(TEST_NSQ_CLUSTER_NAME, "127.0.0.1", "0", "10002", "0", "1", "", nil)
+	nsqdCoord2.leadership = fakeLeadership
+	test.Equal(t, ErrDuplicateWorkerID, nsqdCoord2.checkDuplicateWorkerID())
+
+	nsqdCoord3 := NewNsqdCoordinator(TEST_NSQ_CLUSTER_NAME, "127.0.0.1", "0", "10003", "0", "11", "", nil)
+	nsqdCoord3.leadership = fakeLeadership
+	test.Nil(t, nsqdCoord3.checkDuplicateWorkerID())
+
+	// the worker id can be used after the node left
+	fakeLeadership.UnregisterNsqd(&nsqdCoord1.myNode)
+	test.Nil(t, nsqdCoord2.checkDuplicateWorkerID())
+}
@@ -218,6 +218,29 @@ func (self *NsqdEtcdMgr) GetAllLookupdNodes() ([]NsqLookupdNodeInfo, error) {
 	return lookupdNodeList, nil
 }
 
+func (self *NsqdEtcdMgr) GetAllNsqdNodes() ([]NsqdNodeInfo, error) {
+	rsp, err := self.client.Get(self.createNsqdRootPath(), false, false)
+	if err != nil {
+		if client.IsKeyNotFound(err) {
+			return nil, ErrKeyNotFound
+		}
+		return nil, err
+	}
+	nsqdNodes := make([]NsqdNodeInfo, 0)
+	for _, node := range rsp.Node.Nodes {
+		if node.Dir {
+			continue
+		}
+		var nodeInfo NsqdNodeInfo
+		err := json.Unmarshal([]byte(node.Value), &nodeInfo)
+		if err != nil {
+			continue
+		}
+		nsqdNodes = append(nsqdNodes, nodeInfo)
+	}
+	return nsqdNodes, nil
+}
+
 func (self *NsqdEtcdMgr) WatchLookupdLeader(leader chan *NsqLookupdNodeInfo, stop chan struct{}) error {
 	key := self.createLookupdLeaderPath()
 
@@ -362,6 +385,10 @@ func (self *NsqdEtcdMgr) GetTopicLeaderSession(topic string, partition int) (*To
 	return &topicLeaderSession, nil
 }
 
+func (self *NsqdEtcdMgr) createNsqdRootPath() string {
+	return path.Join("/", NSQ_ROOT_DIR, self.clusterID, NSQ_NODE_DIR)
+}
+
 func (self *NsqdEtcdMgr) createNsqdNodePath(nodeData *NsqdNodeInfo) string {
 	return path.Join("/", NSQ_ROOT_DIR, self.clusterID, NSQ_NODE_DIR, "Node-"+nodeData.ID)
 }
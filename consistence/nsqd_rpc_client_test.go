@@ -40,6 +40,14 @@ func (self *fakeNsqdLeadership) RegisterNsqd(nodeData *NsqdNodeInfo) error {
 	return nil
 }
 
+func (self *fakeNsqdLeadership) GetAllNsqdNodes() ([]NsqdNodeInfo, error) {
+	nodes := make([]NsqdNodeInfo, 0, len(self.regData))
+	for _, n := range self.regData {
+		nodes = append(nodes, *n)
+	}
+	return nodes, nil
+}
+
 func (self *fakeNsqdLeadership) UnregisterNsqd(nodeData *NsqdNodeInfo) error {
 	delete(self.regData, nodeData.GetID())
 	coordLog.Infof("fake nsqd unregistered: %v", nodeData)
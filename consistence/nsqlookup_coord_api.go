@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/youzan/nsq/internal/protocol"
+	"github.com/youzan/nsq/nsqd"
 )
 
 const (
@@ -347,8 +348,12 @@ func (self *NsqLookupCoordinator) deleteTopicPartition(topic string, pid int) er
 	return nil
 }
 
+// ChangeTopicMetaParam changes the topic meta, the param is not changed if negative. The pub
+// rate limits override the node limits if not 0, and the max message size can only lower the
+// node limit if not 0.
 func (self *NsqLookupCoordinator) ChangeTopicMetaParam(topic string,
-	newSyncEvery int, newRetentionDay int, newReplicator int, upgradeExt string) error {
+	newSyncEvery int, newRetentionDay int, newReplicator int, upgradeExt string,
+	newPubRateLimit int64, newPubBytesRateLimit int64, newMaxMsgSize int64) error {
 	if self.leaderNode.GetID() != self.myNode.GetID() {
 		coordLog.Infof("not leader while create topic")
 		return ErrNotNsqLookupLeader
@@ -402,6 +407,15 @@ func (self *NsqLookupCoordinator) ChangeTopicMetaParam(topic string,
 		if newReplicator > 0 {
 			meta.Replica = newReplicator
 		}
+		if newPubRateLimit >= 0 {
+			meta.PubRateLimit = newPubRateLimit
+		}
+		if newPubBytesRateLimit >= 0 {
+			meta.PubBytesRateLimit = newPubBytesRateLimit
+		}
+		if newMaxMsgSize >= 0 {
+			meta.MaxMsgSize = newMaxMsgSize
+		}
 		// change to ext only, can not change ext to non-ext
 		needDisableWrite := false
 		if upgradeExt == "true" && !meta.Ext {
@@ -536,6 +550,12 @@ func (self *NsqLookupCoordinator) ExpandTopicPartition(topic string, newPartitio
 	}
 }
 
+// IsValidTopicBacking returns true if the topic can be created with the queue backing, the disk
+// queue is used if empty.
+func IsValidTopicBacking(backing string) bool {
+	return backing == "" || backing == nsqd.BackendTypeDisk || backing == nsqd.BackendTypeMemory
+}
+
 func (self *NsqLookupCoordinator) CreateTopic(topic string, meta TopicMetaInfo) error {
 	if self.leaderNode.GetID() != self.myNode.GetID() {
 		coordLog.Infof("not leader while create topic")
@@ -545,6 +565,9 @@ func (self *NsqLookupCoordinator) CreateTopic(topic string, meta TopicMetaInfo)
 	if !protocol.IsValidTopicName(topic) {
 		return errors.New("invalid topic name")
 	}
+	if !IsValidTopicBacking(meta.Backing) {
+		return errors.New("invalid topic backing")
+	}
 
 	// TODO: handle default load factor
 	if meta.PartitionNum >= MAX_PARTITION_NUM {
@@ -599,6 +622,54 @@ func (self *NsqLookupCoordinator) CreateTopic(topic string, meta TopicMetaInfo)
 	return self.checkAndUpdateTopicPartitions(currentNodes, topic, meta)
 }
 
+// PlaceTopic decides the nodes for each partition of the topic from the current nodes, the
+// first node of each partition is the leader. The placement is written to etcd so the nodes
+// can be used while creating the topic later.
+func (self *NsqLookupCoordinator) PlaceTopic(topic string, partitions, replicas int) (map[int][]*NsqdNodeInfo, error) {
+	if self.leaderNode.GetID() != self.myNode.GetID() {
+		coordLog.Infof("not leader while place topic")
+		return nil, ErrNotNsqLookupLeader
+	}
+	if !protocol.IsValidTopicName(topic) {
+		return nil, errors.New("invalid topic name")
+	}
+	if partitions <= 0 || partitions >= MAX_PARTITION_NUM {
+		return nil, errors.New("invalid partition num")
+	}
+
+	currentNodes := self.getCurrentNodes()
+	if len(currentNodes) < replicas {
+		coordLog.Infof("nodes %v is less than replica %v while place topic %v", len(currentNodes), replicas, topic)
+		return nil, ErrPlacementNodeNotEnough
+	}
+	nodeNameList := make([]string, 0, len(currentNodes))
+	for nid := range currentNodes {
+		nodeNameList = append(nodeNameList, nid)
+	}
+	partitionNodes, err := AssignPartitions(partitions, replicas, nodeNameList)
+	if err != nil {
+		return nil, err
+	}
+	placement := make(map[int][]string, partitions)
+	placed := make(map[int][]*NsqdNodeInfo, partitions)
+	for i, nlist := range partitionNodes {
+		placement[i] = nlist
+		nodes := make([]*NsqdNodeInfo, 0, len(nlist))
+		for _, nid := range nlist {
+			n := currentNodes[nid]
+			nodes = append(nodes, &n)
+		}
+		placed[i] = nodes
+	}
+	err = self.leadership.UpdateTopicPlacement(topic, placement)
+	if err != nil {
+		coordLog.Infof("write placement for topic %v failed: %v", topic, err)
+		return nil, err
+	}
+	coordLog.Infof("topic %v placed: %v", topic, placement)
+	return placed, nil
+}
+
 func (self *NsqLookupCoordinator) checkAndUpdateTopicPartitions(currentNodes map[string]NsqdNodeInfo,
 	topic string, meta TopicMetaInfo) error {
 	existPart := make(map[int]*TopicPartitionMetaInfo)
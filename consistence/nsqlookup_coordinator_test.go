@@ -33,6 +33,7 @@ type FakeNsqlookupLeadership struct {
 	fakeTopics           map[string]map[int]*fakeTopicData
 	fakeTopicMetaInfo    map[string]TopicMetaInfo
 	fakeNsqdNodes        map[string]NsqdNodeInfo
+	fakePlacements       map[string]map[int][]string
 	nodeChanged          chan struct{}
 	fakeEpoch            EpochType
 	fakeLeader           *NsqLookupdNodeInfo
@@ -47,6 +48,7 @@ func NewFakeNsqlookupLeadership() *FakeNsqlookupLeadership {
 		fakeTopics:           make(map[string]map[int]*fakeTopicData),
 		fakeTopicMetaInfo:    make(map[string]TopicMetaInfo),
 		fakeNsqdNodes:        make(map[string]NsqdNodeInfo),
+		fakePlacements:       make(map[string]map[int][]string),
 		nodeChanged:          make(chan struct{}, 1),
 		leaderChanged:        make(chan struct{}, 1),
 		leaderSessionChanged: make(chan *TopicLeaderSession, 1),
@@ -164,6 +166,10 @@ func (self *FakeNsqlookupLeadership) GetNsqdNodes() ([]NsqdNodeInfo, error) {
 	return nodes, nil
 }
 
+func (self *FakeNsqlookupLeadership) GetAllNsqdNodes() ([]NsqdNodeInfo, error) {
+	return self.GetNsqdNodes()
+}
+
 func (self *FakeNsqlookupLeadership) WatchNsqdNodes(nsqds chan []NsqdNodeInfo, stop chan struct{}) {
 	defer close(nsqds)
 	for {
@@ -487,6 +493,31 @@ func (self *FakeNsqlookupLeadership) WatchLookupdLeader(leader chan *NsqLookupdN
 	}
 }
 
+func (self *FakeNsqlookupLeadership) UpdateTopicPlacement(topic string, placement map[int][]string) error {
+	self.dataMutex.Lock()
+	defer self.dataMutex.Unlock()
+	tmp := make(map[int][]string, len(placement))
+	for p, nlist := range placement {
+		tmp[p] = append([]string(nil), nlist...)
+	}
+	self.fakePlacements[topic] = tmp
+	return nil
+}
+
+func (self *FakeNsqlookupLeadership) GetTopicPlacement(topic string) (map[int][]string, error) {
+	self.dataMutex.Lock()
+	defer self.dataMutex.Unlock()
+	placement, ok := self.fakePlacements[topic]
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	tmp := make(map[int][]string, len(placement))
+	for p, nlist := range placement {
+		tmp[p] = append([]string(nil), nlist...)
+	}
+	return tmp, nil
+}
+
 func startNsqLookupCoord(t *testing.T, useFakeLeadership bool) (*NsqLookupCoordinator, int, *NsqLookupdNodeInfo) {
 	var n NsqLookupdNodeInfo
 	n.NodeIP = "127.0.0.1"
@@ -653,7 +684,7 @@ func testNsqLookupNsqdNodesChange(t *testing.T, useFakeLeadership bool) {
 	}()
 
 	// test new topic create
-	err := lookupCoord1.CreateTopic(topic, TopicMetaInfo{2, 2, 0, 0, 0, 0, false, false})
+	err := lookupCoord1.CreateTopic(topic, TopicMetaInfo{2, 2, 0, 0, 0, 0, false, false, 0, 0, 0, ""})
 	test.Nil(t, err)
 
 	waitClusterStable(lookupCoord1, time.Second*3)
@@ -831,7 +862,7 @@ func testNsqLookupNsqdNodesChange(t *testing.T, useFakeLeadership bool) {
 	waitClusterStable(lookupCoord1, time.Second*5)
 	// test new topic create
 	coordLog.Warningf("============= begin test 3 replicas ====")
-	err = lookupCoord1.CreateTopic(topic3, TopicMetaInfo{1, 3, 0, 0, 0, 0, false, false})
+	err = lookupCoord1.CreateTopic(topic3, TopicMetaInfo{1, 3, 0, 0, 0, 0, false, false, 0, 0, 0, ""})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord1, time.Second*5)
 	// with 3 replica, the isr join timeout will change the isr list if the isr has the quorum nodes
@@ -962,7 +993,7 @@ func TestNsqLookupNsqdCreateTopic(t *testing.T) {
 	}()
 
 	// test new topic create
-	err := lookupCoord1.CreateTopic(topic_p1_r1, TopicMetaInfo{1, 1, 0, 0, 0, 0, false, false})
+	err := lookupCoord1.CreateTopic(topic_p1_r1, TopicMetaInfo{1, 1, 0, 0, 0, 0, false, false, 0, 0, 0, ""})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord1, time.Second*3)
 	pmeta, _, err := lookupLeadership.GetTopicMetaInfo(topic_p1_r1)
@@ -984,7 +1015,7 @@ func TestNsqLookupNsqdCreateTopic(t *testing.T) {
 	test.Equal(t, tc0.topicInfo.Leader, t0.Leader)
 	test.Equal(t, len(tc0.topicInfo.ISR), 1)
 
-	err = lookupCoord1.CreateTopic(topic_p1_r3, TopicMetaInfo{1, 3, 0, 0, 0, 0, false, false})
+	err = lookupCoord1.CreateTopic(topic_p1_r3, TopicMetaInfo{1, 3, 0, 0, 0, 0, false, false, 0, 0, 0, ""})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord1, time.Second*5)
 	lookupCoord1.triggerCheckTopics("", 0, 0)
@@ -1009,7 +1040,7 @@ func TestNsqLookupNsqdCreateTopic(t *testing.T) {
 	test.Equal(t, tc0.topicInfo.Leader, t0.Leader)
 	test.Equal(t, len(tc0.topicInfo.ISR), 3)
 
-	err = lookupCoord1.CreateTopic(topic_p3_r1, TopicMetaInfo{3, 1, 0, 0, 0, 0, false, false})
+	err = lookupCoord1.CreateTopic(topic_p3_r1, TopicMetaInfo{3, 1, 0, 0, 0, 0, false, false, 0, 0, 0, ""})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord1, time.Second*2)
 	waitClusterStable(lookupCoord1, time.Second*5)
@@ -1041,7 +1072,7 @@ func TestNsqLookupNsqdCreateTopic(t *testing.T) {
 	test.Equal(t, tc1.topicInfo.Leader, t1.Leader)
 	test.Equal(t, len(tc1.topicInfo.ISR), 1)
 
-	err = lookupCoord1.CreateTopic(topic_p2_r2, TopicMetaInfo{2, 2, 0, 0, 0, 0, false, false})
+	err = lookupCoord1.CreateTopic(topic_p2_r2, TopicMetaInfo{2, 2, 0, 0, 0, 0, false, false, 0, 0, 0, ""})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord1, time.Second*3)
 	waitClusterStable(lookupCoord1, time.Second*5)
@@ -1076,7 +1107,7 @@ func TestNsqLookupNsqdCreateTopic(t *testing.T) {
 	// test create on exist topic, create on partial partition
 	oldMeta, _, err := lookupCoord1.leadership.GetTopicMetaInfo(topic_p2_r2)
 	test.Nil(t, err)
-	err = lookupCoord1.CreateTopic(topic_p2_r2, TopicMetaInfo{2, 2, 0, 0, 1, 1, false, false})
+	err = lookupCoord1.CreateTopic(topic_p2_r2, TopicMetaInfo{2, 2, 0, 0, 1, 1, false, false, 0, 0, 0, ""})
 	test.NotNil(t, err)
 	waitClusterStable(lookupCoord1, time.Second)
 	waitClusterStable(lookupCoord1, time.Second*5)
@@ -1086,6 +1117,137 @@ func TestNsqLookupNsqdCreateTopic(t *testing.T) {
 	SetCoordLogger(newTestLogger(t), levellogger.LOG_ERR)
 }
 
+func TestNsqLookupPlaceTopic(t *testing.T) {
+	var n NsqLookupdNodeInfo
+	n.NodeIP = "127.0.0.1"
+	n.ID = GenNsqLookupNodeID(&n, "")
+	coord := NewNsqLookupCoordinator(TEST_NSQ_CLUSTER_NAME, &n, nil)
+	fakeLeadership := NewFakeNsqlookupLeadership()
+	coord.leadership = fakeLeadership
+	coord.leaderNode = coord.myNode
+	for i := 0; i < 4; i++ {
+		var node NsqdNodeInfo
+		node.ID = "node" + strconv.Itoa(i)
+		node.NodeIP = "127.0.0.1"
+		coord.nsqdNodes[node.ID] = node
+	}
+
+	_, err := coord.PlaceTopic("test_place_topic", 4, 5)
+	test.Equal(t, ErrPlacementNodeNotEnough, err)
+	_, err = fakeLeadership.GetTopicPlacement("test_place_topic")
+	test.Equal(t, ErrKeyNotFound, err)
+
+	placed, err := coord.PlaceTopic("test_place_topic", 8, 2)
+	test.Nil(t, err)
+	test.Equal(t, 8, len(placed))
+	leaderCnt := make(map[string]int)
+	replicaCnt := make(map[string]int)
+	for p := 0; p < 8; p++ {
+		nodes := placed[p]
+		test.Equal(t, 2, len(nodes))
+		test.NotEqual(t, nodes[0].GetID(), nodes[1].GetID())
+		leaderCnt[nodes[0].GetID()]++
+		for _, node := range nodes {
+			replicaCnt[node.GetID()]++
+		}
+	}
+	// each node should have the same leaders and replicas
+	test.Equal(t, 4, len(leaderCnt))
+	for nid := range coord.nsqdNodes {
+		test.Equal(t, 2, leaderCnt[nid])
+		test.Equal(t, 4, replicaCnt[nid])
+	}
+
+	persisted, err := fakeLeadership.GetTopicPlacement("test_place_topic")
+	test.Nil(t, err)
+	test.Equal(t, 8, len(persisted))
+	for p, nodes := range placed {
+		test.Equal(t, len(nodes), len(persisted[p]))
+		for i, node := range nodes {
+			test.Equal(t, node.GetID(), persisted[p][i])
+		}
+	}
+
+	// the same nodes should get the same placement
+	placed2, err := coord.PlaceTopic("test_place_topic", 8, 2)
+	test.Nil(t, err)
+	for p, nodes := range placed {
+		for i, node := range nodes {
+			test.Equal(t, node.GetID(), placed2[p][i].GetID())
+		}
+	}
+}
+
+func TestNsqLookupDumpClusterState(t *testing.T) {
+	var n NsqLookupdNodeInfo
+	n.NodeIP = "127.0.0.1"
+	n.TcpPort = "4160"
+	n.ID = GenNsqLookupNodeID(&n, "")
+	coord := NewNsqLookupCoordinator(TEST_NSQ_CLUSTER_NAME, &n, nil)
+	fakeLeadership := NewFakeNsqlookupLeadership()
+	coord.leadership = fakeLeadership
+	fakeLeadership.Register(&n)
+	nodes := make([]NsqdNodeInfo, 0, 2)
+	for i := 1; i >= 0; i-- {
+		var node NsqdNodeInfo
+		node.ID = "node" + strconv.Itoa(i)
+		node.NodeIP = "127.0.0.1"
+		node.TcpPort = strconv.Itoa(4150 + i)
+		fakeLeadership.RegisterNsqd(&node)
+		nodes = append([]NsqdNodeInfo{node}, nodes...)
+	}
+
+	topic := "test_dump_cluster_state"
+	test.Nil(t, fakeLeadership.CreateTopic(topic, &TopicMetaInfo{PartitionNum: 2, Replica: 2, SyncEvery: 100}))
+	for p := 0; p < 2; p++ {
+		test.Nil(t, fakeLeadership.CreateTopicPartition(topic, p))
+	}
+	replicas := TopicPartitionReplicaInfo{Leader: "node0", ISR: []string{"node0", "node1"}}
+	test.Nil(t, fakeLeadership.UpdateTopicNodeInfo(topic, 0, &replicas, 0))
+	test.Nil(t, fakeLeadership.AcquireTopicLeader(topic, 0, &nodes[0], 1))
+	test.Nil(t, fakeLeadership.UpdateTopicPlacement(topic, map[int][]string{0: {"node0", "node1"}, 1: {"node1", "node0"}}))
+	// the topic without the placement and leader
+	topic2 := "test_dump_cluster_state2"
+	test.Nil(t, fakeLeadership.CreateTopic(topic2, &TopicMetaInfo{PartitionNum: 1, Replica: 1}))
+	test.Nil(t, fakeLeadership.CreateTopicPartition(topic2, 0))
+
+	state, err := coord.DumpClusterState()
+	test.Nil(t, err)
+	test.Equal(t, TEST_NSQ_CLUSTER_NAME, state.ClusterID)
+	test.Equal(t, fakeLeadership.clusterEpoch, state.Epoch)
+	test.Equal(t, []NsqLookupdNodeInfo{n}, state.LookupdNodes)
+	test.Equal(t, nodes, state.NsqdNodes)
+	test.Equal(t, 2, len(state.Topics))
+
+	ts := state.Topics[0]
+	test.Equal(t, topic, ts.Name)
+	test.Equal(t, 2, ts.PartitionNum)
+	test.Equal(t, 100, ts.SyncEvery)
+	test.Equal(t, 2, len(ts.Partitions))
+	test.Equal(t, 0, ts.Partitions[0].Partition)
+	test.Equal(t, "node0", ts.Partitions[0].Leader)
+	test.Equal(t, []string{"node0", "node1"}, ts.Partitions[0].ISR)
+	test.Equal(t, EpochType(1), ts.Partitions[0].Epoch)
+	test.NotNil(t, ts.Partitions[0].LeaderSession)
+	test.Equal(t, "node0", ts.Partitions[0].LeaderSession.LeaderNode.GetID())
+	test.Equal(t, 1, ts.Partitions[1].Partition)
+	test.Equal(t, "", ts.Partitions[1].Leader)
+	test.Equal(t, true, ts.Partitions[1].LeaderSession == nil)
+	test.Equal(t, map[int][]string{0: {"node0", "node1"}, 1: {"node1", "node0"}}, ts.Placement)
+
+	ts = state.Topics[1]
+	test.Equal(t, topic2, ts.Name)
+	test.Equal(t, 1, len(ts.Partitions))
+	test.Equal(t, true, ts.Partitions[0].LeaderSession == nil)
+	test.Equal(t, true, ts.Placement == nil)
+
+	// nothing changed by the dump
+	epoch := fakeLeadership.clusterEpoch
+	_, err = coord.DumpClusterState()
+	test.Nil(t, err)
+	test.Equal(t, epoch, fakeLeadership.clusterEpoch)
+}
+
 func TestNsqLookupUpdateTopicMeta(t *testing.T) {
 	if testing.Verbose() {
 		SetCoordLogger(levellogger.NewSimpleLog(), levellogger.LOG_INFO)
@@ -1118,16 +1280,16 @@ func TestNsqLookupUpdateTopicMeta(t *testing.T) {
 		lookupCoord.Stop()
 	}()
 
-	err := lookupCoord.CreateTopic(topic_p1_r1, TopicMetaInfo{1, 1, 0, 0, 0, 0, false, false})
+	err := lookupCoord.CreateTopic(topic_p1_r1, TopicMetaInfo{1, 1, 0, 0, 0, 0, false, false, 0, 0, 0, ""})
 	test.Nil(t, err)
 	time.Sleep(time.Second)
 
-	err = lookupCoord.CreateTopic(topic_p2_r1, TopicMetaInfo{2, 1, 0, 0, 0, 0, false, false})
+	err = lookupCoord.CreateTopic(topic_p2_r1, TopicMetaInfo{2, 1, 0, 0, 0, 0, false, false, 0, 0, 0, ""})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord, time.Second*5)
 
 	// test increase replicator and decrease the replicator
-	err = lookupCoord.ChangeTopicMetaParam(topic_p1_r1, -1, -1, 3, "")
+	err = lookupCoord.ChangeTopicMetaParam(topic_p1_r1, -1, -1, 3, "", -1, -1, -1)
 	lookupCoord.triggerCheckTopics("", 0, 0)
 	waitClusterStable(lookupCoord, time.Second*5)
 	time.Sleep(time.Second * 5)
@@ -1140,7 +1302,7 @@ func TestNsqLookupUpdateTopicMeta(t *testing.T) {
 		test.Equal(t, tmeta.Replica, len(info.ISR))
 	}
 
-	err = lookupCoord.ChangeTopicMetaParam(topic_p1_r1, -1, -1, 2, "")
+	err = lookupCoord.ChangeTopicMetaParam(topic_p1_r1, -1, -1, 2, "", -1, -1, -1)
 	lookupCoord.triggerCheckTopics("", 0, 0)
 	waitClusterStable(lookupCoord, time.Second*5)
 	time.Sleep(time.Second * 3)
@@ -1152,7 +1314,7 @@ func TestNsqLookupUpdateTopicMeta(t *testing.T) {
 		test.Equal(t, tmeta.Replica, len(info.ISR))
 	}
 
-	err = lookupCoord.ChangeTopicMetaParam(topic_p2_r1, -1, -1, 2, "")
+	err = lookupCoord.ChangeTopicMetaParam(topic_p2_r1, -1, -1, 2, "", -1, -1, -1)
 	lookupCoord.triggerCheckTopics("", 0, 0)
 	waitClusterStable(lookupCoord, time.Second*5)
 	time.Sleep(time.Second * 5)
@@ -1165,10 +1327,10 @@ func TestNsqLookupUpdateTopicMeta(t *testing.T) {
 	}
 
 	// should fail
-	err = lookupCoord.ChangeTopicMetaParam(topic_p2_r1, -1, -1, 3, "")
+	err = lookupCoord.ChangeTopicMetaParam(topic_p2_r1, -1, -1, 3, "", -1, -1, -1)
 	test.NotNil(t, err)
 
-	err = lookupCoord.ChangeTopicMetaParam(topic_p2_r1, -1, -1, 1, "")
+	err = lookupCoord.ChangeTopicMetaParam(topic_p2_r1, -1, -1, 1, "", -1, -1, -1)
 	waitClusterStable(lookupCoord, time.Second*5)
 	lookupCoord.triggerCheckTopics("", 0, 0)
 	time.Sleep(time.Second * 3)
@@ -1180,14 +1342,17 @@ func TestNsqLookupUpdateTopicMeta(t *testing.T) {
 		test.Equal(t, tmeta.Replica, len(info.ISR))
 	}
 
-	// test update the sync and retention , all partition and replica should be updated
-	err = lookupCoord.ChangeTopicMetaParam(topic_p1_r1, 1234, 3, -1, "")
+	// test update the sync, retention and pub limits, all partition and replica should be updated
+	err = lookupCoord.ChangeTopicMetaParam(topic_p1_r1, 1234, 3, -1, "", 100, 10240, 1024)
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord, time.Second*5)
 	time.Sleep(time.Second)
 	tmeta, _, _ = lookupLeadership.GetTopicMetaInfo(topic_p1_r1)
 	test.Equal(t, 1234, tmeta.SyncEvery)
 	test.Equal(t, int32(3), tmeta.RetentionDay)
+	test.Equal(t, int64(100), tmeta.PubRateLimit)
+	test.Equal(t, int64(10240), tmeta.PubBytesRateLimit)
+	test.Equal(t, int64(1024), tmeta.MaxMsgSize)
 	for i := 0; i < tmeta.PartitionNum; i++ {
 		info, err := lookupLeadership.GetTopicInfo(topic_p1_r1, i)
 		test.Nil(t, err)
@@ -1198,6 +1363,9 @@ func TestNsqLookupUpdateTopicMeta(t *testing.T) {
 			dinfo := localTopic.GetDynamicInfo()
 			test.Equal(t, int64(1234), dinfo.SyncEvery)
 			test.Equal(t, int32(3), dinfo.RetentionDay)
+			test.Equal(t, int64(100), dinfo.PubRateLimit)
+			test.Equal(t, int64(10240), dinfo.PubBytesRateLimit)
+			test.Equal(t, int64(1024), localTopic.GetMaxMsgSize())
 		}
 	}
 	SetCoordLogger(newTestLogger(t), levellogger.LOG_ERR)
@@ -1238,15 +1406,15 @@ func TestNsqLookupMarkNodeRemove(t *testing.T) {
 		lookupCoord.Stop()
 	}()
 
-	err := lookupCoord.CreateTopic(topic_p4_r1, TopicMetaInfo{4, 1, 0, 0, 0, 0, false, false})
+	err := lookupCoord.CreateTopic(topic_p4_r1, TopicMetaInfo{4, 1, 0, 0, 0, 0, false, false, 0, 0, 0, ""})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord, time.Second)
 
-	err = lookupCoord.CreateTopic(topic_p2_r2, TopicMetaInfo{2, 2, 0, 0, 0, 0, false, false})
+	err = lookupCoord.CreateTopic(topic_p2_r2, TopicMetaInfo{2, 2, 0, 0, 0, 0, false, false, 0, 0, 0, ""})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord, time.Second)
 
-	err = lookupCoord.CreateTopic(topic_p1_r3, TopicMetaInfo{1, 3, 0, 0, 0, 0, false, false})
+	err = lookupCoord.CreateTopic(topic_p1_r3, TopicMetaInfo{1, 3, 0, 0, 0, 0, false, false, 0, 0, 0, ""})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord, time.Second)
 
@@ -1353,15 +1521,15 @@ func TestNsqLookupExpandPartition(t *testing.T) {
 		lookupCoord.Stop()
 	}()
 
-	err := lookupCoord.CreateTopic(topic_p1_r1, TopicMetaInfo{1, 1, 0, 0, 0, 0, false, false})
+	err := lookupCoord.CreateTopic(topic_p1_r1, TopicMetaInfo{1, 1, 0, 0, 0, 0, false, false, 0, 0, 0, ""})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord, time.Second)
 
-	err = lookupCoord.CreateTopic(topic_p1_r2, TopicMetaInfo{1, 2, 0, 0, 0, 0, false, false})
+	err = lookupCoord.CreateTopic(topic_p1_r2, TopicMetaInfo{1, 2, 0, 0, 0, 0, false, false, 0, 0, 0, ""})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord, time.Second)
 
-	err = lookupCoord.CreateTopic(topic_p1_r3, TopicMetaInfo{1, 3, 0, 0, 0, 0, false, false})
+	err = lookupCoord.CreateTopic(topic_p1_r3, TopicMetaInfo{1, 3, 0, 0, 0, 0, false, false, 0, 0, 0, ""})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord, time.Second)
 	waitClusterStable(lookupCoord, time.Second)
@@ -1465,13 +1633,13 @@ func TestNsqLookupMovePartition(t *testing.T) {
 	}()
 
 	// test new topic create
-	err := lookupCoord.CreateTopic(topic_p1_r1, TopicMetaInfo{1, 1, 0, 0, 0, 0, false, false})
+	err := lookupCoord.CreateTopic(topic_p1_r1, TopicMetaInfo{1, 1, 0, 0, 0, 0, false, false, 0, 0, 0, ""})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord, time.Second*3)
 
-	err = lookupCoord.CreateTopic(topic_p2_r2, TopicMetaInfo{2, 2, 0, 0, 0, 0, false, false})
+	err = lookupCoord.CreateTopic(topic_p2_r2, TopicMetaInfo{2, 2, 0, 0, 0, 0, false, false, 0, 0, 0, ""})
 	test.Nil(t, err)
-	err = lookupCoord.CreateTopic(topic_ordered_p4_r3, TopicMetaInfo{4, 3, 0, 0, 0, 0, true, false})
+	err = lookupCoord.CreateTopic(topic_ordered_p4_r3, TopicMetaInfo{4, 3, 0, 0, 0, 0, true, false, 0, 0, 0, ""})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord, time.Second*5)
 
@@ -1747,14 +1915,14 @@ func TestNsqLookupOrderedTopicCreate(t *testing.T) {
 	}()
 
 	// test new topic create
-	err := lookupCoord1.CreateTopic(topic_p8_r3, TopicMetaInfo{8, 3, 0, 0, 0, 0, true, false})
+	err := lookupCoord1.CreateTopic(topic_p8_r3, TopicMetaInfo{8, 3, 0, 0, 0, 0, true, false, 0, 0, 0, ""})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord1, time.Second*3)
 
 	checkOrderedMultiTopic(t, topic_p8_r3, 8, len(nodeInfoList),
 		nodeInfoList, lookupLeadership, true)
 
-	err = lookupCoord1.CreateTopic(topic_p13_r1, TopicMetaInfo{13, 1, 0, 0, 0, 0, true, false})
+	err = lookupCoord1.CreateTopic(topic_p13_r1, TopicMetaInfo{13, 1, 0, 0, 0, 0, true, false, 0, 0, 0, ""})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord1, time.Second*5)
 	lookupCoord1.triggerCheckTopics("", 0, 0)
@@ -1763,7 +1931,7 @@ func TestNsqLookupOrderedTopicCreate(t *testing.T) {
 	checkOrderedMultiTopic(t, topic_p13_r1, 13, len(nodeInfoList),
 		nodeInfoList, lookupLeadership, true)
 
-	err = lookupCoord1.CreateTopic(topic_p25_r3, TopicMetaInfo{25, 3, 0, 0, 0, 0, true, false})
+	err = lookupCoord1.CreateTopic(topic_p25_r3, TopicMetaInfo{25, 3, 0, 0, 0, 0, true, false, 0, 0, 0, ""})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord1, time.Second*2)
 	waitClusterStable(lookupCoord1, time.Second*5)
@@ -1774,7 +1942,7 @@ func TestNsqLookupOrderedTopicCreate(t *testing.T) {
 	// test create on exist topic, create on partial partition
 	oldMeta, _, err := lookupCoord1.leadership.GetTopicMetaInfo(topic_p25_r3)
 	test.Nil(t, err)
-	err = lookupCoord1.CreateTopic(topic_p25_r3, TopicMetaInfo{25, 3, 0, 0, 1, 1, true, false})
+	err = lookupCoord1.CreateTopic(topic_p25_r3, TopicMetaInfo{25, 3, 0, 0, 1, 1, true, false, 0, 0, 0, ""})
 	test.NotNil(t, err)
 	waitClusterStable(lookupCoord1, time.Second)
 	waitClusterStable(lookupCoord1, time.Second*5)
@@ -1898,7 +2066,7 @@ func TestNsqLookupOrderedTopicBalance(t *testing.T) {
 		lookupCoord1.Stop()
 	}()
 
-	err := lookupCoord1.CreateTopic(topic_p13_r2, TopicMetaInfo{13, 2, 0, 0, 0, 0, true, false})
+	err := lookupCoord1.CreateTopic(topic_p13_r2, TopicMetaInfo{13, 2, 0, 0, 0, 0, true, false, 0, 0, 0, ""})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord1, time.Second*10)
 	time.Sleep(time.Second * 3)
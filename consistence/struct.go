@@ -17,6 +17,8 @@ const (
 	NSQ_LOOKUPD_DIR            = "NsqlookupdInfo"
 	NSQ_LOOKUPD_NODE_DIR       = "NsqlookupdNodes"
 	NSQ_LOOKUPD_LEADER_SESSION = "LookupdLeaderSession"
+	NSQ_TOPIC_PLACEMENT_DIR    = "TopicPlacements"
+	NSQ_CHANNEL_CONFIRM_DIR    = "ChannelConfirms"
 )
 
 const (
@@ -0,0 +1,123 @@
+package auth
+
+import (
+	"sync"
+	"time"
+)
+
+// StateCache caches the auth state queried from the auth server, so the repeated
+// auth of the same client can be served without querying again.
+type StateCache interface {
+	Get(key string) (*State, bool)
+	Set(key string, state *State)
+	Invalidate(key string)
+}
+
+type cachedState struct {
+	state   *State
+	expires time.Time
+}
+
+// TTLCache is the in-process StateCache, the cached state expires after the ttl or the
+// ttl of the state itself whichever comes first, and the one expiring soonest is evicted
+// while the cache is full.
+type TTLCache struct {
+	sync.Mutex
+	ttl     time.Duration
+	maxSize int
+	items   map[string]cachedState
+}
+
+func NewTTLCache(ttl time.Duration, maxSize int) *TTLCache {
+	return &TTLCache{
+		ttl:     ttl,
+		maxSize: maxSize,
+		items:   make(map[string]cachedState),
+	}
+}
+
+// CacheKey returns the key of the auth query, the same secret from the different
+// address or tls setting may get a different state.
+func CacheKey(remoteIP, tlsEnabled, authSecret string) string {
+	return remoteIP + "|" + tlsEnabled + "|" + authSecret
+}
+
+func (c *TTLCache) Get(key string) (*State, bool) {
+	c.Lock()
+	defer c.Unlock()
+	item, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	if !item.expires.After(time.Now()) {
+		delete(c.items, key)
+		return nil, false
+	}
+	return item.state, true
+}
+
+func (c *TTLCache) Set(key string, state *State) {
+	if c.ttl <= 0 || c.maxSize <= 0 {
+		return
+	}
+	now := time.Now()
+	expires := now.Add(c.ttl)
+	if state.Expires.Before(expires) {
+		expires = state.Expires
+	}
+	c.Lock()
+	defer c.Unlock()
+	if _, ok := c.items[key]; !ok && len(c.items) >= c.maxSize {
+		c.evict(now)
+	}
+	c.items[key] = cachedState{state: state, expires: expires}
+}
+
+func (c *TTLCache) Invalidate(key string) {
+	c.Lock()
+	delete(c.items, key)
+	c.Unlock()
+}
+
+func (c *TTLCache) Len() int {
+	c.Lock()
+	defer c.Unlock()
+	return len(c.items)
+}
+
+// remove all the expired, or the one expiring soonest if none expired
+func (c *TTLCache) evict(now time.Time) {
+	var oldestKey string
+	var oldest time.Time
+	for k, item := range c.items {
+		if !item.expires.After(now) {
+			delete(c.items, k)
+			continue
+		}
+		if oldestKey == "" || item.expires.Before(oldest) {
+			oldestKey = k
+			oldest = item.expires
+		}
+	}
+	if len(c.items) >= c.maxSize && oldestKey != "" {
+		delete(c.items, oldestKey)
+	}
+}
+
+// QueryAnyAuthdCached is the same as QueryAnyAuthd, but the state is served from the
+// cache if not expired, the cache is not used if nil.
+func QueryAnyAuthdCached(cache StateCache, authd []string, remoteIP, tlsEnabled, authSecret string) (*State, error) {
+	if cache == nil {
+		return QueryAnyAuthd(authd, remoteIP, tlsEnabled, authSecret)
+	}
+	key := CacheKey(remoteIP, tlsEnabled, authSecret)
+	if state, ok := cache.Get(key); ok {
+		return state, nil
+	}
+	state, err := QueryAnyAuthd(authd, remoteIP, tlsEnabled, authSecret)
+	if err != nil {
+		return nil, err
+	}
+	cache.Set(key, state)
+	return state, nil
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"sync/atomic"
 	"time"
 
 	"github.com/youzan/go-nsq"
@@ -77,6 +78,11 @@ func (lp *LookupPeer) String() string {
 	return lp.addr
 }
 
+// IsConnected returns true if the connection to the lookupd is established
+func (lp *LookupPeer) IsConnected() bool {
+	return atomic.LoadInt32(&lp.state) == stateConnected
+}
+
 // Read implements the io.Reader interface, adding deadlines
 func (lp *LookupPeer) Read(data []byte) (int, error) {
 	lp.conn.SetReadDeadline(time.Now().Add(lookupTimeout))
@@ -91,7 +97,7 @@ func (lp *LookupPeer) Write(data []byte) (int, error) {
 
 // Close implements the io.Closer interface
 func (lp *LookupPeer) Close() error {
-	lp.state = stateDisconnected
+	atomic.StoreInt32(&lp.state, stateDisconnected)
 	if lp.conn != nil {
 		return lp.conn.Close()
 	}
@@ -105,13 +111,13 @@ func (lp *LookupPeer) Close() error {
 //
 // It returns the response from nsqlookupd as []byte
 func (lp *LookupPeer) Command(cmd *nsq.Command) ([]byte, error) {
-	initialState := lp.state
-	if lp.state != stateConnected {
+	initialState := atomic.LoadInt32(&lp.state)
+	if initialState != stateConnected {
 		err := lp.Connect()
 		if err != nil {
 			return nil, err
 		}
-		lp.state = stateConnected
+		atomic.StoreInt32(&lp.state, stateConnected)
 		lp.Write(nsq.MagicV1)
 		if initialState == stateDisconnected {
 			lp.connectCallback(lp)
@@ -5,12 +5,14 @@ package dirlock
 import (
 	"fmt"
 	"os"
+	"sync/atomic"
 	"syscall"
 )
 
 type DirLock struct {
-	dir string
-	f   *os.File
+	dir    string
+	f      *os.File
+	locked int32
 }
 
 func New(dir string) *DirLock {
@@ -29,10 +31,17 @@ func (l *DirLock) Lock() error {
 	if err != nil {
 		return fmt.Errorf("cannot flock directory %s - %s", l.dir, err)
 	}
+	atomic.StoreInt32(&l.locked, 1)
 	return nil
 }
 
+// IsLocked returns true if the directory is locked by us.
+func (l *DirLock) IsLocked() bool {
+	return atomic.LoadInt32(&l.locked) == 1
+}
+
 func (l *DirLock) Unlock() error {
 	defer l.f.Close()
+	atomic.StoreInt32(&l.locked, 0)
 	return syscall.Flock(int(l.f.Fd()), syscall.LOCK_UN)
 }
@@ -16,6 +16,10 @@ func (l *DirLock) Lock() error {
 	return nil
 }
 
+func (l *DirLock) IsLocked() bool {
+	return true
+}
+
 func (l *DirLock) Unlock() error {
 	return nil
 }
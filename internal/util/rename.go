@@ -3,9 +3,99 @@
 package util
 
 import (
+	"fmt"
+	"io"
+	"math/rand"
 	"os"
+	"path/filepath"
+	"syscall"
 )
 
+// CrossDeviceRenameFallback enables the copy fallback while the rename
+// fails because of the source and target on different filesystems.
+var CrossDeviceRenameFallback = true
+
+// replaced in test to simulate the cross device rename
+var osRename = os.Rename
+
+// replaced in test to check the directory synced
+var syncDir = SyncDir
+
 func AtomicRename(sourceFile, targetFile string) error {
-	return os.Rename(sourceFile, targetFile)
+	err := osRename(sourceFile, targetFile)
+	if err != nil && CrossDeviceRenameFallback && isCrossDeviceErr(err) {
+		return copyRename(sourceFile, targetFile)
+	}
+	return err
+}
+
+// AtomicRenameSync renames and fsyncs the target directory, so the rename is durable after crash.
+func AtomicRenameSync(sourceFile, targetFile string) error {
+	err := AtomicRename(sourceFile, targetFile)
+	if err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(targetFile))
+}
+
+// SyncDir fsyncs the directory, it is ignored if the filesystem does not support.
+func SyncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	f.Close()
+	if err == nil || isSyncUnsupportedErr(err) {
+		return nil
+	}
+	return err
+}
+
+func isSyncUnsupportedErr(err error) bool {
+	if pe, ok := err.(*os.PathError); ok {
+		return pe.Err == syscall.EINVAL || pe.Err == syscall.ENOTSUP
+	}
+	return false
+}
+
+func isCrossDeviceErr(err error) bool {
+	if le, ok := err.(*os.LinkError); ok {
+		return le.Err == syscall.EXDEV
+	}
+	return false
+}
+
+// copy the source to a temp file in the target directory, and rename it
+// to the target so the target is still replaced atomically.
+func copyRename(sourceFile, targetFile string) error {
+	src, err := os.Open(sourceFile)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	tmpFileName := fmt.Sprintf("%s.%d.tmp", targetFile, rand.Int())
+	tmp, err := os.OpenFile(tmpFileName, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tmp, src)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpFileName)
+		return err
+	}
+	err = osRename(tmpFileName, targetFile)
+	if err != nil {
+		os.Remove(tmpFileName)
+		return err
+	}
+	syncDir(filepath.Dir(targetFile))
+	return os.Remove(sourceFile)
 }
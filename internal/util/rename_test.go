@@ -0,0 +1,131 @@
+// +build !windows
+
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestAtomicRenameCrossDevice(t *testing.T) {
+	srcDir, err := ioutil.TempDir("", "nsq-rename-src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(srcDir)
+	dstDir, err := ioutil.TempDir("", "nsq-rename-dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dstDir)
+
+	// simulate the source and target in different filesystems
+	osRename = func(oldpath, newpath string) error {
+		if filepath.Dir(oldpath) != filepath.Dir(newpath) {
+			return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EXDEV}
+		}
+		return os.Rename(oldpath, newpath)
+	}
+	defer func() {
+		osRename = os.Rename
+	}()
+
+	sourceFile := filepath.Join(srcDir, "meta.tmp")
+	targetFile := filepath.Join(dstDir, "meta.dat")
+	err = ioutil.WriteFile(targetFile, []byte("old data"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("new meta data")
+	err = ioutil.WriteFile(sourceFile, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	CrossDeviceRenameFallback = false
+	err = AtomicRename(sourceFile, targetFile)
+	CrossDeviceRenameFallback = true
+	if !isCrossDeviceErr(err) {
+		t.Fatalf("should fail with cross device error without fallback: %v", err)
+	}
+
+	err = AtomicRename(sourceFile, targetFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadFile(targetFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != string(data) {
+		t.Errorf("target data mismatch: %s", out)
+	}
+	if _, err := os.Stat(sourceFile); !os.IsNotExist(err) {
+		t.Errorf("source file should be removed: %v", err)
+	}
+	fis, err := ioutil.ReadDir(dstDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fis) != 1 {
+		t.Errorf("temp file should not be left in the target dir: %v", len(fis))
+	}
+}
+
+func TestAtomicRenameSyncDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nsq-rename-sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var synced []string
+	syncDir = func(d string) error {
+		synced = append(synced, d)
+		return SyncDir(d)
+	}
+	defer func() {
+		syncDir = SyncDir
+	}()
+
+	sourceFile := filepath.Join(dir, "meta.tmp")
+	targetFile := filepath.Join(dir, "meta.dat")
+	err = ioutil.WriteFile(sourceFile, []byte("meta data"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = AtomicRename(sourceFile, targetFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(synced) != 0 {
+		t.Errorf("directory should not be synced without sync: %v", synced)
+	}
+
+	err = ioutil.WriteFile(sourceFile, []byte("new meta data"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = AtomicRenameSync(sourceFile, targetFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(synced) != 1 || synced[0] != dir {
+		t.Errorf("target directory should be synced after rename: %v", synced)
+	}
+	out, err := ioutil.ReadFile(targetFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "new meta data" {
+		t.Errorf("target data mismatch: %s", out)
+	}
+
+	err = SyncDir(filepath.Join(dir, "not-exist"))
+	if !os.IsNotExist(err) {
+		t.Errorf("sync not exist directory should fail: %v", err)
+	}
+}
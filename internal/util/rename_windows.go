@@ -40,3 +40,13 @@ func AtomicRename(sourceFile, targetFile string) error {
 
 	return moveFileEx(lpReplacementFileName, lpReplacedFileName, MOVEFILE_REPLACE_EXISTING)
 }
+
+// AtomicRenameSync is the same as AtomicRename since the directory can not be synced on windows.
+func AtomicRenameSync(sourceFile, targetFile string) error {
+	return AtomicRename(sourceFile, targetFile)
+}
+
+// SyncDir is not supported on windows.
+func SyncDir(dir string) error {
+	return nil
+}
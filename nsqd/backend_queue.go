@@ -2,6 +2,12 @@ package nsqd
 
 type BackendOffset int64
 
+// the backend types of the queue
+const (
+	BackendTypeDisk   = "disk"
+	BackendTypeMemory = "memory"
+)
+
 type BackendQueueOffset interface {
 	Offset() BackendOffset
 }
@@ -35,6 +41,7 @@ type BackendQueueWriter interface {
 	GetQueueReadEnd() BackendQueueEnd
 	RollbackWrite(BackendOffset, uint64) error
 	ResetWriteEnd(BackendOffset, int64) error
+	BackendType() string
 }
 
 type ReadResult struct {
@@ -43,6 +50,12 @@ type ReadResult struct {
 	CurCnt    int64
 	Data      []byte
 	Err       error
+	// the delivery attempts of this offset by the reader, including this one
+	Attempts int32
+	// parsed from the message header if enabled, zero if not a standard message
+	MsgID        MessageID
+	MsgTimestamp int64
+	MsgAttempts  uint16
 }
 
 // for channel consumer
@@ -60,4 +73,5 @@ type BackendQueueReader interface {
 	Delete() error
 	UpdateQueueEnd(BackendQueueEnd, bool) (bool, error)
 	TryReadOne() (ReadResult, bool)
+	BackendType() string
 }
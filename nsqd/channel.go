@@ -15,12 +15,14 @@ import (
 	"github.com/youzan/nsq/internal/ext"
 	"github.com/youzan/nsq/internal/levellogger"
 	"github.com/youzan/nsq/internal/quantile"
+	"golang.org/x/net/context"
 )
 
 const (
 	resetReaderTimeoutSec = 10
 	MAX_MEM_REQ_TIMES     = 10
 	MaxWaitingDelayed     = 100
+	caughtUpDebounce      = time.Second
 )
 
 var (
@@ -31,6 +33,8 @@ var (
 	ErrMsgDeferred                    = errors.New("Message is deferred")
 	ErrSetConsumeOffsetNotFirstClient = errors.New("consume offset can only be changed by the first consume client")
 	ErrNotDiskQueueReader             = errors.New("the consume channel is not disk queue reader")
+	ErrChannelResetTimeout            = errors.New("timeout while waiting the channel reader reset")
+	ErrInvalidConfirmWin              = errors.New("the confirm window should be positive")
 )
 
 type Consumer interface {
@@ -46,10 +50,34 @@ type Consumer interface {
 	GetID() int64
 }
 
+// the reset offset to replay from the oldest retained data
+const resetToQueueStart = BackendOffset(-2)
+
+// the reset offset to read from the beginning of the file number in the reset count
+const resetToFileStart = BackendOffset(-3)
+
+// the reset offset to reset the reader by the function in the reset data
+const resetByFunc = BackendOffset(-4)
+
+// the reset offset to redeliver the messages not confirmed before the deadline
+const resetByConfirmDeadline = BackendOffset(-5)
+
+// the max retry for the end update failed to the reader
+const maxEndUpdateRetry = 3
+
+const (
+	// the weight of the new sample is 1/confirmLatencyWeight in the moving average
+	confirmLatencyWeight = 8
+	maxReadPaceDelay     = 100 * time.Millisecond
+)
+
 type resetChannelData struct {
 	Offset         BackendOffset
 	Cnt            int64
 	ClearConfirmed bool
+	// the reset done on the disk reader for resetByFunc, and the result sent back
+	ResetFunc func(d *diskQueueReader) error
+	Result    chan error
 }
 
 type MsgChanData struct {
@@ -76,6 +104,13 @@ type Channel struct {
 	timeoutCount      uint64
 	deferredCount     int64
 	deferredFromDelay int64
+	deadLetterCount   uint64
+	// the size of the data kept before the confirmed for the rewind
+	rewindRetention int64
+	// the seconds of the data kept by the time for the channel
+	retentionSecs int64
+	// the max messages waiting confirmed before the reader is throttled
+	maxConfirmWin int64
 
 	sync.RWMutex
 
@@ -125,6 +160,38 @@ type Channel struct {
 	endUpdatedChan  chan bool
 	needNotifyRead  int32
 	consumeDisabled int32
+	// the reader is stalled on the confirm window or the backend error
+	throttledByWin int32
+	throttledByErr int32
+	// the redeliver by the confirm deadline is signaled to the message pump and not handled yet
+	deadlineRedeliverPending int32
+	// the time the reader began stalling on the confirm window, and
+	// the breaker state tripped while stalled too long
+	throttledByWinSince int64
+	confirmWinAlarmed   int32
+	// the moving average latency from delivery to confirm, and the delay between
+	// the backend reads paced by it
+	confirmLatency int64
+	readPaceDelay  int64
+	// called while the reader caught up to the end after having backlog
+	onCaughtUp atomic.Value
+	// the pump caught up and waits the end updated without reading the backend
+	pumpIdle int32
+	// sample the delivered and confirmed messages for tracing
+	readSampler atomic.Value
+	// the spans of the delivery and the confirm of the messages
+	readSpanTracer atomic.Value
+	deliverSpans   deliverSpans
+	// the policy to route the poison messages to the dead letter topic
+	deadLetter atomic.Value
+	// the times of the message failed to route to the dead letter topic, protected by the inflight lock
+	deadLetterFailures map[MessageID]int
+	// the end failed to update to the reader, retried while flush
+	pendingEndMutex    sync.Mutex
+	pendingEnd         BackendQueueEnd
+	pendingForceReload bool
+	// the base of the offsets addressed by the external systems
+	offsetBase int64
 	// stat counters
 	EnableTrace int32
 	Ext         int32
@@ -145,10 +212,21 @@ type Channel struct {
 	channelStatsInfo *ChannelStatsInfo
 }
 
-// NewChannel creates a new instance of the Channel type and returns a pointer
+// NewChannel creates a new instance of the Channel type and returns a pointer, the error is
+// returned if the reader can not be loaded, and the reader meta is kept for the recovery.
 func NewChannel(topicName string, part int, channelName string, chEnd BackendQueueEnd, opt *Options,
 	deleteCallback func(*Channel), consumeDisabled int32,
-	notify INsqdNotify, ext int32) *Channel {
+	notify INsqdNotify, ext int32) (*Channel, error) {
+	return newChannelWithQueue(topicName, part, channelName, chEnd,
+		path.Join(opt.DataPath, topicName), getColdDataPath(opt.ColdDataPath, topicName), opt, deleteCallback,
+		consumeDisabled, notify, ext, nil)
+}
+
+// the channel reads the memory queue if not nil, or the disk queue of the topic in the queue path
+func newChannelWithQueue(topicName string, part int, channelName string, chEnd BackendQueueEnd,
+	queuePath string, coldPath string, opt *Options,
+	deleteCallback func(*Channel), consumeDisabled int32,
+	notify INsqdNotify, ext int32, memQueue *memoryQueue) (*Channel, error) {
 
 	c := &Channel{
 		topicName:              topicName,
@@ -170,6 +248,7 @@ func NewChannel(topicName string, part int, channelName string, chEnd BackendQue
 		endUpdatedChan:         make(chan bool, 1),
 		deleteCallback:         deleteCallback,
 		option:                 opt,
+		maxConfirmWin:          opt.MaxConfirmWin,
 		nsqdNotify:             notify,
 		consumeDisabled:        consumeDisabled,
 		delayedConfirmedMsgs:   make(map[MessageID]Message, MaxWaitingDelayed),
@@ -199,8 +278,16 @@ func NewChannel(topicName string, part int, channelName string, chEnd BackendQue
 	// backend names, for uniqueness, automatically include the topic...
 	backendReaderName := getBackendReaderName(c.topicName, c.topicPart, channelName)
 	backendName := getBackendName(c.topicName, c.topicPart)
-	c.backend = newDiskQueueReader(backendName, backendReaderName,
-		path.Join(opt.DataPath, c.topicName),
+	if memQueue != nil {
+		c.backend = memQueue.newReader(backendReaderName, chEnd)
+		go c.messagePump()
+
+		c.nsqdNotify.NotifyStateChanged(c, true)
+		return c, nil
+	}
+	backend, err := newTieredDiskQueueReader(backendName, backendReaderName,
+		queuePath,
+		coldPath,
 		opt.MaxBytesPerFile,
 		int32(minValidMsgLength),
 		int32(opt.MaxMsgSize)+minValidMsgLength,
@@ -208,12 +295,37 @@ func NewChannel(topicName string, part int, channelName string, chEnd BackendQue
 		opt.SyncTimeout,
 		chEnd,
 		false)
+	if err != nil {
+		// the error may be transient, so the meta is kept for the recovery and the consume
+		// offset should not be reset here.
+		nsqLog.LogErrorf("channel(%v) failed to load the reader: %v", channelName, err)
+		return nil, err
+	}
+	c.backend = backend
+	if opt.MetaSyncBatchWindow > 0 {
+		c.backend.(*diskQueueReader).SetSyncCoordinator(notify.metaSyncer())
+	}
+	c.backend.(*diskQueueReader).SetClampOverConfirm(opt.ClampOverConfirm)
+	c.backend.(*diskQueueReader).SetStrictConfirm(opt.StrictConfirm)
+	c.backend.(*diskQueueReader).SetParseMsgHeader(opt.ParseMsgHeader)
+	c.backend.(*diskQueueReader).SetConfirmBoundaryCheck(opt.ConfirmBoundary)
+	c.backend.(*diskQueueReader).SetCorruptionPolicy(opt.CorruptionPolicy)
+	c.backend.(*diskQueueReader).SetCorruptQuarantineDir(opt.CorruptQuarantinePath)
+	c.backend.(*diskQueueReader).SetEndDivergencePolicy(opt.EndDivergencePolicy)
+	if opt.ConfirmDeadline > 0 {
+		c.backend.(*diskQueueReader).SetConfirmDeadline(opt.ConfirmDeadline, int32(opt.ConfirmDeadlineMaxRedeliver))
+	}
+	if opt.ConfirmStore != nil && !c.ephemeral {
+		// only the leader saves the confirmed to the store
+		c.backend.(*diskQueueReader).SetConfirmStoreReadOnly(consumeDisabled == 1)
+		c.backend.(*diskQueueReader).SetConfirmStore(opt.ConfirmStore, c.topicName, channelName, c.topicPart)
+	}
 
 	go c.messagePump()
 
 	c.nsqdNotify.NotifyStateChanged(c, true)
 
-	return c
+	return c, nil
 }
 
 func (c *Channel) GetName() string {
@@ -311,6 +423,84 @@ func (c *Channel) SetDelayedQueue(dq *DelayQueue) {
 	c.delayedLock.Unlock()
 }
 
+// SetOnCaughtUp sets the callback fired in the message pump while the backend reader
+// read to the end after having backlog, it should not block.
+func (c *Channel) SetOnCaughtUp(cb func()) {
+	c.onCaughtUp.Store(cb)
+}
+
+func (c *Channel) notifyCaughtUp() {
+	cb, ok := c.onCaughtUp.Load().(func())
+	if ok && cb != nil {
+		cb()
+	}
+}
+
+// the points the message is sampled at
+const (
+	SamplePointDelivery = "delivery"
+	SamplePointConfirm  = "confirm"
+)
+
+const sampleRateScale = 10000
+
+type MessageSample struct {
+	Point    string
+	ID       MessageID
+	Offset   BackendOffset
+	Size     BackendOffset
+	Attempts uint16
+	// the latency from the delivery to the confirm, zero at the delivery
+	Latency time.Duration
+}
+
+// ReadSampler samples the fraction of the messages by the message id, so the same message
+// is sampled at both the delivery and the confirm.
+type ReadSampler struct {
+	// the fraction of the messages to be sampled, all for 1 or above
+	Rate     float64
+	Callback func(MessageSample)
+}
+
+func (s *ReadSampler) isSampled(id MessageID) bool {
+	if s.Rate >= 1 {
+		return true
+	}
+	return uint64(id)%sampleRateScale < uint64(s.Rate*sampleRateScale)
+}
+
+// SetReadSampler sets the sampler for the delivered and confirmed messages, nil to disable.
+// The callback is called without any lock held, it should not block.
+func (c *Channel) SetReadSampler(s *ReadSampler) {
+	c.readSampler.Store(s)
+}
+
+func (c *Channel) sampleMessage(point string, msg *Message, latency time.Duration) {
+	s, ok := c.readSampler.Load().(*ReadSampler)
+	if !ok || s == nil || s.Callback == nil || !s.isSampled(msg.ID) {
+		return
+	}
+	s.Callback(MessageSample{
+		Point:    point,
+		ID:       msg.ID,
+		Offset:   msg.Offset,
+		Size:     msg.RawMoveSize,
+		Attempts: msg.Attempts,
+		Latency:  latency,
+	})
+}
+
+func (c *Channel) sampleConfirm(msg *Message, err error) {
+	if err != nil || msg == nil {
+		return
+	}
+	var latency time.Duration
+	if !msg.deliveryTS.IsZero() {
+		latency = time.Since(msg.deliveryTS)
+	}
+	c.sampleMessage(SamplePointConfirm, msg, latency)
+}
+
 func (c *Channel) GetDelayedQueue() *DelayQueue {
 	c.delayedLock.RLock()
 	dq := c.delayedQueue
@@ -352,12 +542,12 @@ func (c *Channel) SetConsumeOffset(offset BackendOffset, cnt int64, force bool)
 	_, ok := c.backend.(*diskQueueReader)
 	if ok {
 		select {
-		case c.readerChanged <- resetChannelData{offset, cnt, true}:
+		case c.readerChanged <- resetChannelData{Offset: offset, Cnt: cnt, ClearConfirmed: true}:
 		default:
 			nsqLog.Logf("ignored the reader reset: %v:%v", offset, cnt)
 			if offset > 0 && cnt > 0 {
 				select {
-				case c.readerChanged <- resetChannelData{offset, cnt, true}:
+				case c.readerChanged <- resetChannelData{Offset: offset, Cnt: cnt, ClearConfirmed: true}:
 				case <-time.After(time.Second):
 					nsqLog.Logf("ignored the reader reset finally: %v:%v", offset, cnt)
 				}
@@ -369,13 +559,136 @@ func (c *Channel) SetConsumeOffset(offset BackendOffset, cnt int64, force bool)
 	return nil
 }
 
+// ResetToStart resets the channel to consume from the oldest retained data,
+// all the retained messages will be redelivered.
+func (c *Channel) ResetToStart() error {
+	if c.IsConsumeDisabled() {
+		return ErrConsumeDisabled
+	}
+	if _, ok := c.backend.(*diskQueueReader); !ok {
+		return ErrNotDiskQueueReader
+	}
+	select {
+	case c.readerChanged <- resetChannelData{Offset: resetToQueueStart, ClearConfirmed: true}:
+	case <-time.After(time.Second):
+		nsqLog.Logf("channel %v ignored the reset to queue start", c.GetName())
+		return ErrChannelResetTimeout
+	}
+	return nil
+}
+
+// StartReadFromFile resets the channel to read from the beginning of the data file
+// regardless of the confirmed, the file should exist in the queue.
+func (c *Channel) StartReadFromFile(fileNum int64) error {
+	if c.IsConsumeDisabled() {
+		return ErrConsumeDisabled
+	}
+	d, ok := c.backend.(*diskQueueReader)
+	if !ok {
+		return ErrNotDiskQueueReader
+	}
+	if _, err := d.GetFileStart(fileNum); err != nil {
+		return err
+	}
+	select {
+	case c.readerChanged <- resetChannelData{Offset: resetToFileStart, Cnt: fileNum, ClearConfirmed: true}:
+	case <-time.After(time.Second):
+		nsqLog.Logf("channel %v ignored the reset to file %v", c.GetName(), fileNum)
+		return ErrChannelResetTimeout
+	}
+	return nil
+}
+
+// resetReaderByFunc runs the reset on the disk reader in the message pump, so the messages
+// already read and waiting are drained as the other resets, and the result is returned.
+func (c *Channel) resetReaderByFunc(reset func(d *diskQueueReader) error) error {
+	if _, ok := c.backend.(*diskQueueReader); !ok {
+		return ErrNotDiskQueueReader
+	}
+	result := make(chan error, 1)
+	select {
+	case c.readerChanged <- resetChannelData{Offset: resetByFunc, ResetFunc: reset, Result: result}:
+	case <-time.After(time.Second):
+		nsqLog.Logf("channel %v ignored the reader reset", c.GetName())
+		return ErrChannelResetTimeout
+	case <-c.exitChan:
+		return ErrExiting
+	}
+	select {
+	case err := <-result:
+		return err
+	case <-c.exitChan:
+		return ErrExiting
+	}
+}
+
+// ImportReaderState restores the reader state exported from the other reader over the same
+// data, the messages after the imported confirmed will be delivered.
+func (c *Channel) ImportReaderState(data []byte) error {
+	if c.IsConsumeDisabled() {
+		return ErrConsumeDisabled
+	}
+	return c.resetReaderByFunc(func(d *diskQueueReader) error {
+		return d.ImportState(data)
+	})
+}
+
+// ConfirmPastMessageAt confirms past the single message at the confirmed frontier of the
+// channel, the messages already read are drained and the channel reads from the new confirmed.
+func (c *Channel) ConfirmPastMessageAt(offset BackendOffset) (BackendOffset, error) {
+	if c.IsConsumeDisabled() {
+		return 0, ErrConsumeDisabled
+	}
+	var confirmed BackendOffset
+	err := c.resetReaderByFunc(func(d *diskQueueReader) error {
+		var err error
+		confirmed, err = d.ConfirmPastMessageAt(offset)
+		return err
+	})
+	return confirmed, err
+}
+
+// SkipMessages skips the n messages from the confirmed of the channel without delivering them,
+// the messages already read are drained and the channel reads from the new confirmed.
+func (c *Channel) SkipMessages(n int64) (BackendOffset, int64, error) {
+	if c.IsConsumeDisabled() {
+		return 0, 0, ErrConsumeDisabled
+	}
+	var confirmed BackendOffset
+	var skipped int64
+	err := c.resetReaderByFunc(func(d *diskQueueReader) error {
+		var err error
+		confirmed, skipped, err = d.SkipMessages(n)
+		return err
+	})
+	return confirmed, skipped, err
+}
+
+// ExportReaderState returns the resumable state of the channel reader.
+func (c *Channel) ExportReaderState() ([]byte, error) {
+	d, ok := c.backend.(*diskQueueReader)
+	if !ok {
+		return nil, ErrNotDiskQueueReader
+	}
+	return d.ExportState()
+}
+
+// GetChannelStart returns the oldest retained data the channel can reset to.
+func (c *Channel) GetChannelStart() (BackendQueueEnd, error) {
+	d, ok := c.backend.(*diskQueueReader)
+	if !ok {
+		return nil, ErrNotDiskQueueReader
+	}
+	return d.GetQueueStart()
+}
+
 func (c *Channel) SetOrdered(enable bool) {
 	if enable {
 		if !atomic.CompareAndSwapInt32(&c.requireOrder, 0, 1) {
 			return
 		}
 		select {
-		case c.readerChanged <- resetChannelData{BackendOffset(-1), 0, true}:
+		case c.readerChanged <- resetChannelData{Offset: BackendOffset(-1), ClearConfirmed: true}:
 		default:
 		}
 	} else {
@@ -391,6 +704,49 @@ func (c *Channel) SetOrdered(enable bool) {
 	}
 }
 
+// SetOffsetBase changes the base of the offsets addressed by the external systems, the offsets
+// in the stats and from the offset base reader are shifted by the base.
+func (c *Channel) SetOffsetBase(base BackendOffset) error {
+	if base < 0 {
+		return ErrInvalidOffset
+	}
+	atomic.StoreInt64(&c.offsetBase, int64(base))
+	return nil
+}
+
+func (c *Channel) GetOffsetBase() BackendOffset {
+	return BackendOffset(atomic.LoadInt64(&c.offsetBase))
+}
+
+// GetOffsetBaseReader returns the reader of the channel addressed with the offsets from the base,
+// the offsets passed to it are shifted back to the internal.
+func (c *Channel) GetOffsetBaseReader() (*OffsetBaseReader, error) {
+	return NewOffsetBaseReader(c.backend, c.GetOffsetBase())
+}
+
+// SetFileHeaderLen changes the length of the header of each data file skipped by the reader.
+func (c *Channel) SetFileHeaderLen(headerLen int64) error {
+	if d, ok := c.backend.(*diskQueueReader); ok {
+		return d.SetFileHeaderLen(headerLen)
+	}
+	return nil
+}
+
+// SetSyncPolicy overrides the node-wide sync policy of the channel reader.
+func (c *Channel) SetSyncPolicy(syncEvery int64, syncTimeout time.Duration) {
+	if d, ok := c.backend.(*diskQueueReader); ok {
+		d.SetSyncPolicy(syncEvery, syncTimeout)
+	}
+}
+
+// GetSyncPolicy returns the sync policy used by the channel reader, zero if not disk backed.
+func (c *Channel) GetSyncPolicy() (int64, time.Duration) {
+	if d, ok := c.backend.(*diskQueueReader); ok {
+		return d.GetSyncPolicy()
+	}
+	return 0, 0
+}
+
 func (c *Channel) IsOrdered() bool {
 	return atomic.LoadInt32(&c.requireOrder) == 1
 }
@@ -464,6 +820,7 @@ func (c *Channel) exit(deleted bool) error {
 
 	close(c.exitChan)
 	<-c.exitSyncChan
+	c.endAllDeliverSpans(ErrExiting)
 
 	// write anything leftover to disk
 	c.flush()
@@ -493,6 +850,7 @@ func (c *Channel) skipChannelToEnd() (BackendQueueEnd, error) {
 }
 
 func (c *Channel) flush() error {
+	c.retryPendingEnd()
 	d, ok := c.backend.(*diskQueueReader)
 	if ok {
 		d.Flush()
@@ -500,6 +858,32 @@ func (c *Channel) flush() error {
 	return nil
 }
 
+// IsDegraded returns true if the consume meta of the channel can not be persisted.
+func (c *Channel) IsDegraded() bool {
+	if d, ok := c.backend.(*diskQueueReader); ok {
+		return d.IsDegraded()
+	}
+	return false
+}
+
+// WatchConfirmed returns the channel receiving the confirmed offset changes of the channel.
+func (c *Channel) WatchConfirmed() <-chan BackendOffset {
+	if d, ok := c.backend.(*diskQueueReader); ok {
+		return d.WatchConfirmed()
+	}
+	ch := make(chan BackendOffset)
+	close(ch)
+	return ch
+}
+
+// DrainToEnd blocks until all the messages before the current end of the channel are confirmed.
+func (c *Channel) DrainToEnd(ctx context.Context) error {
+	if d, ok := c.backend.(*diskQueueReader); ok {
+		return d.DrainToEnd(ctx)
+	}
+	return ErrNotDiskQueueReader
+}
+
 func (c *Channel) Depth() int64 {
 	return c.backend.Depth()
 }
@@ -511,6 +895,109 @@ func (c *Channel) DepthSize() int64 {
 	return 0
 }
 
+// IsReaderHalted returns true if the read is halted by the corrupt data.
+func (c *Channel) IsReaderHalted() bool {
+	if d, ok := c.backend.(*diskQueueReader); ok {
+		return d.IsCorruptionHalted()
+	}
+	return false
+}
+
+// GetReaderRewindCount returns the times of the read position rewound by the topic end
+// moved backward, it may indicate the topic data truncated or rolled back.
+func (c *Channel) GetReaderRewindCount() int64 {
+	if d, ok := c.backend.(*diskQueueReader); ok {
+		return d.RewindCount()
+	}
+	return 0
+}
+
+// GetReaderCorruptSkipCount returns the times of the corrupt data skipped by the reader,
+// the logs of the repeated corruption are limited so this should be checked for the detail.
+func (c *Channel) GetReaderCorruptSkipCount() int64 {
+	if d, ok := c.backend.(*diskQueueReader); ok {
+		return d.CorruptSkipCount()
+	}
+	return 0
+}
+
+// GetReaderDeadlineRedelivers returns the times of the read rewound by the confirm deadline,
+// the messages not confirmed after redelivered the max times by the deadline, and the messages
+// delivered without the deadline tracked.
+func (c *Channel) GetReaderDeadlineRedelivers() (int64, int64, int64) {
+	if d, ok := c.backend.(*diskQueueReader); ok {
+		return d.DeadlineRedeliverCount(), d.DeadlineExhaustedCount(), d.DeadlineUntrackedCount()
+	}
+	return 0, 0, 0
+}
+
+// signal the message pump to redeliver the messages not confirmed before the deadline, it is
+// checked while scanning the in flight messages, so it should never wait the message pump.
+func (c *Channel) checkConfirmDeadlines() {
+	d, ok := c.backend.(*diskQueueReader)
+	if !ok || !d.HasExpiredConfirmDeadline() {
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&c.deadlineRedeliverPending, 0, 1) {
+		return
+	}
+	select {
+	case c.readerChanged <- resetChannelData{Offset: resetByConfirmDeadline}:
+	default:
+		// retry in the next scan
+		atomic.StoreInt32(&c.deadlineRedeliverPending, 0)
+	}
+}
+
+func (c *Channel) GetReaderEndMismatchCount() int64 {
+	if d, ok := c.backend.(*diskQueueReader); ok {
+		return d.EndTypeMismatchCount()
+	}
+	return 0
+}
+
+func (c *Channel) GetReaderLatencyStats() ReaderLatencyStats {
+	if d, ok := c.backend.(*diskQueueReader); ok {
+		return d.LatencyStats()
+	}
+	return ReaderLatencyStats{}
+}
+
+// GetBackendType returns the backend type of the channel reader, it is decided
+// while the reader created so no lock is needed.
+func (c *Channel) GetBackendType() string {
+	if c.backend == nil {
+		return ""
+	}
+	return c.backend.BackendType()
+}
+
+func (c *Channel) IsDiskBacked() bool {
+	return c.GetBackendType() == BackendTypeDisk
+}
+
+// GetReaderMsgSizeHistogram returns the message size distribution read by the reader.
+func (c *Channel) GetReaderMsgSizeHistogram() []MsgSizeBucket {
+	if d, ok := c.backend.(*diskQueueReader); ok {
+		return d.GetMsgSizeHistogram()
+	}
+	return nil
+}
+
+func (c *Channel) setReaderStagedBytes(n int64) {
+	if d, ok := c.backend.(*diskQueueReader); ok {
+		d.SetStagedBytes(n)
+	}
+}
+
+// GetReaderBufferedBytes returns the data size buffered in memory by the reader.
+func (c *Channel) GetReaderBufferedBytes() int64 {
+	if d, ok := c.backend.(*diskQueueReader); ok {
+		return d.GetBufferedBytes()
+	}
+	return 0
+}
+
 func (c *Channel) DepthTimestamp() int64 {
 	return atomic.LoadInt64(&c.waitingProcessMsgTs)
 }
@@ -554,6 +1041,118 @@ func (c *Channel) UnSkip() error {
 	return c.doSkip(false)
 }
 
+// IsThrottled returns true if the channel is stalled on reading
+// because of too many waiting confirmed or the read error.
+func (c *Channel) IsThrottled() bool {
+	return atomic.LoadInt32(&c.throttledByWin) == 1 ||
+		atomic.LoadInt32(&c.throttledByErr) == 1
+}
+
+// IsConfirmWinAlarmed returns true if the channel is stalled on the confirm window too long.
+func (c *Channel) IsConfirmWinAlarmed() bool {
+	return atomic.LoadInt32(&c.confirmWinAlarmed) == 1
+}
+
+// GetConfirmWin returns the max messages waiting confirmed before the reader is throttled.
+func (c *Channel) GetConfirmWin() int64 {
+	return atomic.LoadInt64(&c.maxConfirmWin)
+}
+
+// SetConfirmWin changes the confirm window at runtime, and the reader throttled by the window
+// is notified to read again at once, so the stalled channel can be resumed by widening the window.
+func (c *Channel) SetConfirmWin(win int64) error {
+	if win <= 0 {
+		return ErrInvalidConfirmWin
+	}
+	old := atomic.SwapInt64(&c.maxConfirmWin, win)
+	if old == win {
+		return nil
+	}
+	nsqLog.Logf("topic %v channel %v confirm window changed from %v to %v",
+		c.GetTopicName(), c.GetName(), old, win)
+	if win > old && atomic.LoadInt32(&c.needNotifyRead) == 1 {
+		select {
+		case c.tryReadBackend <- true:
+		default:
+		}
+	}
+	return nil
+}
+
+// should be called in the message pump only
+func (c *Channel) setThrottledByWin(throttled bool) {
+	if throttled {
+		atomic.StoreInt32(&c.throttledByWin, 1)
+		if atomic.LoadInt64(&c.throttledByWinSince) == 0 {
+			atomic.StoreInt64(&c.throttledByWinSince, time.Now().UnixNano())
+		}
+		return
+	}
+	atomic.StoreInt32(&c.throttledByWin, 0)
+	atomic.StoreInt64(&c.throttledByWinSince, 0)
+	if atomic.CompareAndSwapInt32(&c.confirmWinAlarmed, 1, 0) {
+		nsqLog.Logf("channel %v-%v confirm window breaker reset, confirmed: %v",
+			c.GetTopicName(), c.GetName(), c.GetConfirmed())
+	}
+}
+
+// checkConfirmWinBreaker trips the breaker if the confirm window is saturated longer than the timeout,
+// the breaker will be reset while the reader resumed.
+func (c *Channel) checkConfirmWinBreaker(tnow int64) {
+	timeout := c.option.ConfirmWinBreakerTimeout
+	if timeout <= 0 {
+		return
+	}
+	since := atomic.LoadInt64(&c.throttledByWinSince)
+	if since == 0 || tnow-since < int64(timeout) {
+		return
+	}
+	if atomic.CompareAndSwapInt32(&c.confirmWinAlarmed, 0, 1) {
+		nsqLog.LogErrorf("channel %v-%v confirm window saturated for %v, breaker tripped, waiting confirm: %v, confirmed: %v",
+			c.GetTopicName(), c.GetName(), time.Duration(tnow-since), c.GetChannelWaitingConfirmCnt(), c.GetConfirmed())
+	}
+}
+
+func (c *Channel) updateConfirmLatency(latency time.Duration) {
+	old := atomic.LoadInt64(&c.confirmLatency)
+	newLatency := int64(latency)
+	if old > 0 {
+		newLatency = old - old/confirmLatencyWeight + newLatency/confirmLatencyWeight
+	}
+	atomic.StoreInt64(&c.confirmLatency, newLatency)
+}
+
+func (c *Channel) GetConfirmLatency() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.confirmLatency))
+}
+
+func (c *Channel) GetReadPaceDelay() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.readPaceDelay))
+}
+
+// the read is paced while the waiting confirm is over the half of the max confirm window,
+// and the delay grows with the confirm latency as the window is close to the max, so the read
+// rate will slow down to the confirm rate before the reader is throttled by the window.
+func (c *Channel) computeReadPaceDelay() time.Duration {
+	var delay int64
+	maxWin := c.GetConfirmWin()
+	if c.option.AdaptiveReadPacing && maxWin > 1 {
+		half := maxWin / 2
+		waiting := c.GetChannelWaitingConfirmCnt()
+		if waiting > half {
+			if waiting > maxWin {
+				waiting = maxWin
+			}
+			delay = atomic.LoadInt64(&c.confirmLatency) / maxWin * (waiting - half) / (maxWin - half)
+			if delay > int64(maxReadPaceDelay) {
+				delay = int64(maxReadPaceDelay)
+			}
+		}
+	}
+	atomic.StoreInt64(&c.readPaceDelay, delay)
+	return time.Duration(delay)
+}
+
 func (c *Channel) IsSkipped() bool {
 	return atomic.LoadInt32(&c.skipped) == 1
 }
@@ -575,10 +1174,76 @@ func (c *Channel) UpdateQueueEnd(end BackendQueueEnd, forceReload bool) error {
 	if end == nil {
 		return nil
 	}
-	changed, err := c.backend.UpdateQueueEnd(end, forceReload)
-	if !changed || err != nil {
+	c.pendingEndMutex.Lock()
+	defer c.pendingEndMutex.Unlock()
+	if c.pendingEnd != nil {
+		// the force reload of the failed one should not be lost
+		forceReload = forceReload || c.pendingForceReload
+	}
+	return c.updateQueueEndNoLock(end, forceReload)
+}
+
+// retry the end failed to update before, so the reader end can converge
+// even if no more new end.
+func (c *Channel) retryPendingEnd() error {
+	c.pendingEndMutex.Lock()
+	defer c.pendingEndMutex.Unlock()
+	if c.pendingEnd == nil {
+		return nil
+	}
+	nsqLog.Logf("channel %v retry the pending end: %v", c.GetName(), c.pendingEnd)
+	return c.updateQueueEndNoLock(c.pendingEnd, c.pendingForceReload)
+}
+
+// ResyncQueueEnd forces the reader to adopt the end of the topic, it is used to recover
+// the reads stalled by the reader end drifted from the topic.
+func (c *Channel) ResyncQueueEnd(end BackendQueueEnd) error {
+	d, ok := c.backend.(*diskQueueReader)
+	if !ok || end == nil {
+		return nil
+	}
+	c.pendingEndMutex.Lock()
+	defer c.pendingEndMutex.Unlock()
+	err := d.ResyncEnd(end)
+	if err != nil {
+		nsqLog.LogWarningf("channel %v failed to resync end %v: %v", c.GetName(), end, err)
+		return err
+	}
+	// the pending end is older than the resynced one
+	c.pendingEnd = nil
+	c.pendingForceReload = false
+	if !c.IsConsumeDisabled() {
+		select {
+		case c.endUpdatedChan <- true:
+		default:
+		}
+	}
+	return nil
+}
+
+func (c *Channel) updateQueueEndNoLock(end BackendQueueEnd, forceReload bool) error {
+	var changed bool
+	var err error
+	for i := 0; i < maxEndUpdateRetry; i++ {
+		changed, err = c.backend.UpdateQueueEnd(end, forceReload)
+		if err == nil || err == ErrExiting || err == ErrOffsetTypeMismatch {
+			break
+		}
+		nsqLog.LogWarningf("channel %v failed to update end %v (retried %v): %v", c.GetName(), end, i, err)
+	}
+	if err != nil {
+		// the mismatched end will never be applied by the retry
+		if err != ErrExiting && err != ErrOffsetTypeMismatch {
+			c.pendingEnd = end
+			c.pendingForceReload = forceReload
+		}
 		return err
 	}
+	c.pendingEnd = nil
+	c.pendingForceReload = false
+	if !changed {
+		return nil
+	}
 
 	if c.IsConsumeDisabled() {
 	} else {
@@ -739,9 +1404,10 @@ func (c *Channel) ConfirmBackendQueue(msg *Message) (BackendOffset, int64, bool)
 					msg.Offset, msg.queueCntIndex, mergedInterval, newConfirmed)
 			}
 			c.confirmedMsgs.DeleteInterval(mergedInterval)
+			newConfirmed, confirmedCnt = c.confirmPastSkipped(newConfirmed, confirmedCnt)
 			atomic.StoreInt32(&c.waitingConfirm, int32(c.confirmedMsgs.Len()))
 		}
-		if int64(c.confirmedMsgs.Len()) < c.option.MaxConfirmWin/2 &&
+		if int64(c.confirmedMsgs.Len()) < c.GetConfirmWin()/2 &&
 			atomic.LoadInt32(&c.needNotifyRead) == 1 &&
 			!c.IsOrdered() {
 			select {
@@ -750,7 +1416,7 @@ func (c *Channel) ConfirmBackendQueue(msg *Message) (BackendOffset, int64, bool)
 			}
 		}
 	}
-	if int64(c.confirmedMsgs.Len()) > c.option.MaxConfirmWin {
+	if int64(c.confirmedMsgs.Len()) > c.GetConfirmWin() {
 		curConfirm = c.GetConfirmed()
 		flightCnt := len(c.inFlightMessages)
 		if flightCnt == 0 && nsqLog.Level() >= levellogger.LOG_DEBUG {
@@ -764,6 +1430,34 @@ func (c *Channel) ConfirmBackendQueue(msg *Message) (BackendOffset, int64, bool)
 	// backend queue to force read the data from disk again.
 }
 
+// the backend moves the confirmed past the data skipped without delivery (filtered or corrupt)
+// once the confirm reaches it, and the messages confirmed after the skipped data are merged here.
+// should be protected by the confirm lock
+func (c *Channel) confirmPastSkipped(confirmed BackendOffset, cnt int64) (BackendOffset, int64) {
+	for {
+		cur := c.GetConfirmed()
+		if cur.Offset() <= confirmed {
+			return confirmed, cnt
+		}
+		confirmed = cur.Offset()
+		cnt = cur.TotalMsgCnt()
+		c.confirmedMsgs.DeleteLower(int64(confirmed))
+		next := c.confirmedMsgs.StartAt(int64(confirmed))
+		if next == nil {
+			return confirmed, cnt
+		}
+		err := c.backend.ConfirmRead(BackendOffset(next.End()), int64(next.EndCnt()))
+		if err != nil {
+			nsqLog.LogWarningf("channel (%v): confirm read past the skipped data failed: %v, interval: %v",
+				c.GetName(), err, next)
+			return confirmed, cnt
+		}
+		c.confirmedMsgs.DeleteInterval(next)
+		confirmed = BackendOffset(next.End())
+		cnt = int64(next.EndCnt())
+	}
+}
+
 func (c *Channel) ShouldWaitDelayed(msg *Message) bool {
 	if c.IsOrdered() {
 		return false
@@ -808,7 +1502,11 @@ func (c *Channel) IsConfirmed(msg *Message) bool {
 
 func (c *Channel) FinishMessage(clientID int64, clientAddr string,
 	id MessageID) (BackendOffset, int64, bool, *Message, error) {
-	return c.internalFinishMessage(clientID, clientAddr, id, false)
+	endSpan := c.startConfirmSpan(id)
+	offset, cnt, changed, msg, err := c.internalFinishMessage(clientID, clientAddr, id, false)
+	endSpan(msg, err)
+	c.sampleConfirm(msg, err)
+	return offset, cnt, changed, msg, err
 }
 
 func (c *Channel) FinishMessageForce(clientID int64, clientAddr string,
@@ -816,7 +1514,11 @@ func (c *Channel) FinishMessageForce(clientID int64, clientAddr string,
 	if forceFin {
 		nsqLog.Logf("topic %v channel %v force finish msg %v", c.GetTopicName(), c.GetName(), id)
 	}
-	return c.internalFinishMessage(clientID, clientAddr, id, forceFin)
+	endSpan := c.startConfirmSpan(id)
+	offset, cnt, changed, msg, err := c.internalFinishMessage(clientID, clientAddr, id, forceFin)
+	endSpan(msg, err)
+	c.sampleConfirm(msg, err)
+	return offset, cnt, changed, msg, err
 }
 
 // FinishMessage successfully discards an in-flight message
@@ -836,6 +1538,7 @@ func (c *Channel) internalFinishMessage(clientID int64, clientAddr string,
 			clientID)
 		return 0, 0, false, nil, err
 	}
+	delete(c.deadLetterFailures, id)
 	isOldDeferred := msg.IsDeferred()
 	if msg.TraceID != 0 || c.IsTraced() || nsqLog.Level() >= levellogger.LOG_DETAIL {
 		// if fin by no client address, means fin by internal delayed queue
@@ -848,6 +1551,9 @@ func (c *Channel) internalFinishMessage(clientID int64, clientAddr string,
 	if c.e2eProcessingLatencyStream != nil {
 		c.e2eProcessingLatencyStream.Insert(msg.Timestamp)
 	}
+	if clientAddr != "" && !msg.deliveryTS.IsZero() {
+		c.updateConfirmLatency(time.Since(msg.deliveryTS))
+	}
 	c.channelStatsInfo.UpdateChannelStats((time.Now().UnixNano() - msg.Timestamp) / int64(time.Millisecond))
 	var offset BackendOffset
 	var cnt int64
@@ -900,7 +1606,7 @@ func (c *Channel) isTooMuchDeferredInMem(deCnt int64) bool {
 	// it may be a bug in client which can not handle any more, so we just wait
 	// timeout not requeue to defer
 	cnt := c.GetChannelWaitingConfirmCnt()
-	if cnt >= c.option.MaxConfirmWin && float64(deCnt) > float64(cnt)*0.5 {
+	if cnt >= c.GetConfirmWin() && float64(deCnt) > float64(cnt)*0.5 {
 		nsqLog.Logf("too much delayed in memory: %v vs %v", deCnt, cnt)
 		return true
 	}
@@ -946,13 +1652,13 @@ func (c *Channel) ShouldRequeueToEnd(clientID int64, clientAddr string, id Messa
 	}
 
 	deCnt := atomic.LoadInt64(&c.deferredCount)
-	if (deCnt >= c.option.MaxConfirmWin) &&
+	if (deCnt >= c.GetConfirmWin()) &&
 		(timeout > threshold/2) {
 		// if requeued by deferred is more than half of the all messages handled,
 		// it may be a bug in client which can not handle any more, so we just wait
 		// timeout not requeue to defer
 		cnt := c.GetChannelWaitingConfirmCnt()
-		if cnt >= c.option.MaxConfirmWin && float64(deCnt) <= float64(cnt)*0.5 {
+		if cnt >= c.GetConfirmWin() && float64(deCnt) <= float64(cnt)*0.5 {
 			nsqLog.Logf("requeue msg to end %v, since too much delayed in memory: %v vs %v", id, deCnt, cnt)
 			return msg.GetCopy(), true
 		}
@@ -961,7 +1667,7 @@ func (c *Channel) ShouldRequeueToEnd(clientID int64, clientAddr string, id Messa
 		return nil, false
 	}
 	ts := time.Now().UnixNano() - c.DepthTimestamp()
-	isBlocking := atomic.LoadInt32(&c.waitingConfirm) >= int32(c.option.MaxConfirmWin)
+	isBlocking := atomic.LoadInt32(&c.waitingConfirm) >= int32(c.GetConfirmWin())
 	if isBlocking {
 		if msg.Timestamp > c.DepthTimestamp()+threshold.Nanoseconds() {
 			return nil, false
@@ -1017,6 +1723,9 @@ func (c *Channel) RequeueMessage(clientID int64, clientAddr string, id MessageID
 			msg.belongedConsumer.RequeuedMessage()
 			msg.belongedConsumer = nil
 		}
+		if c.tryDeadLetter(msg) {
+			return nil
+		}
 		return c.doRequeue(msg, clientAddr)
 	}
 	// change the timeout for inflight
@@ -1169,6 +1878,8 @@ func (c *Channel) StartInFlightTimeout(msg *Message, client Consumer, clientAddr
 	if msg.TraceID != 0 || c.IsTraced() || nsqLog.Level() >= levellogger.LOG_DETAIL {
 		nsqMsgTracer.TraceSub(c.GetTopicName(), c.GetName(), "START", msg.TraceID, msg, clientAddr)
 	}
+	c.sampleMessage(SamplePointDelivery, msg, 0)
+	c.startDeliverSpan(msg)
 	return shouldSend, nil
 }
 
@@ -1226,6 +1937,15 @@ func (c *Channel) GetChannelWaitingConfirmCnt() int64 {
 	return 0
 }
 
+// the message count window is used if the max in flight messages is set,
+// the messages read from backend but not confirmed should be less than it.
+func (c *Channel) isInFlightMsgsFull() bool {
+	if c.option.MaxInFlightMsgs <= 0 {
+		return false
+	}
+	return c.GetChannelWaitingConfirmCnt() >= c.option.MaxInFlightMsgs
+}
+
 // doRequeue performs the low level operations to requeue a message
 // should protect by inflight lock
 func (c *Channel) doRequeue(m *Message, clientAddr string) error {
@@ -1293,6 +2013,9 @@ func (c *Channel) IsConsumeDisabled() bool {
 func (c *Channel) DisableConsume(disable bool) {
 	c.Lock()
 	defer c.Unlock()
+	if d, ok := c.backend.(*diskQueueReader); ok {
+		d.SetConfirmStoreReadOnly(disable)
+	}
 	if disable {
 		if !atomic.CompareAndSwapInt32(&c.consumeDisabled, 0, 1) {
 			return
@@ -1348,7 +2071,7 @@ func (c *Channel) DisableConsume(disable bool) {
 				}
 			}
 			select {
-			case c.readerChanged <- resetChannelData{BackendOffset(-1), 0, false}:
+			case c.readerChanged <- resetChannelData{Offset: BackendOffset(-1)}:
 			default:
 			}
 		}
@@ -1451,14 +2174,52 @@ func (c *Channel) resetReaderToConfirmed() error {
 func (c *Channel) resetChannelReader(resetOffset resetChannelData, lastDataNeedRead *bool, origReadChan chan ReadResult,
 	lastMsg *Message, needReadBackend *bool, readBackendWait *bool) {
 	var err error
-	if resetOffset.Offset == BackendOffset(-1) {
+	d, isDisk := c.backend.(*diskQueueReader)
+	if !isDisk && resetOffset.Offset != BackendOffset(-1) {
+		nsqLog.Warningf("channel %v reader %v can not be reset to %v", c.GetName(), c.GetBackendType(), resetOffset)
+		return
+	}
+	if resetOffset.Offset == resetByFunc {
+		err = resetOffset.ResetFunc(d)
+		if err != nil {
+			nsqLog.Warningf("channel %v failed to reset reader: %v", c.GetName(), err)
+		} else {
+			c.drainChannelWaiting(true, lastDataNeedRead, origReadChan)
+			*lastMsg = Message{}
+		}
+		resetOffset.Result <- err
+		*needReadBackend = true
+		*readBackendWait = false
+	} else if resetOffset.Offset == resetByConfirmDeadline {
+		atomic.StoreInt32(&c.deadlineRedeliverPending, 0)
+		d.Lock()
+		d.redeliverExpiredConfirmDeadline()
+		d.Unlock()
+		c.drainChannelWaiting(true, lastDataNeedRead, origReadChan)
+		*lastMsg = Message{}
+		*needReadBackend = true
+		*readBackendWait = false
+	} else if resetOffset.Offset == resetToQueueStart || resetOffset.Offset == resetToFileStart {
+		if resetOffset.Offset == resetToQueueStart {
+			_, err = d.ResetReadToStart()
+		} else {
+			_, err = d.ResetReadToFile(resetOffset.Cnt)
+		}
+		if err != nil {
+			nsqLog.Warningf("failed to reset reader to %v, %v", resetOffset, err)
+		} else {
+			c.drainChannelWaiting(true, lastDataNeedRead, origReadChan)
+			*lastMsg = Message{}
+		}
+		*needReadBackend = true
+		*readBackendWait = false
+	} else if resetOffset.Offset == BackendOffset(-1) {
 		if resetOffset.ClearConfirmed {
 			atomic.StoreInt32(&c.needResetReader, 2)
 		} else {
 			atomic.StoreInt32(&c.needResetReader, 1)
 		}
 	} else {
-		d := c.backend.(*diskQueueReader)
 		_, err = d.ResetReadToOffset(resetOffset.Offset, resetOffset.Cnt)
 		if err != nil {
 			nsqLog.Warningf("failed to reset reader to %v, %v", resetOffset, err)
@@ -1484,13 +2245,21 @@ func (c *Channel) messagePump() {
 	var readChan <-chan ReadResult
 	var waitEndUpdated chan bool
 
-	maxWin := int32(c.option.MaxConfirmWin)
 	resumedFirst := true
 	d := c.backend
 	needReadBackend := true
 	lastDataNeedRead := false
 	readBackendWait := false
 	backendErr := 0
+	hasBacklog := false
+	var lastCaughtUp time.Time
+	var lastBackendRead time.Time
+	var paceWait <-chan time.Time
+	// the read result waiting in the read chan and the message waiting to be delivered
+	var prefetchedBytes int64
+	var stagedBytes int64
+	// the backend is not read again until the end is updated or the reader changed
+	caughtUp := false
 LOOP:
 	for {
 		// do an extra check for closed exit before we select on all the memory/backend/exitChan
@@ -1499,7 +2268,15 @@ LOOP:
 		if atomic.LoadInt32(&c.exitFlag) == 1 {
 			goto exit
 		}
+		// the message staged before is delivered or dropped, and the prefetched may be drained
+		if !lastDataNeedRead {
+			prefetchedBytes = 0
+		}
+		stagedBytes = 0
+		c.setReaderStagedBytes(prefetchedBytes + stagedBytes)
 
+		// the window may be changed at runtime
+		maxWin := int32(c.GetConfirmWin())
 		resetReaderFlag := atomic.LoadInt32(&c.needResetReader)
 		if resetReaderFlag > 0 {
 			nsqLog.Infof("reset the reader : %v", c.GetConfirmed())
@@ -1525,6 +2302,8 @@ LOOP:
 				c.drainChannelWaiting(needClearConfirm, &lastDataNeedRead, origReadChan)
 				lastMsg = Message{}
 			}
+			caughtUp = false
+			atomic.StoreInt32(&c.pumpIdle, 0)
 			readChan = origReadChan
 			needReadBackend = true
 			readBackendWait = false
@@ -1539,6 +2318,7 @@ LOOP:
 					c.GetConfirmed())
 			}
 			atomic.StoreInt32(&c.needNotifyRead, 1)
+			c.setThrottledByWin(true)
 
 			readChan = nil
 			needReadBackend = false
@@ -1552,7 +2332,20 @@ LOOP:
 				nsqLog.Warningf("many confirmed but no inflight: %v, %v, %v",
 					c.GetTopicName(), c.GetName(), atomic.LoadInt32(&c.waitingConfirm))
 			}
+		} else if c.isInFlightMsgsFull() {
+			if nsqLog.Level() >= levellogger.LOG_DEBUG {
+				nsqLog.LogDebugf("channel %v reader is holding by the unconfirmed messages: %v, %v",
+					c.GetName(),
+					c.GetChannelWaitingConfirmCnt(),
+					c.GetConfirmed())
+			}
+			atomic.StoreInt32(&c.needNotifyRead, 1)
+			c.setThrottledByWin(true)
+
+			readChan = nil
+			needReadBackend = false
 		} else {
+			c.setThrottledByWin(false)
 			readChan = origReadChan
 			needReadBackend = true
 		}
@@ -1560,6 +2353,8 @@ LOOP:
 		if c.IsConsumeDisabled() {
 			readChan = nil
 			needReadBackend = false
+			caughtUp = false
+			atomic.StoreInt32(&c.pumpIdle, 0)
 			nsqLog.Logf("channel consume is disabled : %v", c.name)
 			if lastMsg.ID > 0 {
 				nsqLog.Logf("consume disabled at last read message: %v:%v", lastMsg.ID, lastMsg.Offset)
@@ -1567,18 +2362,45 @@ LOOP:
 			}
 		}
 
-		if needReadBackend {
+		paceWait = nil
+		if needReadBackend && !lastDataNeedRead && !caughtUp {
+			if delay := c.computeReadPaceDelay(); delay > 0 {
+				if left := delay - time.Since(lastBackendRead); left > 0 {
+					readChan = nil
+					needReadBackend = false
+					paceWait = time.After(left)
+				}
+			}
+		}
+
+		if needReadBackend && caughtUp && !lastDataNeedRead {
+			// nothing to read until the end updated, skip locking the backend
+			readChan = nil
+			waitEndUpdated = c.endUpdatedChan
+		} else if needReadBackend {
 			if !lastDataNeedRead {
 				dataRead, hasData := d.TryReadOne()
 				if hasData {
+					lastBackendRead = time.Now()
+					hasBacklog = true
 					lastDataNeedRead = true
 					origReadChan <- dataRead
+					prefetchedBytes = int64(len(dataRead.Data))
+					c.setReaderStagedBytes(prefetchedBytes + stagedBytes)
 					readChan = origReadChan
 					waitEndUpdated = nil
 				} else {
 					if nsqLog.Level() >= levellogger.LOG_DEBUG {
 						nsqLog.LogDebugf("no data to be read: %v", c.name)
 					}
+					// debounce the caught up while the end is updated rapidly
+					if hasBacklog && time.Since(lastCaughtUp) >= caughtUpDebounce {
+						lastCaughtUp = time.Now()
+						c.notifyCaughtUp()
+					}
+					hasBacklog = false
+					caughtUp = true
+					atomic.StoreInt32(&c.pumpIdle, 1)
 					readChan = nil
 					waitEndUpdated = c.endUpdatedChan
 				}
@@ -1594,6 +2416,8 @@ LOOP:
 		select {
 		case <-c.exitChan:
 			goto exit
+		case <-paceWait:
+			continue LOOP
 		case msg = <-c.requeuedMsgChan:
 			if msg.TraceID != 0 || c.IsTraced() || nsqLog.Level() >= levellogger.LOG_DETAIL {
 				nsqLog.LogDebugf("read message %v from requeue", msg.ID)
@@ -1601,19 +2425,27 @@ LOOP:
 			}
 		case data = <-readChan:
 			lastDataNeedRead = false
+			prefetchedBytes = 0
+			stagedBytes = int64(len(data.Data))
+			c.setReaderStagedBytes(prefetchedBytes + stagedBytes)
 			if data.Err != nil {
+				atomic.StoreInt32(&c.throttledByErr, 1)
 				nsqLog.LogErrorf("channel (%v): failed to read message - %s", c.GetName(), data.Err)
-				if data.Err == ErrReadQueueCountMissing {
+				if data.Err == ErrReadQueueCountMissing || data.Err == ErrReadFileUnavailable {
+					// the readable data should not be skipped as the corruption
 					time.Sleep(time.Second)
 				} else {
 					// TODO: fix corrupt file from other replica.
 					// and should handle the confirm offset, since some skipped data
 					// may never be confirmed any more
 					if backendErr > 10 {
-						_, skipErr := c.backend.(*diskQueueReader).SkipToNext()
-						if skipErr != nil {
+						// skip or halt by the corruption policy
+						if diskQ, ok := c.backend.(*diskQueueReader); ok {
+							diskQ.SkipCorruption()
+						} else {
+							c.backend.SkipReadToEnd()
 						}
-						nsqLog.Warningf("channel %v skip to next because of backend error: %v", c.GetName(), backendErr)
+						nsqLog.Warningf("channel %v skip corruption because of backend error: %v", c.GetName(), backendErr)
 						isSkipped = true
 						backendErr = 0
 					} else {
@@ -1628,32 +2460,56 @@ LOOP:
 				nsqLog.Infof("channel %v backend error auto recovery: %v", c.GetName(), backendErr)
 			}
 			backendErr = 0
-			msg, err = decodeMessage(data.Data, c.IsExt())
-			if err != nil {
-				nsqLog.LogErrorf("channel (%v): failed to decode message - %s - %v", c.GetName(), err, data)
-				continue LOOP
-			}
-			msg.Offset = data.Offset
-			msg.RawMoveSize = data.MovedSize
-			msg.queueCntIndex = data.CurCnt
-			if msg.TraceID != 0 || c.IsTraced() || nsqLog.Level() >= levellogger.LOG_DETAIL {
-				nsqMsgTracer.TraceSub(c.GetTopicName(), c.GetName(), "READ_QUEUE", msg.TraceID, msg, "0")
+			atomic.StoreInt32(&c.throttledByErr, 0)
+			msg = nil
+			msgID := data.MsgID
+			if msgID == 0 {
+				// the header is not parsed by the reader
+				msg, err = decodeMessage(data.Data, c.IsExt())
+				if err != nil {
+					nsqLog.LogErrorf("channel (%v): failed to decode message - %s - %v", c.GetName(), err, data)
+					continue LOOP
+				}
+				msgID = msg.ID
 			}
 
-			if lastMsg.ID > 0 && msg.ID < lastMsg.ID {
+			if lastMsg.ID > 0 && msgID < lastMsg.ID {
 				// note: this may happen if the reader pefetch some data not committed by the disk writer
 				// we need read it again later.
-				nsqLog.Warningf("read a message with less message ID: %v vs %v, raw data: %v", msg.ID, lastMsg.ID, data)
+				nsqLog.Warningf("read a message with less message ID: %v vs %v, raw data: %v", msgID, lastMsg.ID, data)
 				nsqLog.Warningf("last raw data: %v", lastDataResult)
 				time.Sleep(time.Millisecond * 5)
 				if diskQ, ok := c.backend.(*diskQueueReader); ok {
 					diskQ.ResetLastReadOne(data.Offset, data.CurCnt-1, int32(data.MovedSize))
 				}
-				lastMsg = *msg
+				if msg != nil {
+					lastMsg = *msg
+				} else {
+					lastMsg = Message{ID: msgID, Timestamp: data.MsgTimestamp}
+				}
+				lastMsg.Offset = data.Offset
 				lastDataResult = data
 				continue LOOP
 			}
 
+			if msg == nil {
+				msg, err = decodeMessage(data.Data, c.IsExt())
+				if err != nil {
+					nsqLog.LogErrorf("channel (%v): failed to decode message - %s - %v", c.GetName(), err, data)
+					continue LOOP
+				}
+			}
+			msg.Offset = data.Offset
+			msg.RawMoveSize = data.MovedSize
+			msg.queueCntIndex = data.CurCnt
+			if data.Attempts > 1 && int32(msg.Attempts) < data.Attempts-1 {
+				// redelivered from the disk queue, the attempts will be increased while in flight
+				msg.Attempts = uint16(data.Attempts - 1)
+			}
+			if msg.TraceID != 0 || c.IsTraced() || nsqLog.Level() >= levellogger.LOG_DETAIL {
+				nsqMsgTracer.TraceSub(c.GetTopicName(), c.GetName(), "READ_QUEUE", msg.TraceID, msg, "0")
+			}
+
 			atomic.StoreInt64(&c.waitingProcessMsgTs, msg.Timestamp)
 			lastDataResult = data
 			if isSkipped {
@@ -1673,12 +2529,18 @@ LOOP:
 			atomic.StoreInt32(&c.needNotifyRead, 0)
 			readBackendWait = false
 			resumedFirst = true
+			caughtUp = false
+			atomic.StoreInt32(&c.pumpIdle, 0)
 			continue LOOP
 		case resetOffset := <-c.readerChanged:
 			nsqLog.Infof("got reader reset notify:%v ", resetOffset)
 			c.resetChannelReader(resetOffset, &lastDataNeedRead, origReadChan, &lastMsg, &needReadBackend, &readBackendWait)
+			caughtUp = false
+			atomic.StoreInt32(&c.pumpIdle, 0)
 			continue LOOP
 		case <-waitEndUpdated:
+			caughtUp = false
+			atomic.StoreInt32(&c.pumpIdle, 0)
 			continue LOOP
 		}
 
@@ -1737,6 +2599,8 @@ LOOP:
 				case resetOffset := <-c.readerChanged:
 					nsqLog.Infof("got reader reset notify while dispatch message:%v ", resetOffset)
 					c.resetChannelReader(resetOffset, &lastDataNeedRead, origReadChan, &lastMsg, &needReadBackend, &readBackendWait)
+					caughtUp = false
+					atomic.StoreInt32(&c.pumpIdle, 0)
 					continue
 				case <-c.exitChan:
 					goto exit
@@ -1757,6 +2621,8 @@ LOOP:
 		case resetOffset := <-c.readerChanged:
 			nsqLog.Infof("got reader reset notify while dispatch message:%v ", resetOffset)
 			c.resetChannelReader(resetOffset, &lastDataNeedRead, origReadChan, &lastMsg, &needReadBackend, &readBackendWait)
+			caughtUp = false
+			atomic.StoreInt32(&c.pumpIdle, 0)
 		case <-c.exitChan:
 			goto exit
 		}
@@ -1766,6 +2632,13 @@ LOOP:
 	}
 
 exit:
+	if msg != nil {
+		// the staged message is abandoned without confirming, so it will be
+		// redelivered from the confirmed after restart
+		nsqLog.Logf("CHANNEL(%s): abandon the message not delivered: %v:%v, confirmed: %v",
+			c.name, msg.ID, msg.Offset, c.GetConfirmed())
+	}
+	c.setReaderStagedBytes(0)
 	nsqLog.Logf("CHANNEL(%s): closing ... messagePump", c.name)
 	close(c.clientMsgChan)
 	close(c.exitSyncChan)
@@ -1816,6 +2689,8 @@ func (c *Channel) processInFlightQueue(tnow int64) (bool, bool) {
 	if c.Exiting() {
 		return false, false
 	}
+	c.checkConfirmDeadlines()
+	c.checkConfirmWinBreaker(tnow)
 
 	dirty := false
 	flightCnt := 0
@@ -1834,7 +2709,7 @@ func (c *Channel) processInFlightQueue(tnow int64) (bool, bool) {
 				nsqLog.LogDebugf("channel %v no timeout, inflight %v, waiting confirm: %v, confirmed: %v",
 					c.GetName(), flightCnt, atomic.LoadInt32(&c.waitingConfirm),
 					c.GetConfirmed())
-				if !c.IsOrdered() && atomic.LoadInt32(&c.waitingConfirm) >= int32(c.option.MaxConfirmWin) {
+				if !c.IsOrdered() && atomic.LoadInt32(&c.waitingConfirm) >= int32(c.GetConfirmWin()) {
 					confirmed := c.GetConfirmed().Offset()
 					var blockingMsg *Message
 					for _, m := range c.inFlightMessages {
@@ -1894,8 +2769,12 @@ func (c *Channel) processInFlightQueue(tnow int64) (bool, bool) {
 		}
 		requeuedCnt++
 		msgCopy := *msg
+		// the deferred message is not failed
+		isDeferred := msg.IsDeferred()
 		atomic.StoreInt32(&msg.deferredCnt, 0)
-		c.doRequeue(msg, strconv.Itoa(int(msg.GetClientID())))
+		if isDeferred || !c.tryDeadLetter(msg) {
+			c.doRequeue(msg, strconv.Itoa(int(msg.GetClientID())))
+		}
 		c.inFlightMutex.Unlock()
 
 		if msgCopy.TraceID != 0 || c.IsTraced() || nsqLog.Level() >= levellogger.LOG_INFO {
@@ -1973,7 +2852,7 @@ exit:
 	c.confirmMutex.Unlock()
 	if fixConsistence {
 		select {
-		case c.readerChanged <- resetChannelData{BackendOffset(-1), 0, false}:
+		case c.readerChanged <- resetChannelData{Offset: BackendOffset(-1)}:
 		default:
 		}
 	}
@@ -2061,7 +2940,7 @@ exit:
 		(requeuedCnt <= 0) && (!dirty) && clientNum > 0 &&
 		oldWaitingDeliveryState == 0 &&
 		atomic.LoadInt32(&c.waitingConfirm) >=
-			int32(c.option.MaxConfirmWin)) &&
+			int32(c.GetConfirmWin())) &&
 		atomic.LoadInt32(&c.waitingDeliveryState) == 0 {
 		diff := time.Now().Unix() - atomic.LoadInt64(&c.processResetReaderTime)
 		if diff > resetReaderTimeoutSec && atomic.LoadInt64(&c.processResetReaderTime) > 0 {
@@ -2071,7 +2950,7 @@ exit:
 
 			atomic.StoreInt64(&c.processResetReaderTime, time.Now().Unix())
 			select {
-			case c.readerChanged <- resetChannelData{BackendOffset(-1), 0, true}:
+			case c.readerChanged <- resetChannelData{Offset: BackendOffset(-1), ClearConfirmed: true}:
 			default:
 			}
 		}
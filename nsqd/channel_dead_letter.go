@@ -0,0 +1,114 @@
+package nsqd
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"github.com/youzan/nsq/internal/levellogger"
+	"github.com/youzan/nsq/internal/protocol"
+)
+
+var ErrInvalidDeadLetterTopic = errors.New("invalid dead letter topic")
+
+// the message failed to route to the dead letter topic this many times is kept in the normal
+// flow, so it will not be requeued to route again forever if the dead letter topic is unavailable.
+const maxDeadLetterRouteFailures = 3
+
+// DeadLetterPolicy routes the message failed too many times to the partition 0 of the dead
+// letter topic, it will be confirmed in the channel after written to the dead letter topic.
+type DeadLetterPolicy struct {
+	Topic string
+	// the message is routed after failed this many attempts
+	MaxAttempts uint16
+}
+
+// NewDeadLetterMessage copies the failed message to be written to the dead letter topic,
+// the trace id is kept to trace the message across the topics.
+func NewDeadLetterMessage(t *Topic, m *Message) *Message {
+	var msg *Message
+	if t.IsExt() {
+		msg = NewMessageWithExt(0, m.Body, m.ExtVer, m.ExtBytes)
+	} else {
+		msg = NewMessage(0, m.Body)
+	}
+	msg.TraceID = m.TraceID
+	return msg
+}
+
+// SetDeadLetterPolicy sets the dead letter topic and the attempt threshold of the channel,
+// empty topic or zero threshold to disable it. The ordered channel will never route the
+// message to the dead letter topic since it is blocked by the failed message.
+func (c *Channel) SetDeadLetterPolicy(topic string, maxAttempts uint16) error {
+	if topic == "" || maxAttempts == 0 {
+		c.deadLetter.Store((*DeadLetterPolicy)(nil))
+		return nil
+	}
+	if !protocol.IsValidTopicName(topic) || topic == c.GetTopicName() {
+		return ErrInvalidDeadLetterTopic
+	}
+	nsqLog.Logf("topic %v channel %v dead letter to %v after %v attempts",
+		c.GetTopicName(), c.GetName(), topic, maxAttempts)
+	c.deadLetter.Store(&DeadLetterPolicy{Topic: topic, MaxAttempts: maxAttempts})
+	return nil
+}
+
+func (c *Channel) GetDeadLetterPolicy() (string, uint16) {
+	p, ok := c.deadLetter.Load().(*DeadLetterPolicy)
+	if !ok || p == nil {
+		return "", 0
+	}
+	return p.Topic, p.MaxAttempts
+}
+
+func (c *Channel) GetDeadLetterCount() uint64 {
+	return atomic.LoadUint64(&c.deadLetterCount)
+}
+
+// tryDeadLetter routes the failed message to the dead letter topic if it exceeds the
+// threshold, it returns false if the message should be requeued as usual.
+// should protect by inflight lock
+func (c *Channel) tryDeadLetter(m *Message) bool {
+	p, ok := c.deadLetter.Load().(*DeadLetterPolicy)
+	if !ok || p == nil || c.IsOrdered() || c.Exiting() {
+		return false
+	}
+	if m.Attempts < p.MaxAttempts || c.deadLetterFailures[m.ID] >= maxDeadLetterRouteFailures {
+		return false
+	}
+	go c.routeDeadLetter(m, p.Topic)
+	return true
+}
+
+func (c *Channel) routeDeadLetter(m *Message, topic string) {
+	err := c.nsqdNotify.PutDeadLetter(c, m, topic)
+	if err != nil {
+		nsqLog.LogWarningf("topic %v channel %v failed to put msg %v to dead letter topic %v: %v",
+			c.GetTopicName(), c.GetName(), PrintMessage(m), topic, err)
+		c.inFlightMutex.Lock()
+		if c.deadLetterFailures == nil {
+			c.deadLetterFailures = make(map[MessageID]int)
+		}
+		c.deadLetterFailures[m.ID]++
+		if c.deadLetterFailures[m.ID] >= maxDeadLetterRouteFailures {
+			nsqLog.LogErrorf("topic %v channel %v msg %v failed to route to dead letter topic %v %v times, keep it in the channel",
+				c.GetTopicName(), c.GetName(), PrintMessage(m), topic, c.deadLetterFailures[m.ID])
+		}
+		c.doRequeue(m, "")
+		c.inFlightMutex.Unlock()
+		return
+	}
+	c.inFlightMutex.Lock()
+	delete(c.deadLetterFailures, m.ID)
+	if m.DelayedType == ChannelDelayed {
+		c.ConfirmDelayedMessage(m)
+	} else {
+		c.ConfirmBackendQueue(m)
+	}
+	c.inFlightMutex.Unlock()
+	atomic.AddUint64(&c.deadLetterCount, 1)
+	if m.TraceID != 0 || c.IsTraced() || nsqLog.Level() >= levellogger.LOG_DEBUG {
+		nsqMsgTracer.TraceSub(c.GetTopicName(), c.GetName(), "DEAD_LETTER", m.TraceID, m, topic)
+	}
+	nsqLog.Logf("topic %v channel %v msg %v routed to dead letter topic %v after %v attempts",
+		c.GetTopicName(), c.GetName(), m.ID, topic, m.Attempts)
+}
@@ -0,0 +1,150 @@
+package nsqd
+
+import (
+	"errors"
+	"sync"
+)
+
+// the names of the spans around the message lifecycle
+const (
+	SpanNameDeliver = "nsqd.deliver"
+	SpanNameConfirm = "nsqd.confirm"
+)
+
+var errSpanRedelivered = errors.New("message redelivered before confirmed")
+
+type SpanAttribute struct {
+	Key   string
+	Value interface{}
+}
+
+// ReadSpan is the span started by the ReadSpanTracer, ended with the error if failed.
+type ReadSpan interface {
+	SetAttributes(attrs ...SpanAttribute)
+	End(err error)
+}
+
+// ReadSpanTracer starts the spans of the delivery and the confirm of the messages, which can be
+// bridged to the OpenTelemetry tracer. The span of the delivery is started while the message is
+// in flight and ended while confirmed or delivered again, and the span of the confirm is around
+// the confirm handling. The spans are started without any lock held, they should not block.
+type ReadSpanTracer interface {
+	StartSpan(name string, attrs ...SpanAttribute) ReadSpan
+}
+
+type noopReadSpan struct{}
+
+func (noopReadSpan) SetAttributes(attrs ...SpanAttribute) {}
+func (noopReadSpan) End(err error)                        {}
+
+// NoopReadSpanTracer is the default tracer which records nothing.
+type NoopReadSpanTracer struct{}
+
+func (NoopReadSpanTracer) StartSpan(name string, attrs ...SpanAttribute) ReadSpan {
+	return noopReadSpan{}
+}
+
+// the atomic value can only store the same concrete type
+type readSpanTracerHolder struct {
+	tracer ReadSpanTracer
+}
+
+// the delivery spans not ended of the messages in flight
+type deliverSpans struct {
+	sync.Mutex
+	spans map[MessageID]ReadSpan
+}
+
+// SetReadSpanTracer sets the tracer of the message spans, nil to use the no-op tracer.
+func (c *Channel) SetReadSpanTracer(t ReadSpanTracer) {
+	if t == nil {
+		t = NoopReadSpanTracer{}
+	}
+	c.readSpanTracer.Store(&readSpanTracerHolder{tracer: t})
+}
+
+// returns nil if no tracer or the no-op tracer is set
+func (c *Channel) getReadSpanTracer() ReadSpanTracer {
+	h, ok := c.readSpanTracer.Load().(*readSpanTracerHolder)
+	if !ok || h == nil {
+		return nil
+	}
+	if _, ok := h.tracer.(NoopReadSpanTracer); ok {
+		return nil
+	}
+	return h.tracer
+}
+
+func (c *Channel) spanAttributes(msg *Message) []SpanAttribute {
+	return []SpanAttribute{
+		{Key: "nsq.topic", Value: c.GetTopicName()},
+		{Key: "nsq.partition", Value: c.GetTopicPart()},
+		{Key: "nsq.channel", Value: c.GetName()},
+		{Key: "nsq.message.id", Value: uint64(msg.ID)},
+		{Key: "nsq.message.offset", Value: int64(msg.Offset)},
+		{Key: "nsq.message.size", Value: int64(msg.RawMoveSize)},
+		{Key: "nsq.message.attempts", Value: int(msg.Attempts)},
+	}
+}
+
+func (c *Channel) startDeliverSpan(msg *Message) {
+	t := c.getReadSpanTracer()
+	if t == nil {
+		return
+	}
+	span := t.StartSpan(SpanNameDeliver, c.spanAttributes(msg)...)
+	c.deliverSpans.Lock()
+	if c.deliverSpans.spans == nil {
+		c.deliverSpans.spans = make(map[MessageID]ReadSpan)
+	}
+	old := c.deliverSpans.spans[msg.ID]
+	c.deliverSpans.spans[msg.ID] = span
+	c.deliverSpans.Unlock()
+	if old != nil {
+		old.End(errSpanRedelivered)
+	}
+}
+
+func (c *Channel) endDeliverSpan(id MessageID, err error) {
+	c.deliverSpans.Lock()
+	span := c.deliverSpans.spans[id]
+	delete(c.deliverSpans.spans, id)
+	c.deliverSpans.Unlock()
+	if span != nil {
+		span.End(err)
+	}
+}
+
+func (c *Channel) endAllDeliverSpans(err error) {
+	c.deliverSpans.Lock()
+	spans := c.deliverSpans.spans
+	c.deliverSpans.spans = nil
+	c.deliverSpans.Unlock()
+	for _, span := range spans {
+		span.End(err)
+	}
+}
+
+// the confirm span is started before the confirm handling and ended by the returned func
+func (c *Channel) startConfirmSpan(id MessageID) func(msg *Message, err error) {
+	t := c.getReadSpanTracer()
+	if t == nil {
+		return func(*Message, error) {}
+	}
+	span := t.StartSpan(SpanNameConfirm,
+		SpanAttribute{Key: "nsq.topic", Value: c.GetTopicName()},
+		SpanAttribute{Key: "nsq.partition", Value: c.GetTopicPart()},
+		SpanAttribute{Key: "nsq.channel", Value: c.GetName()},
+		SpanAttribute{Key: "nsq.message.id", Value: uint64(id)})
+	return func(msg *Message, err error) {
+		if msg != nil {
+			span.SetAttributes(
+				SpanAttribute{Key: "nsq.message.offset", Value: int64(msg.Offset)},
+				SpanAttribute{Key: "nsq.message.size", Value: int64(msg.RawMoveSize)})
+		}
+		span.End(err)
+		if err == nil && msg != nil {
+			c.endDeliverSpan(id, nil)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package nsqd
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// SetRewindRetention keeps the data of the size before the confirmed of the channel from
+// being cleaned by the retention, so the channel can be reset to replay the data in the
+// window even if it is confirmed. Negative or zero to disable it.
+func (c *Channel) SetRewindRetention(size int64) {
+	if size < 0 {
+		size = 0
+	}
+	old := atomic.SwapInt64(&c.rewindRetention, size)
+	if old != size {
+		nsqLog.Logf("topic %v channel %v rewind retention changed from %v to %v",
+			c.GetTopicName(), c.GetName(), old, size)
+	}
+}
+
+func (c *Channel) GetRewindRetention() int64 {
+	return atomic.LoadInt64(&c.rewindRetention)
+}
+
+// SetRetentionSeconds keeps the data written in the seconds from being cleaned for the channel
+// even if the topic retention expired, the topic data is shared so the clean respects the
+// longest retention of all the channels. Negative or zero to follow the topic retention.
+func (c *Channel) SetRetentionSeconds(secs int64) {
+	if secs < 0 {
+		secs = 0
+	}
+	old := atomic.SwapInt64(&c.retentionSecs, secs)
+	if old != secs {
+		nsqLog.Logf("topic %v channel %v retention changed from %vs to %vs",
+			c.GetTopicName(), c.GetName(), old, secs)
+	}
+}
+
+func (c *Channel) GetRetentionSeconds() int64 {
+	return atomic.LoadInt64(&c.retentionSecs)
+}
+
+// the data written after this time should be kept for the channel, zero if no retention
+func (c *Channel) getRetentionHoldTime(now time.Time) int64 {
+	secs := c.GetRetentionSeconds()
+	if secs <= 0 {
+		return 0
+	}
+	return now.Add(-1 * time.Second * time.Duration(secs)).UnixNano()
+}
+
+// GetRetainedStart returns the oldest retained offset the channel can still be reset to.
+func (c *Channel) GetRetainedStart() int64 {
+	d, ok := c.backend.(*diskQueueReader)
+	if !ok {
+		return 0
+	}
+	oldest, err := d.OldestReadableOffset()
+	if err != nil {
+		return 0
+	}
+	return int64(oldest)
+}
+
+// the clean of the topic data should not exceed this offset for the channel
+func (c *Channel) getRetentionHoldOffset() BackendOffset {
+	hold := c.GetConfirmed().Offset() - BackendOffset(c.GetRewindRetention())
+	if d, ok := c.backend.(*diskQueueReader); ok {
+		// the files of the snapshot for the backup should be kept
+		if snap, ok := d.snapshotHoldOffset(); ok && snap < hold {
+			hold = snap
+		}
+	}
+	if hold < 0 {
+		return 0
+	}
+	return hold
+}
+
+// GetRewindAvailable returns the size of the retained data before the confirmed, which
+// the channel can still be reset to.
+func (c *Channel) GetRewindAvailable() int64 {
+	d, ok := c.backend.(*diskQueueReader)
+	if !ok {
+		return 0
+	}
+	oldest, err := d.OldestReadableOffset()
+	if err != nil {
+		return 0
+	}
+	available := int64(c.GetConfirmed().Offset() - oldest)
+	if available < 0 {
+		return 0
+	}
+	return available
+}
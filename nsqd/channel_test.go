@@ -2,8 +2,13 @@ package nsqd
 
 import (
 	//"github.com/youzan/nsq/internal/levellogger"
+	"errors"
+	"io/ioutil"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -202,57 +207,1068 @@ func TestChannelHealth(t *testing.T) {
 	channel.exitChan <- 1
 }
 
+func TestChannelLoadMetaError(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopicIgnPart("test_channel_load_meta_error")
+	channel := topic.GetChannel("channel")
+	metaName := channel.backend.(*diskQueueReader).metaDataFileName(true)
+	equal(t, topic.CloseExistingChannel("channel", false), nil)
+
+	err := ioutil.WriteFile(metaName, []byte("corrupt\n"), 0644)
+	equal(t, err, nil)
+	// the broken meta should be kept and the channel should not be reset to the end
+	_, err = topic.GetOrCreateChannel("channel")
+	nequal(t, err, nil)
+	equal(t, topic.GetChannel("channel") == nil, true)
+	_, err = topic.GetExistingChannel("channel")
+	nequal(t, err, nil)
+	data, err := ioutil.ReadFile(metaName)
+	equal(t, err, nil)
+	equal(t, string(data), "corrupt\n")
+}
+
+func TestChannelDegradedWhileMetaSyncFail(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	opts.SyncEvery = 1
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopicIgnPart("test_channel_degraded")
+	channel := topic.GetChannel("ch")
+	reader := channel.backend.(*diskQueueReader)
+	reader.Lock()
+	reader.persistMeta = func() error {
+		return errors.New("read-only file system")
+	}
+	reader.Unlock()
+
+	for i := 0; i < maxMetaSyncFailures+2; i++ {
+		topic.PutMessage(NewMessage(0, []byte("test")))
+	}
+	topic.flush(true)
+	for i := 0; i < maxMetaSyncFailures+1; i++ {
+		select {
+		case outMsg := <-channel.clientMsgChan:
+			channel.ConfirmBackendQueue(outMsg)
+		case <-time.After(time.Second):
+			t.Fatalf("should read message while meta sync failed")
+		}
+	}
+	equal(t, channel.IsDegraded(), true)
+	equal(t, NewChannelStats(channel, nil).Degraded, true)
+	nsqd.checkChannelsDegraded()
+	equal(t, nsqd.IsHealthy(), false)
+	equal(t, nsqd.GetError(), ErrMetaSyncDegraded)
+	// the other health error is not overwritten by the degraded
+	otherErr := errors.New("other health error")
+	nsqd.SetHealth(otherErr)
+	nsqd.checkChannelsDegraded()
+	equal(t, nsqd.GetError(), otherErr)
+	nsqd.SetHealth(ErrMetaSyncDegraded)
+
+	// the reads from already opened file should go on
+	var lastMsg *Message
+	select {
+	case lastMsg = <-channel.clientMsgChan:
+	case <-time.After(time.Second):
+		t.Fatalf("should read message while degraded")
+	}
+
+	reader.Lock()
+	reader.persistMeta = reader.persistMetaData
+	reader.degradedUntil = 0
+	reader.Unlock()
+	channel.ConfirmBackendQueue(lastMsg)
+	equal(t, channel.IsDegraded(), false)
+	nsqd.checkChannelsDegraded()
+	equal(t, nsqd.IsHealthy(), true)
+}
+
+func TestChannelThrottledByConfirmWin(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	opts.MaxConfirmWin = 2
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopicIgnPart("test_channel_throttled")
+	channel := topic.GetChannel("ch")
+	for i := 0; i < 10; i++ {
+		topic.PutMessage(NewMessage(0, []byte("test")))
+	}
+	topic.flush(true)
+
+	waitThrottled := func(throttled bool) {
+		start := time.Now()
+		for channel.IsThrottled() != throttled {
+			if time.Since(start) > time.Second*3 {
+				t.Fatalf("channel throttled state should be %v", throttled)
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+	}
+	var msgs []*Message
+	for i := 0; i < 8; i++ {
+		select {
+		case msg := <-channel.clientMsgChan:
+			msgs = append(msgs, msg)
+		case <-time.After(time.Second):
+			t.Fatalf("should read message before the confirm window is full")
+		}
+	}
+	// keep the first not confirmed, so the others will be waiting confirm
+	for i := 2; i < len(msgs); i += 2 {
+		channel.ConfirmBackendQueue(msgs[i])
+	}
+	// the one already read from backend before the window is full
+	select {
+	case msg := <-channel.clientMsgChan:
+		msgs = append(msgs, msg)
+	case <-time.After(time.Millisecond * 100):
+	}
+	waitThrottled(true)
+	select {
+	case <-channel.clientMsgChan:
+		t.Fatalf("should not read while throttled")
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	for i, msg := range msgs {
+		if i%2 == 1 || i == 0 || i >= 8 {
+			channel.ConfirmBackendQueue(msg)
+		}
+	}
+	waitThrottled(false)
+	select {
+	case <-channel.clientMsgChan:
+	case <-time.After(time.Second):
+		t.Fatalf("should read message after confirmed")
+	}
+}
+
+func TestChannelConfirmWinChangedAtRuntime(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	opts.MaxConfirmWin = 2
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopicIgnPart("test_channel_confirm_win_runtime")
+	channel := topic.GetChannel("ch")
+	for i := 0; i < 20; i++ {
+		topic.PutMessage(NewMessage(0, []byte("test")))
+	}
+	topic.flush(true)
+
+	equal(t, channel.GetConfirmWin(), int64(2))
+	equal(t, channel.SetConfirmWin(0), ErrInvalidConfirmWin)
+	equal(t, channel.SetConfirmWin(-1), ErrInvalidConfirmWin)
+	equal(t, channel.GetConfirmWin(), int64(2))
+
+	var msgs []*Message
+	for i := 0; i < 8; i++ {
+		select {
+		case msg := <-channel.clientMsgChan:
+			msgs = append(msgs, msg)
+		case <-time.After(time.Second):
+			t.Fatalf("should read message before the confirm window is full")
+		}
+	}
+	// keep the first not confirmed, so the others will be waiting confirm
+	for i := 2; i < len(msgs); i += 2 {
+		channel.ConfirmBackendQueue(msgs[i])
+	}
+	start := time.Now()
+	for !channel.IsThrottled() {
+		if time.Since(start) > time.Second*3 {
+			t.Fatalf("channel should be throttled by the confirm window")
+		}
+		select {
+		case <-channel.clientMsgChan:
+		case <-time.After(time.Millisecond * 10):
+		}
+	}
+	select {
+	case <-channel.clientMsgChan:
+		t.Fatalf("should not read while throttled")
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	// widen the window without any confirm, the read should be resumed at once
+	equal(t, channel.SetConfirmWin(100), nil)
+	equal(t, channel.GetConfirmWin(), int64(100))
+	select {
+	case <-channel.clientMsgChan:
+	case <-time.After(time.Millisecond * 500):
+		t.Fatalf("should read message after the confirm window widened")
+	}
+	equal(t, channel.IsThrottled(), false)
+}
+
+func TestChannelThrottledByInFlightMsgs(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	opts.MaxInFlightMsgs = 5
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	bodySizes := map[string]func(int) int{
+		"fixed":    func(i int) int { return 10 },
+		"variable": func(i int) int { return 1 + (i*37)%200 },
+	}
+	for name, bodySize := range bodySizes {
+		topic := nsqd.GetTopicIgnPart("test_channel_inflight_msgs_" + name)
+		channel := topic.GetChannel("ch")
+		for i := 0; i < 20; i++ {
+			topic.PutMessage(NewMessage(0, []byte(strings.Repeat("a", bodySize(i)))))
+		}
+		topic.flush(true)
+
+		readUntilBlocked := func() []*Message {
+			var msgs []*Message
+			for {
+				select {
+				case msg := <-channel.clientMsgChan:
+					msgs = append(msgs, msg)
+				case <-time.After(time.Millisecond * 200):
+					return msgs
+				}
+			}
+		}
+		msgs := readUntilBlocked()
+		equal(t, len(msgs), int(opts.MaxInFlightMsgs))
+		equal(t, channel.IsThrottled(), true)
+		equal(t, channel.GetChannelWaitingConfirmCnt(), opts.MaxInFlightMsgs)
+
+		// confirm out of order will not reduce the unconfirmed messages
+		channel.ConfirmBackendQueue(msgs[2])
+		equal(t, len(readUntilBlocked()), 0)
+
+		channel.ConfirmBackendQueue(msgs[0])
+		channel.ConfirmBackendQueue(msgs[1])
+		more := readUntilBlocked()
+		equal(t, len(more), 3)
+		equal(t, more[0].Offset, msgs[len(msgs)-1].Offset+msgs[len(msgs)-1].RawMoveSize)
+		equal(t, channel.GetChannelWaitingConfirmCnt(), opts.MaxInFlightMsgs)
+	}
+}
+
+func TestChannelConfirmWinBreaker(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	opts.MaxInFlightMsgs = 5
+	opts.ConfirmWinBreakerTimeout = time.Millisecond * 500
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopicIgnPart("test_channel_confirm_win_breaker")
+	channel := topic.GetChannel("ch")
+	for i := 0; i < 20; i++ {
+		topic.PutMessage(NewMessage(0, []byte("test")))
+	}
+	topic.flush(true)
+
+	readUntilBlocked := func() []*Message {
+		var msgs []*Message
+		for {
+			select {
+			case msg := <-channel.clientMsgChan:
+				msgs = append(msgs, msg)
+			case <-time.After(time.Millisecond * 200):
+				return msgs
+			}
+		}
+	}
+	// never confirm to keep the window saturated
+	msgs := readUntilBlocked()
+	equal(t, len(msgs), int(opts.MaxInFlightMsgs))
+	equal(t, channel.IsThrottled(), true)
+	channel.checkConfirmWinBreaker(time.Now().UnixNano())
+	equal(t, channel.IsConfirmWinAlarmed(), false)
+
+	time.Sleep(opts.ConfirmWinBreakerTimeout)
+	channel.checkConfirmWinBreaker(time.Now().UnixNano())
+	equal(t, channel.IsConfirmWinAlarmed(), true)
+	equal(t, NewChannelStats(channel, nil).ConfirmWinAlarmed, true)
+
+	// the breaker should be reset while the confirms resumed
+	for _, msg := range msgs {
+		channel.ConfirmBackendQueue(msg)
+	}
+	more := readUntilBlocked()
+	equal(t, len(more), int(opts.MaxInFlightMsgs))
+	equal(t, channel.IsConfirmWinAlarmed(), false)
+	equal(t, NewChannelStats(channel, nil).ConfirmWinAlarmed, false)
+	channel.checkConfirmWinBreaker(time.Now().UnixNano())
+	equal(t, channel.IsConfirmWinAlarmed(), false)
+}
+
+func TestChannelRetryFailedEndUpdate(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	// avoid the flush by the nsqd loop
+	opts.SyncTimeout = time.Hour
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopicIgnPart("test_channel_end_retry")
+	channel := topic.GetChannel("ch")
+	var failing int32 = 1
+	var failedCnt int32
+	d := channel.backend.(*diskQueueReader)
+	d.Lock()
+	d.updateEnd = func(e *diskQueueEndInfo, forceReload bool) (bool, error) {
+		if atomic.LoadInt32(&failing) == 1 {
+			atomic.AddInt32(&failedCnt, 1)
+			return false, errors.New("update end failed")
+		}
+		return d.internalUpdateEnd(e, forceReload)
+	}
+	d.Unlock()
+
+	topic.PutMessage(NewMessage(0, []byte("test")))
+	topic.flush(true)
+	end := topic.backend.GetQueueReadEnd()
+	equal(t, channel.GetChannelEnd().Offset(), BackendOffset(0))
+	// each update should be retried with the bounded times
+	equal(t, atomic.LoadInt32(&failedCnt)%maxEndUpdateRetry, int32(0))
+	channel.pendingEndMutex.Lock()
+	if channel.pendingEnd == nil {
+		t.Fatalf("the failed end should be pending for retry")
+	}
+	channel.pendingEndMutex.Unlock()
+
+	// recovered from the transient failure
+	atomic.StoreInt32(&failing, 0)
+	// the pending end should be retried while flush
+	channel.flush()
+	equal(t, channel.GetChannelEnd().Offset(), end.Offset())
+	equal(t, channel.GetChannelEnd().TotalMsgCnt(), end.TotalMsgCnt())
+	select {
+	case msg := <-channel.clientMsgChan:
+		equal(t, string(msg.Body), "test")
+	case <-time.After(time.Second):
+		t.Fatalf("should read the message after the end converged")
+	}
+}
+
+func TestChannelOnCaughtUp(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopicIgnPart("test_channel_caught_up")
+	channel := topic.GetChannel("ch")
+	var caughtUpCnt int32
+	channel.SetOnCaughtUp(func() {
+		atomic.AddInt32(&caughtUpCnt, 1)
+	})
+	msgNum := 10
+	for i := 0; i < msgNum; i++ {
+		topic.PutMessage(NewMessage(0, []byte("test")))
+	}
+	topic.flush(true)
+
+	for i := 0; i < msgNum; i++ {
+		equal(t, atomic.LoadInt32(&caughtUpCnt), int32(0))
+		select {
+		case msg := <-channel.clientMsgChan:
+			channel.ConfirmBackendQueue(msg)
+		case <-time.After(time.Second):
+			t.Fatalf("should read message in backlog")
+		}
+	}
+	start := time.Now()
+	for atomic.LoadInt32(&caughtUpCnt) != 1 {
+		if time.Since(start) > time.Second {
+			t.Fatalf("should notify caught up after the backlog consumed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	equal(t, channel.Depth(), int64(0))
+
+	// the rapidly end update should be debounced
+	topic.PutMessage(NewMessage(0, []byte("test")))
+	topic.flush(true)
+	<-channel.clientMsgChan
+	time.Sleep(time.Millisecond * 100)
+	equal(t, atomic.LoadInt32(&caughtUpCnt), int32(1))
+}
+
+func TestChannelDeliverAfterIdle(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopicIgnPart("test_channel_deliver_after_idle")
+	channel := topic.GetChannel("ch")
+	topic.PutMessage(NewMessage(0, []byte("test")))
+	topic.flush(true)
+	select {
+	case msg := <-channel.clientMsgChan:
+		channel.ConfirmBackendQueue(msg)
+	case <-time.After(time.Second):
+		t.Fatalf("should read message in backlog")
+	}
+	start := time.Now()
+	for atomic.LoadInt32(&channel.pumpIdle) != 1 {
+		if time.Since(start) > time.Second {
+			t.Fatalf("the pump should be idle after caught up")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// the end updated should wake the idle pump to read the backend again
+	for i := 0; i < 3; i++ {
+		topic.PutMessage(NewMessage(0, []byte("test")))
+		topic.flush(true)
+		start = time.Now()
+		select {
+		case msg := <-channel.clientMsgChan:
+			if time.Since(start) > time.Millisecond*100 {
+				t.Errorf("the message should be delivered promptly after idle: %v", time.Since(start))
+			}
+			channel.ConfirmBackendQueue(msg)
+		case <-time.After(time.Second):
+			t.Fatalf("should read the message arrived after idle")
+		}
+	}
+	equal(t, channel.Depth(), int64(0))
+}
+
+func BenchmarkChannelIdleReaders(b *testing.B) {
+	opts := NewOptions()
+	opts.Logger = newTestLogger(b)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopicIgnPart("bench_channel_idle_readers")
+	channels := make([]*Channel, 0, 100)
+	for i := 0; i < 100; i++ {
+		channels = append(channels, topic.GetChannel("ch"+strconv.Itoa(i)))
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// most readers are idle between the occasional messages
+		topic.PutMessage(NewMessage(0, []byte("test")))
+		topic.flush(true)
+		for _, ch := range channels {
+			msg := <-ch.clientMsgChan
+			ch.ConfirmBackendQueue(msg)
+		}
+	}
+}
+
 func TestChannelSkip(t *testing.T) {
 	opts := NewOptions()
 	opts.SyncEvery = 1
 	opts.Logger = newTestLogger(t)
 	_, _, nsqd := mustStartNSQD(opts)
 	defer os.RemoveAll(opts.DataPath)
-	defer nsqd.Exit()
+	defer nsqd.Exit()
+
+	topicName := "test_channel_skip" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopicIgnPart(topicName)
+	channel := topic.GetChannel("channel")
+
+	msgs := make([]*Message, 0, 10)
+	for i := 0; i < 10; i++ {
+		var msgId MessageID
+		msgBytes := []byte(strconv.Itoa(i))
+		msg := NewMessage(msgId, msgBytes)
+		msgs = append(msgs, msg)
+	}
+	topic.PutMessages(msgs)
+
+	var msgId MessageID
+	msgBytes := []byte(strconv.Itoa(10))
+	msg := NewMessage(msgId, msgBytes)
+	_, backendOffsetMid, _, _, _ := topic.PutMessage(msg)
+	topic.flush(true)
+	equal(t, channel.Depth(), int64(11))
+
+	msgs = make([]*Message, 0, 9)
+	//put another 10 messages
+	for i := 0; i < 9; i++ {
+		var msgId MessageID
+		msgBytes := []byte(strconv.Itoa(i + 11))
+		msg := NewMessage(msgId, msgBytes)
+		msgs = append(msgs, msg)
+	}
+	topic.PutMessages(msgs)
+	topic.flush(true)
+	equal(t, channel.Depth(), int64(20))
+
+	//skip forward to message 10
+	t.Logf("backendOffsetMid: %d", backendOffsetMid)
+	channel.SetConsumeOffset(backendOffsetMid, 10, true)
+	time.Sleep(time.Second)
+	for i := 0; i < 10; i++ {
+		outputMsg := <-channel.clientMsgChan
+		equal(t, string(outputMsg.Body[:]), strconv.Itoa(i+10))
+	}
+}
+
+func TestChannelResetReadEnd(t *testing.T) {
+	opts := NewOptions()
+	opts.SyncEvery = 1
+	opts.Logger = newTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_skip" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopicIgnPart(topicName)
+	channel := topic.GetChannel("channel")
+
+	msgs := make([]*Message, 0, 10)
+	for i := 0; i < 10; i++ {
+		var msgId MessageID
+		msgBytes := []byte(strconv.Itoa(i))
+		msg := NewMessage(msgId, msgBytes)
+		msgs = append(msgs, msg)
+	}
+	topic.PutMessages(msgs)
+
+	var msgId MessageID
+	msgBytes := []byte(strconv.Itoa(10))
+	msg := NewMessage(msgId, msgBytes)
+	_, backendOffsetMid, _, _, _ := topic.PutMessage(msg)
+	topic.flush(true)
+	equal(t, channel.Depth(), int64(11))
+
+	msgs = make([]*Message, 0, 9)
+	//put another 10 messages
+	for i := 0; i < 9; i++ {
+		var msgId MessageID
+		msgBytes := []byte(strconv.Itoa(i + 11))
+		msg := NewMessage(msgId, msgBytes)
+		msgs = append(msgs, msg)
+	}
+	topic.PutMessages(msgs)
+	topic.flush(true)
+	equal(t, channel.Depth(), int64(20))
+
+	//skip forward to message 10
+	t.Logf("backendOffsetMid: %d", backendOffsetMid)
+	channel.SetConsumeOffset(backendOffsetMid, 10, true)
+	for i := 0; i < 10; i++ {
+		outputMsg := <-channel.clientMsgChan
+		equal(t, string(outputMsg.Body[:]), strconv.Itoa(i+10))
+	}
+	equal(t, channel.Depth(), int64(10))
+
+	channel.SetConsumeOffset(0, 0, true)
+	//equal(t, channel.Depth(), int64(20))
+	for i := 0; i < 20; i++ {
+		outputMsg := <-channel.clientMsgChan
+		t.Logf("Msg: %s", outputMsg.Body)
+		equal(t, string(outputMsg.Body[:]), strconv.Itoa(i))
+	}
+}
+
+func TestChannelResetToStart(t *testing.T) {
+	opts := NewOptions()
+	opts.SyncEvery = 1
+	opts.MaxBytesPerFile = 1024
+	opts.Logger = newTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopicIgnPart("test_channel_reset_to_start")
+	channel := topic.GetChannel("channel")
+
+	msgNum := 50
+	for i := 0; i < msgNum; i++ {
+		topic.PutMessage(NewMessage(0, []byte(strconv.Itoa(i)+strings.Repeat("a", 100))))
+	}
+	topic.flush(true)
+
+	readAll := func(num int) []*Message {
+		readMsgs := make([]*Message, 0, num)
+		for i := 0; i < num; i++ {
+			select {
+			case msg := <-channel.clientMsgChan:
+				channel.ConfirmBackendQueue(msg)
+				readMsgs = append(readMsgs, msg)
+			case <-time.After(time.Second * 3):
+				t.Fatalf("should read all the retained messages, read: %v", len(readMsgs))
+			}
+		}
+		return readMsgs
+	}
+	consumed := readAll(msgNum)
+	equal(t, channel.Depth(), int64(0))
+
+	err := channel.ResetToStart()
+	equal(t, err, nil)
+	replayed := readAll(msgNum)
+	for i, msg := range replayed {
+		equal(t, msg.Offset, consumed[i].Offset)
+		equal(t, string(msg.Body), string(consumed[i].Body))
+	}
+	equal(t, channel.Depth(), int64(0))
+
+	// the reset should go to the oldest existing file if the earlier ones are cleaned
+	err = os.Remove(GetQueueFileName(topic.dataPath, getBackendName(topic.tname, topic.partition), 0))
+	equal(t, err, nil)
+	start, err := channel.GetChannelStart()
+	equal(t, err, nil)
+	if start.Offset() == BackendOffset(0) {
+		t.Fatalf("the start should be moved to the next data file: %v", start)
+	}
+	retained := make([]*Message, 0, msgNum)
+	for _, msg := range consumed {
+		if msg.Offset >= start.Offset() {
+			retained = append(retained, msg)
+		}
+	}
+	equal(t, start.TotalMsgCnt(), int64(msgNum-len(retained)))
+
+	err = channel.ResetToStart()
+	equal(t, err, nil)
+	replayed = readAll(len(retained))
+	for i, msg := range replayed {
+		equal(t, msg.Offset, retained[i].Offset)
+		equal(t, string(msg.Body), string(retained[i].Body))
+	}
+	equal(t, channel.Depth(), int64(0))
+}
+
+func TestChannelStartReadFromFile(t *testing.T) {
+	opts := NewOptions()
+	opts.SyncEvery = 1
+	opts.MaxBytesPerFile = 1024
+	opts.Logger = newTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopicIgnPart("test_channel_read_from_file")
+	channel := topic.GetChannel("channel")
+	msgNum := 0
+	for {
+		topic.PutMessage(NewMessage(0, []byte(strconv.Itoa(msgNum)+strings.Repeat("a", 100))))
+		msgNum++
+		topic.flush(true)
+		if topic.backend.GetQueueReadEnd().(*diskQueueEndInfo).EndOffset.FileNum >= 3 &&
+			topic.backend.GetQueueReadEnd().(*diskQueueEndInfo).EndOffset.Pos > 0 {
+			break
+		}
+	}
+	files, err := topic.GetQueueFiles()
+	equal(t, err, nil)
+	equal(t, len(files), 4)
+
+	err = channel.StartReadFromFile(4)
+	equal(t, err, ErrMoveOffsetInvalid)
+	err = channel.StartReadFromFile(-1)
+	equal(t, err, ErrMoveOffsetInvalid)
+
+	err = channel.StartReadFromFile(2)
+	equal(t, err, nil)
+	var first *Message
+	select {
+	case first = <-channel.clientMsgChan:
+	case <-time.After(time.Second * 3):
+		t.Fatalf("should read from the file")
+	}
+	equal(t, first.Offset, files[2].StartOffset)
+	// the first record in file 2
+	equal(t, channel.GetConfirmed().Offset(), files[2].StartOffset)
+	start, err := channel.backend.(*diskQueueReader).GetFileStart(2)
+	equal(t, err, nil)
+	equal(t, first.queueCntIndex, start.TotalMsgCnt()+1)
+	equal(t, string(first.Body), strconv.Itoa(int(start.TotalMsgCnt()))+strings.Repeat("a", 100))
+}
+
+func TestChannelConfirmPastCorruptFile(t *testing.T) {
+	opts := NewOptions()
+	opts.SyncEvery = 1
+	opts.MaxBytesPerFile = 1024
+	opts.Logger = newTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopicIgnPart("test_channel_confirm_past_corrupt")
+	channel := topic.GetChannel("channel")
+	msgNum := 0
+	for {
+		topic.PutMessage(NewMessage(0, []byte(strconv.Itoa(msgNum)+strings.Repeat("a", 100))))
+		msgNum++
+		topic.flush(true)
+		if topic.backend.GetQueueReadEnd().(*diskQueueEndInfo).EndOffset.FileNum >= 3 {
+			break
+		}
+	}
+	for i := 0; i < msgNum; i++ {
+		select {
+		case msg := <-channel.clientMsgChan:
+			channel.ConfirmBackendQueue(msg)
+		case <-time.After(time.Second * 3):
+			t.Fatalf("should read all the messages")
+		}
+	}
+	equal(t, channel.Depth(), int64(0))
+
+	reader := channel.backend.(*diskQueueReader)
+	cnt1, err := reader.FileMessageCount(1)
+	equal(t, err, nil)
+	f, err := os.OpenFile(GetQueueFileName(topic.dataPath, getBackendName(topic.tname, topic.partition), 1), os.O_RDWR, 0644)
+	equal(t, err, nil)
+	_, err = f.WriteAt([]byte(strings.Repeat("\xff", 8)), 0)
+	equal(t, err, nil)
+	f.Close()
+
+	err = channel.ResetToStart()
+	equal(t, err, nil)
+	// the read skips the corrupt file while the messages of the first file are not confirmed
+	readMsgs := make([]*Message, 0, msgNum)
+	for i := int64(0); i < int64(msgNum)-cnt1; i++ {
+		select {
+		case msg := <-channel.clientMsgChan:
+			readMsgs = append(readMsgs, msg)
+		case <-time.After(time.Second * 3):
+			t.Fatalf("should read the messages not in the corrupt file, read: %v", len(readMsgs))
+		}
+	}
+	for i := len(readMsgs) - 1; i >= 0; i-- {
+		channel.ConfirmBackendQueue(readMsgs[i])
+	}
+	// the confirm should move past the corrupt file once the messages before it are confirmed
+	equal(t, channel.GetConfirmed().Offset(), channel.GetChannelEnd().Offset())
+	equal(t, channel.Depth(), int64(0))
+	equal(t, channel.GetConfirmedIntervalLen(), 0)
+}
+
+func TestChannelConfirmPastCorruptLastFile(t *testing.T) {
+	opts := NewOptions()
+	opts.SyncEvery = 1
+	opts.MaxBytesPerFile = 1024
+	opts.Logger = newTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopicIgnPart("test_channel_confirm_past_corrupt_last")
+	channel := topic.GetChannel("channel")
+	msgNum := 0
+	for {
+		topic.PutMessage(NewMessage(0, []byte(strconv.Itoa(msgNum)+strings.Repeat("a", 100))))
+		msgNum++
+		topic.flush(true)
+		end := topic.backend.GetQueueReadEnd().(*diskQueueEndInfo)
+		if end.EndOffset.FileNum >= 1 && end.EndOffset.Pos > 0 {
+			break
+		}
+	}
+	for i := 0; i < msgNum; i++ {
+		select {
+		case msg := <-channel.clientMsgChan:
+			channel.ConfirmBackendQueue(msg)
+		case <-time.After(time.Second * 3):
+			t.Fatalf("should read all the messages")
+		}
+	}
+	equal(t, channel.Depth(), int64(0))
+
+	reader := channel.backend.(*diskQueueReader)
+	cnt0, err := reader.FileMessageCount(0)
+	equal(t, err, nil)
+	// corrupt the first message of the last file, the read skips to the end right after the roll
+	f, err := os.OpenFile(GetQueueFileName(topic.dataPath, getBackendName(topic.tname, topic.partition), 1), os.O_RDWR, 0644)
+	equal(t, err, nil)
+	_, err = f.WriteAt([]byte(strings.Repeat("\xff", 8)), 0)
+	equal(t, err, nil)
+	f.Close()
+
+	err = channel.ResetToStart()
+	equal(t, err, nil)
+	readMsgs := make([]*Message, 0, cnt0)
+	for i := int64(0); i < cnt0; i++ {
+		select {
+		case msg := <-channel.clientMsgChan:
+			readMsgs = append(readMsgs, msg)
+		case <-time.After(time.Second * 3):
+			t.Fatalf("should read the messages of the first file, read: %v", len(readMsgs))
+		}
+	}
+	for i := len(readMsgs) - 1; i >= 0; i-- {
+		channel.ConfirmBackendQueue(readMsgs[i])
+	}
+	equal(t, channel.GetConfirmed().Offset(), channel.GetChannelEnd().Offset())
+	equal(t, channel.Depth(), int64(0))
+
+	// the new messages after the skipped are read and confirmed in order
+	topic.PutMessage(NewMessage(0, []byte("new")))
+	topic.flush(true)
+	select {
+	case msg := <-channel.clientMsgChan:
+		equal(t, string(msg.Body), "new")
+		channel.ConfirmBackendQueue(msg)
+	case <-time.After(time.Second * 3):
+		t.Fatalf("should read the new message")
+	}
+	equal(t, channel.GetConfirmed().Offset(), channel.GetChannelEnd().Offset())
+}
+
+func TestChannelImportReaderState(t *testing.T) {
+	opts := NewOptions()
+	opts.SyncEvery = 1
+	opts.Logger = newTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopicIgnPart("test_channel_import_state")
+	channel := topic.GetChannel("channel")
+	restored := topic.GetChannel("restored")
+	msgNum := 10
+	for i := 0; i < msgNum; i++ {
+		topic.PutMessage(NewMessage(0, []byte("body"+strconv.Itoa(i))))
+	}
+	topic.flush(true)
+
+	var msgs []*Message
+	for i := 0; i < 5; i++ {
+		select {
+		case msg := <-channel.clientMsgChan:
+			msgs = append(msgs, msg)
+		case <-time.After(time.Second * 3):
+			t.Fatalf("should read the message")
+		}
+	}
+	for _, msg := range msgs[:3] {
+		channel.ConfirmBackendQueue(msg)
+	}
+	state, err := channel.ExportReaderState()
+	equal(t, err, nil)
+
+	// the messages already read by the restored channel are dropped after imported
+	select {
+	case <-restored.clientMsgChan:
+	case <-time.After(time.Second * 3):
+		t.Fatalf("should read the message")
+	}
+	err = restored.ImportReaderState(state)
+	equal(t, err, nil)
+	equal(t, restored.GetConfirmed().Offset(), channel.GetConfirmed().Offset())
+	for i := 3; i < msgNum; i++ {
+		select {
+		case msg := <-restored.clientMsgChan:
+			equal(t, string(msg.Body), "body"+strconv.Itoa(i))
+			restored.ConfirmBackendQueue(msg)
+		case <-time.After(time.Second * 3):
+			t.Fatalf("should read the message %v after imported", i)
+		}
+	}
+	equal(t, restored.Depth(), int64(0))
+
+	err = restored.ImportReaderState([]byte("invalid"))
+	nequal(t, err, nil)
+	equal(t, restored.GetConfirmed().Offset(), restored.GetChannelEnd().Offset())
+}
+
+func TestChannelConfirmPastMessageAt(t *testing.T) {
+	opts := NewOptions()
+	opts.SyncEvery = 1
+	opts.Logger = newTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopicIgnPart("test_channel_confirm_past")
+	channel := topic.GetChannel("channel")
+	msgNum := 3
+	for i := 0; i < msgNum; i++ {
+		topic.PutMessage(NewMessage(0, []byte("body"+strconv.Itoa(i))))
+	}
+	topic.flush(true)
+
+	var first *Message
+	select {
+	case first = <-channel.clientMsgChan:
+	case <-time.After(time.Second * 3):
+		t.Fatalf("should read the message")
+	}
+	equal(t, string(first.Body), "body0")
+	_, err := channel.ConfirmPastMessageAt(first.Offset + 1)
+	equal(t, err, ErrNotConfirmedFrontier)
+
+	confirmed, err := channel.ConfirmPastMessageAt(first.Offset)
+	equal(t, err, nil)
+	equal(t, confirmed, first.Offset+first.RawMoveSize)
+	equal(t, channel.GetConfirmed().Offset(), confirmed)
+	// the messages read before are dropped and the channel reads from the new confirmed
+	for i := 1; i < msgNum; i++ {
+		select {
+		case msg := <-channel.clientMsgChan:
+			equal(t, string(msg.Body), "body"+strconv.Itoa(i))
+			channel.ConfirmBackendQueue(msg)
+		case <-time.After(time.Second * 3):
+			t.Fatalf("should read the message %v after confirmed past", i)
+		}
+	}
+	equal(t, channel.Depth(), int64(0))
+}
+
+func TestChannelSkipMessages(t *testing.T) {
+	opts := NewOptions()
+	opts.SyncEvery = 1
+	opts.Logger = newTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopicIgnPart("test_channel_skip_messages")
+	channel := topic.GetChannel("channel")
+	msgNum := 10
+	for i := 0; i < msgNum; i++ {
+		topic.PutMessage(NewMessage(0, []byte("body"+strconv.Itoa(i))))
+	}
+	topic.flush(true)
+
+	select {
+	case msg := <-channel.clientMsgChan:
+		equal(t, string(msg.Body), "body0")
+	case <-time.After(time.Second * 3):
+		t.Fatalf("should read the message")
+	}
+	confirmed, skipped, err := channel.SkipMessages(3)
+	equal(t, err, nil)
+	equal(t, skipped, int64(3))
+	equal(t, channel.GetConfirmed().Offset(), confirmed)
+	equal(t, channel.GetConfirmed().TotalMsgCnt(), int64(3))
+	// the messages read before are dropped and the channel reads after the skipped
+	for i := 3; i < msgNum; i++ {
+		select {
+		case msg := <-channel.clientMsgChan:
+			equal(t, string(msg.Body), "body"+strconv.Itoa(i))
+			channel.ConfirmBackendQueue(msg)
+		case <-time.After(time.Second * 3):
+			t.Fatalf("should read the message %v after skipped", i)
+		}
+	}
+	equal(t, channel.Depth(), int64(0))
+}
+
+func TestChannelReaderBufferedBytesStaged(t *testing.T) {
+	opts := NewOptions()
+	opts.SyncEvery = 1
+	opts.Logger = newTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopicIgnPart("test_channel_buffered_staged")
+	channel := topic.GetChannel("channel")
+	d := channel.backend.(*diskQueueReader)
+	msgNum := 4
+	body := make([]byte, 64*1024)
+	for i := 0; i < msgNum; i++ {
+		topic.PutMessage(NewMessage(0, body))
+	}
+	topic.flush(true)
+
+	for i := 0; i < msgNum; i++ {
+		// the pump is blocked while delivering the staged message
+		var staged int64
+		for j := 0; j < 100; j++ {
+			staged = channel.GetReaderBufferedBytes() - atomic.LoadInt64(&d.bufferedBytes)
+			if staged > 0 {
+				break
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+		select {
+		case msg := <-channel.clientMsgChan:
+			// the moved size has the 4 bytes size header of the data
+			equal(t, staged, int64(msg.RawMoveSize)-4)
+			channel.ConfirmBackendQueue(msg)
+		case <-time.After(time.Second * 3):
+			t.Fatalf("should read the message %v", i)
+		}
+	}
+	for j := 0; j < 100; j++ {
+		if channel.GetReaderBufferedBytes() == 0 {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	equal(t, channel.GetReaderBufferedBytes(), int64(0))
+}
+
+func TestChannelStagedMessageRedeliveredAfterRestart(t *testing.T) {
+	opts := NewOptions()
+	opts.SyncEvery = 1
+	opts.Logger = newTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
 
-	topicName := "test_channel_skip" + strconv.Itoa(int(time.Now().Unix()))
+	topicName := "test_channel_staged_restart"
 	topic := nsqd.GetTopicIgnPart(topicName)
 	channel := topic.GetChannel("channel")
-
-	msgs := make([]*Message, 0, 10)
-	for i := 0; i < 10; i++ {
-		var msgId MessageID
-		msgBytes := []byte(strconv.Itoa(i))
-		msg := NewMessage(msgId, msgBytes)
-		msgs = append(msgs, msg)
+	msgNum := 3
+	for i := 0; i < msgNum; i++ {
+		topic.PutMessage(NewMessage(0, []byte("body"+strconv.Itoa(i))))
 	}
-	topic.PutMessages(msgs)
-
-	var msgId MessageID
-	msgBytes := []byte(strconv.Itoa(10))
-	msg := NewMessage(msgId, msgBytes)
-	_, backendOffsetMid, _, _, _ := topic.PutMessage(msg)
 	topic.flush(true)
-	equal(t, channel.Depth(), int64(11))
 
-	msgs = make([]*Message, 0, 9)
-	//put another 10 messages
-	for i := 0; i < 9; i++ {
-		var msgId MessageID
-		msgBytes := []byte(strconv.Itoa(i + 11))
-		msg := NewMessage(msgId, msgBytes)
-		msgs = append(msgs, msg)
+	select {
+	case msg := <-channel.clientMsgChan:
+		equal(t, string(msg.Body), "body0")
+		channel.ConfirmBackendQueue(msg)
+	case <-time.After(time.Second * 3):
+		t.Fatalf("should read the message")
 	}
-	topic.PutMessages(msgs)
-	topic.flush(true)
-	equal(t, channel.Depth(), int64(20))
+	// wait the next message staged by the pump while no client receiving
+	for i := 0; i < 100; i++ {
+		if channel.GetReaderBufferedBytes() > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	confirmed := channel.GetConfirmed()
+	nsqd.Exit()
 
-	//skip forward to message 10
-	t.Logf("backendOffsetMid: %d", backendOffsetMid)
-	channel.SetConsumeOffset(backendOffsetMid, 10, true)
-	time.Sleep(time.Second)
-	for i := 0; i < 10; i++ {
-		outputMsg := <-channel.clientMsgChan
-		equal(t, string(outputMsg.Body[:]), strconv.Itoa(i+10))
+	_, _, nsqd = mustStartNSQD(opts)
+	defer nsqd.Exit()
+	topic = nsqd.GetTopicIgnPart(topicName)
+	channel = topic.GetChannel("channel")
+	// the staged message is not confirmed while closing, so it is delivered again
+	equal(t, channel.GetConfirmed().Offset(), confirmed.Offset())
+	for i := 1; i < msgNum; i++ {
+		select {
+		case msg := <-channel.clientMsgChan:
+			equal(t, string(msg.Body), "body"+strconv.Itoa(i))
+			channel.ConfirmBackendQueue(msg)
+		case <-time.After(time.Second * 3):
+			t.Fatalf("should read the message %v after restart", i)
+		}
 	}
 }
 
-func TestChannelResetReadEnd(t *testing.T) {
+func TestChannelOffsetBase(t *testing.T) {
 	opts := NewOptions()
 	opts.SyncEvery = 1
 	opts.Logger = newTestLogger(t)
@@ -260,54 +1276,113 @@ func TestChannelResetReadEnd(t *testing.T) {
 	defer os.RemoveAll(opts.DataPath)
 	defer nsqd.Exit()
 
-	topicName := "test_channel_skip" + strconv.Itoa(int(time.Now().Unix()))
-	topic := nsqd.GetTopicIgnPart(topicName)
+	topic := nsqd.GetTopicIgnPart("test_channel_offset_base")
 	channel := topic.GetChannel("channel")
-
-	msgs := make([]*Message, 0, 10)
-	for i := 0; i < 10; i++ {
-		var msgId MessageID
-		msgBytes := []byte(strconv.Itoa(i))
-		msg := NewMessage(msgId, msgBytes)
-		msgs = append(msgs, msg)
+	msgNum := 4
+	for i := 0; i < msgNum; i++ {
+		topic.PutMessage(NewMessage(0, []byte("body"+strconv.Itoa(i))))
 	}
-	topic.PutMessages(msgs)
-
-	var msgId MessageID
-	msgBytes := []byte(strconv.Itoa(10))
-	msg := NewMessage(msgId, msgBytes)
-	_, backendOffsetMid, _, _, _ := topic.PutMessage(msg)
 	topic.flush(true)
-	equal(t, channel.Depth(), int64(11))
+	select {
+	case msg := <-channel.clientMsgChan:
+		channel.ConfirmBackendQueue(msg)
+	case <-time.After(time.Second * 3):
+		t.Fatalf("should read the message")
+	}
 
-	msgs = make([]*Message, 0, 9)
-	//put another 10 messages
-	for i := 0; i < 9; i++ {
-		var msgId MessageID
-		msgBytes := []byte(strconv.Itoa(i + 11))
-		msg := NewMessage(msgId, msgBytes)
-		msgs = append(msgs, msg)
+	base := BackendOffset(1000)
+	nequal(t, topic.SetOffsetBase(-1), nil)
+	equal(t, topic.SetOffsetBase(base), nil)
+	equal(t, channel.GetOffsetBase(), base)
+	// the new channel uses the base of the topic
+	equal(t, topic.GetChannel("channel2").GetOffsetBase(), base)
+
+	confirmed := channel.GetConfirmed()
+	stats := NewChannelStats(channel, nil)
+	equal(t, stats.OffsetBase, int64(base))
+	equal(t, stats.ConfirmedOffset, int64(confirmed.Offset()+base))
+	equal(t, stats.RetainedStart, channel.GetRetainedStart()+int64(base))
+
+	r, err := channel.GetOffsetBaseReader()
+	equal(t, err, nil)
+	equal(t, r.OffsetBase(), base)
+	equal(t, r.GetQueueConfirmed().Offset(), confirmed.Offset()+base)
+	equal(t, r.GetQueueConfirmed().TotalMsgCnt(), confirmed.TotalMsgCnt())
+}
+
+func TestChannelParseMsgHeader(t *testing.T) {
+	opts := NewOptions()
+	opts.SyncEvery = 1
+	opts.ParseMsgHeader = true
+	opts.Logger = newTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopicIgnPart("test_channel_parse_msg_header")
+	channel := topic.GetChannel("channel")
+	equal(t, atomic.LoadInt32(&channel.backend.(*diskQueueReader).parseMsgHeader), int32(1))
+	var ids []MessageID
+	for i := 0; i < 10; i++ {
+		id, _, _, _, err := topic.PutMessage(NewMessage(0, []byte("body"+strconv.Itoa(i))))
+		equal(t, err, nil)
+		ids = append(ids, id)
 	}
-	topic.PutMessages(msgs)
 	topic.flush(true)
-	equal(t, channel.Depth(), int64(20))
 
-	//skip forward to message 10
-	t.Logf("backendOffsetMid: %d", backendOffsetMid)
-	channel.SetConsumeOffset(backendOffsetMid, 10, true)
 	for i := 0; i < 10; i++ {
-		outputMsg := <-channel.clientMsgChan
-		equal(t, string(outputMsg.Body[:]), strconv.Itoa(i+10))
+		select {
+		case msg := <-channel.clientMsgChan:
+			equal(t, msg.ID, ids[i])
+			equal(t, string(msg.Body), "body"+strconv.Itoa(i))
+			channel.ConfirmBackendQueue(msg)
+		case <-time.After(time.Second * 3):
+			t.Fatalf("should read the message")
+		}
 	}
-	equal(t, channel.Depth(), int64(10))
+}
 
-	channel.SetConsumeOffset(0, 0, true)
-	//equal(t, channel.Depth(), int64(20))
-	for i := 0; i < 20; i++ {
-		outputMsg := <-channel.clientMsgChan
-		t.Logf("Msg: %s", outputMsg.Body)
-		equal(t, string(outputMsg.Body[:]), strconv.Itoa(i))
+func TestChannelConfirmDeadlineRedeliver(t *testing.T) {
+	opts := NewOptions()
+	opts.SyncEvery = 1
+	opts.ConfirmDeadline = time.Millisecond * 100
+	opts.ConfirmDeadlineMaxRedeliver = 1
+	opts.Logger = newTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopicIgnPart("test_channel_confirm_deadline")
+	channel := topic.GetChannel("channel")
+	topic.PutMessage(NewMessage(0, []byte("body")))
+	topic.flush(true)
+
+	var first *Message
+	select {
+	case first = <-channel.clientMsgChan:
+	case <-time.After(time.Second * 3):
+		t.Fatalf("should read the message")
 	}
+	channel.processInFlightQueue(time.Now().UnixNano())
+	redelivered, _, _ := channel.GetReaderDeadlineRedelivers()
+	equal(t, redelivered, int64(0))
+
+	// never confirmed, redelivered after the deadline
+	time.Sleep(opts.ConfirmDeadline * 2)
+	channel.processInFlightQueue(time.Now().UnixNano())
+	select {
+	case msg := <-channel.clientMsgChan:
+		equal(t, msg.Offset, first.Offset)
+		equal(t, string(msg.Body), "body")
+		channel.ConfirmBackendQueue(msg)
+	case <-time.After(time.Second * 3):
+		t.Fatalf("should redeliver the message")
+	}
+	redelivered, exhausted, _ := channel.GetReaderDeadlineRedelivers()
+	equal(t, redelivered, int64(1))
+	equal(t, exhausted, int64(0))
+	equal(t, channel.GetConfirmed().Offset(), channel.GetChannelEnd().Offset())
+	equal(t, channel.Depth(), int64(0))
 }
 
 // depth timestamp is the next msg time need to be consumed
@@ -512,3 +1587,441 @@ func BenchmarkRangeTree(b *testing.B) {
 		//}
 	}
 }
+
+func TestChannelCloseRedeliverStaged(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+
+	topicName := "test_channel_close_staged" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopicIgnPart(topicName)
+	channel := topic.GetChannel("ch")
+	msgNum := 10
+	for i := 0; i < msgNum; i++ {
+		topic.PutMessage(NewMessage(0, []byte("body"+strconv.Itoa(i))))
+	}
+	topic.flush(true)
+
+	var msgs []*Message
+	for i := 0; i < 3; i++ {
+		select {
+		case msg := <-channel.clientMsgChan:
+			msgs = append(msgs, msg)
+		case <-time.After(time.Second):
+			t.Fatal("should read the message")
+		}
+	}
+	channel.ConfirmBackendQueue(msgs[0])
+	equal(t, channel.GetConfirmed().Offset(), msgs[1].Offset)
+	// wait the next message staged in the pump
+	time.Sleep(time.Millisecond * 100)
+	nsqd.Exit()
+
+	_, _, nsqd = mustStartNSQD(opts)
+	defer nsqd.Exit()
+	nsqd.LoadMetadata(0)
+	topic, err := nsqd.GetExistingTopic(topicName, 0)
+	equal(t, err, nil)
+	channel, err = topic.GetExistingChannel("ch")
+	equal(t, err, nil)
+	equal(t, channel.GetConfirmed().Offset(), msgs[1].Offset)
+	// the messages handed off but not confirmed and the staged one should be redelivered
+	for i := 1; i <= 3; i++ {
+		select {
+		case msg := <-channel.clientMsgChan:
+			equal(t, string(msg.Body), "body"+strconv.Itoa(i))
+			if i < 3 {
+				equal(t, msg.Offset, msgs[i].Offset)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("message %v should be redelivered", i)
+		}
+	}
+}
+
+func TestChannelAdaptiveReadPacing(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	opts.MaxConfirmWin = 4
+	opts.AdaptiveReadPacing = true
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopicIgnPart("test_channel_adaptive_read_pacing")
+	channel := topic.GetChannel("ch")
+	for i := 0; i < 100; i++ {
+		topic.PutMessage(NewMessage(0, []byte("test")))
+	}
+	topic.flush(true)
+
+	client := NewFakeConsumer(0)
+	recv := func() *Message {
+		select {
+		case msg := <-channel.clientMsgChan:
+			channel.StartInFlightTimeout(msg, client, "", opts.MsgTimeout)
+			return msg
+		case <-time.After(time.Second):
+			t.Fatal("no message delivered")
+		}
+		return nil
+	}
+	finish := func(msg *Message) {
+		_, _, _, _, err := channel.FinishMessage(0, "127.0.0.1:0", msg.ID)
+		equal(t, err, nil)
+	}
+
+	// slow confirmer keeps the window filled up
+	var pending []*Message
+	for i := 0; i < 20; i++ {
+		pending = append(pending, recv())
+		if len(pending) > int(opts.MaxConfirmWin) {
+			time.Sleep(time.Millisecond * 20)
+			finish(pending[0])
+			pending = pending[1:]
+		}
+	}
+	slowLatency := channel.GetConfirmLatency()
+	assert(t, slowLatency >= time.Millisecond*20, "confirm latency should be measured: %v", slowLatency)
+	assert(t, channel.GetReadPaceDelay() > 0, "read should be paced by the slow confirm")
+	equal(t, NewChannelStats(channel, nil).ConfirmLatency, int64(slowLatency/time.Millisecond))
+
+	// the pacing should recover while the confirms speed up
+	for _, msg := range pending {
+		finish(msg)
+	}
+	for i := 0; i < 40; i++ {
+		finish(recv())
+	}
+	assert(t, channel.GetConfirmLatency() < slowLatency, "confirm latency should drop: %v, %v",
+		channel.GetConfirmLatency(), slowLatency)
+	equal(t, channel.GetReadPaceDelay(), time.Duration(0))
+}
+
+type memoryBackendReader struct {
+	BackendQueueReader
+}
+
+func (r *memoryBackendReader) BackendType() string {
+	return BackendTypeMemory
+}
+
+func TestChannelBackendType(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopicIgnPart("test_channel_backend_type")
+	channel := topic.GetChannel("ch")
+	equal(t, topic.GetBackendType(), BackendTypeDisk)
+	equal(t, topic.IsDiskBacked(), true)
+	equal(t, channel.GetBackendType(), BackendTypeDisk)
+	equal(t, channel.IsDiskBacked(), true)
+	chStats := NewChannelStats(channel, nil)
+	equal(t, chStats.BackendType, BackendTypeDisk)
+	equal(t, chStats.DiskBacked, true)
+	topicStats := NewTopicStats(topic, nil)
+	equal(t, topicStats.BackendType, BackendTypeDisk)
+	equal(t, topicStats.DiskBacked, true)
+
+	memChannel := &Channel{backend: &memoryBackendReader{}}
+	equal(t, memChannel.GetBackendType(), BackendTypeMemory)
+	equal(t, memChannel.IsDiskBacked(), false)
+}
+
+type recordedSpan struct {
+	sync.Mutex
+	name  string
+	attrs map[string]interface{}
+	ended bool
+	err   error
+}
+
+func (s *recordedSpan) SetAttributes(attrs ...SpanAttribute) {
+	s.Lock()
+	for _, a := range attrs {
+		s.attrs[a.Key] = a.Value
+	}
+	s.Unlock()
+}
+
+func (s *recordedSpan) End(err error) {
+	s.Lock()
+	s.ended = true
+	s.err = err
+	s.Unlock()
+}
+
+func (s *recordedSpan) isEnded() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.ended
+}
+
+type recordingSpanTracer struct {
+	sync.Mutex
+	spans []*recordedSpan
+}
+
+func (r *recordingSpanTracer) StartSpan(name string, attrs ...SpanAttribute) ReadSpan {
+	s := &recordedSpan{name: name, attrs: make(map[string]interface{})}
+	s.SetAttributes(attrs...)
+	r.Lock()
+	r.spans = append(r.spans, s)
+	r.Unlock()
+	return s
+}
+
+func (r *recordingSpanTracer) byName(name string) []*recordedSpan {
+	r.Lock()
+	defer r.Unlock()
+	var ret []*recordedSpan
+	for _, s := range r.spans {
+		if s.name == name {
+			ret = append(ret, s)
+		}
+	}
+	return ret
+}
+
+func TestChannelReadSpanTracer(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopicIgnPart("test_channel_read_span")
+	channel := topic.GetChannel("ch")
+	tracer := &recordingSpanTracer{}
+	channel.SetReadSpanTracer(tracer)
+	msgNum := 5
+	for i := 0; i < msgNum; i++ {
+		topic.PutMessage(NewMessage(0, []byte("test")))
+	}
+	topic.flush(true)
+
+	var delivered []*Message
+	for i := 0; i < msgNum; i++ {
+		select {
+		case msg := <-channel.clientMsgChan:
+			channel.StartInFlightTimeout(msg, NewFakeConsumer(0), "", opts.MsgTimeout)
+			delivered = append(delivered, msg)
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting the message")
+		}
+	}
+	spans := tracer.byName(SpanNameDeliver)
+	equal(t, len(spans), msgNum)
+	for i, msg := range delivered {
+		s := spans[i]
+		equal(t, s.attrs["nsq.message.id"], uint64(msg.ID))
+		equal(t, s.attrs["nsq.message.offset"], int64(msg.Offset))
+		equal(t, s.attrs["nsq.message.size"], int64(msg.RawMoveSize))
+		equal(t, s.attrs["nsq.channel"], "ch")
+		equal(t, s.isEnded(), false)
+	}
+
+	// the confirm ends the delivery span of the message only
+	_, _, _, _, err := channel.FinishMessage(0, "127.0.0.1:0", delivered[0].ID)
+	equal(t, err, nil)
+	equal(t, spans[0].isEnded(), true)
+	equal(t, spans[0].err, nil)
+	equal(t, spans[1].isEnded(), false)
+	confirms := tracer.byName(SpanNameConfirm)
+	equal(t, len(confirms), 1)
+	equal(t, confirms[0].isEnded(), true)
+	equal(t, confirms[0].attrs["nsq.message.offset"], int64(delivered[0].Offset))
+	equal(t, confirms[0].attrs["nsq.message.size"], int64(delivered[0].RawMoveSize))
+
+	for _, msg := range delivered[1:] {
+		_, _, _, _, err := channel.FinishMessage(0, "127.0.0.1:0", msg.ID)
+		equal(t, err, nil)
+	}
+	for _, s := range spans {
+		equal(t, s.isEnded(), true)
+	}
+	equal(t, len(tracer.byName(SpanNameConfirm)), msgNum)
+
+	// the failed confirm ends the confirm span with the error
+	_, _, _, _, err = channel.FinishMessage(0, "127.0.0.1:0", delivered[0].ID)
+	assert(t, err != nil, "should fail to confirm the message not in flight")
+	confirms = tracer.byName(SpanNameConfirm)
+	equal(t, confirms[len(confirms)-1].err, err)
+
+	// nothing is traced by the no-op tracer
+	channel.SetReadSpanTracer(nil)
+	topic.PutMessage(NewMessage(0, []byte("test")))
+	topic.flush(true)
+	msg := <-channel.clientMsgChan
+	channel.StartInFlightTimeout(msg, NewFakeConsumer(0), "", opts.MsgTimeout)
+	channel.FinishMessage(0, "127.0.0.1:0", msg.ID)
+	equal(t, len(tracer.byName(SpanNameDeliver)), msgNum)
+}
+
+func TestChannelReadSampler(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopicIgnPart("test_channel_read_sampler")
+	channel := topic.GetChannel("ch")
+	var lock sync.Mutex
+	var samples []MessageSample
+	channel.SetReadSampler(&ReadSampler{
+		Rate: 1,
+		Callback: func(s MessageSample) {
+			lock.Lock()
+			samples = append(samples, s)
+			lock.Unlock()
+		},
+	})
+	msgNum := 5
+	for i := 0; i < msgNum; i++ {
+		topic.PutMessage(NewMessage(0, []byte("test")))
+	}
+	topic.flush(true)
+
+	var delivered []*Message
+	for i := 0; i < msgNum; i++ {
+		select {
+		case msg := <-channel.clientMsgChan:
+			channel.StartInFlightTimeout(msg, NewFakeConsumer(0), "", opts.MsgTimeout)
+			delivered = append(delivered, msg)
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting the message")
+		}
+	}
+	time.Sleep(time.Millisecond * 10)
+	for _, msg := range delivered {
+		_, _, _, _, err := channel.FinishMessage(0, "127.0.0.1:0", msg.ID)
+		equal(t, err, nil)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	equal(t, len(samples), msgNum*2)
+	for i, msg := range delivered {
+		s := samples[i]
+		equal(t, s.Point, SamplePointDelivery)
+		equal(t, s.ID, msg.ID)
+		equal(t, s.Offset, msg.Offset)
+		equal(t, s.Size, msg.RawMoveSize)
+		equal(t, s.Latency, time.Duration(0))
+		s = samples[msgNum+i]
+		equal(t, s.Point, SamplePointConfirm)
+		equal(t, s.ID, msg.ID)
+		equal(t, s.Offset, msg.Offset)
+		assert(t, s.Latency >= time.Millisecond*10 && s.Latency < time.Second,
+			"confirm latency should be plausible: %v", s.Latency)
+	}
+
+	// nothing is sampled after disabled
+	channel.SetReadSampler(nil)
+	topic.PutMessage(NewMessage(0, []byte("test")))
+	topic.flush(true)
+	msg := <-channel.clientMsgChan
+	channel.StartInFlightTimeout(msg, NewFakeConsumer(0), "", opts.MsgTimeout)
+	channel.FinishMessage(0, "127.0.0.1:0", msg.ID)
+	equal(t, len(samples), msgNum*2)
+}
+
+func TestChannelDeadLetter(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopicIgnPart("test_channel_dead_letter")
+	channel := topic.GetChannel("ch")
+	equal(t, channel.SetDeadLetterPolicy(topic.GetTopicName(), 2), ErrInvalidDeadLetterTopic)
+	equal(t, channel.SetDeadLetterPolicy("test_channel_dead_letter_dlq", 2), nil)
+	dlq := nsqd.GetTopic("test_channel_dead_letter_dlq", 0)
+
+	topic.PutMessage(NewMessage(0, []byte("poison")))
+	topic.flush(true)
+	var msg *Message
+	for i := 0; i < 2; i++ {
+		select {
+		case msg = <-channel.clientMsgChan:
+			channel.StartInFlightTimeout(msg, NewFakeConsumer(0), "", opts.MsgTimeout)
+			equal(t, msg.Attempts, uint16(i+1))
+			err := channel.RequeueMessage(0, "", msg.ID, 0, true)
+			equal(t, err, nil)
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting the message")
+		}
+	}
+
+	start := time.Now()
+	for channel.GetDeadLetterCount() == 0 && time.Since(start) < time.Second*3 {
+		time.Sleep(time.Millisecond * 10)
+	}
+	equal(t, channel.GetDeadLetterCount(), uint64(1))
+	equal(t, dlq.TotalMessageCnt(), uint64(1))
+	equal(t, channel.GetConfirmed().Offset(), msg.Offset+msg.RawMoveSize)
+	equal(t, channel.Depth(), int64(0))
+	select {
+	case m := <-channel.clientMsgChan:
+		t.Fatalf("the dead letter message should not be delivered again: %v", m)
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	// the policy is persisted in the channel meta
+	metas := topic.GetChannelMeta()
+	equal(t, len(metas), 1)
+	equal(t, metas[0].DeadLetterTopic, "test_channel_dead_letter_dlq")
+	equal(t, metas[0].DeadLetterAttempts, uint16(2))
+}
+
+func TestChannelDeadLetterTopicMissing(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopicIgnPart("test_channel_dead_letter_missing")
+	channel := topic.GetChannel("ch")
+	equal(t, channel.SetDeadLetterPolicy("test_channel_dead_letter_missing_dlq", 1), nil)
+
+	topic.PutMessage(NewMessage(0, []byte("poison")))
+	topic.flush(true)
+	// the message is kept in the channel after failed to route the max times
+	var msg *Message
+	for i := 0; i < maxDeadLetterRouteFailures+2; i++ {
+		select {
+		case msg = <-channel.clientMsgChan:
+			channel.StartInFlightTimeout(msg, NewFakeConsumer(0), "", opts.MsgTimeout)
+			err := channel.RequeueMessage(0, "", msg.ID, 0, true)
+			equal(t, err, nil)
+		case <-time.After(time.Second * 3):
+			t.Fatalf("timeout waiting the message")
+		}
+	}
+	equal(t, channel.GetDeadLetterCount(), uint64(0))
+	channel.inFlightMutex.Lock()
+	equal(t, channel.deadLetterFailures[msg.ID], maxDeadLetterRouteFailures)
+	channel.inFlightMutex.Unlock()
+	// the missing dead letter topic should not be created
+	_, err := nsqd.GetExistingTopic("test_channel_dead_letter_missing_dlq", 0)
+	equal(t, err, ErrTopicNotExist)
+
+	select {
+	case msg = <-channel.clientMsgChan:
+		channel.StartInFlightTimeout(msg, NewFakeConsumer(0), "", opts.MsgTimeout)
+		_, _, _, _, err = channel.FinishMessage(0, "", msg.ID)
+		equal(t, err, nil)
+	case <-time.After(time.Second * 3):
+		t.Fatalf("timeout waiting the message")
+	}
+	channel.inFlightMutex.Lock()
+	equal(t, len(channel.deadLetterFailures), 0)
+	channel.inFlightMutex.Unlock()
+}
@@ -115,6 +115,7 @@ type ClientV2 struct {
 
 	AuthSecret  string
 	AuthState   *auth.State
+	AuthCache   auth.StateCache
 	tlsConfig   *tls.Config
 	EnableTrace bool
 
@@ -731,7 +732,7 @@ func (c *ClientV2) QueryAuthd() error {
 		tlsEnabled = "true"
 	}
 
-	authState, err := auth.QueryAnyAuthd(c.ctxOpts.AuthHTTPAddresses,
+	authState, err := auth.QueryAnyAuthdCached(c.AuthCache, c.ctxOpts.AuthHTTPAddresses,
 		remoteIP, tlsEnabled, c.AuthSecret)
 	if err != nil {
 		return err
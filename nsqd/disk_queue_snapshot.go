@@ -22,6 +22,7 @@ type DiskQueueSnapshot struct {
 
 	readFrom string
 	dataPath string
+	coldPath string
 	exitFlag int32
 
 	readFile *os.File
@@ -31,9 +32,15 @@ type DiskQueueSnapshot struct {
 // newDiskQueue instantiates a new instance of DiskQueueSnapshot, retrieving metadata
 // from the filesystem and starting the read ahead goroutine
 func NewDiskQueueSnapshot(readFrom string, dataPath string, endInfo BackendQueueEnd) *DiskQueueSnapshot {
+	return newTieredDiskQueueSnapshot(readFrom, dataPath, "", endInfo)
+}
+
+// the snapshot of the data files which may be moved to the cold path
+func newTieredDiskQueueSnapshot(readFrom string, dataPath string, coldPath string, endInfo BackendQueueEnd) *DiskQueueSnapshot {
 	d := DiskQueueSnapshot{
 		readFrom: readFrom,
 		dataPath: dataPath,
+		coldPath: coldPath,
 	}
 
 	d.UpdateQueueEnd(endInfo)
@@ -42,8 +49,7 @@ func NewDiskQueueSnapshot(readFrom string, dataPath string, endInfo BackendQueue
 }
 
 func (d *DiskQueueSnapshot) getCurrentFileEnd(offset diskQueueOffset) (int64, error) {
-	curFileName := d.fileName(offset.FileNum)
-	f, err := os.Stat(curFileName)
+	f, err := statResolvedQueueFile(d.dataPath, d.coldPath, d.readFrom, offset.FileNum)
 	if err != nil {
 		return 0, err
 	}
@@ -131,7 +137,7 @@ func (d *DiskQueueSnapshot) stepOffset(allowBackward bool, cur diskQueueEndInfo,
 	if !allowBackward && step < 0 {
 		return newOffset.EndOffset, fmt.Errorf("can not step backward")
 	}
-	return stepOffset(d.dataPath, d.readFrom, cur, BackendOffset(step), maxStep)
+	return stepOffset(d.dataPath, d.coldPath, d.readFrom, 0, cur, BackendOffset(step), maxStep)
 }
 
 func (d *DiskQueueSnapshot) SkipToNext() error {
@@ -223,8 +229,9 @@ func (d *DiskQueueSnapshot) ReadRaw(size int32) ([]byte, error) {
 
 	CheckFileOpen:
 		if d.readFile == nil {
-			curFileName := d.fileName(d.readPos.EndOffset.FileNum)
-			d.readFile, err = os.OpenFile(curFileName, os.O_RDONLY, 0600)
+			var curFileName string
+			d.readFile, curFileName, err = openResolvedQueueFile(d.dataPath, d.coldPath, d.readFrom,
+				d.readPos.EndOffset.FileNum, openSnapshotFile)
 			if err != nil {
 				return result, err
 			}
@@ -314,8 +321,9 @@ CheckFileOpen:
 
 	result.Offset = d.readPos.virtualEnd
 	if d.readFile == nil {
-		curFileName := d.fileName(d.readPos.EndOffset.FileNum)
-		d.readFile, result.Err = os.OpenFile(curFileName, os.O_RDONLY, 0600)
+		var curFileName string
+		d.readFile, curFileName, result.Err = openResolvedQueueFile(d.dataPath, d.coldPath, d.readFrom,
+			d.readPos.EndOffset.FileNum, openSnapshotFile)
 		if result.Err != nil {
 			return result
 		}
@@ -408,3 +416,11 @@ CheckFileOpen:
 func (d *DiskQueueSnapshot) fileName(fileNum int64) string {
 	return GetQueueFileName(d.dataPath, d.readFrom, fileNum)
 }
+
+func openSnapshotFile(fileName string) (*os.File, error) {
+	return os.OpenFile(fileName, os.O_RDONLY, 0600)
+}
+
+func (d *DiskQueueSnapshot) dataFileName(fileNum int64) string {
+	return resolveQueueFileName(d.dataPath, d.coldPath, d.readFrom, fileNum)
+}
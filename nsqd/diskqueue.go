@@ -314,6 +314,10 @@ func (d *diskQueue) writeOne(data []byte) error {
 
 	if d.writeFile == nil {
 		curFileName := d.fileName(d.writeFileNum)
+		err = ensureQueueFileDir(curFileName)
+		if err != nil {
+			return err
+		}
 		d.writeFile, err = os.OpenFile(curFileName, os.O_RDWR|os.O_CREATE, 0600)
 		if err != nil {
 			return err
@@ -459,8 +463,9 @@ func (d *diskQueue) metaDataFileName() string {
 	return fmt.Sprintf(path.Join(d.dataPath, "%s.diskqueue.meta.dat"), d.name)
 }
 
+// the data files are named by the configured pattern as the other disk queues
 func (d *diskQueue) fileName(fileNum int64) string {
-	return fmt.Sprintf(path.Join(d.dataPath, "%s.diskqueue.%06d.dat"), d.name, fileNum)
+	return GetQueueFileName(d.dataPath, d.name, fileNum)
 }
 
 func (d *diskQueue) checkTailCorruption(depth int64) {
@@ -519,6 +524,7 @@ func (d *diskQueue) moveForward() {
 		if err != nil {
 			d.logf("ERROR: failed to Remove(%s) - %s", fn, err)
 		}
+		removeEmptyQueueFileDir(d.dataPath, d.name, oldReadFileNum)
 	}
 
 	d.checkTailCorruption(depth)
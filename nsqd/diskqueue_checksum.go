@@ -0,0 +1,110 @@
+package nsqd
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math/rand"
+	"os"
+	"sync/atomic"
+
+	"github.com/youzan/nsq/internal/util"
+)
+
+var ErrDataFileChecksumMismatch = errors.New("the data file checksum mismatch")
+
+// save the checksum of each data file finished by the writer, disabled by default
+// since the whole file should be read again while finished.
+var dataFileChecksum = int32(0)
+
+func SetDataFileChecksum(enable bool) {
+	if enable {
+		atomic.StoreInt32(&dataFileChecksum, 1)
+	} else {
+		atomic.StoreInt32(&dataFileChecksum, 0)
+	}
+}
+
+func isDataFileChecksumEnabled() bool {
+	return atomic.LoadInt32(&dataFileChecksum) == 1
+}
+
+// the checksum is kept with the offset meta, so it is not moved with the cold data file
+func getQueueFileChecksumName(metaBaseName string) string {
+	return metaBaseName + ".checksum.dat"
+}
+
+func calcQueueFileChecksum(dataFileName string) (uint32, error) {
+	f, err := os.Open(dataFileName)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	h := crc32.NewIEEE()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return 0, err
+	}
+	return h.Sum32(), nil
+}
+
+func saveQueueFileChecksum(metaBaseName string, dataFileName string) error {
+	sum, err := calcQueueFileChecksum(dataFileName)
+	if err != nil {
+		return err
+	}
+	return writeQueueFileChecksum(metaBaseName, sum)
+}
+
+// write the checksum to the temp file and rename it, as the offset meta rebuilt.
+func writeQueueFileChecksum(metaBaseName string, sum uint32) error {
+	fName := getQueueFileChecksumName(metaBaseName)
+	tmpName := fmt.Sprintf("%s.%d.tmp", fName, rand.Int())
+	f, err := os.OpenFile(tmpName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "%d\n", sum)
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	return util.AtomicRenameSync(tmpName, fName)
+}
+
+func getQueueFileChecksum(metaBaseName string) (uint32, error) {
+	f, err := os.Open(getQueueFileChecksumName(metaBaseName))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	var sum uint32
+	_, err = fmt.Fscanf(f, "%d\n", &sum)
+	if err != nil {
+		return 0, err
+	}
+	return sum, nil
+}
+
+// verifyQueueFileChecksum returns ErrDataFileChecksumMismatch if the data file is changed
+// after finished, and the error of the checksum file if it is not saved.
+func verifyQueueFileChecksum(metaBaseName string, dataFileName string) error {
+	expected, err := getQueueFileChecksum(metaBaseName)
+	if err != nil {
+		return err
+	}
+	sum, err := calcQueueFileChecksum(dataFileName)
+	if err != nil {
+		return err
+	}
+	if sum != expected {
+		nsqLog.LogErrorf("data file %v checksum mismatch: %v, expected %v", dataFileName, sum, expected)
+		return ErrDataFileChecksumMismatch
+	}
+	return nil
+}
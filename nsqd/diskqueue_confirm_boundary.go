@@ -0,0 +1,45 @@
+package nsqd
+
+import (
+	"sync/atomic"
+)
+
+// SetConfirmBoundaryCheck changes whether the confirm offset is verified to be the boundary of
+// the messages, the confirm in the middle of a message is rejected with ErrConfirmNotBoundary
+// if enabled, otherwise the confirmed is moved to it as before.
+func (d *diskQueueReader) SetConfirmBoundaryCheck(enable bool) {
+	if enable {
+		atomic.StoreInt32(&d.confirmBoundaryCheck, 1)
+	} else {
+		atomic.StoreInt32(&d.confirmBoundaryCheck, 0)
+	}
+}
+
+// the offset between the confirmed and the read is the boundary if it is the start of a message
+// read, otherwise the data is read from the confirmed to verify it. should be protected by the lock
+func (d *diskQueueReader) isMessageBoundary(offset BackendOffset) bool {
+	if offset == d.confirmedQueueInfo.Offset() || offset == d.readQueueInfo.Offset() {
+		return true
+	}
+	if _, ok := d.readAttempts[offset]; ok {
+		return true
+	}
+	if _, ok := d.skippedPending[offset]; ok {
+		return true
+	}
+	tmp := d.newRangeReader(d.confirmedQueueInfo, d.readQueueInfo)
+	defer tmp.closeRangeReader()
+	for d.readQueueInfo.EndOffset.GreatThan(&tmp.readQueueInfo.EndOffset) {
+		cur := tmp.readQueueInfo.Offset()
+		if cur >= offset {
+			return cur == offset
+		}
+		ret := tmp.readOne()
+		if ret.Err != nil {
+			nsqLog.LogWarningf("diskqueue(%s) failed to verify the confirm boundary at %v: %v",
+				d.readerMetaName, tmp.readQueueInfo, ret.Err)
+			return false
+		}
+	}
+	return tmp.readQueueInfo.Offset() == offset
+}
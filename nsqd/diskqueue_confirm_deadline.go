@@ -0,0 +1,165 @@
+package nsqd
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// confirmDeadline is the deadline of the message delivered, and the read position before the
+// message to redeliver from.
+type confirmDeadline struct {
+	start       diskQueueEndInfo
+	deadline    int64
+	redelivered int32
+}
+
+// SetConfirmDeadline sets the deadline for the confirm of each message delivered, the read is
+// rewound to redeliver from the message not confirmed before the deadline. The message is
+// redelivered by the deadline at most maxRedeliver times, and left to the upper layer after
+// that. The deadlines are checked periodically by the channel, and the read is rewound by the
+// channel reset. 0 timeout to disable.
+func (d *diskQueueReader) SetConfirmDeadline(timeout time.Duration, maxRedeliver int32) {
+	d.Lock()
+	d.confirmTimeout = timeout
+	d.maxDeadlineRedeliver = maxRedeliver
+	if timeout <= 0 {
+		d.confirmDeadlines = nil
+	}
+	d.Unlock()
+}
+
+// SetMessageConfirmDeadline changes the deadline of the message delivered and not confirmed,
+// the confirm deadline should be enabled while the message delivered.
+func (d *diskQueueReader) SetMessageConfirmDeadline(offset BackendOffset, deadline time.Time) error {
+	d.Lock()
+	defer d.Unlock()
+	if d.exitFlag == 1 {
+		return ErrExiting
+	}
+	cd, ok := d.confirmDeadlines[offset]
+	if !ok || offset < d.confirmedQueueInfo.Offset() || offset >= d.readQueueInfo.Offset() {
+		return ErrMoveOffsetInvalid
+	}
+	cd.deadline = deadline.UnixNano()
+	return nil
+}
+
+// DeadlineRedeliverCount returns the times of the read rewound by the confirm deadline.
+func (d *diskQueueReader) DeadlineRedeliverCount() int64 {
+	return atomic.LoadInt64(&d.deadlineRedeliverCnt)
+}
+
+// DeadlineUntrackedCount returns the messages delivered without the deadline since too many
+// messages are waiting the confirm.
+func (d *diskQueueReader) DeadlineUntrackedCount() int64 {
+	return atomic.LoadInt64(&d.deadlineUntrackedCnt)
+}
+
+// DeadlineExhaustedCount returns the messages not confirmed before the deadline after
+// redelivered the max times.
+func (d *diskQueueReader) DeadlineExhaustedCount() int64 {
+	return atomic.LoadInt64(&d.deadlineExhaustedCnt)
+}
+
+// the redelivered times are kept while the message is delivered again.
+// should be protected by the lock
+func (d *diskQueueReader) trackConfirmDeadline(start diskQueueEndInfo, offset BackendOffset) {
+	if d.confirmTimeout <= 0 {
+		return
+	}
+	deadline := time.Now().Add(d.confirmTimeout).UnixNano()
+	if cd, ok := d.confirmDeadlines[offset]; ok {
+		cd.start = start
+		cd.deadline = deadline
+		return
+	}
+	if d.confirmDeadlines == nil {
+		d.confirmDeadlines = make(map[BackendOffset]*confirmDeadline)
+	}
+	if len(d.confirmDeadlines) >= maxTrackedAttempts {
+		if atomic.AddInt64(&d.deadlineUntrackedCnt, 1) == 1 {
+			nsqLog.LogWarningf("diskqueue(%s) too many messages waiting the confirm deadline, the message %v is not tracked",
+				d.readerMetaName, offset)
+		}
+		return
+	}
+	d.confirmDeadlines[offset] = &confirmDeadline{start: start, deadline: deadline}
+}
+
+// HasExpiredConfirmDeadline returns true if any message delivered is not confirmed before the
+// deadline and should be redelivered.
+func (d *diskQueueReader) HasExpiredConfirmDeadline() bool {
+	d.Lock()
+	defer d.Unlock()
+	if d.exitFlag == 1 {
+		return false
+	}
+	expired, _ := d.findExpiredConfirmDeadline()
+	return expired != nil
+}
+
+// return the first message delivered but not confirmed before the deadline, the message given
+// up after redelivered the max times is removed. should be protected by the lock
+func (d *diskQueueReader) findExpiredConfirmDeadline() (*confirmDeadline, BackendOffset) {
+	if len(d.confirmDeadlines) == 0 {
+		return nil, 0
+	}
+	now := time.Now().UnixNano()
+	confirmed := d.confirmedQueueInfo.Offset()
+	read := d.readQueueInfo.Offset()
+	var expired *confirmDeadline
+	var expiredOffset BackendOffset
+	for offset, cd := range d.confirmDeadlines {
+		if offset < confirmed {
+			delete(d.confirmDeadlines, offset)
+			continue
+		}
+		if offset >= read || cd.deadline > now {
+			continue
+		}
+		if cd.redelivered >= d.maxDeadlineRedeliver {
+			atomic.AddInt64(&d.deadlineExhaustedCnt, 1)
+			nsqLog.LogWarningf("diskqueue(%s) message %v not confirmed before the deadline after redelivered %v times",
+				d.readerMetaName, offset, cd.redelivered)
+			delete(d.confirmDeadlines, offset)
+			continue
+		}
+		if expired == nil || offset < expiredOffset {
+			expired = cd
+			expiredOffset = offset
+		}
+	}
+	return expired, expiredOffset
+}
+
+// rewind the read to the first message delivered but not confirmed before the deadline. The
+// message after the read position has been put back or reset and will get the new deadline
+// while delivered again. It should be done by the channel reset, so the messages read after it
+// are dropped by the channel. should be protected by the lock
+func (d *diskQueueReader) redeliverExpiredConfirmDeadline() {
+	expired, expiredOffset := d.findExpiredConfirmDeadline()
+	if expired == nil {
+		return
+	}
+	expired.redelivered++
+	atomic.AddInt64(&d.deadlineRedeliverCnt, 1)
+	nsqLog.Logf("diskqueue(%s) message %v not confirmed before the deadline, redeliver from it, read: %v, confirmed: %v",
+		d.readerMetaName, expiredOffset, d.readQueueInfo, d.confirmedQueueInfo)
+	if d.readFile != nil {
+		d.readFile.Close()
+		d.readFile = nil
+	}
+	d.resetReadBuffer()
+	d.readQueueInfo = expired.start
+	d.updateDepth()
+}
+
+// should be protected by the lock
+func (d *diskQueueReader) cleanConfirmedDeadlines() {
+	confirmed := d.confirmedQueueInfo.Offset()
+	for offset := range d.confirmDeadlines {
+		if offset < confirmed {
+			delete(d.confirmDeadlines, offset)
+		}
+	}
+}
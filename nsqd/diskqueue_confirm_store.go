@@ -0,0 +1,150 @@
+package nsqd
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+var ErrConfirmNotStored = errors.New("the confirmed offset is not stored")
+
+// ConfirmStore keeps the confirmed offset of the channel out of the local disk, so the consume
+// position can be recovered on the other node after failover. The offset is the virtual offset
+// with the message count, which is the same on all the replicas. ErrConfirmNotStored should be
+// returned if nothing stored for the channel.
+type ConfirmStore interface {
+	LoadConfirmed(topic string, channel string, partition int) (BackendOffset, int64, error)
+	SaveConfirmed(topic string, channel string, partition int, offset BackendOffset, cnt int64) error
+}
+
+type confirmStoreKey struct {
+	topic     string
+	channel   string
+	partition int
+}
+
+// SetConfirmStore enables persisting the confirmed offset to the store after the meta synced,
+// the save is done in background and only the latest confirmed is saved if the store is slow.
+// The confirmed is seeded from the store only if the local meta is missing or the stored
+// offset is ahead of the local, and the local is kept if the stored offset is not valid for
+// the local data.
+func (d *diskQueueReader) SetConfirmStore(store ConfirmStore, topic string, channel string, partition int) error {
+	d.Lock()
+	defer d.Unlock()
+	if d.exitFlag == 1 {
+		return ErrExiting
+	}
+	if d.confirmStoreStop != nil {
+		close(d.confirmStoreStop)
+		d.confirmStoreStop = nil
+	}
+	d.confirmStore = store
+	d.confirmStoreKey = confirmStoreKey{topic: topic, channel: channel, partition: partition}
+	d.storedConfirmed = -1
+	if store == nil {
+		return nil
+	}
+	d.confirmStoreNotify = make(chan struct{}, 1)
+	d.confirmStoreStop = make(chan struct{})
+	go d.confirmStoreLoop(store, d.confirmStoreKey, d.confirmStoreNotify, d.confirmStoreStop)
+
+	offset, cnt, err := store.LoadConfirmed(topic, channel, partition)
+	if err == ErrConfirmNotStored {
+		return nil
+	}
+	if err != nil {
+		nsqLog.LogErrorf("diskqueue(%s) failed to load the confirmed from the store: %v", d.readerMetaName, err)
+		return err
+	}
+	d.storedConfirmed = offset
+	if offset == d.confirmedQueueInfo.Offset() && cnt == d.confirmedQueueInfo.TotalMsgCnt() {
+		d.metaMissing = false
+		return nil
+	}
+	old := d.confirmedQueueInfo
+	if !d.metaMissing && offset < old.Offset() {
+		// the store may be saved later than the local meta
+		nsqLog.Logf("diskqueue(%s) the stored confirmed %v:%v is behind the local %v, keep the local",
+			d.readerMetaName, offset, cnt, old)
+		return nil
+	}
+	err = d.internalSkipTo(offset, cnt, true)
+	if err != nil {
+		nsqLog.LogWarningf("diskqueue(%s) the stored confirmed %v:%v is invalid, keep the local %v: %v",
+			d.readerMetaName, offset, cnt, old, err)
+		return nil
+	}
+	nsqLog.Logf("diskqueue(%s) seed the confirmed from the store: %v, local: %v",
+		d.readerMetaName, d.confirmedQueueInfo, old)
+	d.metaMissing = false
+	d.needSync = true
+	d.sync()
+	d.notifyConfirmed()
+	return nil
+}
+
+// SetConfirmStoreReadOnly stops saving the confirmed to the store, the follower should be read
+// only so only the leader saves the confirmed of the channel.
+func (d *diskQueueReader) SetConfirmStoreReadOnly(readOnly bool) {
+	if readOnly {
+		atomic.StoreInt32(&d.confirmStoreReadOnly, 1)
+	} else {
+		atomic.StoreInt32(&d.confirmStoreReadOnly, 0)
+	}
+}
+
+// notify the background to save the confirmed synced.
+// should be protected by the lock
+func (d *diskQueueReader) saveConfirmedToStore() {
+	if d.confirmStore == nil || atomic.LoadInt32(&d.confirmStoreReadOnly) == 1 {
+		return
+	}
+	if d.storedConfirmed == d.confirmedQueueInfo.Offset() {
+		return
+	}
+	d.confirmToStore = d.confirmedQueueInfo
+	d.confirmStorePending = true
+	select {
+	case d.confirmStoreNotify <- struct{}{}:
+	default:
+	}
+}
+
+// save the latest confirmed synced to the store, the last one synced is saved while exiting.
+// The store failure is only logged since the local meta is synced, and it is saved again
+// while the confirmed changed.
+func (d *diskQueueReader) confirmStoreLoop(store ConfirmStore, k confirmStoreKey,
+	notify chan struct{}, stop chan struct{}) {
+	for {
+		exiting := false
+		select {
+		case <-stop:
+			return
+		case <-d.exitChan:
+			exiting = true
+		case <-notify:
+		}
+		d.Lock()
+		if d.confirmStore != store {
+			d.Unlock()
+			return
+		}
+		e := d.confirmToStore
+		pending := d.confirmStorePending && d.storedConfirmed != e.Offset()
+		d.confirmStorePending = false
+		d.Unlock()
+		if pending {
+			err := store.SaveConfirmed(k.topic, k.channel, k.partition, e.Offset(), e.TotalMsgCnt())
+			if err != nil {
+				nsqLog.LogWarningf("diskqueue(%s) failed to save the confirmed %v to the store: %v",
+					d.readerMetaName, e, err)
+			} else {
+				d.Lock()
+				d.storedConfirmed = e.Offset()
+				d.Unlock()
+			}
+		}
+		if exiting {
+			return
+		}
+	}
+}
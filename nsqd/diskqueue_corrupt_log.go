@@ -0,0 +1,73 @@
+package nsqd
+
+import (
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// min interval between the logs of the same corruption repeated while skipping
+const corruptLogInterval = time.Second * 10
+
+const invalidReadSizePrefix = "invalid message read size"
+
+// corruptLogLimiter limits the logs of the repeated corruption, the first one of each distinct
+// error is always logged, and the same error is logged at most once per interval with the
+// number of the suppressed ones. It should be protected by the reader lock.
+type corruptLogLimiter struct {
+	lastKind   string
+	lastLogTs  int64
+	suppressed int64
+	// the logs of the skip in progress are suppressed
+	quiet bool
+}
+
+func (l *corruptLogLimiter) allow(kind string, now int64) (bool, int64) {
+	if kind != l.lastKind || now-l.lastLogTs >= int64(corruptLogInterval) {
+		suppressed := l.suppressed
+		l.lastKind = kind
+		l.lastLogTs = now
+		l.suppressed = 0
+		l.quiet = false
+		return true, suppressed
+	}
+	l.suppressed++
+	l.quiet = true
+	return false, 0
+}
+
+// the invalid size read differs in each corrupt message, so they are the same kind
+func corruptErrKind(err error) string {
+	msg := err.Error()
+	if strings.HasPrefix(msg, invalidReadSizePrefix) {
+		return invalidReadSizePrefix
+	}
+	return msg
+}
+
+// CorruptSkipCount returns the times of the corrupt data skipped while reading.
+func (d *diskQueueReader) CorruptSkipCount() int64 {
+	return atomic.LoadInt64(&d.corruptSkipCnt)
+}
+
+func (d *diskQueueReader) logReadError(err error) {
+	ok, suppressed := d.corruptLog.allow(corruptErrKind(err), time.Now().UnixNano())
+	if !ok {
+		return
+	}
+	if suppressed > 0 {
+		nsqLog.LogErrorf("reading from diskqueue(%s) at %d of %s - %s, current end: %v, %v similar errors suppressed",
+			d.readerMetaName, d.readQueueInfo, d.fileName(d.readQueueInfo.EndOffset.FileNum), err, d.queueEndInfo, suppressed)
+		return
+	}
+	nsqLog.LogErrorf("reading from diskqueue(%s) at %d of %s - %s, current end: %v",
+		d.readerMetaName, d.readQueueInfo, d.fileName(d.readQueueInfo.EndOffset.FileNum), err, d.queueEndInfo)
+}
+
+// log the skip of the corrupt data unless the read error of the skip is suppressed
+func (d *diskQueueReader) logCorruptSkipf(f string, args ...interface{}) {
+	if d.corruptLog.quiet {
+		return
+	}
+	nsqLog.LogWarningf(f, args...)
+}
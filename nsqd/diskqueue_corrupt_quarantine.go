@@ -0,0 +1,55 @@
+package nsqd
+
+import (
+	"os"
+	"path"
+)
+
+// SetCorruptQuarantineDir sets the directory to keep the copy of the corrupt data file skipped
+// by the reader for the offline analysis, disabled if empty. The data file is shared by the
+// writer and the other channels which may not read the corrupt part yet, so it is copied
+// instead of moved, and the file is left to be removed by the retention.
+func (d *diskQueueReader) SetCorruptQuarantineDir(dir string) {
+	d.Lock()
+	d.corruptQuarantineDir = dir
+	d.Unlock()
+}
+
+// copy the corrupt data file to the quarantine directory in background before skipping it, the
+// file already copied is not copied again. should be protected by the lock
+func (d *diskQueueReader) quarantineCorruptFile(fileNum int64) {
+	if d.corruptQuarantineDir == "" {
+		return
+	}
+	src := d.dataFileName(fileNum)
+	dst := path.Join(d.corruptQuarantineDir, path.Base(src))
+	if _, err := os.Stat(dst); err == nil {
+		return
+	}
+	if d.quarantiningFiles[dst] {
+		return
+	}
+	if d.quarantiningFiles == nil {
+		d.quarantiningFiles = make(map[string]bool)
+	}
+	d.quarantiningFiles[dst] = true
+	name := d.readerMetaName
+	go func() {
+		defer func() {
+			d.Lock()
+			delete(d.quarantiningFiles, dst)
+			d.Unlock()
+		}()
+		err := os.MkdirAll(path.Dir(dst), 0755)
+		if err == nil {
+			// the file may be removed by the retention while copying, the copy will fail
+			// without affecting the read.
+			err = copyQueueFileSync(src, dst)
+		}
+		if err != nil {
+			nsqLog.LogErrorf("diskqueue(%s) failed to quarantine the corrupt file %v: %v", name, src, err)
+			return
+		}
+		nsqLog.Logf("diskqueue(%s) corrupt file %v quarantined to %v", name, src, dst)
+	}()
+}
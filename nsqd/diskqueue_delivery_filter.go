@@ -0,0 +1,80 @@
+package nsqd
+
+import (
+	"sync/atomic"
+)
+
+// DeliveryFilter decides whether the message read at the offset should be delivered.
+type DeliveryFilter func(offset BackendOffset, data []byte) (keep bool)
+
+// SetDeliveryFilter sets the filter consulted for each message read, the message filtered out
+// is not returned and it is confirmed by the reader. nil to disable the filter.
+func (d *diskQueueReader) SetDeliveryFilter(filter DeliveryFilter) {
+	d.Lock()
+	d.deliveryFilter = filter
+	d.Unlock()
+}
+
+// FilteredCount returns the number of the messages filtered out without delivery.
+func (d *diskQueueReader) FilteredCount() int64 {
+	return atomic.LoadInt64(&d.filteredCnt)
+}
+
+// return true if the message read is filtered out. The filtered message at the confirmed is
+// confirmed at once, otherwise the messages before it are still in flight and it is pending
+// until the confirm reaches it. should be protected by the lock
+func (d *diskQueueReader) filterDelivery(ret ReadResult, pooled bool) bool {
+	if d.deliveryFilter == nil || d.deliveryFilter(ret.Offset, ret.Data) {
+		return false
+	}
+	atomic.AddInt64(&d.filteredCnt, 1)
+	if pooled {
+		ReleaseReadData(ret.Data)
+	}
+	delete(d.readAttempts, ret.Offset)
+	d.addSkippedPending(ret.Offset)
+	return true
+}
+
+// the data from the start to the read position is skipped without delivery, so it will never
+// be confirmed by the channel. The skipped data at the confirmed is confirmed at once, otherwise
+// the messages before it are still in flight and it is pending until the confirm reaches it.
+// should be protected by the lock
+func (d *diskQueueReader) addSkippedPending(start BackendOffset) {
+	if start == d.confirmedQueueInfo.Offset() {
+		d.confirmedQueueInfo = d.readQueueInfo
+		d.updateDepth()
+		d.needSync = true
+		return
+	}
+	if d.skippedPending == nil {
+		d.skippedPending = make(map[BackendOffset]diskQueueEndInfo)
+	}
+	d.skippedPending[start] = d.readQueueInfo
+}
+
+// move the confirmed past the pending skipped data following it, and clean the ones
+// already confirmed. should be protected by the lock
+func (d *diskQueueReader) confirmSkipped() {
+	if len(d.skippedPending) == 0 {
+		return
+	}
+	moved := false
+	for {
+		next, ok := d.skippedPending[d.confirmedQueueInfo.Offset()]
+		if !ok {
+			break
+		}
+		delete(d.skippedPending, d.confirmedQueueInfo.Offset())
+		d.confirmedQueueInfo = next
+		moved = true
+	}
+	for offset := range d.skippedPending {
+		if offset < d.confirmedQueueInfo.Offset() {
+			delete(d.skippedPending, offset)
+		}
+	}
+	if moved {
+		d.updateDepth()
+	}
+}
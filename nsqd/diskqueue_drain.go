@@ -0,0 +1,34 @@
+package nsqd
+
+import (
+	"golang.org/x/net/context"
+)
+
+// DrainToEnd blocks until the confirmed reaches the end while called or the context is done.
+// The reads and confirms are not blocked while waiting, and the new data written after called
+// is not waited. The context should be used to bound the wait since the end may be rolled back.
+func (d *diskQueueReader) DrainToEnd(ctx context.Context) error {
+	watcher := d.WatchConfirmed()
+	defer d.UnwatchConfirmed(watcher)
+	d.RLock()
+	if d.exitFlag == 1 {
+		d.RUnlock()
+		return ErrExiting
+	}
+	target := d.queueEndInfo.Offset()
+	confirmed := d.confirmedQueueInfo.Offset()
+	d.RUnlock()
+	nsqLog.Logf("diskqueue(%s) draining to %v, confirmed: %v", d.readerMetaName, target, confirmed)
+	for confirmed < target {
+		select {
+		case c, ok := <-watcher:
+			if !ok {
+				return ErrExiting
+			}
+			confirmed = c
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,217 @@
+package nsqd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	DefaultQueueFileNamePattern  = "%s.diskqueue.%06d.dat"
+	DefaultReaderMetaNamePattern = "%s.diskqueue.meta.v2.reader.dat"
+)
+
+var (
+	ErrInvalidFileNamePattern = errors.New("invalid file name pattern")
+	ErrInvalidFileShardSize   = errors.New("invalid file shard size")
+)
+
+// the naming patterns of the queue data files and the reader meta files,
+// the data file pattern will use 9 digits for the large file number.
+var queueFileNamePattern atomic.Value
+var readerMetaNamePattern atomic.Value
+
+// the data files are sharded into the sub directories by the file number if positive,
+// otherwise all the data files are in the data path.
+var queueFileShardSize = int64(0)
+
+// the layout of each data file while sharded, true if it is the legacy file in the data path.
+// The legacy files are never created after sharded, so the layout is decided only once for
+// each data file until it is removed or the queue is closed.
+var queueFileLayouts = struct {
+	sync.Mutex
+	m map[queueFileLayoutKey]map[int64]bool
+}{m: make(map[queueFileLayoutKey]map[int64]bool)}
+
+type queueFileLayoutKey struct {
+	dataRoot string
+	base     string
+}
+
+func init() {
+	queueFileNamePattern.Store(DefaultQueueFileNamePattern)
+	readerMetaNamePattern.Store(DefaultReaderMetaNamePattern)
+}
+
+// SetQueueFileNamePattern changes the naming patterns of the data files and the reader meta files,
+// the default is used if empty. The data file pattern should have the %s for the queue name
+// followed by the %06d for the file number, and the reader meta pattern should have the %s for the reader name.
+func SetQueueFileNamePattern(dataPattern string, readerMetaPattern string) error {
+	if dataPattern == "" {
+		dataPattern = DefaultQueueFileNamePattern
+	}
+	if readerMetaPattern == "" {
+		readerMetaPattern = DefaultReaderMetaNamePattern
+	}
+	err := validateFileNamePattern(dataPattern, "%s", "%06d")
+	if err != nil {
+		return err
+	}
+	err = validateFileNamePattern(readerMetaPattern, "%s")
+	if err != nil {
+		return err
+	}
+	if readerMetaPattern == dataPattern {
+		return fmt.Errorf("%v: the reader meta is the same as the data file: %v", ErrInvalidFileNamePattern, dataPattern)
+	}
+	queueFileNamePattern.Store(dataPattern)
+	readerMetaNamePattern.Store(readerMetaPattern)
+	return nil
+}
+
+// the pattern should have all the verbs in order and no other verbs
+func validateFileNamePattern(pattern string, verbs ...string) error {
+	if strings.ContainsAny(pattern, "/\\") {
+		return fmt.Errorf("%v: should not have the path separator: %v", ErrInvalidFileNamePattern, pattern)
+	}
+	if strings.Count(pattern, "%") != len(verbs) {
+		return fmt.Errorf("%v: should have only the verbs %v: %v", ErrInvalidFileNamePattern, verbs, pattern)
+	}
+	left := pattern
+	for _, v := range verbs {
+		index := strings.Index(left, v)
+		if index == -1 {
+			return fmt.Errorf("%v: should have the verbs %v in order: %v", ErrInvalidFileNamePattern, verbs, pattern)
+		}
+		left = left[index+len(v):]
+	}
+	return nil
+}
+
+func getQueueFileNamePattern(fileNum int64) string {
+	pattern := queueFileNamePattern.Load().(string)
+	if fileNum > int64(999990) {
+		return strings.Replace(pattern, "%06d", "%09d", 1)
+	}
+	return pattern
+}
+
+func getReaderMetaNamePattern() string {
+	return readerMetaNamePattern.Load().(string)
+}
+
+// SetQueueFileShardSize changes the file number of each sharded sub directory for the data files,
+// and the sharding is disabled if 0. The legacy files in the data path can still be read after enabled.
+func SetQueueFileShardSize(shardSize int64) error {
+	if shardSize < 0 {
+		return ErrInvalidFileShardSize
+	}
+	queueFileLayouts.Lock()
+	atomic.StoreInt64(&queueFileShardSize, shardSize)
+	queueFileLayouts.m = make(map[queueFileLayoutKey]map[int64]bool)
+	queueFileLayouts.Unlock()
+	return nil
+}
+
+func getQueueFileShardSize() int64 {
+	return atomic.LoadInt64(&queueFileShardSize)
+}
+
+func getQueueFileShardDir(dataRoot string, base string, fileNum int64, shardSize int64) string {
+	return path.Join(dataRoot, fmt.Sprintf("%s.diskqueue.shard.%06d", base, fileNum/shardSize))
+}
+
+// the legacy data file in the data path will be used until it is removed, so the
+// queue can be read while the sharding is enabled for the old data.
+func getShardedQueueFileName(dataRoot string, base string, fileNum int64, fileName string) string {
+	flatName := path.Join(dataRoot, fileName)
+	shardSize := getQueueFileShardSize()
+	if shardSize <= 0 {
+		return flatName
+	}
+	shardedName := path.Join(getQueueFileShardDir(dataRoot, base, fileNum, shardSize), fileName)
+	k := queueFileLayoutKey{dataRoot: dataRoot, base: base}
+	queueFileLayouts.Lock()
+	flat, ok := queueFileLayouts.m[k][fileNum]
+	queueFileLayouts.Unlock()
+	if !ok {
+		if _, err := os.Stat(shardedName); os.IsNotExist(err) {
+			if _, err := os.Stat(flatName); err == nil {
+				flat = true
+			}
+		}
+		queueFileLayouts.Lock()
+		if shardSize == getQueueFileShardSize() {
+			layouts, ok := queueFileLayouts.m[k]
+			if !ok {
+				layouts = make(map[int64]bool)
+				queueFileLayouts.m[k] = layouts
+			}
+			layouts[fileNum] = flat
+		}
+		queueFileLayouts.Unlock()
+	}
+	if flat {
+		return flatName
+	}
+	return shardedName
+}
+
+// forget the layout of the data file removed, both in the data path and the cold path.
+func forgetQueueFileLayout(dataRoot string, coldPath string, base string, fileNum int64) {
+	queueFileLayouts.Lock()
+	delete(queueFileLayouts.m[queueFileLayoutKey{dataRoot: dataRoot, base: base}], fileNum)
+	if coldPath != "" {
+		delete(queueFileLayouts.m[queueFileLayoutKey{dataRoot: coldPath, base: base}], fileNum)
+	}
+	queueFileLayouts.Unlock()
+}
+
+// forget the layouts of all the data files while the queue is closed or removed.
+func forgetQueueFileLayouts(dataRoot string, coldPath string, base string) {
+	queueFileLayouts.Lock()
+	delete(queueFileLayouts.m, queueFileLayoutKey{dataRoot: dataRoot, base: base})
+	if coldPath != "" {
+		delete(queueFileLayouts.m, queueFileLayoutKey{dataRoot: coldPath, base: base})
+	}
+	queueFileLayouts.Unlock()
+}
+
+// make sure the sharded directory exist before creating the data file
+func ensureQueueFileDir(fileName string) error {
+	if getQueueFileShardSize() <= 0 {
+		return nil
+	}
+	return os.MkdirAll(path.Dir(fileName), 0755)
+}
+
+// remove the sharded directory if all the files in it are removed
+func removeEmptyQueueFileDir(dataRoot string, base string, fileNum int64) {
+	shardSize := getQueueFileShardSize()
+	if shardSize <= 0 || (fileNum+1)%shardSize != 0 {
+		return
+	}
+	dir := getQueueFileShardDir(dataRoot, base, fileNum, shardSize)
+	err := os.Remove(dir)
+	if err == nil {
+		nsqLog.Logf("removed the empty shard directory: %v", dir)
+	}
+}
+
+// remove all the sharded directories of the queue files in the range if empty
+func removeQueueFileDirs(dataRoot string, base string, startNum int64, endNum int64) {
+	shardSize := getQueueFileShardSize()
+	if shardSize <= 0 {
+		return
+	}
+	for i := startNum - startNum%shardSize; i <= endNum; i += shardSize {
+		dir := getQueueFileShardDir(dataRoot, base, i, shardSize)
+		if err := os.Remove(dir); err == nil {
+			nsqLog.Logf("removed the empty shard directory: %v", dir)
+		}
+	}
+}
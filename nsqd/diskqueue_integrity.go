@@ -0,0 +1,151 @@
+package nsqd
+
+import (
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	QueueFileGap     = "gap"
+	QueueFileOverlap = "overlap"
+)
+
+// QueueFileIssue is the data file not contiguous with the previous one, the expected is the
+// end of the previous file and the start is the one in the offset meta of the file.
+type QueueFileIssue struct {
+	FileNum  int64
+	Kind     string
+	Expected int64
+	Start    int64
+}
+
+// CheckFileIntegrity verifies the data files are contiguous from the retained base to the
+// end. The file missing or started after the end of the previous file is the gap, and the file
+// started before the end of the previous file is the overlap. The file without the offset meta
+// can not be verified and the check restarts from the next file.
+func (d *diskQueueReader) CheckFileIntegrity() ([]QueueFileIssue, error) {
+	d.Lock()
+	defer d.Unlock()
+	return d.checkFileIntegrity()
+}
+
+func (d *diskQueueReader) checkFileIntegrity() ([]QueueFileIssue, error) {
+	base, err := d.getRetainedBase()
+	if err != nil {
+		return nil, err
+	}
+	return checkQueueFileIntegrity(base, d.queueEndInfo, d.dataFileName, d.fileName)
+}
+
+// CheckFileIntegrity is the same as the reader, but from the queue start to the end written.
+func (d *diskQueueWriter) CheckFileIntegrity() ([]QueueFileIssue, error) {
+	d.RLock()
+	defer d.RUnlock()
+	return checkQueueFileIntegrity(d.diskQueueStart, d.diskReadEnd, d.dataFileName, d.fileName)
+}
+
+func checkQueueFileIntegrity(base diskQueueEndInfo, end diskQueueEndInfo,
+	dataFileName func(int64) string, fileName func(int64) string) ([]QueueFileIssue, error) {
+	var issues []QueueFileIssue
+	expected := int64(base.Offset())
+	known := true
+	endFileNum := end.EndOffset.FileNum
+	for fileNum := base.EndOffset.FileNum; fileNum <= endFileNum; fileNum++ {
+		_, err := os.Stat(dataFileName(fileNum))
+		if err != nil && !os.IsNotExist(err) {
+			return issues, err
+		}
+		missing := err != nil
+		if fileNum == endFileNum {
+			// the file being written has no offset meta
+			if missing && end.EndOffset.Pos > 0 {
+				issues = append(issues, QueueFileIssue{FileNum: fileNum, Kind: QueueFileGap,
+					Expected: expected, Start: expected})
+			}
+			break
+		}
+		_, startPos, endPos, err := getQueueFileOffsetMeta(fileName(fileNum))
+		if err != nil {
+			if !os.IsNotExist(err) {
+				return issues, err
+			}
+			if missing {
+				issues = append(issues, QueueFileIssue{FileNum: fileNum, Kind: QueueFileGap,
+					Expected: expected, Start: expected})
+			}
+			known = false
+			continue
+		}
+		if missing {
+			issues = append(issues, QueueFileIssue{FileNum: fileNum, Kind: QueueFileGap,
+				Expected: expected, Start: startPos})
+		} else if known && startPos > expected {
+			issues = append(issues, QueueFileIssue{FileNum: fileNum, Kind: QueueFileGap,
+				Expected: expected, Start: startPos})
+		} else if (known && startPos < expected) || endPos < startPos {
+			issues = append(issues, QueueFileIssue{FileNum: fileNum, Kind: QueueFileOverlap,
+				Expected: expected, Start: startPos})
+			// the data after the overlap should continue from the latest end
+			if !known || endPos > expected {
+				expected = endPos
+			}
+			known = true
+			continue
+		}
+		expected = endPos
+		known = true
+	}
+	return issues, nil
+}
+
+// quarantine the overlapped data files by renaming them with the offset meta, so the read will
+// skip them as missing and the files are kept for the manual recovery. The gap can not be
+// repaired since the data is lost. Only the writer quarantines the files since they are shared
+// by all the channels of the topic.
+func (d *diskQueueWriter) quarantineQueueFiles(issues []QueueFileIssue) error {
+	d.Lock()
+	defer d.Unlock()
+	suffix := ".corrupt." + strconv.FormatInt(time.Now().Unix(), 10)
+	for _, issue := range issues {
+		if issue.Kind != QueueFileOverlap {
+			continue
+		}
+		// resolve the meta file name before the data file renamed
+		metaName := d.fileName(issue.FileNum) + ".offsetmeta.dat"
+		for _, fName := range []string{d.dataFileName(issue.FileNum), metaName} {
+			if _, err := os.Stat(fName); err != nil {
+				continue
+			}
+			err := os.Rename(fName, fName+suffix)
+			if err != nil {
+				return err
+			}
+			nsqLog.Logf("diskqueue(%s) quarantine the overlapped file %v to %v",
+				d.name, fName, fName+suffix)
+		}
+	}
+	return nil
+}
+
+// checkFileIntegrityOnStart checks the data files once while the topic is loaded, the error is
+// returned if any gap or overlap found, unless repair is enabled, in which case the files
+// overlapped are quarantined.
+func (d *diskQueueWriter) checkFileIntegrityOnStart(repair bool) error {
+	issues, err := d.CheckFileIntegrity()
+	if err != nil {
+		nsqLog.LogErrorf("diskqueue(%s) failed to check the data files: %v", d.name, err)
+		return err
+	}
+	if len(issues) == 0 {
+		return nil
+	}
+	for _, issue := range issues {
+		nsqLog.LogErrorf("diskqueue(%s) data file %v is not contiguous: %v, expected start %v, actual %v",
+			d.name, issue.FileNum, issue.Kind, issue.Expected, issue.Start)
+	}
+	if !repair {
+		return ErrQueueFileIntegrity
+	}
+	return d.quarantineQueueFiles(issues)
+}
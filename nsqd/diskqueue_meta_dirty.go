@@ -0,0 +1,39 @@
+package nsqd
+
+// readerMetaState is the state persisted in the reader meta file.
+type readerMetaState struct {
+	confirmedCnt int64
+	confirmed    diskQueueOffset
+	confirmedOff BackendOffset
+	endCnt       int64
+	end          diskQueueOffset
+	endOff       BackendOffset
+	redeliverEnd BackendOffset
+}
+
+// should be protected by the lock
+func (d *diskQueueReader) currentMetaState() readerMetaState {
+	redeliverEnd := d.maxReadOffset
+	if redeliverEnd < d.redeliverEnd {
+		redeliverEnd = d.redeliverEnd
+	}
+	if redeliverEnd <= d.confirmedQueueInfo.Offset() {
+		redeliverEnd = 0
+	}
+	return readerMetaState{
+		confirmedCnt: d.confirmedQueueInfo.TotalMsgCnt(),
+		confirmed:    d.confirmedQueueInfo.EndOffset,
+		confirmedOff: d.confirmedQueueInfo.Offset(),
+		endCnt:       d.queueEndInfo.TotalMsgCnt(),
+		end:          d.queueEndInfo.EndOffset,
+		endOff:       d.queueEndInfo.Offset(),
+		redeliverEnd: redeliverEnd,
+	}
+}
+
+// isMetaDirty returns true if the state is changed since the last meta written, so the
+// periodic sync of the idle reader can skip the write even if the sync flag lingers.
+// should be protected by the lock
+func (d *diskQueueReader) isMetaDirty() bool {
+	return !d.metaSynced || d.currentMetaState() != d.syncedMeta
+}
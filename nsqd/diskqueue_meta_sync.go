@@ -0,0 +1,71 @@
+package nsqd
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/youzan/nsq/internal/util"
+)
+
+// metaSyncCoordinator batches the directory syncs of the reader metas in the same directory.
+// The meta of each reader is written and renamed by the reader itself, and then the directory
+// is synced only once in the window for all the renames. The readers will not wait for the
+// directory synced while holding the lock, and the meta is synced again if the directory sync
+// failed. The coordinator is owned by the nsqd instance.
+type metaSyncCoordinator struct {
+	sync.Mutex
+	window  int64
+	pending map[string][]func(error)
+	// the directory fsync counter
+	dirSyncCnt int64
+}
+
+func newMetaSyncCoordinator(window time.Duration) *metaSyncCoordinator {
+	return &metaSyncCoordinator{
+		window:  int64(window),
+		pending: make(map[string][]func(error)),
+	}
+}
+
+func (c *metaSyncCoordinator) setWindow(window time.Duration) {
+	atomic.StoreInt64(&c.window, int64(window))
+}
+
+// SyncDir adds the directory sync to the batch of the directory, and the done is called
+// after the directory synced.
+func (c *metaSyncCoordinator) SyncDir(dir string, done func(error)) {
+	c.Lock()
+	reqs := c.pending[dir]
+	c.pending[dir] = append(reqs, done)
+	if len(reqs) == 0 {
+		// the first one in the window starts a new batch
+		time.AfterFunc(time.Duration(atomic.LoadInt64(&c.window)), func() {
+			c.flush(dir)
+		})
+	}
+	c.Unlock()
+}
+
+func (c *metaSyncCoordinator) flush(dir string) {
+	c.Lock()
+	reqs := c.pending[dir]
+	delete(c.pending, dir)
+	c.Unlock()
+
+	if len(reqs) == 0 {
+		return
+	}
+	err := util.SyncDir(dir)
+	atomic.AddInt64(&c.dirSyncCnt, 1)
+	if err != nil {
+		nsqLog.LogErrorf("failed to sync the meta directory %v: %v", dir, err)
+	}
+	for _, done := range reqs {
+		done(err)
+	}
+}
+
+func (c *metaSyncCoordinator) DirSyncCnt() int64 {
+	return atomic.LoadInt64(&c.dirSyncCnt)
+}
@@ -0,0 +1,325 @@
+package nsqd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/youzan/nsq/internal/util"
+)
+
+var ErrMigrateVerifyFailed = errors.New("the migrated data files verify failed")
+
+// the queue data path of the topic partition migrated from the topic data path is persisted in
+// the topic data path, the data files and the metas of the writer and the readers are in the
+// migrated path while the channel meta, the delayed queue and the other topic files are kept
+// in the topic data path.
+func getQueueDataPathFileName(topicPath string, part int) string {
+	return path.Join(topicPath, "queue_path"+strconv.Itoa(part))
+}
+
+// loadQueueDataPath returns the queue data path persisted for the topic partition, the topic
+// data path is used if not migrated.
+func loadQueueDataPath(topicPath string, part int) (string, error) {
+	data, err := ioutil.ReadFile(getQueueDataPathFileName(topicPath, part))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return topicPath, nil
+		}
+		return "", err
+	}
+	queuePath := strings.TrimSpace(string(data))
+	if queuePath == "" {
+		queuePath = topicPath
+	}
+	return queuePath, nil
+}
+
+func saveQueueDataPath(topicPath string, part int, queuePath string) error {
+	fileName := getQueueDataPathFileName(topicPath, part)
+	tmpFileName := fmt.Sprintf("%s.%d.tmp", fileName, rand.Int())
+	err := ioutil.WriteFile(tmpFileName, []byte(queuePath+"\n"), 0644)
+	if err != nil {
+		return err
+	}
+	err = util.AtomicRenameSync(tmpFileName, fileName)
+	if err != nil {
+		os.Remove(tmpFileName)
+	}
+	return err
+}
+
+// copy the file to the temp file and rename it, so the target is either missing or
+// complete while crashed.
+func copyQueueFileSync(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	err = ensureQueueFileDir(dst)
+	if err != nil {
+		return err
+	}
+	tmpName := fmt.Sprintf("%s.%d.tmp", dst, rand.Int())
+	out, err := os.OpenFile(tmpName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	out.Close()
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	return util.AtomicRenameSync(tmpName, dst)
+}
+
+func verifyQueueFileCopied(src string, dst string) error {
+	srcInfo, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	dstInfo, err := os.Stat(dst)
+	if err != nil {
+		return err
+	}
+	if srcInfo.Size() != dstInfo.Size() {
+		nsqLog.LogErrorf("migrated file %v size mismatch: %v, %v", dst, srcInfo.Size(), dstInfo.Size())
+		return ErrMigrateVerifyFailed
+	}
+	return nil
+}
+
+// copyQueueFilesTo copies the data files from the start file to the end and their offset meta
+// to the new path, and verifies the copied. The data files moved to the cold path are left there.
+// The copied files are removed if failed.
+func copyQueueFilesTo(dataPath string, coldPath string, name string, newPath string, startNum int64, end diskQueueEndInfo) ([]string, error) {
+	var copied []string
+	cleanCopied := func() {
+		for _, fName := range copied {
+			os.Remove(fName)
+		}
+	}
+	copyFile := func(src string, dst string) error {
+		err := copyQueueFileSync(src, dst)
+		if err != nil {
+			nsqLog.LogErrorf("diskqueue(%s) failed to copy %v to %v: %v", name, src, dst, err)
+			return err
+		}
+		copied = append(copied, dst)
+		return verifyQueueFileCopied(src, dst)
+	}
+	copyIfExist := func(src string, dst string) error {
+		if _, err := os.Stat(src); err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		return copyFile(src, dst)
+	}
+
+	endNum := end.EndOffset.FileNum
+	if startNum > 0 {
+		// the start of the first file is the end of the previous one
+		err := copyIfExist(GetQueueFileName(dataPath, name, startNum-1)+".offsetmeta.dat",
+			GetQueueFileName(newPath, name, startNum-1)+".offsetmeta.dat")
+		if err != nil {
+			cleanCopied()
+			return nil, err
+		}
+	}
+	for i := startNum; i <= endNum; i++ {
+		src := GetQueueFileName(dataPath, name, i)
+		dst := GetQueueFileName(newPath, name, i)
+		_, err := os.Stat(src)
+		if err == nil {
+			err = copyFile(src, dst)
+		} else if os.IsNotExist(err) {
+			if i == endNum && end.EndOffset.Pos == 0 {
+				// the last file is not created by the writer yet
+				break
+			}
+			if resolveQueueFileName(dataPath, coldPath, name, i) != src {
+				// moved to the cold path, and it is still resolved there from the new path
+				err = nil
+			}
+		}
+		if err == nil {
+			err = copyIfExist(getQueueFileChecksumName(src), getQueueFileChecksumName(dst))
+		}
+		if err != nil {
+			cleanCopied()
+			return nil, err
+		}
+		if i == endNum {
+			// the last file is still being written and has no offset meta
+			info, err := os.Stat(dst)
+			if err != nil || getQueueFileDataSize(info.Size(), 0) < end.EndOffset.Pos {
+				nsqLog.LogErrorf("diskqueue(%s) migrated file %v is smaller than the end: %v, %v",
+					name, dst, end, err)
+				cleanCopied()
+				return nil, ErrMigrateVerifyFailed
+			}
+			continue
+		}
+		err = copyFile(src+".offsetmeta.dat", dst+".offsetmeta.dat")
+		if err != nil {
+			cleanCopied()
+			return nil, err
+		}
+		_, start, fileEnd, err := getQueueFileOffsetMeta(dst)
+		if err == nil && i == endNum-1 && BackendOffset(fileEnd) != end.Offset()-BackendOffset(end.EndOffset.Pos) {
+			err = ErrMigrateVerifyFailed
+		}
+		if err != nil {
+			nsqLog.LogErrorf("diskqueue(%s) migrated offset meta of file %v invalid: %v, %v, %v",
+				name, dst, start, fileEnd, err)
+			cleanCopied()
+			return nil, err
+		}
+	}
+	return copied, nil
+}
+
+// migrateTo copies the data files from the queue start to the new path and switches the writer
+// to it after the copies verified. The writer meta is persisted in the new path while the old
+// one is kept until the migration is done, so the queue can be restarted from the old path if
+// crashed while migrating.
+func (d *diskQueueWriter) migrateTo(newPath string) ([]string, error) {
+	d.Lock()
+	defer d.Unlock()
+	if d.exitFlag == 1 {
+		return nil, errors.New("exiting")
+	}
+	err := d.sync()
+	if err != nil {
+		return nil, err
+	}
+	d.closeCurrentFile()
+	copied, err := copyQueueFilesTo(d.dataPath, d.coldPath, d.name, newPath, d.diskQueueStart.EndOffset.FileNum, d.diskWriteEnd)
+	if err != nil {
+		return nil, err
+	}
+	oldPath := d.dataPath
+	d.dataPath = newPath
+	err = d.persistMetaData()
+	if err == nil {
+		err = d.saveExtraMeta()
+	}
+	if err != nil {
+		nsqLog.LogErrorf("diskqueue(%s) failed to persist the meta to the new path %v: %v", d.name, newPath, err)
+		os.Remove(d.metaDataFileName())
+		os.Remove(d.extraMetaFileName())
+		d.dataPath = oldPath
+		for _, fName := range copied {
+			os.Remove(fName)
+		}
+		return nil, err
+	}
+	return copied, nil
+}
+
+// abortMigrate switches the writer back to the old path and removes the copied files.
+func (d *diskQueueWriter) abortMigrate(oldPath string, copied []string) {
+	d.Lock()
+	defer d.Unlock()
+	d.closeCurrentFile()
+	os.Remove(d.metaDataFileName())
+	os.Remove(d.extraMetaFileName())
+	d.dataPath = oldPath
+	for _, fName := range copied {
+		os.Remove(fName)
+	}
+}
+
+// removeMigratedFrom removes the data files and the metas left in the old path after migrated.
+func (d *diskQueueWriter) removeMigratedFrom(oldPath string) {
+	d.RLock()
+	startNum := d.diskQueueStart.EndOffset.FileNum
+	endNum := d.diskWriteEnd.EndOffset.FileNum
+	d.RUnlock()
+	if startNum > 0 {
+		os.Remove(GetQueueFileName(oldPath, d.name, startNum-1) + ".offsetmeta.dat")
+	}
+	for i := startNum; i <= endNum; i++ {
+		fName := GetQueueFileName(oldPath, d.name, i)
+		os.Remove(fName)
+		sharedReadFileCache.evict(fName)
+		os.Remove(fName + ".offsetmeta.dat")
+		os.Remove(getQueueFileChecksumName(fName))
+		forgetQueueFileLayout(oldPath, "", d.name, i)
+	}
+	removeQueueFileDirs(oldPath, d.name, startNum, endNum)
+	os.Remove(fmt.Sprintf(path.Join(oldPath, "%s.diskqueue.meta.writer.dat"), d.name))
+	os.Remove(fmt.Sprintf(path.Join(oldPath, "%s.diskqueue.meta.extra.dat"), d.name))
+	util.SyncDir(oldPath)
+}
+
+// migrateTo switches the reader to the data files copied to the new path by the writer at the
+// same read and confirmed position. The reader meta is persisted in the new path while the old
+// one is kept until the migration is done, and the old metas are returned.
+func (d *diskQueueReader) migrateTo(newPath string) ([]string, error) {
+	d.Lock()
+	defer d.Unlock()
+	if d.exitFlag == 1 {
+		return nil, ErrExiting
+	}
+	if newPath == d.dataPath {
+		return nil, nil
+	}
+	oldPath := d.dataPath
+	oldMetaNames := []string{d.metaDataFileName(true), d.metaDataFileName(false)}
+	d.dataPath = newPath
+	confirmedNum := d.confirmedQueueInfo.EndOffset.FileNum
+	if confirmedNum < d.queueEndInfo.EndOffset.FileNum || d.queueEndInfo.EndOffset.Pos > 0 {
+		if _, err := os.Stat(d.dataFileName(confirmedNum)); err != nil {
+			nsqLog.LogErrorf("diskqueue(%s) the data file of the confirmed %v is not migrated: %v",
+				d.readerMetaName, d.confirmedQueueInfo, err)
+			d.dataPath = oldPath
+			return nil, err
+		}
+	}
+	err := d.persistMetaData()
+	if err != nil {
+		nsqLog.LogErrorf("diskqueue(%s) failed to persist the meta to the new path %v: %v",
+			d.readerMetaName, newPath, err)
+		os.Remove(d.metaDataFileName(true))
+		d.dataPath = oldPath
+		return nil, err
+	}
+	// reopen the data file in the new path at the same read position
+	if d.readFile != nil {
+		d.readFile.Close()
+		d.readFile = nil
+	}
+	d.resetReadBuffer()
+	d.retainedBase.valid = false
+	nsqLog.Logf("diskqueue(%s) migrated from %v to %v, read: %v, confirmed: %v, end: %v",
+		d.readerMetaName, oldPath, newPath, d.readQueueInfo, d.confirmedQueueInfo, d.queueEndInfo)
+	return oldMetaNames, nil
+}
+
+// abortMigrate switches the reader back to the old path.
+func (d *diskQueueReader) abortMigrate(oldPath string) {
+	d.Lock()
+	defer d.Unlock()
+	os.Remove(d.metaDataFileName(true))
+	d.dataPath = oldPath
+	if d.readFile != nil {
+		d.readFile.Close()
+		d.readFile = nil
+	}
+	d.resetReadBuffer()
+	d.retainedBase.valid = false
+}
@@ -0,0 +1,169 @@
+package nsqd
+
+// offsetBaseEnd is the queue end with the offset shifted by the base
+type offsetBaseEnd struct {
+	end  BackendQueueEnd
+	base BackendOffset
+}
+
+func (e *offsetBaseEnd) Offset() BackendOffset {
+	return e.end.Offset() + e.base
+}
+
+func (e *offsetBaseEnd) TotalMsgCnt() int64 {
+	return e.end.TotalMsgCnt()
+}
+
+func (e *offsetBaseEnd) IsSame(other BackendQueueEnd) bool {
+	if o, ok := other.(*offsetBaseEnd); ok {
+		return e.base == o.base && e.end.IsSame(o.end)
+	}
+	return false
+}
+
+// OffsetBaseReader addresses the disk queue reader with the virtual offsets started at the base,
+// which is used to mirror the offsets to the external systems with their own numbering. All the
+// offsets returned are shifted by the base and the offsets passed in are shifted back, while the
+// queue end updated from the writer is not shifted since it is the internal one.
+type OffsetBaseReader struct {
+	reader *diskQueueReader
+	base   BackendOffset
+}
+
+func NewOffsetBaseReader(r BackendQueueReader, base BackendOffset) (*OffsetBaseReader, error) {
+	d, ok := r.(*diskQueueReader)
+	if !ok {
+		return nil, ErrNotDiskQueueReader
+	}
+	if base < 0 {
+		return nil, ErrInvalidOffset
+	}
+	return &OffsetBaseReader{reader: d, base: base}, nil
+}
+
+func (r *OffsetBaseReader) OffsetBase() BackendOffset {
+	return r.base
+}
+
+func (r *OffsetBaseReader) shiftEnd(e BackendQueueEnd) BackendQueueEnd {
+	if e == nil {
+		return nil
+	}
+	return &offsetBaseEnd{end: e, base: r.base}
+}
+
+func (r *OffsetBaseReader) shiftResult(ret ReadResult) ReadResult {
+	ret.Offset += r.base
+	return ret
+}
+
+func (r *OffsetBaseReader) toInternal(offset BackendOffset) (BackendOffset, error) {
+	if offset < r.base {
+		return 0, ErrMoveOffsetInvalid
+	}
+	return offset - r.base, nil
+}
+
+// ConfirmRead confirms to the shifted offset, and -1 confirms all the read as the reader.
+func (r *OffsetBaseReader) ConfirmRead(offset BackendOffset, cnt int64) error {
+	if int64(offset) == -1 {
+		return r.reader.ConfirmRead(offset, cnt)
+	}
+	internal, err := r.toInternal(offset)
+	if err != nil {
+		return ErrConfirmSizeInvalid
+	}
+	return r.reader.ConfirmRead(internal, cnt)
+}
+
+func (r *OffsetBaseReader) ConfirmAllRead() (BackendOffset, error) {
+	confirmed, err := r.reader.ConfirmAllRead()
+	return confirmed + r.base, err
+}
+
+func (r *OffsetBaseReader) SkipMessages(n int64) (BackendOffset, int64, error) {
+	confirmed, skipped, err := r.reader.SkipMessages(n)
+	return confirmed + r.base, skipped, err
+}
+
+func (r *OffsetBaseReader) ResetReadToConfirmed() (BackendQueueEnd, error) {
+	e, err := r.reader.ResetReadToConfirmed()
+	return r.shiftEnd(e), err
+}
+
+func (r *OffsetBaseReader) ResetReadToOffset(offset BackendOffset, cnt int64) (BackendQueueEnd, error) {
+	internal, err := r.toInternal(offset)
+	if err != nil {
+		return nil, err
+	}
+	e, err := r.reader.ResetReadToOffset(internal, cnt)
+	return r.shiftEnd(e), err
+}
+
+func (r *OffsetBaseReader) SkipReadToOffset(offset BackendOffset, cnt int64) (BackendQueueEnd, error) {
+	internal, err := r.toInternal(offset)
+	if err != nil {
+		return nil, err
+	}
+	e, err := r.reader.SkipReadToOffset(internal, cnt)
+	return r.shiftEnd(e), err
+}
+
+func (r *OffsetBaseReader) SkipReadToEnd() (BackendQueueEnd, error) {
+	e, err := r.reader.SkipReadToEnd()
+	return r.shiftEnd(e), err
+}
+
+func (r *OffsetBaseReader) Close() error {
+	return r.reader.Close()
+}
+
+func (r *OffsetBaseReader) Depth() int64 {
+	return r.reader.Depth()
+}
+
+func (r *OffsetBaseReader) DepthSize() int64 {
+	return r.reader.DepthSize()
+}
+
+func (r *OffsetBaseReader) GetQueueReadEnd() BackendQueueEnd {
+	return r.shiftEnd(r.reader.GetQueueReadEnd())
+}
+
+func (r *OffsetBaseReader) GetQueueConfirmed() BackendQueueEnd {
+	return r.shiftEnd(r.reader.GetQueueConfirmed())
+}
+
+func (r *OffsetBaseReader) GetQueueCurrentRead() BackendQueueEnd {
+	return r.shiftEnd(r.reader.GetQueueCurrentRead())
+}
+
+func (r *OffsetBaseReader) Delete() error {
+	return r.reader.Delete()
+}
+
+// UpdateQueueEnd updates the end from the writer, the shifted end returned by this reader is
+// shifted back.
+func (r *OffsetBaseReader) UpdateQueueEnd(e BackendQueueEnd, forceReload bool) (bool, error) {
+	if shifted, ok := e.(*offsetBaseEnd); ok {
+		e = shifted.end
+	}
+	return r.reader.UpdateQueueEnd(e, forceReload)
+}
+
+func (r *OffsetBaseReader) TryReadOne() (ReadResult, bool) {
+	ret, ok := r.reader.TryReadOne()
+	return r.shiftResult(ret), ok
+}
+
+func (r *OffsetBaseReader) ReadBatch(maxCount int, maxBytes int64) []ReadResult {
+	rets := r.reader.ReadBatch(maxCount, maxBytes)
+	for i := range rets {
+		rets[i] = r.shiftResult(rets[i])
+	}
+	return rets
+}
+
+func (r *OffsetBaseReader) BackendType() string {
+	return r.reader.BackendType()
+}
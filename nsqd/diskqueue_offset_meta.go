@@ -0,0 +1,151 @@
+package nsqd
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"sync/atomic"
+
+	"github.com/youzan/nsq/internal/util"
+)
+
+// rebuild the missing offset meta of the data files while accessed, disabled by default
+// to avoid scanning the whole data files unexpectedly.
+var rebuildOffsetMeta = int32(0)
+
+func SetRebuildOffsetMeta(enable bool) {
+	if enable {
+		atomic.StoreInt32(&rebuildOffsetMeta, 1)
+	} else {
+		atomic.StoreInt32(&rebuildOffsetMeta, 0)
+	}
+}
+
+func isRebuildOffsetMetaEnabled() bool {
+	return atomic.LoadInt32(&rebuildOffsetMeta) == 1
+}
+
+// write the offset meta to the temp file and rename it, so the offset meta is either
+// the old or the new one while crashed, and rebuilding the same file is idempotent. The temp
+// file is unique since the channel readers may rebuild the same file concurrently.
+func saveQueueFileOffsetMeta(dataFileName string, cnt int64, startPos int64, endPos int64) error {
+	fName := dataFileName + ".offsetmeta.dat"
+	tmpName := fmt.Sprintf("%s.%d.tmp", fName, rand.Int())
+	f, err := os.OpenFile(tmpName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "%d\n%d,%d\n", cnt, startPos, endPos)
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	return util.AtomicRenameSync(tmpName, fName)
+}
+
+// getFileOffsetMeta returns the message count, the start and end virtual offset of the data file.
+// If the offset meta is missing and the rebuild is enabled, the data file will be scanned to
+// rebuild it from the offset meta of the previous file. The last file in the queue is still being
+// written, so it will never be rebuilt.
+func (d *diskQueueReader) getFileOffsetMeta(fileNum int64) (int64, int64, int64, error) {
+	cnt, startPos, endPos, err := getQueueFileOffsetMeta(d.fileName(fileNum))
+	if err == nil || !os.IsNotExist(err) || !isRebuildOffsetMetaEnabled() {
+		return cnt, startPos, endPos, err
+	}
+	if fileNum < 0 || fileNum >= d.queueEndInfo.EndOffset.FileNum {
+		return cnt, startPos, endPos, err
+	}
+	return d.rebuildFileOffsetMeta(fileNum)
+}
+
+// walk back to the latest previous file with the offset meta, and rebuild the missing offset
+// metas forward from it, so the long run of the missing files will not recurse deeply.
+func (d *diskQueueReader) rebuildFileOffsetMeta(fileNum int64) (int64, int64, int64, error) {
+	// the data file should exist before walking back the previous files
+	if _, err := os.Stat(d.dataFileName(fileNum)); err != nil {
+		return 0, 0, 0, err
+	}
+	var startCnt int64
+	var startPos int64
+	from := fileNum
+	for from > 0 {
+		cnt, _, endPos, err := getQueueFileOffsetMeta(d.fileName(from - 1))
+		if err == nil {
+			startCnt = cnt
+			startPos = endPos
+			break
+		}
+		if os.IsNotExist(err) {
+			_, err = os.Stat(d.dataFileName(from - 1))
+		}
+		if err != nil {
+			nsqLog.Logf("diskqueue(%s) failed to get the start of file %v for rebuilding offset meta: %v",
+				d.readerMetaName, from, err)
+			return 0, 0, 0, err
+		}
+		from--
+	}
+	for i := from; ; i++ {
+		size, msgCnt, err := d.countFileMessages(i)
+		if err != nil {
+			nsqLog.LogErrorf("diskqueue(%s) failed to scan the data file %v for rebuilding offset meta: %v",
+				d.readerMetaName, i, err)
+			return 0, 0, 0, err
+		}
+		cnt := startCnt + msgCnt
+		endPos := startPos + size
+		err = saveQueueFileOffsetMeta(d.fileName(i), cnt, startPos, endPos)
+		if err != nil {
+			nsqLog.LogErrorf("diskqueue(%s) failed to save the rebuilt offset meta of file %v: %v",
+				d.readerMetaName, i, err)
+			return 0, 0, 0, err
+		}
+		nsqLog.Logf("diskqueue(%s) rebuilt offset meta of file %v: %v, %v, %v",
+			d.readerMetaName, i, cnt, startPos, endPos)
+		if i == fileNum {
+			return cnt, startPos, endPos, nil
+		}
+		startCnt = cnt
+		startPos = endPos
+	}
+}
+
+// FileMessageCount returns the number of the messages in the finalized data file. The count is
+// the difference of the message count in the offset meta of the file and the previous one, which
+// is saved by the writer while the file is finalized, and the data file is scanned for the legacy
+// files without the offset meta. The last file is still being written, so it is rejected.
+func (d *diskQueueReader) FileMessageCount(fileNum int64) (int64, error) {
+	d.Lock()
+	defer d.Unlock()
+	if d.exitFlag == 1 {
+		return 0, ErrExiting
+	}
+	return d.getFileMessageCount(fileNum)
+}
+
+func (d *diskQueueReader) getFileMessageCount(fileNum int64) (int64, error) {
+	if fileNum < 0 || fileNum >= d.queueEndInfo.EndOffset.FileNum {
+		return 0, ErrMoveOffsetInvalid
+	}
+	cnt, _, _, err := d.getFileOffsetMeta(fileNum)
+	if err == nil {
+		if fileNum == 0 {
+			return cnt, nil
+		}
+		prevCnt, _, _, err := d.getFileOffsetMeta(fileNum - 1)
+		if err == nil {
+			return cnt - prevCnt, nil
+		}
+	}
+	_, msgCnt, err := d.countFileMessages(fileNum)
+	if err != nil {
+		nsqLog.LogErrorf("diskqueue(%s) failed to count the messages of file %v: %v",
+			d.readerMetaName, fileNum, err)
+		return 0, err
+	}
+	return msgCnt, nil
+}
@@ -0,0 +1,162 @@
+package nsqd
+
+import (
+	"container/list"
+	"os"
+	"sync"
+)
+
+type cachedReadFile struct {
+	name string
+	f    *os.File
+}
+
+// readFileCache keeps the idle read-only handles of the data files for the random-access reads
+// (the range read, the reverse scan and the last messages read), so the reads on the overlapping
+// files can reuse the opened handles. The handle is used exclusively while acquired and put back
+// after used, the least recently used is closed while more than the max handles are idle.
+// It is never used by the live read of the reader.
+// The cache is shared by all the readers so the total idle handles are bounded, and the handle
+// is closed while the file is removed so the disk space is released.
+type readFileCache struct {
+	sync.Mutex
+	max   int
+	lru   *list.List
+	files map[string]*list.Element
+}
+
+var sharedReadFileCache = newReadFileCache(0)
+
+func newReadFileCache(max int) *readFileCache {
+	return &readFileCache{
+		max:   max,
+		lru:   list.New(),
+		files: make(map[string]*list.Element),
+	}
+}
+
+// acquire returns the idle handle of the file seeked to the start if cached, or opens it.
+func (c *readFileCache) acquire(fileName string) (*os.File, error) {
+	c.Lock()
+	var f *os.File
+	if e, ok := c.files[fileName]; ok {
+		f = e.Value.(*cachedReadFile).f
+		c.lru.Remove(e)
+		delete(c.files, fileName)
+	}
+	c.Unlock()
+	if f != nil {
+		// the file may be removed or replaced while idle
+		if c.isSameFile(fileName, f) {
+			if _, err := f.Seek(0, 0); err == nil {
+				return f, nil
+			}
+		}
+		f.Close()
+	}
+	return openQueueFileForRead(fileName)
+}
+
+func (c *readFileCache) isSameFile(fileName string, f *os.File) bool {
+	stat, err := os.Stat(fileName)
+	if err != nil {
+		return false
+	}
+	fstat, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return os.SameFile(stat, fstat)
+}
+
+// release puts the handle back as the most recently used, the handle is closed if the same
+// file has been cached.
+func (c *readFileCache) release(f *os.File) {
+	c.Lock()
+	if _, ok := c.files[f.Name()]; ok || c.max <= 0 {
+		c.Unlock()
+		f.Close()
+		return
+	}
+	c.files[f.Name()] = c.lru.PushFront(&cachedReadFile{name: f.Name(), f: f})
+	evicted := c.trim(c.max)
+	c.Unlock()
+	for _, old := range evicted {
+		old.Close()
+	}
+}
+
+// should be protected by the lock
+func (c *readFileCache) trim(max int) []*os.File {
+	var evicted []*os.File
+	for c.lru.Len() > max {
+		e := c.lru.Back()
+		item := e.Value.(*cachedReadFile)
+		c.lru.Remove(e)
+		delete(c.files, item.name)
+		evicted = append(evicted, item.f)
+	}
+	return evicted
+}
+
+func (c *readFileCache) setMax(max int) {
+	if max < 0 {
+		max = 0
+	}
+	c.Lock()
+	c.max = max
+	evicted := c.trim(c.max)
+	c.Unlock()
+	for _, old := range evicted {
+		old.Close()
+	}
+}
+
+// close the idle handle of the file removed or moved
+func (c *readFileCache) evict(fileName string) {
+	c.Lock()
+	var f *os.File
+	if e, ok := c.files[fileName]; ok {
+		f = e.Value.(*cachedReadFile).f
+		c.lru.Remove(e)
+		delete(c.files, fileName)
+	}
+	c.Unlock()
+	if f != nil {
+		f.Close()
+	}
+}
+
+func (c *readFileCache) len() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.lru.Len()
+}
+
+// SetMaxCachedReadFiles changes the max idle handles of the data files cached for the random-access
+// reads of all the readers, the cache is disabled if 0.
+func SetMaxCachedReadFiles(max int) {
+	sharedReadFileCache.setMax(max)
+}
+
+// the handle opened by the range reader is acquired from the shared cache
+func (d *diskQueueReader) openReadFile(fileName string) (*os.File, error) {
+	if d.fileCache != nil {
+		return d.fileCache.acquire(fileName)
+	}
+	return openQueueFileForRead(fileName)
+}
+
+// close the read file while rolled to the next file or the range read done, the handle of the
+// range reader is put back to the cache.
+func (d *diskQueueReader) releaseReadFile() {
+	if d.readFile == nil {
+		return
+	}
+	if d.fileCache != nil {
+		d.fileCache.release(d.readFile)
+	} else {
+		d.readFile.Close()
+	}
+	d.readFile = nil
+}
@@ -0,0 +1,97 @@
+package nsqd
+
+import (
+	"bytes"
+	"sync/atomic"
+)
+
+// ReadLastN returns at most the last n messages before the queue end in order. The start is
+// located by walking the files backward from the end with the message count in the offset meta,
+// and the messages are read by a separate reader at that start, so the read and confirmed
+// position of this reader are not changed.
+func (d *diskQueueReader) ReadLastN(n int) ([]ReadResult, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	d.Lock()
+	if d.exitFlag == 1 {
+		d.Unlock()
+		return nil, ErrExiting
+	}
+	end := d.queueEndInfo
+	base, err := d.getRetainedBase()
+	d.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	return d.readLastInRange(d.findLastNStart(base, end, int64(n)), end.Offset(), end, n)
+}
+
+// read the messages from the start until the stop offset or the end by a separate reader, and
+// keep at most the last limit messages in order.
+func (d *diskQueueReader) readLastInRange(start diskQueueEndInfo, stop BackendOffset,
+	end diskQueueEndInfo, limit int) ([]ReadResult, error) {
+	tmp := d.newRangeReader(start, end)
+	defer tmp.closeRangeReader()
+
+	// keep the last messages read in the ring
+	ring := make([]ReadResult, 0, limit)
+	next := 0
+	for end.EndOffset.GreatThan(&tmp.readQueueInfo.EndOffset) && tmp.readQueueInfo.Offset() < stop {
+		ret := tmp.readOne()
+		if ret.Err != nil {
+			nsqLog.LogWarningf("diskqueue(%s) failed to read the last messages at %v: %v",
+				d.readerMetaName, tmp.readQueueInfo, ret.Err)
+			return nil, ret.Err
+		}
+		if len(ring) < limit {
+			ring = append(ring, ret)
+		} else {
+			ring[next] = ret
+			next = (next + 1) % limit
+		}
+	}
+	return append(ring[next:], ring[:next]...), nil
+}
+
+// the reader at the start used to read the data without changing this reader
+func (d *diskQueueReader) newRangeReader(start diskQueueEndInfo, end diskQueueEndInfo) *diskQueueReader {
+	tmp := &diskQueueReader{
+		readFrom:        d.readFrom,
+		readerMetaName:  d.readerMetaName,
+		dataPath:        d.dataPath,
+		coldPath:        d.coldPath,
+		maxBytesPerFile: d.maxBytesPerFile,
+		minMsgSize:      d.minMsgSize,
+		parseMsgHeader:  atomic.LoadInt32(&d.parseMsgHeader),
+		readBuffer:      bytes.NewBuffer(make([]byte, 0, readBufferSize)),
+		fileCache:       sharedReadFileCache,
+	}
+	tmp.queueEndInfo = end
+	tmp.readQueueInfo = start
+	tmp.confirmedQueueInfo = tmp.readQueueInfo
+	return tmp
+}
+
+func (d *diskQueueReader) closeRangeReader() {
+	d.releaseReadFile()
+}
+
+// the file missing the offset meta is treated as empty, so the start may be earlier than needed
+func (d *diskQueueReader) findLastNStart(base diskQueueEndInfo, end diskQueueEndInfo, n int64) diskQueueEndInfo {
+	for fileNum := end.EndOffset.FileNum; fileNum > base.EndOffset.FileNum; fileNum-- {
+		cnt, _, endPos, err := getQueueFileOffsetMeta(d.fileName(fileNum - 1))
+		if err != nil {
+			continue
+		}
+		if end.TotalMsgCnt()-cnt >= n {
+			var start diskQueueEndInfo
+			start.EndOffset.FileNum = fileNum
+			start.virtualEnd = BackendOffset(endPos)
+			start.totalMsgCnt = cnt
+			return start
+		}
+	}
+	return base
+}
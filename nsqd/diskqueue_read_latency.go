@@ -0,0 +1,57 @@
+package nsqd
+
+import (
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// open the data file to read, replaced in the test to simulate the slow disk
+var openQueueFileForRead = func(fileName string) (*os.File, error) {
+	return os.OpenFile(fileName, os.O_RDONLY, 0644)
+}
+
+// ReaderLatencyStats is the latency of the reader startup and the data file open in milliseconds,
+// the first read is the time from the reader created to the first message read, 0 if not read yet.
+type ReaderLatencyStats struct {
+	FirstRead int64 `json:"first_read"`
+	OpenCount int64 `json:"open_count"`
+	LastOpen  int64 `json:"last_open"`
+	MaxOpen   int64 `json:"max_open"`
+	AvgOpen   int64 `json:"avg_open"`
+}
+
+// LatencyStats returns the latency of the startup and the data file open and seek.
+func (d *diskQueueReader) LatencyStats() ReaderLatencyStats {
+	var s ReaderLatencyStats
+	s.FirstRead = atomic.LoadInt64(&d.firstReadLatency) / int64(time.Millisecond)
+	s.OpenCount = atomic.LoadInt64(&d.openCnt)
+	s.LastOpen = atomic.LoadInt64(&d.lastOpenLatency) / int64(time.Millisecond)
+	s.MaxOpen = atomic.LoadInt64(&d.maxOpenLatency) / int64(time.Millisecond)
+	if s.OpenCount > 0 {
+		s.AvgOpen = atomic.LoadInt64(&d.openLatencySum) / s.OpenCount / int64(time.Millisecond)
+	}
+	return s
+}
+
+// should be protected by the lock
+func (d *diskQueueReader) recordOpenLatency(cost time.Duration) {
+	atomic.AddInt64(&d.openCnt, 1)
+	atomic.AddInt64(&d.openLatencySum, int64(cost))
+	atomic.StoreInt64(&d.lastOpenLatency, int64(cost))
+	if int64(cost) > atomic.LoadInt64(&d.maxOpenLatency) {
+		atomic.StoreInt64(&d.maxOpenLatency, int64(cost))
+	}
+}
+
+// only the first message read after the reader created is recorded
+func (d *diskQueueReader) recordFirstRead() {
+	if atomic.LoadInt64(&d.firstReadLatency) != 0 {
+		return
+	}
+	cost := time.Now().UnixNano() - d.createdTs
+	if cost <= 0 {
+		cost = 1
+	}
+	atomic.StoreInt64(&d.firstReadLatency, cost)
+}
@@ -0,0 +1,47 @@
+package nsqd
+
+import (
+	"sync/atomic"
+)
+
+// checkReadOrder verifies the message is read at the read position before the read, so the
+// messages are delivered in order even across the file rolls. The read position is restored
+// if violated, and the message will be read again from it.
+// should be protected by the lock
+func (d *diskQueueReader) checkReadOrder(prevRead diskQueueEndInfo, ret ReadResult) bool {
+	if ret.Offset == prevRead.Offset() && ret.Offset >= d.confirmedQueueInfo.Offset() {
+		return true
+	}
+	atomic.AddInt64(&d.readOrderViolationCnt, 1)
+	nsqLog.LogErrorf("diskqueue(%s) read %v out of order, the read position was: %v, now: %v, confirmed: %v",
+		d.readerMetaName, ret.Offset, prevRead, d.readQueueInfo, d.confirmedQueueInfo)
+	if d.readFile != nil {
+		d.readFile.Close()
+		d.readFile = nil
+	}
+	d.resetReadBuffer()
+	d.readQueueInfo = prevRead
+	return false
+}
+
+// GetReadOrderViolations returns the times of the message read not at the read position.
+func (d *diskQueueReader) GetReadOrderViolations() int64 {
+	return atomic.LoadInt64(&d.readOrderViolationCnt)
+}
+
+// skip the read to the end while the confirmed is kept, the messages read before are
+// still confirmed in order, and the confirmed moves past the skipped data after them.
+// should be protected by the lock
+func (d *diskQueueReader) skipReadToEndKeepConfirmed() {
+	if d.readFile != nil {
+		d.readFile.Close()
+		d.readFile = nil
+	}
+	d.resetReadBuffer()
+	skipStart := d.readQueueInfo.Offset()
+	d.readQueueInfo = d.queueEndInfo
+	d.addSkippedPending(skipStart)
+	d.updateDepth()
+	d.logCorruptSkipf("diskqueue(%s) skip the read to end %v, confirmed: %v",
+		d.readerMetaName, d.readQueueInfo, d.confirmedQueueInfo)
+}
@@ -0,0 +1,42 @@
+package nsqd
+
+import (
+	"sync"
+)
+
+const (
+	minPooledReadDataSize = 256
+	// the large buffers are not pooled to avoid holding too much memory
+	maxPooledReadDataSize = 64 * 1024
+)
+
+var readDataPool sync.Pool
+
+// the buffer is rounded up to the power of 2 so it can be reused by the messages with
+// the similar size.
+func getReadData(size int) []byte {
+	if size > maxPooledReadDataSize {
+		return make([]byte, size)
+	}
+	if b, ok := readDataPool.Get().(*[]byte); ok {
+		if cap(*b) >= size {
+			return (*b)[:size]
+		}
+		readDataPool.Put(b)
+	}
+	c := minPooledReadDataSize
+	for c < size {
+		c <<= 1
+	}
+	return make([]byte, size, c)
+}
+
+// ReleaseReadData returns the data read by TryReadOnePooled to the pool, the data
+// should not be used any more after released.
+func ReleaseReadData(data []byte) {
+	if cap(data) < minPooledReadDataSize || cap(data) > maxPooledReadDataSize {
+		return
+	}
+	data = data[:0]
+	readDataPool.Put(&data)
+}
@@ -0,0 +1,66 @@
+package nsqd
+
+// ReadRange returns the messages started in [from, to) in order. The from should be the start
+// of a message, and the messages are read by a separate reader from the start of the file of the
+// from offset, so the read and confirmed position of this reader are not changed.
+func (d *diskQueueReader) ReadRange(from BackendOffset, to BackendOffset) ([]ReadResult, error) {
+	return d.readRange(from, to, false)
+}
+
+// ReadRangeInclusive is the same as ReadRange but the message started at the to offset is
+// included, and the to should be the start of a message before the end.
+func (d *diskQueueReader) ReadRangeInclusive(from BackendOffset, to BackendOffset) ([]ReadResult, error) {
+	return d.readRange(from, to, true)
+}
+
+func (d *diskQueueReader) readRange(from BackendOffset, to BackendOffset, inclusive bool) ([]ReadResult, error) {
+	d.Lock()
+	if d.exitFlag == 1 {
+		d.Unlock()
+		return nil, ErrExiting
+	}
+	end := d.queueEndInfo
+	base, err := d.getRetainedBase()
+	d.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if from > to || to > end.Offset() || (inclusive && to == end.Offset()) {
+		return nil, ErrMoveOffsetInvalid
+	}
+	if from < base.Offset() {
+		return nil, ErrOffsetGarbageCollected
+	}
+
+	start, _ := d.findFileStartBefore(base, end.EndOffset.FileNum, from+1)
+	tmp := d.newRangeReader(start, end)
+	defer tmp.closeRangeReader()
+	var result []ReadResult
+	for end.EndOffset.GreatThan(&tmp.readQueueInfo.EndOffset) {
+		cur := tmp.readQueueInfo.Offset()
+		if cur > to || (cur == to && !inclusive) {
+			break
+		}
+		ret := tmp.readOne()
+		if ret.Err != nil {
+			nsqLog.LogWarningf("diskqueue(%s) failed to read the range at %v: %v",
+				d.readerMetaName, tmp.readQueueInfo, ret.Err)
+			return result, ret.Err
+		}
+		if ret.Offset < from {
+			if ret.Offset+ret.MovedSize > from {
+				// the from is in the middle of the message
+				return nil, ErrMoveOffsetInvalid
+			}
+			continue
+		}
+		if inclusive && ret.Offset < to && ret.Offset+ret.MovedSize > to {
+			return nil, ErrMoveOffsetInvalid
+		}
+		result = append(result, ret)
+	}
+	if inclusive && (len(result) == 0 || result[len(result)-1].Offset != to) {
+		return nil, ErrMoveOffsetInvalid
+	}
+	return result, nil
+}
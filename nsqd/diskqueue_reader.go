@@ -2,6 +2,7 @@ package nsqd
 
 import (
 	"bytes"
+	"container/heap"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -11,14 +12,26 @@ import (
 	"math/rand"
 	"os"
 	"path"
+	"strconv"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 const (
 	MAX_POSSIBLE_MSG_SIZE = 1 << 28
 	readBufferSize        = 1024 * 4
+	// the reader will stop writing the meta file for a while after some continuous failures
+	maxMetaSyncFailures = 3
+	metaSyncFailBackoff = time.Second * 10
+	// max offsets tracked for the delivery attempts, should be enough for the in-flight window
+	maxTrackedAttempts = 1024 * 16
+	// min interval between the warnings of the confirm clamped to read
+	overConfirmWarnInterval = time.Second * 10
+	// the backoff to retry opening the data file failed by the permission or the transient error
+	readOpenRetryBackoff    = time.Second
+	maxReadOpenRetryBackoff = time.Second * 30
 )
 
 var (
@@ -32,8 +45,29 @@ var (
 	ErrInvalidReadable         = errors.New("readable data is invalid")
 	ErrReadEndChangeToOld      = errors.New("queue read end change to old without reload")
 	ErrExiting                 = errors.New("exiting")
+	ErrMetaSyncDegraded        = errors.New("reader meta sync degraded")
+	ErrNotConfirmedFrontier    = errors.New("offset is not the confirmed frontier")
+	ErrInvalidFileHeaderLen    = errors.New("invalid file header length")
+	ErrInvalidCorruptionPolicy = errors.New("invalid corruption policy")
+	ErrResyncEndTooOld         = errors.New("resync end is behind the confirmed")
+	ErrOffsetGarbageCollected  = errors.New("the offset has been garbage collected")
+	ErrInvalidDivergencePolicy = errors.New("invalid end divergence policy")
+	ErrReadEndDiverged         = errors.New("the read position is past the new end")
+	ErrReadFileUnavailable     = errors.New("the data file is unavailable to read")
+	ErrInvalidInitialPosition  = errors.New("invalid initial position policy")
+	ErrConfirmRegression       = errors.New("confirm offset is not after the confirmed")
+	ErrQueueFileIntegrity      = errors.New("the data files are not contiguous")
+	ErrInvalidReaderState      = errors.New("invalid reader state")
+	ErrConfirmNotBoundary      = errors.New("confirm offset is not the message boundary")
+	ErrSnapshotNotFound        = errors.New("the reader snapshot is not found")
+	ErrReadOutOfOrder          = errors.New("the message read is not at the read position")
 )
 
+// the upper bounds of the message size buckets, the larger sizes are counted in the last bucket
+var msgSizeBucketBounds = [...]int64{64, 256, 1024, 1024 * 4, 1024 * 16, 1024 * 64, 1024 * 256, 1024 * 1024}
+
+const msgSizeBucketNum = len(msgSizeBucketBounds) + 1
+
 type diskQueueOffset struct {
 	FileNum int64
 	Pos     int64
@@ -79,6 +113,17 @@ func (d *diskQueueOffset) GreatThan(o *diskQueueOffset) bool {
 	return false
 }
 
+// EndUpdateResult is the result of updating the queue end. The read position
+// will be rewound to the new end if the end moved backward past it, which
+// happens only if the writer is truncated or rolled back.
+type EndUpdateResult struct {
+	Changed bool
+	Rewound bool
+	// the data size and the message count rewound from the read position
+	RewindSize BackendOffset
+	RewindCnt  int64
+}
+
 // diskQueueReader implements the BackendQueue interface
 // providing a filesystem backed FIFO queue
 type diskQueueReader struct {
@@ -88,6 +133,31 @@ type diskQueueReader struct {
 	// left message number for read
 	depth     int64
 	depthSize int64
+	// the times of the read position rewound by the end moved backward
+	rewindCnt int64
+	// the times of the corrupt data skipped while reading
+	corruptSkipCnt int64
+	// the reads not at the read position, which should never happen
+	readOrderViolationCnt int64
+	// the messages filtered out without delivery
+	filteredCnt int64
+	// the times of the end updated with the type not from the disk queue
+	endMismatchCnt int64
+	// the times of the read rewound by the confirm deadline, the messages given up and the
+	// messages not tracked
+	deadlineRedeliverCnt int64
+	deadlineExhaustedCnt int64
+	deadlineUntrackedCnt int64
+	// the time created and the latency of the first read and the data file open
+	createdTs        int64
+	firstReadLatency int64
+	openCnt          int64
+	openLatencySum   int64
+	lastOpenLatency  int64
+	maxOpenLatency   int64
+
+	// the message sizes read in each bucket
+	msgSizeHist [msgSizeBucketNum]int64
 
 	sync.RWMutex
 
@@ -95,39 +165,147 @@ type diskQueueReader struct {
 	readerMetaName  string
 	readFrom        string
 	dataPath        string
+	coldPath        string
 	maxBytesPerFile int64 // currently this cannot change once created
 	minMsgSize      int32
-	syncEvery       int64 // number of writes per fsync
-	exitFlag        int32
-	needSync        bool
+	syncEvery       int64 // number of confirms per fsync
+	// the length of the header of each data file written by the external writer
+	fileHeaderLen int64
+	syncTimeout   int64 // min interval (in ns) between the periodic meta syncs
+	exitFlag      int32
+	needSync      bool
+	// no meta while created, the initial position can be changed by the policy
+	metaMissing bool
+	// confirms since last meta sync
+	syncCnt    int64
+	lastSyncTs int64
+	// the state in the meta file written last, no meta write if nothing changed since it
+	syncedMeta readerMetaState
+	metaSynced bool
+	// continuous meta sync failures, the reader will be degraded while the sync keeps failing
+	syncFailCnt     int64
+	degraded        int32
+	degradedUntil   int64
+	degradedBackoff time.Duration
+	persistMeta     func() error
+	updateEnd       func(*diskQueueEndInfo, bool) (bool, error)
+	// batch the meta syncs with the other readers if set
+	syncCoordinator *metaSyncCoordinator
+	// the confirmed offset is also saved to the external store in background after synced if set
+	confirmStore    ConfirmStore
+	confirmStoreKey confirmStoreKey
+	storedConfirmed BackendOffset
+	// the confirmed synced and waiting to be saved to the store
+	confirmToStore      diskQueueEndInfo
+	confirmStorePending bool
+	confirmStoreNotify  chan struct{}
+	confirmStoreStop    chan struct{}
+	// the follower never saves to the store
+	confirmStoreReadOnly int32
+	// parse the message header into the read result
+	parseMsgHeader int32
+	// clamp the confirm exceed read to the read position instead of rejecting it
+	clampOverConfirm    int32
+	lastOverConfirmWarn int64
+	// reject the confirm not after the confirmed instead of ignoring it
+	strictConfirm    int32
+	confirmRegressed int64
+	// reject the confirm not at the boundary of the messages
+	confirmBoundaryCheck int32
+	// notified with the latest confirmed offset while changed
+	confirmWatchers []chan BackendOffset
+	// the logs of the repeated corruption are limited
+	corruptLog corruptLogLimiter
+	// the copy of the corrupt data file skipped is kept in this directory
+	corruptQuarantineDir string
+	// the quarantine copies in progress, so the corrupt file hit again is copied once
+	quarantiningFiles map[string]bool
+	// the policy to handle the corrupt data, and the read is halted by the corruption
+	// until the read position is changed manually if the policy is halt
+	corruptionPolicy int32
+	corruptionHalted int32
+	// the policy to handle the read position past the new end
+	endDivergencePolicy int32
+	// delivery attempts of the offsets not confirmed, and the offsets tracked ordered
+	// so the confirmed can be pruned without scanning all
+	readAttempts   map[BackendOffset]int32
+	attemptOffsets offsetHeap
+	// the max read offset, the data before it may be delivered before restart
+	maxReadOffset BackendOffset
+	// the max read offset persisted before restart
+	redeliverEnd BackendOffset
+	// the cached start of the oldest retained data file
+	retainedBase retainedBaseCache
+	// the snapshots not ended which hold the clean of the data files
+	snapshots   map[int64]*SnapshotHandle
+	snapshotSeq int64
+	// the filter of the messages read, and the end of the data filtered or skipped not confirmed
+	deliveryFilter DeliveryFilter
+	skippedPending map[BackendOffset]diskQueueEndInfo
+	// the confirm deadlines of the messages delivered and not confirmed
+	confirmTimeout       time.Duration
+	maxDeadlineRedeliver int32
+	confirmDeadlines     map[BackendOffset]*confirmDeadline
 
 	confirmedQueueInfo diskQueueEndInfo
 
 	readFile   *os.File
 	readBuffer *bytes.Buffer
+	// the idle handles cached for the random-access reads if this is the range reader
+	fileCache *readFileCache
+	// the data size buffered in the read buffer but not read yet
+	bufferedBytes int64
+	// the data size of the read results staged or prefetched by the consumer but not delivered
+	stagedBytes int64
+	// continuous data file open failures not caused by the corruption
+	openFailCnt      int64
+	openRetryUntil   int64
+	openRetryBackoff time.Duration
 
 	exitChan        chan int
-	autoSkipError   bool
+	autoSkipError   int32
 	waitingMoreData int32
 }
 
 // newDiskQueue instantiates a new instance of diskQueueReader, retrieving metadata
-// from the filesystem and starting the read ahead goroutine
+// from the filesystem and starting the read ahead goroutine. The missing metadata is
+// expected for the new reader, but the error will be returned if the metadata can not be read.
 func newDiskQueueReader(readFrom string, metaname string, dataPath string, maxBytesPerFile int64,
 	minMsgSize int32, maxMsgSize int32,
-	syncEvery int64, syncTimeout time.Duration, readEnd BackendQueueEnd, autoSkip bool) BackendQueueReader {
+	syncEvery int64, syncTimeout time.Duration, readEnd BackendQueueEnd, autoSkip bool) (BackendQueueReader, error) {
+	return newTieredDiskQueueReader(readFrom, metaname, dataPath, "", maxBytesPerFile,
+		minMsgSize, maxMsgSize, syncEvery, syncTimeout, readEnd, autoSkip)
+}
 
+// newTieredDiskQueueReader instantiates the reader of the data files which may be moved to
+// the cold path, the cold path is needed while loading since the confirmed file may be moved.
+func newTieredDiskQueueReader(readFrom string, metaname string, dataPath string, coldPath string,
+	maxBytesPerFile int64, minMsgSize int32, maxMsgSize int32,
+	syncEvery int64, syncTimeout time.Duration, readEnd BackendQueueEnd, autoSkip bool) (BackendQueueReader, error) {
+
+	if fixedEvery, fixedTimeout := normalizeSyncPolicy(syncEvery, syncTimeout); fixedEvery != syncEvery || fixedTimeout != syncTimeout {
+		nsqLog.Logf("diskqueue(%s) invalid sync policy %v, %v, use %v, %v",
+			metaname, syncEvery, syncTimeout, fixedEvery, fixedTimeout)
+		syncEvery, syncTimeout = fixedEvery, fixedTimeout
+	}
 	d := diskQueueReader{
 		readFrom:        readFrom,
 		readerMetaName:  metaname,
 		dataPath:        dataPath,
+		coldPath:        coldPath,
 		maxBytesPerFile: maxBytesPerFile,
 		minMsgSize:      minMsgSize,
 		exitChan:        make(chan int),
 		syncEvery:       syncEvery,
-		autoSkipError:   autoSkip,
+		syncTimeout:     int64(syncTimeout),
 		readBuffer:      bytes.NewBuffer(make([]byte, 0, readBufferSize)),
+		degradedBackoff: metaSyncFailBackoff,
+		readAttempts:    make(map[BackendOffset]int32),
+		createdTs:       time.Now().UnixNano(),
 	}
+	d.persistMeta = d.persistMetaData
+	d.updateEnd = d.internalUpdateEnd
+	d.SetAutoSkipError(autoSkip)
 
 	// init the channel to end, so if any new channel without meta will be init to read at end
 	if diskEnd, ok := readEnd.(*diskQueueEndInfo); ok {
@@ -141,22 +319,165 @@ func newDiskQueueReader(readFrom string, metaname string, dataPath string, maxBy
 	if err != nil && !os.IsNotExist(err) {
 		nsqLog.LogErrorf("diskqueue(%s) failed to retrieveMetaData %v - %s",
 			d.readFrom, d.readerMetaName, err)
+		return nil, err
 	}
+	d.metaMissing = err != nil
 
-	return &d
+	return &d, nil
 }
 
-func getQueueSegmentEnd(dataRoot string, readFrom string, offset diskQueueOffset) (int64, error) {
-	curFileName := GetQueueFileName(dataRoot, readFrom, offset.FileNum)
-	f, err := os.Stat(curFileName)
+// the policies to init the read position for the reader created without meta
+const (
+	InitialPositionStart  = "start"
+	InitialPositionEnd    = "end"
+	InitialPositionOffset = "offset"
+)
+
+// SetInitialPosition moves the read and confirmed to the position chosen by the policy if
+// the reader is created without meta, the end and offset are resolved against the end
+// provided by the writer. It should be called before reading, and nothing is changed if
+// the reader is restored from the meta.
+func (d *diskQueueReader) SetInitialPosition(policy string, offset BackendOffset, cnt int64) error {
+	if policy != InitialPositionStart && policy != InitialPositionEnd && policy != InitialPositionOffset {
+		return ErrInvalidInitialPosition
+	}
+	d.Lock()
+	defer d.Unlock()
+	if d.exitFlag == 1 {
+		return ErrExiting
+	}
+	if !d.metaMissing {
+		return nil
+	}
+	if policy == InitialPositionEnd {
+		d.resetReadToFileStart(d.queueEndInfo)
+	} else {
+		start, err := d.findQueueStart()
+		if err != nil {
+			nsqLog.LogErrorf("diskqueue(%s) failed to find the queue start: %v", d.readerMetaName, err)
+			return err
+		}
+		d.resetReadToFileStart(start)
+		if policy == InitialPositionOffset {
+			err = d.internalSkipTo(offset, cnt, false)
+			if err != nil {
+				nsqLog.LogErrorf("diskqueue(%s) failed to init the read to %v:%v: %v",
+					d.readerMetaName, offset, cnt, err)
+				return err
+			}
+			d.needSync = true
+			d.sync()
+			d.notifyConfirmed()
+		}
+	}
+	d.metaMissing = false
+	nsqLog.Logf("diskqueue(%s) init the read by policy %v to: %v", d.readerMetaName, policy, d.readQueueInfo)
+	return nil
+}
+
+// backupReaderMeta renames the unreadable reader metadata files, so the reader can be created
+// again from the init position, and the broken metadata is kept for the manual recovery.
+func backupReaderMeta(dataPath string, metaname string) error {
+	d := diskQueueReader{dataPath: dataPath, readerMetaName: metaname}
+	suffix := ".corrupt." + strconv.FormatInt(time.Now().Unix(), 10)
+	for _, fName := range []string{d.metaDataFileName(true), d.metaDataFileName(false)} {
+		if _, err := os.Stat(fName); err != nil {
+			continue
+		}
+		err := os.Rename(fName, fName+suffix)
+		if err != nil {
+			return err
+		}
+		nsqLog.Logf("reader meta %v backup to %v", fName, fName+suffix)
+	}
+	return nil
+}
+
+// SetFileHeaderLen changes the length of the header at the beginning of each data file written
+// by the external writer, the header is not any message, so the file positions and the virtual
+// offsets exclude it. The files written by nsqd have no header.
+func (d *diskQueueReader) SetFileHeaderLen(headerLen int64) error {
+	if headerLen < 0 {
+		return ErrInvalidFileHeaderLen
+	}
+	atomic.StoreInt64(&d.fileHeaderLen, headerLen)
+	return nil
+}
+
+func (d *diskQueueReader) getFileHeaderLen() int64 {
+	return atomic.LoadInt64(&d.fileHeaderLen)
+}
+
+// the size of the message data in the file excluding the header
+func getQueueFileDataSize(fileSize int64, headerLen int64) int64 {
+	dataSize := fileSize - headerLen
+	if dataSize < 0 {
+		return 0
+	}
+	return dataSize
+}
+
+// the policies to handle the corrupt data while reading
+const (
+	CorruptionPolicySkipFile  = "skip-file"
+	CorruptionPolicySkipToEnd = "skip-to-end"
+	CorruptionPolicyHalt      = "halt"
+)
+
+const (
+	corruptionSkipFile int32 = iota
+	corruptionSkipToEnd
+	corruptionHalt
+)
+
+func parseCorruptionPolicy(policy string) (int32, error) {
+	switch policy {
+	case "", CorruptionPolicySkipFile:
+		return corruptionSkipFile, nil
+	case CorruptionPolicySkipToEnd:
+		return corruptionSkipToEnd, nil
+	case CorruptionPolicyHalt:
+		return corruptionHalt, nil
+	}
+	return corruptionSkipFile, ErrInvalidCorruptionPolicy
+}
+
+// the policies to handle the read position past the new end moved backward
+const (
+	EndDivergencePolicyClamp = "clamp"
+	EndDivergencePolicyHalt  = "halt"
+)
+
+const (
+	endDivergenceClamp int32 = iota
+	endDivergenceHalt
+)
+
+func parseEndDivergencePolicy(policy string) (int32, error) {
+	switch policy {
+	case "", EndDivergencePolicyClamp:
+		return endDivergenceClamp, nil
+	case EndDivergencePolicyHalt:
+		return endDivergenceHalt, nil
+	}
+	return endDivergenceClamp, ErrInvalidDivergencePolicy
+}
+
+func getQueueSegmentEnd(dataRoot string, coldPath string, readFrom string, headerLen int64, offset diskQueueOffset) (int64, error) {
+	f, err := statResolvedQueueFile(dataRoot, coldPath, readFrom, offset.FileNum)
 	if err != nil {
 		return 0, err
 	}
-	return f.Size(), nil
+	return getQueueFileDataSize(f.Size(), headerLen), nil
 }
 
 func (d *diskQueueReader) getCurrentFileEnd(offset diskQueueOffset) (int64, error) {
-	return getQueueSegmentEnd(d.dataPath, d.readFrom, offset)
+	return getQueueSegmentEnd(d.dataPath, d.coldPath, d.readFrom, d.getFileHeaderLen(), offset)
+}
+
+// BackendType returns the type of the backend files the reader reads from.
+func (d *diskQueueReader) BackendType() string {
+	return BackendTypeDisk
 }
 
 // Depth returns the depth of the queue
@@ -193,18 +514,119 @@ func (d *diskQueueReader) GetQueueCurrentRead() BackendQueueEnd {
 // we need make sure this since we may read/write on the same file in different thread.
 func (d *diskQueueReader) UpdateQueueEnd(e BackendQueueEnd, forceReload bool) (bool, error) {
 	end, ok := e.(*diskQueueEndInfo)
-	if !ok || end == nil {
+	if e == nil || (ok && end == nil) {
 		if nsqLog.Level() >= levellogger.LOG_DEBUG {
 			nsqLog.Logf("%v got nil end while update queue end", d.readerMetaName)
 		}
 		return false, nil
 	}
+	if !ok {
+		d.onEndTypeMismatch(e)
+		return false, ErrOffsetTypeMismatch
+	}
 	d.Lock()
 	defer d.Unlock()
 	if d.exitFlag == 1 {
 		return false, ErrExiting
 	}
-	return d.internalUpdateEnd(end, forceReload)
+	return d.updateEnd(end, forceReload)
+}
+
+// UpdateQueueEndWithResult is the same as UpdateQueueEnd but returns whether the read
+// position is rewound by the end and how much.
+func (d *diskQueueReader) UpdateQueueEndWithResult(e BackendQueueEnd, forceReload bool) (EndUpdateResult, error) {
+	end, ok := e.(*diskQueueEndInfo)
+	if e == nil || (ok && end == nil) {
+		return EndUpdateResult{}, nil
+	}
+	if !ok {
+		d.onEndTypeMismatch(e)
+		return EndUpdateResult{}, ErrOffsetTypeMismatch
+	}
+	d.Lock()
+	defer d.Unlock()
+	if d.exitFlag == 1 {
+		return EndUpdateResult{}, ErrExiting
+	}
+	return d.internalUpdateEndWithResult(end, forceReload)
+}
+
+// RewindCount returns the times of the read position rewound by the end.
+func (d *diskQueueReader) RewindCount() int64 {
+	return atomic.LoadInt64(&d.rewindCnt)
+}
+
+// the end of the other backend can never be applied, the read will stall if it is ignored
+func (d *diskQueueReader) onEndTypeMismatch(e BackendQueueEnd) {
+	atomic.AddInt64(&d.endMismatchCnt, 1)
+	nsqLog.LogErrorf("diskqueue(%s) update end with the mismatched type %T: %v", d.readerMetaName, e, e)
+}
+
+// EndTypeMismatchCount returns the times of the end updated with the mismatched type.
+func (d *diskQueueReader) EndTypeMismatchCount() int64 {
+	return atomic.LoadInt64(&d.endMismatchCnt)
+}
+
+func (d *diskQueueReader) observeMsgSize(msgSize int32) {
+	i := 0
+	for i < len(msgSizeBucketBounds) && int64(msgSize) > msgSizeBucketBounds[i] {
+		i++
+	}
+	atomic.AddInt64(&d.msgSizeHist[i], 1)
+}
+
+// GetMsgSizeHistogram returns the message size distribution read by the reader, the upper
+// bound of the last bucket is -1.
+func (d *diskQueueReader) GetMsgSizeHistogram() []MsgSizeBucket {
+	buckets := make([]MsgSizeBucket, msgSizeBucketNum)
+	for i := range buckets {
+		buckets[i].UpperBound = -1
+		if i < len(msgSizeBucketBounds) {
+			buckets[i].UpperBound = msgSizeBucketBounds[i]
+		}
+		buckets[i].Count = atomic.LoadInt64(&d.msgSizeHist[i])
+	}
+	return buckets
+}
+
+// ResyncEnd forces the reader to adopt the end provided by the writer even if it looks the
+// same as the current one, so the reads stalled by the end drifted from the writer can resume.
+func (d *diskQueueReader) ResyncEnd(e BackendQueueEnd) error {
+	end, ok := e.(*diskQueueEndInfo)
+	if !ok || end == nil {
+		return ErrOffsetTypeMismatch
+	}
+	d.Lock()
+	defer d.Unlock()
+	if d.exitFlag == 1 {
+		return ErrExiting
+	}
+	if d.confirmedQueueInfo.EndOffset.GreatThan(&end.EndOffset) ||
+		d.confirmedQueueInfo.Offset() > end.Offset() ||
+		d.confirmedQueueInfo.TotalMsgCnt() > end.TotalMsgCnt() {
+		nsqLog.LogWarningf("diskqueue(%s) resync end %v is behind the confirmed: %v",
+			d.readerMetaName, end, d.confirmedQueueInfo)
+		return ErrResyncEndTooOld
+	}
+	oldEnd := d.queueEndInfo
+	if d.readQueueInfo.EndOffset.GreatThan(&end.EndOffset) || d.readQueueInfo.Offset() > end.Offset() {
+		// the reads beyond the end are not valid, read again from the confirmed
+		d.readQueueInfo = d.confirmedQueueInfo
+	}
+	d.queueEndInfo = *end
+	d.needSync = true
+	d.updateDepth()
+	if d.readFile != nil {
+		d.readFile.Close()
+		d.readFile = nil
+	}
+	d.resetReadBuffer()
+	if end.Offset() > d.confirmedQueueInfo.Offset() {
+		atomic.StoreInt32(&d.waitingMoreData, 0)
+	}
+	nsqLog.Logf("diskqueue(%s) resync the end from %v to %v, read: %v, confirmed: %v",
+		d.readerMetaName, oldEnd, end, d.readQueueInfo, d.confirmedQueueInfo)
+	return nil
 }
 
 func (d *diskQueueReader) Delete() error {
@@ -220,30 +642,54 @@ func (d *diskQueueReader) exit(deleted bool) error {
 	d.Lock()
 	defer d.Unlock()
 
+	if d.exitFlag == 1 {
+		// the exit chan and the watchers have been closed, the meta of the reader closed
+		// concurrently with deleting still needs to be removed.
+		if deleted {
+			d.removeMetaData()
+		}
+		return nil
+	}
 	d.exitFlag = 1
 	close(d.exitChan)
+	for _, ch := range d.confirmWatchers {
+		close(ch)
+	}
+	d.confirmWatchers = nil
 	nsqLog.Logf("diskqueue(%s) exiting ", d.readerMetaName)
 	if d.readFile != nil {
 		d.readFile.Close()
 		d.readFile = nil
 	}
+	if !deleted && d.readQueueInfo.Offset() != d.confirmedQueueInfo.Offset() {
+		// the reads not confirmed are abandoned, only the confirmed will be
+		// persisted so they will be redelivered after restart
+		nsqLog.Logf("diskqueue(%s) abandon the reads not confirmed: %v, confirmed: %v",
+			d.readerMetaName, d.readQueueInfo, d.confirmedQueueInfo)
+		d.readQueueInfo = d.confirmedQueueInfo
+		d.resetReadBuffer()
+	}
 	d.sync()
 	if deleted {
 		d.skipToEndofQueue()
-		err := os.Remove(d.metaDataFileName(false))
-
-		if err != nil && !os.IsNotExist(err) {
-			nsqLog.LogErrorf("diskqueue(%s) failed to remove metadata file - %s", d.readerMetaName, err)
-		}
-		err = os.Remove(d.metaDataFileName(true))
-		if err != nil && !os.IsNotExist(err) {
-			nsqLog.LogErrorf("diskqueue(%s) failed to remove new metadata file - %s", d.readerMetaName, err)
-		}
-		nsqLog.Logf("diskqueue(%s) remove new metadata file - %v", d.readerMetaName, d.metaDataFileName(true))
+		d.removeMetaData()
 	}
 	return nil
 }
 
+func (d *diskQueueReader) removeMetaData() {
+	err := os.Remove(d.metaDataFileName(false))
+
+	if err != nil && !os.IsNotExist(err) {
+		nsqLog.LogErrorf("diskqueue(%s) failed to remove metadata file - %s", d.readerMetaName, err)
+	}
+	err = os.Remove(d.metaDataFileName(true))
+	if err != nil && !os.IsNotExist(err) {
+		nsqLog.LogErrorf("diskqueue(%s) failed to remove new metadata file - %s", d.readerMetaName, err)
+	}
+	nsqLog.Logf("diskqueue(%s) remove new metadata file - %v", d.readerMetaName, d.metaDataFileName(true))
+}
+
 func (d *diskQueueReader) ConfirmRead(offset BackendOffset, cnt int64) error {
 	d.Lock()
 	defer d.Unlock()
@@ -255,22 +701,241 @@ func (d *diskQueueReader) ConfirmRead(offset BackendOffset, cnt int64) error {
 	err := d.internalConfirm(offset, cnt)
 	if oldConfirm != d.confirmedQueueInfo.Offset() {
 		d.needSync = true
-		if d.syncEvery == 1 {
-			d.sync()
-		}
+		d.syncIfNeeded()
+		d.notifyConfirmed()
 	}
 	return err
 }
 
+// ConfirmAllRead confirms all the messages read so far, and returns the new confirmed offset.
+func (d *diskQueueReader) ConfirmAllRead() (BackendOffset, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.exitFlag == 1 {
+		return d.confirmedQueueInfo.Offset(), ErrExiting
+	}
+	oldConfirm := d.confirmedQueueInfo.Offset()
+	err := d.internalConfirm(BackendOffset(-1), 0)
+	if oldConfirm != d.confirmedQueueInfo.Offset() {
+		d.needSync = true
+		d.syncIfNeeded()
+		d.notifyConfirmed()
+	}
+	return d.confirmedQueueInfo.Offset(), err
+}
+
+// ConfirmPastMessageAt confirms past the single message at the confirmed frontier, the message
+// is read to get its size, and the read position is reset to the new confirmed after that.
+func (d *diskQueueReader) ConfirmPastMessageAt(offset BackendOffset) (BackendOffset, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.exitFlag == 1 {
+		return 0, ErrExiting
+	}
+	d.resumeCorruptionHalted()
+	confirmed := d.confirmedQueueInfo.Offset()
+	if offset != confirmed {
+		nsqLog.Logf("reader(%v) confirm past message at %v not the confirmed %v", d.readerMetaName, offset, confirmed)
+		return confirmed, ErrNotConfirmedFrontier
+	}
+	err := d.internalSkipTo(confirmed, d.confirmedQueueInfo.TotalMsgCnt(), false)
+	if err != nil {
+		return confirmed, err
+	}
+	if !d.queueEndInfo.EndOffset.GreatThan(&d.readQueueInfo.EndOffset) {
+		return confirmed, ErrReadEndOfQueue
+	}
+	ret := d.readOne()
+	if ret.Err != nil {
+		nsqLog.LogErrorf("reader(%v) failed to read the message at %v: %v", d.readerMetaName, offset, ret.Err)
+		d.internalSkipTo(confirmed, d.confirmedQueueInfo.TotalMsgCnt(), false)
+		return confirmed, ret.Err
+	}
+	err = d.internalConfirm(ret.Offset+ret.MovedSize, ret.CurCnt)
+	if err != nil {
+		return confirmed, err
+	}
+	nsqLog.Logf("reader(%v) confirmed past the message at %v, new confirmed: %v", d.readerMetaName, offset, d.confirmedQueueInfo)
+	d.needSync = true
+	d.syncIfNeeded()
+	d.notifyConfirmed()
+	return d.confirmedQueueInfo.Offset(), nil
+}
+
+// SkipMessages skips the n messages from the confirmed without delivering them, the new
+// confirmed offset and the number of messages actually skipped are returned. It will stop
+// at the end of the queue if there are less than n messages.
+func (d *diskQueueReader) SkipMessages(n int64) (BackendOffset, int64, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.exitFlag == 1 {
+		return 0, 0, ErrExiting
+	}
+	d.resumeCorruptionHalted()
+	confirmed := d.confirmedQueueInfo.Offset()
+	if n <= 0 {
+		return confirmed, 0, nil
+	}
+	err := d.internalSkipTo(confirmed, d.confirmedQueueInfo.TotalMsgCnt(), false)
+	if err != nil {
+		return confirmed, 0, err
+	}
+	var skipped int64
+	var skipOffset BackendOffset
+	var skipCnt int64
+	// the whole finalized files are skipped by the message count in the offset meta
+	for skipped < n && d.readQueueInfo.EndOffset.FileNum < d.queueEndInfo.EndOffset.FileNum {
+		fileCnt, _, fileEnd, ferr := d.getFileOffsetMeta(d.readQueueInfo.EndOffset.FileNum)
+		left := fileCnt - d.readQueueInfo.TotalMsgCnt()
+		if ferr != nil || left <= 0 || skipped+left > n {
+			break
+		}
+		var next diskQueueEndInfo
+		next.EndOffset.FileNum = d.readQueueInfo.EndOffset.FileNum + 1
+		next.virtualEnd = BackendOffset(fileEnd)
+		next.totalMsgCnt = fileCnt
+		if d.readFile != nil {
+			d.readFile.Close()
+			d.readFile = nil
+		}
+		d.resetReadBuffer()
+		d.readQueueInfo = next
+		skipOffset = next.Offset()
+		skipCnt = next.TotalMsgCnt()
+		skipped += left
+	}
+	for skipped < n && d.queueEndInfo.EndOffset.GreatThan(&d.readQueueInfo.EndOffset) {
+		ret := d.readOne()
+		if ret.Err != nil {
+			nsqLog.LogErrorf("reader(%v) failed to read the message at %v while skipping: %v",
+				d.readerMetaName, d.readQueueInfo, ret.Err)
+			err = ret.Err
+			break
+		}
+		skipOffset = ret.Offset + ret.MovedSize
+		skipCnt = ret.CurCnt
+		skipped++
+	}
+	if skipped == 0 {
+		d.internalSkipTo(confirmed, d.confirmedQueueInfo.TotalMsgCnt(), false)
+		return confirmed, 0, err
+	}
+	cerr := d.internalConfirm(skipOffset, skipCnt)
+	if cerr != nil {
+		d.internalSkipTo(confirmed, d.confirmedQueueInfo.TotalMsgCnt(), false)
+		return confirmed, 0, cerr
+	}
+	if err != nil {
+		// the read position may be in the middle of the bad data
+		d.internalSkipTo(d.confirmedQueueInfo.Offset(), d.confirmedQueueInfo.TotalMsgCnt(), false)
+	}
+	nsqLog.Logf("reader(%v) skipped %v of %v messages from %v, new confirmed: %v",
+		d.readerMetaName, skipped, n, confirmed, d.confirmedQueueInfo)
+	d.needSync = true
+	d.syncIfNeeded()
+	d.notifyConfirmed()
+	return d.confirmedQueueInfo.Offset(), skipped, err
+}
+
+// WatchConfirmed returns the channel receiving the new confirmed offset while changed. The watcher
+// will only get the latest one if it is slow to receive, and the channel is closed while the reader exits.
+func (d *diskQueueReader) WatchConfirmed() <-chan BackendOffset {
+	ch := make(chan BackendOffset, 1)
+	d.Lock()
+	if d.exitFlag == 1 {
+		close(ch)
+	} else {
+		d.confirmWatchers = append(d.confirmWatchers, ch)
+	}
+	d.Unlock()
+	return ch
+}
+
+// UnwatchConfirmed stops notifying the watcher, the channel is not closed.
+func (d *diskQueueReader) UnwatchConfirmed(ch <-chan BackendOffset) {
+	d.Lock()
+	for i, w := range d.confirmWatchers {
+		if w == ch {
+			d.confirmWatchers = append(d.confirmWatchers[:i], d.confirmWatchers[i+1:]...)
+			break
+		}
+	}
+	d.Unlock()
+}
+
+// should be protected by the lock, it never blocks on the slow watchers
+func (d *diskQueueReader) notifyConfirmed() {
+	confirmed := d.confirmedQueueInfo.Offset()
+	for _, ch := range d.confirmWatchers {
+		select {
+		case ch <- confirmed:
+		default:
+			// coalesce to the latest since the old one is not received yet
+			select {
+			case <-ch:
+			default:
+			}
+			select {
+			case ch <- confirmed:
+			default:
+			}
+		}
+	}
+}
+
 func (d *diskQueueReader) Flush() {
 	d.Lock()
 	defer d.Unlock()
 	if d.exitFlag == 1 {
 		return
 	}
+	syncTimeout := atomic.LoadInt64(&d.syncTimeout)
+	if syncTimeout > 0 && time.Now().UnixNano()-d.lastSyncTs < syncTimeout {
+		return
+	}
 	d.internalUpdateEnd(nil, false)
 }
 
+// the syncEvery less than 1 is the same as 1, and the default is used for the non-positive
+// syncTimeout, the same as the node-wide options.
+func normalizeSyncPolicy(syncEvery int64, syncTimeout time.Duration) (int64, time.Duration) {
+	if syncEvery < 1 {
+		syncEvery = 1
+	}
+	if syncTimeout <= 0 {
+		syncTimeout = defaultSyncTimeout
+	}
+	return syncEvery, syncTimeout
+}
+
+// SetSyncPolicy changes the meta sync cadence at runtime,
+// the default is used for the invalid values.
+func (d *diskQueueReader) SetSyncPolicy(syncEvery int64, syncTimeout time.Duration) {
+	syncEvery, syncTimeout = normalizeSyncPolicy(syncEvery, syncTimeout)
+	atomic.StoreInt64(&d.syncEvery, syncEvery)
+	atomic.StoreInt64(&d.syncTimeout, int64(syncTimeout))
+}
+
+// IsDegraded returns true if the meta of the reader can not be persisted for a while.
+func (d *diskQueueReader) IsDegraded() bool {
+	return atomic.LoadInt32(&d.degraded) == 1
+}
+
+func (d *diskQueueReader) GetSyncPolicy() (int64, time.Duration) {
+	return atomic.LoadInt64(&d.syncEvery), time.Duration(atomic.LoadInt64(&d.syncTimeout))
+}
+
+// should be protected by the lock
+func (d *diskQueueReader) syncIfNeeded() {
+	d.syncCnt++
+	if d.syncCnt >= atomic.LoadInt64(&d.syncEvery) {
+		d.sync()
+	}
+}
+
 func (d *diskQueueReader) ResetReadToConfirmed() (BackendQueueEnd, error) {
 	d.Lock()
 	defer d.Unlock()
@@ -282,9 +947,8 @@ func (d *diskQueueReader) ResetReadToConfirmed() (BackendQueueEnd, error) {
 	if skiperr == nil {
 		if old != d.confirmedQueueInfo.Offset() {
 			d.needSync = true
-			if d.syncEvery == 1 {
-				d.sync()
-			}
+			d.syncIfNeeded()
+			d.notifyConfirmed()
 		}
 	}
 
@@ -299,11 +963,12 @@ func (d *diskQueueReader) ResetReadToOffset(offset BackendOffset, cnt int64) (Ba
 	if d.exitFlag == 1 {
 		return nil, ErrExiting
 	}
+	d.resumeCorruptionHalted()
 	if d.readFile != nil {
 		d.readFile.Close()
 		d.readFile = nil
 	}
-	d.readBuffer.Reset()
+	d.resetReadBuffer()
 
 	old := d.confirmedQueueInfo.Offset()
 	nsqLog.Infof("reset from: %v, %v to: %v:%v", d.readQueueInfo, d.confirmedQueueInfo, offset, cnt)
@@ -312,6 +977,7 @@ func (d *diskQueueReader) ResetReadToOffset(offset BackendOffset, cnt int64) (Ba
 		if old != d.confirmedQueueInfo.Offset() {
 			d.needSync = true
 			d.sync()
+			d.notifyConfirmed()
 		}
 	}
 
@@ -323,6 +989,9 @@ func (d *diskQueueReader) ResetReadToOffset(offset BackendOffset, cnt int64) (Ba
 func (d *diskQueueReader) ResetLastReadOne(offset BackendOffset, cnt int64, lastMoved int32) {
 	d.Lock()
 	defer d.Unlock()
+	if d.exitFlag == 1 {
+		return
+	}
 	if d.readFile != nil {
 		d.readFile.Close()
 		d.readFile = nil
@@ -330,9 +999,17 @@ func (d *diskQueueReader) ResetLastReadOne(offset BackendOffset, cnt int64, last
 	if d.readQueueInfo.EndOffset.Pos < int64(lastMoved) {
 		return
 	}
-	d.readBuffer.Reset()
+	d.resetReadBuffer()
 	d.readQueueInfo.EndOffset.Pos -= int64(lastMoved)
 	d.readQueueInfo.virtualEnd = offset
+	// the last one is not delivered, so it will not be counted as an attempt
+	if cnt, ok := d.readAttempts[offset]; ok {
+		if cnt <= 1 {
+			delete(d.readAttempts, offset)
+		} else {
+			d.readAttempts[offset] = cnt - 1
+		}
+	}
 	if cnt > 0 || (offset == 0 && cnt == 0) {
 		atomic.StoreInt64(&d.readQueueInfo.totalMsgCnt, cnt)
 	}
@@ -344,45 +1021,211 @@ func (d *diskQueueReader) SkipReadToOffset(offset BackendOffset, cnt int64) (Bac
 	if d.exitFlag == 1 {
 		return nil, ErrExiting
 	}
+	d.resumeCorruptionHalted()
 	old := d.confirmedQueueInfo.Offset()
 	skiperr := d.internalSkipTo(offset, cnt, false)
 	if skiperr == nil {
 		if old != d.confirmedQueueInfo.Offset() {
 			d.needSync = true
-			if d.syncEvery == 1 {
-				d.sync()
+			d.syncIfNeeded()
+			d.notifyConfirmed()
+		}
+	}
+
+	e := d.confirmedQueueInfo
+	return &e, skiperr
+}
+
+func (d *diskQueueReader) SkipReadToEnd() (BackendQueueEnd, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.exitFlag == 1 {
+		return nil, ErrExiting
+	}
+	d.resumeCorruptionHalted()
+	old := d.confirmedQueueInfo.Offset()
+	skiperr := d.internalSkipTo(d.queueEndInfo.Offset(), d.queueEndInfo.TotalMsgCnt(), false)
+	if skiperr == nil {
+		// it may offset unchanged but the queue end file skip to next
+		// so we need to change all to end.
+		d.confirmedQueueInfo = d.queueEndInfo
+		d.readQueueInfo = d.queueEndInfo
+		if old != d.confirmedQueueInfo.Offset() {
+			d.needSync = true
+			d.syncIfNeeded()
+			d.notifyConfirmed()
+		}
+	}
+
+	e := d.confirmedQueueInfo
+	return &e, skiperr
+}
+
+// GetQueueStart returns the start of the oldest data file still retained.
+func (d *diskQueueReader) GetQueueStart() (BackendQueueEnd, error) {
+	d.RLock()
+	defer d.RUnlock()
+	start, err := d.findQueueStart()
+	if err != nil {
+		return nil, err
+	}
+	return &start, nil
+}
+
+// reset both the read and confirmed to the oldest data file, which is used to
+// replay all the retained data.
+func (d *diskQueueReader) ResetReadToStart() (BackendQueueEnd, error) {
+	d.Lock()
+	defer d.Unlock()
+	if d.exitFlag == 1 {
+		return nil, ErrExiting
+	}
+	d.resumeCorruptionHalted()
+	start, err := d.findQueueStart()
+	if err != nil {
+		nsqLog.LogErrorf("failed to find the queue start: %v", err)
+		return nil, err
+	}
+	d.resetReadToFileStart(start)
+	e := d.confirmedQueueInfo
+	return &e, nil
+}
+
+// GetFileStart returns the start of the data file, the file should be in the queue.
+func (d *diskQueueReader) GetFileStart(fileNum int64) (BackendQueueEnd, error) {
+	d.RLock()
+	defer d.RUnlock()
+	start, err := d.getFileStart(fileNum)
+	if err != nil {
+		return nil, err
+	}
+	return &start, nil
+}
+
+// reset both the read and confirmed to the beginning of the data file
+// regardless of the confirmed, which is used for debugging.
+func (d *diskQueueReader) ResetReadToFile(fileNum int64) (BackendQueueEnd, error) {
+	d.Lock()
+	defer d.Unlock()
+	if d.exitFlag == 1 {
+		return nil, ErrExiting
+	}
+	d.resumeCorruptionHalted()
+	start, err := d.getFileStart(fileNum)
+	if err != nil {
+		nsqLog.LogErrorf("failed to get the start of file %v: %v", fileNum, err)
+		if err == ErrReadQueueAlreadyCleaned {
+			if base, berr := d.getRetainedBase(); berr == nil && fileNum < base.EndOffset.FileNum {
+				return nil, ErrOffsetGarbageCollected
 			}
 		}
+		return nil, err
+	}
+	d.resetReadToFileStart(start)
+	e := d.confirmedQueueInfo
+	return &e, nil
+}
+
+// should be protected by the lock
+func (d *diskQueueReader) resetReadToFileStart(start diskQueueEndInfo) {
+	if d.readFile != nil {
+		d.readFile.Close()
+		d.readFile = nil
+	}
+	d.resetReadBuffer()
+
+	nsqLog.Infof("reset from: %v, %v to file start: %v", d.readQueueInfo, d.confirmedQueueInfo, start)
+	d.readQueueInfo = start
+	d.confirmedQueueInfo = start
+	// the replay is a new round of delivery
+	d.resetReadAttempts()
+	d.maxReadOffset = start.Offset()
+	d.redeliverEnd = 0
+	d.updateDepth()
+	d.needSync = true
+	d.sync()
+	d.notifyConfirmed()
+}
+
+// the virtual offset of the file start is the end of the previous file in the offset meta,
+// if the offset meta is missing, we walk the files from the first to count it.
+func (d *diskQueueReader) getFileStart(fileNum int64) (diskQueueEndInfo, error) {
+	var start diskQueueEndInfo
+	if fileNum < 0 || fileNum > d.queueEndInfo.EndOffset.FileNum {
+		return start, ErrMoveOffsetInvalid
+	}
+	if _, err := os.Stat(d.dataFileName(fileNum)); err != nil {
+		if os.IsNotExist(err) {
+			return start, ErrReadQueueAlreadyCleaned
+		}
+		return start, err
+	}
+	start.EndOffset.FileNum = fileNum
+	if fileNum == 0 {
+		return start, nil
+	}
+	cnt, _, endPos, err := d.getFileOffsetMeta(fileNum - 1)
+	if err == nil {
+		start.virtualEnd = BackendOffset(endPos)
+		start.totalMsgCnt = cnt
+		return start, nil
+	}
+	if !os.IsNotExist(err) {
+		return start, err
+	}
+	for i := int64(0); i < fileNum; i++ {
+		size, msgCnt, err := d.countFileMessages(i)
+		if err != nil {
+			nsqLog.LogErrorf("failed to walk the data file %v: %v", i, err)
+			return start, err
+		}
+		start.virtualEnd += BackendOffset(size)
+		start.totalMsgCnt += msgCnt
 	}
-
-	e := d.confirmedQueueInfo
-	return &e, skiperr
+	return start, nil
 }
 
-func (d *diskQueueReader) SkipReadToEnd() (BackendQueueEnd, error) {
-	d.Lock()
-	defer d.Unlock()
-
-	if d.exitFlag == 1 {
-		return nil, ErrExiting
+// count the messages by walking the size header of each message
+func (d *diskQueueReader) countFileMessages(fileNum int64) (int64, int64, error) {
+	size, cnt, err := d.scanFileMessages(fileNum)
+	if err != nil {
+		return 0, 0, err
 	}
-	old := d.confirmedQueueInfo.Offset()
-	skiperr := d.internalSkipTo(d.queueEndInfo.Offset(), d.queueEndInfo.TotalMsgCnt(), false)
-	if skiperr == nil {
-		// it may offset unchanged but the queue end file skip to next
-		// so we need to change all to end.
-		d.confirmedQueueInfo = d.queueEndInfo
-		d.readQueueInfo = d.queueEndInfo
-		if old != d.confirmedQueueInfo.Offset() {
-			d.needSync = true
-			if d.syncEvery == 1 {
-				d.sync()
+	return size, cnt, nil
+}
+
+// the earlier data files may be cleaned, so we walk from the first file to find
+// the oldest one, and the virtual offset of it is the end of the previous file in the offset meta.
+func (d *diskQueueReader) findQueueStart() (diskQueueEndInfo, error) {
+	var start diskQueueEndInfo
+	for fileNum := int64(0); fileNum <= d.queueEndInfo.EndOffset.FileNum; fileNum++ {
+		_, err := os.Stat(d.dataFileName(fileNum))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
 			}
+			return start, err
 		}
+		start.EndOffset.FileNum = fileNum
+		start.EndOffset.Pos = 0
+		if fileNum == 0 {
+			return start, nil
+		}
+		cnt, _, endPos, err := d.getFileOffsetMeta(fileNum - 1)
+		if err != nil {
+			if os.IsNotExist(err) {
+				nsqLog.Logf("offset meta of the segment before %v not exist, try next", fileNum)
+				continue
+			}
+			return start, err
+		}
+		start.virtualEnd = BackendOffset(endPos)
+		start.totalMsgCnt = cnt
+		return start, nil
 	}
-
-	e := d.confirmedQueueInfo
-	return &e, skiperr
+	// all the data files are cleaned
+	return d.queueEndInfo, nil
 }
 
 func (d *diskQueueReader) IsWaitingMoreData() bool {
@@ -396,6 +1239,7 @@ func (d *diskQueueReader) SkipToNext() (BackendQueueEnd, error) {
 	if d.exitFlag == 1 {
 		return nil, ErrExiting
 	}
+	d.resumeCorruptionHalted()
 	err := d.skipToNextFile()
 	if err != nil {
 		return nil, err
@@ -407,17 +1251,122 @@ func (d *diskQueueReader) SkipToNext() (BackendQueueEnd, error) {
 func (d *diskQueueReader) TryReadOne() (ReadResult, bool) {
 	d.Lock()
 	defer d.Unlock()
+	return d.internalTryReadOne()
+}
+
+// TryReadOnePooled is the same as TryReadOne but the data is read into the buffer from the pool.
+// The caller owns the data until it is returned by ReleaseReadData, and it should be copied if
+// it will be used after released.
+func (d *diskQueueReader) TryReadOnePooled() (ReadResult, bool) {
+	d.Lock()
+	defer d.Unlock()
+	return d.internalTryReadOneInto(true)
+}
+
+// ReadBatch reads at most maxCount messages. If maxBytes is positive, the read stops before the
+// message which will make the total data size exceed the maxBytes, and the message will be read
+// next time. At least one message will be returned if there is any data to read. The read will
+// stop at the first message with any error, and the error message will be the last one in the batch.
+func (d *diskQueueReader) ReadBatch(maxCount int, maxBytes int64) []ReadResult {
+	d.Lock()
+	defer d.Unlock()
+	var rets []ReadResult
+	totalBytes := int64(0)
+	for len(rets) < maxCount {
+		if maxBytes > 0 && len(rets) > 0 && totalBytes >= maxBytes {
+			break
+		}
+		lastRead := d.readQueueInfo
+		ret, ok := d.internalTryReadOne()
+		if !ok {
+			break
+		}
+		if maxBytes > 0 && len(rets) > 0 && ret.Err == nil && totalBytes+int64(len(ret.Data)) > maxBytes &&
+			ret.Offset == lastRead.Offset() {
+			// put back the message exceeding the budget for the next read
+			d.unreadLastOne(lastRead, ret.Offset)
+			break
+		}
+		rets = append(rets, ret)
+		if ret.Err != nil {
+			break
+		}
+		totalBytes += int64(len(ret.Data))
+	}
+	return rets
+}
+
+func (d *diskQueueReader) unreadLastOne(lastRead diskQueueEndInfo, offset BackendOffset) {
+	if d.readFile != nil {
+		d.readFile.Close()
+		d.readFile = nil
+	}
+	d.resetReadBuffer()
+	d.readQueueInfo = lastRead
+	if cnt, ok := d.readAttempts[offset]; ok {
+		if cnt <= 1 {
+			delete(d.readAttempts, offset)
+		} else {
+			d.readAttempts[offset] = cnt - 1
+		}
+	}
+}
+
+func (d *diskQueueReader) internalTryReadOne() (ReadResult, bool) {
+	return d.internalTryReadOneInto(false)
+}
+
+func (d *diskQueueReader) internalTryReadOneInto(pooled bool) (ReadResult, bool) {
 	for {
+		// the read file should not be reopened after exited
+		if d.exitFlag == 1 || d.IsCorruptionHalted() {
+			return ReadResult{}, false
+		}
 		if d.queueEndInfo.EndOffset.GreatThan(&d.readQueueInfo.EndOffset) {
-			dataRead := d.readOne()
+			if d.openRetryUntil > 0 && time.Now().UnixNano() < d.openRetryUntil {
+				// wait the data file to be readable again, the unavailable is returned so the
+				// caller retries later instead of waiting the queue end updated
+				return ReadResult{Offset: d.readQueueInfo.Offset(), Err: ErrReadFileUnavailable}, true
+			}
+			prevRead := d.readQueueInfo
+			dataRead := d.readOneInto(pooled)
+			atomic.StoreInt64(&d.bufferedBytes, int64(d.readBuffer.Len()))
 			rerr := dataRead.Err
+			if rerr == nil && !d.checkReadOrder(prevRead, dataRead) {
+				return ReadResult{Offset: prevRead.Offset(), Err: ErrReadOutOfOrder}, true
+			}
+			if rerr == nil {
+				d.recordFirstRead()
+				if d.filterDelivery(dataRead, pooled) {
+					continue
+				}
+				dataRead.Attempts = d.incrReadAttempts(dataRead.Offset)
+				d.trackConfirmDeadline(prevRead, dataRead.Offset)
+			}
+			if rerr == ErrReadFileUnavailable {
+				d.backoffReadOpen()
+				return dataRead, true
+			}
+			d.openFailCnt = 0
+			d.openRetryUntil = 0
 			if rerr != nil {
-				nsqLog.LogErrorf("reading from diskqueue(%s) at %d of %s - %s, current end: %v",
-					d.readerMetaName, d.readQueueInfo, d.fileName(d.readQueueInfo.EndOffset.FileNum), dataRead.Err, d.queueEndInfo)
-				if rerr != ErrReadQueueCountMissing && d.autoSkipError {
-					d.handleReadError()
+				d.logReadError(rerr)
+				if rerr != ErrReadQueueCountMissing && atomic.LoadInt32(&d.autoSkipError) == 1 {
+					atomic.AddInt64(&d.corruptSkipCnt, 1)
+					d.handleCorruption()
+					d.corruptLog.quiet = false
+					if d.IsCorruptionHalted() {
+						return dataRead, true
+					}
 					continue
 				}
+				// the buffered data may be consumed partially, so read again from the file
+				// at the read position next time
+				if d.readFile != nil {
+					d.readFile.Close()
+					d.readFile = nil
+				}
+				d.resetReadBuffer()
 			}
 			return dataRead, true
 		} else {
@@ -430,24 +1379,177 @@ func (d *diskQueueReader) TryReadOne() (ReadResult, bool) {
 	}
 }
 
-func (d *diskQueueReader) updateDepth() {
-	newDepth := int64(0)
-	if d.confirmedQueueInfo.EndOffset.FileNum > d.queueEndInfo.EndOffset.FileNum {
-		atomic.StoreInt64(&d.depth, 0)
-		atomic.StoreInt64(&d.depthSize, 0)
-	} else {
-		newDepthSize := int64(d.queueEndInfo.Offset() - d.confirmedQueueInfo.Offset())
-		atomic.StoreInt64(&d.depthSize, newDepthSize)
-		newDepth = int64(d.queueEndInfo.TotalMsgCnt() - d.confirmedQueueInfo.TotalMsgCnt())
-		atomic.StoreInt64(&d.depth, newDepth)
-		if newDepthSize == 0 {
-			if newDepth != 0 {
-				nsqLog.Warningf("the confirmed info conflict with queue end: %v, %v", d.confirmedQueueInfo, d.queueEndInfo)
-				d.confirmedQueueInfo = d.queueEndInfo
-			}
-			newDepth = 0
+// the permission or transient open errors can be fixed without losing the data,
+// so they should not be handled as the corruption.
+func isTransientOpenError(err error) bool {
+	if os.IsPermission(err) {
+		return true
+	}
+	if pe, ok := err.(*os.PathError); ok {
+		switch pe.Err {
+		case syscall.EMFILE, syscall.ENFILE, syscall.EINTR, syscall.EAGAIN:
+			return true
 		}
 	}
+	return false
+}
+
+func (d *diskQueueReader) backoffReadOpen() {
+	d.openFailCnt++
+	backoff := d.openRetryBackoff
+	if backoff <= 0 {
+		backoff = readOpenRetryBackoff
+	}
+	for i := int64(1); i < d.openFailCnt && backoff < maxReadOpenRetryBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxReadOpenRetryBackoff {
+		backoff = maxReadOpenRetryBackoff
+	}
+	d.openRetryUntil = time.Now().UnixNano() + int64(backoff)
+	nsqLog.LogErrorf("diskqueue(%s) data file at %v unavailable %v times, retry after %v",
+		d.readerMetaName, d.readQueueInfo, d.openFailCnt, backoff)
+}
+
+// GetBufferedBytes returns the data size buffered in memory but not read yet, and the read
+// results staged or prefetched but not delivered yet.
+func (d *diskQueueReader) GetBufferedBytes() int64 {
+	return atomic.LoadInt64(&d.bufferedBytes) + atomic.LoadInt64(&d.stagedBytes)
+}
+
+// SetStagedBytes updates the data size of the read results held by the consumer of the reader
+// but not delivered yet.
+func (d *diskQueueReader) SetStagedBytes(n int64) {
+	atomic.StoreInt64(&d.stagedBytes, n)
+}
+
+func (d *diskQueueReader) resetReadBuffer() {
+	d.readBuffer.Reset()
+	atomic.StoreInt64(&d.bufferedBytes, 0)
+}
+
+// SetClampOverConfirm changes the policy for the confirm exceed the read position,
+// it will be clamped to the read position with warning if enabled, otherwise rejected.
+func (d *diskQueueReader) SetClampOverConfirm(enable bool) {
+	if enable {
+		atomic.StoreInt32(&d.clampOverConfirm, 1)
+	} else {
+		atomic.StoreInt32(&d.clampOverConfirm, 0)
+	}
+}
+
+// SetStrictConfirm changes the policy for the confirm not after the confirmed offset, it is
+// rejected with ErrConfirmRegression and counted if enabled, otherwise ignored silently.
+// The confirmed offset is never moved backward in both cases.
+func (d *diskQueueReader) SetStrictConfirm(enable bool) {
+	if enable {
+		atomic.StoreInt32(&d.strictConfirm, 1)
+	} else {
+		atomic.StoreInt32(&d.strictConfirm, 0)
+	}
+}
+
+// ConfirmRegressedCount returns the times of the confirm rejected by the strict confirm.
+func (d *diskQueueReader) ConfirmRegressedCount() int64 {
+	return atomic.LoadInt64(&d.confirmRegressed)
+}
+
+// SetAutoSkipError changes whether the corrupt data is handled by the corruption policy while
+// read, otherwise the read error is returned and the read stays at the corrupt data. It can be
+// enabled temporarily to get past the known corrupt data.
+func (d *diskQueueReader) SetAutoSkipError(enable bool) {
+	if enable {
+		atomic.StoreInt32(&d.autoSkipError, 1)
+	} else {
+		atomic.StoreInt32(&d.autoSkipError, 0)
+	}
+}
+
+// SetParseMsgHeader enables parsing the message id, timestamp and attempts
+// into the read result, so the consumer can use them without decoding the data.
+func (d *diskQueueReader) SetParseMsgHeader(enable bool) {
+	if enable {
+		atomic.StoreInt32(&d.parseMsgHeader, 1)
+	} else {
+		atomic.StoreInt32(&d.parseMsgHeader, 0)
+	}
+}
+
+// the header fields will be left zero if the data is not a standard message
+func parseReadMsgHeader(result *ReadResult) {
+	if len(result.Data) < minValidMsgLength {
+		return
+	}
+	ts := int64(binary.BigEndian.Uint64(result.Data[:8]))
+	attempts := binary.BigEndian.Uint16(result.Data[8:10])
+	if attempts > maxAttempts {
+		// the high 4-bits may be reused for the message version
+		attempts = attempts & uint16(0x0FFF)
+	}
+	if ts <= 0 || attempts > maxAttempts {
+		return
+	}
+	result.MsgTimestamp = ts
+	result.MsgAttempts = attempts
+	result.MsgID = MessageID(binary.BigEndian.Uint64(result.Data[10:18]))
+}
+
+// should be protected by the lock
+func (d *diskQueueReader) incrReadAttempts(offset BackendOffset) int32 {
+	if offset >= d.maxReadOffset {
+		d.maxReadOffset = offset + 1
+	}
+	cnt, ok := d.readAttempts[offset]
+	if !ok && offset < d.redeliverEnd {
+		// the offset may be delivered before restart but not confirmed
+		cnt = 1
+	}
+	cnt++
+	if ok {
+		d.readAttempts[offset] = cnt
+	} else if len(d.readAttempts) < maxTrackedAttempts {
+		d.readAttempts[offset] = cnt
+		heap.Push(&d.attemptOffsets, offset)
+	}
+	return cnt
+}
+
+// should be protected by the lock
+func (d *diskQueueReader) resetReadAttempts() {
+	d.readAttempts = make(map[BackendOffset]int32)
+	d.attemptOffsets = nil
+}
+
+// should be protected by the lock
+func (d *diskQueueReader) cleanConfirmedAttempts() {
+	confirmed := d.confirmedQueueInfo.Offset()
+	// the offset removed from the attempts may be left in the heap, and it is dropped here
+	for len(d.attemptOffsets) > 0 && d.attemptOffsets[0] < confirmed {
+		delete(d.readAttempts, heap.Pop(&d.attemptOffsets).(BackendOffset))
+	}
+	if d.redeliverEnd <= confirmed {
+		d.redeliverEnd = 0
+	}
+}
+
+func (d *diskQueueReader) updateDepth() {
+	// the depth size is always the virtual distance between the end and confirmed,
+	// and the confirmed past the end should be treated as no depth.
+	newDepthSize := int64(d.queueEndInfo.Offset() - d.confirmedQueueInfo.Offset())
+	newDepth := d.queueEndInfo.TotalMsgCnt() - d.confirmedQueueInfo.TotalMsgCnt()
+	if newDepthSize == 0 && newDepth != 0 &&
+		!d.confirmedQueueInfo.EndOffset.GreatThan(&d.queueEndInfo.EndOffset) {
+		nsqLog.Warningf("the confirmed info conflict with queue end: %v, %v", d.confirmedQueueInfo, d.queueEndInfo)
+		d.confirmedQueueInfo = d.queueEndInfo
+	}
+	if newDepthSize <= 0 || d.confirmedQueueInfo.EndOffset.GreatThan(&d.queueEndInfo.EndOffset) {
+		newDepthSize = 0
+		newDepth = 0
+	} else if newDepth < 0 {
+		newDepth = 0
+	}
+	atomic.StoreInt64(&d.depthSize, newDepthSize)
+	atomic.StoreInt64(&d.depth, newDepth)
 	if newDepth == 0 {
 		atomic.StoreInt32(&d.waitingMoreData, 1)
 	}
@@ -465,6 +1567,9 @@ func (d *diskQueueReader) getVirtualOffsetDistance(prev diskQueueOffset, next di
 
 	fsize, err := d.getCurrentFileEnd(prev)
 	if err != nil {
+		if os.IsNotExist(err) {
+			return BackendOffset(diff), ErrOffsetGarbageCollected
+		}
 		return BackendOffset(diff), err
 	}
 	left := fsize - prev.Pos
@@ -475,7 +1580,7 @@ func (d *diskQueueReader) getVirtualOffsetDistance(prev diskQueueOffset, next di
 	return BackendOffset(int64(vdiff) + left), err
 }
 
-func stepOffset(dataRoot string, readFrom string, cur diskQueueEndInfo, step BackendOffset, maxStep diskQueueEndInfo) (diskQueueOffset, error) {
+func stepOffset(dataRoot string, coldPath string, readFrom string, headerLen int64, cur diskQueueEndInfo, step BackendOffset, maxStep diskQueueEndInfo) (diskQueueOffset, error) {
 	newOffset := cur
 	var err error
 	if cur.EndOffset.FileNum > maxStep.EndOffset.FileNum {
@@ -507,7 +1612,7 @@ func stepOffset(dataRoot string, readFrom string, cur diskQueueEndInfo, step Bac
 				return newOffset.EndOffset, ErrMoveOffsetInvalid
 			}
 			var f os.FileInfo
-			f, err = os.Stat(GetQueueFileName(dataRoot, readFrom, newOffset.EndOffset.FileNum))
+			f, err = statResolvedQueueFile(dataRoot, coldPath, readFrom, newOffset.EndOffset.FileNum)
 			if err != nil {
 				nsqLog.LogErrorf("stat data file error %v, %v: %v", step, newOffset, err)
 				if os.IsNotExist(err) {
@@ -515,7 +1620,7 @@ func stepOffset(dataRoot string, readFrom string, cur diskQueueEndInfo, step Bac
 				}
 				return newOffset.EndOffset, err
 			}
-			newOffset.EndOffset.Pos = f.Size()
+			newOffset.EndOffset.Pos = getQueueFileDataSize(f.Size(), headerLen)
 		}
 		newOffset.EndOffset.Pos -= int64(step)
 		return newOffset.EndOffset, nil
@@ -523,7 +1628,7 @@ func stepOffset(dataRoot string, readFrom string, cur diskQueueEndInfo, step Bac
 	for {
 		end := int64(0)
 		if cur.EndOffset.FileNum < maxStep.EndOffset.FileNum {
-			end, err = getQueueSegmentEnd(dataRoot, readFrom, newOffset.EndOffset)
+			end, err = getQueueSegmentEnd(dataRoot, coldPath, readFrom, headerLen, newOffset.EndOffset)
 			if err != nil {
 				return newOffset.EndOffset, err
 			}
@@ -561,12 +1666,28 @@ func (d *diskQueueReader) internalConfirm(offset BackendOffset, cnt int64) error
 		return nil
 	}
 	if offset <= d.confirmedQueueInfo.Offset() {
+		if atomic.LoadInt32(&d.strictConfirm) == 1 {
+			atomic.AddInt64(&d.confirmRegressed, 1)
+			nsqLog.LogErrorf("diskqueue(%s) confirm regression: %v:%v, confirmed: %v",
+				d.readerMetaName, offset, cnt, d.confirmedQueueInfo)
+			return ErrConfirmRegression
+		}
 		nsqLog.LogDebugf("already confirmed to : %v", d.confirmedQueueInfo.Offset())
 		return nil
 	}
 	if offset > d.readQueueInfo.Offset() {
-		nsqLog.LogErrorf("confirm exceed read: %v, %v", offset, d.readQueueInfo.Offset())
-		return ErrConfirmSizeInvalid
+		if atomic.LoadInt32(&d.clampOverConfirm) != 1 {
+			nsqLog.LogErrorf("confirm exceed read: %v, %v", offset, d.readQueueInfo.Offset())
+			return ErrConfirmSizeInvalid
+		}
+		now := time.Now().UnixNano()
+		if now-d.lastOverConfirmWarn >= int64(overConfirmWarnInterval) {
+			d.lastOverConfirmWarn = now
+			nsqLog.LogWarningf("diskqueue(%s) confirm exceed read: %v:%v, clamp to read: %v",
+				d.readerMetaName, offset, cnt, d.readQueueInfo)
+		}
+		offset = d.readQueueInfo.Offset()
+		cnt = d.readQueueInfo.TotalMsgCnt()
 	}
 	if offset == d.readQueueInfo.Offset() {
 		if cnt == 0 {
@@ -581,9 +1702,14 @@ func (d *diskQueueReader) internalConfirm(offset BackendOffset, cnt int64) error
 		nsqLog.LogErrorf("confirm read count invalid: %v:%v, %v", offset, cnt, d.readQueueInfo)
 		return ErrConfirmCntInvalid
 	}
+	if atomic.LoadInt32(&d.confirmBoundaryCheck) == 1 && !d.isMessageBoundary(offset) {
+		nsqLog.LogErrorf("diskqueue(%s) confirm offset not at the message boundary: %v:%v, confirmed: %v",
+			d.readerMetaName, offset, cnt, d.confirmedQueueInfo)
+		return ErrConfirmNotBoundary
+	}
 
 	diffVirtual := offset - d.confirmedQueueInfo.Offset()
-	newConfirm, err := stepOffset(d.dataPath, d.readFrom,
+	newConfirm, err := stepOffset(d.dataPath, d.coldPath, d.readFrom, d.getFileHeaderLen(),
 		d.confirmedQueueInfo, diffVirtual, d.readQueueInfo)
 	if err != nil {
 		nsqLog.LogErrorf("confirmed exceed the read pos: %v, %v", offset, d.readQueueInfo.Offset())
@@ -597,6 +1723,9 @@ func (d *diskQueueReader) internalConfirm(offset BackendOffset, cnt int64) error
 	d.confirmedQueueInfo.virtualEnd = offset
 	atomic.StoreInt64(&d.confirmedQueueInfo.totalMsgCnt, cnt)
 	d.updateDepth()
+	d.cleanConfirmedAttempts()
+	d.cleanConfirmedDeadlines()
+	d.confirmSkipped()
 	nsqLog.LogDebugf("confirmed to offset: %v:%v", offset, cnt)
 	return nil
 }
@@ -615,7 +1744,7 @@ func (d *diskQueueReader) internalSkipTo(voffset BackendOffset, cnt int64, backT
 		d.readFile.Close()
 		d.readFile = nil
 	}
-	d.readBuffer.Reset()
+	d.resetReadBuffer()
 
 	if voffset == d.confirmedQueueInfo.Offset() {
 		if cnt != 0 && d.confirmedQueueInfo.TotalMsgCnt() != cnt {
@@ -631,6 +1760,10 @@ func (d *diskQueueReader) internalSkipTo(voffset BackendOffset, cnt int64, backT
 	var err error
 	if voffset < d.confirmedQueueInfo.Offset() {
 		nsqLog.Logf("skip backward to less than confirmed: %v, %v", voffset, d.confirmedQueueInfo.Offset())
+		// the data before confirmed may have been cleaned even if nothing left to read
+		if err = d.checkRetained(voffset); err != nil {
+			return err
+		}
 		if !backToConfirmed {
 			return ErrMoveOffsetInvalid
 		}
@@ -653,8 +1786,24 @@ func (d *diskQueueReader) internalSkipTo(voffset BackendOffset, cnt int64, backT
 			return ErrMoveOffsetInvalid
 		}
 
-		newPos, err = stepOffset(d.dataPath, d.readFrom, d.readQueueInfo,
-			voffset-d.readQueueInfo.Offset(), d.queueEndInfo)
+		// the virtual offsets are absolute, translate it against the oldest retained file
+		// if the read position has been cleaned
+		cur := d.readQueueInfo
+		base, berr := d.getRetainedBase()
+		if berr == nil {
+			if voffset < base.Offset() {
+				nsqLog.Logf("internal skip to %v before the retained base: %v", voffset, base)
+				return ErrOffsetGarbageCollected
+			}
+			if cur.EndOffset.FileNum < base.EndOffset.FileNum {
+				cur = base
+			}
+		}
+		newPos, err = stepOffset(d.dataPath, d.coldPath, d.readFrom, d.getFileHeaderLen(), cur,
+			voffset-cur.Offset(), d.queueEndInfo)
+		if err == ErrReadQueueAlreadyCleaned {
+			return ErrOffsetGarbageCollected
+		}
 		if err != nil {
 			nsqLog.LogErrorf("internal skip error : %v, skipping to : %v", err, voffset)
 			if os.IsNotExist(err) {
@@ -672,7 +1821,7 @@ func (d *diskQueueReader) internalSkipTo(voffset BackendOffset, cnt int64, backT
 						break
 					}
 					// check offset meta
-					_, metaStartPos, metaEndPos, innerErr := getQueueFileOffsetMeta(d.fileName(newPos.FileNum))
+					_, metaStartPos, metaEndPos, innerErr := d.getFileOffsetMeta(newPos.FileNum)
 					if innerErr != nil {
 						if os.IsNotExist(innerErr) {
 							nsqLog.Logf("check segment offset meta not exist, try next: %v ", newPos)
@@ -683,6 +1832,11 @@ func (d *diskQueueReader) internalSkipTo(voffset BackendOffset, cnt int64, backT
 						break
 					}
 					nsqLog.Logf("check segment: %v offset, %v, %v ", newPos, metaStartPos, metaEndPos)
+					if voffset < BackendOffset(metaStartPos) {
+						// the segments before have been removed
+						err = ErrOffsetGarbageCollected
+						break
+					}
 					if voffset >= BackendOffset(metaEndPos) {
 						newPos.FileNum++
 						newPos.Pos = 0
@@ -717,7 +1871,7 @@ func (d *diskQueueReader) internalSkipTo(voffset BackendOffset, cnt int64, backT
 }
 
 func (d *diskQueueReader) skipToNextFile() error {
-	nsqLog.LogWarningf("diskqueue(%s) skip to next from %v, %v",
+	d.logCorruptSkipf("diskqueue(%s) skip to next from %v, %v",
 		d.readerMetaName, d.readQueueInfo, d.confirmedQueueInfo)
 	if d.confirmedQueueInfo.EndOffset.FileNum >= d.queueEndInfo.EndOffset.FileNum {
 		return d.skipToEndofQueue()
@@ -726,9 +1880,9 @@ func (d *diskQueueReader) skipToNextFile() error {
 		d.readFile.Close()
 		d.readFile = nil
 	}
-	d.readBuffer.Reset()
+	d.resetReadBuffer()
 	for {
-		cnt, _, end, err := getQueueFileOffsetMeta(d.fileName(d.confirmedQueueInfo.EndOffset.FileNum))
+		cnt, _, end, err := d.getFileOffsetMeta(d.confirmedQueueInfo.EndOffset.FileNum)
 		if err != nil {
 			nsqLog.LogErrorf("diskqueue(%s) failed to skip to next %v : %v",
 				d.readerMetaName, d.confirmedQueueInfo, err)
@@ -751,17 +1905,54 @@ func (d *diskQueueReader) skipToNextFile() error {
 	d.readQueueInfo = d.confirmedQueueInfo
 	d.updateDepth()
 
-	nsqLog.LogWarningf("diskqueue(%s) skip to next %v",
+	d.logCorruptSkipf("diskqueue(%s) skip to next %v",
 		d.readerMetaName, d.confirmedQueueInfo)
 	return nil
 }
 
+// skip the read to the next file of the corrupt data. The messages read from the previous files
+// may be still in flight while the confirm lagged, so the confirmed is kept to avoid reading them
+// again, and it will be moved past the skipped data once the confirm reaches the corrupt data.
+func (d *diskQueueReader) skipCorruptFile() error {
+	readFileNum := d.readQueueInfo.EndOffset.FileNum
+	if readFileNum <= d.confirmedQueueInfo.EndOffset.FileNum {
+		return d.skipToNextFile()
+	}
+	if readFileNum >= d.queueEndInfo.EndOffset.FileNum {
+		// the read just rolled to the last file, moving the confirmed to the next file
+		// will pass the messages of the previous file still in flight
+		d.skipReadToEndKeepConfirmed()
+		return nil
+	}
+	cnt, _, end, err := d.getFileOffsetMeta(readFileNum)
+	if err != nil {
+		nsqLog.LogErrorf("diskqueue(%s) failed to skip the read to next %v : %v",
+			d.readerMetaName, d.readQueueInfo, err)
+		return err
+	}
+	if d.readFile != nil {
+		d.readFile.Close()
+		d.readFile = nil
+	}
+	d.resetReadBuffer()
+	skipStart := d.readQueueInfo.Offset()
+	d.readQueueInfo.virtualEnd = BackendOffset(end)
+	atomic.StoreInt64(&d.readQueueInfo.totalMsgCnt, cnt)
+	d.readQueueInfo.EndOffset.FileNum++
+	d.readQueueInfo.EndOffset.Pos = 0
+	d.addSkippedPending(skipStart)
+	d.updateDepth()
+	d.logCorruptSkipf("diskqueue(%s) skip the read to next %v, confirmed: %v",
+		d.readerMetaName, d.readQueueInfo, d.confirmedQueueInfo)
+	return nil
+}
+
 func (d *diskQueueReader) skipToEndofQueue() error {
 	if d.readFile != nil {
 		d.readFile.Close()
 		d.readFile = nil
 	}
-	d.readBuffer.Reset()
+	d.resetReadBuffer()
 
 	d.readQueueInfo = d.queueEndInfo
 	if d.confirmedQueueInfo.EndOffset != d.readQueueInfo.EndOffset {
@@ -796,7 +1987,7 @@ func (d *diskQueueReader) ensureReadBuffer(dataNeed int64, currentRead int64, cu
 				d.readerMetaName, n, currentRead, currentFileEnd, d.readBuffer.Len(), bufDataSize,
 				dataNeed, err, d.queueEndInfo)
 			curPos, err := d.readFile.Seek(0, 1)
-			newPos, err := d.readFile.Seek(currentFileEnd, 0)
+			newPos, err := d.readFile.Seek(d.getFileHeaderLen()+currentFileEnd, 0)
 			nsqLog.Logf("seek to end : %v, %v, %v", curPos, newPos, err)
 			return err
 		}
@@ -807,6 +1998,11 @@ func (d *diskQueueReader) ensureReadBuffer(dataNeed int64, currentRead int64, cu
 // readOne performs a low level filesystem read for a single []byte
 // while advancing read positions and rolling files, if necessary
 func (d *diskQueueReader) readOne() ReadResult {
+	return d.readOneInto(false)
+}
+
+// readOneInto reads the data into the buffer from the pool if pooled
+func (d *diskQueueReader) readOneInto(pooled bool) ReadResult {
 	var result ReadResult
 	var msgSize int32
 	var stat os.FileInfo
@@ -821,9 +2017,15 @@ CheckFileOpen:
 
 	result.Offset = d.readQueueInfo.Offset()
 	if d.readFile == nil {
-		curFileName := d.fileName(d.readQueueInfo.EndOffset.FileNum)
-		d.readFile, result.Err = os.OpenFile(curFileName, os.O_RDONLY, 0644)
+		var curFileName string
+		openStart := time.Now()
+		d.readFile, curFileName, result.Err = openResolvedQueueFile(d.dataPath, d.coldPath, d.readFrom,
+			d.readQueueInfo.EndOffset.FileNum, d.openReadFile)
 		if result.Err != nil {
+			if isTransientOpenError(result.Err) {
+				nsqLog.LogErrorf("DISKQUEUE(%s): open %v failed: %v", d.readerMetaName, curFileName, result.Err)
+				result.Err = ErrReadFileUnavailable
+			}
 			return result
 		}
 
@@ -831,8 +2033,10 @@ CheckFileOpen:
 			nsqLog.LogDebugf("DISKQUEUE(%s): readOne() opened %s", d.readerMetaName, curFileName)
 		}
 
-		if d.readQueueInfo.EndOffset.Pos > 0 {
-			_, result.Err = d.readFile.Seek(d.readQueueInfo.EndOffset.Pos, 0)
+		// skip the file header while opened
+		headerLen := d.getFileHeaderLen()
+		if d.readQueueInfo.EndOffset.Pos > 0 || headerLen > 0 {
+			_, result.Err = d.readFile.Seek(headerLen+d.readQueueInfo.EndOffset.Pos, 0)
 			if result.Err != nil {
 				nsqLog.LogWarningf("DISKQUEUE(%s): seek %v error %s", d.readerMetaName, curFileName, result.Err)
 				tmpStat, tmpErr := d.readFile.Stat()
@@ -846,26 +2050,26 @@ CheckFileOpen:
 				return result
 			}
 		}
+		d.recordOpenLatency(time.Since(openStart))
 	}
 	if d.readQueueInfo.EndOffset.FileNum < d.queueEndInfo.EndOffset.FileNum {
 		stat, result.Err = d.readFile.Stat()
 		if result.Err != nil {
 			return result
 		}
-		if d.readQueueInfo.EndOffset.Pos >= stat.Size() {
+		if d.readQueueInfo.EndOffset.Pos >= getQueueFileDataSize(stat.Size(), d.getFileHeaderLen()) {
 			d.readQueueInfo.EndOffset.FileNum++
 			d.readQueueInfo.EndOffset.Pos = 0
 			nsqLog.Logf("DISKQUEUE(%s): readOne() read end, try next: %v",
 				d.readerMetaName, d.readQueueInfo.EndOffset.FileNum)
-			d.readFile.Close()
-			d.readFile = nil
+			d.releaseReadFile()
 			goto CheckFileOpen
 		}
 	}
 
 	defer func() {
 		if result.Err != nil {
-			d.readBuffer.Reset()
+			d.resetReadBuffer()
 			d.readFile.Close()
 			d.readFile = nil
 		}
@@ -877,7 +2081,7 @@ CheckFileOpen:
 	} else if d.readQueueInfo.EndOffset.FileNum < d.queueEndInfo.EndOffset.FileNum {
 		stat, result.Err = d.readFile.Stat()
 		if result.Err == nil {
-			currentFileEnd = stat.Size()
+			currentFileEnd = getQueueFileDataSize(stat.Size(), d.getFileHeaderLen())
 		} else {
 			return result
 		}
@@ -913,7 +2117,11 @@ CheckFileOpen:
 		return result
 	}
 
-	result.Data = make([]byte, msgSize)
+	if pooled {
+		result.Data = getReadData(int(msgSize))
+	} else {
+		result.Data = make([]byte, msgSize)
+	}
 
 	result.Err = d.ensureReadBuffer(int64(msgSize), d.readQueueInfo.EndOffset.Pos+4, currentFileEnd)
 	if result.Err != nil {
@@ -934,10 +2142,14 @@ CheckFileOpen:
 	}
 
 	result.Offset = d.readQueueInfo.Offset()
+	if atomic.LoadInt32(&d.parseMsgHeader) == 1 {
+		parseReadMsgHeader(&result)
+	}
 
 	totalBytes := int64(4 + msgSize)
 	result.MovedSize = BackendOffset(totalBytes)
 	oldCnt := d.readQueueInfo.TotalMsgCnt()
+	d.observeMsgSize(msgSize)
 
 	// we only advance next* because we have not yet sent this to consumers
 	// (where readFileNum, readQueueInfo.EndOffset will actually be advanced)
@@ -972,11 +2184,11 @@ CheckFileOpen:
 			d.readFile.Close()
 			d.readFile = nil
 		}
-		d.readBuffer.Reset()
+		d.resetReadBuffer()
 
 		d.readQueueInfo.EndOffset.FileNum++
 		d.readQueueInfo.EndOffset.Pos = 0
-		fixCnt, _, metaEnd, err := getQueueFileOffsetMeta(d.fileName(d.readQueueInfo.EndOffset.FileNum - 1))
+		fixCnt, _, metaEnd, err := getQueueFileOffsetMeta(d.dataFileName(d.readQueueInfo.EndOffset.FileNum - 1))
 		if err == nil {
 			// we compare the meta file to check if any wrong on the count of message
 			if metaEnd != int64(d.readQueueInfo.Offset()) {
@@ -996,12 +2208,34 @@ CheckFileOpen:
 
 // sync fsyncs the current writeFile and persists metadata
 func (d *diskQueueReader) sync() error {
-	err := d.persistMetaData()
+	now := time.Now().UnixNano()
+	if d.IsDegraded() && now < d.degradedUntil {
+		// avoid writing to the disk while in backoff, the reads can still go on
+		return ErrMetaSyncDegraded
+	}
+	err := d.persistMeta()
 	if err != nil {
+		d.syncFailCnt++
+		if d.syncFailCnt >= maxMetaSyncFailures {
+			d.degradedUntil = now + int64(d.degradedBackoff)
+			if atomic.CompareAndSwapInt32(&d.degraded, 0, 1) {
+				nsqLog.LogErrorf("diskqueue(%s) meta sync failed %v times, degraded: %v",
+					d.readerMetaName, d.syncFailCnt, err)
+			}
+		}
 		return err
 	}
+	if atomic.CompareAndSwapInt32(&d.degraded, 1, 0) {
+		nsqLog.Logf("diskqueue(%s) meta sync recovered from degraded", d.readerMetaName)
+	}
+	d.syncFailCnt = 0
 
 	d.needSync = false
+	d.syncCnt = 0
+	d.lastSyncTs = time.Now().UnixNano()
+	d.syncedMeta = d.currentMetaState()
+	d.metaSynced = true
+	d.saveConfirmedToStore()
 	return nil
 }
 
@@ -1025,6 +2259,11 @@ func (d *diskQueueReader) retrieveMetaData() error {
 			nsqLog.Infof("fscanf new meta file err : %v", errV2)
 			return errV2
 		}
+		// may be missing in the old version meta
+		var redeliverEnd int64
+		if _, err := fmt.Fscanf(fV2, "%d\n", &redeliverEnd); err == nil {
+			d.redeliverEnd = BackendOffset(redeliverEnd)
+		}
 	} else {
 		nsqLog.Infof("new meta file err : %v", errV2)
 
@@ -1062,12 +2301,44 @@ func (d *diskQueueReader) retrieveMetaData() error {
 	}
 	d.readQueueInfo = d.confirmedQueueInfo
 	d.updateDepth()
+	d.syncedMeta = d.currentMetaState()
+	d.metaSynced = true
 
 	return nil
 }
 
+func (d *diskQueueReader) SetSyncCoordinator(c *metaSyncCoordinator) {
+	d.Lock()
+	d.syncCoordinator = c
+	d.Unlock()
+}
+
 // persistMetaData atomically writes state to the filesystem
 func (d *diskQueueReader) persistMetaData() error {
+	err := d.writeMetaData()
+	if err != nil {
+		return err
+	}
+	if d.syncCoordinator != nil {
+		// the rename is made durable in the batch without holding the lock
+		d.syncCoordinator.SyncDir(d.dataPath, d.onMetaDirSynced)
+		return nil
+	}
+	// make sure the rename is durable
+	return util.SyncDir(d.dataPath)
+}
+
+// sync the meta again later if the rename may be not durable
+func (d *diskQueueReader) onMetaDirSynced(err error) {
+	if err == nil {
+		return
+	}
+	d.Lock()
+	d.needSync = true
+	d.Unlock()
+}
+
+func (d *diskQueueReader) writeMetaData() error {
 	var f *os.File
 	var err error
 
@@ -1080,11 +2351,15 @@ func (d *diskQueueReader) persistMetaData() error {
 		return err
 	}
 
-	_, err = fmt.Fprintf(f, "%d\n%d\n%d,%d,%d\n%d,%d,%d\n",
-		d.confirmedQueueInfo.TotalMsgCnt(),
-		d.queueEndInfo.totalMsgCnt,
-		d.confirmedQueueInfo.EndOffset.FileNum, d.confirmedQueueInfo.EndOffset.Pos, d.confirmedQueueInfo.Offset(),
-		d.queueEndInfo.EndOffset.FileNum, d.queueEndInfo.EndOffset.Pos, d.queueEndInfo.Offset())
+	m := d.currentMetaState()
+	// the last line is the max read offset which is used to count the redelivery
+	// attempts after restart, it will be ignored by the old version.
+	_, err = fmt.Fprintf(f, "%d\n%d\n%d,%d,%d\n%d,%d,%d\n%d\n",
+		m.confirmedCnt,
+		m.endCnt,
+		m.confirmed.FileNum, m.confirmed.Pos, m.confirmedOff,
+		m.end.FileNum, m.end.Pos, m.endOff,
+		m.redeliverEnd)
 	if err != nil {
 		f.Close()
 		return err
@@ -1098,7 +2373,7 @@ func (d *diskQueueReader) persistMetaData() error {
 
 func (d *diskQueueReader) metaDataFileName(newVer bool) string {
 	if newVer {
-		return fmt.Sprintf(path.Join(d.dataPath, "%s.diskqueue.meta.v2.reader.dat"),
+		return fmt.Sprintf(path.Join(d.dataPath, getReaderMetaNamePattern()),
 			d.readerMetaName)
 	}
 	return fmt.Sprintf(path.Join(d.dataPath, "%s.diskqueue.meta.reader.dat"),
@@ -1106,16 +2381,19 @@ func (d *diskQueueReader) metaDataFileName(newVer bool) string {
 }
 
 func GetQueueFileName(dataRoot string, base string, fileNum int64) string {
-	if fileNum > int64(999990) {
-		return fmt.Sprintf(path.Join(dataRoot, "%s.diskqueue.%09d.dat"), base, fileNum)
-	}
-	return fmt.Sprintf(path.Join(dataRoot, "%s.diskqueue.%06d.dat"), base, fileNum)
+	fileName := fmt.Sprintf(getQueueFileNamePattern(fileNum), base, fileNum)
+	return getShardedQueueFileName(dataRoot, base, fileNum, fileName)
 }
 
 func (d *diskQueueReader) fileName(fileNum int64) string {
 	return GetQueueFileName(d.dataPath, d.readFrom, fileNum)
 }
 
+// the data file may be moved to the cold data path
+func (d *diskQueueReader) dataFileName(fileNum int64) string {
+	return resolveQueueFileName(d.dataPath, d.coldPath, d.readFrom, fileNum)
+}
+
 func (d *diskQueueReader) checkTailCorruption() {
 	if d.readQueueInfo.EndOffset.FileNum < d.queueEndInfo.EndOffset.FileNum || d.readQueueInfo.EndOffset.Pos < d.queueEndInfo.EndOffset.Pos {
 		return
@@ -1123,48 +2401,152 @@ func (d *diskQueueReader) checkTailCorruption() {
 
 	// we reach file end, the readQueueInfo.EndOffset should be exactly at the end of file.
 	if d.readQueueInfo.EndOffset != d.queueEndInfo.EndOffset {
-		nsqLog.LogErrorf(
-			"diskqueue(%s) read to end at readQueueInfo.EndOffset != endPos (%v > %v), corruption, skipping to end ...",
-			d.readerMetaName, d.readQueueInfo, d.queueEndInfo)
+		if ok, suppressed := d.corruptLog.allow("tail corruption", time.Now().UnixNano()); ok {
+			nsqLog.LogErrorf(
+				"diskqueue(%s) read to end at readQueueInfo.EndOffset != endPos (%v > %v), corruption, skipping to end ... (%v suppressed)",
+				d.readerMetaName, d.readQueueInfo, d.queueEndInfo, suppressed)
+		}
 		d.skipToEndofQueue()
 		d.needSync = true
 	}
 }
 
-func (d *diskQueueReader) handleReadError() {
-	// should not change the bad file, just log it.
-	err := d.skipToNextFile()
+// SetCorruptionPolicy changes the policy to handle the corrupt data, skip-file by default.
+func (d *diskQueueReader) SetCorruptionPolicy(policy string) error {
+	p, err := parseCorruptionPolicy(policy)
 	if err != nil {
-		return
+		return err
 	}
-	nsqLog.LogWarningf("diskqueue(%s) skip error to next %v",
-		d.readerMetaName, d.readQueueInfo)
-	// significant state change, schedule a sync on the next iteration
-	d.needSync = true
+	atomic.StoreInt32(&d.corruptionPolicy, p)
+	return nil
+}
+
+// SetEndDivergencePolicy changes the policy to handle the read position past the new end
+// moved backward, clamp by default. The data read may never exist in the writer if diverged,
+// so the read will be halted until the read position is changed manually if the policy is halt.
+func (d *diskQueueReader) SetEndDivergencePolicy(policy string) error {
+	p, err := parseEndDivergencePolicy(policy)
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt32(&d.endDivergencePolicy, p)
+	return nil
+}
+
+// IsCorruptionHalted returns true if the read is halted by the corrupt data.
+func (d *diskQueueReader) IsCorruptionHalted() bool {
+	return atomic.LoadInt32(&d.corruptionHalted) == 1
+}
+
+// the read position is changed manually, so the halted read can be resumed
+func (d *diskQueueReader) resumeCorruptionHalted() {
+	if atomic.CompareAndSwapInt32(&d.corruptionHalted, 1, 0) {
+		nsqLog.Logf("diskqueue(%s) resumed from the corruption halted at %v", d.readerMetaName, d.readQueueInfo)
+	}
+}
+
+// SkipCorruption handles the corrupt data at the read position by the corruption policy.
+func (d *diskQueueReader) SkipCorruption() (BackendQueueEnd, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.exitFlag == 1 {
+		return nil, ErrExiting
+	}
+	err := d.handleCorruption()
+	if err != nil {
+		return nil, err
+	}
+	e := d.confirmedQueueInfo
+	return &e, nil
+}
+
+func (d *diskQueueReader) handleCorruption() error {
+	switch atomic.LoadInt32(&d.corruptionPolicy) {
+	case corruptionSkipToEnd:
+		old := d.confirmedQueueInfo.Offset()
+		d.quarantineCorruptFile(d.readQueueInfo.EndOffset.FileNum)
+		d.skipToEndofQueue()
+		d.logCorruptSkipf("diskqueue(%s) skip error to end %v", d.readerMetaName, d.readQueueInfo)
+		if old != d.confirmedQueueInfo.Offset() {
+			d.needSync = true
+			d.notifyConfirmed()
+		}
+	case corruptionHalt:
+		d.resetReadBuffer()
+		if atomic.CompareAndSwapInt32(&d.corruptionHalted, 0, 1) {
+			nsqLog.LogErrorf("diskqueue(%s) read halted by the corrupt data at %v, confirmed: %v, need reset or skip manually",
+				d.readerMetaName, d.readQueueInfo, d.confirmedQueueInfo)
+		}
+	default:
+		// should not change the bad file, just log it.
+		d.quarantineCorruptFile(d.readQueueInfo.EndOffset.FileNum)
+		err := d.skipCorruptFile()
+		if err != nil {
+			return err
+		}
+		d.logCorruptSkipf("diskqueue(%s) skip error to next %v",
+			d.readerMetaName, d.readQueueInfo)
+		d.needSync = true
+	}
+	return nil
 }
 
 func (d *diskQueueReader) internalUpdateEnd(endPos *diskQueueEndInfo, forceReload bool) (bool, error) {
+	ret, err := d.internalUpdateEndWithResult(endPos, forceReload)
+	return ret.Changed, err
+}
+
+func (d *diskQueueReader) internalUpdateEndWithResult(endPos *diskQueueEndInfo, forceReload bool) (EndUpdateResult, error) {
+	var ret EndUpdateResult
 	if endPos == nil {
+		if d.needSync && !d.isMetaDirty() {
+			// the state changed back or never changed, nothing to write for the idle reader
+			d.needSync = false
+			d.syncCnt = 0
+		}
 		if d.needSync {
 			d.sync()
 		}
-		return false, nil
+		return ret, nil
 	}
 	if forceReload {
 		nsqLog.Logf("read force reload at end %v ", endPos)
 	}
 
 	if endPos.Offset() == d.queueEndInfo.Offset() && endPos.TotalMsgCnt() == d.queueEndInfo.TotalMsgCnt() {
-		return false, nil
+		return ret, nil
 	}
-	d.needSync = true
 	if d.readQueueInfo.EndOffset.GreatThan(&endPos.EndOffset) || d.readQueueInfo.Offset() > endPos.Offset() {
 		nsqLog.LogWarningf("new end old than the read end: %v, %v, %v", d.readQueueInfo.EndOffset,
 			endPos, d.queueEndInfo)
 		if !forceReload {
 			// if rollback or reset, should set the force reload flag
-			return false, nil
+			return ret, nil
+		}
+		if atomic.LoadInt32(&d.endDivergencePolicy) == endDivergenceHalt {
+			// keep the read position diverged for diagnosing, and halt the read like the corruption
+			d.queueEndInfo = *endPos
+			d.needSync = true
+			d.updateDepth()
+			if d.readFile != nil {
+				d.readFile.Close()
+				d.readFile = nil
+			}
+			d.resetReadBuffer()
+			if atomic.CompareAndSwapInt32(&d.corruptionHalted, 0, 1) {
+				nsqLog.LogErrorf("diskqueue(%s) read halted since the read %v is past the new end %v, confirmed: %v, need reset or skip manually",
+					d.readerMetaName, d.readQueueInfo, endPos, d.confirmedQueueInfo)
+			}
+			ret.Changed = true
+			return ret, ErrReadEndDiverged
 		}
+		ret.Rewound = true
+		ret.RewindSize = d.readQueueInfo.Offset() - endPos.Offset()
+		ret.RewindCnt = d.readQueueInfo.TotalMsgCnt() - endPos.TotalMsgCnt()
+		atomic.AddInt64(&d.rewindCnt, 1)
+		nsqLog.LogWarningf("diskqueue(%s) read rewound by the end from %v to %v, size: %v, cnt: %v",
+			d.readerMetaName, d.readQueueInfo, endPos, ret.RewindSize, ret.RewindCnt)
 		d.readQueueInfo = *endPos
 		forceReload = true
 	}
@@ -1178,6 +2560,7 @@ func (d *diskQueueReader) internalUpdateEnd(endPos *diskQueueEndInfo, forceReloa
 	}
 	oldPos := d.queueEndInfo
 	d.queueEndInfo = *endPos
+	d.needSync = true
 	d.updateDepth()
 	if nsqLog.Level() >= levellogger.LOG_DETAIL {
 		nsqLog.LogDebugf("read end %v updated to : %v, current confirmed: %v ", oldPos, endPos, d.confirmedQueueInfo)
@@ -1188,8 +2571,28 @@ func (d *diskQueueReader) internalUpdateEnd(endPos *diskQueueEndInfo, forceReloa
 			d.readFile.Close()
 			d.readFile = nil
 		}
-		d.readBuffer.Reset()
+		d.resetReadBuffer()
 	}
 
-	return true, nil
+	ret.Changed = true
+	return ret, nil
+}
+
+// offsetHeap is the min heap of the offsets
+type offsetHeap []BackendOffset
+
+func (h offsetHeap) Len() int           { return len(h) }
+func (h offsetHeap) Less(i, j int) bool { return h[i] < h[j] }
+func (h offsetHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *offsetHeap) Push(x interface{}) {
+	*h = append(*h, x.(BackendOffset))
+}
+
+func (h *offsetHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
 }
@@ -0,0 +1,265 @@
+package nsqd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/youzan/nsq/internal/test"
+)
+
+// the harness runs the writer appending and updating the end concurrently with the reader
+// reading and confirming, it should be run with the race detector.
+type concurrentQueueHarness struct {
+	t      *testing.T
+	writer *diskQueueWriter
+	reader *diskQueueReader
+	msgNum int
+	inject bool
+	// the reads confirmed at most once in the lag, to keep the messages across files in flight
+	confirmLag int
+	lost       map[int]bool
+	read       []int
+	writeEnd   chan struct{}
+}
+
+func newConcurrentQueueHarness(t *testing.T, tmpDir string, msgNum int, inject bool, confirmLag int) *concurrentQueueHarness {
+	dqName := "test_disk_queue_concurrent" + strconv.Itoa(int(time.Now().Unix()))
+	queue, err := NewDiskQueueWriter(dqName, tmpDir, 1024, 4, 1<<10, 10000)
+	test.Nil(t, err)
+	dqReader, _ := newDiskQueueReader(dqName, dqName, tmpDir, 1024, 4, 1<<10, 10000, 2*time.Second, nil, inject)
+	return &concurrentQueueHarness{
+		t:          t,
+		writer:     queue.(*diskQueueWriter),
+		reader:     dqReader.(*diskQueueReader),
+		msgNum:     msgNum,
+		inject:     inject,
+		confirmLag: confirmLag,
+		lost:       make(map[int]bool),
+		writeEnd:   make(chan struct{}),
+	}
+}
+
+func (h *concurrentQueueHarness) publishEnd() {
+	h.writer.Flush()
+	_, err := h.reader.UpdateQueueEnd(h.writer.GetQueueWriteEnd(), false)
+	if err != nil {
+		h.t.Errorf("update end failed: %v", err)
+	}
+}
+
+// corrupt the size of the message, so the message and the rest of the file will be skipped
+func (h *concurrentQueueHarness) corrupt(pos diskQueueOffset) {
+	f, err := os.OpenFile(h.writer.fileName(pos.FileNum), os.O_RDWR, 0644)
+	if err != nil {
+		h.t.Errorf("open data file failed: %v", err)
+		return
+	}
+	_, err = f.WriteAt([]byte{0xff, 0xff, 0xff, 0xff}, pos.Pos)
+	if err != nil {
+		h.t.Errorf("corrupt data file failed: %v", err)
+	}
+	f.Close()
+}
+
+// the data of the file to be corrupted will not be published until the file is finished,
+// so the reader never buffered it before corrupted.
+func (h *concurrentQueueHarness) shouldCorrupt(fileNum int64) bool {
+	return h.inject && fileNum%3 == 1
+}
+
+func (h *concurrentQueueHarness) runWriter() {
+	defer close(h.writeEnd)
+	prev := h.writer.GetQueueWriteEnd().(*diskQueueEndInfo).EndOffset
+	var fileMsgs []int
+	var filePos []diskQueueOffset
+	for i := 0; i < h.msgNum; i++ {
+		_, _, e, err := h.writer.PutV2([]byte(fmt.Sprintf("msg-%08d", i)))
+		if err != nil {
+			h.t.Errorf("put failed: %v", err)
+			return
+		}
+		start := prev
+		prev = e.EndOffset
+		fileMsgs = append(fileMsgs, i)
+		filePos = append(filePos, start)
+		rolled := e.EndOffset.FileNum != start.FileNum
+		if h.shouldCorrupt(start.FileNum) {
+			if !rolled {
+				if i == h.msgNum-1 {
+					h.publishEnd()
+				}
+				continue
+			}
+			h.writer.Flush()
+			k := len(fileMsgs) / 2
+			h.corrupt(filePos[k])
+			for _, idx := range fileMsgs[k:] {
+				h.lost[idx] = true
+			}
+		}
+		if rolled {
+			fileMsgs = fileMsgs[:0]
+			filePos = filePos[:0]
+		}
+		if rolled || i%20 == 0 || i == h.msgNum-1 {
+			h.publishEnd()
+		}
+	}
+}
+
+func (h *concurrentQueueHarness) confirm(ret ReadResult) bool {
+	err := h.reader.ConfirmRead(ret.Offset+ret.MovedSize, ret.CurCnt)
+	if err != nil {
+		h.t.Errorf("confirm failed at %v: %v", ret.Offset, err)
+		return false
+	}
+	return true
+}
+
+func (h *concurrentQueueHarness) runReader() {
+	var last ReadResult
+	unconfirmed := 0
+	for {
+		ret, ok := h.reader.TryReadOne()
+		if !ok {
+			if unconfirmed > 0 {
+				if !h.confirm(last) {
+					return
+				}
+				unconfirmed = 0
+			}
+			select {
+			case <-h.writeEnd:
+				if h.reader.GetQueueCurrentRead().Offset() == h.reader.GetQueueReadEnd().Offset() {
+					return
+				}
+			default:
+			}
+			if h.reader.IsCorruptionHalted() {
+				h.t.Errorf("read halted at %v", h.reader.GetQueueCurrentRead())
+				return
+			}
+			time.Sleep(time.Millisecond)
+			continue
+		}
+		if ret.Err != nil {
+			h.t.Errorf("read failed at %v: %v", ret.Offset, ret.Err)
+			return
+		}
+		idx, err := strconv.Atoi(string(ret.Data[len("msg-"):]))
+		if err != nil {
+			h.t.Errorf("read invalid data %v at %v", string(ret.Data), ret.Offset)
+			return
+		}
+		h.read = append(h.read, idx)
+		last = ret
+		unconfirmed++
+		if unconfirmed >= h.confirmLag {
+			if !h.confirm(last) {
+				return
+			}
+			unconfirmed = 0
+		}
+	}
+}
+
+// watch the stats while reading and writing to catch the unprotected access
+func (h *concurrentQueueHarness) runStats(done chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		h.reader.Depth()
+		h.reader.DepthSize()
+		h.reader.GetQueueConfirmed()
+		h.reader.GetBufferedBytes()
+		h.writer.GetQueueReadEnd()
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (h *concurrentQueueHarness) run() {
+	var wg sync.WaitGroup
+	statsDone := make(chan struct{})
+	go h.runStats(statsDone)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		h.runWriter()
+	}()
+	go func() {
+		defer wg.Done()
+		h.runReader()
+	}()
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Minute):
+		h.t.Fatalf("timeout while reading, read: %v, end: %v", h.reader.GetQueueCurrentRead(),
+			h.reader.GetQueueReadEnd())
+	}
+	close(statsDone)
+
+	// every message not in the corrupt regions should be read exactly once in order
+	expected := make([]int, 0, h.msgNum)
+	for i := 0; i < h.msgNum; i++ {
+		if !h.lost[i] {
+			expected = append(expected, i)
+		}
+	}
+	test.Equal(h.t, len(expected), len(h.read))
+	for i := 0; i < len(expected) && i < len(h.read); i++ {
+		if expected[i] != h.read[i] {
+			h.t.Fatalf("read %v at %v, expected %v", h.read[i], i, expected[i])
+		}
+	}
+	test.Equal(h.t, h.writer.GetQueueWriteEnd().Offset(), h.reader.GetQueueConfirmed().Offset())
+	test.Equal(h.t, int64(0), h.reader.Depth())
+}
+
+func (h *concurrentQueueHarness) close() {
+	h.reader.Close()
+	h.writer.Close()
+}
+
+func TestDiskQueueReaderConcurrentWrite(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	h := newConcurrentQueueHarness(t, tmpDir, 20000, false, 1)
+	defer h.close()
+	h.run()
+	test.Equal(t, 0, len(h.lost))
+}
+
+func TestDiskQueueReaderConcurrentWriteWithCorruption(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	h := newConcurrentQueueHarness(t, tmpDir, 20000, true, 1)
+	defer h.close()
+	h.run()
+	test.NotEqual(t, 0, len(h.lost))
+}
+
+func TestDiskQueueReaderConcurrentWriteWithCorruptionConfirmLag(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	// each data file has about 64 messages, so the unconfirmed messages will cross the files
+	h := newConcurrentQueueHarness(t, tmpDir, 20000, true, 100)
+	defer h.close()
+	h.run()
+	test.NotEqual(t, 0, len(h.lost))
+}
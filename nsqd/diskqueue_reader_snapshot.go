@@ -0,0 +1,104 @@
+package nsqd
+
+import (
+	"os"
+)
+
+// SnapshotHandle is the consistent view of the reader for the backup, the meta file is synced
+// with the offsets, and the data files from the queue start to the end are listed.
+type SnapshotHandle struct {
+	ID         int64
+	QueueStart BackendQueueEnd
+	Confirmed  BackendQueueEnd
+	End        BackendQueueEnd
+	MetaFile   string
+	DataFiles  []string
+	// the data files are kept from the clean until the snapshot ended
+	holdClean bool
+}
+
+// BeginSnapshot syncs the meta and returns the offsets and the files of the reader, so the backup
+// can copy them as a point-in-time consistent view. If holdClean is set, the retention clean of
+// the topic will not remove any data file of the snapshot until EndSnapshot is called.
+func (d *diskQueueReader) BeginSnapshot(holdClean bool) (*SnapshotHandle, error) {
+	d.Lock()
+	defer d.Unlock()
+	if d.exitFlag == 1 {
+		return nil, ErrExiting
+	}
+	d.needSync = true
+	err := d.sync()
+	if err != nil {
+		nsqLog.LogErrorf("diskqueue(%s) failed to sync the meta for the snapshot: %v", d.readerMetaName, err)
+		return nil, err
+	}
+	start, err := d.findQueueStart()
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for fileNum := start.EndOffset.FileNum; fileNum <= d.queueEndInfo.EndOffset.FileNum; fileNum++ {
+		fileName := d.dataFileName(fileNum)
+		if _, err := os.Stat(fileName); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		files = append(files, fileName)
+	}
+	confirmed := d.confirmedQueueInfo
+	end := d.queueEndInfo
+	d.snapshotSeq++
+	h := &SnapshotHandle{
+		ID:         d.snapshotSeq,
+		QueueStart: &start,
+		Confirmed:  &confirmed,
+		End:        &end,
+		MetaFile:   d.metaDataFileName(true),
+		DataFiles:  files,
+		holdClean:  holdClean,
+	}
+	if holdClean {
+		if d.snapshots == nil {
+			d.snapshots = make(map[int64]*SnapshotHandle)
+		}
+		d.snapshots[h.ID] = h
+	}
+	nsqLog.Logf("diskqueue(%s) begin snapshot %v at start: %v, confirmed: %v, end: %v, hold clean: %v",
+		d.readerMetaName, h.ID, start, confirmed, end, holdClean)
+	return h, nil
+}
+
+// EndSnapshot releases the data files held by the snapshot.
+func (d *diskQueueReader) EndSnapshot(h *SnapshotHandle) error {
+	if h == nil {
+		return ErrSnapshotNotFound
+	}
+	d.Lock()
+	defer d.Unlock()
+	if !h.holdClean {
+		return nil
+	}
+	if _, ok := d.snapshots[h.ID]; !ok {
+		return ErrSnapshotNotFound
+	}
+	delete(d.snapshots, h.ID)
+	nsqLog.Logf("diskqueue(%s) end snapshot %v", d.readerMetaName, h.ID)
+	return nil
+}
+
+// returns the oldest start of the snapshots holding the clean
+func (d *diskQueueReader) snapshotHoldOffset() (BackendOffset, bool) {
+	d.RLock()
+	defer d.RUnlock()
+	var hold BackendOffset
+	found := false
+	for _, h := range d.snapshots {
+		if !found || h.QueueStart.Offset() < hold {
+			hold = h.QueueStart.Offset()
+			found = true
+		}
+	}
+	return hold, found
+}
@@ -0,0 +1,147 @@
+package nsqd
+
+import (
+	"encoding/json"
+	"os"
+)
+
+const readerStateVersion = 1
+
+type readerStatePos struct {
+	FileNum int64         `json:"file_num"`
+	Pos     int64         `json:"pos"`
+	Offset  BackendOffset `json:"offset"`
+	Cnt     int64         `json:"cnt"`
+}
+
+func newReaderStatePos(info diskQueueEndInfo) readerStatePos {
+	return readerStatePos{
+		FileNum: info.EndOffset.FileNum,
+		Pos:     info.EndOffset.Pos,
+		Offset:  info.Offset(),
+		Cnt:     info.TotalMsgCnt(),
+	}
+}
+
+func (p readerStatePos) toEndInfo() diskQueueEndInfo {
+	var info diskQueueEndInfo
+	info.EndOffset.FileNum = p.FileNum
+	info.EndOffset.Pos = p.Pos
+	info.virtualEnd = p.Offset
+	info.totalMsgCnt = p.Cnt
+	return info
+}
+
+// the persisted reader state, the read position is not included since the read will
+// start from the confirmed after restored as reloading the meta. The end is only for the
+// information, the end of the importing reader is always from the local queue.
+type readerState struct {
+	Version      int            `json:"version"`
+	ReadFrom     string         `json:"read_from"`
+	Confirmed    readerStatePos `json:"confirmed"`
+	End          readerStatePos `json:"end"`
+	RedeliverEnd BackendOffset  `json:"redeliver_end"`
+}
+
+// ExportState returns the resumable state of the reader as the same as the meta persisted, which
+// can be restored by ImportState of the reader over the same data.
+func (d *diskQueueReader) ExportState() ([]byte, error) {
+	d.Lock()
+	defer d.Unlock()
+	if d.exitFlag == 1 {
+		return nil, ErrExiting
+	}
+	redeliverEnd := d.maxReadOffset
+	if redeliverEnd < d.redeliverEnd {
+		redeliverEnd = d.redeliverEnd
+	}
+	if redeliverEnd <= d.confirmedQueueInfo.Offset() {
+		redeliverEnd = 0
+	}
+	return json.Marshal(&readerState{
+		Version:      readerStateVersion,
+		ReadFrom:     d.readFrom,
+		Confirmed:    newReaderStatePos(d.confirmedQueueInfo),
+		End:          newReaderStatePos(d.queueEndInfo),
+		RedeliverEnd: redeliverEnd,
+	})
+}
+
+// ImportState restores the state exported, the read and confirmed are moved to the confirmed in
+// the state and the meta is persisted. The state is rejected if it is from the other queue or
+// the confirmed is beyond the local end or not consistent with the data files. The channel should
+// import it by the reader reset, see Channel.ImportReaderState.
+func (d *diskQueueReader) ImportState(data []byte) error {
+	var state readerState
+	err := json.Unmarshal(data, &state)
+	if err != nil {
+		return err
+	}
+	if state.Version != readerStateVersion {
+		nsqLog.LogErrorf("diskqueue(%s) unsupported reader state version: %v", d.readerMetaName, state.Version)
+		return ErrInvalidReaderState
+	}
+	confirmed := state.Confirmed.toEndInfo()
+
+	d.Lock()
+	defer d.Unlock()
+	if d.exitFlag == 1 {
+		return ErrExiting
+	}
+	if state.ReadFrom != d.readFrom {
+		nsqLog.LogErrorf("diskqueue(%s) reader state of the other queue: %v", d.readerMetaName, state.ReadFrom)
+		return ErrInvalidReaderState
+	}
+	err = d.checkReaderState(confirmed, d.queueEndInfo)
+	if err != nil {
+		nsqLog.LogErrorf("diskqueue(%s) invalid reader state %v: %v", d.readerMetaName, state, err)
+		return err
+	}
+
+	if d.readFile != nil {
+		d.readFile.Close()
+		d.readFile = nil
+	}
+	d.resetReadBuffer()
+	d.confirmedQueueInfo = confirmed
+	d.readQueueInfo = confirmed
+	d.resetReadAttempts()
+	d.maxReadOffset = confirmed.Offset()
+	d.redeliverEnd = state.RedeliverEnd
+	d.metaMissing = false
+	d.updateDepth()
+	d.needSync = true
+	d.sync()
+	d.notifyConfirmed()
+	nsqLog.Logf("diskqueue(%s) reader state imported, confirmed: %v, end: %v",
+		d.readerMetaName, d.confirmedQueueInfo, d.queueEndInfo)
+	return nil
+}
+
+func (d *diskQueueReader) checkReaderState(confirmed diskQueueEndInfo, end diskQueueEndInfo) error {
+	if confirmed.EndOffset.Pos < 0 || confirmed.Offset() < 0 || confirmed.TotalMsgCnt() < 0 ||
+		confirmed.EndOffset.GreatThan(&end.EndOffset) || confirmed.Offset() > end.Offset() ||
+		confirmed.TotalMsgCnt() > end.TotalMsgCnt() {
+		return ErrInvalidReaderState
+	}
+	if confirmed.EndOffset == end.EndOffset {
+		if confirmed.Offset() != end.Offset() {
+			return ErrInvalidReaderState
+		}
+		return nil
+	}
+	if _, err := os.Stat(d.dataFileName(confirmed.EndOffset.FileNum)); err != nil {
+		if os.IsNotExist(err) {
+			return ErrOffsetGarbageCollected
+		}
+		return err
+	}
+	// the virtual offset should match the file start in the offset meta
+	if confirmed.EndOffset.FileNum > 0 {
+		_, _, endPos, err := getQueueFileOffsetMeta(d.fileName(confirmed.EndOffset.FileNum - 1))
+		if err == nil && endPos+confirmed.EndOffset.Pos != int64(confirmed.Offset()) {
+			return ErrInvalidReaderState
+		}
+	}
+	return nil
+}
@@ -1,11 +1,22 @@
 package nsqd
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"github.com/youzan/nsq/internal/test"
+	"golang.org/x/net/context"
+	"io"
 	"io/ioutil"
+	"math/rand"
 	"os"
+	"path"
+	"path/filepath"
+	"runtime"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -30,7 +41,7 @@ func TestDiskQueueReaderResetConfirmed(t *testing.T) {
 	end := dqWriter.GetQueueWriteEnd()
 	test.Nil(t, err)
 
-	dqReader := newDiskQueueReader(dqName, dqName, tmpDir, 1024, 4, 1<<10, 1, 2*time.Second, nil, true)
+	dqReader, _ := newDiskQueueReader(dqName, dqName, tmpDir, 1024, 4, 1<<10, 1, 2*time.Second, nil, true)
 	dqReader.UpdateQueueEnd(end, false)
 	msgOut, _ := dqReader.TryReadOne()
 	equal(t, msgOut.Data, msg)
@@ -44,6 +55,9 @@ func TestDiskQueueReaderResetConfirmed(t *testing.T) {
 	test.Equal(t, oldConfirm, curConfirmed)
 	test.Equal(t, oldConfirm.(*diskQueueEndInfo), &dqReader.(*diskQueueReader).readQueueInfo)
 	msgOut2, _ := dqReader.TryReadOne()
+	// the reset read will be counted as redelivered
+	test.Equal(t, msgOut.Attempts+1, msgOut2.Attempts)
+	msgOut2.Attempts = msgOut.Attempts
 	test.Equal(t, msgOut, msgOut2)
 	err = dqReader.ConfirmRead(msgOut.Offset+BackendOffset(msgOut.MovedSize), msgOut.CurCnt)
 	test.Nil(t, err)
@@ -78,6 +92,3054 @@ func TestDiskQueueReaderResetConfirmed(t *testing.T) {
 	test.Equal(t, confirmMsg.Offset+confirmMsg.MovedSize, msgOut2.Offset)
 }
 
+func TestDiskQueueReaderAttemptsAfterRestart(t *testing.T) {
+	dqName := "test_disk_queue_attempts" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	queue, _ := NewDiskQueueWriter(dqName, tmpDir, 1024, 4, 1<<10, 1)
+	dqWriter := queue.(*diskQueueWriter)
+	defer dqWriter.Close()
+
+	msg := []byte("test")
+	msgNum := 10
+	for i := 0; i < msgNum; i++ {
+		dqWriter.Put(msg)
+	}
+	dqWriter.Flush()
+	end := dqWriter.GetQueueWriteEnd()
+
+	dqReader, _ := newDiskQueueReader(dqName, dqName, tmpDir, 1024, 4, 1<<10, 1, 2*time.Second, nil, true)
+	dqReader.UpdateQueueEnd(end, false)
+	var readList []ReadResult
+	for i := 0; i < 5; i++ {
+		msgOut, hasData := dqReader.TryReadOne()
+		test.Equal(t, true, hasData)
+		test.Equal(t, int32(1), msgOut.Attempts)
+		readList = append(readList, msgOut)
+	}
+	// confirm the first and crash in the middle of the window
+	err = dqReader.ConfirmRead(readList[0].Offset+readList[0].MovedSize, readList[0].CurCnt)
+	test.Nil(t, err)
+	test.Equal(t, int32(0), dqReader.(*diskQueueReader).readAttempts[readList[0].Offset])
+	// only the confirmed are pruned
+	test.Equal(t, 4, len(dqReader.(*diskQueueReader).readAttempts))
+	test.Equal(t, 4, len(dqReader.(*diskQueueReader).attemptOffsets))
+	dqReader.Close()
+
+	dqReader, _ = newDiskQueueReader(dqName, dqName, tmpDir, 1024, 4, 1<<10, 1, 2*time.Second, nil, true)
+	defer dqReader.Close()
+	dqReader.UpdateQueueEnd(end, false)
+	for i := 1; i < msgNum; i++ {
+		msgOut, hasData := dqReader.TryReadOne()
+		test.Equal(t, true, hasData)
+		if i < len(readList) {
+			test.Equal(t, readList[i].Offset, msgOut.Offset)
+			test.Equal(t, int32(2), msgOut.Attempts)
+		} else {
+			test.Equal(t, int32(1), msgOut.Attempts)
+		}
+	}
+}
+
+func TestDiskQueueReaderBatchMetaSync(t *testing.T) {
+	dqName := "test_disk_queue_batch_sync" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	queue, _ := NewDiskQueueWriter(dqName, tmpDir, 1024, 4, 1<<10, 1)
+	dqWriter := queue.(*diskQueueWriter)
+	defer dqWriter.Close()
+
+	msg := []byte("test")
+	msgNum := 10
+	for i := 0; i < msgNum; i++ {
+		dqWriter.Put(msg)
+	}
+	dqWriter.Flush()
+	end := dqWriter.GetQueueWriteEnd()
+
+	coordinator := newMetaSyncCoordinator(time.Millisecond * 50)
+	readerNum := 20
+	readers := make([]BackendQueueReader, 0, readerNum)
+	for i := 0; i < readerNum; i++ {
+		dqReader, _ := newDiskQueueReader(dqName, dqName+strconv.Itoa(i), tmpDir, 1024, 4, 1<<10, 1, 2*time.Second, nil, true)
+		dqReader.UpdateQueueEnd(end, false)
+		dqReader.(*diskQueueReader).SetSyncCoordinator(coordinator)
+		readers = append(readers, dqReader)
+	}
+	confirmed := make([]ReadResult, readerNum)
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := 0; i < readerNum; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var msgOut ReadResult
+			for j := 0; j <= i%msgNum; j++ {
+				msgOut, _ = readers[i].TryReadOne()
+			}
+			<-start
+			confirmed[i] = msgOut
+			err := readers[i].ConfirmRead(msgOut.Offset+msgOut.MovedSize, msgOut.CurCnt)
+			test.Nil(t, err)
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+	// the directory is synced in background after the window
+	time.Sleep(time.Millisecond * 200)
+	t.Logf("dir synced %v times for %v readers", coordinator.DirSyncCnt(), readerNum)
+	if coordinator.DirSyncCnt() < 1 || coordinator.DirSyncCnt() > int64(readerNum/2) {
+		t.Fatalf("the meta syncs should be batched: %v", coordinator.DirSyncCnt())
+	}
+
+	// the meta should be durable after confirmed
+	for i := 0; i < readerNum; i++ {
+		dqReader, _ := newDiskQueueReader(dqName, dqName+strconv.Itoa(i), tmpDir, 1024, 4, 1<<10, 1, 2*time.Second, nil, true)
+		test.Equal(t, confirmed[i].Offset+confirmed[i].MovedSize, dqReader.GetQueueConfirmed().Offset())
+		test.Equal(t, confirmed[i].CurCnt, dqReader.GetQueueConfirmed().TotalMsgCnt())
+		dqReader.Close()
+	}
+	for _, dqReader := range readers {
+		dqReader.Close()
+	}
+}
+
+func TestDiskQueueReaderParseMsgHeader(t *testing.T) {
+	dqName := "test_disk_queue_parse_header" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	queue, _ := NewDiskQueueWriter(dqName, tmpDir, 1024, 4, 1<<10, 1)
+	dqWriter := queue.(*diskQueueWriter)
+	defer dqWriter.Close()
+
+	var msgs []*Message
+	for i := 0; i < 5; i++ {
+		msg := NewMessageWithTs(MessageID(i+100), []byte("test"), time.Now().UnixNano()+int64(i))
+		msg.Attempts = uint16(i + 1)
+		var buf bytes.Buffer
+		_, err := msg.WriteTo(&buf, false)
+		test.Nil(t, err)
+		dqWriter.Put(buf.Bytes())
+		msgs = append(msgs, msg)
+	}
+	// the payload not a standard message
+	dqWriter.Put([]byte("test"))
+	dqWriter.Flush()
+	end := dqWriter.GetQueueWriteEnd()
+
+	dqReader, _ := newDiskQueueReader(dqName, dqName, tmpDir, 1024, 4, 1<<10, 1, 2*time.Second, nil, true)
+	defer dqReader.Close()
+	dqReader.UpdateQueueEnd(end, false)
+	parseReader, _ := newDiskQueueReader(dqName, dqName+"-parse", tmpDir, 1024, 4, 1<<10, 1, 2*time.Second, nil, true)
+	defer parseReader.Close()
+	parseReader.UpdateQueueEnd(end, false)
+	parseReader.(*diskQueueReader).SetParseMsgHeader(true)
+
+	for i := 0; i < len(msgs)+1; i++ {
+		raw, hasData := dqReader.TryReadOne()
+		test.Equal(t, true, hasData)
+		test.Equal(t, MessageID(0), raw.MsgID)
+		parsed, hasData := parseReader.TryReadOne()
+		test.Equal(t, true, hasData)
+		test.Equal(t, raw.Offset, parsed.Offset)
+		test.Equal(t, raw.MovedSize, parsed.MovedSize)
+		test.Equal(t, raw.CurCnt, parsed.CurCnt)
+		if i < len(msgs) {
+			test.Equal(t, msgs[i].ID, parsed.MsgID)
+			test.Equal(t, msgs[i].Timestamp, parsed.MsgTimestamp)
+			test.Equal(t, msgs[i].Attempts, parsed.MsgAttempts)
+		} else {
+			test.Equal(t, MessageID(0), parsed.MsgID)
+			test.Equal(t, int64(0), parsed.MsgTimestamp)
+			test.Equal(t, uint16(0), parsed.MsgAttempts)
+		}
+	}
+}
+
+func TestDiskQueueReaderOverConfirmPolicy(t *testing.T) {
+	dqName := "test_disk_queue_over_confirm" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	queue, _ := NewDiskQueueWriter(dqName, tmpDir, 1024, 4, 1<<10, 1)
+	dqWriter := queue.(*diskQueueWriter)
+	defer dqWriter.Close()
+
+	msgNum := 10
+	for i := 0; i < msgNum; i++ {
+		dqWriter.Put([]byte("test"))
+	}
+	dqWriter.Flush()
+	end := dqWriter.GetQueueWriteEnd()
+
+	for _, clamp := range []bool{false, true} {
+		dqReader, _ := newDiskQueueReader(dqName, dqName+strconv.FormatBool(clamp), tmpDir, 1024, 4, 1<<10, 1, 2*time.Second, nil, true)
+		dqReader.UpdateQueueEnd(end, false)
+		dqReader.(*diskQueueReader).SetClampOverConfirm(clamp)
+		var last ReadResult
+		for i := 0; i < 3; i++ {
+			last, _ = dqReader.TryReadOne()
+		}
+		read := dqReader.(*diskQueueReader).GetQueueCurrentRead()
+		test.Equal(t, last.Offset+last.MovedSize, read.Offset())
+		// confirm ahead of the read
+		err = dqReader.ConfirmRead(end.Offset(), end.TotalMsgCnt())
+		if clamp {
+			test.Nil(t, err)
+			test.Equal(t, read.Offset(), dqReader.GetQueueConfirmed().Offset())
+			test.Equal(t, read.TotalMsgCnt(), dqReader.GetQueueConfirmed().TotalMsgCnt())
+		} else {
+			test.Equal(t, ErrConfirmSizeInvalid, err)
+			test.Equal(t, BackendOffset(0), dqReader.GetQueueConfirmed().Offset())
+		}
+		dqReader.Close()
+	}
+}
+
+func TestDiskQueueReaderConfirmBoundaryCheck(t *testing.T) {
+	dqName := "test_disk_queue_confirm_boundary" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	queue, _ := NewDiskQueueWriter(dqName, tmpDir, 1024, 4, 1<<10, 1)
+	dqWriter := queue.(*diskQueueWriter)
+	defer dqWriter.Close()
+	for i := 0; i < 10; i++ {
+		dqWriter.Put([]byte(fmt.Sprintf("test%02d", i)))
+	}
+	dqWriter.Flush()
+	end := dqWriter.GetQueueWriteEnd()
+
+	dqReader, _ := newDiskQueueReader(dqName, dqName, tmpDir, 1024, 4, 1<<10, 1, 2*time.Second, nil, true)
+	defer dqReader.Close()
+	dqReader.UpdateQueueEnd(end, false)
+	reader := dqReader.(*diskQueueReader)
+	reader.SetConfirmBoundaryCheck(true)
+	var rets []ReadResult
+	for i := 0; i < 8; i++ {
+		ret, ok := dqReader.TryReadOne()
+		test.Equal(t, true, ok)
+		rets = append(rets, ret)
+	}
+
+	err = dqReader.ConfirmRead(rets[2].Offset+3, rets[2].CurCnt)
+	test.Equal(t, ErrConfirmNotBoundary, err)
+	test.Equal(t, BackendOffset(0), dqReader.GetQueueConfirmed().Offset())
+	err = dqReader.ConfirmRead(rets[2].Offset+rets[2].MovedSize, rets[2].CurCnt)
+	test.Nil(t, err)
+	test.Equal(t, rets[3].Offset, dqReader.GetQueueConfirmed().Offset())
+
+	// the boundary not tracked is verified by reading the data
+	reader.Lock()
+	reader.resetReadAttempts()
+	reader.Unlock()
+	err = dqReader.ConfirmRead(rets[5].Offset+1, rets[5].CurCnt)
+	test.Equal(t, ErrConfirmNotBoundary, err)
+	err = dqReader.ConfirmRead(rets[5].Offset+rets[5].MovedSize, rets[5].CurCnt)
+	test.Nil(t, err)
+	test.Equal(t, rets[6].Offset, dqReader.GetQueueConfirmed().Offset())
+
+	// the lenient mode moves the confirmed to the middle as before
+	reader.SetConfirmBoundaryCheck(false)
+	err = dqReader.ConfirmRead(rets[6].Offset+3, rets[6].CurCnt)
+	test.Nil(t, err)
+	test.Equal(t, rets[6].Offset+3, dqReader.GetQueueConfirmed().Offset())
+}
+
+func TestDiskQueueReaderNoMetaWriteWhileIdle(t *testing.T) {
+	dqName := "test_disk_queue_idle_meta" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	queue, _ := NewDiskQueueWriter(dqName, tmpDir, 1024, 4, 1<<10, 1)
+	dqWriter := queue.(*diskQueueWriter)
+	defer dqWriter.Close()
+	var midEnd BackendQueueEnd
+	for i := 0; i < 10; i++ {
+		dqWriter.Put([]byte(fmt.Sprintf("test%02d", i)))
+		if i == 2 {
+			midEnd = dqWriter.GetQueueWriteEnd()
+		}
+	}
+	dqWriter.Flush()
+	end := dqWriter.GetQueueWriteEnd()
+
+	syncTimeout := time.Millisecond * 10
+	dqReader, _ := newDiskQueueReader(dqName, dqName, tmpDir, 1024, 4, 1<<10, 100, syncTimeout, nil, true)
+	defer dqReader.Close()
+	reader := dqReader.(*diskQueueReader)
+	var writeCnt int64
+	reader.Lock()
+	reader.persistMeta = func() error {
+		atomic.AddInt64(&writeCnt, 1)
+		return reader.persistMetaData()
+	}
+	reader.Unlock()
+	dqReader.UpdateQueueEnd(end, false)
+	var rets []ReadResult
+	for i := 0; i < 5; i++ {
+		ret, ok := dqReader.TryReadOne()
+		test.Equal(t, true, ok)
+		rets = append(rets, ret)
+	}
+	test.Nil(t, dqReader.ConfirmRead(rets[2].Offset+rets[2].MovedSize, rets[2].CurCnt))
+	time.Sleep(syncTimeout * 2)
+	reader.Flush()
+	test.Equal(t, int64(1), atomic.LoadInt64(&writeCnt))
+
+	// the end not changed and the old end ignored should not need any meta write
+	dqReader.UpdateQueueEnd(end, false)
+	dqReader.UpdateQueueEnd(midEnd, false)
+	for i := 0; i < 5; i++ {
+		time.Sleep(syncTimeout * 2)
+		reader.Flush()
+	}
+	test.Equal(t, int64(1), atomic.LoadInt64(&writeCnt))
+
+	test.Nil(t, dqReader.ConfirmRead(rets[3].Offset+rets[3].MovedSize, rets[3].CurCnt))
+	time.Sleep(syncTimeout * 2)
+	reader.Flush()
+	reader.Flush()
+	test.Equal(t, int64(2), atomic.LoadInt64(&writeCnt))
+}
+
+func TestDiskQueueReaderStrictConfirm(t *testing.T) {
+	dqName := "test_disk_queue_strict_confirm" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	queue, _ := NewDiskQueueWriter(dqName, tmpDir, 1024, 4, 1<<10, 1)
+	dqWriter := queue.(*diskQueueWriter)
+	defer dqWriter.Close()
+
+	msgNum := 10
+	for i := 0; i < msgNum; i++ {
+		dqWriter.Put([]byte("test"))
+	}
+	dqWriter.Flush()
+	end := dqWriter.GetQueueWriteEnd()
+
+	for _, strict := range []bool{false, true} {
+		dqReader, _ := newDiskQueueReader(dqName, dqName+strconv.FormatBool(strict), tmpDir, 1024, 4, 1<<10, 1, 2*time.Second, nil, true)
+		dqReader.UpdateQueueEnd(end, false)
+		dqReader.(*diskQueueReader).SetStrictConfirm(strict)
+		var first ReadResult
+		var last ReadResult
+		for i := 0; i < 3; i++ {
+			last, _ = dqReader.TryReadOne()
+			if i == 0 {
+				first = last
+			}
+		}
+		confirmed := last.Offset + last.MovedSize
+		err = dqReader.ConfirmRead(confirmed, last.CurCnt)
+		test.Nil(t, err)
+		// confirm the same offset twice and then an older one
+		err = dqReader.ConfirmRead(confirmed, last.CurCnt)
+		if strict {
+			test.Equal(t, ErrConfirmRegression, err)
+		} else {
+			test.Nil(t, err)
+		}
+		err = dqReader.ConfirmRead(first.Offset+first.MovedSize, first.CurCnt)
+		if strict {
+			test.Equal(t, ErrConfirmRegression, err)
+			test.Equal(t, int64(2), dqReader.(*diskQueueReader).ConfirmRegressedCount())
+		} else {
+			test.Nil(t, err)
+			test.Equal(t, int64(0), dqReader.(*diskQueueReader).ConfirmRegressedCount())
+		}
+		test.Equal(t, confirmed, dqReader.GetQueueConfirmed().Offset())
+		test.Equal(t, last.CurCnt, dqReader.GetQueueConfirmed().TotalMsgCnt())
+		dqReader.Close()
+	}
+}
+
+func TestDiskQueueReaderInvalidSyncPolicy(t *testing.T) {
+	dqName := "test_disk_queue_invalid_sync" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	queue, _ := NewDiskQueueWriter(dqName, tmpDir, 1024, 4, 1<<10, 1)
+	dqWriter := queue.(*diskQueueWriter)
+	defer dqWriter.Close()
+
+	msgNum := 10
+	for i := 0; i < msgNum; i++ {
+		dqWriter.Put([]byte("test"))
+	}
+	dqWriter.Flush()
+	end := dqWriter.GetQueueWriteEnd()
+
+	for i, timeout := range []time.Duration{0, -time.Second} {
+		metaName := dqName + strconv.Itoa(i)
+		dqReader, err := newDiskQueueReader(dqName, metaName, tmpDir, 1024, 4, 1<<10, int64(-i), timeout, nil, true)
+		test.Nil(t, err)
+		dqReader.UpdateQueueEnd(end, false)
+		syncEvery, syncTimeout := dqReader.(*diskQueueReader).GetSyncPolicy()
+		test.Equal(t, int64(1), syncEvery)
+		test.Equal(t, defaultSyncTimeout, syncTimeout)
+
+		ret, ok := dqReader.TryReadOne()
+		test.Equal(t, true, ok)
+		test.Nil(t, ret.Err)
+		err = dqReader.ConfirmRead(ret.Offset+ret.MovedSize, ret.CurCnt)
+		test.Nil(t, err)
+		dqReader.(*diskQueueReader).Flush()
+		// the meta should be synced on each confirm
+		dqReader2, err := newDiskQueueReader(dqName, metaName, tmpDir, 1024, 4, 1<<10, 1, 2*time.Second, nil, true)
+		test.Nil(t, err)
+		test.Equal(t, ret.Offset+ret.MovedSize, dqReader2.GetQueueConfirmed().Offset())
+		dqReader2.Close()
+		dqReader.Close()
+	}
+}
+
+type countCorruptLogger struct {
+	sync.Mutex
+	metaName string
+	readErrs int
+	lines    int
+}
+
+func (l *countCorruptLogger) count(s string) error {
+	if !strings.Contains(s, "diskqueue("+l.metaName+")") {
+		return nil
+	}
+	l.Lock()
+	if strings.Contains(s, "reading from") {
+		l.readErrs++
+	}
+	l.lines++
+	l.Unlock()
+	return nil
+}
+
+func (l *countCorruptLogger) Output(maxdepth int, s string) error        { return l.count(s) }
+func (l *countCorruptLogger) OutputErr(maxdepth int, s string) error     { return l.count(s) }
+func (l *countCorruptLogger) OutputWarning(maxdepth int, s string) error { return l.count(s) }
+
+func TestDiskQueueReaderCorruptLogLimited(t *testing.T) {
+	dqName := "test_disk_queue_corrupt_log" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	queue, _ := NewDiskQueueWriter(dqName, tmpDir, 64, 4, 1<<10, 1)
+	dqWriter := queue.(*diskQueueWriter)
+	defer dqWriter.Close()
+
+	msgNum := 400
+	for i := 0; i < msgNum; i++ {
+		dqWriter.Put([]byte("test"))
+	}
+	dqWriter.Flush()
+	end := dqWriter.GetQueueWriteEnd()
+	invalidFiles := int64(30)
+	zeroFiles := int64(5)
+	test.Equal(t, true, end.(*diskQueueEndInfo).EndOffset.FileNum > invalidFiles+zeroFiles)
+
+	dqReader, _ := newDiskQueueReader(dqName, dqName, tmpDir, 64, 4, 1<<10, 1, 2*time.Second, nil, true)
+	defer dqReader.Close()
+	dqReader.UpdateQueueEnd(end, false)
+	reader := dqReader.(*diskQueueReader)
+	// the invalid size first and then the zero size, so there are 2 distinct errors
+	for i := int64(0); i < invalidFiles+zeroFiles; i++ {
+		f, err := os.OpenFile(reader.dataFileName(i), os.O_RDWR, 0644)
+		test.Nil(t, err)
+		header := []byte{0xff, 0xff, 0xff, 0xff}
+		if i >= invalidFiles {
+			header = []byte{0, 0, 0, 0}
+		}
+		_, err = f.WriteAt(header, 0)
+		test.Nil(t, err)
+		f.Close()
+	}
+
+	logger := &countCorruptLogger{metaName: dqName}
+	oldLogger := nsqLog.Logger
+	SetLogger(logger)
+	defer SetLogger(oldLogger)
+	ret, ok := dqReader.TryReadOne()
+	SetLogger(oldLogger)
+	test.Equal(t, true, ok)
+	test.Nil(t, ret.Err)
+	test.Equal(t, "test", string(ret.Data))
+	test.Equal(t, invalidFiles+zeroFiles, reader.CorruptSkipCount())
+	test.Equal(t, invalidFiles+zeroFiles, dqReader.GetQueueConfirmed().(*diskQueueEndInfo).EndOffset.FileNum)
+	logger.Lock()
+	defer logger.Unlock()
+	test.Equal(t, 2, logger.readErrs)
+	if int64(logger.lines) >= invalidFiles {
+		t.Fatalf("the corruption logs should be limited: %v", logger.lines)
+	}
+}
+
+func TestDiskQueueReaderWatchConfirmed(t *testing.T) {
+	dqName := "test_disk_queue_watch_confirmed" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	queue, _ := NewDiskQueueWriter(dqName, tmpDir, 1024, 4, 1<<10, 1)
+	dqWriter := queue.(*diskQueueWriter)
+	defer dqWriter.Close()
+
+	msgNum := 20
+	for i := 0; i < msgNum; i++ {
+		dqWriter.Put([]byte("test"))
+	}
+	dqWriter.Flush()
+	end := dqWriter.GetQueueWriteEnd()
+
+	dqReader, _ := newDiskQueueReader(dqName, dqName, tmpDir, 1024, 4, 1<<10, 1, 2*time.Second, nil, true)
+	dqReader.UpdateQueueEnd(end, false)
+	watchCh := dqReader.(*diskQueueReader).WatchConfirmed()
+
+	var observed []BackendOffset
+	done := make(chan bool)
+	go func() {
+		for offset := range watchCh {
+			observed = append(observed, offset)
+			// slow watcher to make the updates coalesced
+			time.Sleep(time.Millisecond)
+		}
+		close(done)
+	}()
+
+	var last ReadResult
+	for i := 0; i < msgNum; i++ {
+		last, _ = dqReader.TryReadOne()
+		err = dqReader.ConfirmRead(last.Offset+last.MovedSize, last.CurCnt)
+		test.Nil(t, err)
+	}
+	// confirm to the same offset should not be notified
+	err = dqReader.ConfirmRead(last.Offset+last.MovedSize, last.CurCnt)
+	test.Nil(t, err)
+	// wait the last notify received before close
+	time.Sleep(time.Millisecond * 100)
+	dqReader.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("watch channel should be closed while the reader exits")
+	}
+
+	t.Logf("observed confirmed: %v", observed)
+	test.Equal(t, true, len(observed) > 0)
+	test.Equal(t, true, len(observed) <= msgNum)
+	for i := 1; i < len(observed); i++ {
+		test.Equal(t, true, observed[i] > observed[i-1])
+	}
+	test.Equal(t, end.Offset(), observed[len(observed)-1])
+
+	// watch after exit should get the closed channel
+	_, ok := <-dqReader.(*diskQueueReader).WatchConfirmed()
+	test.Equal(t, false, ok)
+}
+
+func TestDiskQueueReaderCustomFileNamePattern(t *testing.T) {
+	for _, p := range []string{"%s.data.dat", "%06d.%s.dat", "%s/%06d.dat", "%s.%06d.%d.dat", "%s.%d.dat"} {
+		err := SetQueueFileNamePattern(p, "")
+		test.NotNil(t, err)
+	}
+	test.NotNil(t, SetQueueFileNamePattern("", "reader.meta"))
+	test.NotNil(t, SetQueueFileNamePattern("%s.same.%06d", "%s.same.%06d"))
+
+	err := SetQueueFileNamePattern("%s.custom.%06d.log", "%s.custom.reader.meta")
+	test.Nil(t, err)
+	defer SetQueueFileNamePattern("", "")
+
+	dqName := "test_disk_queue_file_pattern" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	queue, _ := NewDiskQueueWriter(dqName, tmpDir, 1024, 4, 1<<10, 1)
+	dqWriter := queue.(*diskQueueWriter)
+	defer dqWriter.Close()
+
+	msgNum := 300
+	for i := 0; i < msgNum; i++ {
+		dqWriter.Put([]byte("test" + strconv.Itoa(i)))
+	}
+	dqWriter.Flush()
+	end := dqWriter.GetQueueWriteEnd()
+	test.Equal(t, true, end.(*diskQueueEndInfo).EndOffset.FileNum > 0)
+
+	dqReader, _ := newDiskQueueReader(dqName, dqName, tmpDir, 1024, 4, 1<<10, 1, 2*time.Second, nil, true)
+	dqReader.UpdateQueueEnd(end, false)
+	for i := 0; i < msgNum; i++ {
+		ret, hasData := dqReader.TryReadOne()
+		test.Equal(t, true, hasData)
+		test.Nil(t, ret.Err)
+		test.Equal(t, "test"+strconv.Itoa(i), string(ret.Data))
+	}
+	err = dqReader.ConfirmRead(end.Offset(), end.TotalMsgCnt())
+	test.Nil(t, err)
+	dqReader.Close()
+
+	files, err := filepath.Glob(path.Join(tmpDir, dqName+".custom.*.log"))
+	test.Nil(t, err)
+	test.Equal(t, int(end.(*diskQueueEndInfo).EndOffset.FileNum+1), len(files))
+	_, err = os.Stat(GetQueueFileName(tmpDir, dqName, 0))
+	test.Nil(t, err)
+	test.Equal(t, path.Join(tmpDir, dqName+".custom.000000.log"), GetQueueFileName(tmpDir, dqName, 0))
+	test.Equal(t, path.Join(tmpDir, dqName+".custom.001000000.log"), GetQueueFileName(tmpDir, dqName, 1000000))
+	_, err = os.Stat(path.Join(tmpDir, dqName+".custom.reader.meta"))
+	test.Nil(t, err)
+	_, err = os.Stat(path.Join(tmpDir, dqName+".diskqueue.000000.dat"))
+	test.Equal(t, true, os.IsNotExist(err))
+	_, err = os.Stat(path.Join(tmpDir, dqName+".diskqueue.meta.v2.reader.dat"))
+	test.Equal(t, true, os.IsNotExist(err))
+
+	// the reader should restore from the meta under the custom pattern
+	dqReader, _ = newDiskQueueReader(dqName, dqName, tmpDir, 1024, 4, 1<<10, 1, 2*time.Second, nil, true)
+	test.Equal(t, end.Offset(), dqReader.GetQueueConfirmed().Offset())
+	dqReader.Close()
+}
+
+func TestDiskQueueReaderBufferedBytes(t *testing.T) {
+	dqName := "test_disk_queue_buffered_bytes" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	queue, _ := NewDiskQueueWriter(dqName, tmpDir, 1024, 4, 1<<10, 1)
+	dqWriter := queue.(*diskQueueWriter)
+	defer dqWriter.Close()
+
+	msgNum := 20
+	for i := 0; i < msgNum; i++ {
+		dqWriter.Put([]byte("test"))
+	}
+	dqWriter.Flush()
+	end := dqWriter.GetQueueWriteEnd()
+
+	dqReader, _ := newDiskQueueReader(dqName, dqName, tmpDir, 1024, 4, 1<<10, 1, 2*time.Second, nil, true)
+	defer dqReader.Close()
+	dqReader.UpdateQueueEnd(end, false)
+	reader := dqReader.(*diskQueueReader)
+	test.Equal(t, int64(0), reader.GetBufferedBytes())
+
+	// each message has 4 bytes size header and 4 bytes body, all in the same file
+	msgSize := int64(8)
+	for i := 0; i < msgNum/2; i++ {
+		ret, ok := dqReader.TryReadOne()
+		test.Equal(t, true, ok)
+		test.Nil(t, ret.Err)
+		test.Equal(t, int64(msgNum-i-1)*msgSize, reader.GetBufferedBytes())
+	}
+	dqReader.ResetReadToConfirmed()
+	test.Equal(t, int64(0), reader.GetBufferedBytes())
+	for i := 0; i < msgNum; i++ {
+		_, ok := dqReader.TryReadOne()
+		test.Equal(t, true, ok)
+	}
+	test.Equal(t, int64(0), reader.GetBufferedBytes())
+}
+
+func TestDiskQueueReaderConfirmPastMessage(t *testing.T) {
+	dqName := "test_disk_queue_confirm_past" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	queue, _ := NewDiskQueueWriter(dqName, tmpDir, 1024, 4, 1<<10, 1)
+	dqWriter := queue.(*diskQueueWriter)
+	defer dqWriter.Close()
+
+	msgNum := 10
+	for i := 0; i < msgNum; i++ {
+		dqWriter.Put([]byte("test" + strconv.Itoa(i)))
+	}
+	dqWriter.Flush()
+	end := dqWriter.GetQueueWriteEnd()
+
+	dqReader, _ := newDiskQueueReader(dqName, dqName, tmpDir, 1024, 4, 1<<10, 1, 2*time.Second, nil, true)
+	defer dqReader.Close()
+	dqReader.UpdateQueueEnd(end, false)
+	reader := dqReader.(*diskQueueReader)
+
+	first, ok := dqReader.TryReadOne()
+	test.Equal(t, true, ok)
+	err = dqReader.ConfirmRead(first.Offset+first.MovedSize, first.CurCnt)
+	test.Nil(t, err)
+	// read ahead of the poison message should be reset
+	poison, _ := dqReader.TryReadOne()
+	test.Equal(t, "test1", string(poison.Data))
+	dqReader.TryReadOne()
+
+	_, err = reader.ConfirmPastMessageAt(0)
+	test.Equal(t, ErrNotConfirmedFrontier, err)
+	newConfirmed, err := reader.ConfirmPastMessageAt(poison.Offset)
+	test.Nil(t, err)
+	test.Equal(t, poison.Offset+poison.MovedSize, newConfirmed)
+	test.Equal(t, newConfirmed, dqReader.GetQueueConfirmed().Offset())
+	test.Equal(t, poison.CurCnt, dqReader.GetQueueConfirmed().TotalMsgCnt())
+
+	next, ok := dqReader.TryReadOne()
+	test.Equal(t, true, ok)
+	test.Nil(t, next.Err)
+	test.Equal(t, newConfirmed, next.Offset)
+	test.Equal(t, "test2", string(next.Data))
+}
+
+func TestDiskQueueReaderReadBatchMaxBytes(t *testing.T) {
+	dqName := "test_disk_queue_read_batch" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	queue, _ := NewDiskQueueWriter(dqName, tmpDir, 1024, 4, 1<<10, 1)
+	dqWriter := queue.(*diskQueueWriter)
+	defer dqWriter.Close()
+
+	msgNum := 20
+	for i := 0; i < msgNum; i++ {
+		dqWriter.Put([]byte("test" + strconv.Itoa(i%10)))
+	}
+	dqWriter.Flush()
+	end := dqWriter.GetQueueWriteEnd()
+
+	dqReader, _ := newDiskQueueReader(dqName, dqName, tmpDir, 1024, 4, 1<<10, 1, 2*time.Second, nil, true)
+	defer dqReader.Close()
+	dqReader.UpdateQueueEnd(end, false)
+	reader := dqReader.(*diskQueueReader)
+
+	// each message body has 5 bytes
+	rets := reader.ReadBatch(10, 9)
+	test.Equal(t, 1, len(rets))
+	test.Equal(t, "test0", string(rets[0].Data))
+	// at least one message even if the budget is less than one message
+	rets = reader.ReadBatch(10, 1)
+	test.Equal(t, 1, len(rets))
+	test.Equal(t, "test1", string(rets[0].Data))
+
+	rets = reader.ReadBatch(10, 22)
+	test.Equal(t, 4, len(rets))
+	for i, ret := range rets {
+		test.Nil(t, ret.Err)
+		test.Equal(t, "test"+strconv.Itoa(i+2), string(ret.Data))
+	}
+	last := rets[len(rets)-1]
+	// the message exceeding the budget should be read next time
+	next, ok := dqReader.TryReadOne()
+	test.Equal(t, true, ok)
+	test.Equal(t, last.Offset+last.MovedSize, next.Offset)
+	test.Equal(t, last.CurCnt+1, next.CurCnt)
+	test.Equal(t, "test6", string(next.Data))
+	test.Equal(t, int32(1), next.Attempts)
+
+	err = dqReader.ConfirmRead(next.Offset+next.MovedSize, next.CurCnt)
+	test.Nil(t, err)
+	test.Equal(t, next.Offset+next.MovedSize, dqReader.GetQueueConfirmed().Offset())
+
+	// the count limit works without the bytes budget
+	rets = reader.ReadBatch(5, 0)
+	test.Equal(t, 5, len(rets))
+	test.Equal(t, "test7", string(rets[0].Data))
+	rets = reader.ReadBatch(100, 0)
+	test.Equal(t, msgNum-12, len(rets))
+	rets = reader.ReadBatch(100, 0)
+	test.Equal(t, 0, len(rets))
+}
+
+func TestDiskQueueReaderRebuildOffsetMeta(t *testing.T) {
+	dqName := "test_disk_queue_rebuild_offset_meta" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	queue, _ := NewDiskQueueWriter(dqName, tmpDir, 1024, 4, 1<<10, 1)
+	dqWriter := queue.(*diskQueueWriter)
+	defer dqWriter.Close()
+
+	msgNum := 400
+	for i := 0; i < msgNum; i++ {
+		dqWriter.Put([]byte("test"))
+	}
+	dqWriter.Flush()
+	end := dqWriter.GetQueueWriteEnd()
+	test.Equal(t, true, end.(*diskQueueEndInfo).EndOffset.FileNum > 2)
+
+	var expectedCnts, expectedStarts, expectedEnds []int64
+	for i := int64(0); i < 2; i++ {
+		cnt, startPos, endPos, err := getQueueFileOffsetMeta(dqWriter.fileName(i))
+		test.Nil(t, err)
+		expectedCnts = append(expectedCnts, cnt)
+		expectedStarts = append(expectedStarts, startPos)
+		expectedEnds = append(expectedEnds, endPos)
+		os.Remove(dqWriter.fileName(i) + ".offsetmeta.dat")
+	}
+
+	SetRebuildOffsetMeta(true)
+	defer SetRebuildOffsetMeta(false)
+	dqReader, _ := newDiskQueueReader(dqName, dqName, tmpDir, 1024, 4, 1<<10, 1, 2*time.Second, nil, true)
+	defer dqReader.Close()
+	dqReader.UpdateQueueEnd(end, false)
+	reader := dqReader.(*diskQueueReader)
+
+	start, err := reader.GetFileStart(2)
+	test.Nil(t, err)
+	test.Equal(t, BackendOffset(expectedEnds[1]), start.Offset())
+	test.Equal(t, expectedCnts[1], start.TotalMsgCnt())
+	for i := int64(0); i < 2; i++ {
+		cnt, startPos, endPos, err := getQueueFileOffsetMeta(dqWriter.fileName(i))
+		test.Nil(t, err)
+		test.Equal(t, expectedCnts[i], cnt)
+		test.Equal(t, expectedStarts[i], startPos)
+		test.Equal(t, expectedEnds[i], endPos)
+		tmpFiles, err := filepath.Glob(dqWriter.fileName(i) + ".offsetmeta.dat.*.tmp")
+		test.Nil(t, err)
+		test.Equal(t, 0, len(tmpFiles))
+	}
+	// rebuild again should be the same
+	cnt, startPos, endPos, err := reader.rebuildFileOffsetMeta(1)
+	test.Nil(t, err)
+	test.Equal(t, expectedCnts[1], cnt)
+	test.Equal(t, expectedStarts[1], startPos)
+	test.Equal(t, expectedEnds[1], endPos)
+
+	// the next file should be read from the rebuilt offset
+	_, err = reader.ResetReadToFile(2)
+	test.Nil(t, err)
+	ret, ok := dqReader.TryReadOne()
+	test.Equal(t, true, ok)
+	test.Nil(t, ret.Err)
+	test.Equal(t, BackendOffset(expectedEnds[1]), ret.Offset)
+	test.Equal(t, expectedCnts[1]+1, ret.CurCnt)
+	test.Equal(t, "test", string(ret.Data))
+}
+
+func TestDiskQueueReaderSkipFileHeader(t *testing.T) {
+	dqName := "test_disk_queue_file_header" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	queue, _ := NewDiskQueueWriter(dqName, tmpDir, 1024, 4, 1<<10, 1)
+	dqWriter := queue.(*diskQueueWriter)
+	defer dqWriter.Close()
+
+	msgNum := 300
+	for i := 0; i < msgNum; i++ {
+		dqWriter.Put([]byte("test" + strconv.Itoa(i)))
+	}
+	dqWriter.Flush()
+	end := dqWriter.GetQueueWriteEnd()
+	test.Equal(t, true, end.(*diskQueueEndInfo).EndOffset.FileNum > 1)
+
+	dqReader, _ := newDiskQueueReader(dqName, "no_header", tmpDir, 1024, 4, 1<<10, 1, 2*time.Second, nil, true)
+	dqReader.UpdateQueueEnd(end, false)
+	var expected []ReadResult
+	for i := 0; i < msgNum; i++ {
+		ret, ok := dqReader.TryReadOne()
+		test.Equal(t, true, ok)
+		test.Nil(t, ret.Err)
+		expected = append(expected, ret)
+	}
+	dqReader.Close()
+
+	// prepend the header to each data file like the external writer
+	header := []byte("HEADER01")
+	for i := int64(0); i <= end.(*diskQueueEndInfo).EndOffset.FileNum; i++ {
+		data, err := ioutil.ReadFile(dqWriter.fileName(i))
+		test.Nil(t, err)
+		err = ioutil.WriteFile(dqWriter.fileName(i), append(append([]byte{}, header...), data...), 0644)
+		test.Nil(t, err)
+	}
+
+	dqReader, _ = newDiskQueueReader(dqName, "with_header", tmpDir, 1024, 4, 1<<10, 1, 2*time.Second, nil, true)
+	defer dqReader.Close()
+	test.Equal(t, ErrInvalidFileHeaderLen, dqReader.(*diskQueueReader).SetFileHeaderLen(-1))
+	test.Nil(t, dqReader.(*diskQueueReader).SetFileHeaderLen(int64(len(header))))
+	dqReader.UpdateQueueEnd(end, false)
+	for i := 0; i < msgNum; i++ {
+		ret, ok := dqReader.TryReadOne()
+		test.Equal(t, true, ok)
+		test.Nil(t, ret.Err)
+		test.Equal(t, expected[i].Offset, ret.Offset)
+		test.Equal(t, expected[i].MovedSize, ret.MovedSize)
+		test.Equal(t, expected[i].CurCnt, ret.CurCnt)
+		test.Equal(t, string(expected[i].Data), string(ret.Data))
+	}
+	_, ok := dqReader.TryReadOne()
+	test.Equal(t, false, ok)
+	reader := dqReader.(*diskQueueReader)
+	test.Equal(t, end.Offset(), reader.GetQueueCurrentRead().Offset())
+
+	// step back across the files should exclude the headers
+	pos := msgNum / 3
+	_, err = reader.ResetReadToOffset(expected[pos].Offset, expected[pos].CurCnt-1)
+	test.Nil(t, err)
+	ret, ok := dqReader.TryReadOne()
+	test.Equal(t, true, ok)
+	test.Nil(t, ret.Err)
+	test.Equal(t, expected[pos].Offset, ret.Offset)
+	test.Equal(t, string(expected[pos].Data), string(ret.Data))
+}
+
+func TestDiskQueueReaderCorruptionPolicy(t *testing.T) {
+	for _, policy := range []string{CorruptionPolicySkipFile, CorruptionPolicySkipToEnd, CorruptionPolicyHalt} {
+		testDiskQueueReaderCorruptionPolicy(t, policy)
+	}
+}
+
+func testDiskQueueReaderCorruptionPolicy(t *testing.T, policy string) {
+	dqName := "test_disk_queue_corruption" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	queue, _ := NewDiskQueueWriter(dqName, tmpDir, 1024, 4, 1<<10, 1)
+	dqWriter := queue.(*diskQueueWriter)
+	defer dqWriter.Close()
+
+	msgNum := 300
+	for i := 0; i < msgNum; i++ {
+		dqWriter.Put([]byte("test" + strconv.Itoa(i)))
+	}
+	dqWriter.Flush()
+	end := dqWriter.GetQueueWriteEnd()
+	test.Equal(t, true, end.(*diskQueueEndInfo).EndOffset.FileNum > 1)
+	_, _, firstFileEnd, err := getQueueFileOffsetMeta(dqWriter.fileName(0))
+	test.Nil(t, err)
+
+	// corrupt the size of the 10th message in the first file,
+	// each of the first 10 messages has 4 bytes size and 5 bytes body
+	okNum := 9
+	corruptPos := int64(okNum * 9)
+	f, err := os.OpenFile(dqWriter.fileName(0), os.O_RDWR, 0644)
+	test.Nil(t, err)
+	_, err = f.WriteAt([]byte{0xff, 0xff, 0xff, 0xff}, corruptPos)
+	test.Nil(t, err)
+	f.Close()
+
+	dqReader, _ := newDiskQueueReader(dqName, dqName, tmpDir, 1024, 4, 1<<10, 1, 2*time.Second, nil, true)
+	defer dqReader.Close()
+	reader := dqReader.(*diskQueueReader)
+	test.Equal(t, ErrInvalidCorruptionPolicy, reader.SetCorruptionPolicy("unknown"))
+	test.Nil(t, reader.SetCorruptionPolicy(policy))
+	dqReader.UpdateQueueEnd(end, false)
+	for i := 0; i < okNum; i++ {
+		ret, ok := dqReader.TryReadOne()
+		test.Equal(t, true, ok)
+		test.Nil(t, ret.Err)
+		test.Equal(t, "test"+strconv.Itoa(i), string(ret.Data))
+	}
+	ret, ok := dqReader.TryReadOne()
+	switch policy {
+	case CorruptionPolicySkipFile:
+		// skipped to the next file
+		test.Equal(t, true, ok)
+		test.Nil(t, ret.Err)
+		test.Equal(t, BackendOffset(firstFileEnd), ret.Offset)
+		test.Equal(t, int64(1), reader.GetQueueCurrentRead().(*diskQueueEndInfo).EndOffset.FileNum)
+		test.Equal(t, BackendOffset(firstFileEnd), dqReader.GetQueueConfirmed().Offset())
+	case CorruptionPolicySkipToEnd:
+		test.Equal(t, false, ok)
+		test.Equal(t, end.Offset(), reader.GetQueueCurrentRead().Offset())
+		test.Equal(t, end.Offset(), dqReader.GetQueueConfirmed().Offset())
+	case CorruptionPolicyHalt:
+		test.Equal(t, true, ok)
+		test.NotNil(t, ret.Err)
+		test.Equal(t, true, reader.IsCorruptionHalted())
+		// the read position is unchanged while halted
+		_, ok = dqReader.TryReadOne()
+		test.Equal(t, false, ok)
+		test.Equal(t, BackendOffset(corruptPos), reader.GetQueueCurrentRead().Offset())
+		test.Equal(t, true, reader.IsCorruptionHalted())
+
+		// resumed by skipping manually
+		_, err = reader.SkipToNext()
+		test.Nil(t, err)
+		test.Equal(t, false, reader.IsCorruptionHalted())
+		ret, ok = dqReader.TryReadOne()
+		test.Equal(t, true, ok)
+		test.Nil(t, ret.Err)
+		test.Equal(t, BackendOffset(firstFileEnd), ret.Offset)
+	}
+}
+
+func TestDiskQueueReaderOrderedAcrossRollWithError(t *testing.T) {
+	dqName := "test_disk_queue_roll_order" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	queue, _ := NewDiskQueueWriter(dqName, tmpDir, 1024, 4, 1<<10, 1)
+	dqWriter := queue.(*diskQueueWriter)
+	defer dqWriter.Close()
+
+	msgNum := 150
+	for i := 0; i < msgNum; i++ {
+		dqWriter.Put([]byte("test" + strconv.Itoa(i)))
+	}
+	dqWriter.Flush()
+	end := dqWriter.GetQueueWriteEnd()
+	test.Equal(t, int64(1), end.(*diskQueueEndInfo).EndOffset.FileNum)
+	firstFileCnt, _, firstFileEnd, err := getQueueFileOffsetMeta(dqWriter.fileName(0))
+	test.Nil(t, err)
+
+	// corrupt the first message of the last file, so the error happens right after the roll
+	f, err := os.OpenFile(dqWriter.fileName(1), os.O_RDWR, 0644)
+	test.Nil(t, err)
+	_, err = f.WriteAt([]byte{0xff, 0xff, 0xff, 0xff}, 0)
+	test.Nil(t, err)
+	f.Close()
+
+	dqReader, _ := newDiskQueueReader(dqName, dqName, tmpDir, 1024, 4, 1<<10, 1, 2*time.Second, nil, true)
+	defer dqReader.Close()
+	reader := dqReader.(*diskQueueReader)
+	dqReader.UpdateQueueEnd(end, false)
+	// read the whole first file without any confirm
+	var rets []ReadResult
+	next := BackendOffset(0)
+	for i := int64(0); i < firstFileCnt; i++ {
+		ret, ok := dqReader.TryReadOne()
+		test.Equal(t, true, ok)
+		test.Nil(t, ret.Err)
+		test.Equal(t, next, ret.Offset)
+		test.Equal(t, "test"+strconv.Itoa(int(i)), string(ret.Data))
+		next = ret.Offset + ret.MovedSize
+		rets = append(rets, ret)
+	}
+	test.Equal(t, BackendOffset(firstFileEnd), next)
+
+	_, ok := dqReader.TryReadOne()
+	test.Equal(t, false, ok)
+	test.Equal(t, end.Offset(), reader.GetQueueCurrentRead().Offset())
+	// the messages of the first file in flight are not confirmed by the skip
+	test.Equal(t, BackendOffset(0), dqReader.GetQueueConfirmed().Offset())
+	last := rets[len(rets)-1]
+	err = dqReader.ConfirmRead(last.Offset+last.MovedSize, last.CurCnt)
+	test.Nil(t, err)
+	// the confirmed moves past the skipped data after the messages in flight
+	test.Equal(t, end.Offset(), dqReader.GetQueueConfirmed().Offset())
+
+	// the new data is read in order after the skipped
+	for i := msgNum; i < msgNum+10; i++ {
+		dqWriter.Put([]byte("test" + strconv.Itoa(i)))
+	}
+	dqWriter.Flush()
+	dqReader.UpdateQueueEnd(dqWriter.GetQueueWriteEnd(), false)
+	next = end.Offset()
+	for i := msgNum; i < msgNum+10; i++ {
+		ret, ok := dqReader.TryReadOne()
+		test.Equal(t, true, ok)
+		test.Nil(t, ret.Err)
+		test.Equal(t, next, ret.Offset)
+		test.Equal(t, "test"+strconv.Itoa(i), string(ret.Data))
+		next = ret.Offset + ret.MovedSize
+	}
+	test.Equal(t, int64(0), reader.GetReadOrderViolations())
+}
+
+func TestDiskQueueReaderReadOrderViolation(t *testing.T) {
+	dqName := "test_disk_queue_read_order" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	queue, _ := NewDiskQueueWriter(dqName, tmpDir, 1024, 4, 1<<10, 1)
+	dqWriter := queue.(*diskQueueWriter)
+	defer dqWriter.Close()
+	for i := 0; i < 10; i++ {
+		dqWriter.Put([]byte("test" + strconv.Itoa(i)))
+	}
+	dqWriter.Flush()
+
+	dqReader, _ := newDiskQueueReader(dqName, dqName, tmpDir, 1024, 4, 1<<10, 1, 2*time.Second, nil, true)
+	defer dqReader.Close()
+	reader := dqReader.(*diskQueueReader)
+	dqReader.UpdateQueueEnd(dqWriter.GetQueueWriteEnd(), false)
+	first, ok := dqReader.TryReadOne()
+	test.Equal(t, true, ok)
+	second, ok := dqReader.TryReadOne()
+	test.Equal(t, true, ok)
+
+	// the read position is restored if the message is not read at it
+	reader.Lock()
+	prev := reader.readQueueInfo
+	test.Equal(t, false, reader.checkReadOrder(prev, first))
+	test.Equal(t, prev, reader.readQueueInfo)
+	test.Equal(t, true, reader.checkReadOrder(prev, ReadResult{Offset: second.Offset + second.MovedSize}))
+	reader.Unlock()
+	test.Equal(t, int64(1), reader.GetReadOrderViolations())
+	ret, ok := dqReader.TryReadOne()
+	test.Equal(t, true, ok)
+	test.Equal(t, second.Offset+second.MovedSize, ret.Offset)
+	test.Equal(t, "test2", string(ret.Data))
+}
+
+func TestDiskQueueReaderResyncEnd(t *testing.T) {
+	dqName := "test_disk_queue_resync_end" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	queue, _ := NewDiskQueueWriter(dqName, tmpDir, 1024, 4, 1<<10, 1)
+	dqWriter := queue.(*diskQueueWriter)
+	defer dqWriter.Close()
+
+	msgNum := 4
+	for i := 0; i < msgNum; i++ {
+		dqWriter.Put([]byte("test" + strconv.Itoa(i)))
+	}
+	dqWriter.Flush()
+	end := dqWriter.GetQueueWriteEnd()
+
+	dqReader, _ := newDiskQueueReader(dqName, dqName, tmpDir, 1024, 4, 1<<10, 1, 2*time.Second, nil, true)
+	defer dqReader.Close()
+	dqReader.UpdateQueueEnd(end, false)
+	reader := dqReader.(*diskQueueReader)
+
+	first, ok := dqReader.TryReadOne()
+	test.Equal(t, true, ok)
+	err = dqReader.ConfirmRead(first.Offset+first.MovedSize, first.CurCnt)
+	test.Nil(t, err)
+
+	// the end position drifted while the virtual end is the same as the writer
+	reader.Lock()
+	reader.queueEndInfo.EndOffset = reader.readQueueInfo.EndOffset
+	reader.Unlock()
+	_, ok = dqReader.TryReadOne()
+	test.Equal(t, false, ok)
+	changed, err := dqReader.UpdateQueueEnd(end, false)
+	test.Nil(t, err)
+	test.Equal(t, false, changed)
+	_, ok = dqReader.TryReadOne()
+	test.Equal(t, false, ok)
+
+	err = reader.ResyncEnd(&diskQueueEndInfo{})
+	test.Equal(t, ErrResyncEndTooOld, err)
+	err = reader.ResyncEnd(end)
+	test.Nil(t, err)
+	test.Equal(t, end.Offset(), dqReader.GetQueueReadEnd().Offset())
+	for i := 1; i < msgNum; i++ {
+		ret, ok := dqReader.TryReadOne()
+		test.Equal(t, true, ok)
+		test.Nil(t, ret.Err)
+		test.Equal(t, "test"+strconv.Itoa(i), string(ret.Data))
+	}
+	_, ok = dqReader.TryReadOne()
+	test.Equal(t, false, ok)
+}
+
+func TestDiskQueueReaderSkipMessages(t *testing.T) {
+	dqName := "test_disk_queue_skip_messages" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	queue, _ := NewDiskQueueWriter(dqName, tmpDir, 1024, 4, 1<<10, 1)
+	dqWriter := queue.(*diskQueueWriter)
+	defer dqWriter.Close()
+
+	msgNum := 10
+	for i := 0; i < msgNum; i++ {
+		dqWriter.Put([]byte("test" + strconv.Itoa(i)))
+	}
+	dqWriter.Flush()
+	end := dqWriter.GetQueueWriteEnd()
+
+	dqReader, _ := newDiskQueueReader(dqName, dqName, tmpDir, 1024, 4, 1<<10, 1, 2*time.Second, nil, true)
+	defer dqReader.Close()
+	dqReader.UpdateQueueEnd(end, false)
+	reader := dqReader.(*diskQueueReader)
+
+	// the read ahead is reset to the skipped position
+	dqReader.TryReadOne()
+	newConfirmed, skipped, err := reader.SkipMessages(3)
+	test.Nil(t, err)
+	test.Equal(t, int64(3), skipped)
+	test.Equal(t, newConfirmed, dqReader.GetQueueConfirmed().Offset())
+	test.Equal(t, int64(3), dqReader.GetQueueConfirmed().TotalMsgCnt())
+	ret, ok := dqReader.TryReadOne()
+	test.Equal(t, true, ok)
+	test.Equal(t, newConfirmed, ret.Offset)
+	test.Equal(t, "test3", string(ret.Data))
+
+	// skip to the end if not enough messages
+	newConfirmed, skipped, err = reader.SkipMessages(100)
+	test.Nil(t, err)
+	test.Equal(t, int64(msgNum-3), skipped)
+	test.Equal(t, end.Offset(), newConfirmed)
+	test.Equal(t, end.TotalMsgCnt(), dqReader.GetQueueConfirmed().TotalMsgCnt())
+	_, ok = dqReader.TryReadOne()
+	test.Equal(t, false, ok)
+	_, skipped, err = reader.SkipMessages(1)
+	test.Nil(t, err)
+	test.Equal(t, int64(0), skipped)
+}
+
+func TestDiskQueueReaderSkipMessagesAcrossFiles(t *testing.T) {
+	dqName := "test_disk_queue_skip_messages_files" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	queue, _ := NewDiskQueueWriter(dqName, tmpDir, 64, 4, 1<<10, 1)
+	dqWriter := queue.(*diskQueueWriter)
+	defer dqWriter.Close()
+
+	msgNum := 30
+	for i := 0; i < msgNum; i++ {
+		dqWriter.Put([]byte("test" + strconv.Itoa(i)))
+	}
+	dqWriter.Flush()
+	end := dqWriter.GetQueueWriteEnd()
+
+	dqReader, _ := newDiskQueueReader(dqName, dqName, tmpDir, 64, 4, 1<<10, 1, 2*time.Second, nil, true)
+	defer dqReader.Close()
+	dqReader.UpdateQueueEnd(end, false)
+	reader := dqReader.(*diskQueueReader)
+
+	startFile := dqReader.GetQueueConfirmed().(*diskQueueEndInfo).EndOffset.FileNum
+	_, skipped, err := reader.SkipMessages(12)
+	test.Nil(t, err)
+	test.Equal(t, int64(12), skipped)
+	confirmed := dqReader.GetQueueConfirmed().(*diskQueueEndInfo)
+	test.Equal(t, true, confirmed.EndOffset.FileNum > startFile)
+	test.Equal(t, int64(12), confirmed.TotalMsgCnt())
+	for i := 12; i < msgNum; i++ {
+		ret, ok := dqReader.TryReadOne()
+		test.Equal(t, true, ok)
+		test.Nil(t, ret.Err)
+		test.Equal(t, "test"+strconv.Itoa(i), string(ret.Data))
+	}
+}
+
+func TestDiskQueueReaderFileIntegrity(t *testing.T) {
+	dqName := "test_disk_queue_file_integrity" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	queue, _ := NewDiskQueueWriter(dqName, tmpDir, 64, 4, 1<<10, 1)
+	dqWriter := queue.(*diskQueueWriter)
+	defer dqWriter.Close()
+
+	for i := 0; i < 40; i++ {
+		dqWriter.Put([]byte(fmt.Sprintf("test%02d", i)))
+	}
+	dqWriter.Flush()
+	end := dqWriter.GetQueueWriteEnd()
+	test.Equal(t, true, end.(*diskQueueEndInfo).EndOffset.FileNum > 4)
+
+	dqReader, err := newDiskQueueReader(dqName, dqName, tmpDir, 64, 4, 1<<10, 1, 2*time.Second, end, true)
+	test.Nil(t, err)
+	issues, err := dqReader.(*diskQueueReader).CheckFileIntegrity()
+	test.Nil(t, err)
+	test.Equal(t, 0, len(issues))
+
+	// plant a gap at file 1 and an overlap of file 3 with file 2
+	os.Remove(dqWriter.fileName(1))
+	_, start2, _, err := getQueueFileOffsetMeta(dqWriter.fileName(2))
+	test.Nil(t, err)
+	cnt3, _, end3, err := getQueueFileOffsetMeta(dqWriter.fileName(3))
+	test.Nil(t, err)
+	test.Nil(t, saveQueueFileOffsetMeta(dqWriter.fileName(3), cnt3, start2, end3))
+
+	issues, err = dqReader.(*diskQueueReader).CheckFileIntegrity()
+	test.Nil(t, err)
+	test.Equal(t, 2, len(issues))
+	test.Equal(t, int64(1), issues[0].FileNum)
+	test.Equal(t, QueueFileGap, issues[0].Kind)
+	test.Equal(t, int64(3), issues[1].FileNum)
+	test.Equal(t, QueueFileOverlap, issues[1].Kind)
+	test.Equal(t, start2, issues[1].Start)
+	dqReader.Close()
+
+	// the writer found the same issues and only the writer quarantines the files
+	issues, err = dqWriter.CheckFileIntegrity()
+	test.Nil(t, err)
+	test.Equal(t, 2, len(issues))
+	err = dqWriter.checkFileIntegrityOnStart(false)
+	test.Equal(t, ErrQueueFileIntegrity, err)
+	_, err = os.Stat(dqWriter.fileName(3))
+	test.Nil(t, err)
+	dqReader, err = newDiskQueueReader(dqName, dqName, tmpDir, 64, 4, 1<<10, 1, 2*time.Second, end, true)
+	test.Nil(t, err)
+	defer dqReader.Close()
+	_, err = os.Stat(dqWriter.fileName(3))
+	test.Nil(t, err)
+
+	err = dqWriter.checkFileIntegrityOnStart(true)
+	test.Nil(t, err)
+	_, err = os.Stat(dqWriter.fileName(3))
+	test.Equal(t, true, os.IsNotExist(err))
+	_, err = os.Stat(dqWriter.fileName(3) + ".offsetmeta.dat")
+	test.Equal(t, true, os.IsNotExist(err))
+	// only the gaps left after the overlapped file quarantined
+	issues, err = dqReader.(*diskQueueReader).CheckFileIntegrity()
+	test.Nil(t, err)
+	test.Equal(t, 2, len(issues))
+	test.Equal(t, QueueFileGap, issues[0].Kind)
+	test.Equal(t, QueueFileGap, issues[1].Kind)
+	test.Equal(t, int64(3), issues[1].FileNum)
+}
+
+func TestDiskQueueReaderDeliveryFilter(t *testing.T) {
+	dqName := "test_disk_queue_delivery_filter" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	queue, _ := NewDiskQueueWriter(dqName, tmpDir, 1024, 4, 1<<10, 1)
+	dqWriter := queue.(*diskQueueWriter)
+	defer dqWriter.Close()
+
+	msgNum := 10
+	for i := 0; i < msgNum; i++ {
+		dqWriter.Put([]byte(fmt.Sprintf("test%02d", i)))
+	}
+	dqWriter.Flush()
+	end := dqWriter.GetQueueWriteEnd()
+
+	dqReader, _ := newDiskQueueReader(dqName, dqName, tmpDir, 1024, 4, 1<<10, 1, 2*time.Second, nil, true)
+	defer dqReader.Close()
+	dqReader.UpdateQueueEnd(end, false)
+	reader := dqReader.(*diskQueueReader)
+	reader.SetDeliveryFilter(func(offset BackendOffset, data []byte) bool {
+		i, err := strconv.Atoi(string(data[4:]))
+		return err == nil && i%2 == 1
+	})
+
+	var delivered []ReadResult
+	for {
+		ret, ok := dqReader.TryReadOne()
+		if !ok {
+			break
+		}
+		test.Nil(t, ret.Err)
+		delivered = append(delivered, ret)
+	}
+	test.Equal(t, msgNum/2, len(delivered))
+	for i, ret := range delivered {
+		test.Equal(t, fmt.Sprintf("test%02d", 2*i+1), string(ret.Data))
+	}
+	test.Equal(t, int64(msgNum/2), reader.FilteredCount())
+	// the first filtered is confirmed at once, the others are pending on the delivered before them
+	test.Equal(t, delivered[0].Offset, dqReader.GetQueueConfirmed().Offset())
+
+	err = dqReader.ConfirmRead(delivered[0].Offset+delivered[0].MovedSize, delivered[0].CurCnt)
+	test.Nil(t, err)
+	test.Equal(t, delivered[1].Offset, dqReader.GetQueueConfirmed().Offset())
+	last := delivered[len(delivered)-1]
+	err = dqReader.ConfirmRead(last.Offset+last.MovedSize, last.CurCnt)
+	test.Nil(t, err)
+	test.Equal(t, end.Offset(), dqReader.GetQueueConfirmed().Offset())
+	test.Equal(t, end.TotalMsgCnt(), dqReader.GetQueueConfirmed().TotalMsgCnt())
+	test.Equal(t, int64(0), dqReader.Depth())
+}
+
+func TestDiskQueueReaderFileMessageCount(t *testing.T) {
+	dqName := "test_disk_queue_file_msg_cnt" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	queue, _ := NewDiskQueueWriter(dqName, tmpDir, 64, 4, 1<<10, 1)
+	dqWriter := queue.(*diskQueueWriter)
+	defer dqWriter.Close()
+
+	msgNum := 40
+	for i := 0; i < msgNum; i++ {
+		dqWriter.Put([]byte(fmt.Sprintf("test%02d", i)))
+	}
+	dqWriter.Flush()
+	end := dqWriter.GetQueueWriteEnd()
+	lastFile := end.(*diskQueueEndInfo).EndOffset.FileNum
+	test.Equal(t, true, lastFile > 3)
+
+	dqReader, _ := newDiskQueueReader(dqName, dqName, tmpDir, 64, 4, 1<<10, 1, 2*time.Second, nil, true)
+	defer dqReader.Close()
+	dqReader.UpdateQueueEnd(end, false)
+	reader := dqReader.(*diskQueueReader)
+
+	var fileCnts []int64
+	var total int64
+	for i := int64(0); i < lastFile; i++ {
+		_, scanned, err := reader.countFileMessages(i)
+		test.Nil(t, err)
+		cnt, err := reader.FileMessageCount(i)
+		test.Nil(t, err)
+		test.Equal(t, scanned, cnt)
+		fileCnts = append(fileCnts, cnt)
+		total += cnt
+	}
+	_, lastCnt, err := reader.countFileMessages(lastFile)
+	test.Nil(t, err)
+	test.Equal(t, int64(msgNum), total+lastCnt)
+	// the file being written has no persisted count
+	_, err = reader.FileMessageCount(lastFile)
+	test.Equal(t, ErrMoveOffsetInvalid, err)
+
+	// the legacy file without the offset meta is scanned
+	os.Remove(dqWriter.fileName(2) + ".offsetmeta.dat")
+	cnt, err := reader.FileMessageCount(2)
+	test.Nil(t, err)
+	test.Equal(t, fileCnts[2], cnt)
+	cnt, err = reader.FileMessageCount(3)
+	test.Nil(t, err)
+	test.Equal(t, fileCnts[3], cnt)
+
+	// the skip over the whole file should use the persisted count without reading the data
+	f, err := os.OpenFile(dqWriter.fileName(1), os.O_RDWR, 0644)
+	test.Nil(t, err)
+	_, err = f.WriteAt(bytes.Repeat([]byte{0xff}, 8), 0)
+	test.Nil(t, err)
+	f.Close()
+	n := fileCnts[0] + fileCnts[1] + 1
+	_, skipped, err := reader.SkipMessages(n)
+	test.Nil(t, err)
+	test.Equal(t, n, skipped)
+	confirmed := dqReader.GetQueueConfirmed().(*diskQueueEndInfo)
+	test.Equal(t, n, confirmed.TotalMsgCnt())
+	test.Equal(t, int64(2), confirmed.EndOffset.FileNum)
+	ret, ok := dqReader.TryReadOne()
+	test.Equal(t, true, ok)
+	test.Nil(t, ret.Err)
+	test.Equal(t, fmt.Sprintf("test%02d", n), string(ret.Data))
+}
+
+func TestDiskQueueReaderRetainedBase(t *testing.T) {
+	dqName := "test_disk_queue_retained_base" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	queue, _ := NewDiskQueueWriter(dqName, tmpDir, 64, 4, 1<<10, 1)
+	dqWriter := queue.(*diskQueueWriter)
+	defer dqWriter.Close()
+
+	msgNum := 30
+	for i := 0; i < msgNum; i++ {
+		dqWriter.Put([]byte("test" + strconv.Itoa(i)))
+	}
+	dqWriter.Flush()
+	end := dqWriter.GetQueueWriteEnd()
+	test.Equal(t, true, end.(*diskQueueEndInfo).EndOffset.FileNum > 2)
+
+	dqReader, _ := newDiskQueueReader(dqName, dqName, tmpDir, 64, 4, 1<<10, 1, 2*time.Second, nil, true)
+	defer dqReader.Close()
+	dqReader.UpdateQueueEnd(end, false)
+	reader := dqReader.(*diskQueueReader)
+	expected := make([]ReadResult, 0, msgNum)
+	for i := 0; i < msgNum; i++ {
+		ret, ok := dqReader.TryReadOne()
+		test.Equal(t, true, ok)
+		test.Nil(t, ret.Err)
+		expected = append(expected, ret)
+	}
+
+	newStart, err := dqWriter.CleanOldDataByRetention(&diskQueueEndInfo{EndOffset: diskQueueOffset{FileNum: 2}}, false, 0)
+	test.Nil(t, err)
+	base, err := reader.getRetainedBase()
+	test.Nil(t, err)
+	test.Equal(t, newStart.Offset(), base.Offset())
+	test.Equal(t, newStart.TotalMsgCnt(), base.TotalMsgCnt())
+
+	// the offset in the cleaned files should return the specific error
+	_, err = reader.ResetReadToOffset(expected[1].Offset, expected[1].CurCnt-1)
+	test.Equal(t, ErrOffsetGarbageCollected, err)
+	_, err = reader.SkipReadToOffset(expected[1].Offset, expected[1].CurCnt-1)
+	test.Equal(t, ErrOffsetGarbageCollected, err)
+
+	// the offset in the retained files can still be reset to
+	pos := msgNum - 5
+	test.Equal(t, true, expected[pos].Offset > base.Offset())
+	_, err = reader.ResetReadToOffset(expected[pos].Offset, expected[pos].CurCnt-1)
+	test.Nil(t, err)
+	ret, ok := dqReader.TryReadOne()
+	test.Equal(t, true, ok)
+	test.Nil(t, ret.Err)
+	test.Equal(t, "test"+strconv.Itoa(pos), string(ret.Data))
+}
+
+func TestDiskQueueReaderRewindGarbageCollectedAfterConfirmed(t *testing.T) {
+	dqName := "test_disk_queue_rewind_gc_confirmed" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	queue, _ := NewDiskQueueWriter(dqName, tmpDir, 64, 4, 1<<10, 1)
+	dqWriter := queue.(*diskQueueWriter)
+	defer dqWriter.Close()
+
+	msgNum := 30
+	for i := 0; i < msgNum; i++ {
+		dqWriter.Put([]byte("test" + strconv.Itoa(i)))
+	}
+	dqWriter.Flush()
+	end := dqWriter.GetQueueWriteEnd()
+	test.Equal(t, true, end.(*diskQueueEndInfo).EndOffset.FileNum > 2)
+
+	dqReader, _ := newDiskQueueReader(dqName, dqName, tmpDir, 64, 4, 1<<10, 1, 2*time.Second, nil, true)
+	defer dqReader.Close()
+	dqReader.UpdateQueueEnd(end, false)
+	reader := dqReader.(*diskQueueReader)
+	expected := make([]ReadResult, 0, msgNum)
+	for i := 0; i < msgNum; i++ {
+		ret, ok := dqReader.TryReadOne()
+		test.Equal(t, true, ok)
+		test.Nil(t, ret.Err)
+		expected = append(expected, ret)
+	}
+	last := expected[msgNum-1]
+	err = dqReader.ConfirmRead(last.Offset+last.MovedSize, last.CurCnt)
+	test.Nil(t, err)
+	test.Equal(t, int64(0), dqReader.Depth())
+	test.Equal(t, end.Offset(), reader.GetQueueConfirmed().Offset())
+
+	newStart, err := dqWriter.CleanOldDataByRetention(&diskQueueEndInfo{EndOffset: diskQueueOffset{FileNum: 2}}, false, 0)
+	test.Nil(t, err)
+	test.Equal(t, true, expected[1].Offset < newStart.Offset())
+	_, err = os.Stat(reader.fileName(0))
+	test.Equal(t, true, os.IsNotExist(err))
+
+	// the rewind to the cleaned data should report the data is gone
+	_, err = reader.ResetReadToOffset(expected[1].Offset, expected[1].CurCnt-1)
+	test.Equal(t, ErrOffsetGarbageCollected, err)
+	_, err = reader.ResetReadToOffset(expected[1].Offset, 0)
+	test.Equal(t, ErrOffsetGarbageCollected, err)
+	_, err = reader.SkipReadToOffset(expected[1].Offset, expected[1].CurCnt-1)
+	test.Equal(t, ErrOffsetGarbageCollected, err)
+	_, err = reader.ResetReadToFile(0)
+	test.Equal(t, ErrOffsetGarbageCollected, err)
+	// the failed rewind should not move the confirmed
+	test.Equal(t, end.Offset(), reader.GetQueueConfirmed().Offset())
+	test.Equal(t, int64(0), dqReader.Depth())
+}
+
+func TestDiskQueueReaderUpdateEndRewind(t *testing.T) {
+	dqName := "test_disk_queue_update_end_rewind" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	queue, _ := NewDiskQueueWriter(dqName, tmpDir, 1024, 4, 1<<10, 1)
+	dqWriter := queue.(*diskQueueWriter)
+	defer dqWriter.Close()
+
+	msgNum := 10
+	for i := 0; i < msgNum; i++ {
+		dqWriter.Put([]byte("test" + strconv.Itoa(i)))
+	}
+	dqWriter.Flush()
+	end := dqWriter.GetQueueWriteEnd()
+
+	dqReader, _ := newDiskQueueReader(dqName, dqName, tmpDir, 1024, 4, 1<<10, 1, 2*time.Second, nil, true)
+	defer dqReader.Close()
+	reader := dqReader.(*diskQueueReader)
+	ret, err := reader.UpdateQueueEndWithResult(end, false)
+	test.Nil(t, err)
+	test.Equal(t, true, ret.Changed)
+	test.Equal(t, false, ret.Rewound)
+
+	var last ReadResult
+	for i := 0; i < msgNum; i++ {
+		r, ok := dqReader.TryReadOne()
+		test.Equal(t, true, ok)
+		test.Nil(t, r.Err)
+		if i == 4 {
+			last = r
+		}
+	}
+	// the writer rolled back to the 5th message
+	rollback := last.Offset + last.MovedSize
+	newEnd := &diskQueueEndInfo{
+		EndOffset:   diskQueueOffset{FileNum: 0, Pos: int64(rollback)},
+		virtualEnd:  rollback,
+		totalMsgCnt: last.CurCnt,
+	}
+	ret, err = reader.UpdateQueueEndWithResult(newEnd, false)
+	test.Nil(t, err)
+	test.Equal(t, false, ret.Changed)
+	test.Equal(t, false, ret.Rewound)
+	test.Equal(t, int64(0), reader.RewindCount())
+
+	ret, err = reader.UpdateQueueEndWithResult(newEnd, true)
+	test.Nil(t, err)
+	test.Equal(t, true, ret.Changed)
+	test.Equal(t, true, ret.Rewound)
+	test.Equal(t, end.Offset()-rollback, ret.RewindSize)
+	test.Equal(t, end.TotalMsgCnt()-last.CurCnt, ret.RewindCnt)
+	test.Equal(t, int64(1), reader.RewindCount())
+	test.Equal(t, rollback, reader.GetQueueCurrentRead().Offset())
+
+	// the end moved forward again should not be counted as rewind
+	ret, err = reader.UpdateQueueEndWithResult(end, false)
+	test.Nil(t, err)
+	test.Equal(t, true, ret.Changed)
+	test.Equal(t, false, ret.Rewound)
+	test.Equal(t, int64(1), reader.RewindCount())
+	r, ok := dqReader.TryReadOne()
+	test.Equal(t, true, ok)
+	test.Equal(t, "test5", string(r.Data))
+}
+
+func TestDiskQueueReaderCloseRace(t *testing.T) {
+	dqName := "test_disk_queue_close_race" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	queue, _ := NewDiskQueueWriter(dqName, tmpDir, 1024, 4, 1<<10, 1)
+	dqWriter := queue.(*diskQueueWriter)
+	defer dqWriter.Close()
+
+	msgNum := 100
+	for i := 0; i < msgNum; i++ {
+		dqWriter.Put([]byte("test" + strconv.Itoa(i)))
+	}
+	dqWriter.Flush()
+	end := dqWriter.GetQueueWriteEnd()
+
+	for round := 0; round < 10; round++ {
+		goroutines := runtime.NumGoroutine()
+		dqReader, _ := newDiskQueueReader(dqName, dqName, tmpDir, 1024, 4, 1<<10, 1, 2*time.Second, nil, true)
+		dqReader.UpdateQueueEnd(end, false)
+		watcher := dqReader.(*diskQueueReader).WatchConfirmed()
+
+		var wg sync.WaitGroup
+		start := make(chan struct{})
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				for j := 0; j < msgNum; j++ {
+					ret, ok := dqReader.TryReadOne()
+					if !ok {
+						return
+					}
+					dqReader.ConfirmRead(ret.Offset+ret.MovedSize, ret.CurCnt)
+					dqReader.SkipReadToOffset(ret.Offset+ret.MovedSize, ret.CurCnt)
+					dqReader.UpdateQueueEnd(end, j%10 == 0)
+				}
+			}()
+		}
+		wg.Add(2)
+		for i := 0; i < 2; i++ {
+			go func() {
+				defer wg.Done()
+				<-start
+				dqReader.Close()
+			}()
+		}
+		close(start)
+
+		done := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("deadlock while closing the reader in round %v", round)
+		}
+		// the watcher is closed while exited
+		for range watcher {
+		}
+
+		test.Equal(t, ErrExiting, dqReader.ConfirmRead(0, 0))
+		_, err = dqReader.SkipReadToOffset(end.Offset(), end.TotalMsgCnt())
+		test.Equal(t, ErrExiting, err)
+		_, err = dqReader.UpdateQueueEnd(end, true)
+		test.Equal(t, ErrExiting, err)
+		_, ok := dqReader.TryReadOne()
+		test.Equal(t, false, ok)
+
+		leaked := 0
+		for i := 0; i < 100; i++ {
+			leaked = runtime.NumGoroutine() - goroutines
+			if leaked <= 0 {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		test.Equal(t, true, leaked <= 0)
+	}
+}
+
+func TestDiskQueueReaderCloseDeleteRace(t *testing.T) {
+	dqName := "test_disk_queue_close_delete_race" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	queue, _ := NewDiskQueueWriter(dqName, tmpDir, 1024, 4, 1<<10, 1)
+	dqWriter := queue.(*diskQueueWriter)
+	defer dqWriter.Close()
+	for i := 0; i < 100; i++ {
+		dqWriter.Put([]byte("test" + strconv.Itoa(i)))
+	}
+	dqWriter.Flush()
+	end := dqWriter.GetQueueWriteEnd()
+
+	for round := 0; round < 20; round++ {
+		goroutines := runtime.NumGoroutine()
+		dqReader, _ := newDiskQueueReader(dqName, dqName, tmpDir, 1024, 4, 1<<10, 1, 2*time.Second, nil, true)
+		d := dqReader.(*diskQueueReader)
+		dqReader.UpdateQueueEnd(end, false)
+		ret, ok := dqReader.TryReadOne()
+		test.Equal(t, true, ok)
+		test.Nil(t, dqReader.ConfirmRead(ret.Offset+ret.MovedSize, ret.CurCnt))
+		_, err = os.Stat(d.metaDataFileName(true))
+		test.Nil(t, err)
+		watcher := d.WatchConfirmed()
+
+		var wg sync.WaitGroup
+		start := make(chan struct{})
+		errs := make(chan error, 4)
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				<-start
+				if (i+round)%2 == 0 {
+					errs <- dqReader.Close()
+				} else {
+					errs <- dqReader.Delete()
+				}
+			}(i)
+		}
+		close(start)
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			test.Nil(t, err)
+		}
+		for range watcher {
+		}
+		// the meta is removed even if the close wins
+		_, err = os.Stat(d.metaDataFileName(true))
+		test.Equal(t, true, os.IsNotExist(err))
+		_, err = os.Stat(d.metaDataFileName(false))
+		test.Equal(t, true, os.IsNotExist(err))
+		test.Equal(t, ErrExiting, dqReader.ConfirmRead(0, 0))
+
+		leaked := 0
+		for i := 0; i < 100; i++ {
+			leaked = runtime.NumGoroutine() - goroutines
+			if leaked <= 0 {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		test.Equal(t, true, leaked <= 0)
+	}
+}
+
+func TestDiskQueueReaderOldestReadableOffset(t *testing.T) {
+	dqName := "test_disk_queue_oldest_readable" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	queue, _ := NewDiskQueueWriter(dqName, tmpDir, 64, 4, 1<<10, 1)
+	dqWriter := queue.(*diskQueueWriter)
+	defer dqWriter.Close()
+
+	msgNum := 30
+	for i := 0; i < msgNum; i++ {
+		dqWriter.Put([]byte("test" + strconv.Itoa(i)))
+	}
+	dqWriter.Flush()
+	end := dqWriter.GetQueueWriteEnd()
+	test.Equal(t, true, end.(*diskQueueEndInfo).EndOffset.FileNum > 3)
+
+	dqReader, _ := newDiskQueueReader(dqName, dqName, tmpDir, 64, 4, 1<<10, 1, 2*time.Second, nil, true)
+	defer dqReader.Close()
+	dqReader.UpdateQueueEnd(end, false)
+	reader := dqReader.(*diskQueueReader)
+	oldest, err := reader.OldestReadableOffset()
+	test.Nil(t, err)
+	test.Equal(t, BackendOffset(0), oldest)
+
+	for _, fileNum := range []int64{1, 3} {
+		newStart, err := dqWriter.CleanOldDataByRetention(&diskQueueEndInfo{EndOffset: diskQueueOffset{FileNum: fileNum}}, false, 0)
+		test.Nil(t, err)
+		fileStart, err := reader.GetFileStart(fileNum)
+		test.Nil(t, err)
+		oldest, err = reader.OldestReadableOffset()
+		test.Nil(t, err)
+		test.Equal(t, newStart.Offset(), oldest)
+		test.Equal(t, fileStart.Offset(), oldest)
+		_, err = os.Stat(reader.fileName(fileNum - 1))
+		test.Equal(t, true, os.IsNotExist(err))
+		_, err = os.Stat(reader.fileName(fileNum))
+		test.Nil(t, err)
+		// the cached one will be returned if not changed
+		cached, err := reader.OldestReadableOffset()
+		test.Nil(t, err)
+		test.Equal(t, oldest, cached)
+	}
+}
+
+func TestDiskQueueReaderReadPooled(t *testing.T) {
+	dqName := "test_disk_queue_read_pooled" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	queue, _ := NewDiskQueueWriter(dqName, tmpDir, 1024*1024, 4, 1<<10, 1)
+	dqWriter := queue.(*diskQueueWriter)
+	defer dqWriter.Close()
+
+	msgNum := 100
+	for i := 0; i < msgNum; i++ {
+		dqWriter.Put([]byte("test" + strconv.Itoa(i)))
+	}
+	dqWriter.Flush()
+	end := dqWriter.GetQueueWriteEnd()
+
+	dqReader, _ := newDiskQueueReader(dqName, dqName, tmpDir, 1024*1024, 4, 1<<10, 1, 2*time.Second, nil, true)
+	defer dqReader.Close()
+	dqReader.UpdateQueueEnd(end, false)
+	reader := dqReader.(*diskQueueReader)
+
+	recycled := 0
+	var last *byte
+	for i := 0; i < msgNum; i++ {
+		ret, ok := reader.TryReadOnePooled()
+		test.Equal(t, true, ok)
+		test.Nil(t, ret.Err)
+		test.Equal(t, "test"+strconv.Itoa(i), string(ret.Data))
+		test.Equal(t, BackendOffset(len(ret.Data)+4), ret.MovedSize)
+		if last != nil && &ret.Data[0] == last {
+			recycled++
+		}
+		last = &ret.Data[0]
+		ReleaseReadData(ret.Data)
+	}
+	_, ok := reader.TryReadOnePooled()
+	test.Equal(t, false, ok)
+	// the pool may drop the buffers randomly, but most of them should be reused
+	test.Equal(t, true, recycled > 0)
+
+	// the data read by default is never shared
+	reader.ResetReadToConfirmed()
+	ret1, _ := dqReader.TryReadOne()
+	ret2, _ := dqReader.TryReadOne()
+	test.Equal(t, "test0", string(ret1.Data))
+	test.Equal(t, "test1", string(ret2.Data))
+}
+
+func BenchmarkDiskQueueReaderRead(b *testing.B) {
+	benchmarkDiskQueueReaderRead(false, b)
+}
+func BenchmarkDiskQueueReaderReadPooled(b *testing.B) {
+	benchmarkDiskQueueReaderRead(true, b)
+}
+func benchmarkDiskQueueReaderRead(pooled bool, b *testing.B) {
+	b.StopTimer()
+	dqName := "bench_disk_queue_reader_read" + strconv.Itoa(b.N) + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	queue, _ := NewDiskQueueWriter(dqName, tmpDir, 1024*1024*100, 4, 1<<20, 1)
+	dqWriter := queue.(*diskQueueWriter)
+	defer dqWriter.Close()
+	data := make([]byte, 1024)
+	for i := 0; i < b.N; i++ {
+		dqWriter.Put(data)
+	}
+	dqWriter.Flush()
+	dqReader, _ := newDiskQueueReader(dqName, dqName, tmpDir, 1024*1024*100, 4, 1<<20, 1, 2*time.Second, nil, true)
+	defer dqReader.Close()
+	dqReader.UpdateQueueEnd(dqWriter.GetQueueWriteEnd(), false)
+	reader := dqReader.(*diskQueueReader)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.StartTimer()
+
+	for i := 0; i < b.N; i++ {
+		if pooled {
+			ret, ok := reader.TryReadOnePooled()
+			if !ok || ret.Err != nil {
+				panic(ret.Err)
+			}
+			ReleaseReadData(ret.Data)
+		} else {
+			ret, ok := reader.TryReadOne()
+			if !ok || ret.Err != nil {
+				panic(ret.Err)
+			}
+		}
+	}
+}
+
+func TestDiskQueueReaderEndDivergencePolicy(t *testing.T) {
+	dqName := "test_disk_queue_end_divergence" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	queue, _ := NewDiskQueueWriter(dqName, tmpDir, 1024, 4, 1<<10, 1)
+	dqWriter := queue.(*diskQueueWriter)
+	defer dqWriter.Close()
+
+	msgNum := 10
+	for i := 0; i < msgNum; i++ {
+		dqWriter.Put([]byte("test" + strconv.Itoa(i)))
+	}
+	dqWriter.Flush()
+	end := dqWriter.GetQueueWriteEnd()
+
+	dqReader, _ := newDiskQueueReader(dqName, dqName, tmpDir, 1024, 4, 1<<10, 1, 2*time.Second, nil, true)
+	defer dqReader.Close()
+	reader := dqReader.(*diskQueueReader)
+	test.NotNil(t, reader.SetEndDivergencePolicy("unknown"))
+	test.Nil(t, reader.SetEndDivergencePolicy(EndDivergencePolicyHalt))
+	_, err = reader.UpdateQueueEndWithResult(end, false)
+	test.Nil(t, err)
+
+	var last ReadResult
+	for i := 0; i < msgNum; i++ {
+		r, ok := dqReader.TryReadOne()
+		test.Equal(t, true, ok)
+		test.Nil(t, r.Err)
+		if i == 4 {
+			last = r
+		}
+	}
+	readPos := reader.GetQueueCurrentRead()
+	rollback := last.Offset + last.MovedSize
+	newEnd := &diskQueueEndInfo{
+		EndOffset:   diskQueueOffset{FileNum: 0, Pos: int64(rollback)},
+		virtualEnd:  rollback,
+		totalMsgCnt: last.CurCnt,
+	}
+	ret, err := reader.UpdateQueueEndWithResult(newEnd, true)
+	test.Equal(t, ErrReadEndDiverged, err)
+	test.Equal(t, true, ret.Changed)
+	test.Equal(t, false, ret.Rewound)
+	test.Equal(t, int64(0), reader.RewindCount())
+	test.Equal(t, true, reader.IsCorruptionHalted())
+	test.Equal(t, readPos.Offset(), reader.GetQueueCurrentRead().Offset())
+	test.Equal(t, rollback, reader.GetQueueReadEnd().Offset())
+	_, ok := dqReader.TryReadOne()
+	test.Equal(t, false, ok)
+	// the same end should not be reported again
+	_, err = reader.UpdateQueueEndWithResult(newEnd, true)
+	test.Nil(t, err)
+
+	// reset the read manually to resume
+	_, err = reader.SkipReadToEnd()
+	test.Nil(t, err)
+	test.Equal(t, false, reader.IsCorruptionHalted())
+	test.Equal(t, rollback, reader.GetQueueCurrentRead().Offset())
+
+	// the clamp policy should rewind the read to the new end
+	test.Nil(t, reader.SetEndDivergencePolicy(EndDivergencePolicyClamp))
+	_, err = reader.UpdateQueueEndWithResult(end, false)
+	test.Nil(t, err)
+	for i := 5; i < msgNum; i++ {
+		_, ok := dqReader.TryReadOne()
+		test.Equal(t, true, ok)
+	}
+	ret, err = reader.UpdateQueueEndWithResult(newEnd, true)
+	test.Nil(t, err)
+	test.Equal(t, true, ret.Rewound)
+	test.Equal(t, int64(1), reader.RewindCount())
+	test.Equal(t, false, reader.IsCorruptionHalted())
+	test.Equal(t, rollback, reader.GetQueueCurrentRead().Offset())
+}
+
+func TestDiskQueueReaderFilePermission(t *testing.T) {
+	dqName := "test_disk_queue_file_permission" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	queue, _ := NewDiskQueueWriter(dqName, tmpDir, 1024, 4, 1<<10, 1)
+	dqWriter := queue.(*diskQueueWriter)
+	defer dqWriter.Close()
+	msgNum := 10
+	for i := 0; i < msgNum; i++ {
+		dqWriter.Put([]byte("test" + strconv.Itoa(i)))
+	}
+	dqWriter.Flush()
+	end := dqWriter.GetQueueWriteEnd()
+
+	fName := dqWriter.fileName(0)
+	test.Nil(t, os.Chmod(fName, 0))
+	defer os.Chmod(fName, 0644)
+	if f, err := os.Open(fName); err == nil {
+		f.Close()
+		t.Skip("the file permission is not enforced for the current user")
+	}
+
+	dqReader, _ := newDiskQueueReader(dqName, dqName, tmpDir, 1024, 4, 1<<10, 1, 2*time.Second, nil, true)
+	defer dqReader.Close()
+	reader := dqReader.(*diskQueueReader)
+	reader.openRetryBackoff = time.Millisecond * 100
+	dqReader.UpdateQueueEnd(end, false)
+	ret, ok := dqReader.TryReadOne()
+	test.Equal(t, true, ok)
+	test.Equal(t, ErrReadFileUnavailable, ret.Err)
+	// the unreadable file should not be skipped as the corruption
+	test.Equal(t, BackendOffset(0), reader.GetQueueCurrentRead().Offset())
+	test.Equal(t, BackendOffset(0), dqReader.GetQueueConfirmed().Offset())
+	test.Equal(t, false, reader.IsCorruptionHalted())
+	// no retry while in backoff, but the unavailable should be returned to retry later
+	ret, ok = dqReader.TryReadOne()
+	test.Equal(t, true, ok)
+	test.Equal(t, ErrReadFileUnavailable, ret.Err)
+	test.Equal(t, BackendOffset(0), reader.GetQueueCurrentRead().Offset())
+
+	test.Nil(t, os.Chmod(fName, 0644))
+	time.Sleep(time.Millisecond * 300)
+	for i := 0; i < msgNum; i++ {
+		ret, ok := dqReader.TryReadOne()
+		test.Equal(t, true, ok)
+		test.Nil(t, ret.Err)
+		test.Equal(t, "test"+strconv.Itoa(i), string(ret.Data))
+	}
+}
+
+func TestDiskQueueReaderConstructMetaError(t *testing.T) {
+	dqName := "test_disk_queue_construct_meta" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	// the missing meta should create a fresh reader
+	dqReader, err := newDiskQueueReader(dqName, dqName, tmpDir, 1024, 4, 1<<10, 1, 2*time.Second, nil, true)
+	test.Nil(t, err)
+	test.NotNil(t, dqReader)
+	test.Equal(t, BackendOffset(0), dqReader.GetQueueConfirmed().Offset())
+	dqReader.Close()
+
+	metaName := dqReader.(*diskQueueReader).metaDataFileName(true)
+	err = ioutil.WriteFile(metaName, []byte("corrupt\n"), 0644)
+	test.Nil(t, err)
+	dqReader, err = newDiskQueueReader(dqName, dqName, tmpDir, 1024, 4, 1<<10, 1, 2*time.Second, nil, true)
+	test.NotNil(t, err)
+	test.Nil(t, dqReader)
+
+	// the broken meta is kept while recreating the reader
+	test.Nil(t, backupReaderMeta(tmpDir, dqName))
+	_, err = os.Stat(metaName)
+	test.Equal(t, true, os.IsNotExist(err))
+	matches, err := filepath.Glob(metaName + ".corrupt.*")
+	test.Nil(t, err)
+	test.Equal(t, 1, len(matches))
+	dqReader, err = newDiskQueueReader(dqName, dqName, tmpDir, 1024, 4, 1<<10, 1, 2*time.Second, nil, true)
+	test.Nil(t, err)
+	dqReader.Close()
+}
+
+func TestDiskQueueReaderReadLastN(t *testing.T) {
+	dqName := "test_disk_queue_read_last" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	queue, _ := NewDiskQueueWriter(dqName, tmpDir, 1024, 4, 1<<10, 1)
+	dqWriter := queue.(*diskQueueWriter)
+	defer dqWriter.Close()
+
+	msgNum := 300
+	for i := 0; i < msgNum; i++ {
+		dqWriter.Put([]byte("test" + strconv.Itoa(i)))
+	}
+	dqWriter.Flush()
+	end := dqWriter.GetQueueWriteEnd()
+	test.Equal(t, true, end.(*diskQueueEndInfo).EndOffset.FileNum > 1)
+
+	dqReader, _ := newDiskQueueReader(dqName, dqName, tmpDir, 1024, 4, 1<<10, 1, 2*time.Second, nil, true)
+	defer dqReader.Close()
+	reader := dqReader.(*diskQueueReader)
+	dqReader.UpdateQueueEnd(end, false)
+	for i := 0; i < 10; i++ {
+		_, ok := dqReader.TryReadOne()
+		test.Equal(t, true, ok)
+	}
+	readPos := reader.GetQueueCurrentRead().Offset()
+
+	rets, err := reader.ReadLastN(0)
+	test.Nil(t, err)
+	test.Equal(t, 0, len(rets))
+	for _, n := range []int{1, 50, 200} {
+		rets, err = reader.ReadLastN(n)
+		test.Nil(t, err)
+		test.Equal(t, n, len(rets))
+		for i, ret := range rets {
+			test.Equal(t, "test"+strconv.Itoa(msgNum-n+i), string(ret.Data))
+		}
+		test.Equal(t, end.Offset(), rets[n-1].Offset+rets[n-1].MovedSize)
+		test.Equal(t, end.TotalMsgCnt(), rets[n-1].CurCnt)
+	}
+	// all the messages are returned if less than n
+	rets, err = reader.ReadLastN(msgNum * 2)
+	test.Nil(t, err)
+	test.Equal(t, msgNum, len(rets))
+	test.Equal(t, "test0", string(rets[0].Data))
+
+	// the live reader should not be changed
+	test.Equal(t, readPos, reader.GetQueueCurrentRead().Offset())
+	ret, ok := dqReader.TryReadOne()
+	test.Equal(t, true, ok)
+	test.Equal(t, "test10", string(ret.Data))
+}
+
+func TestDiskQueueReaderReadRangeInclusive(t *testing.T) {
+	dqName := "test_disk_queue_read_range" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	queue, _ := NewDiskQueueWriter(dqName, tmpDir, 64, 4, 1<<10, 1)
+	dqWriter := queue.(*diskQueueWriter)
+	defer dqWriter.Close()
+
+	msgNum := 20
+	for i := 0; i < msgNum; i++ {
+		dqWriter.Put([]byte(fmt.Sprintf("test%02d", i)))
+	}
+	dqWriter.Flush()
+	end := dqWriter.GetQueueWriteEnd()
+
+	dqReader, _ := newDiskQueueReader(dqName, dqName, tmpDir, 64, 4, 1<<10, 1, 2*time.Second, nil, true)
+	defer dqReader.Close()
+	dqReader.UpdateQueueEnd(end, false)
+	reader := dqReader.(*diskQueueReader)
+	all, err := reader.ReadLastN(msgNum)
+	test.Nil(t, err)
+	test.Equal(t, msgNum, len(all))
+
+	from := all[3].Offset
+	to := all[12].Offset
+	exclusive, err := reader.ReadRange(from, to)
+	test.Nil(t, err)
+	inclusive, err := reader.ReadRangeInclusive(from, to)
+	test.Nil(t, err)
+	test.Equal(t, len(exclusive)+1, len(inclusive))
+	test.Equal(t, 9, len(exclusive))
+	for i, ret := range inclusive {
+		test.Equal(t, fmt.Sprintf("test%02d", i+3), string(ret.Data))
+	}
+	test.Equal(t, to, inclusive[len(inclusive)-1].Offset)
+	// the read position is not changed
+	test.Equal(t, BackendOffset(0), reader.GetQueueCurrentRead().Offset())
+
+	// the inclusive boundary should be the start of a message before the end
+	_, err = reader.ReadRangeInclusive(from, to+1)
+	test.Equal(t, ErrMoveOffsetInvalid, err)
+	_, err = reader.ReadRangeInclusive(from, end.Offset())
+	test.Equal(t, ErrMoveOffsetInvalid, err)
+	_, err = reader.ReadRange(from+1, to)
+	test.Equal(t, ErrMoveOffsetInvalid, err)
+	one, err := reader.ReadRangeInclusive(to, to)
+	test.Nil(t, err)
+	test.Equal(t, 1, len(one))
+}
+
+func TestDiskQueueReaderCorruptQuarantine(t *testing.T) {
+	dqName := "test_disk_queue_corrupt_quarantine" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	queue, _ := NewDiskQueueWriter(dqName, tmpDir, 64, 4, 1<<10, 1)
+	dqWriter := queue.(*diskQueueWriter)
+	defer dqWriter.Close()
+
+	msgNum := 20
+	for i := 0; i < msgNum; i++ {
+		dqWriter.Put([]byte(fmt.Sprintf("test%02d", i)))
+	}
+	dqWriter.Flush()
+	end := dqWriter.GetQueueWriteEnd()
+	test.Equal(t, true, end.(*diskQueueEndInfo).EndOffset.FileNum > 2)
+
+	dqReader, _ := newDiskQueueReader(dqName, dqName, tmpDir, 64, 4, 1<<10, 1, 2*time.Second, nil, true)
+	defer dqReader.Close()
+	dqReader.UpdateQueueEnd(end, false)
+	reader := dqReader.(*diskQueueReader)
+	quarantineDir := path.Join(tmpDir, "quarantine")
+	reader.SetCorruptQuarantineDir(quarantineDir)
+	cnt0, err := reader.FileMessageCount(0)
+	test.Nil(t, err)
+	cnt1, err := reader.FileMessageCount(1)
+	test.Nil(t, err)
+
+	corruptFile := dqWriter.fileName(1)
+	f, err := os.OpenFile(corruptFile, os.O_RDWR, 0644)
+	test.Nil(t, err)
+	_, err = f.WriteAt(bytes.Repeat([]byte{0xff}, 8), 0)
+	test.Nil(t, err)
+	f.Close()
+	origStat, err := os.Stat(corruptFile)
+	test.Nil(t, err)
+
+	var read []string
+	for {
+		ret, ok := dqReader.TryReadOne()
+		if !ok {
+			break
+		}
+		test.Nil(t, ret.Err)
+		read = append(read, string(ret.Data))
+	}
+	// the read continues from the next file after the corrupt one
+	test.Equal(t, int64(msgNum)-cnt1, int64(len(read)))
+	test.Equal(t, fmt.Sprintf("test%02d", cnt0+cnt1), read[cnt0])
+
+	// the corrupt file is copied in background
+	var stat os.FileInfo
+	for i := 0; i < 100; i++ {
+		stat, err = os.Stat(path.Join(quarantineDir, path.Base(corruptFile)))
+		if err == nil {
+			break
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+	test.Nil(t, err)
+	test.Equal(t, origStat.Size(), stat.Size())
+	// the shared data file is kept for the other channels
+	_, err = os.Stat(corruptFile)
+	test.Nil(t, err)
+}
+
+func TestDiskQueueReaderLatencyStats(t *testing.T) {
+	dqName := "test_disk_queue_latency_stats" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	queue, _ := NewDiskQueueWriter(dqName, tmpDir, 64, 4, 1<<10, 1)
+	dqWriter := queue.(*diskQueueWriter)
+	defer dqWriter.Close()
+
+	for i := 0; i < 20; i++ {
+		dqWriter.Put([]byte(fmt.Sprintf("test%02d", i)))
+	}
+	dqWriter.Flush()
+	end := dqWriter.GetQueueWriteEnd()
+
+	slowOpen := time.Millisecond * 50
+	oldOpen := openQueueFileForRead
+	openQueueFileForRead = func(fileName string) (*os.File, error) {
+		time.Sleep(slowOpen)
+		return oldOpen(fileName)
+	}
+	defer func() {
+		openQueueFileForRead = oldOpen
+	}()
+
+	dqReader, _ := newDiskQueueReader(dqName, dqName, tmpDir, 64, 4, 1<<10, 1, 2*time.Second, nil, true)
+	defer dqReader.Close()
+	dqReader.UpdateQueueEnd(end, false)
+	reader := dqReader.(*diskQueueReader)
+	stats := reader.LatencyStats()
+	test.Equal(t, int64(0), stats.FirstRead)
+	test.Equal(t, int64(0), stats.OpenCount)
+
+	time.Sleep(time.Millisecond * 100)
+	ret, ok := dqReader.TryReadOne()
+	test.Equal(t, true, ok)
+	test.Nil(t, ret.Err)
+	stats = reader.LatencyStats()
+	test.Equal(t, true, stats.FirstRead >= int64((slowOpen+time.Millisecond*100)/time.Millisecond))
+	test.Equal(t, int64(1), stats.OpenCount)
+	test.Equal(t, true, stats.LastOpen >= int64(slowOpen/time.Millisecond))
+
+	for {
+		ret, ok := dqReader.TryReadOne()
+		if !ok {
+			break
+		}
+		test.Nil(t, ret.Err)
+	}
+	firstRead := stats.FirstRead
+	stats = reader.LatencyStats()
+	// the first read is not changed by the later reads, and each file is opened once
+	test.Equal(t, firstRead, stats.FirstRead)
+	fileCnt := end.(*diskQueueEndInfo).EndOffset.FileNum + 1
+	if end.(*diskQueueEndInfo).EndOffset.Pos == 0 {
+		fileCnt--
+	}
+	test.Equal(t, fileCnt, stats.OpenCount)
+	test.Equal(t, true, stats.MaxOpen >= stats.AvgOpen)
+	test.Equal(t, true, stats.AvgOpen >= int64(slowOpen/time.Millisecond))
+}
+
+func TestDiskQueueReaderReverseScan(t *testing.T) {
+	dqName := "test_disk_queue_reverse_scan" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	queue, _ := NewDiskQueueWriter(dqName, tmpDir, 1024, 4, 1<<10, 1)
+	dqWriter := queue.(*diskQueueWriter)
+	defer dqWriter.Close()
+
+	msgNum := 300
+	for i := 0; i < msgNum; i++ {
+		dqWriter.Put([]byte("test" + strconv.Itoa(i)))
+	}
+	dqWriter.Flush()
+	end := dqWriter.GetQueueWriteEnd()
+	test.Equal(t, true, end.(*diskQueueEndInfo).EndOffset.FileNum > 1)
+
+	dqReader, _ := newDiskQueueReader(dqName, dqName, tmpDir, 1024, 4, 1<<10, 1, 2*time.Second, nil, true)
+	defer dqReader.Close()
+	reader := dqReader.(*diskQueueReader)
+	dqReader.UpdateQueueEnd(end, false)
+	var offsets []BackendOffset
+	for i := 0; i < msgNum; i++ {
+		ret, ok := dqReader.TryReadOne()
+		test.Equal(t, true, ok)
+		offsets = append(offsets, ret.Offset)
+	}
+	_, err = dqReader.ResetReadToConfirmed()
+	test.Nil(t, err)
+	readPos := reader.GetQueueCurrentRead()
+
+	rets, err := reader.ReverseScan(end.Offset(), 20)
+	test.Nil(t, err)
+	test.Equal(t, 20, len(rets))
+	for i, ret := range rets {
+		test.Equal(t, "test"+strconv.Itoa(msgNum-1-i), string(ret.Data))
+		if i > 0 {
+			test.Equal(t, true, ret.Offset < rets[i-1].Offset)
+		}
+	}
+	// scan across the file boundary to the oldest
+	from := 150
+	rets, err = reader.ReverseScan(offsets[from], msgNum)
+	test.Nil(t, err)
+	test.Equal(t, from, len(rets))
+	for i, ret := range rets {
+		test.Equal(t, offsets[from-1-i], ret.Offset)
+		test.Equal(t, "test"+strconv.Itoa(from-1-i), string(ret.Data))
+	}
+	// from the start of the file
+	cnt, _, endPos, err := getQueueFileOffsetMeta(dqWriter.fileName(0))
+	test.Nil(t, err)
+	rets, err = reader.ReverseScan(BackendOffset(endPos), 2)
+	test.Nil(t, err)
+	test.Equal(t, 2, len(rets))
+	test.Equal(t, "test"+strconv.Itoa(int(cnt)-1), string(rets[0].Data))
+	test.Equal(t, "test"+strconv.Itoa(int(cnt)-2), string(rets[1].Data))
+
+	rets, err = reader.ReverseScan(0, 10)
+	test.Nil(t, err)
+	test.Equal(t, 0, len(rets))
+	_, err = reader.ReverseScan(end.Offset()+1, 10)
+	test.Equal(t, ErrMoveOffsetInvalid, err)
+	// the live reader is not changed
+	test.Equal(t, readPos.Offset(), reader.GetQueueCurrentRead().Offset())
+	test.Equal(t, BackendOffset(0), dqReader.GetQueueConfirmed().Offset())
+}
+
+func TestDiskQueueReaderMsgSizeHistogram(t *testing.T) {
+	dqName := "test_disk_queue_msg_size" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	queue, _ := NewDiskQueueWriter(dqName, tmpDir, 1024*1024, 0, 1<<20, 1)
+	dqWriter := queue.(*diskQueueWriter)
+	defer dqWriter.Close()
+	dqReader, _ := newDiskQueueReader(dqName, dqName, tmpDir, 1024*1024, 0, 1<<20, 1, 2*time.Second, nil, true)
+	defer dqReader.Close()
+
+	// the sizes and the bucket index of each size
+	sizes := []int{0, 64, 65, 200, 256, 1000, 5000, 100000, 300000}
+	expected := make([]int64, msgSizeBucketNum)
+	for _, i := range []int{0, 0, 1, 1, 1, 2, 4, 6, 7} {
+		expected[i]++
+	}
+	for _, size := range sizes {
+		_, _, _, err = dqWriter.Put(make([]byte, size))
+		test.Nil(t, err)
+	}
+	dqWriter.Flush()
+	dqReader.UpdateQueueEnd(dqWriter.GetQueueWriteEnd(), false)
+	for range sizes {
+		ret, ok := dqReader.TryReadOne()
+		test.Equal(t, true, ok)
+		test.Nil(t, ret.Err)
+	}
+
+	buckets := dqReader.(*diskQueueReader).GetMsgSizeHistogram()
+	test.Equal(t, msgSizeBucketNum, len(buckets))
+	for i, bucket := range buckets {
+		test.Equal(t, expected[i], bucket.Count)
+		if i < len(msgSizeBucketBounds) {
+			test.Equal(t, msgSizeBucketBounds[i], bucket.UpperBound)
+		} else {
+			test.Equal(t, int64(-1), bucket.UpperBound)
+		}
+	}
+}
+
+func TestDiskQueueReaderConfirmAllRead(t *testing.T) {
+	dqName := "test_disk_queue_confirm_all" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	queue, _ := NewDiskQueueWriter(dqName, tmpDir, 1024, 4, 1<<10, 1)
+	dqWriter := queue.(*diskQueueWriter)
+	defer dqWriter.Close()
+	dqReader, _ := newDiskQueueReader(dqName, dqName, tmpDir, 1024, 4, 1<<10, 1, 2*time.Second, nil, true)
+	defer dqReader.Close()
+
+	msgNum := 10
+	for i := 0; i < msgNum; i++ {
+		dqWriter.Put([]byte("test" + strconv.Itoa(i)))
+	}
+	dqWriter.Flush()
+	dqReader.UpdateQueueEnd(dqWriter.GetQueueWriteEnd(), false)
+	test.Equal(t, int64(msgNum), dqReader.Depth())
+
+	d := dqReader.(*diskQueueReader)
+	confirmed, err := d.ConfirmAllRead()
+	test.Nil(t, err)
+	test.Equal(t, BackendOffset(0), confirmed)
+	test.Equal(t, int64(msgNum), dqReader.Depth())
+
+	for i := 0; i < 4; i++ {
+		ret, ok := dqReader.TryReadOne()
+		test.Equal(t, true, ok)
+		test.Nil(t, ret.Err)
+	}
+	confirmed, err = d.ConfirmAllRead()
+	test.Nil(t, err)
+	test.Equal(t, d.GetQueueCurrentRead().Offset(), confirmed)
+	test.Equal(t, confirmed, dqReader.GetQueueConfirmed().Offset())
+	test.Equal(t, int64(msgNum-4), dqReader.Depth())
+
+	// the unread messages are still read after confirmed all
+	ret, ok := dqReader.TryReadOne()
+	test.Equal(t, true, ok)
+	test.Equal(t, "test4", string(ret.Data))
+	test.Equal(t, int64(msgNum-4), dqReader.Depth())
+}
+
+func TestDiskQueueReaderInitialPosition(t *testing.T) {
+	dqName := "test_disk_queue_init_pos" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	queue, _ := NewDiskQueueWriter(dqName, tmpDir, 1024, 4, 1<<10, 1)
+	dqWriter := queue.(*diskQueueWriter)
+	defer dqWriter.Close()
+	var third diskQueueEndInfo
+	for i := 0; i < 100; i++ {
+		_, _, e, err := dqWriter.PutV2([]byte("test" + strconv.Itoa(i)))
+		test.Nil(t, err)
+		if i == 2 {
+			third = e
+		}
+	}
+	dqWriter.Flush()
+	end := dqWriter.GetQueueWriteEnd()
+
+	newReader := func(name string) *diskQueueReader {
+		dqReader, err := newDiskQueueReader(dqName, name, tmpDir, 1024, 4, 1<<10, 1, 2*time.Second, end, true)
+		test.Nil(t, err)
+		return dqReader.(*diskQueueReader)
+	}
+
+	d := newReader(dqName + "invalid")
+	test.Equal(t, ErrInvalidInitialPosition, d.SetInitialPosition("middle", 0, 0))
+	d.Close()
+
+	d = newReader(dqName + InitialPositionStart)
+	test.Nil(t, d.SetInitialPosition(InitialPositionStart, 0, 0))
+	test.Equal(t, int64(100), d.Depth())
+	ret, ok := d.TryReadOne()
+	test.Equal(t, true, ok)
+	test.Equal(t, "test0", string(ret.Data))
+	test.Nil(t, d.ConfirmRead(ret.Offset+ret.MovedSize, ret.CurCnt))
+	d.Close()
+
+	d = newReader(dqName + InitialPositionEnd)
+	test.Nil(t, d.SetInitialPosition(InitialPositionEnd, 0, 0))
+	test.Equal(t, int64(0), d.Depth())
+	_, ok = d.TryReadOne()
+	test.Equal(t, false, ok)
+	d.Close()
+
+	d = newReader(dqName + InitialPositionOffset)
+	test.Nil(t, d.SetInitialPosition(InitialPositionOffset, third.Offset(), third.TotalMsgCnt()))
+	test.Equal(t, int64(97), d.Depth())
+	ret, ok = d.TryReadOne()
+	test.Equal(t, true, ok)
+	test.Equal(t, "test3", string(ret.Data))
+	d.Close()
+
+	// the policy is ignored if the meta exists
+	d = newReader(dqName + InitialPositionStart)
+	test.Nil(t, d.SetInitialPosition(InitialPositionEnd, 0, 0))
+	test.Equal(t, int64(99), d.Depth())
+	ret, ok = d.TryReadOne()
+	test.Equal(t, true, ok)
+	test.Equal(t, "test1", string(ret.Data))
+	d.Close()
+}
+
+func TestDiskQueueReaderRebuildMetaFromData(t *testing.T) {
+	dqName := "test_disk_queue_rebuild_meta" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	queue, _ := NewDiskQueueWriter(dqName, tmpDir, 1024, 4, 1<<10, 1)
+	dqWriter := queue.(*diskQueueWriter)
+	defer dqWriter.Close()
+	msgNum := 300
+	for i := 0; i < msgNum; i++ {
+		dqWriter.Put([]byte("test" + strconv.Itoa(i)))
+	}
+	dqWriter.Flush()
+	end := dqWriter.GetQueueWriteEnd().(*diskQueueEndInfo)
+	test.Equal(t, true, end.EndOffset.FileNum > 2)
+
+	dqReader, _ := newDiskQueueReader(dqName, dqName, tmpDir, 1024, 4, 1<<10, 1, 2*time.Second, nil, true)
+	dqReader.UpdateQueueEnd(end, false)
+	for i := 0; i < 50; i++ {
+		ret, ok := dqReader.TryReadOne()
+		test.Equal(t, true, ok)
+		test.Nil(t, dqReader.ConfirmRead(ret.Offset+ret.MovedSize, ret.CurCnt))
+	}
+	reader := dqReader.(*diskQueueReader)
+	metaNames := []string{reader.metaDataFileName(true), reader.metaDataFileName(false)}
+	dqReader.Close()
+	for _, fName := range metaNames {
+		os.Remove(fName)
+	}
+
+	dqReader, _ = newDiskQueueReader(dqName, dqName, tmpDir, 1024, 4, 1<<10, 1, 2*time.Second, nil, true)
+	reader = dqReader.(*diskQueueReader)
+	_, err = reader.RebuildMetaFromData(InitialPositionOffset)
+	test.Equal(t, ErrInvalidInitialPosition, err)
+	rebuilt, err := reader.RebuildMetaFromData(InitialPositionStart)
+	test.Nil(t, err)
+	test.Equal(t, end.Offset(), rebuilt)
+	test.Equal(t, end.EndOffset, reader.GetQueueReadEnd().(*diskQueueEndInfo).EndOffset)
+	test.Equal(t, end.TotalMsgCnt(), reader.GetQueueReadEnd().TotalMsgCnt())
+	test.Equal(t, int64(msgNum), dqReader.Depth())
+	ret, ok := dqReader.TryReadOne()
+	test.Equal(t, true, ok)
+	test.Equal(t, "test0", string(ret.Data))
+	dqReader.Close()
+	_, err = os.Stat(metaNames[0])
+	test.Nil(t, err)
+
+	// the fresh meta is restored after restart
+	dqReader, _ = newDiskQueueReader(dqName, dqName, tmpDir, 1024, 4, 1<<10, 1, 2*time.Second, nil, true)
+	reader = dqReader.(*diskQueueReader)
+	test.Equal(t, end.Offset(), reader.GetQueueReadEnd().Offset())
+	test.Equal(t, int64(msgNum), dqReader.Depth())
+	rebuilt, err = reader.RebuildMetaFromData(InitialPositionEnd)
+	test.Nil(t, err)
+	test.Equal(t, end.Offset(), rebuilt)
+	test.Equal(t, int64(0), dqReader.Depth())
+	_, ok = dqReader.TryReadOne()
+	test.Equal(t, false, ok)
+
+	// the partial message at the tail is not counted
+	f, err := os.OpenFile(dqWriter.fileName(end.EndOffset.FileNum), os.O_WRONLY|os.O_APPEND, 0644)
+	test.Nil(t, err)
+	f.Write([]byte{0, 0, 0, 100, 't'})
+	f.Close()
+	rebuilt, err = reader.RebuildMetaFromData(InitialPositionStart)
+	test.Equal(t, io.ErrUnexpectedEOF, err)
+	test.Equal(t, end.Offset(), rebuilt)
+	test.Equal(t, int64(msgNum), dqReader.Depth())
+	dqReader.Close()
+}
+
+type fakeConfirmStore struct {
+	sync.Mutex
+	offsets map[string][2]int64
+}
+
+func (s *fakeConfirmStore) LoadConfirmed(topic string, channel string, partition int) (BackendOffset, int64, error) {
+	s.Lock()
+	defer s.Unlock()
+	v, ok := s.offsets[getBackendReaderName(topic, partition, channel)]
+	if !ok {
+		return 0, 0, ErrConfirmNotStored
+	}
+	return BackendOffset(v[0]), v[1], nil
+}
+
+func (s *fakeConfirmStore) SaveConfirmed(topic string, channel string, partition int, offset BackendOffset, cnt int64) error {
+	s.Lock()
+	defer s.Unlock()
+	s.offsets[getBackendReaderName(topic, partition, channel)] = [2]int64{int64(offset), cnt}
+	return nil
+}
+
+func TestDiskQueueReaderConfirmStore(t *testing.T) {
+	dqName := "test_disk_queue_confirm_store" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	queue, _ := NewDiskQueueWriter(dqName, tmpDir, 1024, 4, 1<<10, 1)
+	dqWriter := queue.(*diskQueueWriter)
+	defer dqWriter.Close()
+	for i := 0; i < 100; i++ {
+		dqWriter.Put([]byte("test" + strconv.Itoa(i)))
+	}
+	dqWriter.Flush()
+	end := dqWriter.GetQueueWriteEnd()
+
+	store := &fakeConfirmStore{offsets: make(map[string][2]int64)}
+	dqReader, _ := newDiskQueueReader(dqName, dqName, tmpDir, 1024, 4, 1<<10, 1, 2*time.Second, nil, true)
+	d := dqReader.(*diskQueueReader)
+	test.Nil(t, d.SetConfirmStore(store, "topic", "ch", 0))
+	dqReader.UpdateQueueEnd(end, false)
+	test.Equal(t, int64(100), dqReader.Depth())
+	for i := 0; i < 10; i++ {
+		ret, ok := dqReader.TryReadOne()
+		test.Equal(t, true, ok)
+		test.Nil(t, dqReader.ConfirmRead(ret.Offset+ret.MovedSize, ret.CurCnt))
+	}
+	confirmed := dqReader.GetQueueConfirmed()
+	// saved in background
+	var stored BackendOffset
+	var cnt int64
+	for i := 0; i < 100; i++ {
+		stored, cnt, err = store.LoadConfirmed("topic", "ch", 0)
+		if err == nil && stored == confirmed.Offset() {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	test.Nil(t, err)
+	test.Equal(t, confirmed.Offset(), stored)
+	test.Equal(t, int64(10), cnt)
+	// the follower never saves to the store
+	d.SetConfirmStoreReadOnly(true)
+	ret, ok := dqReader.TryReadOne()
+	test.Equal(t, true, ok)
+	test.Nil(t, dqReader.ConfirmRead(ret.Offset+ret.MovedSize, ret.CurCnt))
+	time.Sleep(time.Millisecond * 100)
+	stored, _, err = store.LoadConfirmed("topic", "ch", 0)
+	test.Nil(t, err)
+	test.Equal(t, confirmed.Offset(), stored)
+	dqReader.Close()
+
+	// the local meta is kept if the store is behind
+	dqReader, _ = newDiskQueueReader(dqName, dqName, tmpDir, 1024, 4, 1<<10, 1, 2*time.Second, end, true)
+	d = dqReader.(*diskQueueReader)
+	test.Nil(t, d.SetConfirmStore(store, "topic", "ch", 0))
+	test.Equal(t, int64(11), dqReader.GetQueueConfirmed().TotalMsgCnt())
+	dqReader.Close()
+
+	// the local meta is lost on the new node, and the reader is created at the end
+	os.Remove(d.metaDataFileName(true))
+	os.Remove(d.metaDataFileName(false))
+	dqReader, _ = newDiskQueueReader(dqName, dqName, tmpDir, 1024, 4, 1<<10, 1, 2*time.Second, end, true)
+	d = dqReader.(*diskQueueReader)
+	test.Equal(t, int64(0), dqReader.Depth())
+	test.Nil(t, d.SetConfirmStore(store, "topic", "ch", 0))
+	test.Equal(t, confirmed.Offset(), dqReader.GetQueueConfirmed().Offset())
+	test.Equal(t, int64(10), dqReader.GetQueueConfirmed().TotalMsgCnt())
+	test.Equal(t, int64(90), dqReader.Depth())
+	ret, ok = dqReader.TryReadOne()
+	test.Equal(t, true, ok)
+	test.Equal(t, "test10", string(ret.Data))
+	// the local meta is used if nothing stored
+	test.Nil(t, d.SetConfirmStore(store, "topic", "ch2", 0))
+	test.Equal(t, confirmed.Offset(), dqReader.GetQueueConfirmed().Offset())
+	dqReader.Close()
+}
+
+func TestDiskQueueReaderDrainToEnd(t *testing.T) {
+	dqName := "test_disk_queue_drain_to_end" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	queue, _ := NewDiskQueueWriter(dqName, tmpDir, 1024, 4, 1<<10, 1)
+	dqWriter := queue.(*diskQueueWriter)
+	defer dqWriter.Close()
+	msgNum := 100
+	for i := 0; i < msgNum; i++ {
+		dqWriter.Put([]byte("test" + strconv.Itoa(i)))
+	}
+	dqWriter.Flush()
+	end := dqWriter.GetQueueWriteEnd()
+
+	dqReader, _ := newDiskQueueReader(dqName, dqName, tmpDir, 1024, 4, 1<<10, 1, 2*time.Second, nil, true)
+	defer dqReader.Close()
+	d := dqReader.(*diskQueueReader)
+	dqReader.UpdateQueueEnd(end, false)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- d.DrainToEnd(context.Background())
+	}()
+	var last ReadResult
+	for i := 0; i < msgNum; i++ {
+		ret, ok := dqReader.TryReadOne()
+		test.Equal(t, true, ok)
+		last = ret
+		if i == msgNum-1 {
+			break
+		}
+		test.Nil(t, dqReader.ConfirmRead(ret.Offset+ret.MovedSize, ret.CurCnt))
+	}
+	// the new data written while draining is not waited
+	dqWriter.Put([]byte("test"))
+	dqWriter.Flush()
+	dqReader.UpdateQueueEnd(dqWriter.GetQueueWriteEnd(), false)
+	select {
+	case err := <-done:
+		t.Fatalf("drain returned before the last confirmed: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	test.Nil(t, dqReader.ConfirmRead(last.Offset+last.MovedSize, last.CurCnt))
+	select {
+	case err := <-done:
+		test.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Fatalf("drain not returned after the last confirmed")
+	}
+	test.Equal(t, end.Offset(), dqReader.GetQueueConfirmed().Offset())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	test.Equal(t, context.DeadlineExceeded, d.DrainToEnd(ctx))
+	d.RLock()
+	test.Equal(t, 0, len(d.confirmWatchers))
+	d.RUnlock()
+}
+
+func TestDiskQueueReaderSetAutoSkipError(t *testing.T) {
+	dqName := "test_disk_queue_set_auto_skip" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	queue, _ := NewDiskQueueWriter(dqName, tmpDir, 1024, 4, 1<<10, 1)
+	dqWriter := queue.(*diskQueueWriter)
+	defer dqWriter.Close()
+	var corruptPos diskQueueOffset
+	corruptIdx := -1
+	nextFileIdx := -1
+	prev := dqWriter.GetQueueWriteEnd().(*diskQueueEndInfo).EndOffset
+	for i := 0; i < 200; i++ {
+		_, _, e, err := dqWriter.PutV2([]byte("test" + strconv.Itoa(i)))
+		test.Nil(t, err)
+		if prev.FileNum == 1 && corruptIdx == -1 && prev.Pos > 0 {
+			corruptIdx = i
+			corruptPos = prev
+		}
+		if prev.FileNum == 2 && nextFileIdx == -1 {
+			nextFileIdx = i
+		}
+		prev = e.EndOffset
+	}
+	dqWriter.Flush()
+	test.NotEqual(t, -1, nextFileIdx)
+	f, err := os.OpenFile(dqWriter.fileName(corruptPos.FileNum), os.O_RDWR, 0644)
+	test.Nil(t, err)
+	_, err = f.WriteAt([]byte{0xff, 0xff, 0xff, 0xff}, corruptPos.Pos)
+	test.Nil(t, err)
+	f.Close()
+
+	dqReader, _ := newDiskQueueReader(dqName, dqName, tmpDir, 1024, 4, 1<<10, 1, 2*time.Second, nil, false)
+	defer dqReader.Close()
+	d := dqReader.(*diskQueueReader)
+	dqReader.UpdateQueueEnd(dqWriter.GetQueueWriteEnd(), false)
+	for i := 0; i < corruptIdx; i++ {
+		ret, ok := dqReader.TryReadOne()
+		test.Equal(t, true, ok)
+		test.Nil(t, ret.Err)
+		test.Equal(t, "test"+strconv.Itoa(i), string(ret.Data))
+		test.Nil(t, dqReader.ConfirmRead(ret.Offset+ret.MovedSize, ret.CurCnt))
+	}
+	// the read stays at the corrupt data while the skip disabled
+	for i := 0; i < 3; i++ {
+		ret, ok := dqReader.TryReadOne()
+		test.Equal(t, true, ok)
+		test.NotNil(t, ret.Err)
+		test.Equal(t, corruptPos, d.GetQueueCurrentRead().(*diskQueueEndInfo).EndOffset)
+	}
+
+	d.SetAutoSkipError(true)
+	ret, ok := dqReader.TryReadOne()
+	test.Equal(t, true, ok)
+	test.Nil(t, ret.Err)
+	test.Equal(t, "test"+strconv.Itoa(nextFileIdx), string(ret.Data))
+	test.Nil(t, dqReader.ConfirmRead(ret.Offset+ret.MovedSize, ret.CurCnt))
+
+	d.SetAutoSkipError(false)
+	for i := nextFileIdx + 1; i < 200; i++ {
+		ret, ok := dqReader.TryReadOne()
+		test.Equal(t, true, ok)
+		test.Nil(t, ret.Err)
+		test.Equal(t, "test"+strconv.Itoa(i), string(ret.Data))
+	}
+}
+
+func TestDiskQueueReaderOffsetBase(t *testing.T) {
+	dqName := "test_disk_queue_offset_base" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	queue, _ := NewDiskQueueWriter(dqName, tmpDir, 1024, 4, 1<<10, 1)
+	dqWriter := queue.(*diskQueueWriter)
+	defer dqWriter.Close()
+
+	msgNum := 300
+	for i := 0; i < msgNum; i++ {
+		dqWriter.Put([]byte("test" + strconv.Itoa(i)))
+	}
+	dqWriter.Flush()
+	end := dqWriter.GetQueueWriteEnd()
+
+	dqReader, _ := newDiskQueueReader(dqName, dqName, tmpDir, 1024, 4, 1<<10, 1, 2*time.Second, nil, true)
+	_, err = NewOffsetBaseReader(dqReader, -1)
+	test.Equal(t, ErrInvalidOffset, err)
+	base := BackendOffset(1000000)
+	r, err := NewOffsetBaseReader(dqReader, base)
+	test.Nil(t, err)
+	var reader BackendQueueReader = r
+	defer reader.Close()
+	reader.UpdateQueueEnd(end, false)
+	test.Equal(t, end.Offset()+base, reader.GetQueueReadEnd().Offset())
+	test.Equal(t, end.TotalMsgCnt(), reader.GetQueueReadEnd().TotalMsgCnt())
+	test.Equal(t, base, reader.GetQueueConfirmed().Offset())
+
+	var rets []ReadResult
+	for i := 0; i < 10; i++ {
+		ret, ok := reader.TryReadOne()
+		test.Equal(t, true, ok)
+		test.Nil(t, ret.Err)
+		rets = append(rets, ret)
+	}
+	test.Equal(t, base, rets[0].Offset)
+	test.Equal(t, rets[9].Offset+rets[9].MovedSize, r.GetQueueCurrentRead().Offset())
+	// confirm with the shifted offset
+	err = reader.ConfirmRead(rets[4].Offset+rets[4].MovedSize, rets[4].CurCnt)
+	test.Nil(t, err)
+	test.Equal(t, rets[4].Offset+rets[4].MovedSize, reader.GetQueueConfirmed().Offset())
+	test.Equal(t, rets[4].Offset+rets[4].MovedSize-base, dqReader.GetQueueConfirmed().Offset())
+	err = reader.ConfirmRead(base-1, 1)
+	test.Equal(t, ErrConfirmSizeInvalid, err)
+
+	// reset back and read again at the same shifted offset
+	e, err := r.ResetReadToOffset(rets[2].Offset, rets[2].CurCnt-1)
+	test.Nil(t, err)
+	test.Equal(t, rets[2].Offset, e.Offset())
+	ret, ok := reader.TryReadOne()
+	test.Equal(t, true, ok)
+	test.Equal(t, rets[2].Offset, ret.Offset)
+	test.Equal(t, string(rets[2].Data), string(ret.Data))
+
+	// skip with the shifted offset
+	e, err = reader.SkipReadToOffset(rets[9].Offset+rets[9].MovedSize, rets[9].CurCnt)
+	test.Nil(t, err)
+	test.Equal(t, rets[9].Offset+rets[9].MovedSize, e.Offset())
+	test.Equal(t, rets[9].Offset+rets[9].MovedSize, reader.GetQueueConfirmed().Offset())
+	_, err = reader.SkipReadToOffset(base-1, 0)
+	test.Equal(t, ErrMoveOffsetInvalid, err)
+	confirmed, skipped, err := r.SkipMessages(5)
+	test.Nil(t, err)
+	test.Equal(t, int64(5), skipped)
+	test.Equal(t, dqReader.GetQueueConfirmed().Offset()+base, confirmed)
+	ret, ok = reader.TryReadOne()
+	test.Equal(t, true, ok)
+	test.Equal(t, confirmed, ret.Offset)
+	test.Equal(t, "test15", string(ret.Data))
+
+	e, err = reader.SkipReadToEnd()
+	test.Nil(t, err)
+	test.Equal(t, end.Offset()+base, e.Offset())
+	test.Equal(t, true, e.IsSame(reader.GetQueueReadEnd()))
+}
+
+type otherBackendEnd struct {
+	offset BackendOffset
+	cnt    int64
+}
+
+func (e *otherBackendEnd) Offset() BackendOffset {
+	return e.offset
+}
+
+func (e *otherBackendEnd) TotalMsgCnt() int64 {
+	return e.cnt
+}
+
+func (e *otherBackendEnd) IsSame(other BackendQueueEnd) bool {
+	return false
+}
+
+func TestDiskQueueReaderEndTypeMismatch(t *testing.T) {
+	dqName := "test_disk_queue_end_mismatch" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	queue, _ := NewDiskQueueWriter(dqName, tmpDir, 1024, 4, 1<<10, 1)
+	dqWriter := queue.(*diskQueueWriter)
+	defer dqWriter.Close()
+	for i := 0; i < 10; i++ {
+		dqWriter.Put([]byte(fmt.Sprintf("test%02d", i)))
+	}
+	dqWriter.Flush()
+	end := dqWriter.GetQueueWriteEnd()
+
+	dqReader, _ := newDiskQueueReader(dqName, dqName, tmpDir, 1024, 4, 1<<10, 1, 2*time.Second, nil, true)
+	defer dqReader.Close()
+	reader := dqReader.(*diskQueueReader)
+
+	other := &otherBackendEnd{offset: end.Offset(), cnt: end.TotalMsgCnt()}
+	changed, err := dqReader.UpdateQueueEnd(other, false)
+	test.Equal(t, ErrOffsetTypeMismatch, err)
+	test.Equal(t, false, changed)
+	_, err = reader.UpdateQueueEndWithResult(other, false)
+	test.Equal(t, ErrOffsetTypeMismatch, err)
+	test.Equal(t, int64(2), reader.EndTypeMismatchCount())
+	test.Equal(t, BackendOffset(0), dqReader.GetQueueReadEnd().Offset())
+
+	// the nil end is not the mismatch
+	_, err = dqReader.UpdateQueueEnd(nil, false)
+	test.Nil(t, err)
+	var nilEnd *diskQueueEndInfo
+	_, err = dqReader.UpdateQueueEnd(nilEnd, false)
+	test.Nil(t, err)
+	test.Equal(t, int64(2), reader.EndTypeMismatchCount())
+
+	changed, err = dqReader.UpdateQueueEnd(end, false)
+	test.Nil(t, err)
+	test.Equal(t, true, changed)
+}
+
+func TestDiskQueueReaderExportImportState(t *testing.T) {
+	dqName := "test_disk_queue_reader_state" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	queue, _ := NewDiskQueueWriter(dqName, tmpDir, 64, 4, 1<<10, 1)
+	dqWriter := queue.(*diskQueueWriter)
+	defer dqWriter.Close()
+
+	msgNum := 20
+	for i := 0; i < msgNum; i++ {
+		dqWriter.Put([]byte(fmt.Sprintf("test%02d", i)))
+	}
+	dqWriter.Flush()
+	end := dqWriter.GetQueueWriteEnd()
+
+	dqReader, _ := newDiskQueueReader(dqName, dqName, tmpDir, 64, 4, 1<<10, 1, 2*time.Second, nil, true)
+	defer dqReader.Close()
+	dqReader.UpdateQueueEnd(end, false)
+	var rets []ReadResult
+	for i := 0; i < 9; i++ {
+		ret, ok := dqReader.TryReadOne()
+		test.Equal(t, true, ok)
+		rets = append(rets, ret)
+	}
+	confirmed := rets[6]
+	err = dqReader.ConfirmRead(confirmed.Offset+confirmed.MovedSize, confirmed.CurCnt)
+	test.Nil(t, err)
+	state, err := dqReader.(*diskQueueReader).ExportState()
+	test.Nil(t, err)
+
+	restored, err := newDiskQueueReader(dqName, dqName+"_restored", tmpDir, 64, 4, 1<<10, 1, 2*time.Second, nil, true)
+	test.Nil(t, err)
+	// the confirmed is beyond the end known by the importing reader
+	err = restored.(*diskQueueReader).ImportState(state)
+	test.Equal(t, ErrInvalidReaderState, err)
+	restored.UpdateQueueEnd(end, false)
+	err = restored.(*diskQueueReader).ImportState(state)
+	test.Nil(t, err)
+	test.Equal(t, dqReader.GetQueueConfirmed(), restored.GetQueueConfirmed())
+	test.Equal(t, end.Offset(), restored.GetQueueReadEnd().Offset())
+	ret, ok := restored.TryReadOne()
+	test.Equal(t, true, ok)
+	test.Nil(t, ret.Err)
+	test.Equal(t, rets[7].Offset, ret.Offset)
+	test.Equal(t, "test07", string(ret.Data))
+
+	// the state restored is persisted
+	restored.Close()
+	restored, err = newDiskQueueReader(dqName, dqName+"_restored", tmpDir, 64, 4, 1<<10, 1, 2*time.Second, nil, true)
+	test.Nil(t, err)
+	defer restored.Close()
+	test.Equal(t, dqReader.GetQueueConfirmed(), restored.GetQueueConfirmed())
+
+	var tmp readerState
+	test.Nil(t, json.Unmarshal(state, &tmp))
+	invalids := []func(s *readerState){
+		func(s *readerState) { s.Version = readerStateVersion + 1 },
+		func(s *readerState) { s.ReadFrom = "other" },
+		func(s *readerState) { s.Confirmed.Offset = s.End.Offset + 1 },
+		func(s *readerState) { s.Confirmed.Cnt = s.End.Cnt + 1 },
+		// the end in the state is never used
+		func(s *readerState) {
+			s.End.Offset += 1000
+			s.End.Cnt += 100
+			s.Confirmed.Offset = end.Offset() + 1
+		},
+	}
+	for _, invalid := range invalids {
+		s := tmp
+		invalid(&s)
+		data, _ := json.Marshal(&s)
+		err = restored.(*diskQueueReader).ImportState(data)
+		test.Equal(t, ErrInvalidReaderState, err)
+	}
+	test.Equal(t, dqReader.GetQueueConfirmed(), restored.GetQueueConfirmed())
+	test.Equal(t, end.Offset(), restored.GetQueueReadEnd().Offset())
+}
+
+func TestDiskQueueReaderDepth(t *testing.T) {
+	dqName := "test_disk_queue_depth" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	queue, _ := NewDiskQueueWriter(dqName, tmpDir, 1024, 4, 1<<10, 1)
+	dqWriter := queue.(*diskQueueWriter)
+	defer dqWriter.Close()
+
+	msg := []byte("test")
+	msgRawSize := int64(4 + len(msg))
+	msgNum := 200
+	for i := 0; i < msgNum; i++ {
+		dqWriter.Put(msg)
+	}
+	dqWriter.Flush()
+	end := dqWriter.GetQueueWriteEnd()
+	test.Equal(t, true, end.(*diskQueueEndInfo).EndOffset.FileNum > 0)
+
+	dqReader, _ := newDiskQueueReader(dqName, dqName, tmpDir, 1024, 4, 1<<10, 1, 2*time.Second, nil, true)
+	defer dqReader.Close()
+	dqReader.UpdateQueueEnd(end, false)
+	test.Equal(t, int64(msgNum)*msgRawSize, dqReader.DepthSize())
+	test.Equal(t, int64(msgNum), dqReader.Depth())
+
+	var readList []ReadResult
+	for i := 0; i < msgNum; i++ {
+		msgOut, hasData := dqReader.TryReadOne()
+		test.Equal(t, true, hasData)
+		readList = append(readList, msgOut)
+	}
+	// confirm across the files should use the virtual distance
+	first := readList[0]
+	err = dqReader.ConfirmRead(first.Offset+first.MovedSize, first.CurCnt)
+	test.Nil(t, err)
+	test.Equal(t, int64(0), dqReader.GetQueueConfirmed().(*diskQueueEndInfo).EndOffset.FileNum)
+	test.Equal(t, int64(end.Offset()-(first.Offset+first.MovedSize)), dqReader.DepthSize())
+	test.Equal(t, int64(msgNum-1), dqReader.Depth())
+
+	// confirm in the same file with the end
+	last := readList[msgNum-2]
+	err = dqReader.ConfirmRead(last.Offset+last.MovedSize, last.CurCnt)
+	test.Nil(t, err)
+	test.Equal(t, end.(*diskQueueEndInfo).EndOffset.FileNum, dqReader.GetQueueConfirmed().(*diskQueueEndInfo).EndOffset.FileNum)
+	test.Equal(t, msgRawSize, dqReader.DepthSize())
+	test.Equal(t, int64(1), dqReader.Depth())
+
+	r := dqReader.(*diskQueueReader)
+	// the confirmed past the end should have no depth
+	r.Lock()
+	oldEnd := r.queueEndInfo
+	r.queueEndInfo = r.confirmedQueueInfo
+	r.queueEndInfo.virtualEnd -= BackendOffset(msgRawSize)
+	r.queueEndInfo.EndOffset.Pos -= msgRawSize
+	r.queueEndInfo.totalMsgCnt--
+	r.updateDepth()
+	r.Unlock()
+	test.Equal(t, int64(0), dqReader.DepthSize())
+	test.Equal(t, int64(0), dqReader.Depth())
+	r.Lock()
+	r.queueEndInfo = oldEnd
+	r.confirmedQueueInfo = oldEnd
+	r.confirmedQueueInfo.EndOffset.FileNum++
+	r.confirmedQueueInfo.EndOffset.Pos = 0
+	r.updateDepth()
+	r.Unlock()
+	test.Equal(t, int64(0), dqReader.DepthSize())
+	test.Equal(t, int64(0), dqReader.Depth())
+}
+
 func TestDiskQueueReaderResetRead(t *testing.T) {
 	// backward, forward
 
@@ -99,7 +3161,7 @@ func TestDiskQueueReaderResetRead(t *testing.T) {
 	end := dqWriter.GetQueueWriteEnd()
 	test.Nil(t, err)
 
-	dqReader := newDiskQueueReader(dqName, dqName, tmpDir, 1024, 4, 1<<10, 1, 2*time.Second, nil, true)
+	dqReader, _ := newDiskQueueReader(dqName, dqName, tmpDir, 1024, 4, 1<<10, 1, 2*time.Second, nil, true)
 	dqReader.UpdateQueueEnd(end, false)
 	firstReadMsg, _ := dqReader.TryReadOne()
 	equal(t, firstReadMsg.Data, msg)
@@ -196,7 +3258,7 @@ func TestDiskQueueReaderSkip(t *testing.T) {
 	end := dqWriter.GetQueueWriteEnd()
 	test.Nil(t, err)
 
-	dqReader := newDiskQueueReader(dqName, dqName, tmpDir, 1024, 4, 1<<10, 1, 2*time.Second, nil, true)
+	dqReader, _ := newDiskQueueReader(dqName, dqName, tmpDir, 1024, 4, 1<<10, 1, 2*time.Second, nil, true)
 	dqReader.UpdateQueueEnd(end, false)
 	firstReadMsg, _ := dqReader.TryReadOne()
 	equal(t, firstReadMsg.Data, msg)
@@ -292,40 +3354,40 @@ func TestDiskQueueReaderUpdateEnd(t *testing.T) {
 	end := dqWriter.GetQueueWriteEnd()
 	test.Nil(t, err)
 
-	dqReaderWithEnd := newDiskQueueReader(dqName, dqName+"-meta1", tmpDir, 1024, 4, 1<<10, 1, 2*time.Second, end, true)
+	dqReaderWithEnd, _ := newDiskQueueReader(dqName, dqName+"-meta1", tmpDir, 1024, 4, 1<<10, 1, 2*time.Second, end, true)
 	test.Equal(t, dqReaderWithEnd.GetQueueReadEnd(), end)
 	test.Equal(t, dqReaderWithEnd.GetQueueConfirmed(), end)
 	_, hasData := dqReaderWithEnd.TryReadOne()
 	equal(t, hasData, false)
 	dqReaderWithEnd.Close()
-	dqReaderWithEnd = newDiskQueueReader(dqName, dqName+"-meta1", tmpDir, 1024, 4, 1<<10, 1, 2*time.Second, midEnd, true)
+	dqReaderWithEnd, _ = newDiskQueueReader(dqName, dqName+"-meta1", tmpDir, 1024, 4, 1<<10, 1, 2*time.Second, midEnd, true)
 	test.Equal(t, dqReaderWithEnd.GetQueueReadEnd(), end)
 	test.Equal(t, dqReaderWithEnd.GetQueueConfirmed(), end)
 	_, hasData = dqReaderWithEnd.TryReadOne()
 	equal(t, hasData, false)
 
 	dqReaderWithEnd.Close()
-	dqReaderWithEnd = newDiskQueueReader(dqName, dqName+"-meta2", tmpDir, 1024, 4, 1<<10, 1, 2*time.Second, midEnd, true)
+	dqReaderWithEnd, _ = newDiskQueueReader(dqName, dqName+"-meta2", tmpDir, 1024, 4, 1<<10, 1, 2*time.Second, midEnd, true)
 	test.Equal(t, dqReaderWithEnd.GetQueueReadEnd(), midEnd)
 	test.Equal(t, dqReaderWithEnd.GetQueueConfirmed(), midEnd)
 	_, hasData = dqReaderWithEnd.TryReadOne()
 	equal(t, hasData, false)
 
 	dqReaderWithEnd.Close()
-	dqReaderWithEnd = newDiskQueueReader(dqName, dqName+"-meta2", tmpDir, 1024, 4, 1<<10, 1, 2*time.Second, end, true)
+	dqReaderWithEnd, _ = newDiskQueueReader(dqName, dqName+"-meta2", tmpDir, 1024, 4, 1<<10, 1, 2*time.Second, end, true)
 	test.Equal(t, dqReaderWithEnd.GetQueueReadEnd(), midEnd)
 	test.Equal(t, dqReaderWithEnd.GetQueueConfirmed(), midEnd)
 	_, hasData = dqReaderWithEnd.TryReadOne()
 	equal(t, hasData, false)
 	dqReaderWithEnd.UpdateQueueEnd(end, false)
 	dqReaderWithEnd.Close()
-	dqReaderWithEnd = newDiskQueueReader(dqName, dqName+"-meta2", tmpDir, 1024, 4, 1<<10, 1, 2*time.Second, end, true)
+	dqReaderWithEnd, _ = newDiskQueueReader(dqName, dqName+"-meta2", tmpDir, 1024, 4, 1<<10, 1, 2*time.Second, end, true)
 	test.Equal(t, dqReaderWithEnd.GetQueueReadEnd(), end)
 	test.Equal(t, dqReaderWithEnd.GetQueueConfirmed(), midEnd)
 	_, hasData = dqReaderWithEnd.TryReadOne()
 	equal(t, hasData, true)
 
-	dqReader := newDiskQueueReader(dqName, dqName, tmpDir, 1024, 4, 1<<10, 1, 2*time.Second, nil, true)
+	dqReader, _ := newDiskQueueReader(dqName, dqName, tmpDir, 1024, 4, 1<<10, 1, 2*time.Second, nil, true)
 	dqReader.UpdateQueueEnd(end, false)
 	defer dqReader.Close()
 	test.Equal(t, dqReader.GetQueueReadEnd(), end)
@@ -382,3 +3444,187 @@ func TestDiskQueueSnapshotReader(t *testing.T) {
 	test.Equal(t, 100, len(data))
 	// remove some begin of queue, and test queue start
 }
+
+func TestDiskQueueReaderRandomReadFileCache(t *testing.T) {
+	dqName := "test_disk_queue_read_file_cache" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	queue, _ := NewDiskQueueWriter(dqName, tmpDir, 1024, 4, 1<<10, 1)
+	dqWriter := queue.(*diskQueueWriter)
+	defer dqWriter.Close()
+
+	msgNum := 300
+	for i := 0; i < msgNum; i++ {
+		dqWriter.Put([]byte("test" + strconv.Itoa(i)))
+	}
+	dqWriter.Flush()
+	end := dqWriter.GetQueueWriteEnd()
+	fileCnt := int(end.(*diskQueueEndInfo).EndOffset.FileNum) + 1
+	if end.(*diskQueueEndInfo).EndOffset.Pos == 0 {
+		fileCnt--
+	}
+	test.Equal(t, true, fileCnt > 2)
+
+	var openCnt int64
+	oldOpen := openQueueFileForRead
+	openQueueFileForRead = func(fileName string) (*os.File, error) {
+		atomic.AddInt64(&openCnt, 1)
+		return oldOpen(fileName)
+	}
+	defer func() {
+		openQueueFileForRead = oldOpen
+	}()
+
+	dqReader, _ := newDiskQueueReader(dqName, dqName, tmpDir, 1024, 4, 1<<10, 1, 2*time.Second, nil, true)
+	defer dqReader.Close()
+	dqReader.UpdateQueueEnd(end, false)
+	reader := dqReader.(*diskQueueReader)
+	maxCached := fileCnt + 1
+	SetMaxCachedReadFiles(maxCached)
+	defer SetMaxCachedReadFiles(0)
+
+	all, err := reader.ReadLastN(msgNum)
+	test.Nil(t, err)
+	test.Equal(t, msgNum, len(all))
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for i := 0; i < 200; i++ {
+		from := r.Intn(msgNum)
+		to := from + r.Intn(msgNum-from)
+		switch i % 3 {
+		case 0:
+			rets, err := reader.ReadRange(all[from].Offset, all[to].Offset)
+			test.Nil(t, err)
+			test.Equal(t, to-from, len(rets))
+			for j, ret := range rets {
+				test.Equal(t, "test"+strconv.Itoa(from+j), string(ret.Data))
+			}
+		case 1:
+			rets, err := reader.ReverseScan(all[to].Offset, to-from)
+			test.Nil(t, err)
+			test.Equal(t, to-from, len(rets))
+			for j, ret := range rets {
+				test.Equal(t, "test"+strconv.Itoa(to-1-j), string(ret.Data))
+			}
+		default:
+			rets, err := reader.ReadLastN(msgNum - from)
+			test.Nil(t, err)
+			test.Equal(t, msgNum-from, len(rets))
+			test.Equal(t, "test"+strconv.Itoa(from), string(rets[0].Data))
+		}
+	}
+	// each file is opened once and reused by the later reads
+	test.Equal(t, true, atomic.LoadInt64(&openCnt) <= int64(maxCached))
+	test.Equal(t, true, sharedReadFileCache.len() <= maxCached)
+
+	// the least recently used are closed while the cache is shrunk
+	SetMaxCachedReadFiles(2)
+	test.Equal(t, 2, sharedReadFileCache.len())
+	for i := 0; i < 20; i++ {
+		from := r.Intn(msgNum)
+		rets, err := reader.ReadRange(all[from].Offset, end.Offset())
+		test.Nil(t, err)
+		test.Equal(t, msgNum-from, len(rets))
+		test.Equal(t, true, sharedReadFileCache.len() <= 2)
+	}
+
+	// the live read opens its own file
+	atomic.StoreInt64(&openCnt, 0)
+	for i := 0; i < msgNum; i++ {
+		ret, ok := dqReader.TryReadOne()
+		test.Equal(t, true, ok)
+		test.Nil(t, ret.Err)
+		test.Equal(t, "test"+strconv.Itoa(i), string(ret.Data))
+	}
+	test.Equal(t, int64(fileCnt), atomic.LoadInt64(&openCnt))
+
+	// the handles of the files removed by the retention should be closed
+	SetMaxCachedReadFiles(maxCached)
+	_, err = reader.ReadRange(all[0].Offset, end.Offset())
+	test.Nil(t, err)
+	test.Equal(t, fileCnt, sharedReadFileCache.len())
+	_, err = dqWriter.CleanOldDataByRetention(end, false, 0)
+	test.Nil(t, err)
+	test.Equal(t, true, sharedReadFileCache.len() < fileCnt)
+	sharedReadFileCache.Lock()
+	for fileName := range sharedReadFileCache.files {
+		_, err = os.Stat(fileName)
+		test.Nil(t, err)
+	}
+	sharedReadFileCache.Unlock()
+}
+
+func TestDiskQueueReaderConfirmDeadlineRedeliver(t *testing.T) {
+	dqName := "test_disk_queue_confirm_deadline" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	queue, _ := NewDiskQueueWriter(dqName, tmpDir, 1024, 4, 1<<10, 1)
+	dqWriter := queue.(*diskQueueWriter)
+	defer dqWriter.Close()
+
+	msgNum := 2
+	for i := 0; i < msgNum; i++ {
+		dqWriter.Put([]byte("test" + strconv.Itoa(i)))
+	}
+	dqWriter.Flush()
+	end := dqWriter.GetQueueWriteEnd()
+
+	dqReader, _ := newDiskQueueReader(dqName, dqName, tmpDir, 1024, 4, 1<<10, 1, 2*time.Second, nil, true)
+	defer dqReader.Close()
+	dqReader.UpdateQueueEnd(end, false)
+	reader := dqReader.(*diskQueueReader)
+	timeout := time.Millisecond * 100
+	reader.SetConfirmDeadline(timeout, 1)
+
+	first, ok := dqReader.TryReadOne()
+	test.Equal(t, true, ok)
+	test.Nil(t, first.Err)
+	test.Equal(t, int32(1), first.Attempts)
+	// not redelivered before the deadline
+	second, ok := dqReader.TryReadOne()
+	test.Equal(t, true, ok)
+	test.Equal(t, "test1", string(second.Data))
+	_, ok = dqReader.TryReadOne()
+	test.Equal(t, false, ok)
+	test.Equal(t, false, reader.HasExpiredConfirmDeadline())
+	test.Equal(t, int64(0), reader.DeadlineRedeliverCount())
+
+	// never confirmed, redelivered from the first after the deadline
+	time.Sleep(timeout * 2)
+	test.Equal(t, true, reader.HasExpiredConfirmDeadline())
+	reader.Lock()
+	reader.redeliverExpiredConfirmDeadline()
+	reader.Unlock()
+	ret, ok := dqReader.TryReadOne()
+	test.Equal(t, true, ok)
+	test.Nil(t, ret.Err)
+	test.Equal(t, first.Offset, ret.Offset)
+	test.Equal(t, string(first.Data), string(ret.Data))
+	test.Equal(t, int32(2), ret.Attempts)
+	test.Equal(t, int64(1), reader.DeadlineRedeliverCount())
+	test.Equal(t, first.Offset, reader.GetQueueConfirmed().Offset())
+	ret, ok = dqReader.TryReadOne()
+	test.Equal(t, true, ok)
+	test.Equal(t, second.Offset, ret.Offset)
+	test.Equal(t, int32(2), ret.Attempts)
+
+	// the deadline of the message can be changed while not confirmed
+	err = reader.SetMessageConfirmDeadline(second.Offset, time.Now().Add(time.Hour))
+	test.Nil(t, err)
+	err = reader.SetMessageConfirmDeadline(end.Offset(), time.Now())
+	test.Equal(t, ErrMoveOffsetInvalid, err)
+
+	// given up after redelivered the max times
+	time.Sleep(timeout * 2)
+	test.Equal(t, false, reader.HasExpiredConfirmDeadline())
+	_, ok = dqReader.TryReadOne()
+	test.Equal(t, false, ok)
+	test.Equal(t, int64(1), reader.DeadlineRedeliverCount())
+	test.Equal(t, int64(1), reader.DeadlineExhaustedCount())
+
+	err = dqReader.ConfirmRead(second.Offset+second.MovedSize, second.CurCnt)
+	test.Nil(t, err)
+	test.Equal(t, 0, len(reader.confirmDeadlines))
+	test.Equal(t, int64(0), dqReader.Depth())
+}
@@ -0,0 +1,109 @@
+package nsqd
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+)
+
+// walk the size header of each message, and return the size and count of the messages before
+// the first invalid framing with the error.
+func (d *diskQueueReader) scanFileMessages(fileNum int64) (int64, int64, error) {
+	f, err := os.Open(d.dataFileName(fileNum))
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	var pos int64
+	var cnt int64
+	var msgSize int32
+	headerLen := d.getFileHeaderLen()
+	dataSize := getQueueFileDataSize(stat.Size(), headerLen)
+	for pos < dataSize {
+		_, err = f.Seek(headerLen+pos, 0)
+		if err != nil {
+			return pos, cnt, err
+		}
+		err = binary.Read(f, binary.BigEndian, &msgSize)
+		if err != nil {
+			return pos, cnt, err
+		}
+		if msgSize < d.minMsgSize || msgSize > MAX_POSSIBLE_MSG_SIZE {
+			return pos, cnt, ErrInvalidReadable
+		}
+		if pos+4+int64(msgSize) > dataSize {
+			// the last message is not written completely
+			return pos, cnt, io.ErrUnexpectedEOF
+		}
+		pos += 4 + int64(msgSize)
+		cnt++
+	}
+	return pos, cnt, nil
+}
+
+// RebuildMetaFromData rebuilds the end of the reader by scanning the data files from the
+// oldest one, and writes the fresh meta with the read and confirmed moved to the start or
+// the end by the policy. It is used to recover the reader while the meta is lost or corrupt.
+// The oldest data file is searched until the end provided by the writer, and the scan stops at
+// the first invalid framing, so the end is the last consistent offset and the framing error is
+// returned with the meta rebuilt.
+func (d *diskQueueReader) RebuildMetaFromData(policy string) (BackendOffset, error) {
+	if policy != InitialPositionStart && policy != InitialPositionEnd {
+		return 0, ErrInvalidInitialPosition
+	}
+	d.Lock()
+	defer d.Unlock()
+	if d.exitFlag == 1 {
+		return 0, ErrExiting
+	}
+	d.resumeCorruptionHalted()
+	start, err := d.findQueueStart()
+	if err != nil {
+		nsqLog.LogErrorf("diskqueue(%s) failed to find the queue start for rebuilding meta: %v",
+			d.readerMetaName, err)
+		return 0, err
+	}
+
+	end, scanErr := d.scanQueueEnd(start)
+	nsqLog.Logf("diskqueue(%s) rebuilt the end from %v to %v, start: %v",
+		d.readerMetaName, d.queueEndInfo, end, start)
+	d.queueEndInfo = end
+	if policy == InitialPositionEnd {
+		d.resetReadToFileStart(end)
+	} else {
+		d.resetReadToFileStart(start)
+	}
+	d.metaMissing = false
+	return end.Offset(), scanErr
+}
+
+// scan the data files from the start until the file missing, the start is the end if all the
+// data files are cleaned.
+func (d *diskQueueReader) scanQueueEnd(start diskQueueEndInfo) (diskQueueEndInfo, error) {
+	end := start
+	if start.EndOffset.Pos != 0 {
+		return end, nil
+	}
+	for fileNum := start.EndOffset.FileNum; ; fileNum++ {
+		if _, err := os.Stat(d.dataFileName(fileNum)); err != nil {
+			if os.IsNotExist(err) {
+				return end, nil
+			}
+			return end, err
+		}
+		size, cnt, err := d.scanFileMessages(fileNum)
+		end.EndOffset.FileNum = fileNum
+		end.EndOffset.Pos = size
+		end.virtualEnd += BackendOffset(size)
+		end.totalMsgCnt += cnt
+		if err != nil {
+			nsqLog.LogErrorf("diskqueue(%s) rebuilding meta stopped at invalid data in file %v:%v: %v",
+				d.readerMetaName, fileNum, size, err)
+			return end, err
+		}
+	}
+}
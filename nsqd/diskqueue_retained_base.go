@@ -0,0 +1,87 @@
+package nsqd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+)
+
+// the retained base cached with the stat of the extra meta, the writer will update the
+// extra meta before removing the leading files, so the cache is invalid if it changed.
+type retainedBaseCache struct {
+	valid   bool
+	modTime time.Time
+	size    int64
+	base    diskQueueEndInfo
+}
+
+// getRetainedBase returns the start of the oldest retained data file, the virtual offsets
+// before it have been garbage collected by the retention. The base is persisted by the writer
+// in the extra meta before the leading files are removed, so it will never be behind the
+// files removed. If no extra meta, the data files are walked to find the start.
+// should be protected by the lock
+func (d *diskQueueReader) getRetainedBase() (diskQueueEndInfo, error) {
+	var base diskQueueEndInfo
+	fileName := fmt.Sprintf(path.Join(d.dataPath, "%s.diskqueue.meta.extra.dat"), d.readFrom)
+	stat, err := os.Stat(fileName)
+	if err == nil && d.retainedBase.valid && stat.ModTime().Equal(d.retainedBase.modTime) &&
+		stat.Size() == d.retainedBase.size {
+		return d.retainedBase.base, nil
+	}
+	d.retainedBase.valid = false
+	var data []byte
+	if err == nil {
+		data, err = ioutil.ReadFile(fileName)
+	}
+	if err == nil {
+		var tmp extraMeta
+		err = json.Unmarshal(data, &tmp)
+		if err == nil {
+			base.EndOffset = tmp.SegOffset
+			base.virtualEnd = tmp.VirtualOffset
+			base.totalMsgCnt = tmp.TotalMsgCnt
+			d.retainedBase = retainedBaseCache{
+				valid:   true,
+				modTime: stat.ModTime(),
+				size:    stat.Size(),
+				base:    base,
+			}
+			return base, nil
+		}
+		nsqLog.LogWarningf("diskqueue(%s) failed to parse the extra meta %v: %v", d.readerMetaName, fileName, err)
+	} else if !os.IsNotExist(err) {
+		nsqLog.LogWarningf("diskqueue(%s) failed to read the extra meta %v: %v", d.readerMetaName, fileName, err)
+	}
+	return d.findQueueStart()
+}
+
+// OldestReadableOffset returns the virtual offset at the start of the oldest retained data file,
+// the offsets before it have been garbage collected and can not be read any more.
+func (d *diskQueueReader) OldestReadableOffset() (BackendOffset, error) {
+	d.Lock()
+	defer d.Unlock()
+	if d.exitFlag == 1 {
+		return 0, ErrExiting
+	}
+	base, err := d.getRetainedBase()
+	if err != nil {
+		return 0, err
+	}
+	return base.Offset(), nil
+}
+
+// checkRetained returns ErrOffsetGarbageCollected if the virtual offset is before the retained
+// base, so the rewind to the removed data is reported clearly. The error of finding the base is
+// ignored here and left to the later read.
+// should be protected by the lock
+func (d *diskQueueReader) checkRetained(voffset BackendOffset) error {
+	base, err := d.getRetainedBase()
+	if err == nil && voffset < base.Offset() {
+		nsqLog.Logf("diskqueue(%s) offset %v is before the retained base: %v", d.readerMetaName, voffset, base)
+		return ErrOffsetGarbageCollected
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package nsqd
+
+// ReverseScan returns at most n messages before the from offset in the reverse order, the
+// newest one first. The files are walked backward from the file of the from offset by the file
+// start in the offset meta, and each file is read forward by a separate reader, so the read and
+// confirmed position of this reader are not changed. The scan stops at the oldest retained data.
+func (d *diskQueueReader) ReverseScan(from BackendOffset, n int) ([]ReadResult, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	d.Lock()
+	if d.exitFlag == 1 {
+		d.Unlock()
+		return nil, ErrExiting
+	}
+	end := d.queueEndInfo
+	base, err := d.getRetainedBase()
+	d.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if from > end.Offset() {
+		return nil, ErrMoveOffsetInvalid
+	}
+	if from < base.Offset() {
+		return nil, ErrOffsetGarbageCollected
+	}
+
+	var result []ReadResult
+	stop := from
+	fileNum := end.EndOffset.FileNum
+	for stop > base.Offset() && len(result) < n {
+		start, startFile := d.findFileStartBefore(base, fileNum, stop)
+		msgs, err := d.readLastInRange(start, stop, end, n-len(result))
+		if err != nil {
+			return result, err
+		}
+		for i := len(msgs) - 1; i >= 0; i-- {
+			result = append(result, msgs[i])
+		}
+		stop = start.Offset()
+		fileNum = startFile
+	}
+	return result, nil
+}
+
+// find the latest file start before the offset from the file backward, the file missing the
+// offset meta is skipped, so the start may be earlier than needed.
+func (d *diskQueueReader) findFileStartBefore(base diskQueueEndInfo, fileNum int64,
+	offset BackendOffset) (diskQueueEndInfo, int64) {
+	for ; fileNum > base.EndOffset.FileNum; fileNum-- {
+		cnt, _, endPos, err := getQueueFileOffsetMeta(d.fileName(fileNum - 1))
+		if err != nil || BackendOffset(endPos) >= offset {
+			continue
+		}
+		var start diskQueueEndInfo
+		start.EndOffset.FileNum = fileNum
+		start.virtualEnd = BackendOffset(endPos)
+		start.totalMsgCnt = cnt
+		return start, fileNum
+	}
+	return base, base.EndOffset.FileNum
+}
@@ -62,6 +62,31 @@ func TestDiskQueueRoll(t *testing.T) {
 	equal(t, dq.(*diskQueue).writePos, int64(0))
 }
 
+func TestDiskQueueCustomFileNamePattern(t *testing.T) {
+	l := newTestLogger(t)
+	dqName := "test_disk_queue_pattern" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	err = SetQueueFileNamePattern("%s.custom.%06d.log", "%s.custom.reader.meta")
+	equal(t, err, nil)
+	defer SetQueueFileNamePattern("", "")
+
+	dq := newDiskQueue(dqName, tmpDir, 1024, 4, 1<<10, 2500, 2*time.Second, l)
+	defer dq.Close()
+	msg := []byte("test")
+	err = dq.Put(msg)
+	equal(t, err, nil)
+	msgOut := <-dq.ReadChan()
+	equal(t, msgOut, msg)
+
+	_, err = os.Stat(path.Join(tmpDir, fmt.Sprintf("%s.custom.%06d.log", dqName, 0)))
+	equal(t, err, nil)
+	assertFileNotExist(t, path.Join(tmpDir, fmt.Sprintf("%s.diskqueue.%06d.dat", dqName, 0)))
+}
+
 func assertFileNotExist(t *testing.T, fn string) {
 	f, err := os.OpenFile(fn, os.O_RDONLY, 0600)
 	equal(t, f, (*os.File)(nil))
@@ -0,0 +1,101 @@
+package nsqd
+
+import (
+	"os"
+	"path"
+	"time"
+
+	"github.com/youzan/nsq/internal/util"
+)
+
+// the cold data path for the old data files of the topic, the data files all consumed and older
+// than the cold age will be moved to the cold path, disabled if empty.
+func getColdDataPath(coldRoot string, topicName string) string {
+	if coldRoot == "" {
+		return ""
+	}
+	return path.Join(coldRoot, topicName)
+}
+
+// resolveQueueFileName returns the actual location of the data file,
+// the hot data path is preferred if the file is not moved to cold.
+func resolveQueueFileName(dataRoot string, coldPath string, base string, fileNum int64) string {
+	fileName := GetQueueFileName(dataRoot, base, fileNum)
+	if coldPath == "" {
+		return fileName
+	}
+	if _, err := os.Stat(fileName); !os.IsNotExist(err) {
+		return fileName
+	}
+	coldFileName := GetQueueFileName(coldPath, base, fileNum)
+	if _, err := os.Stat(coldFileName); err == nil {
+		return coldFileName
+	}
+	return fileName
+}
+
+// the data file resolved in the hot path may be moved to cold before opened, so the cold file
+// should be tried if the resolved is not found.
+func getColdFileNameIfMoved(coldPath string, base string, fileNum int64, resolved string, err error) string {
+	if !os.IsNotExist(err) || coldPath == "" {
+		return ""
+	}
+	coldFileName := GetQueueFileName(coldPath, base, fileNum)
+	if coldFileName == resolved {
+		return ""
+	}
+	return coldFileName
+}
+
+// openResolvedQueueFile opens the actual location of the data file by the open func, and returns
+// the file name opened.
+func openResolvedQueueFile(dataRoot string, coldPath string, base string, fileNum int64,
+	open func(string) (*os.File, error)) (*os.File, string, error) {
+	fileName := resolveQueueFileName(dataRoot, coldPath, base, fileNum)
+	f, err := open(fileName)
+	if coldFileName := getColdFileNameIfMoved(coldPath, base, fileNum, fileName, err); coldFileName != "" {
+		fileName = coldFileName
+		f, err = open(fileName)
+	}
+	return f, fileName, err
+}
+
+// statResolvedQueueFile returns the file info of the actual location of the data file.
+func statResolvedQueueFile(dataRoot string, coldPath string, base string, fileNum int64) (os.FileInfo, error) {
+	fileName := resolveQueueFileName(dataRoot, coldPath, base, fileNum)
+	f, err := os.Stat(fileName)
+	if coldFileName := getColdFileNameIfMoved(coldPath, base, fileNum, fileName, err); coldFileName != "" {
+		f, err = os.Stat(coldFileName)
+	}
+	return f, err
+}
+
+// the opened file can still be read after moved, and the move is atomic
+// since the file is copied to a temp file in the cold path before renamed.
+func moveQueueFileToCold(dataRoot string, coldPath string, base string, fileNum int64, olderThan time.Time) (bool, error) {
+	if coldPath == "" {
+		return false, nil
+	}
+	fileName := GetQueueFileName(dataRoot, base, fileNum)
+	f, err := os.Stat(fileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	if f.ModTime().After(olderThan) {
+		return false, nil
+	}
+	coldFileName := GetQueueFileName(coldPath, base, fileNum)
+	err = os.MkdirAll(path.Dir(coldFileName), 0755)
+	if err != nil {
+		return false, err
+	}
+	err = util.AtomicRename(fileName, coldFileName)
+	if err != nil {
+		return false, err
+	}
+	sharedReadFileCache.evict(fileName)
+	return true, nil
+}
@@ -6,6 +6,8 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
+	"hash/crc32"
 	"io/ioutil"
 	"math/rand"
 	"os"
@@ -61,6 +63,7 @@ type diskQueueWriter struct {
 	// instantiation time metadata
 	name            string
 	dataPath        string
+	coldPath        string
 	maxBytesPerFile int64 // currently this cannot change once created
 	minMsgSize      int32
 	maxMsgSize      int32
@@ -69,6 +72,12 @@ type diskQueueWriter struct {
 
 	writeFile    *os.File
 	bufferWriter *bufio.Writer
+	// the checksum of the data written to the current file, it is unknown if the file is
+	// reopened in the middle, and calculated in background after the file finished.
+	fileChecksum      hash.Hash32
+	fileChecksumValid bool
+	// called with the range removed by the clean
+	cleanAudit func(start BackendOffset, end BackendOffset)
 }
 
 type extraMeta struct {
@@ -80,26 +89,28 @@ type extraMeta struct {
 func NewDiskQueueWriter(name string, dataPath string, maxBytesPerFile int64,
 	minMsgSize int32, maxMsgSize int32,
 	syncEvery int64) (BackendQueueWriter, error) {
-	return newDiskQueueWriter(name, dataPath, maxBytesPerFile,
+	return newDiskQueueWriter(name, dataPath, "", maxBytesPerFile,
 		minMsgSize, maxMsgSize, syncEvery, false)
 }
 
 func NewDiskQueueWriterForRead(name string, dataPath string, maxBytesPerFile int64,
 	minMsgSize int32, maxMsgSize int32,
 	syncEvery int64) (BackendQueueWriter, error) {
-	return newDiskQueueWriter(name, dataPath, maxBytesPerFile,
+	return newDiskQueueWriter(name, dataPath, "", maxBytesPerFile,
 		minMsgSize, maxMsgSize, syncEvery, true)
 }
 
 // newDiskQueue instantiates a new instance of diskQueueWriter, retrieving metadata
-// from the filesystem and starting the read ahead goroutine
-func newDiskQueueWriter(name string, dataPath string, maxBytesPerFile int64,
+// from the filesystem and starting the read ahead goroutine, the old data files may be
+// moved to the cold path if not empty.
+func newDiskQueueWriter(name string, dataPath string, coldPath string, maxBytesPerFile int64,
 	minMsgSize int32, maxMsgSize int32,
 	syncEvery int64, readOnly bool) (BackendQueueWriter, error) {
 
 	d := diskQueueWriter{
 		name:            name,
 		dataPath:        dataPath,
+		coldPath:        coldPath,
 		maxBytesPerFile: maxBytesPerFile,
 		minMsgSize:      minMsgSize,
 		maxMsgSize:      maxMsgSize,
@@ -240,7 +251,28 @@ func (d *diskQueueWriter) ResetWriteWithQueueStart(queueStart BackendQueueEnd) e
 	return nil
 }
 
+// SetCleanAudit sets the callback with the range removed by each clean.
+func (d *diskQueueWriter) SetCleanAudit(audit func(start BackendOffset, end BackendOffset)) {
+	d.Lock()
+	d.cleanAudit = audit
+	d.Unlock()
+}
+
 func (d *diskQueueWriter) CleanOldDataByRetention(cleanEndInfo BackendQueueOffset,
+	noRealClean bool, maxCleanOffset BackendOffset) (BackendQueueEnd, error) {
+	d.RLock()
+	oldStart := d.diskQueueStart.Offset()
+	audit := d.cleanAudit
+	d.RUnlock()
+	newStart, err := d.cleanOldDataByRetention(cleanEndInfo, noRealClean, maxCleanOffset)
+	// audit out of the lock since it may read the channels
+	if err == nil && !noRealClean && audit != nil && newStart != nil && newStart.Offset() > oldStart {
+		audit(oldStart, newStart.Offset())
+	}
+	return newStart, err
+}
+
+func (d *diskQueueWriter) cleanOldDataByRetention(cleanEndInfo BackendQueueOffset,
 	noRealClean bool, maxCleanOffset BackendOffset) (BackendQueueEnd, error) {
 	if cleanEndInfo == nil {
 		return nil, nil
@@ -324,7 +356,10 @@ func (d *diskQueueWriter) CleanOldDataByRetention(cleanEndInfo BackendQueueOffse
 	d.saveExtraMeta()
 	cleanMetaFileNum := cleanFileNum - MAX_QUEUE_OFFSET_META_DATA_KEEP
 	for i := int64(0); i < cleanFileNum; i++ {
-		fn := d.fileName(i)
+		// the legacy file may be not sharded, so the meta file name should be resolved before
+		// the data file removed
+		metaFn := d.fileName(i) + ".offsetmeta.dat"
+		fn := d.dataFileName(i)
 		innerErr := os.Remove(fn)
 		if innerErr != nil {
 			if !os.IsNotExist(innerErr) {
@@ -334,10 +369,14 @@ func (d *diskQueueWriter) CleanOldDataByRetention(cleanEndInfo BackendQueueOffse
 		} else {
 			nsqLog.Logf("DISKQUEUE(%s): removed data file: %v", d.name, fn)
 		}
+		// the idle handle keeps the disk space of the removed file in use
+		sharedReadFileCache.evict(fn)
+		// the checksum is useless after the data file removed
+		os.Remove(getQueueFileChecksumName(metaFn))
 
 		//remove queue meta file
 		if i <= cleanMetaFileNum {
-			fn = d.fileName(i) + ".offsetmeta.dat"
+			fn = metaFn
 			innerErr = os.Remove(fn)
 			if innerErr != nil {
 				if !os.IsNotExist(innerErr) {
@@ -346,12 +385,93 @@ func (d *diskQueueWriter) CleanOldDataByRetention(cleanEndInfo BackendQueueOffse
 			} else {
 				nsqLog.Debugf("DISKQUEUE(%s): removed offset meta data file: %v", d.name, fn)
 			}
+			forgetQueueFileLayout(d.dataPath, d.coldPath, d.name, i)
+			removeEmptyQueueFileDir(d.dataPath, d.name, i)
 		}
 	}
 
 	return &newStart, nil
 }
 
+// MoveToColdTier moves the data files before the maxFileNum and older than the given time
+// to the cold data path, the current reading file will be kept.
+func (d *diskQueueWriter) MoveToColdTier(maxFileNum int64, olderThan time.Time) (int, error) {
+	d.Lock()
+	defer d.Unlock()
+	if d.exitFlag == 1 {
+		return 0, ErrExiting
+	}
+	if maxFileNum > d.diskReadEnd.EndOffset.FileNum-1 {
+		maxFileNum = d.diskReadEnd.EndOffset.FileNum - 1
+	}
+	moved := 0
+	for i := d.diskQueueStart.EndOffset.FileNum; i < maxFileNum; i++ {
+		ok, err := moveQueueFileToCold(d.dataPath, d.coldPath, d.name, i, olderThan)
+		if err != nil {
+			nsqLog.LogErrorf("diskqueue(%s) failed to move data file %v to cold - %s", d.name, i, err)
+			return moved, err
+		}
+		if ok {
+			nsqLog.Logf("DISKQUEUE(%s): moved data file %v to cold", d.name, i)
+			moved++
+		}
+	}
+	return moved, nil
+}
+
+// QueueFileInfo describes a data file and the virtual offset range it covers.
+type QueueFileInfo struct {
+	FileNum     int64         `json:"file_num"`
+	Path        string        `json:"path"`
+	Size        int64         `json:"size"`
+	StartOffset BackendOffset `json:"start_offset"`
+	EndOffset   BackendOffset `json:"end_offset"`
+	Confirmed   bool          `json:"confirmed"`
+}
+
+// Files returns the readable data files from the queue start to the read end.
+func (d *diskQueueWriter) Files() ([]QueueFileInfo, error) {
+	d.RLock()
+	defer d.RUnlock()
+	readEnd := d.diskReadEnd
+	files := make([]QueueFileInfo, 0, readEnd.EndOffset.FileNum-d.diskQueueStart.EndOffset.FileNum+1)
+	prevEnd := d.diskQueueStart.Offset() - BackendOffset(d.diskQueueStart.EndOffset.Pos)
+	for i := d.diskQueueStart.EndOffset.FileNum; i <= readEnd.EndOffset.FileNum; i++ {
+		fileName := d.dataFileName(i)
+		fi, err := os.Stat(fileName)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		info := QueueFileInfo{
+			FileNum: i,
+			Path:    fileName,
+			Size:    fi.Size(),
+		}
+		if i == readEnd.EndOffset.FileNum {
+			// the data after the read end is not readable yet
+			info.EndOffset = readEnd.Offset()
+			info.StartOffset = info.EndOffset - BackendOffset(readEnd.EndOffset.Pos)
+		} else {
+			_, startPos, endPos, err := getQueueFileOffsetMeta(d.fileName(i))
+			if err != nil {
+				if !os.IsNotExist(err) {
+					return nil, err
+				}
+				startPos = int64(prevEnd)
+				endPos = startPos + fi.Size()
+			}
+			info.StartOffset = BackendOffset(startPos)
+			info.EndOffset = BackendOffset(endPos)
+		}
+		prevEnd = info.EndOffset
+		files = append(files, info)
+	}
+	return files, nil
+}
+
 func (d *diskQueueWriter) closeCurrentFile() {
 	if d.bufferWriter != nil {
 		d.bufferWriter.Flush()
@@ -374,6 +494,7 @@ func (d *diskQueueWriter) truncateDiskQueueToWriteEnd() {
 		d.writeFile = nil
 	} else {
 		curFileName := d.fileName(d.diskWriteEnd.EndOffset.FileNum)
+		ensureQueueFileDir(curFileName)
 		tmpFile, err := os.OpenFile(curFileName, os.O_RDWR|os.O_CREATE, 0644)
 		if err != nil {
 			nsqLog.LogErrorf("open write queue failed: %v", err)
@@ -466,21 +587,29 @@ func (d *diskQueueWriter) RemoveTo(destPath string) error {
 	d.sync()
 	d.closeCurrentFile()
 	d.saveFileOffsetMeta()
-	for i := int64(0); i <= d.diskWriteEnd.EndOffset.FileNum; i++ {
+	endNum := d.diskWriteEnd.EndOffset.FileNum
+	for i := int64(0); i <= endNum; i++ {
+		// the legacy file may be not sharded, so the meta file name should be resolved before
+		// the data file moved
 		fn := d.fileName(i)
-		destFile := fmt.Sprintf(path.Join(destPath, "%s.diskqueue.%06d.dat"), d.name, i)
+		fName := fn + ".offsetmeta.dat"
+		destFile := GetQueueFileName(destPath, d.name, i)
+		ensureQueueFileDir(destFile)
 		innerErr := util.AtomicRename(fn, destFile)
+		sharedReadFileCache.evict(fn)
 		nsqLog.Logf("DISKQUEUE(%s): renamed data file %v to %v", d.name, fn, destFile)
 		if innerErr != nil && !os.IsNotExist(innerErr) {
 			nsqLog.LogErrorf("diskqueue(%s) failed to remove data file - %s", d.name, innerErr)
 		}
-		fName := d.fileName(i) + ".offsetmeta.dat"
+		os.Remove(getQueueFileChecksumName(fn))
 		innerErr = util.AtomicRename(fName, destFile+".offsetmeta.dat")
 		nsqLog.Logf("DISKQUEUE(%s): rename offset meta file %v ", d.name, fName)
 		if innerErr != nil && !os.IsNotExist(innerErr) {
 			nsqLog.LogErrorf("diskqueue(%s) failed to remove offset meta file %v - %s", d.name, fName, innerErr)
 		}
+		forgetQueueFileLayout(d.dataPath, d.coldPath, d.name, i)
 	}
+	removeQueueFileDirs(d.dataPath, d.name, 0, endNum)
 	d.diskWriteEnd.EndOffset.FileNum++
 	d.diskWriteEnd.EndOffset.Pos = 0
 	d.diskReadEnd = d.diskWriteEnd
@@ -509,6 +638,7 @@ func (d *diskQueueWriter) exit(deleted bool) error {
 	}
 
 	d.sync()
+	defer forgetQueueFileLayouts(d.dataPath, d.coldPath, d.name)
 	if deleted {
 		return d.deleteAllFiles(deleted)
 	}
@@ -530,6 +660,14 @@ func (d *diskQueueWriter) Empty() error {
 }
 
 func (d *diskQueueWriter) deleteAllFiles(deleted bool) error {
+	// the legacy file may be not sharded, so the meta file names should be resolved before
+	// the data files removed
+	var metaBases []string
+	if deleted {
+		for i := int64(0); i <= d.diskWriteEnd.EndOffset.FileNum; i++ {
+			metaBases = append(metaBases, d.fileName(i))
+		}
+	}
 	d.cleanOldData()
 
 	if deleted {
@@ -540,14 +678,17 @@ func (d *diskQueueWriter) deleteAllFiles(deleted bool) error {
 			return innerErr
 		}
 		os.Remove(d.extraMetaFileName())
-		for i := int64(0); i <= d.diskWriteEnd.EndOffset.FileNum; i++ {
-			fName := d.fileName(i) + ".offsetmeta.dat"
+		for i, metaBase := range metaBases {
+			os.Remove(getQueueFileChecksumName(metaBase))
+			fName := metaBase + ".offsetmeta.dat"
 			innerErr := os.Remove(fName)
 			nsqLog.Logf("DISKQUEUE(%s): removed offset meta file: %v", d.name, fName)
 			if innerErr != nil && !os.IsNotExist(innerErr) {
 				nsqLog.LogErrorf("diskqueue(%s) failed to remove offset meta file %v - %s", d.name, fName, innerErr)
 			}
+			forgetQueueFileLayout(d.dataPath, d.coldPath, d.name, int64(i))
 		}
+		removeQueueFileDirs(d.dataPath, d.name, 0, int64(len(metaBases)))
 	}
 	return nil
 }
@@ -559,8 +700,9 @@ func (d *diskQueueWriter) cleanOldData() error {
 	d.saveFileOffsetMeta()
 
 	for i := int64(0); i <= d.diskWriteEnd.EndOffset.FileNum; i++ {
-		fn := d.fileName(i)
+		fn := d.dataFileName(i)
 		innerErr := os.Remove(fn)
+		sharedReadFileCache.evict(fn)
 		nsqLog.Logf("DISKQUEUE(%s): removed data file: %v", d.name, fn)
 		if innerErr != nil && !os.IsNotExist(innerErr) {
 			nsqLog.LogErrorf("diskqueue(%s) failed to remove data file - %s", d.name, innerErr)
@@ -594,6 +736,11 @@ func (d *diskQueueWriter) saveFileOffsetMeta() {
 	f.Close()
 }
 
+// BackendType returns the type of the backend files the writer writes to.
+func (d *diskQueueWriter) BackendType() string {
+	return BackendTypeDisk
+}
+
 func (d *diskQueueWriter) GetQueueWriteEnd() BackendQueueEnd {
 	d.RLock()
 	e := &diskQueueEndInfo{}
@@ -630,6 +777,10 @@ func (d *diskQueueWriter) writeOne(data []byte, isRaw bool, msgCnt int32) (Backe
 
 	if d.writeFile == nil {
 		curFileName := d.fileName(d.diskWriteEnd.EndOffset.FileNum)
+		err = ensureQueueFileDir(curFileName)
+		if err != nil {
+			return 0, 0, nil, err
+		}
 		d.writeFile, err = os.OpenFile(curFileName, os.O_RDWR|os.O_CREATE, 0644)
 		if err != nil {
 			return 0, 0, nil, err
@@ -645,6 +796,11 @@ func (d *diskQueueWriter) writeOne(data []byte, isRaw bool, msgCnt int32) (Backe
 				return 0, 0, nil, err
 			}
 		}
+		if d.fileChecksum == nil {
+			d.fileChecksum = crc32.NewIEEE()
+		}
+		d.fileChecksum.Reset()
+		d.fileChecksumValid = d.diskWriteEnd.EndOffset.Pos == 0
 		if d.bufferWriter == nil {
 			d.bufferWriter = bufio.NewWriterSize(d.writeFile, writeBufSize)
 		} else {
@@ -680,6 +836,15 @@ func (d *diskQueueWriter) writeOne(data []byte, isRaw bool, msgCnt int32) (Backe
 		return 0, 0, nil, err
 	}
 
+	if d.fileChecksumValid {
+		if !isRaw {
+			var sizeBuf [4]byte
+			binary.BigEndian.PutUint32(sizeBuf[:], uint32(dataLen))
+			d.fileChecksum.Write(sizeBuf[:])
+		}
+		d.fileChecksum.Write(data)
+	}
+
 	writeOffset := d.diskWriteEnd.Offset()
 	totalBytes := int64(dataLen)
 	if !isRaw {
@@ -705,6 +870,9 @@ func (d *diskQueueWriter) writeOne(data []byte, isRaw bool, msgCnt int32) (Backe
 			d.writeFile = nil
 		}
 		d.saveFileOffsetMeta()
+		if isDataFileChecksumEnabled() {
+			d.saveFinishedFileChecksum(d.diskWriteEnd.EndOffset.FileNum)
+		}
 		nsqLog.LogDebugf("DISKQUEUE(%s): new file write, last file: %v", d.name, d.diskWriteEnd)
 
 		d.diskWriteEnd.EndOffset.FileNum++
@@ -715,6 +883,27 @@ func (d *diskQueueWriter) writeOne(data []byte, isRaw bool, msgCnt int32) (Backe
 	return writeOffset, int32(totalBytes), &d.diskWriteEnd, err
 }
 
+// save the checksum of the finished file written from the start, or calculate it from the
+// file in background so the write is not blocked.
+// should be protected by the lock
+func (d *diskQueueWriter) saveFinishedFileChecksum(fileNum int64) {
+	metaBase := d.fileName(fileNum)
+	if d.fileChecksumValid {
+		err := writeQueueFileChecksum(metaBase, d.fileChecksum.Sum32())
+		if err != nil {
+			nsqLog.LogErrorf("diskqueue(%s) failed to save the checksum of file %v: %v", d.name, fileNum, err)
+		}
+		return
+	}
+	dataFileName := d.dataFileName(fileNum)
+	go func() {
+		err := saveQueueFileChecksum(metaBase, dataFileName)
+		if err != nil {
+			nsqLog.LogErrorf("diskqueue(%s) failed to save the checksum of file %v: %v", d.name, fileNum, err)
+		}
+	}()
+}
+
 func (d *diskQueueWriter) Flush() error {
 	d.Lock()
 	defer d.Unlock()
@@ -941,11 +1130,12 @@ func (d *diskQueueWriter) metaDataFileName() string {
 	return fmt.Sprintf(path.Join(d.dataPath, "%s.diskqueue.meta.writer.dat"), d.name)
 }
 
+func (d *diskQueueWriter) dataFileName(fileNum int64) string {
+	return resolveQueueFileName(d.dataPath, d.coldPath, d.name, fileNum)
+}
+
 func (d *diskQueueWriter) fileName(fileNum int64) string {
-	if fileNum > int64(999990) {
-		return fmt.Sprintf(path.Join(d.dataPath, "%s.diskqueue.%09d.dat"), d.name, fileNum)
-	}
-	return fmt.Sprintf(path.Join(d.dataPath, "%s.diskqueue.%06d.dat"), d.name, fileNum)
+	return GetQueueFileName(d.dataPath, d.name, fileNum)
 }
 
 func (d *diskQueueWriter) extraMetaFileName() string {
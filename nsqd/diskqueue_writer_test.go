@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path"
 	"strconv"
 	"strings"
 	"sync"
@@ -43,7 +44,7 @@ func TestDiskQueueWriter(t *testing.T) {
 	equal(t, end.(*diskQueueEndInfo).EndOffset.Pos, int64(len(msg)+4))
 	equal(t, end.(*diskQueueEndInfo).EndOffset.Pos, dqWriter.diskWriteEnd.EndOffset.Pos)
 
-	dqReader := newDiskQueueReader(dqName, dqName, tmpDir, 1024, 4, 1<<10, 1, 2*time.Second, nil, true)
+	dqReader, _ := newDiskQueueReader(dqName, dqName, tmpDir, 1024, 4, 1<<10, 1, 2*time.Second, nil, true)
 	dqReader.UpdateQueueEnd(end, false)
 	msgOut, _ := dqReader.TryReadOne()
 	equal(t, msgOut.Data, msg)
@@ -93,6 +94,112 @@ func TestDiskQueueWriterCleanOffsetmeta(t *testing.T) {
 	}
 }
 
+func TestDiskQueueWriterShardedFiles(t *testing.T) {
+	dqName := "test_disk_queue_sharded" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	// each message is in its own file
+	queue, _ := NewDiskQueueWriter(dqName, tmpDir, 3, 4, 1<<10, 1)
+	dqWriter := queue.(*diskQueueWriter)
+	defer dqWriter.Close()
+
+	legacyNum := 5
+	msgNum := 150
+	for i := 0; i < legacyNum; i++ {
+		dqWriter.Put([]byte("test" + strconv.Itoa(i)))
+	}
+	dqWriter.Flush()
+	shardSize := int64(10)
+	SetQueueFileShardSize(shardSize)
+	defer SetQueueFileShardSize(0)
+	test.Equal(t, ErrInvalidFileShardSize, SetQueueFileShardSize(-1))
+	for i := legacyNum; i < msgNum; i++ {
+		dqWriter.Put([]byte("test" + strconv.Itoa(i)))
+	}
+	dqWriter.Flush()
+	end := dqWriter.GetQueueWriteEnd()
+	test.Equal(t, int64(msgNum), end.(*diskQueueEndInfo).EndOffset.FileNum)
+
+	// the legacy files are still in the data path
+	fileName := fmt.Sprintf(DefaultQueueFileNamePattern, dqName, 0)
+	test.Equal(t, path.Join(tmpDir, fileName), dqWriter.fileName(0))
+	_, err = os.Stat(path.Join(tmpDir, fileName))
+	test.Nil(t, err)
+	for _, fileNum := range []int64{10, 19, 20, int64(msgNum) - 1} {
+		fileName = fmt.Sprintf(DefaultQueueFileNamePattern, dqName, fileNum)
+		shardedName := path.Join(getQueueFileShardDir(tmpDir, dqName, fileNum, shardSize), fileName)
+		test.Equal(t, shardedName, dqWriter.fileName(fileNum))
+		_, err = os.Stat(shardedName)
+		test.Nil(t, err)
+		_, err = os.Stat(path.Join(tmpDir, fileName))
+		test.Equal(t, true, os.IsNotExist(err))
+	}
+
+	// read through the legacy and the sharded files
+	dqReader, _ := newDiskQueueReader(dqName, dqName, tmpDir, 3, 4, 1<<10, 1, 2*time.Second, nil, true)
+	defer dqReader.Close()
+	dqReader.UpdateQueueEnd(end, false)
+	for i := 0; i < msgNum; i++ {
+		ret, ok := dqReader.TryReadOne()
+		test.Equal(t, true, ok)
+		test.Nil(t, ret.Err)
+		test.Equal(t, "test"+strconv.Itoa(i), string(ret.Data))
+	}
+	_, ok := dqReader.TryReadOne()
+	test.Equal(t, false, ok)
+
+	// the last file before the end will be kept
+	cleanFileNum := end.(*diskQueueEndInfo).EndOffset.FileNum - 1
+	_, err = dqWriter.CleanOldDataByRetention(end, false, 0)
+	test.Nil(t, err)
+	for i := int64(0); i < cleanFileNum; i++ {
+		_, err = os.Stat(dqWriter.fileName(i))
+		test.Equal(t, true, os.IsNotExist(err))
+	}
+	_, err = os.Stat(dqWriter.fileName(cleanFileNum))
+	test.Nil(t, err)
+	// the shard directories without any offset meta should be removed
+	cleanMetaFileNum := cleanFileNum - MAX_QUEUE_OFFSET_META_DATA_KEEP
+	for i := int64(0); i*shardSize < int64(msgNum); i++ {
+		_, err = os.Stat(getQueueFileShardDir(tmpDir, dqName, i*shardSize, shardSize))
+		if (i+1)*shardSize-1 <= cleanMetaFileNum {
+			test.Equal(t, true, os.IsNotExist(err))
+		} else {
+			test.Nil(t, err)
+		}
+	}
+	_, err = os.Stat(path.Join(tmpDir, fmt.Sprintf(DefaultQueueFileNamePattern, dqName, 0)+".offsetmeta.dat"))
+	test.Equal(t, true, os.IsNotExist(err))
+}
+
+func TestDiskQueueWriterShardedDelete(t *testing.T) {
+	dqName := "test_disk_queue_sharded_delete" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	queue, _ := NewDiskQueueWriter(dqName, tmpDir, 3, 4, 1<<10, 1)
+	dqWriter := queue.(*diskQueueWriter)
+
+	for i := 0; i < 5; i++ {
+		dqWriter.Put([]byte("test" + strconv.Itoa(i)))
+	}
+	dqWriter.Flush()
+	SetQueueFileShardSize(10)
+	defer SetQueueFileShardSize(0)
+	for i := 5; i < 25; i++ {
+		dqWriter.Put([]byte("test" + strconv.Itoa(i)))
+	}
+	dqWriter.Flush()
+	test.Nil(t, dqWriter.Delete())
+	// the legacy offset metas and the shard directories should all be removed
+	files, err := ioutil.ReadDir(tmpDir)
+	test.Nil(t, err)
+	for _, f := range files {
+		t.Errorf("file left after deleted: %v", f.Name())
+	}
+}
+
 func TestDiskQueueWriterRoll(t *testing.T) {
 	//l := newTestLogger(t)
 	//nsqLog.Logger = l
@@ -196,7 +303,7 @@ func TestDiskQueueWriterEmpty(t *testing.T) {
 	msgRawSize := 4 + len(msg)
 	maxBytesPerFile := 100
 	dq, _ := NewDiskQueueWriter(dqName, tmpDir, int64(maxBytesPerFile), 0, 1<<10, 1)
-	dqReader := newDiskQueueReader(dqName, dqName, tmpDir,
+	dqReader, _ := newDiskQueueReader(dqName, dqName, tmpDir,
 		int64(maxBytesPerFile), 0, 1<<10, 1, 2*time.Second, nil, true)
 	dqObj := dq.(*diskQueueWriter)
 	defer dq.Close()
@@ -273,7 +380,7 @@ func TestDiskQueueWriterEmpty(t *testing.T) {
 	}
 	equal(t, dqObj.diskWriteEnd.TotalMsgCnt(), int64(100))
 
-	dqReader = newDiskQueueReader(dqName, dqName, tmpDir, int64(maxBytesPerFile), 0, 1<<10, 1, 2*time.Second, nil, true)
+	dqReader, _ = newDiskQueueReader(dqName, dqName, tmpDir, int64(maxBytesPerFile), 0, 1<<10, 1, 2*time.Second, nil, true)
 
 	equal(t, dqReader.(*diskQueueReader).confirmedQueueInfo.Offset(),
 		BackendOffset(100*msgRawSize))
@@ -335,7 +442,7 @@ func TestDiskQueueWriterCorruption(t *testing.T) {
 	defer os.RemoveAll(tmpDir)
 	// require a non-zero message length for the corrupt (len 0) test below
 	dq, _ := NewDiskQueueWriter(dqName, tmpDir, 1000, 10, 1<<10, 1)
-	dqReader := newDiskQueueReader(dqName, dqName, tmpDir, 1000, 10, 1<<10, 5, 2*time.Second, nil, true)
+	dqReader, _ := newDiskQueueReader(dqName, dqName, tmpDir, 1000, 10, 1<<10, 5, 2*time.Second, nil, true)
 	defer dqReader.Close()
 	defer dq.Close()
 
@@ -599,7 +706,7 @@ func TestDiskQueueWriterTorture(t *testing.T) {
 	t.Logf("restarting diskqueue")
 	dq.Close()
 
-	dqReader := newDiskQueueReader(dqName, dqName, tmpDir, 262144, 0, 1<<10, 1, 2*time.Second, nil, true)
+	dqReader, _ := newDiskQueueReader(dqName, dqName, tmpDir, 262144, 0, 1<<10, 1, 2*time.Second, nil, true)
 	defer dqReader.Close()
 	dqReader.UpdateQueueEnd(e, false)
 	time.Sleep(time.Second * 1)
@@ -770,7 +877,7 @@ func benchmarkDiskQueueReaderGet(size int64, b *testing.B) {
 	}
 	defer os.RemoveAll(tmpDir)
 	dq, _ := NewDiskQueueWriter(dqName, tmpDir, 1024768, 0, 1<<20, 2500)
-	dqReader := newDiskQueueReader(dqName, dqName, tmpDir, 1024768, 0, 1<<20,
+	dqReader, _ := newDiskQueueReader(dqName, dqName, tmpDir, 1024768, 0, 1<<20,
 		2500, 2*time.Second, nil, true)
 	defer dqReader.Close()
 	defer dq.Close()
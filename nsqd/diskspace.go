@@ -0,0 +1,17 @@
+// +build !windows
+
+package nsqd
+
+import (
+	"syscall"
+)
+
+// getDiskSpace returns the free and total bytes of the disk the path located.
+func getDiskSpace(path string) (uint64, uint64, error) {
+	var st syscall.Statfs_t
+	err := syscall.Statfs(path, &st)
+	if err != nil {
+		return 0, 0, err
+	}
+	return st.Bavail * uint64(st.Bsize), st.Blocks * uint64(st.Bsize), nil
+}
@@ -0,0 +1,8 @@
+// +build windows
+
+package nsqd
+
+// the disk space is not checked on windows.
+func getDiskSpace(path string) (uint64, uint64, error) {
+	return 0, 0, nil
+}
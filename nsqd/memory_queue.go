@@ -0,0 +1,606 @@
+package nsqd
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+var ErrMemoryQueueRawInvalid = errors.New("invalid raw data for memory queue")
+var ErrMemoryQueueFull = errors.New("memory queue is full")
+
+// topicQueueWriter is the queue written by the topic, which is the disk queue or the
+// memory queue chosen by the topic backing.
+type topicQueueWriter interface {
+	PutV2([]byte) (BackendOffset, int32, diskQueueEndInfo, error)
+	PutRawV2([]byte, int32) (BackendOffset, int32, diskQueueEndInfo, error)
+	RollbackWriteV2(BackendOffset, uint64) (diskQueueEndInfo, error)
+	ResetWriteEndV2(BackendOffset, int64) (diskQueueEndInfo, error)
+	ResetWriteWithQueueStart(BackendQueueEnd) error
+	Flush() error
+	FlushBuffer()
+	GetQueueWriteEnd() BackendQueueEnd
+	GetQueueReadStart() BackendQueueEnd
+	GetQueueReadEnd() BackendQueueEnd
+	Close() error
+	Delete() error
+	Empty() error
+	BackendType() string
+}
+
+type memoryQueueEntry struct {
+	offset BackendOffset
+	data   []byte
+}
+
+// memoryQueue is the queue of the topic which never touches the disk, the data is lost
+// after restart. The offsets and the message counts are the same as the disk queue, so
+// the channel can handle them in the same way, and the end is the diskQueueEndInfo with
+// all the data in the file 0. The data confirmed by all the readers is removed, and the
+// write is rejected while the messages not removed reach the max.
+type memoryQueue struct {
+	sync.RWMutex
+	name       string
+	minMsgSize int32
+	maxMsgSize int32
+	maxMsgs    int
+	entries    []memoryQueueEntry
+	queueStart diskQueueEndInfo
+	writeEnd   diskQueueEndInfo
+	readers    map[*memoryQueueReader]bool
+	exitFlag   int32
+}
+
+func newMemoryQueue(name string, minMsgSize int32, maxMsgSize int32, maxMsgs int) *memoryQueue {
+	if maxMsgs <= 0 {
+		maxMsgs = 1
+	}
+	return &memoryQueue{
+		name:       name,
+		minMsgSize: minMsgSize,
+		maxMsgSize: maxMsgSize,
+		maxMsgs:    maxMsgs,
+		readers:    make(map[*memoryQueueReader]bool),
+	}
+}
+
+func newMemoryQueueEnd(offset BackendOffset, cnt int64) diskQueueEndInfo {
+	var e diskQueueEndInfo
+	e.EndOffset.Pos = int64(offset)
+	e.virtualEnd = offset
+	e.totalMsgCnt = cnt
+	return e
+}
+
+func (q *memoryQueue) BackendType() string {
+	return BackendTypeMemory
+}
+
+func (q *memoryQueue) PutV2(data []byte) (BackendOffset, int32, diskQueueEndInfo, error) {
+	dataLen := int32(len(data))
+	if dataLen < q.minMsgSize || dataLen > q.maxMsgSize {
+		return 0, 0, diskQueueEndInfo{}, fmt.Errorf("invalid message write size (%d) maxMsgSize=%d", dataLen, q.maxMsgSize)
+	}
+	buf := make([]byte, len(data))
+	copy(buf, data)
+	q.Lock()
+	defer q.Unlock()
+	if q.exitFlag == 1 {
+		return 0, 0, diskQueueEndInfo{}, errors.New("exiting")
+	}
+	if !q.hasRoom(1) {
+		return 0, 0, diskQueueEndInfo{}, ErrMemoryQueueFull
+	}
+	offset := q.writeEnd.Offset()
+	q.append(buf)
+	e := q.writeEnd
+	if len(q.readers) == 0 {
+		q.trim()
+	}
+	return offset, dataLen + 4, e, nil
+}
+
+// PutRawV2 writes the raw data with the size before each message as the disk queue.
+func (q *memoryQueue) PutRawV2(data []byte, msgCnt int32) (BackendOffset, int32, diskQueueEndInfo, error) {
+	var msgs [][]byte
+	for pos := 0; pos < len(data); {
+		if pos+4 > len(data) {
+			return 0, 0, diskQueueEndInfo{}, ErrMemoryQueueRawInvalid
+		}
+		size := int32(binary.BigEndian.Uint32(data[pos : pos+4]))
+		pos += 4
+		if size < 0 || pos+int(size) > len(data) {
+			return 0, 0, diskQueueEndInfo{}, ErrMemoryQueueRawInvalid
+		}
+		buf := make([]byte, size)
+		copy(buf, data[pos:pos+int(size)])
+		msgs = append(msgs, buf)
+		pos += int(size)
+	}
+	if len(msgs) != int(msgCnt) {
+		return 0, 0, diskQueueEndInfo{}, ErrMemoryQueueRawInvalid
+	}
+	q.Lock()
+	defer q.Unlock()
+	if q.exitFlag == 1 {
+		return 0, 0, diskQueueEndInfo{}, errors.New("exiting")
+	}
+	if !q.hasRoom(len(msgs)) {
+		return 0, 0, diskQueueEndInfo{}, ErrMemoryQueueFull
+	}
+	offset := q.writeEnd.Offset()
+	for _, buf := range msgs {
+		q.append(buf)
+	}
+	e := q.writeEnd
+	if len(q.readers) == 0 {
+		q.trim()
+	}
+	return offset, int32(len(data)), e, nil
+}
+
+// the confirmed data may be not removed yet, so it is trimmed before rejected.
+// should be protected by the lock
+func (q *memoryQueue) hasRoom(cnt int) bool {
+	if len(q.entries)+cnt <= q.maxMsgs {
+		return true
+	}
+	q.trim()
+	if len(q.entries)+cnt <= q.maxMsgs {
+		return true
+	}
+	nsqLog.LogWarningf("memory queue %v is full, %v messages waiting confirm, start %v, end %v", q.name,
+		len(q.entries), q.queueStart, q.writeEnd)
+	return false
+}
+
+// should be protected by the lock
+func (q *memoryQueue) append(data []byte) {
+	q.entries = append(q.entries, memoryQueueEntry{offset: q.writeEnd.Offset(), data: data})
+	q.writeEnd = newMemoryQueueEnd(q.writeEnd.Offset()+BackendOffset(len(data)+4), q.writeEnd.TotalMsgCnt()+1)
+}
+
+// returns the index of the message at the offset, or the number of the messages if at the end.
+// should be protected by the lock
+func (q *memoryQueue) findEntry(offset BackendOffset) (int, bool) {
+	if offset < q.queueStart.Offset() || offset > q.writeEnd.Offset() {
+		return 0, false
+	}
+	if offset == q.writeEnd.Offset() {
+		return len(q.entries), true
+	}
+	i := sort.Search(len(q.entries), func(i int) bool {
+		return q.entries[i].offset >= offset
+	})
+	if i >= len(q.entries) || q.entries[i].offset != offset {
+		return 0, false
+	}
+	return i, true
+}
+
+// should be protected by the lock
+func (q *memoryQueue) truncateTo(offset BackendOffset, totalCnt int64) (diskQueueEndInfo, error) {
+	i, ok := q.findEntry(offset)
+	if !ok || q.queueStart.TotalMsgCnt()+int64(i) != totalCnt {
+		nsqLog.Logf("memory queue %v truncate to %v:%v invalid, start %v, end %v", q.name,
+			offset, totalCnt, q.queueStart, q.writeEnd)
+		return q.writeEnd, ErrInvalidOffset
+	}
+	q.entries = q.entries[:i]
+	q.writeEnd = newMemoryQueueEnd(offset, totalCnt)
+	return q.writeEnd, nil
+}
+
+func (q *memoryQueue) RollbackWriteV2(offset BackendOffset, diffCnt uint64) (diskQueueEndInfo, error) {
+	q.Lock()
+	defer q.Unlock()
+	return q.truncateTo(offset, q.writeEnd.TotalMsgCnt()-int64(diffCnt))
+}
+
+func (q *memoryQueue) ResetWriteEndV2(offset BackendOffset, totalCnt int64) (diskQueueEndInfo, error) {
+	q.Lock()
+	defer q.Unlock()
+	return q.truncateTo(offset, totalCnt)
+}
+
+func (q *memoryQueue) ResetWriteWithQueueStart(queueStart BackendQueueEnd) error {
+	q.Lock()
+	defer q.Unlock()
+	nsqLog.Warningf("memory queue %v reset the queue start from %v:%v to new queue start: %v", q.name,
+		q.queueStart, q.writeEnd, queueStart)
+	q.entries = nil
+	q.queueStart = newMemoryQueueEnd(queueStart.Offset(), queueStart.TotalMsgCnt())
+	q.writeEnd = q.queueStart
+	return nil
+}
+
+func (q *memoryQueue) Flush() error {
+	return nil
+}
+
+func (q *memoryQueue) FlushBuffer() {
+}
+
+func (q *memoryQueue) GetQueueWriteEnd() BackendQueueEnd {
+	q.RLock()
+	e := q.writeEnd
+	q.RUnlock()
+	return &e
+}
+
+// all the data written can be read since nothing is buffered
+func (q *memoryQueue) GetQueueReadEnd() BackendQueueEnd {
+	return q.GetQueueWriteEnd()
+}
+
+func (q *memoryQueue) GetQueueReadStart() BackendQueueEnd {
+	q.RLock()
+	e := q.queueStart
+	q.RUnlock()
+	return &e
+}
+
+func (q *memoryQueue) Close() error {
+	q.Lock()
+	q.exitFlag = 1
+	q.Unlock()
+	return nil
+}
+
+func (q *memoryQueue) Delete() error {
+	q.Lock()
+	q.exitFlag = 1
+	q.entries = nil
+	q.Unlock()
+	return nil
+}
+
+func (q *memoryQueue) Empty() error {
+	q.Lock()
+	q.entries = nil
+	q.queueStart = q.writeEnd
+	q.Unlock()
+	return nil
+}
+
+func (q *memoryQueue) trimConfirmed() {
+	q.Lock()
+	q.trim()
+	q.Unlock()
+}
+
+// remove the data confirmed by all the readers, the new reader is created at the end so all
+// the data can be removed if no reader.
+// should be protected by the lock
+func (q *memoryQueue) trim() {
+	minConfirmed := q.writeEnd.Offset()
+	for r := range q.readers {
+		confirmed := BackendOffset(atomic.LoadInt64(&r.confirmedOffset))
+		if confirmed < minConfirmed {
+			minConfirmed = confirmed
+		}
+	}
+	i, ok := q.findEntry(minConfirmed)
+	if !ok || i == 0 {
+		return
+	}
+	q.entries = append([]memoryQueueEntry(nil), q.entries[i:]...)
+	q.queueStart = newMemoryQueueEnd(minConfirmed, q.queueStart.TotalMsgCnt()+int64(i))
+}
+
+// returns the message at the offset and the message count after it
+func (q *memoryQueue) readAt(offset BackendOffset) ([]byte, int64, error) {
+	q.RLock()
+	defer q.RUnlock()
+	i, ok := q.findEntry(offset)
+	if !ok {
+		if offset < q.queueStart.Offset() {
+			return nil, 0, ErrOffsetGarbageCollected
+		}
+		return nil, 0, ErrMoveOffsetInvalid
+	}
+	if i >= len(q.entries) {
+		return nil, 0, ErrMoveOffsetInvalid
+	}
+	return q.entries[i].data, q.queueStart.TotalMsgCnt() + int64(i) + 1, nil
+}
+
+// returns the message count before the offset if the offset is at the message boundary
+func (q *memoryQueue) countAt(offset BackendOffset) (int64, bool) {
+	q.RLock()
+	defer q.RUnlock()
+	i, ok := q.findEntry(offset)
+	if !ok {
+		return 0, false
+	}
+	return q.queueStart.TotalMsgCnt() + int64(i), true
+}
+
+// newReader creates the reader at the end, the end is the start of the new channel.
+func (q *memoryQueue) newReader(name string, readEnd BackendQueueEnd) *memoryQueueReader {
+	r := &memoryQueueReader{
+		q:            q,
+		name:         name,
+		readAttempts: make(map[BackendOffset]int32),
+	}
+	if end, ok := readEnd.(*diskQueueEndInfo); ok && end != nil {
+		r.queueEndInfo = *end
+	} else {
+		r.queueEndInfo = *(q.GetQueueReadEnd().(*diskQueueEndInfo))
+	}
+	r.confirmedQueueInfo = r.queueEndInfo
+	r.readQueueInfo = r.queueEndInfo
+	atomic.StoreInt64(&r.confirmedOffset, int64(r.confirmedQueueInfo.Offset()))
+	q.Lock()
+	q.readers[r] = true
+	q.Unlock()
+	return r
+}
+
+func (q *memoryQueue) removeReader(r *memoryQueueReader) {
+	q.Lock()
+	delete(q.readers, r)
+	q.Unlock()
+	q.trimConfirmed()
+}
+
+// memoryQueueReader is the channel reader of the memory queue, the confirm, skip and
+// depth are the same as the disk queue reader, but nothing is persisted.
+type memoryQueueReader struct {
+	sync.Mutex
+	q    *memoryQueue
+	name string
+
+	readQueueInfo      diskQueueEndInfo
+	confirmedQueueInfo diskQueueEndInfo
+	queueEndInfo       diskQueueEndInfo
+	// the confirmed offset read by the queue without the reader lock
+	confirmedOffset int64
+	depth           int64
+	depthSize       int64
+	readAttempts    map[BackendOffset]int32
+	exitFlag        int32
+}
+
+func (r *memoryQueueReader) BackendType() string {
+	return BackendTypeMemory
+}
+
+func (r *memoryQueueReader) Depth() int64 {
+	return atomic.LoadInt64(&r.depth)
+}
+
+func (r *memoryQueueReader) DepthSize() int64 {
+	return atomic.LoadInt64(&r.depthSize)
+}
+
+func (r *memoryQueueReader) GetQueueReadEnd() BackendQueueEnd {
+	r.Lock()
+	e := r.queueEndInfo
+	r.Unlock()
+	return &e
+}
+
+func (r *memoryQueueReader) GetQueueConfirmed() BackendQueueEnd {
+	r.Lock()
+	e := r.confirmedQueueInfo
+	r.Unlock()
+	return &e
+}
+
+func (r *memoryQueueReader) GetQueueCurrentRead() BackendQueueEnd {
+	r.Lock()
+	e := r.readQueueInfo
+	r.Unlock()
+	return &e
+}
+
+// should be protected by the lock
+func (r *memoryQueueReader) updateDepth() {
+	depthSize := int64(r.queueEndInfo.Offset() - r.confirmedQueueInfo.Offset())
+	depth := r.queueEndInfo.TotalMsgCnt() - r.confirmedQueueInfo.TotalMsgCnt()
+	if depthSize <= 0 {
+		depthSize = 0
+		depth = 0
+	} else if depth < 0 {
+		depth = 0
+	}
+	atomic.StoreInt64(&r.depth, depth)
+	atomic.StoreInt64(&r.depthSize, depthSize)
+}
+
+// should be protected by the lock
+func (r *memoryQueueReader) setConfirmed(e diskQueueEndInfo) {
+	r.confirmedQueueInfo = e
+	atomic.StoreInt64(&r.confirmedOffset, int64(e.Offset()))
+	for offset := range r.readAttempts {
+		if offset < e.Offset() {
+			delete(r.readAttempts, offset)
+		}
+	}
+	r.updateDepth()
+}
+
+func (r *memoryQueueReader) ConfirmRead(offset BackendOffset, cnt int64) error {
+	r.Lock()
+	if r.exitFlag == 1 {
+		r.Unlock()
+		return ErrExiting
+	}
+	old := r.confirmedQueueInfo.Offset()
+	err := r.internalConfirm(offset, cnt)
+	changed := old != r.confirmedQueueInfo.Offset()
+	r.Unlock()
+	if changed {
+		r.q.trimConfirmed()
+	}
+	return err
+}
+
+// should be protected by the lock
+func (r *memoryQueueReader) internalConfirm(offset BackendOffset, cnt int64) error {
+	if int64(offset) == -1 {
+		r.setConfirmed(r.readQueueInfo)
+		return nil
+	}
+	if offset <= r.confirmedQueueInfo.Offset() {
+		return nil
+	}
+	if offset > r.readQueueInfo.Offset() {
+		nsqLog.LogErrorf("confirm exceed read: %v, %v", offset, r.readQueueInfo.Offset())
+		return ErrConfirmSizeInvalid
+	}
+	realCnt, ok := r.q.countAt(offset)
+	if !ok {
+		nsqLog.LogErrorf("memory queue(%s) confirm offset not at the message boundary: %v:%v, confirmed: %v",
+			r.name, offset, cnt, r.confirmedQueueInfo)
+		return ErrConfirmNotBoundary
+	}
+	if cnt != 0 && cnt != realCnt {
+		nsqLog.LogErrorf("confirm read count invalid: %v:%v, %v", offset, cnt, realCnt)
+		return ErrConfirmCntInvalid
+	}
+	r.setConfirmed(newMemoryQueueEnd(offset, realCnt))
+	return nil
+}
+
+func (r *memoryQueueReader) ResetReadToConfirmed() (BackendQueueEnd, error) {
+	r.Lock()
+	defer r.Unlock()
+	if r.exitFlag == 1 {
+		return nil, ErrExiting
+	}
+	r.readQueueInfo = r.confirmedQueueInfo
+	e := r.confirmedQueueInfo
+	return &e, nil
+}
+
+// SkipReadToOffset skips the read and confirmed forward to the offset, which should be the
+// message boundary before the end.
+func (r *memoryQueueReader) SkipReadToOffset(offset BackendOffset, cnt int64) (BackendQueueEnd, error) {
+	r.Lock()
+	if r.exitFlag == 1 {
+		r.Unlock()
+		return nil, ErrExiting
+	}
+	old := r.confirmedQueueInfo.Offset()
+	err := r.internalSkipTo(offset, cnt)
+	e := r.confirmedQueueInfo
+	r.Unlock()
+	if old != e.Offset() {
+		r.q.trimConfirmed()
+	}
+	return &e, err
+}
+
+// should be protected by the lock
+func (r *memoryQueueReader) internalSkipTo(offset BackendOffset, cnt int64) error {
+	if offset < r.confirmedQueueInfo.Offset() || offset > r.queueEndInfo.Offset() {
+		nsqLog.Logf("memory queue(%s) skip to %v invalid, confirmed: %v, end: %v", r.name,
+			offset, r.confirmedQueueInfo, r.queueEndInfo)
+		return ErrMoveOffsetInvalid
+	}
+	realCnt, ok := r.q.countAt(offset)
+	if !ok || (cnt != 0 && cnt != realCnt) {
+		nsqLog.LogErrorf("memory queue(%s) skip to %v:%v invalid", r.name, offset, cnt)
+		return ErrMoveOffsetInvalid
+	}
+	r.readQueueInfo = newMemoryQueueEnd(offset, realCnt)
+	r.setConfirmed(r.readQueueInfo)
+	return nil
+}
+
+func (r *memoryQueueReader) SkipReadToEnd() (BackendQueueEnd, error) {
+	r.Lock()
+	if r.exitFlag == 1 {
+		r.Unlock()
+		return nil, ErrExiting
+	}
+	old := r.confirmedQueueInfo.Offset()
+	r.readQueueInfo = r.queueEndInfo
+	r.setConfirmed(r.queueEndInfo)
+	e := r.confirmedQueueInfo
+	r.Unlock()
+	if old != e.Offset() {
+		r.q.trimConfirmed()
+	}
+	return &e, nil
+}
+
+// UpdateQueueEnd changes the end readable, and the read and confirmed past the new end
+// are moved back to the end.
+func (r *memoryQueueReader) UpdateQueueEnd(e BackendQueueEnd, forceReload bool) (bool, error) {
+	end, ok := e.(*diskQueueEndInfo)
+	if e == nil || (ok && end == nil) {
+		return false, nil
+	}
+	if !ok {
+		nsqLog.LogErrorf("memory queue(%s) update end with the mismatched type %T: %v", r.name, e, e)
+		return false, ErrOffsetTypeMismatch
+	}
+	r.Lock()
+	defer r.Unlock()
+	if r.exitFlag == 1 {
+		return false, ErrExiting
+	}
+	if r.queueEndInfo == *end && !forceReload {
+		return false, nil
+	}
+	r.queueEndInfo = *end
+	if r.readQueueInfo.Offset() > end.Offset() {
+		nsqLog.Logf("memory queue(%s) read %v rewound to the new end %v", r.name, r.readQueueInfo, end)
+		r.readQueueInfo = *end
+	}
+	if r.confirmedQueueInfo.Offset() > end.Offset() {
+		r.setConfirmed(*end)
+	}
+	r.updateDepth()
+	return true, nil
+}
+
+func (r *memoryQueueReader) TryReadOne() (ReadResult, bool) {
+	r.Lock()
+	defer r.Unlock()
+	if r.exitFlag == 1 || r.readQueueInfo.Offset() >= r.queueEndInfo.Offset() {
+		return ReadResult{}, false
+	}
+	var result ReadResult
+	result.Offset = r.readQueueInfo.Offset()
+	data, cnt, err := r.q.readAt(result.Offset)
+	if err != nil {
+		nsqLog.LogWarningf("memory queue(%s) read %v error: %v", r.name, r.readQueueInfo, err)
+		result.Err = err
+		return result, true
+	}
+	// the data is never changed after written, so it is shared without copy
+	result.Data = data
+	result.MovedSize = BackendOffset(len(data) + 4)
+	result.CurCnt = cnt
+	r.readQueueInfo = newMemoryQueueEnd(result.Offset+result.MovedSize, cnt)
+	r.readAttempts[result.Offset]++
+	result.Attempts = r.readAttempts[result.Offset]
+	return result, true
+}
+
+func (r *memoryQueueReader) Close() error {
+	return r.exit()
+}
+
+func (r *memoryQueueReader) Delete() error {
+	return r.exit()
+}
+
+func (r *memoryQueueReader) exit() error {
+	r.Lock()
+	if r.exitFlag == 1 {
+		r.Unlock()
+		return nil
+	}
+	r.exitFlag = 1
+	r.Unlock()
+	r.q.removeReader(r)
+	return nil
+}
@@ -0,0 +1,97 @@
+package nsqd
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+)
+
+const (
+	MetaFormatJSON = "json"
+	MetaFormatGob  = "gob"
+
+	topicMetaFileSuffix = ".meta.dat"
+)
+
+// the gob metadata file is started with the magic header, while the json file has no header
+// for the backward compatibility.
+var gobMetaMagic = []byte("\x00NSQMETA.GOB.1")
+
+type channelMetaData struct {
+	Name    string `json:"name"`
+	Paused  bool   `json:"paused,omitempty"`
+	Skipped bool   `json:"skipped,omitempty"`
+}
+
+// the fields are sorted by the json name to keep the same output as the old map encoding.
+type topicMetaData struct {
+	Backing       string            `json:"backing,omitempty"`
+	Channels      []channelMetaData `json:"channels"`
+	Ext           bool              `json:"ext"`
+	Name          string            `json:"name"`
+	Partition     int               `json:"partition"`
+	SyncEvery     int64             `json:"sync_every,omitempty"`
+	SyncTimeoutMs int64             `json:"sync_timeout_ms,omitempty"`
+}
+
+type nsqdMetaData struct {
+	EnabledDelayedQueue *int32          `json:"enabled_delayedqueue,omitempty"`
+	Topics              []topicMetaData `json:"topics"`
+	Version             string          `json:"version"`
+}
+
+type metaSerializer interface {
+	Marshal(meta interface{}) ([]byte, error)
+	Unmarshal(data []byte, meta interface{}) error
+}
+
+type jsonMetaSerializer struct {
+}
+
+func (s *jsonMetaSerializer) Marshal(meta interface{}) ([]byte, error) {
+	return json.Marshal(meta)
+}
+
+func (s *jsonMetaSerializer) Unmarshal(data []byte, meta interface{}) error {
+	return json.Unmarshal(data, meta)
+}
+
+type gobMetaSerializer struct {
+}
+
+func (s *gobMetaSerializer) Marshal(meta interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Write(gobMetaMagic)
+	err := gob.NewEncoder(&buf).Encode(meta)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (s *gobMetaSerializer) Unmarshal(data []byte, meta interface{}) error {
+	if !bytes.HasPrefix(data, gobMetaMagic) {
+		return fmt.Errorf("invalid gob metadata header")
+	}
+	return gob.NewDecoder(bytes.NewReader(data[len(gobMetaMagic):])).Decode(meta)
+}
+
+func getMetaSerializer(format string) (metaSerializer, error) {
+	switch format {
+	case "", MetaFormatJSON:
+		return &jsonMetaSerializer{}, nil
+	case MetaFormatGob:
+		return &gobMetaSerializer{}, nil
+	default:
+		return nil, fmt.Errorf("unknown metadata format: %v", format)
+	}
+}
+
+// detectMetaSerializer returns the serializer of the metadata file by the magic header.
+func detectMetaSerializer(data []byte) metaSerializer {
+	if bytes.HasPrefix(data, gobMetaMagic) {
+		return &gobMetaSerializer{}
+	}
+	return &jsonMetaSerializer{}
+}
@@ -1,7 +1,7 @@
 package nsqd
 
 import (
-	"encoding/json"
+	"bytes"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -9,12 +9,15 @@ import (
 	"net"
 	"os"
 	"path"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/bitly/go-simplejson"
+	"github.com/youzan/nsq/internal/auth"
 	"github.com/youzan/nsq/internal/clusterinfo"
 	"github.com/youzan/nsq/internal/dirlock"
 	"github.com/youzan/nsq/internal/http_api"
@@ -38,6 +41,8 @@ type errStore struct {
 var (
 	ErrTopicPartitionMismatch = errors.New("topic partition mismatch")
 	ErrTopicNotExist          = errors.New("topic does not exist")
+	ErrTopicBackingMismatch   = errors.New("topic backing mismatch")
+	ErrTopicNoDiskQueue       = errors.New("topic has no disk queue")
 )
 
 var DEFAULT_RETENTION_DAYS = 7
@@ -52,10 +57,13 @@ type INsqdNotify interface {
 	NotifyDeleteTopic(*Topic)
 	NotifyStateChanged(v interface{}, needPersist bool)
 	ReqToEnd(*Channel, *Message, time.Duration) error
+	PutDeadLetter(*Channel, *Message, string) error
 	NotifyScanDelayed(*Channel)
+	metaSyncer() *metaSyncCoordinator
 }
 
 type ReqToEndFunc func(*Channel, *Message, time.Duration) error
+type DeadLetterFunc func(*Channel, *Message, string) error
 
 type NSQD struct {
 	sync.RWMutex
@@ -66,6 +74,13 @@ type NSQD struct {
 	isLoading int32
 	errValue  atomic.Value
 	startTime time.Time
+	// whether the old data files are moving to the cold data path
+	movingColdData int32
+	// the topic lifecycle counters, and the channel counters of the removed topics
+	topicCreatedCnt     int64
+	topicDeletedCnt     int64
+	removedChCreatedCnt int64
+	removedChDeletedCnt int64
 
 	topicMap       map[string]map[int]*Topic
 	magicCodeMutex sync.Mutex
@@ -76,15 +91,27 @@ type NSQD struct {
 	OptsNotificationChan chan struct{}
 	exitChan             chan int
 	waitGroup            util.WaitGroupWrapper
-
-	ci              *clusterinfo.ClusterInfo
-	exiting         bool
-	pubLoopFunc     func(t *Topic)
-	reqToEndCB      ReqToEndFunc
-	scanTriggerChan chan *Channel
-	persistNotifyCh chan struct{}
-	persistClosed   chan struct{}
-	persistWaitGroup     util.WaitGroupWrapper
+	// the running background tasks in the wait group
+	bgTaskLock sync.Mutex
+	bgTasks    map[int64]string
+	bgTaskSeq  int64
+
+	ci               *clusterinfo.ClusterInfo
+	exiting          bool
+	pubLoopFunc      func(t *Topic)
+	reqToEndCB       ReqToEndFunc
+	deadLetterCB     DeadLetterFunc
+	scanTriggerChan  chan *Channel
+	persistNotifyCh  chan struct{}
+	persistClosed    chan struct{}
+	persistWaitGroup util.WaitGroupWrapper
+	persistMetaMutex sync.Mutex
+	// batch the directory syncs of the channel metas
+	metaSyncCoordinator *metaSyncCoordinator
+	// the last persisted data of each topic metadata file
+	persistedTopicMetas map[string][]byte
+	// the auth state cache shared by the clients, nil if disabled
+	authCache auth.StateCache
 }
 
 func New(opts *Options) *NSQD {
@@ -94,6 +121,15 @@ func New(opts *Options) *NSQD {
 		dataPath = cwd
 		opts.DataPath = dataPath
 	}
+	if opts.ID < 0 || opts.ID >= MAX_NODE_ID {
+		nsqLog.LogErrorf("FATAL: --worker-id must be [0,%d)", MAX_NODE_ID)
+		os.Exit(1)
+	}
+	if opts.DataPathPerWorker {
+		// multi instances can share the parent data path while each one has its own sub directory
+		dataPath = GetWorkerDataPath(dataPath, opts.ID)
+		opts.DataPath = dataPath
+	}
 	err := os.MkdirAll(dataPath, 0755)
 	if err != nil {
 		nsqLog.LogErrorf("failed to create directory: %v ", err)
@@ -112,6 +148,7 @@ func New(opts *Options) *NSQD {
 		scanTriggerChan:      make(chan *Channel, 1),
 		persistNotifyCh:      make(chan struct{}, 2),
 		persistClosed:        make(chan struct{}),
+		metaSyncCoordinator:  newMetaSyncCoordinator(opts.MetaSyncBatchWindow),
 	}
 	n.SwapOpts(opts)
 
@@ -128,10 +165,51 @@ func New(opts *Options) *NSQD {
 		os.Exit(1)
 	}
 
-	if opts.ID < 0 || opts.ID >= MAX_NODE_ID {
-		nsqLog.LogErrorf("FATAL: --worker-id must be [0,%d)", MAX_NODE_ID)
+	// the flush ticker can not be created with the non-positive duration
+	if opts.SyncTimeout <= 0 {
+		nsqLog.Logf("--sync-timeout %v is not positive, use the default %v", opts.SyncTimeout, defaultSyncTimeout)
+		opts.SyncTimeout = defaultSyncTimeout
+	}
+	if opts.SyncEvery < 1 {
+		nsqLog.Logf("--sync-every %v is less than 1, use 1", opts.SyncEvery)
+		opts.SyncEvery = 1
+	}
+	if opts.AuthCacheTTL > 0 && opts.AuthCacheMaxSize > 0 {
+		n.authCache = auth.NewTTLCache(opts.AuthCacheTTL, opts.AuthCacheMaxSize)
+	}
+
+	if opts.QueueScanWorkerPoolRatio <= 0 {
+		nsqLog.LogErrorf("FATAL: queue scan worker pool ratio must be greater than 0")
+		os.Exit(1)
+	}
+
+	if _, err := getMetaSerializer(opts.MetadataFormat); err != nil {
+		nsqLog.LogErrorf("FATAL: --metadata-format %v", err)
+		os.Exit(1)
+	}
+
+	if _, err := parseCorruptionPolicy(opts.CorruptionPolicy); err != nil {
+		nsqLog.LogErrorf("FATAL: --corruption-policy %v", err)
 		os.Exit(1)
 	}
+
+	if _, err := parseEndDivergencePolicy(opts.EndDivergencePolicy); err != nil {
+		nsqLog.LogErrorf("FATAL: --end-divergence-policy %v", err)
+		os.Exit(1)
+	}
+
+	if err := SetQueueFileNamePattern(opts.QueueFileNamePattern, opts.ReaderMetaNamePattern); err != nil {
+		nsqLog.LogErrorf("FATAL: --queue-file-name-pattern or --reader-meta-name-pattern %v", err)
+		os.Exit(1)
+	}
+	SetRebuildOffsetMeta(opts.RebuildOffsetMeta)
+	SetDataFileChecksum(opts.ScrubInterval > 0)
+	SetMaxCachedReadFiles(opts.MaxCachedReadFiles)
+	if err := SetQueueFileShardSize(opts.QueueFileShardSize); err != nil {
+		nsqLog.LogErrorf("FATAL: --queue-file-shard-size %v", err)
+		os.Exit(1)
+	}
+
 	nsqLog.Logf("broadcast option: %s, %s", opts.BroadcastAddress, opts.BroadcastInterface)
 
 	if opts.StatsdPrefix != "" {
@@ -167,6 +245,14 @@ func (n *NSQD) SetReqToEndCB(reqToEndCB ReqToEndFunc) {
 	n.Unlock()
 }
 
+// SetDeadLetterCB sets the callback to write the dead letter message, the message
+// will be written to the local topic if not set.
+func (n *NSQD) SetDeadLetterCB(cb DeadLetterFunc) {
+	n.Lock()
+	n.deadLetterCB = cb
+	n.Unlock()
+}
+
 func (n *NSQD) SetPubLoop(loop func(t *Topic)) {
 	n.Lock()
 	n.pubLoopFunc = loop
@@ -182,6 +268,9 @@ func (n *NSQD) GetOpts() *Options {
 
 func (n *NSQD) SwapOpts(opts *Options) {
 	nsqLog.SetLevel(opts.LogLevel)
+	if n.metaSyncCoordinator != nil {
+		n.metaSyncCoordinator.setWindow(opts.MetaSyncBatchWindow)
+	}
 	n.opts.Store(opts)
 }
 
@@ -192,6 +281,11 @@ func (n *NSQD) TriggerOptsNotification() {
 	}
 }
 
+// GetWorkerDataPath returns the data path of the worker while the parent data path is shared.
+func GetWorkerDataPath(parent string, id int64) string {
+	return path.Join(parent, "worker-"+strconv.FormatInt(id, 10))
+}
+
 func (n *NSQD) SetHealth(err error) {
 	n.errValue.Store(errStore{err: err})
 }
@@ -213,6 +307,87 @@ func (n *NSQD) GetHealth() string {
 	return "OK"
 }
 
+// SubsystemHealth is the health status of a subsystem and the underlying error if any.
+type SubsystemHealth struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// NewSubsystemHealth returns the OK status if err is nil, otherwise NOK with the error.
+func NewSubsystemHealth(name string, err error) SubsystemHealth {
+	h := SubsystemHealth{Name: name, Status: "OK"}
+	if err != nil {
+		h.Status = "NOK"
+		h.Error = err.Error()
+	}
+	return h
+}
+
+// GetHealthDetails returns the health of each subsystem, use GetHealthVerdict for the aggregated verdict.
+func (n *NSQD) GetHealthDetails() []SubsystemHealth {
+	details := make([]SubsystemHealth, 0, 4)
+	details = append(details, NewSubsystemHealth("health", n.GetError()))
+	details = append(details, NewSubsystemHealth("dirlock", n.checkDirLock()))
+	details = append(details, NewSubsystemHealth("disk_space", n.checkDiskSpace()))
+	details = append(details, NewSubsystemHealth("topic_readers", n.checkTopicReaders()))
+	return details
+}
+
+// GetHealthVerdict returns OK only if all the subsystems are OK, otherwise NOK with the errors
+// of the subsystems failed.
+func GetHealthVerdict(details []SubsystemHealth) string {
+	var errs []string
+	for _, h := range details {
+		if h.Status != "OK" {
+			errs = append(errs, h.Error)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Sprintf("NOK - %s", strings.Join(errs, "; "))
+	}
+	return "OK"
+}
+
+func (n *NSQD) checkDirLock() error {
+	dataPath := n.GetOpts().DataPath
+	if !n.dl.IsLocked() {
+		return fmt.Errorf("data path %v is not locked", dataPath)
+	}
+	_, err := os.Stat(dataPath)
+	return err
+}
+
+func (n *NSQD) checkDiskSpace() error {
+	dataPath := n.GetOpts().DataPath
+	free, total, err := getDiskSpace(dataPath)
+	if err != nil {
+		return err
+	}
+	if free < total/100 {
+		return fmt.Errorf("disk space of data path %v is low: free %v of %v bytes", dataPath, free, total)
+	}
+	return nil
+}
+
+func (n *NSQD) checkTopicReaders() error {
+	var degraded []string
+	for _, topics := range n.GetTopicMapCopy() {
+		for _, t := range topics {
+			for _, ch := range t.GetChannelMapCopy() {
+				if ch.IsDegraded() {
+					degraded = append(degraded, t.GetFullName()+":"+ch.GetName())
+				}
+			}
+		}
+	}
+	if len(degraded) > 0 {
+		sort.Strings(degraded)
+		return fmt.Errorf("channel readers degraded: %v", strings.Join(degraded, ","))
+	}
+	return nil
+}
+
 func (n *NSQD) GetStartTime() time.Time {
 	return n.startTime
 }
@@ -255,99 +430,143 @@ func (n *NSQD) GetTopicMapCopy() map[string]map[int]*Topic {
 }
 
 func (n *NSQD) Start() {
-	n.waitGroup.Wrap(func() { n.queueScanLoop() })
+	n.wrapBackground("queueScanLoop", func() { n.queueScanLoop() })
+	if n.GetOpts().ScrubInterval > 0 {
+		n.wrapBackground("scrubLoop", func() { n.scrubLoop() })
+	}
 	n.persistWaitGroup.Wrap(func() { n.persistLoop() })
 }
 
+func (n *NSQD) metaDataFileName() string {
+	return fmt.Sprintf(path.Join(n.GetOpts().DataPath, "nsqd.%d.dat"), n.GetOpts().ID)
+}
+
+// the directory of the topic metadata files, each topic is persisted to its own file
+// so a bad file will only lose the topic, and the top-level file is the index of all topics.
+func (n *NSQD) topicMetaDir() string {
+	return fmt.Sprintf(path.Join(n.GetOpts().DataPath, "nsqd.%d.topics"), n.GetOpts().ID)
+}
+
+func (n *NSQD) topicMetaFileName(fullName string) string {
+	return path.Join(n.topicMetaDir(), fullName+topicMetaFileSuffix)
+}
+
 func (n *NSQD) LoadMetadata(disabled int32) {
 	atomic.StoreInt32(&n.isLoading, 1)
 	defer atomic.StoreInt32(&n.isLoading, 0)
-	fn := fmt.Sprintf(path.Join(n.GetOpts().DataPath, "nsqd.%d.dat"), n.GetOpts().ID)
+	fn := n.metaDataFileName()
+	var meta nsqdMetaData
 	data, err := ioutil.ReadFile(fn)
 	if err != nil {
 		if !os.IsNotExist(err) {
 			nsqLog.LogErrorf("failed to read channel metadata from %s - %s", fn, err)
 		}
-		return
+	} else {
+		err = detectMetaSerializer(data).Unmarshal(data, &meta)
+		if err != nil {
+			// the topics can still be loaded from the topic metadata files
+			nsqLog.LogErrorf("failed to parse metadata - %s", err)
+			meta = nsqdMetaData{}
+		}
 	}
 
-	js, err := simplejson.NewJson(data)
-	if err != nil {
-		nsqLog.LogErrorf("failed to parse metadata - %s", err)
-		return
+	if meta.EnabledDelayedQueue != nil {
+		atomic.StoreInt32(&EnableDelayedQueue, *meta.EnabledDelayedQueue)
 	}
+	nsqLog.Logf("delayed queue enable state %v", atomic.LoadInt32(&EnableDelayedQueue))
 
-	enabled, err := js.Get("enabled_delayedqueue").Int()
-	if err != nil {
-	} else {
-		atomic.StoreInt32(&EnableDelayedQueue, int32(enabled))
+	topicMetas, badTopics := n.loadTopicMetaFiles()
+	loaded := make(map[string]bool, len(topicMetas))
+	for _, topicMeta := range topicMetas {
+		loaded[GetTopicFullName(topicMeta.Name, topicMeta.Partition)] = true
+		n.loadTopicMeta(topicMeta, disabled)
 	}
-	nsqLog.Logf("delayed queue enable state %v", enabled)
-
-	topics, err := js.Get("topics").Array()
-	if err != nil {
-		nsqLog.LogErrorf("failed to parse metadata - %s", err)
-		return
+	// the topic in the index without the topic metadata file is from the old version
+	for _, topicMeta := range meta.Topics {
+		fullName := GetTopicFullName(topicMeta.Name, topicMeta.Partition)
+		if loaded[fullName] {
+			continue
+		}
+		if badTopics[fullName] {
+			nsqLog.LogErrorf("skipping topic %s since the metadata file is bad", fullName)
+			continue
+		}
+		n.loadTopicMeta(topicMeta, disabled)
 	}
+}
 
-	for ti := range topics {
-		topicJs := js.Get("topics").GetIndex(ti)
-
-		topicName, err := topicJs.Get("name").String()
-		if err != nil {
-			nsqLog.LogErrorf("failed to parse metadata - %s", err)
-			return
+// loadTopicMetaFiles loads the topic metadata files independently, the bad files are skipped.
+func (n *NSQD) loadTopicMetaFiles() ([]topicMetaData, map[string]bool) {
+	dir := n.topicMetaDir()
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			nsqLog.LogErrorf("failed to read topic metadata dir %s - %s", dir, err)
 		}
-		if !protocol.IsValidTopicName(topicName) {
-			nsqLog.LogWarningf("skipping creation of invalid topic %s", topicName)
+		return nil, nil
+	}
+	topicMetas := make([]topicMetaData, 0, len(fis))
+	badTopics := make(map[string]bool)
+	for _, fi := range fis {
+		if fi.IsDir() || !strings.HasSuffix(fi.Name(), topicMetaFileSuffix) {
 			continue
 		}
-		part, err := topicJs.Get("partition").Int()
-		if err != nil {
-			nsqLog.LogErrorf("failed to parse metadata - %s", err)
-			return
+		fn := path.Join(dir, fi.Name())
+		data, err := ioutil.ReadFile(fn)
+		var topicMeta topicMetaData
+		if err == nil {
+			err = detectMetaSerializer(data).Unmarshal(data, &topicMeta)
 		}
-		ext, err := topicJs.Get("ext").Bool()
 		if err != nil {
-			nsqLog.Infof("failed to parse topic extend metadata, set to false - %s", err)
-			ext = false
+			nsqLog.LogErrorf("failed to load topic metadata from %s - %s", fn, err)
+			badTopics[strings.TrimSuffix(fi.Name(), topicMetaFileSuffix)] = true
+			continue
 		}
-		topic := n.internalGetTopic(topicName, part, ext, disabled)
+		topicMetas = append(topicMetas, topicMeta)
+	}
+	return topicMetas, badTopics
+}
 
-		// old meta should also be loaded
-		channels, err := topicJs.Get("channels").Array()
+func (n *NSQD) loadTopicMeta(topicMeta topicMetaData, disabled int32) {
+	topicName := topicMeta.Name
+	if !protocol.IsValidTopicName(topicName) {
+		nsqLog.LogWarningf("skipping creation of invalid topic %s", topicName)
+		return
+	}
+	topic := n.internalGetTopicWithBacking(topicName, topicMeta.Partition, topicMeta.Ext, topicMeta.Backing, disabled)
+	if topic == nil {
+		return
+	}
+	if topicMeta.SyncEvery > 0 || topicMeta.SyncTimeoutMs > 0 {
+		topic.SetSyncPolicy(TopicSyncPolicy{
+			SyncEvery:   topicMeta.SyncEvery,
+			SyncTimeout: time.Duration(topicMeta.SyncTimeoutMs) * time.Millisecond,
+		})
+	}
+
+	// old meta should also be loaded
+	for _, channelMeta := range topicMeta.Channels {
+		channelName := channelMeta.Name
+		if !protocol.IsValidChannelName(channelName) {
+			nsqLog.LogWarningf("skipping creation of invalid channel %s", channelName)
+			continue
+		}
+		channel, err := topic.GetOrCreateChannel(channelName)
 		if err != nil {
-			nsqLog.LogErrorf("failed to parse metadata - %s", err)
-			return
+			nsqLog.LogErrorf("topic %v failed to load channel %v: %v", topic.GetFullName(), channelName, err)
+			continue
 		}
 
-		for ci := range channels {
-			channelJs := topicJs.Get("channels").GetIndex(ci)
-
-			channelName, err := channelJs.Get("name").String()
-			if err != nil {
-				nsqLog.LogErrorf("failed to parse metadata - %s", err)
-				return
-			}
-			if !protocol.IsValidChannelName(channelName) {
-				nsqLog.LogWarningf("skipping creation of invalid channel %s", channelName)
-				continue
-			}
-			channel := topic.GetChannel(channelName)
-
-			paused, _ := channelJs.Get("paused").Bool()
-			if paused {
-				channel.Pause()
-			}
+		if channelMeta.Paused {
+			channel.Pause()
+		}
 
-			skipped, _ := channelJs.Get("skipped").Bool()
-			if skipped {
-				channel.Skip()
-			}
+		if channelMeta.Skipped {
+			channel.Skip()
 		}
-		// we load channels from the new meta file
-		topic.LoadChannelMeta()
 	}
+	// we load channels from the new meta file
+	topic.LoadChannelMeta()
 }
 
 func (n *NSQD) persistLoop() {
@@ -372,42 +591,107 @@ func (n *NSQD) NotifyPersistMetadata() {
 }
 
 func (n *NSQD) persistMetadata(currentTopicMap map[string]map[int]*Topic) error {
+	n.persistMetaMutex.Lock()
+	defer n.persistMetaMutex.Unlock()
 	// persist metadata about what topics/channels we have
 	// so that upon restart we can get back to the same state
-	fileName := fmt.Sprintf(path.Join(n.GetOpts().DataPath, "nsqd.%d.dat"), n.GetOpts().ID)
+	fileName := n.metaDataFileName()
 	nsqLog.Logf("NSQ: persisting topic/channel metadata to %s", fileName)
 	defer nsqLog.Logf("NSQ: persisted metadata")
 
-	js := make(map[string]interface{})
-	topics := []interface{}{}
+	serializer, err := getMetaSerializer(n.GetOpts().MetadataFormat)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(n.topicMetaDir(), 0755)
+	if err != nil {
+		return err
+	}
+	enabledDelayedQueue := atomic.LoadInt32(&EnableDelayedQueue)
+	meta := &nsqdMetaData{
+		EnabledDelayedQueue: &enabledDelayedQueue,
+		Topics:              []topicMetaData{},
+		Version:             version.Binary,
+	}
+	persisted := make(map[string][]byte, len(n.persistedTopicMetas))
+	existing := make(map[string]bool, len(n.persistedTopicMetas))
 	for _, topicParts := range currentTopicMap {
 		for _, topic := range topicParts {
 			if topic.ephemeral {
 				continue
 			}
-			topicData := make(map[string]interface{})
-			topicData["name"] = topic.GetTopicName()
-			topicData["partition"] = topic.GetTopicPart()
-			topicData["ext"] = topic.IsExt()
-			// we save the channels to topic, but for compatible we need save empty channels to json
-			channels := []interface{}{}
+			topicMeta := topicMetaData{
+				Name:      topic.GetTopicName(),
+				Partition: topic.GetTopicPart(),
+				Ext:       topic.IsExt(),
+				// we save the channels to topic, but for compatible we need save empty channels to json
+				Channels: []channelMetaData{},
+			}
+			// the index only has the topic identity which can be loaded by the old version
+			meta.Topics = append(meta.Topics, topicMeta)
+
+			if !topic.IsDiskBacked() {
+				topicMeta.Backing = topic.GetBackendType()
+			}
+			syncPolicy := topic.GetSyncPolicy()
+			if syncPolicy.SyncEvery > 0 || syncPolicy.SyncTimeout > 0 {
+				topicMeta.SyncEvery = syncPolicy.SyncEvery
+				topicMeta.SyncTimeoutMs = int64(syncPolicy.SyncTimeout / time.Millisecond)
+			}
 			err := topic.SaveChannelMeta()
 			if err != nil {
 				nsqLog.Warningf("save topic %v channel meta failed: %v", topic.GetFullName(), err)
 			}
-			topicData["channels"] = channels
-			topics = append(topics, topicData)
+			data, err := serializer.Marshal(&topicMeta)
+			if err != nil {
+				return err
+			}
+			fullName := topic.GetFullName()
+			existing[fullName] = true
+			persisted[fullName] = data
+			// only the changed topic need to be written
+			if bytes.Equal(n.persistedTopicMetas[fullName], data) {
+				continue
+			}
+			err = writeTopicMetaFile(n.topicMetaFileName(fullName), data, false)
+			if err != nil {
+				// the previous metadata file is kept, and written again next time
+				nsqLog.LogErrorf("failed to persist topic %v metadata: %v", fullName, err)
+				if old, ok := n.persistedTopicMetas[fullName]; ok {
+					persisted[fullName] = old
+				} else {
+					delete(persisted, fullName)
+				}
+			}
 		}
 	}
-	js["version"] = version.Binary
-	js["enabled_delayedqueue"] = atomic.LoadInt32(&EnableDelayedQueue)
-	js["topics"] = topics
+	// remove the metadata files of the deleted topics
+	fis, _ := ioutil.ReadDir(n.topicMetaDir())
+	for _, fi := range fis {
+		if !strings.HasSuffix(fi.Name(), topicMetaFileSuffix) {
+			continue
+		}
+		if existing[strings.TrimSuffix(fi.Name(), topicMetaFileSuffix)] {
+			continue
+		}
+		os.Remove(path.Join(n.topicMetaDir(), fi.Name()))
+	}
+	err = util.SyncDir(n.topicMetaDir())
+	if err != nil {
+		return err
+	}
+	n.persistedTopicMetas = persisted
 
-	data, err := json.Marshal(&js)
+	data, err := serializer.Marshal(meta)
 	if err != nil {
 		return err
 	}
+	return writeMetaFile(fileName, data, true)
+}
 
+var writeTopicMetaFile = writeMetaFile
+
+func writeMetaFile(fileName string, data []byte, syncDir bool) error {
 	tmpFileName := fmt.Sprintf("%s.%d.tmp", fileName, rand.Int())
 	f, err := os.OpenFile(tmpFileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
@@ -422,12 +706,10 @@ func (n *NSQD) persistMetadata(currentTopicMap map[string]map[int]*Topic) error
 	f.Sync()
 	f.Close()
 
-	err = util.AtomicRename(tmpFileName, fileName)
-	if err != nil {
-		return err
+	if syncDir {
+		return util.AtomicRenameSync(tmpFileName, fileName)
 	}
-
-	return nil
+	return util.AtomicRename(tmpFileName, fileName)
 }
 
 func (n *NSQD) Exit() {
@@ -452,12 +734,76 @@ func (n *NSQD) Exit() {
 	// we want to do this last as it closes the idPump (if closed first it
 	// could potentially starve items in process and deadlock)
 	close(n.exitChan)
-	n.waitGroup.Wait()
+	if !n.waitBackgroundTasks(n.GetOpts().ExitTimeout) {
+		// the data path is kept locked until the running tasks exit, so the other
+		// nsqd will not start on the data may still be written
+		go func() {
+			n.waitGroup.Wait()
+			n.dl.Unlock()
+			nsqLog.Logf("NSQ: the background tasks exited after timeout, data path unlocked")
+		}()
+		nsqLog.Logf("NSQ: exited")
+		return
+	}
 
 	n.dl.Unlock()
 	nsqLog.Logf("NSQ: exited")
 }
 
+// wrapBackground runs the task in the wait group, and the running tasks are
+// tracked by name to find the one blocking the exit.
+func (n *NSQD) wrapBackground(name string, cb func()) {
+	n.bgTaskLock.Lock()
+	if n.bgTasks == nil {
+		n.bgTasks = make(map[int64]string)
+	}
+	n.bgTaskSeq++
+	id := n.bgTaskSeq
+	n.bgTasks[id] = name
+	n.bgTaskLock.Unlock()
+	n.waitGroup.Wrap(func() {
+		defer func() {
+			n.bgTaskLock.Lock()
+			delete(n.bgTasks, id)
+			n.bgTaskLock.Unlock()
+		}()
+		cb()
+	})
+}
+
+func (n *NSQD) runningBackgroundTasks() []string {
+	n.bgTaskLock.Lock()
+	names := make([]string, 0, len(n.bgTasks))
+	for _, name := range n.bgTasks {
+		names = append(names, name)
+	}
+	n.bgTaskLock.Unlock()
+	sort.Strings(names)
+	return names
+}
+
+// wait all the background tasks exit, and give up waiting after the timeout
+// so a stuck task will not block the exit forever.
+func (n *NSQD) waitBackgroundTasks(timeout time.Duration) bool {
+	if timeout <= 0 {
+		n.waitGroup.Wait()
+		return true
+	}
+	done := make(chan struct{})
+	go func() {
+		n.waitGroup.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		nsqLog.LogErrorf("NSQ: exit timeout after %v, the background tasks still running: %v",
+			timeout, n.runningBackgroundTasks())
+		return false
+	}
+}
+
 func (n *NSQD) GetTopicDefaultPart(topicName string) int {
 	n.RLock()
 	topics, ok := n.topicMap[topicName]
@@ -492,6 +838,12 @@ func (n *NSQD) GetTopicWithDisabled(topicName string, part int, ext bool) *Topic
 	return n.internalGetTopic(topicName, part, ext, 1)
 }
 
+// GetTopicWithBackingDisabled returns the topic, which is created write disabled with the
+// backing if not exist. The backing of the existing topic can not be changed.
+func (n *NSQD) GetTopicWithBackingDisabled(topicName string, part int, ext bool, backing string) (*Topic, error) {
+	return n.getTopicWithBacking(topicName, part, ext, backing, 1)
+}
+
 // GetTopic performs a thread safe operation
 // to return a pointer to a Topic object (potentially new)
 func (n *NSQD) GetTopic(topicName string, part int) *Topic {
@@ -502,7 +854,31 @@ func (n *NSQD) GetTopicWithExt(topicName string, part int) *Topic {
 	return n.internalGetTopic(topicName, part, true, 0)
 }
 
+// GetTopicWithBacking returns the topic, which is created with the backing if not exist.
+// The backing of the existing topic can not be changed.
+func (n *NSQD) GetTopicWithBacking(topicName string, part int, ext bool, backing string) (*Topic, error) {
+	return n.getTopicWithBacking(topicName, part, ext, backing, 0)
+}
+
+func (n *NSQD) getTopicWithBacking(topicName string, part int, ext bool, backing string, disabled int32) (*Topic, error) {
+	if backing == "" {
+		backing = BackendTypeDisk
+	}
+	t := n.internalGetTopicWithBacking(topicName, part, ext, backing, disabled)
+	if t == nil {
+		return nil, ErrTopicNotExist
+	}
+	if t.GetBackendType() != backing {
+		return t, ErrTopicBackingMismatch
+	}
+	return t, nil
+}
+
 func (n *NSQD) internalGetTopic(topicName string, part int, ext bool, disabled int32) *Topic {
+	return n.internalGetTopicWithBacking(topicName, part, ext, BackendTypeDisk, disabled)
+}
+
+func (n *NSQD) internalGetTopicWithBacking(topicName string, part int, ext bool, backing string, disabled int32) *Topic {
 	if part > MAX_TOPIC_PARTITION || part < 0 {
 		return nil
 	}
@@ -538,18 +914,13 @@ func (n *NSQD) internalGetTopic(topicName string, part int, ext bool, disabled i
 	if part < 0 {
 		part = 0
 	}
-	var t *Topic
-	if !ext {
-		t = NewTopic(topicName, part, n.GetOpts(), disabled, n,
-			n.pubLoopFunc)
-	} else {
-		t = NewTopicWithExt(topicName, part, true, n.GetOpts(), disabled, n,
-			n.pubLoopFunc)
-	}
+	t := NewTopicWithBacking(topicName, part, ext, backing, n.GetOpts(), disabled, n,
+		n.pubLoopFunc)
 	if t == nil {
 		nsqLog.Errorf("TOPIC(%s): create failed", topicName)
 	} else {
 		topics[part] = t
+		n.topicCreatedCnt++
 		nsqLog.Logf("TOPIC(%s): created", t.GetFullName())
 
 	}
@@ -586,6 +957,10 @@ func (n *NSQD) deleteTopic(topicName string, part int) {
 	if !ok {
 		return
 	}
+	if t, ok := topics[part]; ok {
+		n.removedChCreatedCnt += atomic.LoadInt64(&t.channelCreatedCnt)
+		n.removedChDeletedCnt += atomic.LoadInt64(&t.channelDeletedCnt)
+	}
 	delete(topics, part)
 	if len(topics) == 0 {
 		delete(n.topicMap, topicName)
@@ -612,6 +987,7 @@ func (n *NSQD) CloseExistingTopic(topicName string, partition int) error {
 
 func (n *NSQD) ForceDeleteTopicData(name string, partition int) error {
 	topic, err := n.GetExistingTopic(name, partition)
+	existing := err == nil
 	if err != nil {
 		// not exist, create temp for check
 		n.Lock()
@@ -624,6 +1000,11 @@ func (n *NSQD) ForceDeleteTopicData(name string, partition int) error {
 	}
 	topic.Delete()
 	n.deleteTopic(name, partition)
+	if existing {
+		n.Lock()
+		n.topicDeletedCnt++
+		n.Unlock()
+	}
 	return nil
 }
 
@@ -684,9 +1065,44 @@ func (n *NSQD) DeleteExistingTopic(topicName string, part int) error {
 	topic.Delete()
 
 	n.deleteTopic(topicName, part)
+	n.Lock()
+	n.topicDeletedCnt++
+	n.Unlock()
 	return nil
 }
 
+// LifecycleStats is the topic and channel lifecycle counters of the node
+type LifecycleStats struct {
+	TopicCreated   int64 `json:"topic_created"`
+	TopicDeleted   int64 `json:"topic_deleted"`
+	ChannelCreated int64 `json:"channel_created"`
+	ChannelDeleted int64 `json:"channel_deleted"`
+	TopicCount     int64 `json:"topic_count"`
+	ChannelCount   int64 `json:"channel_count"`
+}
+
+func (n *NSQD) GetLifecycleStats() LifecycleStats {
+	n.RLock()
+	defer n.RUnlock()
+	stats := LifecycleStats{
+		TopicCreated:   n.topicCreatedCnt,
+		TopicDeleted:   n.topicDeletedCnt,
+		ChannelCreated: n.removedChCreatedCnt,
+		ChannelDeleted: n.removedChDeletedCnt,
+	}
+	for _, topics := range n.topicMap {
+		for _, t := range topics {
+			stats.TopicCount++
+			stats.ChannelCreated += atomic.LoadInt64(&t.channelCreatedCnt)
+			stats.ChannelDeleted += atomic.LoadInt64(&t.channelDeletedCnt)
+			t.channelLock.RLock()
+			stats.ChannelCount += int64(len(t.channelMap))
+			t.channelLock.RUnlock()
+		}
+	}
+	return stats
+}
+
 func (n *NSQD) CleanClientPubStats(remote string, protocol string) {
 	tmpMap := n.GetTopicMapCopy()
 	for _, topics := range tmpMap {
@@ -712,11 +1128,123 @@ func (n *NSQD) flushAll(all bool, flushCnt int) {
 	}
 }
 
+// only one move at the same time since it may be slow while the cold data path is on the other device
+func (n *NSQD) tryMoveColdData() {
+	if !atomic.CompareAndSwapInt32(&n.movingColdData, 0, 1) {
+		return
+	}
+	n.wrapBackground("moveColdData", func() {
+		defer atomic.StoreInt32(&n.movingColdData, 0)
+		tmpMap := n.GetTopicMapCopy()
+		for _, topics := range tmpMap {
+			for _, t := range topics {
+				select {
+				case <-n.exitChan:
+					return
+				default:
+				}
+				_, err := t.TryMoveColdData()
+				if err != nil {
+					nsqLog.LogWarningf("topic %v failed to move cold data: %v", t.GetFullName(), err)
+				}
+			}
+		}
+	})
+}
+
+// scrubLoop verifies a retained data file of the topics in turn every interval, so the latent
+// disk corruption can be found before the files are read again.
+func (n *NSQD) scrubLoop() {
+	ticker := time.NewTicker(n.GetOpts().ScrubInterval)
+	defer ticker.Stop()
+	last := ""
+	for {
+		select {
+		case <-ticker.C:
+			last = n.scrubNextTopic(last)
+		case <-n.exitChan:
+			return
+		}
+	}
+}
+
+// scrub the topics in the order of the name from the one after the last scrubbed
+func (n *NSQD) scrubNextTopic(last string) string {
+	topics := make(map[string]*Topic)
+	names := make([]string, 0)
+	for _, parts := range n.GetTopicMapCopy() {
+		for _, t := range parts {
+			topics[t.GetFullName()] = t
+			names = append(names, t.GetFullName())
+		}
+	}
+	sort.Strings(names)
+	start := sort.SearchStrings(names, last)
+	if start < len(names) && names[start] == last {
+		start++
+	}
+	for i := 0; i < len(names); i++ {
+		t := topics[names[(start+i)%len(names)]]
+		scrubbed, err := t.ScrubNextFile()
+		if err != nil && err != ErrDataFileChecksumMismatch {
+			nsqLog.LogWarningf("topic %v failed to scrub data file: %v", t.GetFullName(), err)
+		}
+		if scrubbed {
+			return t.GetFullName()
+		}
+	}
+	return last
+}
+
+// checkChannelsDegraded will mark the node unhealthy while any channel meta can not be persisted,
+// and recover if all the channels are fine again.
+func (n *NSQD) checkChannelsDegraded() {
+	var degradedList []string
+	tmpMap := n.GetTopicMapCopy()
+	for _, topics := range tmpMap {
+		for _, t := range topics {
+			t.channelLock.RLock()
+			for _, ch := range t.channelMap {
+				if ch.IsDegraded() {
+					degradedList = append(degradedList, t.GetFullName()+":"+ch.GetName())
+				}
+			}
+			t.channelLock.RUnlock()
+		}
+	}
+	if len(degradedList) > 0 {
+		// the other health error is kept since it may be more severe
+		if n.GetError() == nil {
+			nsqLog.LogErrorf("channels degraded since meta sync failed: %v", degradedList)
+			n.SetHealth(ErrMetaSyncDegraded)
+		}
+	} else if n.GetError() == ErrMetaSyncDegraded {
+		nsqLog.Logf("all channels recovered from degraded")
+		n.SetHealth(nil)
+	}
+}
+
 func (n *NSQD) ReqToEnd(ch *Channel, msg *Message, t time.Duration) error {
 	go n.reqToEndCB(ch, msg, t)
 	return nil
 }
 
+func (n *NSQD) PutDeadLetter(ch *Channel, msg *Message, topicName string) error {
+	n.RLock()
+	cb := n.deadLetterCB
+	n.RUnlock()
+	if cb != nil {
+		return cb(ch, msg, topicName)
+	}
+	// the dead letter topic should be created before, so the typo will not create the topic
+	t, err := n.GetExistingTopic(topicName, 0)
+	if err != nil {
+		return err
+	}
+	_, _, _, _, err = t.PutMessage(NewDeadLetterMessage(t, msg))
+	return err
+}
+
 func (n *NSQD) NotifyDeleteTopic(t *Topic) {
 	n.DeleteExistingTopic(t.GetTopicName(), t.GetTopicPart())
 }
@@ -728,12 +1256,23 @@ func (n *NSQD) NotifyScanDelayed(ch *Channel) {
 	}
 }
 
+func (n *NSQD) metaSyncer() *metaSyncCoordinator {
+	return n.metaSyncCoordinator
+}
+
 func (n *NSQD) NotifyStateChanged(v interface{}, needPersist bool) {
 	// since the in-memory metadata is incomplete,
 	// should not persist metadata while loading it.
 	// nsqd will call `PersistMetadata` it after loading
 	persist := atomic.LoadInt32(&n.isLoading) == 0
-	n.waitGroup.Wrap(func() {
+	if n.GetOpts().DisableLookupd {
+		// no lookup loop to receive the notify
+		if persist && needPersist {
+			n.NotifyPersistMetadata()
+		}
+		return
+	}
+	n.wrapBackground("notifyStateChanged", func() {
 		// by selecting on exitChan we guarantee that
 		// we do not block exit, see issue #123
 		select {
@@ -770,15 +1309,74 @@ type responseData struct {
 
 // resizePool adjusts the size of the pool of queueScanWorker goroutines
 //
-// 	1 <= pool <= min(num * 0.25, QueueScanWorkerPoolMax)
+// 	1 <= pool <= min(num * QueueScanWorkerPoolRatio, QueueScanWorkerPoolMax)
 //
+// If QueueScanWorkerPoolAuto is enabled, the pool is sized by the scan rounds
+// and only clamped by the auto cap here.
 func (n *NSQD) resizePool(num int, workCh chan *Channel, responseCh chan responseData, closeCh chan int) {
-	idealPoolSize := int(float64(num) * 0.25)
-	if idealPoolSize < 1 {
-		idealPoolSize = 1
-	} else if idealPoolSize > n.GetOpts().QueueScanWorkerPoolMax {
-		idealPoolSize = n.GetOpts().QueueScanWorkerPoolMax
+	var idealPoolSize int
+	if n.GetOpts().QueueScanWorkerPoolAuto {
+		idealPoolSize = clampPoolSize(n.poolSize, autoPoolCap(num, n.GetOpts().QueueScanSelectionCount))
+	} else {
+		idealPoolSize = fixedPoolSize(num, n.GetOpts().QueueScanWorkerPoolRatio, n.GetOpts().QueueScanWorkerPoolMax)
+	}
+	n.setPoolSize(idealPoolSize, workCh, responseCh, closeCh)
+}
+
+// autoResizePool grows the pool if the scan round is dirty and slow, and shrinks
+// it if no channel is dirty.
+func (n *NSQD) autoResizePool(num int, dirtyRatio float64, latency time.Duration,
+	workCh chan *Channel, responseCh chan responseData, closeCh chan int) {
+	opts := n.GetOpts()
+	size := nextAutoPoolSize(n.poolSize, autoPoolCap(num, opts.QueueScanSelectionCount),
+		dirtyRatio, opts.QueueScanDirtyPercent, latency, opts.QueueScanInterval/100)
+	if size != n.poolSize && nsqLog.Level() >= levellogger.LOG_DEBUG {
+		nsqLog.Logf("QUEUESCAN resize the pool from %v to %v, dirty: %v, latency: %v",
+			n.poolSize, size, dirtyRatio, latency)
+	}
+	n.setPoolSize(size, workCh, responseCh, closeCh)
+}
+
+func fixedPoolSize(num int, ratio float64, max int) int {
+	return clampPoolSize(int(float64(num)*ratio), max)
+}
+
+// the workers more than the channels scanned in each round are always idle
+func autoPoolCap(num int, selectionCount int) int {
+	c := runtime.NumCPU() * 2
+	if c > num {
+		c = num
+	}
+	if c > selectionCount {
+		c = selectionCount
+	}
+	if c < 1 {
+		c = 1
 	}
+	return c
+}
+
+func nextAutoPoolSize(cur int, cap int, dirtyRatio float64, dirtyPercent float64,
+	latency time.Duration, busyLatency time.Duration) int {
+	if dirtyRatio > dirtyPercent && latency >= busyLatency {
+		cur++
+	} else if dirtyRatio == 0 {
+		cur--
+	}
+	return clampPoolSize(cur, cap)
+}
+
+func clampPoolSize(size int, max int) int {
+	if size > max {
+		size = max
+	}
+	if size < 1 {
+		size = 1
+	}
+	return size
+}
+
+func (n *NSQD) setPoolSize(idealPoolSize int, workCh chan *Channel, responseCh chan responseData, closeCh chan int) {
 	for {
 		if idealPoolSize == n.poolSize {
 			break
@@ -788,7 +1386,7 @@ func (n *NSQD) resizePool(num int, workCh chan *Channel, responseCh chan respons
 			n.poolSize--
 		} else {
 			// expand
-			n.waitGroup.Wrap(func() {
+			n.wrapBackground("queueScanWorker", func() {
 				n.queueScanWorker(workCh, responseCh, closeCh)
 			})
 			n.poolSize++
@@ -882,6 +1480,10 @@ func (n *NSQD) queueScanLoop() {
 			continue
 		case <-flushTicker.C:
 			n.flushAll(flushCnt%100 == 0, flushCnt)
+			n.checkChannelsDegraded()
+			if flushCnt%100 == 0 && n.GetOpts().ColdDataPath != "" {
+				n.tryMoveColdData()
+			}
 			flushCnt++
 			continue
 		case <-n.exitChan:
@@ -892,8 +1494,10 @@ func (n *NSQD) queueScanLoop() {
 		if num > len(channels) {
 			num = len(channels)
 		}
+		var roundStart time.Time
 
 	loop:
+		roundStart = time.Now()
 		for _, i := range util.UniqRands(num, len(channels)) {
 			select {
 			case workCh <- channels[i]:
@@ -918,6 +1522,10 @@ func (n *NSQD) queueScanLoop() {
 			}
 		}
 
+		if n.GetOpts().QueueScanWorkerPoolAuto {
+			n.autoResizePool(len(channels), float64(numDirty)/float64(num), time.Since(roundStart),
+				workCh, responseCh, closeCh)
+		}
 		if float64(numDirty)/float64(num) > n.GetOpts().QueueScanDirtyPercent {
 			goto loop
 		}
@@ -938,3 +1546,17 @@ exit:
 func (n *NSQD) IsAuthEnabled() bool {
 	return len(n.GetOpts().AuthHTTPAddresses) != 0
 }
+
+// GetAuthCache returns the cache of the auth states, nil if disabled.
+func (n *NSQD) GetAuthCache() auth.StateCache {
+	n.RLock()
+	defer n.RUnlock()
+	return n.authCache
+}
+
+// SetAuthCache replaces the cache of the auth states, the cache is disabled if nil.
+func (n *NSQD) SetAuthCache(c auth.StateCache) {
+	n.Lock()
+	n.authCache = c
+	n.Unlock()
+}
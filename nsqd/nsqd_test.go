@@ -2,6 +2,7 @@ package nsqd
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -361,6 +362,106 @@ func TestSetHealth(t *testing.T) {
 	equal(t, nsqd.IsHealthy(), true)
 }
 
+func TestHealthVerdictFromSubsystems(t *testing.T) {
+	details := []SubsystemHealth{
+		NewSubsystemHealth("health", nil),
+		NewSubsystemHealth("disk_space", nil),
+	}
+	equal(t, GetHealthVerdict(details), "OK")
+
+	details = append(details, NewSubsystemHealth("lookupd", errors.New("lookupd disconnected")))
+	equal(t, GetHealthVerdict(details), "NOK - lookupd disconnected")
+
+	details[1] = NewSubsystemHealth("disk_space", errors.New("disk space low"))
+	equal(t, GetHealthVerdict(details), "NOK - disk space low; lookupd disconnected")
+}
+
+func TestMultiWorkersShareDataPath(t *testing.T) {
+	parentPath, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	equal(t, err, nil)
+	defer os.RemoveAll(parentPath)
+
+	opts1 := NewOptions()
+	opts1.Logger = newTestLogger(t)
+	opts1.ID = 1
+	opts1.DataPath = parentPath
+	opts1.DataPathPerWorker = true
+	_, _, nsqd1 := mustStartNSQD(opts1)
+	defer nsqd1.Exit()
+	opts2 := NewOptions()
+	opts2.Logger = newTestLogger(t)
+	opts2.ID = 2
+	opts2.DataPath = parentPath
+	opts2.DataPathPerWorker = true
+	// should not conflict with the dirlock of the first
+	_, _, nsqd2 := mustStartNSQD(opts2)
+	defer nsqd2.Exit()
+
+	equal(t, nsqd1.GetOpts().DataPath, GetWorkerDataPath(parentPath, 1))
+	equal(t, nsqd2.GetOpts().DataPath, GetWorkerDataPath(parentPath, 2))
+
+	nsqd1.GetTopicIgnPart("test_worker1")
+	nsqd2.GetTopicIgnPart("test_worker2")
+	err = nsqd1.persistMetadata(nsqd1.GetTopicMapCopy())
+	equal(t, err, nil)
+	err = nsqd2.persistMetadata(nsqd2.GetTopicMapCopy())
+	equal(t, err, nil)
+
+	for _, n := range []*NSQD{nsqd1, nsqd2} {
+		metaData, err := getMetadata(n)
+		equal(t, err, nil)
+		topics, err := metaData.Get("topics").Array()
+		equal(t, err, nil)
+		equal(t, len(topics), 1)
+		topicName, _ := metaData.Get("topics").GetIndex(0).Get("name").String()
+		equal(t, topicName, "test_worker"+strconv.Itoa(int(n.GetOpts().ID)))
+	}
+	_, err = os.Stat(path.Join(parentPath, "nsqd.1.dat"))
+	equal(t, os.IsNotExist(err), true)
+	_, err = os.Stat(path.Join(GetWorkerDataPath(parentPath, 1), "test_worker2"))
+	equal(t, os.IsNotExist(err), true)
+}
+
+func TestTopicChannelLifecycleStats(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicNum := 3
+	for i := 0; i < topicNum; i++ {
+		topic := nsqd.GetTopic("test_lifecycle"+strconv.Itoa(i), 0)
+		topic.GetChannel("ch1")
+		topic.GetChannel("ch2")
+		// get the existing should not be counted
+		nsqd.GetTopic("test_lifecycle"+strconv.Itoa(i), 0).GetChannel("ch1")
+	}
+	stats := nsqd.GetLifecycleStats()
+	equal(t, stats.TopicCreated, int64(topicNum))
+	equal(t, stats.TopicDeleted, int64(0))
+	equal(t, stats.ChannelCreated, int64(topicNum*2))
+	equal(t, stats.ChannelDeleted, int64(0))
+	equal(t, stats.TopicCount, int64(topicNum))
+	equal(t, stats.ChannelCount, int64(topicNum*2))
+
+	topic, err := nsqd.GetExistingTopic("test_lifecycle0", 0)
+	equal(t, err, nil)
+	err = topic.DeleteExistingChannel("ch1")
+	equal(t, err, nil)
+	// the channels will be deleted with the topic
+	err = nsqd.DeleteExistingTopic("test_lifecycle1", 0)
+	equal(t, err, nil)
+
+	stats = nsqd.GetLifecycleStats()
+	equal(t, stats.TopicCreated, int64(topicNum))
+	equal(t, stats.TopicDeleted, int64(1))
+	equal(t, stats.ChannelCreated, int64(topicNum*2))
+	equal(t, stats.ChannelDeleted, int64(3))
+	equal(t, stats.TopicCount, int64(topicNum-1))
+	equal(t, stats.ChannelCount, int64(topicNum*2-3))
+}
+
 func TestLoadTopicMetaExt(t *testing.T) {
 	opts := NewOptions()
 	opts.Logger = newTestLogger(t)
@@ -408,3 +509,354 @@ func TestLoadTopicMetaExt(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+func TestMetadataFormatRoundTrip(t *testing.T) {
+	for _, format := range []string{MetaFormatJSON, MetaFormatGob} {
+		opts := NewOptions()
+		opts.Logger = newTestLogger(t)
+		opts.MetadataFormat = format
+		_, _, nsqd := mustStartNSQD(opts)
+
+		atomic.StoreInt32(&nsqd.isLoading, 1)
+		topicName := "meta_format_" + format + strconv.Itoa(int(time.Now().Unix()))
+		topic := nsqd.GetTopic(topicName, 1)
+		topic.SetDynamicInfo(TopicDynamicConf{AutoCommit: 1, SyncEvery: 1, Ext: true}, nil)
+		topic.GetChannel("ch")
+		topic.SetSyncPolicy(TopicSyncPolicy{SyncEvery: 10, SyncTimeout: time.Second})
+		atomic.StoreInt32(&nsqd.isLoading, 0)
+		err := nsqd.persistMetadata(nsqd.GetTopicMapCopy())
+		equal(t, err, nil)
+		nsqd.Exit()
+
+		fn := fmt.Sprintf(path.Join(opts.DataPath, "nsqd.%d.dat"), opts.ID)
+		data, err := ioutil.ReadFile(fn)
+		equal(t, err, nil)
+		equal(t, bytes.HasPrefix(data, gobMetaMagic), format == MetaFormatGob)
+
+		_, _, nsqd = mustStartNSQD(opts)
+		nsqd.LoadMetadata(1)
+		topic, err = nsqd.GetExistingTopic(topicName, 1)
+		equal(t, err, nil)
+		equal(t, topic.IsExt(), true)
+		equal(t, topic.GetSyncPolicy(), TopicSyncPolicy{SyncEvery: 10, SyncTimeout: time.Second})
+		_, err = topic.GetExistingChannel("ch")
+		equal(t, err, nil)
+		nsqd.Exit()
+		os.RemoveAll(opts.DataPath)
+	}
+}
+
+func TestMetadataJSONCompatible(t *testing.T) {
+	enabled := int32(1)
+	meta := &nsqdMetaData{
+		EnabledDelayedQueue: &enabled,
+		Topics: []topicMetaData{
+			{Name: "t1", Partition: 0, Channels: []channelMetaData{}},
+			{Name: "t2", Partition: 1, Ext: true, SyncEvery: 10, SyncTimeoutMs: 100, Channels: []channelMetaData{}},
+		},
+		Version: "test",
+	}
+	// the json output should be the same as the old map encoding
+	old := map[string]interface{}{
+		"enabled_delayedqueue": int32(1),
+		"topics": []interface{}{
+			map[string]interface{}{"name": "t1", "partition": 0, "ext": false, "channels": []interface{}{}},
+			map[string]interface{}{"name": "t2", "partition": 1, "ext": true, "channels": []interface{}{},
+				"sync_every": int64(10), "sync_timeout_ms": int64(100)},
+		},
+		"version": "test",
+	}
+	expected, err := json.Marshal(&old)
+	equal(t, err, nil)
+	s, _ := getMetaSerializer(MetaFormatJSON)
+	data, err := s.Marshal(meta)
+	equal(t, err, nil)
+	equal(t, string(data), string(expected))
+
+	for _, format := range []string{MetaFormatJSON, MetaFormatGob} {
+		s, err = getMetaSerializer(format)
+		equal(t, err, nil)
+		data, err = s.Marshal(meta)
+		equal(t, err, nil)
+		var decoded nsqdMetaData
+		err = detectMetaSerializer(data).Unmarshal(data, &decoded)
+		equal(t, err, nil)
+		equal(t, *decoded.EnabledDelayedQueue, enabled)
+		equal(t, decoded.Version, meta.Version)
+		equal(t, len(decoded.Topics), len(meta.Topics))
+		for i, topicMeta := range decoded.Topics {
+			equal(t, topicMeta.Name, meta.Topics[i].Name)
+			equal(t, topicMeta.Partition, meta.Topics[i].Partition)
+			equal(t, topicMeta.Ext, meta.Topics[i].Ext)
+			equal(t, topicMeta.SyncEvery, meta.Topics[i].SyncEvery)
+			equal(t, topicMeta.SyncTimeoutMs, meta.Topics[i].SyncTimeoutMs)
+		}
+	}
+	_, err = getMetaSerializer("unknown")
+	assert(t, err != nil, "unknown format should fail")
+}
+
+func TestLoadOldJSONMetadata(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	opts.MetadataFormat = MetaFormatGob
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+	defer atomic.StoreInt32(&EnableDelayedQueue, atomic.LoadInt32(&EnableDelayedQueue))
+
+	// the metadata written by the old version
+	oldMeta := `{"enabled_delayedqueue":1,"topics":[` +
+		`{"channels":[{"name":"ch_paused","paused":true}],"ext":false,"name":"old_meta_topic","partition":0},` +
+		`{"channels":[],"ext":true,"name":"old_meta_topic_ext","partition":2,"sync_every":5,"sync_timeout_ms":200}` +
+		`],"version":"0.3.7-HA.1.5.6"}`
+	fn := fmt.Sprintf(path.Join(opts.DataPath, "nsqd.%d.dat"), opts.ID)
+	err := ioutil.WriteFile(fn, []byte(oldMeta), 0644)
+	equal(t, err, nil)
+
+	nsqd.LoadMetadata(1)
+	equal(t, atomic.LoadInt32(&EnableDelayedQueue), int32(1))
+	topic, err := nsqd.GetExistingTopic("old_meta_topic", 0)
+	equal(t, err, nil)
+	equal(t, topic.IsExt(), false)
+	ch, err := topic.GetExistingChannel("ch_paused")
+	equal(t, err, nil)
+	equal(t, ch.IsPaused(), true)
+
+	topicExt, err := nsqd.GetExistingTopic("old_meta_topic_ext", 2)
+	equal(t, err, nil)
+	equal(t, topicExt.IsExt(), true)
+	equal(t, topicExt.GetSyncPolicy(), TopicSyncPolicy{SyncEvery: 5, SyncTimeout: 200 * time.Millisecond})
+
+	// should be saved using the configured format
+	err = nsqd.persistMetadata(nsqd.GetTopicMapCopy())
+	equal(t, err, nil)
+	data, err := ioutil.ReadFile(fn)
+	equal(t, err, nil)
+	equal(t, bytes.HasPrefix(data, gobMetaMagic), true)
+}
+
+func TestLoadMetadataSkipBadTopicFile(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+
+	atomic.StoreInt32(&nsqd.isLoading, 1)
+	topicNum := 20
+	topicPrefix := "topic_meta_files" + strconv.Itoa(int(time.Now().Unix()))
+	for i := 0; i < topicNum; i++ {
+		topic := nsqd.GetTopic(topicPrefix+strconv.Itoa(i), 0)
+		topic.GetChannel("ch")
+	}
+	atomic.StoreInt32(&nsqd.isLoading, 0)
+	err := nsqd.persistMetadata(nsqd.GetTopicMapCopy())
+	equal(t, err, nil)
+	fis, err := ioutil.ReadDir(nsqd.topicMetaDir())
+	equal(t, err, nil)
+	equal(t, len(fis), topicNum)
+
+	// the metadata file of the deleted topic should be removed
+	err = nsqd.DeleteExistingTopic(topicPrefix+"0", 0)
+	equal(t, err, nil)
+	err = nsqd.persistMetadata(nsqd.GetTopicMapCopy())
+	equal(t, err, nil)
+	_, err = os.Stat(nsqd.topicMetaFileName(GetTopicFullName(topicPrefix+"0", 0)))
+	equal(t, os.IsNotExist(err), true)
+
+	// the metadata file failed to write should be kept and written again next time
+	failedFile := nsqd.topicMetaFileName(GetTopicFullName(topicPrefix+"2", 0))
+	oldData, err := ioutil.ReadFile(failedFile)
+	equal(t, err, nil)
+	writeTopicMetaFile = func(fileName string, data []byte, syncDir bool) error {
+		if fileName == failedFile {
+			return errors.New("write failed")
+		}
+		return writeMetaFile(fileName, data, syncDir)
+	}
+	topic2, err := nsqd.GetExistingTopic(topicPrefix+"2", 0)
+	equal(t, err, nil)
+	topic2.SetSyncPolicy(TopicSyncPolicy{SyncEvery: 5})
+	err = nsqd.persistMetadata(nsqd.GetTopicMapCopy())
+	equal(t, err, nil)
+	data, err := ioutil.ReadFile(failedFile)
+	equal(t, err, nil)
+	equal(t, data, oldData)
+	writeTopicMetaFile = writeMetaFile
+	err = nsqd.persistMetadata(nsqd.GetTopicMapCopy())
+	equal(t, err, nil)
+	data, err = ioutil.ReadFile(failedFile)
+	equal(t, err, nil)
+	nequal(t, data, oldData)
+	nsqd.Exit()
+
+	badTopic := topicPrefix + "1"
+	err = ioutil.WriteFile(nsqd.topicMetaFileName(GetTopicFullName(badTopic, 0)), []byte("{bad meta"), 0644)
+	equal(t, err, nil)
+
+	_, _, nsqd = mustStartNSQD(opts)
+	defer nsqd.Exit()
+	nsqd.LoadMetadata(1)
+	_, err = nsqd.GetExistingTopic(topicPrefix+"0", 0)
+	assert(t, err != nil, "deleted topic should not be loaded")
+	_, err = nsqd.GetExistingTopic(badTopic, 0)
+	assert(t, err != nil, "topic with bad metadata file should not be loaded")
+	for i := 2; i < topicNum; i++ {
+		topic, err := nsqd.GetExistingTopic(topicPrefix+strconv.Itoa(i), 0)
+		equal(t, err, nil)
+		_, err = topic.GetExistingChannel("ch")
+		equal(t, err, nil)
+	}
+}
+
+func TestExitTimeoutWithStuckTask(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	opts.ExitTimeout = time.Millisecond * 200
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+
+	topicName := "exit_timeout" + strconv.Itoa(int(time.Now().Unix()))
+	nsqd.GetTopic(topicName, 0).GetChannel("ch")
+
+	stuck := make(chan struct{})
+	nsqd.wrapBackground("stuckTask", func() {
+		<-stuck
+	})
+
+	start := time.Now()
+	nsqd.Exit()
+	cost := time.Since(start)
+	assert(t, cost >= opts.ExitTimeout, "exit should wait the timeout: %v", cost)
+	assert(t, cost < opts.ExitTimeout+time.Second, "exit should not hang: %v", cost)
+	equal(t, nsqd.runningBackgroundTasks(), []string{"stuckTask"})
+	// the data path is locked until the stuck task exits
+	equal(t, nsqd.dl.IsLocked(), true)
+
+	// the metadata should be persisted before waiting the background tasks
+	_, err := os.Stat(nsqd.metaDataFileName())
+	equal(t, err, nil)
+	_, err = os.Stat(nsqd.topicMetaFileName(GetTopicFullName(topicName, 0)))
+	equal(t, err, nil)
+
+	close(stuck)
+	for i := 0; i < 100 && nsqd.dl.IsLocked(); i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	equal(t, nsqd.dl.IsLocked(), false)
+}
+
+func TestQueueScanAutoPoolSize(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	opts.QueueScanWorkerPoolMax = 1
+	opts.QueueScanWorkerPoolAuto = true
+	n := &NSQD{}
+	n.SwapOpts(opts)
+	workCh := make(chan *Channel)
+	responseCh := make(chan responseData)
+	closeCh := make(chan int)
+	defer n.waitGroup.Wait()
+	defer close(closeCh)
+
+	channelNum := 100
+	fixed := fixedPoolSize(channelNum, opts.QueueScanWorkerPoolRatio, opts.QueueScanWorkerPoolMax)
+	equal(t, fixed, 1)
+	poolCap := autoPoolCap(channelNum, opts.QueueScanSelectionCount)
+	expectedCap := runtime.NumCPU() * 2
+	if expectedCap > opts.QueueScanSelectionCount {
+		expectedCap = opts.QueueScanSelectionCount
+	}
+	equal(t, poolCap, expectedCap)
+	assert(t, poolCap > fixed, "the auto cap %v should be larger than the fixed size %v", poolCap, fixed)
+
+	n.resizePool(channelNum, workCh, responseCh, closeCh)
+	equal(t, n.poolSize, 1)
+	busy := opts.QueueScanInterval / 100
+	// the dirty but fast round does not need more workers
+	n.autoResizePool(channelNum, 1, busy/2, workCh, responseCh, closeCh)
+	equal(t, n.poolSize, 1)
+	for i := 0; i < poolCap*2; i++ {
+		n.autoResizePool(channelNum, 1, busy*2, workCh, responseCh, closeCh)
+	}
+	equal(t, n.poolSize, poolCap)
+	equal(t, len(n.runningBackgroundTasks()), poolCap)
+	// the refresh keeps the auto size
+	n.resizePool(channelNum, workCh, responseCh, closeCh)
+	equal(t, n.poolSize, poolCap)
+	// the pool is clamped while most channels are removed
+	n.resizePool(1, workCh, responseCh, closeCh)
+	equal(t, n.poolSize, 1)
+	n.resizePool(channelNum, workCh, responseCh, closeCh)
+	for i := 0; i < poolCap*2; i++ {
+		n.autoResizePool(channelNum, 1, busy*2, workCh, responseCh, closeCh)
+	}
+	equal(t, n.poolSize, poolCap)
+
+	// shrink while idle
+	n.autoResizePool(channelNum, opts.QueueScanDirtyPercent/2, busy*2, workCh, responseCh, closeCh)
+	equal(t, n.poolSize, poolCap)
+	for i := 0; i < poolCap*2; i++ {
+		n.autoResizePool(channelNum, 0, 0, workCh, responseCh, closeCh)
+	}
+	equal(t, n.poolSize, 1)
+	for i := 0; i < 100; i++ {
+		if len(n.runningBackgroundTasks()) == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	equal(t, len(n.runningBackgroundTasks()), 1)
+
+	// the fixed ratio is used if not auto
+	opts.QueueScanWorkerPoolAuto = false
+	opts.QueueScanWorkerPoolMax = 8
+	opts.QueueScanWorkerPoolRatio = 0.05
+	n.resizePool(channelNum, workCh, responseCh, closeCh)
+	equal(t, n.poolSize, 5)
+	n.resizePool(1, workCh, responseCh, closeCh)
+	equal(t, n.poolSize, 1)
+}
+
+func TestInvalidSyncOptions(t *testing.T) {
+	for _, v := range []int64{0, -1} {
+		opts := NewOptions()
+		opts.Logger = newTestLogger(t)
+		opts.SyncTimeout = time.Duration(v) * time.Second
+		opts.SyncEvery = v
+		_, _, nsqd := mustStartNSQD(opts)
+		equal(t, nsqd.GetOpts().SyncTimeout, defaultSyncTimeout)
+		equal(t, nsqd.GetOpts().SyncEvery, int64(1))
+		nsqd.Exit()
+		os.RemoveAll(opts.DataPath)
+	}
+}
+
+func TestGetNewTopicNotBlockedByLookup(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	opts.DisableLookupd = true
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	start := time.Now()
+	topic := nsqd.GetTopic("new_topic_no_lookup", 0)
+	assert(t, topic != nil, "topic should be created")
+	assert(t, time.Since(start) < time.Second, "topic creation should not wait the lookup")
+	// no lookup loop to notify without lookupd
+	select {
+	case v := <-nsqd.MetaNotifyChan:
+		t.Fatalf("unexpected notify: %v", v)
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	// the notify to the lookup loop not running should not block the creation
+	newOpts := *nsqd.GetOpts()
+	newOpts.DisableLookupd = false
+	nsqd.SwapOpts(&newOpts)
+	start = time.Now()
+	topic = nsqd.GetTopic("new_topic_lookup_stuck", 0)
+	assert(t, topic != nil, "topic should be created")
+	assert(t, time.Since(start) < time.Second, "topic creation should not wait the lookup")
+}
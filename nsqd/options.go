@@ -15,6 +15,8 @@ import (
 
 const (
 	MAX_NODE_ID = 1024 * 1024
+	// the sync timeout used if the configured one is not positive
+	defaultSyncTimeout = 2 * time.Second
 )
 
 type Options struct {
@@ -33,19 +35,56 @@ type Options struct {
 	NSQLookupdTCPAddresses     []string      `flag:"lookupd-tcp-address" cfg:"nsqlookupd_tcp_addresses"`
 	AuthHTTPAddresses          []string      `flag:"auth-http-address" cfg:"auth_http_addresses"`
 	LookupPingInterval         time.Duration `flag:"lookup-ping-interval" arg:"5s"`
+	ExitTimeout                time.Duration `flag:"exit-timeout"`
+	// start even if the worker id is used by another live node in the cluster
+	AllowDuplicateWorkerID bool `flag:"allow-duplicate-worker-id"`
+	// run standalone without registering to or discovering the lookupd
+	DisableLookupd bool `flag:"disable-lookupd"`
+	// cache the auth state of the same client for this duration, disabled if 0
+	AuthCacheTTL     time.Duration `flag:"auth-cache-ttl"`
+	AuthCacheMaxSize int           `flag:"auth-cache-max-size"`
 
 	// diskqueue options
-	DataPath        string        `flag:"data-path"`
-	MemQueueSize    int64         `flag:"mem-queue-size"`
-	MaxBytesPerFile int64         `flag:"max-bytes-per-file"`
-	SyncEvery       int64         `flag:"sync-every"`
-	SyncTimeout     time.Duration `flag:"sync-timeout"`
+	DataPath          string        `flag:"data-path"`
+	DataPathPerWorker bool          `flag:"data-path-per-worker"`
+	MemQueueSize      int64         `flag:"mem-queue-size"`
+	MaxBytesPerFile   int64         `flag:"max-bytes-per-file"`
+	SyncEvery         int64         `flag:"sync-every"`
+	SyncTimeout       time.Duration `flag:"sync-timeout"`
+	ColdDataPath      string        `flag:"cold-data-path"`
+	ColdDataAge       time.Duration `flag:"cold-data-age"`
+	// the channel meta syncs in this window will be batched, disabled if 0
+	MetaSyncBatchWindow time.Duration `flag:"meta-sync-batch-window"`
+	// the format of the nsqd metadata file, json or gob
+	MetadataFormat string `flag:"metadata-format"`
+	// the naming patterns of the data files and the channel meta files, the default is used if empty
+	QueueFileNamePattern  string `flag:"queue-file-name-pattern"`
+	ReaderMetaNamePattern string `flag:"reader-meta-name-pattern"`
+	// rebuild the missing offset meta of the data files by scanning them while accessed
+	RebuildOffsetMeta bool `flag:"rebuild-offset-meta"`
+	// check the data files are contiguous while loading the topics, and refuse to load if not
+	CheckFilesOnStart bool `flag:"check-files-on-start"`
+	// quarantine the overlapped data files found by the check instead of refusing to start
+	RepairOnStart bool `flag:"repair-on-start"`
+	// the interval to verify a retained data file by the checksum saved while finished, disabled if 0
+	ScrubInterval time.Duration `flag:"scrub-interval"`
+	// the file number of each sub directory for sharding the data files, disabled if 0
+	QueueFileShardSize int64 `flag:"queue-file-shard-size"`
+	// save the channel confirmed offsets to the cluster leadership store to recover them after failover
+	ExternalConfirmStore bool `flag:"external-confirm-store"`
+	// the store of the channel confirmed offsets besides the local meta, ignored if nil
+	ConfirmStore ConfirmStore
 
 	QueueScanInterval        time.Duration
 	QueueScanRefreshInterval time.Duration
 	QueueScanSelectionCount  int
 	QueueScanWorkerPoolMax   int
 	QueueScanDirtyPercent    float64
+	// the pool size ratio to the channels
+	QueueScanWorkerPoolRatio float64
+	// size the pool by the dirty channels and the latency of each scan round, capped by
+	// the cpu count instead of QueueScanWorkerPoolMax
+	QueueScanWorkerPoolAuto bool
 
 	// msg and command options
 	MsgTimeout        time.Duration `flag:"msg-timeout" arg:"60s"`
@@ -54,8 +93,35 @@ type Options struct {
 	MaxBodySize       int64         `flag:"max-body-size"`
 	MaxReqTimeout     time.Duration `flag:"max-req-timeout"`
 	MaxConfirmWin     int64         `flag:"max-confirm-win"`
+	MaxInFlightMsgs   int64         `flag:"max-inflight-msgs"`
+	ClampOverConfirm  bool          `flag:"clamp-over-confirm"`
+	StrictConfirm     bool          `flag:"strict-confirm"`
+	ConfirmBoundary   bool          `flag:"confirm-boundary-check"`
 	ClientTimeout     time.Duration
 	ReqToEndThreshold time.Duration `flag:"req-to-end-threshold"`
+	// the channel is alarmed while the confirm window is saturated longer than this, disabled if 0
+	ConfirmWinBreakerTimeout time.Duration `flag:"confirm-win-breaker-timeout"`
+	// parse the message header while the channel reads the disk queue, so the message read out
+	// of order can be handled without decoding
+	ParseMsgHeader bool `flag:"parse-msg-header"`
+	// pace the channel reads by the confirm latency while the confirm window is filling up
+	AdaptiveReadPacing bool `flag:"adaptive-read-pacing"`
+	// the policy to handle the corrupt data of the channel: skip-file, skip-to-end or halt
+	CorruptionPolicy string `flag:"corruption-policy"`
+	// the path to keep the copy of the corrupt data files skipped by the channels, disabled if empty
+	CorruptQuarantinePath string `flag:"corrupt-quarantine-path"`
+	// the policy to handle the channel read past the topic end moved backward: clamp or halt
+	EndDivergencePolicy string `flag:"end-divergence-policy"`
+	// the max idle data file handles cached for the random-access reads of all the channels, disabled if 0
+	MaxCachedReadFiles int `flag:"max-cached-read-files"`
+	// the deadline for the channel to confirm each message delivered, the message not confirmed in
+	// time is redelivered by rewinding the read at most the max redeliver times, disabled if 0
+	ConfirmDeadline             time.Duration `flag:"confirm-deadline"`
+	ConfirmDeadlineMaxRedeliver int           `flag:"confirm-deadline-max-redeliver"`
+	// the pub rate limits of each topic in messages and bytes per second, disabled if 0,
+	// it can be overridden by the topic meta
+	PubRateLimit      int64 `flag:"pub-rate-limit"`
+	PubBytesRateLimit int64 `flag:"pub-bytes-rate-limit"`
 
 	// client overridable configuration options
 	MaxHeartbeatInterval   time.Duration `flag:"max-heartbeat-interval"`
@@ -120,18 +186,23 @@ func NewOptions() *Options {
 
 		NSQLookupdTCPAddresses: make([]string, 0),
 		AuthHTTPAddresses:      make([]string, 0),
+		AuthCacheMaxSize:       10000,
 		LookupPingInterval:     5 * time.Second,
+		ExitTimeout:            30 * time.Second,
 
 		MemQueueSize:    10000,
 		MaxBytesPerFile: 100 * 1024 * 1024,
 		SyncEvery:       2500,
-		SyncTimeout:     2 * time.Second,
+		SyncTimeout:     defaultSyncTimeout,
+		ColdDataAge:     24 * time.Hour,
+		MetadataFormat:  MetaFormatJSON,
 
 		QueueScanInterval:        500 * time.Millisecond,
 		QueueScanRefreshInterval: 5 * time.Second,
 		QueueScanSelectionCount:  20,
 		QueueScanWorkerPoolMax:   4,
 		QueueScanDirtyPercent:    0.25,
+		QueueScanWorkerPoolRatio: 0.25,
 
 		MsgTimeout:        60 * time.Second,
 		MaxMsgTimeout:     15 * time.Minute,
@@ -141,6 +212,8 @@ func NewOptions() *Options {
 		ClientTimeout:     60 * time.Second,
 		ReqToEndThreshold: 15 * time.Minute,
 
+		ConfirmDeadlineMaxRedeliver: 3,
+
 		MaxHeartbeatInterval:   60 * time.Second,
 		MaxRdyCount:            2500,
 		MaxOutputBufferSize:    64 * 1024,
@@ -593,6 +593,15 @@ func (self *IntervalHash) query(inter QueueInterval, excludeBoard bool, earlyExi
 	return rets
 }
 
+// return the interval started at the low, nil if not found
+func (self *IntervalHash) StartAt(low int64) QueueInterval {
+	qi, ok := self.elems[low]
+	if ok && qi.Start() == low {
+		return qi
+	}
+	return nil
+}
+
 func (self *IntervalHash) IsLowestAt(low int64) QueueInterval {
 	qi, ok := self.elems[low]
 	if ok && qi.Start() == low {
@@ -34,8 +34,30 @@ type TopicStats struct {
 	IsMultiOrdered       bool             `json:"is_multi_ordered"`
 	IsExt                bool             `json:"is_ext"`
 	StatsdName           string           `json:"statsd_name"`
+	BackendType          string           `json:"backend_type"`
+	DiskBacked           bool             `json:"disk_backed"`
+	PubMsgRate           int64            `json:"pub_msg_rate"`
+	PubBytesRate         int64            `json:"pub_bytes_rate"`
 
 	E2eProcessingLatency *quantile.Result `json:"e2e_processing_latency"`
+
+	Backlog            TopicBacklogStats `json:"backlog"`
+	ScrubMismatchCount int64             `json:"scrub_mismatch_count"`
+	LostConfirmCount   int64             `json:"lost_confirm_count"`
+}
+
+// TopicBacklogStats is the backlog aggregated across the channels of the topic. The depth is
+// the message count not confirmed, and the confirm lag is the data size between the confirmed
+// and the topic committed end.
+type TopicBacklogStats struct {
+	ChannelNum      int    `json:"channel_num"`
+	MinDepth        int64  `json:"min_depth"`
+	MaxDepth        int64  `json:"max_depth"`
+	TotalDepth      int64  `json:"total_depth"`
+	MinConfirmLag   int64  `json:"min_confirm_lag"`
+	MaxConfirmLag   int64  `json:"max_confirm_lag"`
+	TotalConfirmLag int64  `json:"total_confirm_lag"`
+	MaxLagChannel   string `json:"max_lag_channel"`
 }
 
 func NewTopicStats(t *Topic, channels []ChannelStats) TopicStats {
@@ -43,6 +65,7 @@ func NewTopicStats(t *Topic, channels []ChannelStats) TopicStats {
 	if t.IsOrdered() {
 		statsdName += "." + strconv.Itoa(t.GetTopicPart())
 	}
+	pubMsgRate, pubBytesRate := t.GetPubRates()
 	return TopicStats{
 		TopicName:            t.GetTopicName(),
 		TopicFullName:        t.GetFullName(),
@@ -59,8 +82,16 @@ func NewTopicStats(t *Topic, channels []ChannelStats) TopicStats {
 		IsMultiOrdered:       t.IsOrdered(),
 		IsExt:                t.IsExt(),
 		StatsdName:           statsdName,
+		BackendType:          t.GetBackendType(),
+		DiskBacked:           t.IsDiskBacked(),
+		PubMsgRate:           pubMsgRate,
+		PubBytesRate:         pubBytesRate,
 
 		E2eProcessingLatency: t.AggregateChannelE2eProcessingLatency().Result(),
+
+		Backlog:            t.BacklogStats(),
+		ScrubMismatchCount: t.GetScrubMismatchCount(),
+		LostConfirmCount:   t.GetLostConfirmCount(),
 	}
 }
 
@@ -81,6 +112,46 @@ type ChannelStats struct {
 	Clients       []ClientStats `json:"clients"`
 	Paused        bool          `json:"paused"`
 	Skipped       bool          `json:"skipped"`
+	Degraded      bool          `json:"degraded"`
+	Throttled     bool          `json:"throttled"`
+	// the confirm window breaker is tripped
+	ConfirmWinAlarmed bool `json:"confirm_win_alarmed"`
+	// the data buffered in memory by the reader
+	ReaderBufferedBytes int64 `json:"reader_buffered_bytes"`
+	// the moving average latency from delivery to confirm in milliseconds
+	ConfirmLatency int64 `json:"confirm_latency"`
+	// the read is halted by the corrupt data
+	ReaderHalted bool `json:"reader_halted"`
+	// the backend type of the reader and whether it reads from the disk files
+	BackendType string `json:"backend_type"`
+	DiskBacked  bool   `json:"disk_backed"`
+	// the times of the read position rewound by the topic end moved backward
+	ReaderRewindCount int64 `json:"reader_rewind_count"`
+	// the times of the corrupt data skipped by the reader
+	ReaderCorruptSkips int64 `json:"reader_corrupt_skips"`
+	// the times of the end updated with the type mismatched
+	ReaderEndMismatches int64 `json:"reader_end_mismatches"`
+	// the times of the read rewound by the confirm deadline, the messages given up after
+	// redelivered the max times, and the messages delivered without the deadline tracked
+	DeadlineRedelivers int64 `json:"deadline_redelivers"`
+	DeadlineExhausted  int64 `json:"deadline_exhausted"`
+	DeadlineUntracked  int64 `json:"deadline_untracked"`
+	// the latency of the reader startup and the data file open
+	ReaderLatency ReaderLatencyStats `json:"reader_latency"`
+	// the message size distribution read by the reader
+	ReaderMsgSizes []MsgSizeBucket `json:"reader_msg_sizes"`
+	// the messages routed to the dead letter topic
+	DeadLetterCount uint64 `json:"dead_letter_count"`
+	// the size of the data kept before the confirmed for the rewind, and the size of the
+	// retained data the channel can rewind to
+	RewindRetention int64 `json:"rewind_retention"`
+	RewindAvailable int64 `json:"rewind_available"`
+	// the retention seconds of the channel and the oldest retained offset it can reset to
+	RetentionSeconds int64 `json:"retention_seconds"`
+	RetainedStart    int64 `json:"retained_start"`
+	// the offsets are shifted by the base addressed by the external systems
+	OffsetBase      int64 `json:"offset_base"`
+	ConfirmedOffset int64 `json:"confirmed_offset"`
 
 	DelayedQueueCount  uint64 `json:"delayed_queue_count"`
 	DelayedQueueRecent string `json:"delayed_queue_recent"`
@@ -89,6 +160,13 @@ type ChannelStats struct {
 	MSgConsumeLatencyStats []int64          `json:"msg_consume_latency_stats"`
 }
 
+// the messages read with the size not larger than the upper bound and larger than
+// the previous bucket, the upper bound of the last bucket is -1.
+type MsgSizeBucket struct {
+	UpperBound int64 `json:"le"`
+	Count      int64 `json:"count"`
+}
+
 func NewChannelStats(c *Channel, clients []ClientStats) ChannelStats {
 	c.inFlightMutex.Lock()
 	inflightCnt := len(c.inFlightMessages)
@@ -109,6 +187,8 @@ func NewChannelStats(c *Channel, clients []ClientStats) ChannelStats {
 	if len(chCntList) > 0 {
 		dqCnt, _ = chCntList[c.GetName()]
 	}
+	deadlineRedelivers, deadlineExhausted, deadlineUntracked := c.GetReaderDeadlineRedelivers()
+	offsetBase := int64(c.GetOffsetBase())
 	return ChannelStats{
 		ChannelName:    c.name,
 		Depth:          c.Depth(),
@@ -119,15 +199,38 @@ func NewChannelStats(c *Channel, clients []ClientStats) ChannelStats {
 		InFlightCount: inflightCnt,
 		// this is total message count need consume.
 		// may diff with topic total size since some is in buffer.
-		MessageCount:       uint64(c.backend.GetQueueReadEnd().TotalMsgCnt()),
-		RequeueCount:       atomic.LoadUint64(&c.requeueCount),
-		DeferredCount:      int(atomic.LoadInt64(&c.deferredCount)),
-		TimeoutCount:       atomic.LoadUint64(&c.timeoutCount),
-		Clients:            clients,
-		Paused:             c.IsPaused(),
-		Skipped:            c.IsSkipped(),
-		DelayedQueueCount:  dqCnt,
-		DelayedQueueRecent: time.Unix(0, recentTs).String(),
+		MessageCount:        uint64(c.backend.GetQueueReadEnd().TotalMsgCnt()),
+		RequeueCount:        atomic.LoadUint64(&c.requeueCount),
+		DeferredCount:       int(atomic.LoadInt64(&c.deferredCount)),
+		TimeoutCount:        atomic.LoadUint64(&c.timeoutCount),
+		Clients:             clients,
+		Paused:              c.IsPaused(),
+		Skipped:             c.IsSkipped(),
+		Degraded:            c.IsDegraded(),
+		Throttled:           c.IsThrottled(),
+		ConfirmWinAlarmed:   c.IsConfirmWinAlarmed(),
+		ReaderBufferedBytes: c.GetReaderBufferedBytes(),
+		ConfirmLatency:      int64(c.GetConfirmLatency() / time.Millisecond),
+		ReaderHalted:        c.IsReaderHalted(),
+		BackendType:         c.GetBackendType(),
+		DiskBacked:          c.IsDiskBacked(),
+		ReaderRewindCount:   c.GetReaderRewindCount(),
+		ReaderCorruptSkips:  c.GetReaderCorruptSkipCount(),
+		ReaderLatency:       c.GetReaderLatencyStats(),
+		ReaderEndMismatches: c.GetReaderEndMismatchCount(),
+		DeadlineRedelivers:  deadlineRedelivers,
+		DeadlineExhausted:   deadlineExhausted,
+		DeadlineUntracked:   deadlineUntracked,
+		ReaderMsgSizes:      c.GetReaderMsgSizeHistogram(),
+		DeadLetterCount:     c.GetDeadLetterCount(),
+		RewindRetention:     c.GetRewindRetention(),
+		RewindAvailable:     c.GetRewindAvailable(),
+		RetentionSeconds:    c.GetRetentionSeconds(),
+		RetainedStart:       c.GetRetainedStart() + offsetBase,
+		OffsetBase:          offsetBase,
+		ConfirmedOffset:     int64(c.GetConfirmed().Offset()) + offsetBase,
+		DelayedQueueCount:   dqCnt,
+		DelayedQueueRecent:  time.Unix(0, recentTs).String(),
 
 		E2eProcessingLatency:   c.e2eProcessingLatencyStream.Result(),
 		MSgConsumeLatencyStats: c.channelStatsInfo.GetChannelLatencyStats(),
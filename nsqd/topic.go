@@ -42,7 +42,7 @@ func writeMessageToBackend(writeExt bool, buf *bytes.Buffer, msg *Message, bq *d
 	return bq.PutV2(buf.Bytes())
 }
 
-func writeMessageToBackendWithCheck(writeExt bool, buf *bytes.Buffer, msg *Message, checkSize int64, bq *diskQueueWriter) (BackendOffset, int32, diskQueueEndInfo, error) {
+func writeMessageToBackendWithCheck(writeExt bool, buf *bytes.Buffer, msg *Message, checkSize int64, bq topicQueueWriter) (BackendOffset, int32, diskQueueEndInfo, error) {
 	buf.Reset()
 	wsize, err := msg.WriteTo(buf, writeExt)
 	if err != nil {
@@ -66,6 +66,18 @@ type TopicDynamicConf struct {
 	SyncEvery    int64
 	OrderedMulti bool
 	Ext          bool
+	// override the node pub rate limits if not 0
+	PubRateLimit      int64
+	PubBytesRateLimit int64
+	// the max message size lower than the node option if not 0
+	MaxMsgSize int64
+}
+
+// TopicSyncPolicy overrides the node-wide sync options for the channels of the topic,
+// the zero value means using the node-wide options.
+type TopicSyncPolicy struct {
+	SyncEvery   int64
+	SyncTimeout time.Duration
 }
 
 type PubInfo struct {
@@ -82,6 +94,13 @@ type ChannelMetaInfo struct {
 	Name    string `json:"name"`
 	Paused  bool   `json:"paused"`
 	Skipped bool   `json:"skipped"`
+	// route the message to the dead letter topic after failed the attempts
+	DeadLetterTopic    string `json:"dead_letter_topic,omitempty"`
+	DeadLetterAttempts uint16 `json:"dead_letter_attempts,omitempty"`
+	// the size of the data kept before the confirmed for the rewind
+	RewindRetention int64 `json:"rewind_retention,omitempty"`
+	// the seconds of the data kept for the channel overriding the topic retention
+	RetentionSeconds int64 `json:"retention_seconds,omitempty"`
 }
 
 type Topic struct {
@@ -94,6 +113,7 @@ type Topic struct {
 	channelLock sync.RWMutex
 	backend     *diskQueueWriter
 	dataPath    string
+	queuePath   atomic.Value // may be migrated out of the topic data path
 	flushChan   chan int
 	exitFlag    int32
 
@@ -124,6 +144,25 @@ type Topic struct {
 	delayedQueue atomic.Value
 	isExt        int32
 	saveMutex    sync.Mutex
+	syncPolicy   atomic.Value
+	pubLimiter   pubRateLimiter
+	// the length of the header of each data file written by the external writer
+	queueFileHeaderLen int64
+	// the base of the offsets addressed by the external systems
+	offsetBase int64
+	// the channel lifecycle counters
+	channelCreatedCnt int64
+	channelDeletedCnt int64
+	// the next data file to scrub and the checksum mismatches found
+	scrubFileNum     int64
+	scrubMismatchCnt int64
+	// the unconfirmed data removed by the clean, which should never happen
+	lostConfirmCnt  int64
+	lostConfirmLock sync.Mutex
+	lastLostRange   LostConfirmRange
+	// the queue written, which is the backend or the memory queue by the backing
+	writer   topicQueueWriter
+	memQueue *memoryQueue
 }
 
 func (t *Topic) setExt() {
@@ -144,13 +183,28 @@ func NewTopic(topicName string, part int, opt *Options,
 	return NewTopicWithExt(topicName, part, false, opt, writeDisabled, notify, loopFunc)
 }
 
-// Topic constructor
 func NewTopicWithExt(topicName string, part int, ext bool, opt *Options,
+	writeDisabled int32,
+	notify INsqdNotify, loopFunc func(v *Topic)) *Topic {
+	return NewTopicWithBacking(topicName, part, ext, BackendTypeDisk, opt, writeDisabled, notify, loopFunc)
+}
+
+// Topic constructor, the backing is the type of the queue written by the topic, the memory
+// queue never touches the disk and the data is lost after restart, so it can not be read by
+// the disk queue snapshot either.
+func NewTopicWithBacking(topicName string, part int, ext bool, backing string, opt *Options,
 	writeDisabled int32,
 	notify INsqdNotify, loopFunc func(v *Topic)) *Topic {
 	if part > MAX_TOPIC_PARTITION {
 		return nil
 	}
+	if backing == "" {
+		backing = BackendTypeDisk
+	}
+	if backing != BackendTypeDisk && backing != BackendTypeMemory {
+		nsqLog.LogErrorf("topic(%v) invalid backing: %v", topicName, backing)
+		return nil
+	}
 	t := &Topic{
 		tname:          topicName,
 		partition:      part,
@@ -182,27 +236,54 @@ func NewTopicWithExt(topicName string, part int, ext bool, opt *Options,
 		nsqLog.LogErrorf("topic(%v) failed to create directory: %v ", t.fullName, err)
 		return nil
 	}
-
 	backendName := getBackendName(t.tname, t.partition)
-	queue, err := NewDiskQueueWriter(backendName,
-		t.dataPath,
-		opt.MaxBytesPerFile,
-		int32(minValidMsgLength),
-		int32(opt.MaxMsgSize)+minValidMsgLength,
-		opt.SyncEvery)
-
+	queuePath, err := loadQueueDataPath(t.dataPath, t.partition)
 	if err != nil {
-		nsqLog.LogErrorf("topic(%v) failed to init disk queue: %v ", t.fullName, err)
-		if err == ErrNeedFixQueueStart {
-			t.SetDataFixState(true)
-		} else {
-			t.MarkAsRemoved()
-			return nil
+		nsqLog.LogErrorf("topic(%v) failed to load the queue data path: %v ", t.fullName, err)
+		return nil
+	}
+	t.queuePath.Store(queuePath)
+
+	if backing == BackendTypeMemory {
+		t.memQueue = newMemoryQueue(backendName,
+			int32(minValidMsgLength),
+			int32(opt.MaxMsgSize)+minValidMsgLength,
+			int(opt.MemQueueSize))
+		t.writer = t.memQueue
+	} else {
+		queue, err := newDiskQueueWriter(backendName,
+			queuePath,
+			t.getColdDataPath(),
+			opt.MaxBytesPerFile,
+			int32(minValidMsgLength),
+			int32(opt.MaxMsgSize)+minValidMsgLength,
+			opt.SyncEvery, false)
+
+		if err != nil {
+			nsqLog.LogErrorf("topic(%v) failed to init disk queue: %v ", t.fullName, err)
+			if err == ErrNeedFixQueueStart {
+				t.SetDataFixState(true)
+			} else {
+				t.MarkAsRemoved()
+				return nil
+			}
 		}
+		t.backend = queue.(*diskQueueWriter)
+		if err == nil && (opt.CheckFilesOnStart || opt.RepairOnStart) {
+			// the files are shared by the channels, so check them once for the topic
+			err = t.backend.checkFileIntegrityOnStart(opt.RepairOnStart)
+			if err != nil {
+				// the data files are kept as they are for the manual recovery
+				nsqLog.LogErrorf("topic(%v) refused to load the data files: %v", t.fullName, err)
+				t.backend.Close()
+				return nil
+			}
+		}
+		t.backend.SetCleanAudit(t.auditCleanedData)
+		t.writer = t.backend
 	}
-	t.backend = queue.(*diskQueueWriter)
 
-	t.UpdateCommittedOffset(t.backend.GetQueueWriteEnd())
+	t.UpdateCommittedOffset(t.writer.GetQueueWriteEnd())
 	err = t.loadMagicCode()
 	if err != nil {
 		nsqLog.LogErrorf("topic %v failed to load magic code: %v", t.fullName, err)
@@ -357,7 +438,12 @@ func (t *Topic) MarkAsRemoved() (string, error) {
 	renamePath := t.dataPath + "-removed-" + strconv.Itoa(int(time.Now().Unix()))
 	nsqLog.Warningf("mark the topic %v as removed: %v", t.GetFullName(), renamePath)
 	os.MkdirAll(renamePath, 0755)
-	err := t.backend.RemoveTo(renamePath)
+	var err error
+	if t.backend != nil {
+		err = t.backend.RemoveTo(renamePath)
+	} else if t.writer != nil {
+		t.writer.Delete()
+	}
 	if err != nil {
 		nsqLog.Errorf("failed to mark the topic %v as removed %v failed: %v", t.GetFullName(), renamePath, err)
 	}
@@ -365,6 +451,7 @@ func (t *Topic) MarkAsRemoved() (string, error) {
 	t.removeHistoryStat()
 	t.RemoveChannelMeta()
 	t.removeMagicCode()
+	t.removeQueueDataPath()
 	if t.GetDelayedQueue() != nil {
 		t.GetDelayedQueue().Delete()
 	}
@@ -399,6 +486,25 @@ func (t *Topic) SetTrace(enable bool) {
 	}
 }
 
+// the data files of the queue may be migrated out of the topic data path
+func (t *Topic) getQueueDataPath() string {
+	return t.queuePath.Load().(string)
+}
+
+func (t *Topic) getColdDataPath() string {
+	return getColdDataPath(t.option.ColdDataPath, t.tname)
+}
+
+func (t *Topic) removeQueueDataPath() {
+	os.Remove(getQueueDataPathFileName(t.dataPath, t.partition))
+	t.queuePath.Store(t.dataPath)
+}
+
+func (t *Topic) newDiskQueueSnapshot(endInfo BackendQueueEnd) *DiskQueueSnapshot {
+	return newTieredDiskQueueSnapshot(getBackendName(t.tname, t.partition), t.getQueueDataPath(),
+		t.getColdDataPath(), endInfo)
+}
+
 func (t *Topic) getChannelMetaFileName() string {
 	return path.Join(t.dataPath, "channel_meta"+strconv.Itoa(t.partition))
 }
@@ -419,13 +525,19 @@ func (t *Topic) LoadChannelMeta() error {
 		return err
 	}
 
+	var loadErr error
 	for _, ch := range channels {
 		channelName := ch.Name
 		if !protocol.IsValidChannelName(channelName) {
 			nsqLog.LogWarningf("skipping creation of invalid channel %s", channelName)
 			continue
 		}
-		channel := t.GetChannel(channelName)
+		channel, err := t.GetOrCreateChannel(channelName)
+		if err != nil {
+			// the other channels can still be loaded
+			loadErr = err
+			continue
+		}
 
 		if ch.Paused {
 			channel.Pause()
@@ -434,8 +546,20 @@ func (t *Topic) LoadChannelMeta() error {
 		if ch.Skipped {
 			channel.Skip()
 		}
+		if ch.DeadLetterTopic != "" {
+			err := channel.SetDeadLetterPolicy(ch.DeadLetterTopic, ch.DeadLetterAttempts)
+			if err != nil {
+				nsqLog.LogWarningf("channel %v invalid dead letter topic %v: %v", channelName, ch.DeadLetterTopic, err)
+			}
+		}
+		if ch.RewindRetention > 0 {
+			channel.SetRewindRetention(ch.RewindRetention)
+		}
+		if ch.RetentionSeconds > 0 {
+			channel.SetRetentionSeconds(ch.RetentionSeconds)
+		}
 	}
-	return nil
+	return loadErr
 }
 
 func (t *Topic) GetChannelMeta() []ChannelMetaInfo {
@@ -445,10 +569,13 @@ func (t *Topic) GetChannelMeta() []ChannelMetaInfo {
 		channel.RLock()
 		if !channel.ephemeral {
 			meta := ChannelMetaInfo{
-				Name:    channel.name,
-				Paused:  channel.IsPaused(),
-				Skipped: channel.IsSkipped(),
+				Name:             channel.name,
+				Paused:           channel.IsPaused(),
+				Skipped:          channel.IsSkipped(),
+				RewindRetention:  channel.GetRewindRetention(),
+				RetentionSeconds: channel.GetRetentionSeconds(),
 			}
+			meta.DeadLetterTopic, meta.DeadLetterAttempts = channel.GetDeadLetterPolicy()
 			channels = append(channels, meta)
 		}
 		channel.RUnlock()
@@ -465,10 +592,13 @@ func (t *Topic) SaveChannelMeta() error {
 		channel.RLock()
 		if !channel.ephemeral {
 			meta := &ChannelMetaInfo{
-				Name:    channel.name,
-				Paused:  channel.IsPaused(),
-				Skipped: channel.IsSkipped(),
+				Name:             channel.name,
+				Paused:           channel.IsPaused(),
+				Skipped:          channel.IsSkipped(),
+				RewindRetention:  channel.GetRewindRetention(),
+				RetentionSeconds: channel.GetRetentionSeconds(),
 			}
+			meta.DeadLetterTopic, meta.DeadLetterAttempts = channel.GetDeadLetterPolicy()
 			channels = append(channels, meta)
 		}
 		channel.RUnlock()
@@ -557,18 +687,36 @@ func (t *Topic) UpdateCommittedOffset(offset BackendQueueEnd) {
 	}
 }
 
-func (t *Topic) GetDiskQueueSnapshot() *DiskQueueSnapshot {
-	e := t.backend.GetQueueReadEnd()
+func (t *Topic) getSnapshotEnd() BackendQueueEnd {
+	e := t.writer.GetQueueReadEnd()
 	commit := t.GetCommitted()
 	if commit != nil && e.Offset() > commit.Offset() {
 		e = commit
 	}
-	start := t.backend.GetQueueReadStart()
-	d := NewDiskQueueSnapshot(getBackendName(t.tname, t.partition), t.dataPath, e)
+	return e
+}
+
+// GetDiskQueueSnapshot returns the snapshot to read the committed data files, nil for the
+// memory backing since nothing is written to the disk.
+func (t *Topic) GetDiskQueueSnapshot() *DiskQueueSnapshot {
+	if t.memQueue != nil {
+		return nil
+	}
+	e := t.getSnapshotEnd()
+	start := t.writer.GetQueueReadStart()
+	d := t.newDiskQueueSnapshot(e)
 	d.SetQueueStart(start)
 	return d
 }
 
+// UpdateDiskQueueSnapshot updates the snapshot to read the new committed data,
+// and returns the new end of the snapshot.
+func (t *Topic) UpdateDiskQueueSnapshot(d *DiskQueueSnapshot) BackendQueueEnd {
+	e := t.getSnapshotEnd()
+	d.UpdateQueueEnd(e)
+	return e
+}
+
 func (t *Topic) BufferPoolGet(capacity int) *bytes.Buffer {
 	b := t.bp.Get().(*bytes.Buffer)
 	b.Reset()
@@ -606,6 +754,16 @@ func (t *Topic) IsOrdered() bool {
 	return atomic.LoadInt32(&t.isOrdered) == 1
 }
 
+// GetMaxMsgSize returns the max message size accepted by the pub, the topic meta can only
+// lower the node option since the queue files are written with the node option.
+func (t *Topic) GetMaxMsgSize() int64 {
+	size := atomic.LoadInt64(&t.dynamicConf.MaxMsgSize)
+	if size <= 0 || size > t.option.MaxMsgSize {
+		return t.option.MaxMsgSize
+	}
+	return size
+}
+
 func (t *Topic) SetDynamicInfo(dynamicConf TopicDynamicConf, idGen MsgIDGenerator) {
 	t.Lock()
 	if idGen != nil {
@@ -614,6 +772,9 @@ func (t *Topic) SetDynamicInfo(dynamicConf TopicDynamicConf, idGen MsgIDGenerato
 	atomic.StoreInt64(&t.dynamicConf.SyncEvery, dynamicConf.SyncEvery)
 	atomic.StoreInt32(&t.dynamicConf.AutoCommit, dynamicConf.AutoCommit)
 	atomic.StoreInt32(&t.dynamicConf.RetentionDay, dynamicConf.RetentionDay)
+	atomic.StoreInt64(&t.dynamicConf.PubRateLimit, dynamicConf.PubRateLimit)
+	atomic.StoreInt64(&t.dynamicConf.PubBytesRateLimit, dynamicConf.PubBytesRateLimit)
+	atomic.StoreInt64(&t.dynamicConf.MaxMsgSize, dynamicConf.MaxMsgSize)
 	t.dynamicConf.OrderedMulti = dynamicConf.OrderedMulti
 	if dynamicConf.OrderedMulti {
 		atomic.StoreInt32(&t.isOrdered, 1)
@@ -641,6 +802,90 @@ func (t *Topic) SetDynamicInfo(dynamicConf TopicDynamicConf, idGen MsgIDGenerato
 	t.nsqdNotify.NotifyStateChanged(t, true)
 }
 
+func (t *Topic) GetSyncPolicy() TopicSyncPolicy {
+	p := t.syncPolicy.Load()
+	if p == nil {
+		return TopicSyncPolicy{}
+	}
+	return p.(TopicSyncPolicy)
+}
+
+// SetSyncPolicy changes the sync policy for all the channels of the topic,
+// and the new created channel will use it as well.
+func (t *Topic) SetSyncPolicy(policy TopicSyncPolicy) {
+	t.syncPolicy.Store(policy)
+	syncEvery, syncTimeout := t.getChannelSyncPolicy()
+	t.channelLock.RLock()
+	for _, ch := range t.channelMap {
+		ch.SetSyncPolicy(syncEvery, syncTimeout)
+	}
+	t.channelLock.RUnlock()
+	nsqLog.Logf("topic %v sync policy changed to %v", t.GetFullName(), policy)
+	t.nsqdNotify.NotifyStateChanged(t, true)
+}
+
+// SetOffsetBase changes the base of the offsets addressed by the external systems for all the
+// channels of the topic, and the new created channel will use it as well. The data and the
+// metas on the disk are not changed.
+func (t *Topic) SetOffsetBase(base BackendOffset) error {
+	if base < 0 {
+		return ErrInvalidOffset
+	}
+	if t.backend == nil {
+		return ErrOperationInvalidState
+	}
+	atomic.StoreInt64(&t.offsetBase, int64(base))
+	t.channelLock.RLock()
+	for _, ch := range t.channelMap {
+		ch.SetOffsetBase(base)
+	}
+	t.channelLock.RUnlock()
+	nsqLog.Logf("topic %v offset base changed to %v", t.GetFullName(), base)
+	return nil
+}
+
+func (t *Topic) GetOffsetBase() BackendOffset {
+	return BackendOffset(atomic.LoadInt64(&t.offsetBase))
+}
+
+// SetQueueFileHeaderLen changes the length of the header at the beginning of each data file
+// skipped by all the channels of the topic, and the new created channel will use it as well.
+// It should be set only for the topic whose data files are written by the external writer,
+// the files written by nsqd have no header.
+func (t *Topic) SetQueueFileHeaderLen(headerLen int64) error {
+	if headerLen < 0 {
+		return ErrInvalidFileHeaderLen
+	}
+	if t.backend == nil {
+		return ErrOperationInvalidState
+	}
+	atomic.StoreInt64(&t.queueFileHeaderLen, headerLen)
+	t.channelLock.RLock()
+	for _, ch := range t.channelMap {
+		ch.SetFileHeaderLen(headerLen)
+	}
+	t.channelLock.RUnlock()
+	nsqLog.Logf("topic %v queue file header length changed to %v", t.GetFullName(), headerLen)
+	return nil
+}
+
+func (t *Topic) getChannelSyncPolicy() (int64, time.Duration) {
+	policy := t.GetSyncPolicy()
+	syncEvery := policy.SyncEvery
+	if syncEvery <= 0 {
+		// channel no need sync so much.
+		syncEvery = t.option.SyncEvery * 1000
+	}
+	if syncEvery < 1 {
+		syncEvery = 1
+	}
+	syncTimeout := policy.SyncTimeout
+	if syncTimeout <= 0 {
+		syncTimeout = t.option.SyncTimeout
+	}
+	return syncEvery, syncTimeout
+}
+
 func (t *Topic) nextMsgID() MessageID {
 	id := uint64(0)
 	if t.msgIDCursor != nil {
@@ -665,18 +910,31 @@ func (t *Topic) GetTopicPart() int {
 
 // GetChannel performs a thread safe operation
 // to return a pointer to a Channel object (potentially new)
-// for the given Topic
+// for the given Topic, nil is returned if the new channel failed to load.
 func (t *Topic) GetChannel(channelName string) *Channel {
+	channel, err := t.GetOrCreateChannel(channelName)
+	if err != nil {
+		return nil
+	}
+	return channel
+}
+
+// GetOrCreateChannel is the same as GetChannel, but the error is returned if the new
+// channel failed to load.
+func (t *Topic) GetOrCreateChannel(channelName string) (*Channel, error) {
 	t.channelLock.Lock()
-	channel, isNew := t.getOrCreateChannel(channelName)
+	channel, isNew, err := t.getOrCreateChannel(channelName)
 	t.channelLock.Unlock()
+	if err != nil {
+		return nil, err
+	}
 
 	if isNew {
 		// update messagePump state
 		t.NotifyReloadChannels()
 	}
 
-	return channel
+	return channel, nil
 }
 
 func (t *Topic) NotifyReloadChannels() {
@@ -695,13 +953,13 @@ func (t *Topic) GetTopicChannelDebugStat(channelName string) string {
 }
 
 // this expects the caller to handle locking
-func (t *Topic) getOrCreateChannel(channelName string) (*Channel, bool) {
+func (t *Topic) getOrCreateChannel(channelName string) (*Channel, bool, error) {
 	channel, ok := t.channelMap[channelName]
 	if !ok {
 		deleteCallback := func(c *Channel) {
 			t.DeleteExistingChannel(c.name)
 		}
-		readEnd := t.backend.GetQueueReadEnd()
+		readEnd := t.writer.GetQueueReadEnd()
 		curCommit := t.GetCommitted()
 		if curCommit != nil && readEnd.Offset() > curCommit.Offset() {
 			if nsqLog.Level() >= levellogger.LOG_DEBUG {
@@ -716,21 +974,33 @@ func (t *Topic) getOrCreateChannel(channelName string) (*Channel, bool) {
 		} else {
 			ext = 0
 		}
-		channel = NewChannel(t.GetTopicName(), t.GetTopicPart(), channelName, readEnd,
-			t.option, deleteCallback, atomic.LoadInt32(&t.writeDisabled),
-			t.nsqdNotify, ext)
+		var err error
+		channel, err = newChannelWithQueue(t.GetTopicName(), t.GetTopicPart(), channelName, readEnd,
+			t.getQueueDataPath(), t.getColdDataPath(), t.option, deleteCallback, atomic.LoadInt32(&t.writeDisabled),
+			t.nsqdNotify, ext, t.memQueue)
+		if err != nil {
+			nsqLog.LogErrorf("TOPIC(%s): failed to create channel(%s): %v", t.GetFullName(), channelName, err)
+			return nil, false, err
+		}
 
-		channel.UpdateQueueEnd(readEnd, false)
+		channel.SetSyncPolicy(t.getChannelSyncPolicy())
+		channel.SetFileHeaderLen(atomic.LoadInt64(&t.queueFileHeaderLen))
+		channel.SetOffsetBase(t.GetOffsetBase())
+		err = channel.UpdateQueueEnd(readEnd, false)
+		if err != nil {
+			nsqLog.LogWarningf("TOPIC(%s): failed to update new channel(%s) end: %v", t.GetFullName(), channelName, err)
+		}
 		channel.SetDelayedQueue(t.GetDelayedQueue())
 		if t.IsWriteDisabled() {
 			channel.DisableConsume(true)
 		}
 		t.channelMap[channelName] = channel
+		atomic.AddInt64(&t.channelCreatedCnt, 1)
 		nsqLog.Logf("TOPIC(%s): new channel(%s), end: %v", t.GetFullName(),
 			channel.name, channel.GetChannelEnd())
-		return channel, true
+		return channel, true, nil
 	}
-	return channel, false
+	return channel, false, nil
 }
 
 func (t *Topic) GetExistingChannel(channelName string) (*Channel, error) {
@@ -761,6 +1031,7 @@ func (t *Topic) CloseExistingChannel(channelName string, deleteData bool) error
 	// (so that we dont leave any messages around)
 	if deleteData {
 		channel.Delete()
+		atomic.AddInt64(&t.channelDeletedCnt, 1)
 	} else {
 		channel.Close()
 	}
@@ -778,9 +1049,9 @@ func (t *Topic) DeleteExistingChannel(channelName string) error {
 }
 
 func (t *Topic) RollbackNoLock(vend BackendOffset, diffCnt uint64) error {
-	old := t.backend.GetQueueWriteEnd()
+	old := t.writer.GetQueueWriteEnd()
 	nsqLog.Logf("reset the backend from %v to : %v, %v", old, vend, diffCnt)
-	dend, err := t.backend.RollbackWriteV2(vend, diffCnt)
+	dend, err := t.writer.RollbackWriteV2(vend, diffCnt)
 	if err == nil {
 		t.UpdateCommittedOffset(&dend)
 		t.updateChannelsEnd(true)
@@ -789,12 +1060,12 @@ func (t *Topic) RollbackNoLock(vend BackendOffset, diffCnt uint64) error {
 }
 
 func (t *Topic) ResetBackendEndNoLock(vend BackendOffset, totalCnt int64) error {
-	old := t.backend.GetQueueWriteEnd()
+	old := t.writer.GetQueueWriteEnd()
 	if old.Offset() == vend && old.TotalMsgCnt() == totalCnt {
 		return nil
 	}
 	nsqLog.Logf("topic %v reset the backend from %v to : %v, %v", t.GetFullName(), old, vend, totalCnt)
-	dend, err := t.backend.ResetWriteEndV2(vend, totalCnt)
+	dend, err := t.writer.ResetWriteEndV2(vend, totalCnt)
 	if err != nil {
 		nsqLog.LogErrorf("reset backend to %v error: %v", vend, err)
 	} else {
@@ -850,7 +1121,7 @@ func (t *Topic) flushForChannels() {
 	if needFlush {
 		// flush buffer only to allow the channel read recent write
 		// no need sync to disk, since sync is heavy IO.
-		t.backend.FlushBuffer()
+		t.writer.FlushBuffer()
 		t.updateChannelsEnd(false)
 	}
 }
@@ -859,12 +1130,12 @@ func (t *Topic) PutRawDataOnReplica(rawData []byte, offset BackendOffset, checkS
 	if atomic.LoadInt32(&t.exitFlag) == 1 {
 		return nil, ErrExiting
 	}
-	wend := t.backend.GetQueueWriteEnd()
+	wend := t.writer.GetQueueWriteEnd()
 	if wend.Offset() != offset {
 		nsqLog.LogErrorf("topic %v: write offset mismatch: %v, %v", t.GetFullName(), offset, wend)
 		return nil, ErrWriteOffsetMismatch
 	}
-	_, writeBytes, dend, err := t.backend.PutRawV2(rawData, msgNum)
+	_, writeBytes, dend, err := t.writer.PutRawV2(rawData, msgNum)
 	if err != nil {
 		nsqLog.LogErrorf("topic %v: write to disk error: %v, %v", t.GetFullName(), offset, err.Error())
 		return &dend, err
@@ -885,7 +1156,7 @@ func (t *Topic) PutMessageOnReplica(m *Message, offset BackendOffset, checkSize
 	if atomic.LoadInt32(&t.exitFlag) == 1 {
 		return nil, ErrExiting
 	}
-	wend := t.backend.GetQueueWriteEnd()
+	wend := t.writer.GetQueueWriteEnd()
 	if wend.Offset() != offset {
 		nsqLog.LogErrorf("topic %v: write offset mismatch: %v, %v", t.GetFullName(), offset, wend)
 		return nil, ErrWriteOffsetMismatch
@@ -902,7 +1173,7 @@ func (t *Topic) PutMessagesOnReplica(msgs []*Message, offset BackendOffset, chec
 		return nil, ErrExiting
 	}
 
-	wend := t.backend.GetQueueWriteEnd()
+	wend := t.writer.GetQueueWriteEnd()
 	if wend.Offset() != offset {
 		nsqLog.LogErrorf(
 			"TOPIC(%s) : write message offset mismatch %v, %v",
@@ -935,7 +1206,7 @@ func (t *Topic) PutMessagesNoLock(msgs []*Message) (MessageID, BackendOffset, in
 		return 0, 0, 0, 0, nil, ErrExiting
 	}
 
-	wend := t.backend.GetQueueWriteEnd()
+	wend := t.writer.GetQueueWriteEnd()
 	firstMsgID := MessageID(0)
 	firstOffset := BackendOffset(-1)
 	firstCnt := int64(0)
@@ -975,7 +1246,7 @@ func (t *Topic) put(m *Message, trace bool, checkSize int64) (MessageID, Backend
 	if m.ID <= 0 {
 		m.ID = t.nextMsgID()
 	}
-	offset, writeBytes, dend, err := writeMessageToBackendWithCheck(t.IsExt(), &t.putBuffer, m, checkSize, t.backend)
+	offset, writeBytes, dend, err := writeMessageToBackendWithCheck(t.IsExt(), &t.putBuffer, m, checkSize, t.writer)
 	atomic.StoreInt32(&t.needFlush, 1)
 	if err != nil {
 		nsqLog.LogErrorf(
@@ -1000,7 +1271,7 @@ func (t *Topic) put(m *Message, trace bool, checkSize int64) (MessageID, Backend
 
 func (t *Topic) updateChannelsEnd(forceReload bool) {
 	s := time.Now()
-	e := t.backend.GetQueueReadEnd()
+	e := t.writer.GetQueueReadEnd()
 	curCommit := t.GetCommitted()
 	// if not committed, we need wait to notify channel.
 	if curCommit != nil && e.Offset() > curCommit.Offset() {
@@ -1037,15 +1308,23 @@ func (t *Topic) updateChannelsEnd(forceReload bool) {
 }
 
 func (t *Topic) TotalMessageCnt() uint64 {
-	return uint64(t.backend.GetQueueWriteEnd().TotalMsgCnt())
+	return uint64(t.writer.GetQueueWriteEnd().TotalMsgCnt())
 }
 
 func (t *Topic) GetQueueReadStart() int64 {
-	return int64(t.backend.GetQueueReadStart().Offset())
+	return int64(t.writer.GetQueueReadStart().Offset())
+}
+
+func (t *Topic) GetBackendType() string {
+	return t.writer.BackendType()
+}
+
+func (t *Topic) IsDiskBacked() bool {
+	return t.GetBackendType() == BackendTypeDisk
 }
 
 func (t *Topic) TotalDataSize() int64 {
-	e := t.backend.GetQueueWriteEnd()
+	e := t.writer.GetQueueWriteEnd()
 	if e == nil {
 		return 0
 	}
@@ -1086,6 +1365,7 @@ func (t *Topic) exit(deleted bool) error {
 		for _, channel := range t.channelMap {
 			delete(t.channelMap, channel.name)
 			channel.Delete()
+			atomic.AddInt64(&t.channelDeletedCnt, 1)
 		}
 		t.channelLock.Unlock()
 
@@ -1097,7 +1377,9 @@ func (t *Topic) exit(deleted bool) error {
 		t.removeHistoryStat()
 		t.RemoveChannelMeta()
 		t.removeMagicCode()
-		return t.backend.Delete()
+		err := t.writer.Delete()
+		t.removeQueueDataPath()
+		return err
 	}
 
 	// write anything leftover to disk
@@ -1119,7 +1401,7 @@ func (t *Topic) exit(deleted bool) error {
 	if t.GetDelayedQueue() != nil {
 		t.GetDelayedQueue().Close()
 	}
-	return t.backend.Close()
+	return t.writer.Close()
 }
 
 func (t *Topic) IsWriteDisabled() bool {
@@ -1129,7 +1411,7 @@ func (t *Topic) IsWriteDisabled() bool {
 func (t *Topic) DisableForSlave() {
 	atomic.StoreInt32(&t.writeDisabled, 1)
 	nsqLog.Logf("[TRACE_DATA] while disable topic %v end: %v, cnt: %v, queue start: %v", t.GetFullName(),
-		t.TotalDataSize(), t.TotalMessageCnt(), t.backend.GetQueueReadStart())
+		t.TotalDataSize(), t.TotalMessageCnt(), t.writer.GetQueueReadStart())
 	t.channelLock.RLock()
 	for _, c := range t.channelMap {
 		c.DisableConsume(true)
@@ -1168,12 +1450,12 @@ func (t *Topic) EnableForMaster() {
 
 func (t *Topic) Empty() error {
 	nsqLog.Logf("TOPIC(%s): empty", t.GetFullName())
-	return t.backend.Empty()
+	return t.writer.Empty()
 }
 
 func (t *Topic) ForceFlush() {
 	if nsqLog.Level() >= levellogger.LOG_DETAIL {
-		e := t.backend.GetQueueReadEnd()
+		e := t.writer.GetQueueReadEnd()
 		curCommit := t.GetCommitted()
 		nsqLog.Logf("topic %v, end to commit: %v, read end: %v", t.fullName, curCommit, e)
 	}
@@ -1208,8 +1490,8 @@ func (t *Topic) flush(notifyChan bool) error {
 		}
 		return nil
 	}
-	atomic.StoreInt64(&t.lastSyncCnt, t.backend.GetQueueWriteEnd().TotalMsgCnt())
-	err := t.backend.Flush()
+	atomic.StoreInt64(&t.lastSyncCnt, t.writer.GetQueueWriteEnd().TotalMsgCnt())
+	err := t.writer.Flush()
 	if err != nil {
 		nsqLog.LogErrorf("failed flush: %v", err)
 		return err
@@ -1222,7 +1504,7 @@ func (t *Topic) flush(notifyChan bool) error {
 }
 
 func (t *Topic) PrintCurrentStats() {
-	nsqLog.Logf("topic(%s) status: write end %v", t.GetFullName(), t.backend.GetQueueWriteEnd())
+	nsqLog.Logf("topic(%s) status: write end %v", t.GetFullName(), t.writer.GetQueueWriteEnd())
 	t.channelLock.RLock()
 	for _, ch := range t.channelMap {
 		nsqLog.Logf("channel(%s) depth: %v, confirmed: %v, debug: %v", ch.GetName(), ch.Depth(),
@@ -1253,17 +1535,159 @@ func (t *Topic) AggregateChannelE2eProcessingLatency() *quantile.Quantile {
 	return latencyStream
 }
 
+// BacklogStats aggregates the backlog of all the channels, the channels and the committed end
+// are read under the channel lock, so all the channels are compared with the same end.
+func (t *Topic) BacklogStats() TopicBacklogStats {
+	var stats TopicBacklogStats
+	t.channelLock.RLock()
+	defer t.channelLock.RUnlock()
+	committed := t.GetCommitted()
+	for name, c := range t.channelMap {
+		depth := c.Depth()
+		var lag int64
+		if committed != nil {
+			lag = int64(committed.Offset() - c.GetConfirmed().Offset())
+			if lag < 0 {
+				lag = 0
+			}
+		}
+		if stats.ChannelNum == 0 || depth < stats.MinDepth {
+			stats.MinDepth = depth
+		}
+		if depth > stats.MaxDepth {
+			stats.MaxDepth = depth
+		}
+		if stats.ChannelNum == 0 || lag < stats.MinConfirmLag {
+			stats.MinConfirmLag = lag
+		}
+		if stats.ChannelNum == 0 || lag > stats.MaxConfirmLag {
+			stats.MaxConfirmLag = lag
+			stats.MaxLagChannel = name
+		}
+		stats.TotalDepth += depth
+		stats.TotalConfirmLag += lag
+		stats.ChannelNum++
+	}
+	return stats
+}
+
+// TryMoveColdData moves the data files consumed by all the channels and
+// older than the cold data age to the cold data path.
+func (t *Topic) TryMoveColdData() (int, error) {
+	if t.option.ColdDataPath == "" || t.backend == nil {
+		return 0, nil
+	}
+	var oldestFileNum int64
+	hasChannel := false
+	t.channelLock.RLock()
+	for _, ch := range t.channelMap {
+		pos, ok := ch.GetConfirmed().(*diskQueueEndInfo)
+		if !ok {
+			continue
+		}
+		if !hasChannel || oldestFileNum > pos.EndOffset.FileNum {
+			oldestFileNum = pos.EndOffset.FileNum
+		}
+		hasChannel = true
+	}
+	t.channelLock.RUnlock()
+	if !hasChannel {
+		return 0, nil
+	}
+	return t.backend.MoveToColdTier(oldestFileNum, time.Now().Add(-1*t.option.ColdDataAge))
+}
+
+// ScrubNextFile verifies the checksum of the next data file confirmed by all the channels
+// but still retained, only one file is verified each time to limit the disk reads. It returns
+// false if no more file to verify, and the scrub will start over from the oldest file next time.
+func (t *Topic) ScrubNextFile() (bool, error) {
+	files, err := t.GetQueueFiles()
+	if err != nil {
+		return false, err
+	}
+	next := atomic.LoadInt64(&t.scrubFileNum)
+	for _, f := range files {
+		if f.FileNum < next || !f.Confirmed {
+			continue
+		}
+		metaBase := t.backend.fileName(f.FileNum)
+		if _, err := os.Stat(getQueueFileChecksumName(metaBase)); err != nil {
+			// finished before the checksum enabled or still being written
+			continue
+		}
+		atomic.StoreInt64(&t.scrubFileNum, f.FileNum+1)
+		err = verifyQueueFileChecksum(metaBase, f.Path)
+		if err == ErrDataFileChecksumMismatch {
+			atomic.AddInt64(&t.scrubMismatchCnt, 1)
+			nsqLog.LogErrorf("topic %v data file %v corrupted while scrubbing", t.GetFullName(), f.Path)
+		}
+		return true, err
+	}
+	atomic.StoreInt64(&t.scrubFileNum, 0)
+	return false, nil
+}
+
+func (t *Topic) GetScrubMismatchCount() int64 {
+	return atomic.LoadInt64(&t.scrubMismatchCnt)
+}
+
+// GetQueueFiles returns the data files of the topic, the file is confirmed
+// if all the channels have consumed it.
+func (t *Topic) GetQueueFiles() ([]QueueFileInfo, error) {
+	if t.backend == nil {
+		return nil, nil
+	}
+	files, err := t.backend.Files()
+	if err != nil {
+		return nil, err
+	}
+	var minConfirmed BackendOffset
+	hasChannel := false
+	t.channelLock.RLock()
+	for _, ch := range t.channelMap {
+		confirmed := ch.GetConfirmed().Offset()
+		if !hasChannel || minConfirmed > confirmed {
+			minConfirmed = confirmed
+		}
+		hasChannel = true
+	}
+	t.channelLock.RUnlock()
+	for i := range files {
+		files[i].Confirmed = hasChannel && files[i].EndOffset <= minConfirmed
+	}
+	return files, nil
+}
+
 // maybe should return the cleaned offset to allow commit log clean
 func (t *Topic) TryCleanOldData(retentionSize int64, noRealClean bool, maxCleanOffset BackendOffset) (BackendQueueEnd, error) {
+	if t.backend == nil {
+		// the memory queue removes the data once confirmed by all the channels
+		return nil, nil
+	}
 	// clean the data that has been consumed and keep the retention policy
 	var oldestPos BackendQueueEnd
+	// the data in the rewind retention of the channels should be kept
+	var holdOffset BackendOffset
+	// the data written after the hold time is kept for the longest retention of the channels
+	var holdTime int64
+	now := time.Now()
 	t.channelLock.RLock()
 	for _, ch := range t.channelMap {
 		pos := ch.GetConfirmed()
+		hold := ch.getRetentionHoldOffset()
+		if ht := ch.getRetentionHoldTime(now); ht > 0 && (holdTime == 0 || ht < holdTime) {
+			holdTime = ht
+		}
 		if oldestPos == nil {
 			oldestPos = pos
-		} else if oldestPos.Offset() > pos.Offset() {
-			oldestPos = pos
+			holdOffset = hold
+		} else {
+			if oldestPos.Offset() > pos.Offset() {
+				oldestPos = pos
+			}
+			if holdOffset > hold {
+				holdOffset = hold
+			}
 		}
 	}
 	t.channelLock.RUnlock()
@@ -1271,17 +1695,17 @@ func (t *Topic) TryCleanOldData(retentionSize int64, noRealClean bool, maxCleanO
 		nsqLog.Logf("no consume position found")
 		return nil, nil
 	}
-	cleanStart := t.backend.GetQueueReadStart()
-	nsqLog.Logf("clean topic %v data current start: %v, oldest confirmed %v, max clean end: %v",
-		t.GetFullName(), cleanStart, oldestPos, maxCleanOffset)
-	if cleanStart.Offset()+BackendOffset(retentionSize) >= oldestPos.Offset() {
+	cleanStart := t.writer.GetQueueReadStart()
+	nsqLog.Logf("clean topic %v data current start: %v, oldest confirmed %v, hold: %v, max clean end: %v",
+		t.GetFullName(), cleanStart, oldestPos, holdOffset, maxCleanOffset)
+	if cleanStart.Offset()+BackendOffset(retentionSize) >= holdOffset {
 		return nil, nil
 	}
 
-	if oldestPos.Offset() < maxCleanOffset || maxCleanOffset == BackendOffset(0) {
-		maxCleanOffset = oldestPos.Offset()
+	if holdOffset < maxCleanOffset || maxCleanOffset == BackendOffset(0) {
+		maxCleanOffset = holdOffset
 	}
-	snapReader := NewDiskQueueSnapshot(getBackendName(t.tname, t.partition), t.dataPath, oldestPos)
+	snapReader := t.newDiskQueueSnapshot(oldestPos)
 	snapReader.SetQueueStart(cleanStart)
 	err := snapReader.SeekTo(cleanStart.Offset())
 	if err != nil {
@@ -1301,6 +1725,9 @@ func (t *Topic) TryCleanOldData(retentionSize int64, noRealClean bool, maxCleanO
 	}
 	cleanTime := time.Now().Add(-1 * time.Hour * 24 * time.Duration(retentionDay))
 	t.Unlock()
+	if holdTime > 0 && holdTime < cleanTime.UnixNano() {
+		cleanTime = time.Unix(0, holdTime)
+	}
 	for {
 		if retentionSize > 0 {
 			// clean data ignore the retention day
@@ -1308,6 +1735,15 @@ func (t *Topic) TryCleanOldData(retentionSize int64, noRealClean bool, maxCleanO
 			if data.Offset > maxCleanOffset-BackendOffset(retentionSize) {
 				break
 			}
+			// but the retention of the channels should be kept
+			if holdTime > 0 {
+				msg, decodeErr := decodeMessage(data.Data, t.IsExt())
+				if decodeErr != nil {
+					nsqLog.LogErrorf("failed to decode message - %s - %v", decodeErr, data)
+				} else if msg.Timestamp >= holdTime {
+					break
+				}
+			}
 			cleanEndInfo = readInfo
 		} else {
 			msg, decodeErr := decodeMessage(data.Data, t.IsExt())
@@ -1356,21 +1792,24 @@ func (t *Topic) ResetBackendWithQueueStartNoLock(queueStartOffset int64, queueSt
 	if queueStartOffset < 0 || queueStartCnt < 0 {
 		return errors.New("queue start should not less than 0")
 	}
-	queueStart := t.backend.GetQueueWriteEnd().(*diskQueueEndInfo)
+	queueStart := t.writer.GetQueueWriteEnd().(*diskQueueEndInfo)
 	queueStart.virtualEnd = BackendOffset(queueStartOffset)
 	queueStart.totalMsgCnt = queueStartCnt
 	nsqLog.Warningf("reset the topic %v backend with queue start: %v", t.GetFullName(), queueStart)
-	err := t.backend.ResetWriteWithQueueStart(queueStart)
+	err := t.writer.ResetWriteWithQueueStart(queueStart)
 	if err != nil {
 		return err
 	}
-	newEnd := t.backend.GetQueueReadEnd()
+	newEnd := t.writer.GetQueueReadEnd()
 	t.UpdateCommittedOffset(newEnd)
 
 	t.channelLock.Lock()
 	for _, ch := range t.channelMap {
 		nsqLog.Infof("channel stats: %v", ch.GetChannelDebugStats())
-		ch.UpdateQueueEnd(newEnd, true)
+		err := ch.UpdateQueueEnd(newEnd, true)
+		if err != nil && err != ErrExiting {
+			nsqLog.LogWarningf("failed to update channel %v end %v after reset: %v", ch.GetName(), newEnd, err)
+		}
 		ch.ConfirmBackendQueueOnSlave(newEnd.Offset(), newEnd.TotalMsgCnt(), true)
 	}
 	t.channelLock.Unlock()
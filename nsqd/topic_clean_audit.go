@@ -0,0 +1,56 @@
+package nsqd
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// LostConfirmRange is the data removed by the clean before the channel confirmed it.
+type LostConfirmRange struct {
+	Channel string
+	Start   BackendOffset
+	End     BackendOffset
+	Ts      int64
+}
+
+// the whole range removed by the clean should be confirmed by all the channels, otherwise
+// the unconfirmed messages are lost without delivery.
+func (t *Topic) auditCleanedData(start BackendOffset, end BackendOffset) {
+	var lost []LostConfirmRange
+	t.channelLock.RLock()
+	for name, ch := range t.channelMap {
+		confirmed := ch.GetConfirmed().Offset()
+		if confirmed >= end {
+			continue
+		}
+		r := LostConfirmRange{Channel: name, Start: confirmed, End: end, Ts: time.Now().UnixNano()}
+		if r.Start < start {
+			r.Start = start
+		}
+		lost = append(lost, r)
+	}
+	t.channelLock.RUnlock()
+	if len(lost) == 0 {
+		return
+	}
+	for _, r := range lost {
+		nsqLog.LogErrorf("topic %v channel %v unconfirmed data [%v, %v) removed by the clean",
+			t.GetFullName(), r.Channel, r.Start, r.End)
+	}
+	atomic.AddInt64(&t.lostConfirmCnt, int64(len(lost)))
+	t.lostConfirmLock.Lock()
+	t.lastLostRange = lost[len(lost)-1]
+	t.lostConfirmLock.Unlock()
+}
+
+// GetLostConfirmCount returns the times of the unconfirmed data removed by the clean.
+func (t *Topic) GetLostConfirmCount() int64 {
+	return atomic.LoadInt64(&t.lostConfirmCnt)
+}
+
+// GetLastLostConfirmRange returns the latest range of the unconfirmed data removed.
+func (t *Topic) GetLastLostConfirmRange() LostConfirmRange {
+	t.lostConfirmLock.Lock()
+	defer t.lostConfirmLock.Unlock()
+	return t.lastLostRange
+}
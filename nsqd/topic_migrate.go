@@ -0,0 +1,75 @@
+package nsqd
+
+import (
+	"os"
+	"sync/atomic"
+)
+
+// MigrateQueueTo moves the queue data of the topic partition to the new path without changing
+// the positions of the writer and the channels, the writes and the channel creations are blocked
+// while migrating. The data files are copied and verified before the writer and the channel
+// readers switch to the new path, and the new path is persisted for the restart at last. The
+// metas and the data files in the old path are removed only after all switched, so the topic is
+// restarted from the old path if crashed while migrating.
+func (t *Topic) MigrateQueueTo(newPath string) error {
+	if t.backend == nil {
+		return ErrOperationInvalidState
+	}
+	t.Lock()
+	defer t.Unlock()
+	if atomic.LoadInt32(&t.exitFlag) == 1 {
+		return ErrExiting
+	}
+	oldPath := t.getQueueDataPath()
+	if newPath == oldPath {
+		return nil
+	}
+	err := os.MkdirAll(newPath, 0755)
+	if err != nil {
+		return err
+	}
+	t.channelLock.RLock()
+	defer t.channelLock.RUnlock()
+	copied, err := t.backend.migrateTo(newPath)
+	if err != nil {
+		nsqLog.LogErrorf("topic(%v) failed to migrate the queue data to %v: %v", t.GetFullName(), newPath, err)
+		return err
+	}
+	var migrated []*diskQueueReader
+	var oldMetas []string
+	abort := func() {
+		for _, r := range migrated {
+			r.abortMigrate(oldPath)
+		}
+		t.backend.abortMigrate(oldPath, copied)
+	}
+	for _, ch := range t.channelMap {
+		r, ok := ch.backend.(*diskQueueReader)
+		if !ok {
+			continue
+		}
+		metas, err := r.migrateTo(newPath)
+		if err != nil {
+			nsqLog.LogErrorf("topic(%v) failed to migrate the channel %v to %v: %v",
+				t.GetFullName(), ch.GetName(), newPath, err)
+			abort()
+			return err
+		}
+		migrated = append(migrated, r)
+		oldMetas = append(oldMetas, metas...)
+	}
+	err = saveQueueDataPath(t.dataPath, t.partition, newPath)
+	if err != nil {
+		nsqLog.LogErrorf("topic(%v) failed to save the queue data path %v: %v", t.GetFullName(), newPath, err)
+		abort()
+		return err
+	}
+	t.queuePath.Store(newPath)
+	for _, fName := range oldMetas {
+		os.Remove(fName)
+	}
+	t.backend.removeMigratedFrom(oldPath)
+	nsqLog.Logf("topic(%v) migrated the queue data from %v to %v, channels: %v",
+		t.GetFullName(), oldPath, newPath, len(migrated))
+	return nil
+}
@@ -0,0 +1,97 @@
+package nsqd
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrPubRateLimited = errors.New("topic pub rate exceeded")
+
+const pubRateWindow = int64(time.Second)
+
+// pubRateLimiter counts the messages and bytes published in each second window, the pub
+// exceeding the limits in the current window is rejected. The rates of the last window
+// are kept for the stats.
+type pubRateLimiter struct {
+	sync.Mutex
+	windowStart   int64
+	msgCnt        int64
+	bytesSize     int64
+	lastMsgRate   int64
+	lastBytesRate int64
+}
+
+func (l *pubRateLimiter) rollWindow(now int64) {
+	elapsed := now - l.windowStart
+	if elapsed < pubRateWindow {
+		return
+	}
+	if elapsed < 2*pubRateWindow {
+		l.lastMsgRate = l.msgCnt
+		l.lastBytesRate = l.bytesSize
+	} else {
+		l.lastMsgRate = 0
+		l.lastBytesRate = 0
+	}
+	l.windowStart = now - elapsed%pubRateWindow
+	l.msgCnt = 0
+	l.bytesSize = 0
+}
+
+// admit the pub if it is under the limits, the first pub in the window is always admitted
+// so the batch larger than the limits will not be rejected forever.
+func (l *pubRateLimiter) admit(now int64, msgLimit int64, bytesLimit int64, msgs int64, size int64) bool {
+	l.Lock()
+	defer l.Unlock()
+	l.rollWindow(now)
+	if l.msgCnt > 0 {
+		if msgLimit > 0 && l.msgCnt+msgs > msgLimit {
+			return false
+		}
+		if bytesLimit > 0 && l.bytesSize+size > bytesLimit {
+			return false
+		}
+	}
+	l.msgCnt += msgs
+	l.bytesSize += size
+	return true
+}
+
+func (l *pubRateLimiter) rates(now int64) (int64, int64) {
+	l.Lock()
+	defer l.Unlock()
+	l.rollWindow(now)
+	return l.lastMsgRate, l.lastBytesRate
+}
+
+// GetPubRateLimits returns the pub limits of messages and bytes per second, the topic meta
+// overrides the node options.
+func (t *Topic) GetPubRateLimits() (int64, int64) {
+	msgLimit := atomic.LoadInt64(&t.dynamicConf.PubRateLimit)
+	if msgLimit == 0 {
+		msgLimit = t.option.PubRateLimit
+	}
+	bytesLimit := atomic.LoadInt64(&t.dynamicConf.PubBytesRateLimit)
+	if bytesLimit == 0 {
+		bytesLimit = t.option.PubBytesRateLimit
+	}
+	return msgLimit, bytesLimit
+}
+
+// AdmitPub checks the pub of the messages against the rate limits, ErrPubRateLimited is
+// returned if exceeded and the client can retry later.
+func (t *Topic) AdmitPub(msgCnt int, size int64) error {
+	// the pub is counted for the ingress rate even if no limits
+	msgLimit, bytesLimit := t.GetPubRateLimits()
+	if !t.pubLimiter.admit(time.Now().UnixNano(), msgLimit, bytesLimit, int64(msgCnt), size) {
+		return ErrPubRateLimited
+	}
+	return nil
+}
+
+// GetPubRates returns the messages and bytes published in the last second.
+func (t *Topic) GetPubRates() (int64, int64) {
+	return t.pubLimiter.rates(time.Now().UnixNano())
+}
@@ -2,11 +2,14 @@ package nsqd
 
 import (
 	"errors"
+	"fmt"
+	"io/ioutil"
 	"os"
 	//"runtime"
 	"path"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -291,6 +294,195 @@ func TestTopicPutChannelWait(t *testing.T) {
 	test.Equal(t, topic.backend.GetQueueReadEnd(), channel.GetChannelEnd())
 }
 
+func getReaderMetaConfirmedCnt(t *testing.T, ch *Channel) int64 {
+	f, err := os.Open(ch.backend.(*diskQueueReader).metaDataFileName(true))
+	if os.IsNotExist(err) {
+		return 0
+	}
+	test.Nil(t, err)
+	defer f.Close()
+	var cnt int64
+	_, err = fmt.Fscanf(f, "%d\n", &cnt)
+	test.Nil(t, err)
+	return cnt
+}
+
+func TestTopicChannelSyncPolicy(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	// avoid the periodic flush sync the channel meta
+	opts.SyncTimeout = time.Minute
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic1 := nsqd.GetTopic("test_sync_policy1", 0)
+	topic2 := nsqd.GetTopic("test_sync_policy2", 0)
+	topic1.SetSyncPolicy(TopicSyncPolicy{SyncEvery: 1})
+	ch1 := topic1.GetChannel("ch")
+	ch2 := topic2.GetChannel("ch")
+	// runtime update should apply to the existing channel
+	topic2.SetSyncPolicy(TopicSyncPolicy{SyncEvery: 3})
+	syncEvery, syncTimeout := ch1.backend.(*diskQueueReader).GetSyncPolicy()
+	test.Equal(t, int64(1), syncEvery)
+	// the node-wide sync timeout is used if not overridden
+	test.Equal(t, opts.SyncTimeout, syncTimeout)
+	syncEvery, syncTimeout = ch2.backend.(*diskQueueReader).GetSyncPolicy()
+	test.Equal(t, int64(3), syncEvery)
+	test.Equal(t, opts.SyncTimeout, syncTimeout)
+
+	for i := 0; i < 3; i++ {
+		topic1.PutMessage(NewMessage(0, []byte("test")))
+		topic2.PutMessage(NewMessage(0, []byte("test")))
+	}
+	topic1.flush(true)
+	topic2.flush(true)
+	for i := 0; i < 3; i++ {
+		for _, ch := range []*Channel{ch1, ch2} {
+			select {
+			case outMsg := <-ch.clientMsgChan:
+				ch.ConfirmBackendQueue(outMsg)
+			case <-time.After(time.Second):
+				t.Fatalf("should read message in channel")
+			}
+		}
+		test.Equal(t, int64(i+1), getReaderMetaConfirmedCnt(t, ch1))
+		if i < 2 {
+			test.Equal(t, int64(0), getReaderMetaConfirmedCnt(t, ch2))
+		} else {
+			test.Equal(t, int64(3), getReaderMetaConfirmedCnt(t, ch2))
+		}
+	}
+	test.Equal(t, TopicSyncPolicy{SyncEvery: 3}, topic2.GetSyncPolicy())
+}
+
+func TestTopicMoveColdData(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	opts.MaxBytesPerFile = 1024 * 10
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-cold-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	opts.ColdDataPath = tmpDir
+	opts.ColdDataAge = time.Millisecond
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("test_cold", 0)
+	channel := topic.GetChannel("ch")
+	msgNum := 100
+	for i := 0; i < msgNum; i++ {
+		topic.PutMessage(NewMessage(0, make([]byte, 1000)))
+	}
+	topic.ForceFlush()
+	fileNum := topic.backend.diskWriteEnd.EndOffset.FileNum
+	test.Equal(t, true, fileNum >= 8)
+
+	for i := 0; i < msgNum/2; i++ {
+		msg := <-channel.clientMsgChan
+		channel.ConfirmBackendQueue(msg)
+	}
+	confirmedFileNum := channel.GetConfirmed().(*diskQueueEndInfo).EndOffset.FileNum
+	test.Equal(t, true, confirmedFileNum >= 2)
+	time.Sleep(time.Millisecond * 10)
+	moved, err := topic.TryMoveColdData()
+	test.Nil(t, err)
+	test.Equal(t, int(confirmedFileNum), moved)
+	for i := int64(0); i < fileNum; i++ {
+		_, err := os.Stat(topic.backend.fileName(i))
+		coldFileName := path.Join(tmpDir, "test_cold", path.Base(topic.backend.fileName(i)))
+		_, coldErr := os.Stat(coldFileName)
+		if i < confirmedFileNum {
+			test.Equal(t, true, os.IsNotExist(err))
+			test.Nil(t, coldErr)
+			test.Equal(t, coldFileName, topic.backend.dataFileName(i))
+		} else {
+			test.Nil(t, err)
+			test.Equal(t, true, os.IsNotExist(coldErr))
+		}
+	}
+	// the consumed cold data can be read again transparently
+	snap := topic.GetDiskQueueSnapshot()
+	defer snap.Close()
+	err = snap.SeekTo(0)
+	test.Nil(t, err)
+	var readList []ReadResult
+	for i := 0; i < msgNum/2; i++ {
+		data := snap.ReadOne()
+		test.Nil(t, data.Err)
+		readList = append(readList, data)
+		err = snap.SkipToNext()
+		test.Nil(t, err)
+	}
+
+	reader, _ := newDiskQueueReader(getBackendName(topic.tname, topic.partition), "cold_reader", topic.dataPath,
+		opts.MaxBytesPerFile, int32(minValidMsgLength), int32(opts.MaxMsgSize)+minValidMsgLength,
+		1, opts.SyncTimeout, nil, true)
+	defer reader.Delete()
+	reader.UpdateQueueEnd(topic.backend.GetQueueReadEnd(), false)
+	data, hasData := reader.TryReadOne()
+	test.Equal(t, true, hasData)
+	test.Nil(t, data.Err)
+	test.Equal(t, readList[0].Offset, data.Offset)
+	// seek into the middle of the cold data
+	seekTo := readList[len(readList)/2]
+	_, err = reader.SkipReadToOffset(seekTo.Offset, seekTo.CurCnt-1)
+	test.Nil(t, err)
+	data, hasData = reader.TryReadOne()
+	test.Equal(t, true, hasData)
+	test.Nil(t, data.Err)
+	test.Equal(t, seekTo.Offset, data.Offset)
+	test.Equal(t, seekTo.Data, data.Data)
+
+	// the cold data should be cleaned
+	topic.TryCleanOldData(1, false, 0)
+	_, err = os.Stat(path.Join(tmpDir, "test_cold", path.Base(topic.backend.fileName(0))))
+	test.Equal(t, true, os.IsNotExist(err))
+}
+
+func TestTopicColdDataPathOpenMoved(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-cold-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	opts.ColdDataPath = tmpDir
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_cold_open"
+	coldPath := path.Join(tmpDir, topicName)
+	t0 := nsqd.GetTopic(topicName, 0)
+	ch := t0.GetChannel("ch")
+	test.Equal(t, coldPath, t0.backend.coldPath)
+	test.Equal(t, coldPath, ch.backend.(*diskQueueReader).coldPath)
+	test.Equal(t, coldPath, t0.GetDiskQueueSnapshot().coldPath)
+
+	// the file moved to cold after resolved should be opened from the cold path
+	hotPath := t0.getQueueDataPath()
+	fileName := GetQueueFileName(hotPath, "cold_race", 0)
+	coldFileName := GetQueueFileName(coldPath, "cold_race", 0)
+	err = os.MkdirAll(path.Dir(fileName), 0755)
+	test.Nil(t, err)
+	err = ioutil.WriteFile(fileName, []byte("data"), 0644)
+	test.Nil(t, err)
+	var opened []string
+	f, openedName, err := openResolvedQueueFile(hotPath, coldPath, "cold_race", 0, func(fn string) (*os.File, error) {
+		if len(opened) == 0 {
+			_, err := moveQueueFileToCold(hotPath, coldPath, "cold_race", 0, time.Now().Add(time.Hour))
+			test.Nil(t, err)
+		}
+		opened = append(opened, fn)
+		return os.Open(fn)
+	})
+	test.Nil(t, err)
+	defer f.Close()
+	test.Equal(t, []string{fileName, coldFileName}, opened)
+	test.Equal(t, coldFileName, openedName)
+}
+
 func TestTopicCleanOldDataByRetentionSize(t *testing.T) {
 	opts := NewOptions()
 	opts.Logger = newTestLogger(t)
@@ -364,6 +556,236 @@ func TestTopicCleanOldDataByRetentionSize(t *testing.T) {
 	}
 }
 
+func TestTopicCleanUnconfirmedDataAudited(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	opts.MaxBytesPerFile = 1024 * 1024
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("test", 0)
+	topic.dynamicConf.AutoCommit = 1
+	topic.dynamicConf.SyncEvery = 10
+	topic.dynamicConf.RetentionDay = 1
+
+	msgNum := 5000
+	channel := topic.GetChannel("ch")
+	test.NotNil(t, channel)
+	msg := NewMessage(0, make([]byte, 1000))
+	for i := 0; i <= msgNum; i++ {
+		msg.ID = 0
+		topic.PutMessage(msg)
+	}
+	topic.ForceFlush()
+	test.Equal(t, true, topic.backend.diskWriteEnd.EndOffset.FileNum >= 4)
+
+	for i := 0; i < msgNum/5; i++ {
+		msg := <-channel.clientMsgChan
+		channel.ConfirmBackendQueue(msg)
+	}
+	confirmed := channel.GetConfirmed()
+	test.Equal(t, true, confirmed.Offset() < BackendOffset(opts.MaxBytesPerFile*2))
+	// the clean limited by the confirmed is fine
+	topic.TryCleanOldData(1, false, 0)
+	test.Equal(t, int64(0), topic.GetLostConfirmCount())
+
+	// the clean without the max clean end removes the unconfirmed files
+	cleanEnd := &diskQueueEndInfo{EndOffset: diskQueueOffset{FileNum: 3}}
+	newStart, err := topic.backend.CleanOldDataByRetention(cleanEnd, false, 0)
+	test.Nil(t, err)
+	test.Equal(t, true, newStart.Offset() > confirmed.Offset())
+	test.Equal(t, int64(1), topic.GetLostConfirmCount())
+	lost := topic.GetLastLostConfirmRange()
+	test.Equal(t, "ch", lost.Channel)
+	test.Equal(t, confirmed.Offset(), lost.Start)
+	test.Equal(t, newStart.Offset(), lost.End)
+	test.Equal(t, int64(1), NewTopicStats(topic, nil).LostConfirmCount)
+}
+
+func TestTopicCleanOldDataKeepChannelRetention(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	opts.MaxBytesPerFile = 1024 * 1024
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("test", 0)
+	topic.dynamicConf.AutoCommit = 1
+	topic.dynamicConf.SyncEvery = 10
+	topic.dynamicConf.RetentionDay = 1
+
+	msgNum := 5000
+	realtime := topic.GetChannel("realtime")
+	audit := topic.GetChannel("audit")
+	audit.SetRetentionSeconds(3600)
+	msg := NewMessage(0, make([]byte, 1000))
+	for i := 0; i <= msgNum; i++ {
+		msg.ID = 0
+		topic.PutMessage(msg)
+	}
+	topic.ForceFlush()
+	test.Equal(t, true, topic.backend.diskWriteEnd.EndOffset.FileNum >= 4)
+
+	for _, ch := range []*Channel{realtime, audit} {
+		for i := 0; i < msgNum; i++ {
+			msg := <-ch.clientMsgChan
+			ch.ConfirmBackendQueue(msg)
+		}
+	}
+	oldStart := topic.backend.GetQueueReadStart()
+	// all the data is confirmed but written in the retention of the audit channel
+	topic.TryCleanOldData(1, false, 0)
+	test.Equal(t, oldStart, topic.backend.GetQueueReadStart())
+	stats := NewChannelStats(audit, nil)
+	test.Equal(t, int64(3600), stats.RetentionSeconds)
+	test.Equal(t, int64(oldStart.Offset()), stats.RetainedStart)
+	for _, meta := range topic.GetChannelMeta() {
+		if meta.Name == "audit" {
+			test.Equal(t, int64(3600), meta.RetentionSeconds)
+		} else {
+			test.Equal(t, int64(0), meta.RetentionSeconds)
+		}
+	}
+
+	// the data is cleaned after the longest retention expired
+	audit.SetRetentionSeconds(1)
+	time.Sleep(time.Second * 2)
+	topic.TryCleanOldData(1, false, 0)
+	start := topic.backend.GetQueueReadStart()
+	test.Equal(t, true, start.Offset() > oldStart.Offset())
+	test.Equal(t, int64(start.Offset()), NewChannelStats(realtime, nil).RetainedStart)
+}
+
+func TestTopicCleanOldDataKeepReaderSnapshot(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	opts.MaxBytesPerFile = 1024 * 1024
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("test", 0)
+	topic.dynamicConf.AutoCommit = 1
+	topic.dynamicConf.SyncEvery = 10
+	topic.dynamicConf.RetentionDay = 1
+
+	msgNum := 5000
+	channel := topic.GetChannel("ch")
+	msg := NewMessage(0, make([]byte, 1000))
+	for i := 0; i < msgNum; i++ {
+		msg.ID = 0
+		topic.PutMessage(msg)
+	}
+	topic.ForceFlush()
+	test.Equal(t, true, topic.backend.diskWriteEnd.EndOffset.FileNum >= 4)
+	for i := 0; i < msgNum/2; i++ {
+		msg := <-channel.clientMsgChan
+		channel.ConfirmBackendQueue(msg)
+	}
+
+	reader := channel.backend.(*diskQueueReader)
+	snap, err := reader.BeginSnapshot(true)
+	test.Nil(t, err)
+	oldStart := topic.backend.GetQueueReadStart()
+	test.Equal(t, oldStart.Offset(), snap.QueueStart.Offset())
+	test.Equal(t, channel.GetConfirmed(), snap.Confirmed)
+	test.Equal(t, topic.backend.GetQueueReadEnd().Offset(), snap.End.Offset())
+	test.Equal(t, true, len(snap.DataFiles) >= 5)
+	// the meta file is synced with the confirmed of the snapshot
+	metaReader, err := newDiskQueueReader(reader.readFrom, reader.readerMetaName, reader.dataPath,
+		opts.MaxBytesPerFile, 4, 1<<20, 1, time.Second, nil, false)
+	test.Nil(t, err)
+	test.Equal(t, snap.Confirmed.Offset(), metaReader.GetQueueConfirmed().Offset())
+
+	// more data is written and confirmed after the snapshot began
+	for i := 0; i < msgNum; i++ {
+		msg.ID = 0
+		topic.PutMessage(msg)
+	}
+	topic.ForceFlush()
+	for i := 0; i < msgNum/2+msgNum; i++ {
+		msg := <-channel.clientMsgChan
+		channel.ConfirmBackendQueue(msg)
+	}
+	topic.TryCleanOldData(1, false, 0)
+	test.Equal(t, oldStart, topic.backend.GetQueueReadStart())
+	for _, f := range snap.DataFiles {
+		_, err := os.Stat(f)
+		test.Nil(t, err)
+	}
+
+	test.Nil(t, reader.EndSnapshot(snap))
+	test.Equal(t, ErrSnapshotNotFound, reader.EndSnapshot(snap))
+	topic.TryCleanOldData(1, false, 0)
+	start := topic.backend.GetQueueReadStart()
+	test.Equal(t, true, start.Offset() > oldStart.Offset())
+	_, err = os.Stat(snap.DataFiles[0])
+	test.Equal(t, true, os.IsNotExist(err))
+}
+
+func TestTopicCleanOldDataKeepRewindRetention(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	opts.MaxBytesPerFile = 1024 * 1024
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("test", 0)
+	topic.dynamicConf.AutoCommit = 1
+	topic.dynamicConf.SyncEvery = 10
+	topic.dynamicConf.RetentionDay = 1
+
+	msgNum := 5000
+	channel := topic.GetChannel("ch")
+	test.NotNil(t, channel)
+	rewindSize := int64(1024 * 1024 * 2)
+	channel.SetRewindRetention(rewindSize)
+	msg := NewMessage(0, make([]byte, 1000))
+	for i := 0; i <= msgNum; i++ {
+		msg.ID = 0
+		topic.PutMessage(msg)
+	}
+	topic.ForceFlush()
+	test.Equal(t, true, topic.backend.diskWriteEnd.EndOffset.FileNum >= 4)
+
+	for i := 0; i < msgNum; i++ {
+		msg := <-channel.clientMsgChan
+		channel.ConfirmBackendQueue(msg)
+	}
+	confirmed := channel.GetConfirmed()
+	topic.TryCleanOldData(1, false, 0)
+	start := topic.backend.GetQueueReadStart()
+	test.Equal(t, true, start.(*diskQueueEndInfo).EndOffset.FileNum > 0)
+	// the confirmed data in the rewind window should be kept
+	test.Equal(t, true, int64(confirmed.Offset()-start.Offset()) >= rewindSize)
+	test.Equal(t, int64(confirmed.Offset()-start.Offset()), channel.GetRewindAvailable())
+	stats := NewChannelStats(channel, nil)
+	test.Equal(t, rewindSize, stats.RewindRetention)
+	test.Equal(t, channel.GetRewindAvailable(), stats.RewindAvailable)
+	for _, meta := range topic.GetChannelMeta() {
+		test.Equal(t, rewindSize, meta.RewindRetention)
+	}
+
+	// rewind to the oldest in the window and the confirmed data should be redelivered
+	err := channel.SetConsumeOffset(start.Offset(), start.TotalMsgCnt(), true)
+	test.Nil(t, err)
+	for {
+		select {
+		case outMsg := <-channel.clientMsgChan:
+			if outMsg.Offset != start.Offset() {
+				continue
+			}
+			test.Equal(t, 1000, len(outMsg.Body))
+		case <-time.After(time.Second * 3):
+			t.Fatalf("should redeliver the message at %v", start)
+		}
+		break
+	}
+}
+
 func TestTopicCleanOldDataByRetentionDay(t *testing.T) {
 	opts := NewOptions()
 	opts.Logger = newTestLogger(t)
@@ -549,6 +971,124 @@ func TestTopicResetWithQueueStart(t *testing.T) {
 	}
 }
 
+func TestTopicBacklogStats(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("test_backlog_stats", 0)
+	stats := topic.BacklogStats()
+	test.Equal(t, 0, stats.ChannelNum)
+	test.Equal(t, int64(0), stats.TotalDepth)
+
+	confirmNums := []int{0, 3, 10}
+	channels := make([]*Channel, 0, len(confirmNums))
+	for i := range confirmNums {
+		channels = append(channels, topic.GetChannel("ch"+strconv.Itoa(i)))
+	}
+	msgNum := 10
+	for i := 0; i < msgNum; i++ {
+		topic.PutMessage(NewMessage(0, []byte("test")))
+	}
+	topic.ForceFlush()
+	for i, channel := range channels {
+		for j := 0; j < confirmNums[i]; j++ {
+			msg := <-channel.clientMsgChan
+			channel.ConfirmBackendQueue(msg)
+		}
+	}
+
+	committed := topic.GetCommitted().Offset()
+	var minDepth, maxDepth, totalDepth int64
+	var totalLag int64
+	for i, channel := range channels {
+		depth := channel.Depth()
+		test.Equal(t, int64(msgNum-confirmNums[i]), depth)
+		if i == 0 || depth < minDepth {
+			minDepth = depth
+		}
+		if depth > maxDepth {
+			maxDepth = depth
+		}
+		totalDepth += depth
+		totalLag += int64(committed - channel.GetConfirmed().Offset())
+	}
+	stats = topic.BacklogStats()
+	test.Equal(t, len(channels), stats.ChannelNum)
+	test.Equal(t, minDepth, stats.MinDepth)
+	test.Equal(t, maxDepth, stats.MaxDepth)
+	test.Equal(t, totalDepth, stats.TotalDepth)
+	test.Equal(t, int64(0), stats.MinConfirmLag)
+	test.Equal(t, int64(committed), stats.MaxConfirmLag)
+	test.Equal(t, totalLag, stats.TotalConfirmLag)
+	test.Equal(t, "ch0", stats.MaxLagChannel)
+	test.Equal(t, stats, NewTopicStats(topic, nil).Backlog)
+}
+
+func TestTopicScrubDataFile(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	opts.MaxBytesPerFile = 1024 * 10
+	opts.ScrubInterval = time.Hour
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+	defer SetDataFileChecksum(false)
+
+	topic := nsqd.GetTopic("test_scrub", 0)
+	channel := topic.GetChannel("ch")
+	msgNum := 50
+	for i := 0; i < msgNum; i++ {
+		topic.PutMessage(NewMessage(0, make([]byte, 1000)))
+	}
+	topic.ForceFlush()
+	fileNum := topic.backend.diskWriteEnd.EndOffset.FileNum
+	test.Equal(t, true, fileNum >= 3)
+	// the checksum kept while writing should be the same as calculated from the file
+	for i := int64(0); i < fileNum; i++ {
+		sum, err := getQueueFileChecksum(topic.backend.fileName(i))
+		test.Nil(t, err)
+		calc, err := calcQueueFileChecksum(topic.backend.dataFileName(i))
+		test.Nil(t, err)
+		test.Equal(t, calc, sum)
+	}
+	// the files not confirmed should not be scrubbed
+	scrubbed, err := topic.ScrubNextFile()
+	test.Nil(t, err)
+	test.Equal(t, false, scrubbed)
+
+	for i := 0; i < msgNum; i++ {
+		msg := <-channel.clientMsgChan
+		channel.ConfirmBackendQueue(msg)
+	}
+	for i := int64(0); i < fileNum; i++ {
+		scrubbed, err = topic.ScrubNextFile()
+		test.Nil(t, err)
+		test.Equal(t, true, scrubbed)
+	}
+	scrubbed, err = topic.ScrubNextFile()
+	test.Nil(t, err)
+	test.Equal(t, false, scrubbed)
+	test.Equal(t, int64(0), topic.GetScrubMismatchCount())
+
+	f, err := os.OpenFile(topic.backend.dataFileName(1), os.O_RDWR, 0644)
+	test.Nil(t, err)
+	_, err = f.WriteAt([]byte{0xff, 0xff, 0xff, 0xff}, 100)
+	test.Nil(t, err)
+	f.Close()
+	// the mismatch should be found on the next pass
+	scrubbed, err = topic.ScrubNextFile()
+	test.Nil(t, err)
+	test.Equal(t, true, scrubbed)
+	scrubbed, err = topic.ScrubNextFile()
+	test.Equal(t, ErrDataFileChecksumMismatch, err)
+	test.Equal(t, true, scrubbed)
+	test.Equal(t, int64(1), topic.GetScrubMismatchCount())
+	test.Equal(t, int64(1), NewTopicStats(topic, nil).ScrubMismatchCount)
+}
+
 func benchmarkTopicPut(b *testing.B, size int) {
 	b.StopTimer()
 	topicName := "bench_topic_put" + strconv.Itoa(b.N)
@@ -597,3 +1137,241 @@ func BenchmarkTopicToChannelPut(b *testing.B) {
 		topic.PutMessage(msg)
 	}
 }
+
+func TestTopicQueueFileHeaderLen(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("test_file_header", 0)
+	ch1 := topic.GetChannel("ch1")
+	test.Equal(t, int64(0), ch1.backend.(*diskQueueReader).getFileHeaderLen())
+	test.Equal(t, ErrInvalidFileHeaderLen, topic.SetQueueFileHeaderLen(-1))
+	test.Nil(t, topic.SetQueueFileHeaderLen(8))
+	test.Equal(t, int64(8), ch1.backend.(*diskQueueReader).getFileHeaderLen())
+	// the new channel should skip the header as well
+	ch2 := topic.GetChannel("ch2")
+	test.Equal(t, int64(8), ch2.backend.(*diskQueueReader).getFileHeaderLen())
+	// the other topics are not changed
+	other := nsqd.GetTopic("test_file_header_other", 0)
+	test.Equal(t, int64(0), other.GetChannel("ch1").backend.(*diskQueueReader).getFileHeaderLen())
+}
+
+func TestTopicMemoryBacking(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	memTopic, err := nsqd.GetTopicWithBacking("test_memory_backing", 0, false, BackendTypeMemory)
+	test.Nil(t, err)
+	test.Equal(t, BackendTypeMemory, memTopic.GetBackendType())
+	diskTopic, err := nsqd.GetTopicWithBacking("test_disk_backing", 0, false, BackendTypeDisk)
+	test.Nil(t, err)
+	test.Equal(t, true, diskTopic.IsDiskBacked())
+	_, err = nsqd.GetTopicWithBacking("test_memory_backing", 0, false, BackendTypeDisk)
+	test.Equal(t, ErrTopicBackingMismatch, err)
+
+	type queueState struct {
+		Offset    BackendOffset
+		CurCnt    int64
+		Body      string
+		Depth     int64
+		DepthSize int64
+		Confirmed BackendOffset
+	}
+	runQueueOps := func(topic *Topic) []queueState {
+		var reader BackendQueueReader
+		end := topic.writer.GetQueueReadEnd()
+		if topic.memQueue != nil {
+			reader = topic.memQueue.newReader("test_reader", end)
+		} else {
+			var err error
+			reader, err = newDiskQueueReader(getBackendName(topic.GetTopicName(), topic.GetTopicPart()),
+				"test_reader", topic.dataPath, opts.MaxBytesPerFile, int32(minValidMsgLength),
+				int32(opts.MaxMsgSize)+minValidMsgLength, 1, 0, end, false)
+			test.Nil(t, err)
+		}
+		defer reader.Close()
+		for i := 0; i < 10; i++ {
+			_, _, _, _, err := topic.PutMessage(NewMessage(0, []byte("body"+strconv.Itoa(i))))
+			test.Nil(t, err)
+		}
+		topic.ForceFlush()
+		_, err := reader.UpdateQueueEnd(topic.writer.GetQueueReadEnd(), false)
+		test.Nil(t, err)
+
+		var states []queueState
+		record := func(ret ReadResult) {
+			st := queueState{
+				Depth:     reader.Depth(),
+				DepthSize: reader.DepthSize(),
+				Confirmed: reader.GetQueueConfirmed().Offset(),
+			}
+			if ret.Data != nil {
+				test.Nil(t, ret.Err)
+				msg, err := DecodeMessage(ret.Data, false)
+				test.Nil(t, err)
+				st.Offset = ret.Offset
+				st.CurCnt = ret.CurCnt
+				st.Body = string(msg.Body)
+			}
+			states = append(states, st)
+		}
+		record(ReadResult{})
+		var rets []ReadResult
+		for i := 0; i < 5; i++ {
+			ret, ok := reader.TryReadOne()
+			test.Equal(t, true, ok)
+			rets = append(rets, ret)
+			record(ret)
+		}
+		test.Nil(t, reader.ConfirmRead(rets[2].Offset+rets[2].MovedSize, rets[2].CurCnt))
+		record(ReadResult{})
+		// the confirm past the read is rejected
+		test.NotNil(t, reader.ConfirmRead(topic.writer.GetQueueReadEnd().Offset(), 10))
+		_, err = reader.ResetReadToConfirmed()
+		test.Nil(t, err)
+		ret, ok := reader.TryReadOne()
+		test.Equal(t, true, ok)
+		record(ret)
+		_, err = reader.SkipReadToOffset(rets[4].Offset+rets[4].MovedSize, rets[4].CurCnt)
+		test.Nil(t, err)
+		record(ReadResult{})
+		ret, ok = reader.TryReadOne()
+		test.Equal(t, true, ok)
+		record(ret)
+		_, err = reader.SkipReadToEnd()
+		test.Nil(t, err)
+		record(ReadResult{})
+		_, ok = reader.TryReadOne()
+		test.Equal(t, false, ok)
+		return states
+	}
+	memStates := runQueueOps(memTopic)
+	diskStates := runQueueOps(diskTopic)
+	test.Equal(t, diskStates, memStates)
+	test.Equal(t, "body3", memStates[7].Body)
+	test.Equal(t, "body5", memStates[9].Body)
+	test.Equal(t, int64(0), memStates[len(memStates)-1].Depth)
+
+	// the channel consumes the memory topic in the same way
+	ch := memTopic.GetChannel("ch")
+	test.Equal(t, BackendTypeMemory, ch.GetBackendType())
+	_, _, _, _, err = memTopic.PutMessage(NewMessage(0, []byte("channel body")))
+	test.Nil(t, err)
+	memTopic.ForceFlush()
+	test.Equal(t, int64(1), ch.Depth())
+
+	hasDataFile := func(dir string) bool {
+		found := false
+		filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+			if err == nil && strings.HasSuffix(p, ".dat") {
+				found = true
+			}
+			return nil
+		})
+		return found
+	}
+	test.Equal(t, false, hasDataFile(memTopic.dataPath))
+	test.Equal(t, true, hasDataFile(diskTopic.dataPath))
+	test.Equal(t, true, memTopic.GetDiskQueueSnapshot() == nil)
+
+	// the write is rejected while the messages not confirmed reach the max
+	q := newMemoryQueue("test_memory_full", int32(minValidMsgLength), int32(opts.MaxMsgSize), 2)
+	reader := q.newReader("test_reader", nil)
+	defer reader.Close()
+	data := make([]byte, minValidMsgLength)
+	_, _, _, err = q.PutV2(data)
+	test.Nil(t, err)
+	_, _, _, err = q.PutV2(data)
+	test.Nil(t, err)
+	_, _, _, err = q.PutV2(data)
+	test.Equal(t, ErrMemoryQueueFull, err)
+	reader.UpdateQueueEnd(q.GetQueueReadEnd(), false)
+	ret, ok := reader.TryReadOne()
+	test.Equal(t, true, ok)
+	test.Nil(t, reader.ConfirmRead(ret.Offset+ret.MovedSize, ret.CurCnt))
+	_, _, _, err = q.PutV2(data)
+	test.Nil(t, err)
+}
+
+func TestTopicMigrateQueueTo(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	opts.MaxBytesPerFile = 1024
+	newDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-migrate-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(newDir)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+
+	topicName := "test_topic_migrate"
+	topic := nsqd.GetTopic(topicName, 0)
+	channel := topic.GetChannel("ch")
+	msgNum := 40
+	for i := 0; i < msgNum; i++ {
+		topic.PutMessage(NewMessage(0, []byte(strconv.Itoa(i)+strings.Repeat("a", 100))))
+	}
+	topic.ForceFlush()
+	oldPath := topic.dataPath
+	oldFileName := topic.backend.fileName(0)
+	test.Equal(t, true, topic.backend.diskWriteEnd.EndOffset.FileNum > 2)
+
+	var last *Message
+	for i := 0; i < 15; i++ {
+		msg := <-channel.clientMsgChan
+		if i < 12 {
+			channel.ConfirmBackendQueue(msg)
+		}
+		last = msg
+	}
+	confirmed := channel.GetConfirmed()
+	test.Equal(t, true, confirmed.(*diskQueueEndInfo).EndOffset.FileNum > 0)
+
+	err = topic.MigrateQueueTo(newDir)
+	test.Nil(t, err)
+	test.Equal(t, newDir, topic.getQueueDataPath())
+	test.Equal(t, newDir, path.Dir(topic.backend.metaDataFileName()))
+	test.Equal(t, confirmed.Offset(), channel.GetConfirmed().Offset())
+	reader := channel.backend.(*diskQueueReader)
+	test.Equal(t, newDir, path.Dir(reader.metaDataFileName(true)))
+	// the queue files in the old path are removed after migrated
+	_, err = os.Stat(oldFileName)
+	test.Equal(t, true, os.IsNotExist(err))
+	_, err = os.Stat(path.Join(oldPath, path.Base(reader.metaDataFileName(true))))
+	test.Equal(t, true, os.IsNotExist(err))
+	_, err = os.Stat(topic.getChannelMetaFileName())
+	test.Nil(t, err)
+
+	// continue to read from the same offset, and write to the new path
+	for i := msgNum; i < msgNum+10; i++ {
+		topic.PutMessage(NewMessage(0, []byte(strconv.Itoa(i)+strings.Repeat("a", 100))))
+	}
+	topic.ForceFlush()
+	for i := 15; i < msgNum+10; i++ {
+		msg := <-channel.clientMsgChan
+		test.Equal(t, last.Offset+BackendOffset(last.RawMoveSize), msg.Offset)
+		test.Equal(t, strconv.Itoa(i)+strings.Repeat("a", 100), string(msg.Body))
+		last = msg
+	}
+	end := topic.backend.GetQueueWriteEnd()
+	nsqd.Exit()
+
+	// the migrated path is used after restart
+	_, _, nsqd = mustStartNSQD(opts)
+	defer nsqd.Exit()
+	nsqd.LoadMetadata(0)
+	topic, err = nsqd.GetExistingTopic(topicName, 0)
+	test.Nil(t, err)
+	test.Equal(t, newDir, topic.getQueueDataPath())
+	test.Equal(t, end.Offset(), topic.backend.GetQueueWriteEnd().Offset())
+	channel, err = topic.GetExistingChannel("ch")
+	test.Nil(t, err)
+	test.Equal(t, confirmed.Offset(), channel.GetConfirmed().Offset())
+	msg := <-channel.clientMsgChan
+	test.Equal(t, confirmed.Offset(), msg.Offset)
+}
@@ -3,11 +3,14 @@ package nsqdserver
 import (
 	"crypto/tls"
 	"errors"
+	"fmt"
 	"net"
+	"strings"
 	"sync/atomic"
 	"time"
 
 	"github.com/youzan/nsq/consistence"
+	"github.com/youzan/nsq/internal/clusterinfo"
 	"github.com/youzan/nsq/internal/ext"
 	"github.com/youzan/nsq/nsqd"
 )
@@ -25,6 +28,7 @@ type context struct {
 	httpAddr         *net.TCPAddr
 	tcpAddr          *net.TCPAddr
 	reverseProxyPort string
+	lookupPeers      atomic.Value
 }
 
 func (c *context) getOpts() *nsqd.Options {
@@ -72,6 +76,25 @@ func (c *context) setHealth(err error) {
 	c.nsqd.SetHealth(err)
 }
 
+// getHealthDetails returns the health of the nsqd subsystems and the lookupd connectivity.
+func (c *context) getHealthDetails() []nsqd.SubsystemHealth {
+	details := c.nsqd.GetHealthDetails()
+	var disconnected []string
+	lookupPeers := c.lookupPeers.Load()
+	if lookupPeers != nil {
+		for _, lp := range lookupPeers.([]*clusterinfo.LookupPeer) {
+			if !lp.IsConnected() {
+				disconnected = append(disconnected, lp.String())
+			}
+		}
+	}
+	var err error
+	if len(disconnected) > 0 {
+		err = fmt.Errorf("lookupd disconnected: %v", strings.Join(disconnected, ","))
+	}
+	return append(details, nsqd.NewSubsystemHealth("lookupd", err))
+}
+
 func (c *context) getStats(leaderOnly bool, selectedTopic string) []nsqd.TopicStats {
 	if selectedTopic != "" {
 		return c.nsqd.GetTopicStats(leaderOnly, selectedTopic)
@@ -110,6 +133,10 @@ func (c *context) getTopic(name string, part int, ext bool) *nsqd.Topic {
 	}
 }
 
+func (c *context) getTopicWithBacking(name string, part int, ext bool, backing string) (*nsqd.Topic, error) {
+	return c.nsqd.GetTopicWithBacking(name, part, ext, backing)
+}
+
 func (c *context) deleteExistingTopic(name string, part int) error {
 	return c.nsqd.DeleteExistingTopic(name, part)
 }
@@ -326,6 +353,27 @@ func (c *context) SetChannelOffset(ch *nsqd.Channel, startFrom *ConsumeOffset, f
 	return queueOffset, cnt, nil
 }
 
+// ResetChannelToStart resets the channel to the oldest retained data to replay all the messages.
+func (c *context) ResetChannelToStart(ch *nsqd.Channel) (int64, int64, error) {
+	start, err := ch.GetChannelStart()
+	if err != nil {
+		nsqd.NsqLogger().Logf("failed to get the channel %v start: %v", ch.GetName(), err)
+		return 0, 0, err
+	}
+	queueOffset := int64(start.Offset())
+	cnt := start.TotalMsgCnt()
+	if c.nsqdCoord == nil {
+		err = ch.ResetToStart()
+	} else {
+		err = c.nsqdCoord.SetChannelConsumeOffsetToCluster(ch, queueOffset, cnt, true)
+	}
+	if err != nil {
+		nsqd.NsqLogger().Logf("failed to reset the channel %v to start (%v:%v), err: %v ", ch.GetName(), queueOffset, cnt, err)
+		return 0, 0, err
+	}
+	return queueOffset, cnt, nil
+}
+
 func (c *context) internalPubLoop(topic *nsqd.Topic) {
 	messages := make([]*nsqd.Message, 0, 100)
 	pubInfoList := make([]*nsqd.PubInfo, 0, 100)
@@ -445,6 +493,32 @@ func (c *context) internalRequeueToEnd(ch *nsqd.Channel,
 	return err
 }
 
+func (c *context) internalPutDeadLetter(ch *nsqd.Channel, msg *nsqd.Message, topicName string) error {
+	var topic *nsqd.Topic
+	if c.nsqdCoord == nil {
+		topic = c.getTopic(topicName, 0, false)
+	} else {
+		// the topic in cluster should be created by the lookup
+		t, err := c.getExistingTopic(topicName, 0)
+		if err != nil {
+			return err
+		}
+		if !c.checkForMasterWrite(topicName, 0) {
+			return consistence.ErrNotTopicLeader.ToErrorType()
+		}
+		topic = t
+	}
+	if topic == nil {
+		return nsqd.ErrInvalidDeadLetterTopic
+	}
+	_, _, _, _, err := c.PutMessageObj(topic, nsqd.NewDeadLetterMessage(topic, msg))
+	if err != nil {
+		nsqd.NsqLogger().Logf("put dead letter message %v of channel %v to %v failed: %v",
+			msg.ID, ch.GetName(), topicName, err)
+	}
+	return err
+}
+
 func (c *context) GreedyCleanTopicOldData(topic *nsqd.Topic) error {
 	if c.nsqdCoord != nil {
 		return c.nsqdCoord.GreedyCleanTopicOldData(topic)
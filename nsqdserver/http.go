@@ -54,6 +54,7 @@ func newHTTPServer(ctx *context, tlsEnabled bool, tlsRequired bool) *httpServer
 	}
 
 	router.Handle("GET", "/ping", http_api.Decorate(s.pingHandler, log, http_api.PlainText))
+	router.Handle("GET", "/health/details", http_api.Decorate(s.doHealthDetails, log, http_api.V1))
 	router.Handle("POST", "/loglevel/set", http_api.Decorate(s.doSetLogLevel, log, http_api.V1))
 	router.Handle("GET", "/info", http_api.Decorate(s.doInfo, log, http_api.NegotiateVersion))
 
@@ -79,13 +80,20 @@ func newHTTPServer(ctx *context, tlsEnabled bool, tlsRequired bool) *httpServer
 	router.Handle("POST", "/channel/empty", http_api.Decorate(s.doEmptyChannel, log, http_api.V1))
 	router.Handle("POST", "/channel/emptydelayed", http_api.Decorate(s.doEmptyChannelDelayed, log, http_api.V1))
 	router.Handle("POST", "/channel/setoffset", http_api.Decorate(s.doSetChannelOffset, log, http_api.V1))
+	router.Handle("POST", "/channel/resettostart", http_api.Decorate(s.doResetChannelToStart, log, http_api.V1))
 	router.Handle("POST", "/channel/setorder", http_api.Decorate(s.doSetChannelOrder, log, http_api.V1))
+	router.Handle("POST", "/channel/setdeadletter", http_api.Decorate(s.doSetChannelDeadLetter, log, http_api.V1))
+	router.Handle("POST", "/channel/setrewindretention", http_api.Decorate(s.doSetChannelRewindRetention, log, http_api.V1))
+	router.Handle("POST", "/channel/setretention", http_api.Decorate(s.doSetChannelRetention, log, http_api.V1))
+	router.Handle("GET", "/topic/tail", http_api.Decorate(s.doTailTopic, log, http_api.V1Stream))
 	router.Handle("GET", "/config/:opt", http_api.Decorate(s.doConfig, log, http_api.V1))
 	router.Handle("PUT", "/config/:opt", http_api.Decorate(s.doConfig, log, http_api.V1))
 	router.Handle("PUT", "/delayqueue/enable", http_api.Decorate(s.doEnableDelayedQueue, log, http_api.V1))
 	router.Handle("GET", "/delayqueue/backupto", http_api.Decorate(s.doDelayedQueueBackupTo, log, http_api.V1Stream))
 
 	router.Handle("POST", "/topic/greedyclean", http_api.Decorate(s.doGreedyCleanTopic, log, http_api.V1))
+	router.Handle("POST", "/topic/setsyncpolicy", http_api.Decorate(s.doSetTopicSyncPolicy, log, http_api.V1))
+	router.Handle("GET", "/topic/files", http_api.Decorate(s.doTopicFiles, log, http_api.V1))
 	//router.Handle("POST", "/topic/delete", http_api.Decorate(s.doDeleteTopic, http_api.DeprecatedAPI, log, http_api.V1))
 
 	// debug
@@ -130,6 +138,14 @@ func (s *httpServer) pingHandler(w http.ResponseWriter, req *http.Request, ps ht
 	return health, nil
 }
 
+func (s *httpServer) doHealthDetails(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	details := s.ctx.getHealthDetails()
+	return struct {
+		Health     string                 `json:"health"`
+		Subsystems []nsqd.SubsystemHealth `json:"subsystems"`
+	}{nsqd.GetHealthVerdict(details), details}, nil
+}
+
 func (s *httpServer) doSetLogLevel(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	reqParams, err := url.ParseQuery(req.URL.RawQuery)
 	if err != nil {
@@ -249,6 +265,48 @@ func (s *httpServer) doGreedyCleanTopic(w http.ResponseWriter, req *http.Request
 	return nil, nil
 }
 
+// doSetTopicSyncPolicy changes the sync policy of the channel readers of the topic at runtime,
+// the node-wide option is used for the one not given or 0. The policy is persisted in the topic
+// metadata and applied to the live readers.
+func (s *httpServer) doSetTopicSyncPolicy(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, localTopic, err := s.getExistingTopicFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+	var policy nsqd.TopicSyncPolicy
+	if syncEveryStr := reqParams.Get("sync_every"); syncEveryStr != "" {
+		policy.SyncEvery, err = strconv.ParseInt(syncEveryStr, 10, 64)
+		if err != nil || policy.SyncEvery < 0 {
+			return nil, http_api.Err{400, "INVALID_SYNC_EVERY"}
+		}
+	}
+	if syncTimeoutStr := reqParams.Get("sync_timeout_ms"); syncTimeoutStr != "" {
+		ms, err := strconv.ParseInt(syncTimeoutStr, 10, 64)
+		if err != nil || ms < 0 {
+			return nil, http_api.Err{400, "INVALID_SYNC_TIMEOUT"}
+		}
+		policy.SyncTimeout = time.Duration(ms) * time.Millisecond
+	}
+	localTopic.SetSyncPolicy(policy)
+	nsqd.NsqLogger().Logf("topic:%v set sync policy: %v by client:%v", localTopic.GetFullName(),
+		policy, req.RemoteAddr)
+	return nil, nil
+}
+
+func (s *httpServer) doTopicFiles(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	_, localTopic, err := s.getExistingTopicFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+	files, err := localTopic.GetQueueFiles()
+	if err != nil {
+		return nil, http_api.Err{500, err.Error()}
+	}
+	return struct {
+		Files []nsqd.QueueFileInfo `json:"files"`
+	}{files}, nil
+}
+
 func (s *httpServer) doPUBTrace(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	return s.internalPUB(w, req, ps, true, false)
 }
@@ -277,6 +335,10 @@ func (s *httpServer) internalPUB(w http.ResponseWriter, req *http.Request, ps ht
 		return nil, http_api.Err{404, E_TOPIC_NOT_EXIST}
 	}
 
+	if req.ContentLength > topic.GetMaxMsgSize() {
+		return nil, http_api.Err{413, "MSG_TOO_BIG"}
+	}
+
 	readMax := req.ContentLength + 1
 	b := topic.BufferPoolGet(int(req.ContentLength))
 	defer topic.BufferPoolPut(b)
@@ -383,6 +445,10 @@ func (s *httpServer) internalPUB(w http.ResponseWriter, req *http.Request, ps ht
 			asyncAction = false
 		}
 
+		err = topic.AdmitPub(1, int64(len(body)))
+		if err != nil {
+			return nil, http_api.Err{429, E_PUB_RATE_LIMITED}
+		}
 		id := nsqd.MessageID(0)
 		offset := nsqd.BackendOffset(0)
 		rawSize := int32(0)
@@ -444,7 +510,7 @@ func (s *httpServer) doMPUB(w http.ResponseWriter, req *http.Request, ps httprou
 	if ok {
 		tmp := make([]byte, 4)
 		msgs, buffers, err = readMPUB(req.Body, tmp, topic,
-			s.ctx.getOpts().MaxMsgSize, s.ctx.getOpts().MaxBodySize, false)
+			topic.GetMaxMsgSize(), s.ctx.getOpts().MaxBodySize, false)
 		defer func() {
 			for _, b := range buffers {
 				topic.BufferPoolPut(b)
@@ -485,7 +551,7 @@ func (s *httpServer) doMPUB(w http.ResponseWriter, req *http.Request, ps httprou
 				continue
 			}
 
-			if int64(len(block)) > s.ctx.getOpts().MaxMsgSize {
+			if int64(len(block)) > topic.GetMaxMsgSize() {
 				return nil, http_api.Err{413, "MSG_TOO_BIG"}
 			}
 
@@ -496,7 +562,11 @@ func (s *httpServer) doMPUB(w http.ResponseWriter, req *http.Request, ps httprou
 	}
 
 	if s.ctx.checkForMasterWrite(topic.GetTopicName(), topic.GetTopicPart()) {
-		_, _, _, err := s.ctx.PutMessages(topic, msgs)
+		err := topic.AdmitPub(len(msgs), messagesBodySize(msgs))
+		if err != nil {
+			return nil, http_api.Err{429, E_PUB_RATE_LIMITED}
+		}
+		_, _, _, err = s.ctx.PutMessages(topic, msgs)
 		//s.ctx.setHealth(err)
 		if err != nil {
 			nsqd.NsqLogger().LogErrorf("topic %v put message failed: %v", topic.GetFullName(), err)
@@ -548,7 +618,10 @@ func (s *httpServer) doCreateChannel(w http.ResponseWriter, req *http.Request, p
 	if err != nil {
 		return nil, err
 	}
-	topic.GetChannel(channelName)
+	_, err = topic.GetOrCreateChannel(channelName)
+	if err != nil {
+		return nil, http_api.Err{500, err.Error()}
+	}
 	return nil, nil
 }
 
@@ -586,6 +659,32 @@ func (s *httpServer) doEmptyChannel(w http.ResponseWriter, req *http.Request, ps
 	return nil, nil
 }
 
+func (s *httpServer) doResetChannelToStart(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	_, topic, channelName, err := s.getExistingTopicChannelFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+
+	channel, err := topic.GetExistingChannel(channelName)
+	if err != nil {
+		return nil, http_api.Err{404, "CHANNEL_NOT_FOUND"}
+	}
+
+	if s.ctx.checkForMasterWrite(topic.GetTopicName(), topic.GetTopicPart()) {
+		queueOffset, cnt, err := s.ctx.ResetChannelToStart(channel)
+		if err != nil {
+			return nil, http_api.Err{500, err.Error()}
+		}
+		nsqd.NsqLogger().Logf("reset the channel %v to start offset: %v:%v, by client:%v",
+			channelName, queueOffset, cnt, req.RemoteAddr)
+	} else {
+		nsqd.NsqLogger().LogDebugf("should request to master: %v, from %v",
+			topic.GetFullName(), req.RemoteAddr)
+		return nil, http_api.Err{400, FailedOnNotLeader}
+	}
+	return nil, nil
+}
+
 func (s *httpServer) doEmptyChannelDelayed(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	_, topic, channelName, err := s.getExistingTopicChannelFromQuery(req)
 	if err != nil {
@@ -632,6 +731,89 @@ func (s *httpServer) doSetChannelOrder(w http.ResponseWriter, req *http.Request,
 	return nil, nil
 }
 
+// set the dead letter topic and the attempt threshold of the channel, disabled if the
+// topic is empty or the attempts is 0.
+func (s *httpServer) doSetChannelDeadLetter(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, topic, channelName, err := s.getExistingTopicChannelFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+
+	channel, err := topic.GetExistingChannel(channelName)
+	if err != nil {
+		return nil, http_api.Err{404, "CHANNEL_NOT_FOUND"}
+	}
+
+	var attempts uint64
+	attemptsStr := reqParams.Get("max_attempts")
+	if attemptsStr != "" {
+		attempts, err = strconv.ParseUint(attemptsStr, 10, 16)
+		if err != nil {
+			return nil, http_api.Err{400, "INVALID_OPTION"}
+		}
+	}
+	err = channel.SetDeadLetterPolicy(reqParams.Get("dead_letter_topic"), uint16(attempts))
+	if err != nil {
+		return nil, http_api.Err{400, "INVALID_DEAD_LETTER_TOPIC"}
+	}
+	nsqd.NsqLogger().Logf("topic:%v channel:%v set dead letter: %v, %v by client:%v", topic.GetTopicName(),
+		channel.GetName(), reqParams.Get("dead_letter_topic"), attempts, req.RemoteAddr)
+
+	// pro-actively persist metadata so in case of process failure
+	topic.SaveChannelMeta()
+	return nil, nil
+}
+
+// set the size of the confirmed data kept for the channel rewind, disabled if the size is 0.
+func (s *httpServer) doSetChannelRewindRetention(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, topic, channelName, err := s.getExistingTopicChannelFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+
+	channel, err := topic.GetExistingChannel(channelName)
+	if err != nil {
+		return nil, http_api.Err{404, "CHANNEL_NOT_FOUND"}
+	}
+
+	size, err := strconv.ParseInt(reqParams.Get("size"), 10, 64)
+	if err != nil || size < 0 {
+		return nil, http_api.Err{400, "INVALID_OPTION"}
+	}
+	channel.SetRewindRetention(size)
+	nsqd.NsqLogger().Logf("topic:%v channel:%v set rewind retention: %v by client:%v", topic.GetTopicName(),
+		channel.GetName(), size, req.RemoteAddr)
+
+	// pro-actively persist metadata so in case of process failure
+	topic.SaveChannelMeta()
+	return nil, nil
+}
+
+// set the seconds of the data kept for the channel, follow the topic retention if the seconds is 0.
+func (s *httpServer) doSetChannelRetention(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, topic, channelName, err := s.getExistingTopicChannelFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+
+	channel, err := topic.GetExistingChannel(channelName)
+	if err != nil {
+		return nil, http_api.Err{404, "CHANNEL_NOT_FOUND"}
+	}
+
+	secs, err := strconv.ParseInt(reqParams.Get("seconds"), 10, 64)
+	if err != nil || secs < 0 {
+		return nil, http_api.Err{400, "INVALID_OPTION"}
+	}
+	channel.SetRetentionSeconds(secs)
+	nsqd.NsqLogger().Logf("topic:%v channel:%v set retention: %vs by client:%v", topic.GetTopicName(),
+		channel.GetName(), secs, req.RemoteAddr)
+
+	// pro-actively persist metadata so in case of process failure
+	topic.SaveChannelMeta()
+	return nil, nil
+}
+
 func (s *httpServer) doSetChannelOffset(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	_, topic, channelName, err := s.getExistingTopicChannelFromQuery(req)
 	if err != nil {
@@ -1272,6 +1454,117 @@ func (s *httpServer) doEnableDelayedQueue(w http.ResponseWriter, req *http.Reque
 	return nil, nil
 }
 
+const (
+	defaultTailMaxBody = 256
+	tailPollInterval   = 100 * time.Millisecond
+)
+
+// doTailTopic streams the messages written to the topic as server-sent events using a transient
+// snapshot reader of the topic data. It tails the topic rather than the messages delivered by any
+// channel, so the filter, the requeue and the delay of the channel are not applied, and the consume
+// position of the channel will not be changed. The stream starts at the queue end by default, or the
+// confirmed of the given channel if from=confirmed. The event id is the offset of the next message,
+// so the client can resume from the Last-Event-ID after the stream closed by the write timeout.
+func (s *httpServer) doTailTopic(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, topic, err := s.getExistingTopicFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+	maxBody := defaultTailMaxBody
+	if maxBodyStr := reqParams.Get("max_body"); maxBodyStr != "" {
+		maxBody, err = strconv.Atoi(maxBodyStr)
+		if err != nil {
+			return nil, http_api.Err{400, "INVALID_MAX_BODY"}
+		}
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, http_api.Err{500, "STREAMING_UNSUPPORTED"}
+	}
+	closeNotifier, ok := w.(http.CloseNotifier)
+	if !ok {
+		return nil, http_api.Err{500, "STREAMING_UNSUPPORTED"}
+	}
+
+	snap := topic.GetDiskQueueSnapshot()
+	if snap == nil {
+		return nil, http_api.Err{400, "TOPIC_NO_DISK_QUEUE"}
+	}
+	defer snap.Close()
+	if lastID := req.Header.Get("Last-Event-ID"); lastID != "" {
+		resumeOffset, err := strconv.ParseInt(lastID, 10, 64)
+		if err != nil {
+			return nil, http_api.Err{400, "INVALID_LAST_EVENT_ID"}
+		}
+		err = snap.SeekTo(nsqd.BackendOffset(resumeOffset))
+		if err != nil {
+			return nil, http_api.Err{400, err.Error()}
+		}
+	} else if reqParams.Get("from") == "confirmed" {
+		channel, err := topic.GetExistingChannel(reqParams.Get("channel"))
+		if err != nil {
+			return nil, http_api.Err{404, "CHANNEL_NOT_FOUND"}
+		}
+		err = snap.SeekTo(channel.GetConfirmed().Offset())
+		if err != nil {
+			return nil, http_api.Err{400, err.Error()}
+		}
+	} else {
+		snap.SeekToEnd()
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	nsqd.NsqLogger().Logf("start tail the topic %v by client:%v", topic.GetFullName(), req.RemoteAddr)
+	defer nsqd.NsqLogger().Logf("stop tail the topic %v by client:%v", topic.GetFullName(), req.RemoteAddr)
+
+	closeChan := closeNotifier.CloseNotify()
+	ticker := time.NewTicker(tailPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-closeChan:
+			return nil, nil
+		case <-ticker.C:
+		}
+		end := topic.UpdateDiskQueueSnapshot(snap)
+		written := false
+		for snap.GetCurrentReadQueueOffset().Offset() < end.Offset() {
+			ret := snap.ReadOne()
+			if ret.Err != nil {
+				nsqd.NsqLogger().LogWarningf("tail topic %v read error: %v", topic.GetFullName(), ret.Err)
+				return nil, nil
+			}
+			msg, err := nsqd.DecodeMessage(ret.Data, topic.IsExt())
+			if err != nil {
+				nsqd.NsqLogger().LogWarningf("tail topic %v decode error: %v", topic.GetFullName(), err)
+				continue
+			}
+			body := msg.Body
+			if maxBody > 0 && len(body) > maxBody {
+				body = body[:maxBody]
+			}
+			data, _ := json.Marshal(struct {
+				ID        nsqd.MessageID     `json:"id"`
+				Offset    nsqd.BackendOffset `json:"offset"`
+				Timestamp int64              `json:"timestamp"`
+				Body      string             `json:"body"`
+			}{msg.ID, ret.Offset, msg.Timestamp, string(body)})
+			_, err = fmt.Fprintf(w, "id: %d\nevent: message\ndata: %s\n\n", ret.Offset+ret.MovedSize, data)
+			if err != nil {
+				// the client is disconnected
+				return nil, nil
+			}
+			written = true
+		}
+		if written {
+			flusher.Flush()
+		}
+	}
+}
+
 func (s *httpServer) doDelayedQueueBackupTo(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	reqParams, err := url.ParseQuery(req.URL.RawQuery)
 	if err != nil {
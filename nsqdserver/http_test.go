@@ -1,9 +1,11 @@
 package nsqdserver
 
 import (
+	"bufio"
 	"bytes"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net"
@@ -388,6 +390,207 @@ func TestHTTPpubEmpty(t *testing.T) {
 
 }
 
+func TestHTTPTailTopic(t *testing.T) {
+	opts := nsqd.NewOptions()
+	opts.Logger = newTestLogger(t)
+	_, httpAddr, nsqdNs, nsqdServer := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqdServer.Exit()
+
+	topicName := "test_http_tail" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqdNs.GetTopicIgnPart(topicName)
+	channel := topic.GetChannel("ch")
+
+	tailURL := fmt.Sprintf("http://%s/topic/tail?topic=%s&partition=0&max_body=1", httpAddr, topicName)
+	resp, err := http.Get(tailURL)
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	test.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	msgNum := 3
+	for i := 0; i < msgNum; i++ {
+		buf := bytes.NewBuffer([]byte(strconv.Itoa(i) + " test message"))
+		pubResp, err := http.Post(fmt.Sprintf("http://%s/pub?topic=%s", httpAddr, topicName), "application/octet-stream", buf)
+		test.Nil(t, err)
+		pubResp.Body.Close()
+	}
+	topic.ForceFlush()
+
+	reader := bufio.NewReader(resp.Body)
+	lastOffset := int64(-1)
+	for i := 0; i < msgNum; i++ {
+		var eventID string
+		var eventData []byte
+		for {
+			line, err := reader.ReadString('\n')
+			test.Nil(t, err)
+			line = strings.TrimSuffix(line, "\n")
+			if line == "" {
+				break
+			}
+			if strings.HasPrefix(line, "id: ") {
+				eventID = strings.TrimPrefix(line, "id: ")
+			} else if strings.HasPrefix(line, "data: ") {
+				eventData = []byte(strings.TrimPrefix(line, "data: "))
+			}
+		}
+		var event struct {
+			Offset int64  `json:"offset"`
+			Body   string `json:"body"`
+		}
+		err = json.Unmarshal(eventData, &event)
+		test.Nil(t, err)
+		// the body should be truncated
+		test.Equal(t, strconv.Itoa(i), event.Body)
+		test.Equal(t, true, event.Offset > lastOffset)
+		nextOffset, err := strconv.ParseInt(eventID, 10, 64)
+		test.Nil(t, err)
+		test.Equal(t, true, nextOffset > event.Offset)
+		lastOffset = event.Offset
+	}
+	resp.Body.Close()
+	// the tail should not change the channel consume position
+	test.Equal(t, nsqd.BackendOffset(0), channel.GetConfirmed().Offset())
+}
+
+func TestHTTPSetTopicSyncPolicy(t *testing.T) {
+	opts := nsqd.NewOptions()
+	opts.Logger = newTestLogger(t)
+	_, httpAddr, nsqdNs, nsqdServer := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqdServer.Exit()
+
+	topicName := "test_http_sync_policy" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqdNs.GetTopicIgnPart(topicName)
+	channel := topic.GetChannel("ch")
+
+	policyURL := fmt.Sprintf("http://%s/topic/setsyncpolicy?topic=%s&partition=0&sync_every=10&sync_timeout_ms=500", httpAddr, topicName)
+	resp, err := http.Post(policyURL, "application/octet-stream", nil)
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+	test.Equal(t, nsqd.TopicSyncPolicy{SyncEvery: 10, SyncTimeout: 500 * time.Millisecond}, topic.GetSyncPolicy())
+	// the live reader should use the new policy
+	syncEvery, syncTimeout := channel.GetSyncPolicy()
+	test.Equal(t, int64(10), syncEvery)
+	test.Equal(t, 500*time.Millisecond, syncTimeout)
+
+	// the node-wide sync timeout is used if not given
+	policyURL = fmt.Sprintf("http://%s/topic/setsyncpolicy?topic=%s&partition=0&sync_every=5", httpAddr, topicName)
+	resp, err = http.Post(policyURL, "application/octet-stream", nil)
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+	syncEvery, syncTimeout = channel.GetSyncPolicy()
+	test.Equal(t, int64(5), syncEvery)
+	test.Equal(t, opts.SyncTimeout, syncTimeout)
+
+	policyURL = fmt.Sprintf("http://%s/topic/setsyncpolicy?topic=%s&partition=0&sync_every=-1", httpAddr, topicName)
+	resp, err = http.Post(policyURL, "application/octet-stream", nil)
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 400, resp.StatusCode)
+}
+
+func TestHTTPTopicFiles(t *testing.T) {
+	opts := nsqd.NewOptions()
+	opts.Logger = newTestLogger(t)
+	opts.MaxBytesPerFile = 1024
+	_, httpAddr, nsqdNs, nsqdServer := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqdServer.Exit()
+
+	topicName := "test_http_topic_files" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqdNs.GetTopicIgnPart(topicName)
+	channel := topic.GetChannel("ch")
+	for i := 0; i < 30; i++ {
+		topic.PutMessage(nsqd.NewMessage(0, bytes.Repeat([]byte("a"), 100)))
+	}
+	topic.ForceFlush()
+	// consume some messages to confirm the first file
+	for i := 0; i < 10; i++ {
+		channel.ConfirmBackendQueue(<-channel.GetClientMsgChan())
+	}
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/topic/files?topic=%s&partition=0", httpAddr, topicName))
+	test.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+	var ret struct {
+		Files []nsqd.QueueFileInfo `json:"files"`
+	}
+	err = json.Unmarshal(body, &ret)
+	test.Nil(t, err)
+	t.Logf("topic files: %v", ret.Files)
+	test.Equal(t, true, len(ret.Files) > 1)
+	test.Equal(t, nsqd.BackendOffset(0), ret.Files[0].StartOffset)
+	test.Equal(t, true, ret.Files[0].Confirmed)
+	for i, f := range ret.Files {
+		test.Equal(t, int64(i), f.FileNum)
+		test.Equal(t, f.Size, int64(f.EndOffset-f.StartOffset))
+		test.Equal(t, f.EndOffset <= channel.GetConfirmed().Offset(), f.Confirmed)
+		if i > 0 {
+			test.Equal(t, ret.Files[i-1].EndOffset, f.StartOffset)
+		}
+	}
+	test.Equal(t, channel.GetChannelEnd().Offset(), ret.Files[len(ret.Files)-1].EndOffset)
+}
+
+func TestHTTPHealthDetails(t *testing.T) {
+	opts := nsqd.NewOptions()
+	opts.Logger = newTestLogger(t)
+	_, httpAddr, nsqdNs, nsqdServer := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqdServer.Exit()
+
+	topicName := "test_http_health_details" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqdNs.GetTopicIgnPart(topicName)
+	topic.GetChannel("ch")
+
+	getDetails := func() (string, map[string]nsqd.SubsystemHealth) {
+		resp, err := http.Get(fmt.Sprintf("http://%s/health/details", httpAddr))
+		test.Nil(t, err)
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		test.Equal(t, 200, resp.StatusCode)
+		var ret struct {
+			Health     string                 `json:"health"`
+			Subsystems []nsqd.SubsystemHealth `json:"subsystems"`
+		}
+		err = json.Unmarshal(body, &ret)
+		test.Nil(t, err)
+		t.Logf("health details: %v", string(body))
+		subsystems := make(map[string]nsqd.SubsystemHealth)
+		for _, h := range ret.Subsystems {
+			subsystems[h.Name] = h
+		}
+		return ret.Health, subsystems
+	}
+
+	health, subsystems := getDetails()
+	test.Equal(t, "OK", health)
+	test.Equal(t, 5, len(subsystems))
+	for _, h := range subsystems {
+		test.Equal(t, "OK", h.Status)
+		test.Equal(t, "", h.Error)
+	}
+
+	nsqdNs.SetHealth(errors.New("health test failure"))
+	health, subsystems = getDetails()
+	test.Equal(t, "NOK - health test failure", health)
+	test.Equal(t, "NOK", subsystems["health"].Status)
+	test.Equal(t, "health test failure", subsystems["health"].Error)
+	for _, name := range []string{"dirlock", "disk_space", "topic_readers", "lookupd"} {
+		test.Equal(t, "OK", subsystems[name].Status)
+	}
+
+	nsqdNs.SetHealth(nil)
+	health, subsystems = getDetails()
+	test.Equal(t, "OK", health)
+	test.Equal(t, "OK", subsystems["health"].Status)
+}
+
 func TestHTTPmpub(t *testing.T) {
 	opts := nsqd.NewOptions()
 	opts.Logger = newTestLogger(t)
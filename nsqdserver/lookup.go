@@ -139,7 +139,7 @@ func (n *NsqdServer) lookupLoop(pingInterval time.Duration, metaNotifyChan chan
 				lookupPeers = append(lookupPeers, lookupPeer)
 				lookupAddrs = append(lookupAddrs, host)
 			}
-			n.lookupPeers.Store(lookupPeers)
+			n.ctx.lookupPeers.Store(lookupPeers)
 			changed = false
 		}
 
@@ -294,7 +294,10 @@ func in(s string, lst []string) bool {
 
 func (n *NsqdServer) lookupdHTTPAddrs() []string {
 	var lookupHTTPAddrs []string
-	lookupPeers := n.lookupPeers.Load()
+	if n.ctx.getOpts().DisableLookupd {
+		return nil
+	}
+	lookupPeers := n.ctx.lookupPeers.Load()
 	if lookupPeers == nil {
 		return nil
 	}
@@ -8,7 +8,6 @@ import (
 	"net"
 	"os"
 	"strconv"
-	"sync/atomic"
 
 	"github.com/youzan/nsq/consistence"
 	"github.com/youzan/nsq/nsqd"
@@ -21,7 +20,6 @@ import (
 
 type NsqdServer struct {
 	ctx           *context
-	lookupPeers   atomic.Value
 	waitGroup     util.WaitGroupWrapper
 	tcpListener   net.Listener
 	httpListener  net.Listener
@@ -88,6 +86,9 @@ func NewNsqdServer(opts *nsqd.Options) (*nsqd.NSQD, *NsqdServer) {
 		nsqd.NsqLogger().LogWarningf("starting in data fix mode...")
 	}
 
+	if opts.RPCPort != "" && opts.ExternalConfirmStore && opts.ConfirmStore == nil {
+		opts.ConfirmStore = consistence.NewEtcdConfirmStore(opts.ClusterLeadershipAddresses, opts.ClusterID)
+	}
 	nsqdInstance := nsqd.New(opts)
 
 	s := &NsqdServer{}
@@ -103,6 +104,7 @@ func NewNsqdServer(opts *nsqd.Options) (*nsqd.NSQD, *NsqdServer) {
 			strconv.FormatInt(opts.ID, 10), opts.DataPath, nsqdInstance)
 		l := consistence.NewNsqdEtcdMgr(opts.ClusterLeadershipAddresses)
 		coord.SetLeadershipMgr(l)
+		coord.SetAllowDuplicateWorkerID(opts.AllowDuplicateWorkerID)
 		ctx.nsqdCoord = coord
 	} else {
 		nsqd.NsqLogger().LogWarningf("Start without nsqd coordinator enabled")
@@ -125,6 +127,7 @@ func NewNsqdServer(opts *nsqd.Options) (*nsqd.NSQD, *NsqdServer) {
 	s.ctx.tlsConfig = tlsConfig
 	s.ctx.nsqd.SetPubLoop(s.ctx.internalPubLoop)
 	s.ctx.nsqd.SetReqToEndCB(s.ctx.internalRequeueToEnd)
+	s.ctx.nsqd.SetDeadLetterCB(s.ctx.internalPutDeadLetter)
 
 	nsqd.NsqLogger().Logf(version.String("nsqd"))
 	nsqd.NsqLogger().Logf("ID: %d", opts.ID)
@@ -217,9 +220,13 @@ func (s *NsqdServer) Main() {
 
 	s.ctx.nsqd.Start()
 
-	s.waitGroup.Wrap(func() {
-		s.lookupLoop(opts.LookupPingInterval, s.ctx.nsqd.MetaNotifyChan, s.ctx.nsqd.OptsNotificationChan, s.exitChan)
-	})
+	if opts.DisableLookupd {
+		nsqd.NsqLogger().LogWarningf("Start with lookupd disabled")
+	} else {
+		s.waitGroup.Wrap(func() {
+			s.lookupLoop(opts.LookupPingInterval, s.ctx.nsqd.MetaNotifyChan, s.ctx.nsqd.OptsNotificationChan, s.exitChan)
+		})
+	}
 
 	if opts.StatsdAddress != "" {
 		s.waitGroup.Wrap(s.statsdLoop)
@@ -15,6 +15,7 @@ import (
 	"net"
 	"os"
 	"strconv"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -157,7 +158,7 @@ func TestReconfigure(t *testing.T) {
 
 	time.Sleep(50 * time.Millisecond)
 
-	numLookupPeers := len(nsqdServer.lookupPeers.Load().([]*clusterinfo.LookupPeer))
+	numLookupPeers := len(nsqdServer.ctx.lookupPeers.Load().([]*clusterinfo.LookupPeer))
 	test.Equal(t, numLookupPeers, 1)
 
 	newOpts = *opts
@@ -169,7 +170,7 @@ func TestReconfigure(t *testing.T) {
 	time.Sleep(time.Second)
 
 	var lookupPeers []string
-	for _, lp := range nsqdServer.lookupPeers.Load().([]*clusterinfo.LookupPeer) {
+	for _, lp := range nsqdServer.ctx.lookupPeers.Load().([]*clusterinfo.LookupPeer) {
 		lookupPeers = append(lookupPeers, lp.String())
 	}
 	test.Equal(t, len(lookupPeers), 2)
@@ -273,3 +274,43 @@ func TestCluster(t *testing.T) {
 	producers, _ = data.Get("channel:" + topicName + ":" + partitionStr).Array()
 	test.Equal(t, len(producers), 0)
 }
+
+func TestDisableLookupd(t *testing.T) {
+	// the fake lookupd only counts the connections
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	test.Equal(t, err, nil)
+	defer l.Close()
+	var connCnt int32
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&connCnt, 1)
+			conn.Close()
+		}
+	}()
+
+	opts := nsqdNs.NewOptions()
+	opts.Logger = newTestLogger(t)
+	opts.NSQLookupdTCPAddresses = []string{l.Addr().String()}
+	opts.LookupPingInterval = 10 * time.Millisecond
+	opts.DisableLookupd = true
+	_, _, nsqd, nsqdServer := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqdServer.Exit()
+
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		topic := nsqd.GetTopic("disable_lookupd_"+strconv.Itoa(i), 0)
+		topic.GetChannel("ch")
+	}
+	test.Equal(t, true, time.Since(start) < time.Second)
+
+	nsqd.TriggerOptsNotification()
+	time.Sleep(100 * time.Millisecond)
+	test.Equal(t, int32(0), atomic.LoadInt32(&connCnt))
+	test.Equal(t, nil, nsqdServer.ctx.lookupPeers.Load())
+	test.Equal(t, 0, len(nsqdServer.lookupdHTTPAddrs()))
+}
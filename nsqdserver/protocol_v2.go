@@ -7,6 +7,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math"
 	"math/rand"
 	"net"
@@ -26,8 +27,9 @@ import (
 )
 
 const (
-	E_INVALID         = "E_INVALID"
-	E_TOPIC_NOT_EXIST = "E_TOPIC_NOT_EXIST"
+	E_INVALID          = "E_INVALID"
+	E_TOPIC_NOT_EXIST  = "E_TOPIC_NOT_EXIST"
+	E_PUB_RATE_LIMITED = "E_PUB_RATE_LIMITED"
 )
 
 const maxTimeout = time.Hour
@@ -127,6 +129,7 @@ func (p *protocolV2) IOLoop(conn net.Conn) error {
 
 	clientID := p.ctx.nextClientID()
 	client := nsqd.NewClientV2(clientID, conn, p.ctx.getOpts(), p.ctx.GetTlsConfig())
+	client.AuthCache = p.ctx.nsqd.GetAuthCache()
 	client.SetWriteDeadline(zeroTime)
 
 	// synchronize the startup of messagePump in order
@@ -944,7 +947,11 @@ func (p *protocolV2) internalSUB(client *nsqd.ClientV2, params [][]byte, enableT
 		topic.DisableForSlave()
 		return nil, protocol.NewFatalClientErr(nil, FailedOnNotLeader, "")
 	}
-	channel := topic.GetChannel(channelName)
+	channel, err := topic.GetOrCreateChannel(channelName)
+	if err != nil {
+		nsqd.NsqLogger().Logf("sub failed to load the channel: %v, %v", client, err)
+		return nil, protocol.NewFatalClientErr(err, "E_SUB_FAILED", "SUB failed to load the channel "+err.Error())
+	}
 	// client with tag is subscribe to topic not support tag, remove client's tag and treat it like untaged consumer
 	if !topic.IsExt() && client.GetDesiredTag() != "" {
 		nsqd.NsqLogger().Logf("[%v] IDENTIFY before subscribe has a tag %v to topic %v not support tag. Remove client's tag.", client, client.GetDesiredTag(), topicName)
@@ -1227,16 +1234,25 @@ func (p *protocolV2) internalCreateTopic(client *nsqd.ClientV2, params [][]byte)
 				fmt.Sprintf("topic ext is not valid: %v", err))
 		}
 	}
+	// the queue backing of the topic, disk if not given
+	var backing string
+	if len(params) >= 5 {
+		backing = string(params[4])
+		if backing != nsqd.BackendTypeDisk && backing != nsqd.BackendTypeMemory {
+			return nil, protocol.NewFatalClientErr(nil, "E_BAD_BACKING",
+				fmt.Sprintf("topic backing %q is not valid", backing))
+		}
+	}
 
 	if p.ctx.nsqdCoord != nil {
 		return nil, protocol.NewClientErr(err, "E_CREATE_TOPIC_FAILED",
 			fmt.Sprintf("CREATE_TOPIC is not allowed here while cluster feature enabled."))
 	}
 
-	topic := p.ctx.getTopic(topicName, partition, ext)
-	if topic == nil {
+	_, err = p.ctx.getTopicWithBacking(topicName, partition, ext, backing)
+	if err != nil {
 		return nil, protocol.NewClientErr(err, "E_CREATE_TOPIC_FAILED",
-			fmt.Sprintf("CREATE_TOPIC %v failed", topicName))
+			fmt.Sprintf("CREATE_TOPIC %v failed: %v", topicName, err))
 	}
 	return okBytes, nil
 }
@@ -1394,6 +1410,16 @@ func (p *protocolV2) internalPubExtAndTrace(client *nsqd.ClientV2, params [][]by
 	if err != nil {
 		return nil, err
 	}
+	if maxMsgSize := topic.GetMaxMsgSize(); int64(bodyLen) > maxMsgSize {
+		nsqd.NsqLogger().Logf("topic: %v message body too large %v vs %v ", topic.GetFullName(), bodyLen, maxMsgSize)
+		// the body is under the node limit, so it can be skipped and the connection is kept
+		_, err = io.CopyN(ioutil.Discard, client.Reader, int64(bodyLen))
+		if err != nil {
+			return nil, protocol.NewFatalClientErr(err, "E_BAD_MESSAGE", "failed to read message body")
+		}
+		return nil, protocol.NewClientErr(nil, "E_BAD_MESSAGE",
+			fmt.Sprintf("message too big %d > %d", bodyLen, maxMsgSize))
+	}
 
 	if traceEnable && bodyLen <= nsqd.MsgTraceIDLength {
 		return nil, protocol.NewFatalClientErr(nil, "E_BAD_BODY",
@@ -1491,6 +1517,11 @@ func (p *protocolV2) internalPubExtAndTrace(client *nsqd.ClientV2, params [][]by
 					fmt.Sprintf("ext content not supported in topic %v", topicName))
 			}
 		}
+		err = topic.AdmitPub(1, int64(len(realBody)))
+		if err != nil {
+			topic.GetDetailStats().UpdatePubClientStats(client.String(), client.UserAgent, "tcp", 1, true)
+			return nil, protocol.NewClientErr(err, E_PUB_RATE_LIMITED, err.Error())
+		}
 		id := nsqd.MessageID(0)
 		offset := nsqd.BackendOffset(0)
 		rawSize := int32(0)
@@ -1539,7 +1570,7 @@ func (p *protocolV2) internalMPUBAndTrace(client *nsqd.ClientV2, params [][]byte
 	}
 
 	messages, buffers, preErr := readMPUB(client.Reader, client.LenSlice, topic,
-		p.ctx.getOpts().MaxMsgSize, p.ctx.getOpts().MaxBodySize, traceEnable)
+		topic.GetMaxMsgSize(), p.ctx.getOpts().MaxBodySize, traceEnable)
 
 	defer func() {
 		for _, b := range buffers {
@@ -1553,6 +1584,11 @@ func (p *protocolV2) internalMPUBAndTrace(client *nsqd.ClientV2, params [][]byte
 	topicName := topic.GetTopicName()
 	partition := topic.GetTopicPart()
 	if p.ctx.checkForMasterWrite(topicName, partition) {
+		err := topic.AdmitPub(len(messages), messagesBodySize(messages))
+		if err != nil {
+			topic.GetDetailStats().UpdatePubClientStats(client.String(), client.UserAgent, "tcp", int64(len(messages)), true)
+			return nil, protocol.NewClientErr(err, E_PUB_RATE_LIMITED, err.Error())
+		}
 		id, offset, rawSize, err := p.ctx.PutMessages(topic, messages)
 		//p.ctx.setHealth(err)
 		if err != nil {
@@ -1615,6 +1651,14 @@ func (p *protocolV2) TOUCH(client *nsqd.ClientV2, params [][]byte) ([]byte, erro
 	return nil, nil
 }
 
+func messagesBodySize(msgs []*nsqd.Message) int64 {
+	var size int64
+	for _, m := range msgs {
+		size += int64(len(m.Body))
+	}
+	return size
+}
+
 func readMPUB(r io.Reader, tmp []byte, topic *nsqd.Topic, maxMessageSize int64,
 	maxBodySize int64, traceEnable bool) ([]*nsqd.Message, []*bytes.Buffer, error) {
 	numMessages, err := readLen(r, tmp)
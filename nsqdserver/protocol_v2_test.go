@@ -2451,6 +2451,127 @@ func TestTcpPub(t *testing.T) {
 	conn.Close()
 }
 
+func TestTcpPubRateLimited(t *testing.T) {
+	opts := nsqdNs.NewOptions()
+	opts.Logger = newTestLogger(t)
+	opts.PubRateLimit = 5
+	tcpAddr, _, nsqd, nsqdServer := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqdServer.Exit()
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Equal(t, err, nil)
+	defer conn.Close()
+
+	topicName := "test_tcp_pub_rate_limited" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopicIgnPart(topicName)
+	topic.GetChannel("ch")
+	identify(t, conn, nil, frameTypeResponse)
+
+	pub := func() (int32, []byte) {
+		cmd := nsq.Publish(topicName, make([]byte, 5))
+		cmd.WriteTo(conn)
+		resp, _ := nsq.ReadResponse(conn)
+		frameType, data, _ := nsq.UnpackResponse(resp)
+		return frameType, data
+	}
+	okCnt := 0
+	limitedCnt := 0
+	for i := 0; i < 20; i++ {
+		frameType, data := pub()
+		if frameType == frameTypeError {
+			test.Equal(t, "E_PUB_RATE_LIMITED topic pub rate exceeded", string(data))
+			limitedCnt++
+			continue
+		}
+		test.Equal(t, frameTypeResponse, frameType)
+		test.Equal(t, []byte("OK"), data)
+		okCnt++
+	}
+	// the burst may cross the second window
+	test.Equal(t, true, okCnt >= 5 && okCnt <= 10)
+	test.Equal(t, 20-okCnt, limitedCnt)
+
+	// the client is not closed and can retry in the next window
+	time.Sleep(time.Second)
+	frameType, data := pub()
+	test.Equal(t, frameTypeResponse, frameType)
+	test.Equal(t, []byte("OK"), data)
+
+	// the topic meta overrides the node limit
+	topic.SetDynamicInfo(nsqdNs.TopicDynamicConf{AutoCommit: 1, SyncEvery: 1, PubRateLimit: 100}, nil)
+	time.Sleep(time.Second)
+	for i := 0; i < 20; i++ {
+		frameType, data := pub()
+		test.Equal(t, frameTypeResponse, frameType)
+		test.Equal(t, []byte("OK"), data)
+	}
+}
+
+func TestTcpPubTopicMaxMsgSize(t *testing.T) {
+	opts := nsqdNs.NewOptions()
+	opts.Logger = newTestLogger(t)
+	tcpAddr, _, nsqd, nsqdServer := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqdServer.Exit()
+
+	topicName := "test_tcp_pub_topic_max_msg_size" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopicIgnPart(topicName)
+	topic.GetChannel("ch")
+	topic.SetDynamicInfo(nsqdNs.TopicDynamicConf{AutoCommit: 1, SyncEvery: 1, MaxMsgSize: 100}, nil)
+	test.Equal(t, int64(100), topic.GetMaxMsgSize())
+
+	pub := func(cmd *nsq.Command) (int32, []byte) {
+		conn, err := mustConnectNSQD(tcpAddr)
+		test.Equal(t, err, nil)
+		defer conn.Close()
+		identify(t, conn, nil, frameTypeResponse)
+		cmd.WriteTo(conn)
+		resp, _ := nsq.ReadResponse(conn)
+		frameType, data, _ := nsq.UnpackResponse(resp)
+		return frameType, data
+	}
+	frameType, data := pub(nsq.Publish(topicName, make([]byte, 100)))
+	test.Equal(t, frameTypeResponse, frameType)
+	test.Equal(t, []byte("OK"), data)
+	frameType, data = pub(nsq.Publish(topicName, make([]byte, 101)))
+	test.Equal(t, frameTypeError, frameType)
+	test.Equal(t, "E_BAD_MESSAGE message too big 101 > 100", string(data))
+	// the connection is kept after the message too big
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Equal(t, err, nil)
+	identify(t, conn, nil, frameTypeResponse)
+	nsq.Publish(topicName, make([]byte, 101)).WriteTo(conn)
+	resp, _ := nsq.ReadResponse(conn)
+	frameType, data, _ = nsq.UnpackResponse(resp)
+	test.Equal(t, frameTypeError, frameType)
+	test.Equal(t, "E_BAD_MESSAGE message too big 101 > 100", string(data))
+	nsq.Publish(topicName, make([]byte, 10)).WriteTo(conn)
+	resp, _ = nsq.ReadResponse(conn)
+	frameType, data, _ = nsq.UnpackResponse(resp)
+	test.Equal(t, frameTypeResponse, frameType)
+	test.Equal(t, []byte("OK"), data)
+	conn.Close()
+
+	cmd, _ := nsq.MultiPublish(topicName, [][]byte{make([]byte, 10), make([]byte, 101)})
+	frameType, data = pub(cmd)
+	test.Equal(t, frameTypeError, frameType)
+	test.Equal(t, "E_BAD_MESSAGE MPUB message too big 101 > 100", string(data))
+	cmd, _ = nsq.MultiPublish(topicName, [][]byte{make([]byte, 10), make([]byte, 100)})
+	frameType, data = pub(cmd)
+	test.Equal(t, frameTypeResponse, frameType)
+	test.Equal(t, []byte("OK"), data)
+	// only the valid messages are written
+	test.Equal(t, uint64(4), topic.TotalMessageCnt())
+
+	// the topic meta can not raise the node limit
+	topic.SetDynamicInfo(nsqdNs.TopicDynamicConf{AutoCommit: 1, SyncEvery: 1, MaxMsgSize: opts.MaxMsgSize * 2}, nil)
+	test.Equal(t, opts.MaxMsgSize, topic.GetMaxMsgSize())
+	frameType, data = pub(nsq.Publish(topicName, make([]byte, 101)))
+	test.Equal(t, frameTypeResponse, frameType)
+	test.Equal(t, []byte("OK"), data)
+}
+
 func TestTcpPubExtToNonExtTopic(t *testing.T) {
 	testTcpPubExtToNonExtTopic(t, true)
 }
@@ -4595,6 +4716,54 @@ func runAuthTest(t *testing.T, authResponse, authSecret, authError, authSuccess
 
 }
 
+func TestClientAuthCached(t *testing.T) {
+	authSecret := "testsecret"
+	authResponse := `{"ttl":10, "authorizations":
+		[{"topic":"test", "channels":[".*"], "permissions":["subscribe","publish"]}]
+	}`
+	authSuccess := `{"identity":"","identity_url":"","permission_count":1}`
+	var queryCnt int32
+	authd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&queryCnt, 1)
+		r.ParseForm()
+		test.Equal(t, r.Form.Get("secret"), authSecret)
+		fmt.Fprint(w, authResponse)
+	}))
+	defer authd.Close()
+
+	addr, err := url.Parse(authd.URL)
+	test.Equal(t, err, nil)
+
+	opts := nsqdNs.NewOptions()
+	opts.Logger = newTestLogger(t)
+	opts.LogLevel = 2
+	opts.AuthHTTPAddresses = []string{addr.Host}
+	opts.AuthCacheTTL = time.Second
+	tcpAddr, _, _, nsqdServer := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqdServer.Exit()
+
+	connectAndAuth := func() {
+		conn, err := mustConnectNSQD(tcpAddr)
+		test.Equal(t, err, nil)
+		defer conn.Close()
+		identify(t, conn, map[string]interface{}{
+			"tls_v1": false,
+		}, nsq.FrameTypeResponse)
+		authCmd(t, conn, authSecret, authSuccess)
+	}
+
+	connectAndAuth()
+	test.Equal(t, int32(1), atomic.LoadInt32(&queryCnt))
+	// served from the cache within the ttl
+	connectAndAuth()
+	test.Equal(t, int32(1), atomic.LoadInt32(&queryCnt))
+
+	time.Sleep(opts.AuthCacheTTL + time.Millisecond*100)
+	connectAndAuth()
+	test.Equal(t, int32(2), atomic.LoadInt32(&queryCnt))
+}
+
 func TestResetChannelToOld(t *testing.T) {
 	// test many confirmed messages and waiting inflight is empty,
 	// and while confirming message offset, the channel end is changed
@@ -4789,7 +4958,7 @@ func BenchmarkProtocolV2Exec(b *testing.B) {
 	_, _, nsqd, nsqdServer := mustStartNSQD(opts)
 	defer os.RemoveAll(opts.DataPath)
 	defer nsqdServer.Exit()
-	ctx := &context{0, nsqd, nil, nil, nil, nil, ""}
+	ctx := &context{nsqd: nsqd}
 	p := &protocolV2{ctx}
 	c := nsqdNs.NewClientV2(0, nil, ctx.getOpts(), nil)
 	params := [][]byte{[]byte("NOP")}
@@ -28,6 +28,7 @@ func (s Uint64Slice) Less(i, j int) bool {
 func (n *NsqdServer) statsdLoop() {
 	var lastMemStats runtime.MemStats
 	var lastStats []nsqd.TopicStats
+	var lastLifecycle nsqd.LifecycleStats
 	opts := n.ctx.getOpts()
 	ticker := time.NewTicker(opts.StatsdInterval)
 	for {
@@ -115,6 +116,39 @@ func (n *NsqdServer) statsdLoop() {
 					stat = fmt.Sprintf("topic.%s.channel.%s.clients", statdName, channel.ChannelName)
 					client.Gauge(stat, int64(len(channel.Clients)))
 
+					stat = fmt.Sprintf("topic.%s.channel.%s.reader_buffered_bytes", statdName, channel.ChannelName)
+					client.Gauge(stat, channel.ReaderBufferedBytes)
+
+					stat = fmt.Sprintf("topic.%s.channel.%s.confirm_latency", statdName, channel.ChannelName)
+					client.Gauge(stat, channel.ConfirmLatency)
+
+					stat = fmt.Sprintf("topic.%s.channel.%s.confirm_win_alarmed", statdName, channel.ChannelName)
+					if channel.ConfirmWinAlarmed {
+						client.Gauge(stat, 1)
+					} else {
+						client.Gauge(stat, 0)
+					}
+
+					stat = fmt.Sprintf("topic.%s.channel.%s.reader_halted", statdName, channel.ChannelName)
+					if channel.ReaderHalted {
+						client.Gauge(stat, 1)
+					} else {
+						client.Gauge(stat, 0)
+					}
+
+					for i, bucket := range channel.ReaderMsgSizes {
+						le := "inf"
+						if bucket.UpperBound >= 0 {
+							le = fmt.Sprintf("%d", bucket.UpperBound)
+						}
+						lastCnt := int64(0)
+						if i < len(lastChannel.ReaderMsgSizes) {
+							lastCnt = lastChannel.ReaderMsgSizes[i].Count
+						}
+						stat = fmt.Sprintf("topic.%s.channel.%s.reader_msg_size_le_%s", statdName, channel.ChannelName, le)
+						client.Incr(stat, bucket.Count-lastCnt)
+					}
+
 					for _, item := range channel.E2eProcessingLatency.Percentiles {
 						stat = fmt.Sprintf("topic.%s.channel.%s.e2e_processing_latency_%.0f", statdName, channel.ChannelName, item["quantile"]*100.0)
 						client.Gauge(stat, int64(item["value"]))
@@ -123,6 +157,15 @@ func (n *NsqdServer) statsdLoop() {
 			}
 			lastStats = stats
 
+			lifecycle := n.ctx.nsqd.GetLifecycleStats()
+			client.Incr("topic_created", lifecycle.TopicCreated-lastLifecycle.TopicCreated)
+			client.Incr("topic_deleted", lifecycle.TopicDeleted-lastLifecycle.TopicDeleted)
+			client.Incr("channel_created", lifecycle.ChannelCreated-lastLifecycle.ChannelCreated)
+			client.Incr("channel_deleted", lifecycle.ChannelDeleted-lastLifecycle.ChannelDeleted)
+			client.Gauge("topic_count", lifecycle.TopicCount)
+			client.Gauge("channel_count", lifecycle.ChannelCount)
+			lastLifecycle = lifecycle
+
 			if opts.StatsdMemStats {
 				var memStats runtime.MemStats
 				runtime.ReadMemStats(&memStats)
@@ -72,6 +72,36 @@ func GetValidSuggestLF(r string) (int, error) {
 	return 0, errors.New("INVALID_SUGGEST_LOADFACTOR")
 }
 
+// the pub rate limit should not be negative, and the default is used if empty
+func getValidPubRateLimit(r string, defaultLimit int64) (int64, error) {
+	if r == "" {
+		return defaultLimit, nil
+	}
+	num, err := strconv.ParseInt(r, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if num < 0 {
+		return 0, errors.New("INVALID_PUB_RATE_LIMIT")
+	}
+	return num, nil
+}
+
+// the max message size should not be negative, and the default is used if empty
+func getValidMaxMsgSize(r string, defaultSize int64) (int64, error) {
+	if r == "" {
+		return defaultSize, nil
+	}
+	num, err := strconv.ParseInt(r, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if num < 0 {
+		return 0, errors.New("INVALID_MAX_MSG_SIZE")
+	}
+	return num, nil
+}
+
 type httpServer struct {
 	ctx    *Context
 	router http.Handler
@@ -511,6 +541,22 @@ func (s *httpServer) doCreateTopic(w http.ResponseWriter, req *http.Request, ps
 	}
 	allowMultiOrdered := reqParams.Get("orderedmulti")
 	allowExt := reqParams.Get("extend")
+	backing := reqParams.Get("backing")
+	if !consistence.IsValidTopicBacking(backing) {
+		return nil, http_api.Err{400, "INVALID_ARG_TOPIC_BACKING"}
+	}
+	pubRateLimit, err := getValidPubRateLimit(reqParams.Get("pubratelimit"), 0)
+	if err != nil {
+		return nil, http_api.Err{400, "INVALID_ARG_TOPIC_PUB_RATE_LIMIT"}
+	}
+	pubBytesRateLimit, err := getValidPubRateLimit(reqParams.Get("pubbytesratelimit"), 0)
+	if err != nil {
+		return nil, http_api.Err{400, "INVALID_ARG_TOPIC_PUB_BYTES_RATE_LIMIT"}
+	}
+	maxMsgSize, err := getValidMaxMsgSize(reqParams.Get("maxmsgsize"), 0)
+	if err != nil {
+		return nil, http_api.Err{400, "INVALID_ARG_TOPIC_MAX_MSG_SIZE"}
+	}
 
 	if s.ctx.nsqlookupd.coordinator == nil {
 		return nil, http_api.Err{500, "MISSING_COORDINATOR"}
@@ -535,6 +581,10 @@ func (s *httpServer) doCreateTopic(w http.ResponseWriter, req *http.Request, ps
 	if allowExt == "true" {
 		meta.Ext = true
 	}
+	meta.Backing = backing
+	meta.PubRateLimit = pubRateLimit
+	meta.PubBytesRateLimit = pubBytesRateLimit
+	meta.MaxMsgSize = maxMsgSize
 	err = s.ctx.nsqlookupd.coordinator.CreateTopic(topicName, meta)
 	if err != nil {
 		nsqlookupLog.LogErrorf("DB: adding topic(%s) failed: %v", topicName, err)
@@ -654,9 +704,21 @@ func (s *httpServer) doChangeTopicDynamicParam(w http.ResponseWriter, req *http.
 		}
 	}
 	upgradeExtStr := reqParams.Get("upgradeext")
+	pubRateLimit, err := getValidPubRateLimit(reqParams.Get("pubratelimit"), -1)
+	if err != nil {
+		return nil, http_api.Err{400, "INVALID_ARG_TOPIC_PUB_RATE_LIMIT"}
+	}
+	pubBytesRateLimit, err := getValidPubRateLimit(reqParams.Get("pubbytesratelimit"), -1)
+	if err != nil {
+		return nil, http_api.Err{400, "INVALID_ARG_TOPIC_PUB_BYTES_RATE_LIMIT"}
+	}
+	maxMsgSize, err := getValidMaxMsgSize(reqParams.Get("maxmsgsize"), -1)
+	if err != nil {
+		return nil, http_api.Err{400, "INVALID_ARG_TOPIC_MAX_MSG_SIZE"}
+	}
 
 	err = s.ctx.nsqlookupd.coordinator.ChangeTopicMetaParam(topicName, syncEvery,
-		retentionDays, replicator, upgradeExtStr)
+		retentionDays, replicator, upgradeExtStr, pubRateLimit, pubBytesRateLimit, maxMsgSize)
 	if err != nil {
 		return nil, http_api.Err{400, err.Error()}
 	}